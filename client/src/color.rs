@@ -0,0 +1,130 @@
+//! ANSI colors for what the client prints.
+//!
+//! Each username gets the color [`common::color`] picks for it, so it is the
+//! same in every session and on every client, JSON ones included. Presence
+//! lines are dimmed, DMs stand out, and whatever the server says itself has a
+//! color no username gets.
+//! Everything stays plain with `--no-color` or when stdout is not a terminal.
+//!
+//! With `--name-width`, the name in front of each chat line is cut or padded
+//! to that many characters, so long names don't push the text about. That is
+//! only for the eye: it applies on a terminal alone, and the name on the wire
+//! is always whole.
+
+use std::{
+    io::{self, IsTerminal},
+    sync::OnceLock,
+};
+
+static ENABLED: OnceLock<bool> = OnceLock::new();
+static NAME_WIDTH: OnceLock<Option<usize>> = OnceLock::new();
+
+// the ANSI color nearest each of `common::color::USER_COLORS`, in the same order;
+// none of these is used for anything but usernames
+const USER_COLORS: [&str; 10] = ["31", "32", "33", "34", "36", "91", "92", "93", "94", "96"];
+const SYSTEM: &str = "35";
+const DIM: &str = "2";
+const DIRECT: &str = "1;95";
+
+/// Turns colors on if `wanted` and stdout is a terminal, and on a terminal
+/// fits speakers' names to `name_width` if given.
+pub fn init(wanted: bool, name_width: Option<usize>) {
+    let terminal = io::stdout().is_terminal();
+    let _ = ENABLED.set(wanted && terminal);
+    let _ = NAME_WIDTH.set(name_width.filter(|_| terminal));
+}
+
+fn enabled() -> bool {
+    ENABLED.get().copied().unwrap_or_default()
+}
+
+/// `username` in its own color.
+pub fn user(username: &str) -> String {
+    paint(enabled(), color_of(username), username)
+}
+
+/// `username` in front of a chat line: [`user`], fitted to `--name-width`.
+pub fn speaker(username: &str) -> String {
+    match NAME_WIDTH.get().copied().flatten() {
+        Some(width) => paint(enabled(), color_of(username), &fit(username, width)),
+        None => user(username),
+    }
+}
+
+/// Joins, leaves, renames and other comings and goings.
+pub fn dim(text: &str) -> String {
+    paint(enabled(), DIM, text)
+}
+
+/// The part of a private message that says who it is from or to.
+pub fn direct(text: &str) -> String {
+    paint(enabled(), DIRECT, text)
+}
+
+/// Errors, notices and anything else the server says on its own account.
+pub fn system(text: &str) -> String {
+    paint(enabled(), SYSTEM, text)
+}
+
+fn paint(enabled: bool, code: &str, text: &str) -> String {
+    if enabled {
+        format!("\x1b[{code}m{text}\x1b[0m")
+    } else {
+        text.to_string()
+    }
+}
+
+/// `name` padded to `width` characters or, if longer, cut to fit with an
+/// ellipsis in place of the last.
+fn fit(name: &str, width: usize) -> String {
+    if name.chars().count() <= width {
+        return format!("{name:<width$}");
+    }
+    let kept: String = name.chars().take(width.saturating_sub(1)).collect();
+    format!("{kept}…")
+}
+
+fn color_of(username: &str) -> &'static str {
+    USER_COLORS
+        .get(common::color::user_color_index(username))
+        .copied()
+        .unwrap_or(SYSTEM)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_color_is_stable_and_ignores_case() {
+        assert_eq!(color_of("alice"), color_of("ALICE"));
+        assert_eq!(color_of("alice"), color_of("alice"));
+        let names = ["alice", "bob", "carol", "dave", "erin", "frank"];
+        assert!(names.iter().any(|name| color_of(name) != color_of("alice")));
+    }
+
+    #[test]
+    fn test_one_ansi_color_per_user_color() {
+        assert_eq!(USER_COLORS.len(), common::color::USER_COLORS.len());
+    }
+
+    #[test]
+    fn test_system_color_is_reserved() {
+        assert!(!USER_COLORS.contains(&SYSTEM));
+        assert!(!USER_COLORS.contains(&DIRECT));
+    }
+
+    #[test]
+    fn test_fit() {
+        assert_eq!(fit("bob", 6), "bob   ");
+        assert_eq!(fit("alice", 5), "alice");
+        assert_eq!(fit("bartholomew", 6), "barth…");
+        assert_eq!(fit("élodie-ünal", 4), "élo…");
+    }
+
+    #[test]
+    fn test_paint() {
+        assert_eq!(paint(true, "32", "bob"), "\x1b[32mbob\x1b[0m");
+        assert_eq!(paint(false, "32", "bob"), "bob");
+    }
+}
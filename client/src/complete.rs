@@ -0,0 +1,273 @@
+//! Tab completion for command keywords and the usernames this client has
+//! seen, for the interactive line editor.
+//!
+//! Usernames are learned from presence events, from anyone who speaks and
+//! from `who` replies, which replace the lot. Matching ignores case; the
+//! editor cycles through several matches on repeated tabs.
+
+use std::{
+    collections::BTreeMap,
+    sync::{Arc, Mutex},
+};
+
+use common::tcp_message::ServerMessage;
+use rustyline::{
+    Context, Helper,
+    completion::{Completer, Pair},
+    highlight::Highlighter,
+    hint::Hinter,
+    validate::Validator,
+};
+
+/// Keywords as typed, and whether anything follows them.
+const COMMANDS: [(&str, bool); 36] = [
+    ("send", true),
+    ("sendid", true),
+    ("reply", true),
+    ("me", true),
+    ("edit", true),
+    ("delete", true),
+    ("away", false),
+    ("dm", true),
+    ("dm-history", true),
+    ("resync", false),
+    ("join", true),
+    ("rooms", false),
+    ("who", false),
+    ("list", false),
+    ("nick", true),
+    ("mute", true),
+    ("unmute", true),
+    ("muted", false),
+    ("quiet", false),
+    ("save", true),
+    ("sendfile", true),
+    ("savefile", true),
+    ("clear", false),
+    ("ping", false),
+    ("auth", true),
+    ("kick", true),
+    ("ban", true),
+    ("unban", true),
+    ("stats", false),
+    ("who-all", false),
+    ("conns", false),
+    ("drop", true),
+    ("broadcast", true),
+    ("room-policy", true),
+    ("help", false),
+    ("leave", false),
+];
+
+/// Commands whose first argument is a username, and whether more follows it.
+const TAKES_USERNAME: [(&str, bool); 7] = [
+    ("dm", true),
+    ("dm-history", false),
+    ("mute", false),
+    ("unmute", false),
+    ("kick", false),
+    ("ban", false),
+    ("unban", false),
+];
+
+/// Shared between the reader, which keeps it up to date, and the editor.
+#[derive(Debug, Clone, Default)]
+pub struct OnlineUsers {
+    // lowercased name to the name as shown
+    names: Arc<Mutex<BTreeMap<String, String>>>,
+}
+
+impl OnlineUsers {
+    /// Learns who is around from a server message.
+    pub fn follow(&self, msg: &ServerMessage) {
+        let Ok(mut names) = self.names.lock() else {
+            return;
+        };
+        let mut add = |username: &str| {
+            names.insert(username.to_lowercase(), username.to_string());
+        };
+        match msg {
+            ServerMessage::UserJoined { username, .. }
+            | ServerMessage::Broadcast { username, .. }
+            | ServerMessage::Edited { username, .. }
+            | ServerMessage::Action { username, .. }
+            | ServerMessage::Typing { username, .. }
+            | ServerMessage::Presence { username, .. } => add(username),
+            ServerMessage::Direct { from, to, .. } => {
+                add(from);
+                add(to);
+            }
+            ServerMessage::UserLeft { username, .. } => {
+                names.remove(&username.to_lowercase());
+            }
+            ServerMessage::Renamed { from, to, .. } => {
+                names.remove(&from.to_lowercase());
+                names.insert(to.to_lowercase(), to.clone());
+            }
+            ServerMessage::Info { text } => {
+                // a room's list adds to what was seen elsewhere rather than replacing it
+                if let Some(online) = who_list(text) {
+                    names.extend(online.map(|name| (name.to_lowercase(), name.to_string())));
+                }
+            }
+            ServerMessage::UserList { users, .. } => {
+                names.extend(users.iter().map(|name| (name.to_lowercase(), name.clone())));
+            }
+            _ => {}
+        }
+    }
+
+    fn names(&self) -> Vec<String> {
+        self.names
+            .lock()
+            .map(|names| names.values().cloned().collect())
+            .unwrap_or_default()
+    }
+}
+
+/// The names in a `who` reply, `Online in #general (2): alice, bob (away)`,
+/// or in one room's line of a `who-all` reply, `  #dev (1): carol`.
+fn who_list(text: &str) -> Option<impl Iterator<Item = &str>> {
+    let listed = text.strip_prefix("Online in ").or_else(|| text.strip_prefix("  #"))?;
+    let (_, names) = listed.split_once("): ")?;
+    Some(
+        names
+            .split(", ")
+            .map(|name| name.strip_suffix(" (away)").unwrap_or(name))
+            .filter(|name| !name.is_empty()),
+    )
+}
+
+/// The line editor's helper; only completion does anything.
+pub struct ChatHelper {
+    online: OnlineUsers,
+}
+
+impl ChatHelper {
+    pub const fn new(online: OnlineUsers) -> Self {
+        Self { online }
+    }
+}
+
+impl Completer for ChatHelper {
+    type Candidate = Pair;
+
+    fn complete(&self, line: &str, pos: usize, _ctx: &Context<'_>) -> rustyline::Result<(usize, Vec<Pair>)> {
+        Ok(completions(line.get(..pos).unwrap_or(line), &self.online.names()))
+    }
+}
+
+impl Hinter for ChatHelper {
+    type Hint = String;
+}
+
+impl Highlighter for ChatHelper {}
+
+impl Validator for ChatHelper {}
+
+impl Helper for ChatHelper {}
+
+/// Where the word being completed starts in `line`, and what it may become.
+fn completions(line: &str, names: &[String]) -> (usize, Vec<Pair>) {
+    let Some((command, rest)) = line.split_once(' ') else {
+        let candidates = COMMANDS
+            .iter()
+            .filter(|(keyword, _)| starts_with_ignoring_case(keyword, line))
+            .map(|&(keyword, more)| pair(keyword, more))
+            .collect();
+        return (0, candidates);
+    };
+    let more = TAKES_USERNAME
+        .iter()
+        .find(|(keyword, _)| command.eq_ignore_ascii_case(keyword))
+        .map(|&(_, more)| more);
+    let word = rest.trim_start();
+    // only the username itself is completed, not the message after it
+    let (Some(more), false) = (more, word.contains(' ')) else {
+        return (line.len(), Vec::new());
+    };
+    let candidates = names
+        .iter()
+        .filter(|name| starts_with_ignoring_case(name, word))
+        .map(|name| pair(name, more))
+        .collect();
+    (line.len().saturating_sub(word.len()), candidates)
+}
+
+fn starts_with_ignoring_case(candidate: &str, prefix: &str) -> bool {
+    candidate.to_lowercase().starts_with(&prefix.to_lowercase())
+}
+
+fn pair(word: &str, more: bool) -> Pair {
+    Pair {
+        display: word.to_string(),
+        replacement: if more { format!("{word} ") } else { word.to_string() },
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn replacements(line: &str, names: &[&str]) -> (usize, Vec<String>) {
+        let names: Vec<String> = names.iter().map(ToString::to_string).collect();
+        let (start, pairs) = completions(line, &names);
+        (start, pairs.into_iter().map(|pair| pair.replacement).collect())
+    }
+
+    #[test]
+    fn test_complete_commands() {
+        assert_eq!(replacements("le", &[]), (0, vec!["leave".to_string()]));
+        assert_eq!(
+            replacements("MU", &[]),
+            (0, vec!["mute ".to_string(), "muted".to_string()])
+        );
+        assert_eq!(replacements("xyz", &[]).1.len(), 0);
+    }
+
+    #[test]
+    fn test_complete_usernames_ignoring_case() {
+        let names = ["Alice", "albert", "bob"];
+        assert_eq!(
+            replacements("dm al", &names),
+            (3, vec!["Alice ".to_string(), "albert ".to_string()])
+        );
+        assert_eq!(replacements("KICK B", &names), (5, vec!["bob".to_string()]));
+        // not after commands that don't take a name, nor inside the message
+        assert!(replacements("send al", &names).1.is_empty());
+        assert!(replacements("dm bob al", &names).1.is_empty());
+    }
+
+    #[test]
+    fn test_follow_presence_and_who() {
+        let online = OnlineUsers::default();
+        let joined = |username: &str| ServerMessage::UserJoined {
+            timestamp: "2024-01-02T15:04:05Z".to_string(),
+            username: username.to_string(),
+            room: "#general".to_string(),
+        };
+        online.follow(&joined("bob"));
+        online.follow(&joined("carol"));
+        online.follow(&ServerMessage::UserLeft {
+            timestamp: "2024-01-02T15:04:05Z".to_string(),
+            username: "carol".to_string(),
+            room: "#general".to_string(),
+            disconnected: true,
+        });
+        assert_eq!(online.names(), ["bob"]);
+
+        online.follow(&ServerMessage::Info {
+            text: "Online in #general (2): Alice, dave (away)".to_string(),
+        });
+        assert_eq!(online.names(), ["Alice", "bob", "dave"]);
+        online.follow(&ServerMessage::Info {
+            text: "  #dev (1): erin".to_string(),
+        });
+        assert_eq!(online.names(), ["Alice", "bob", "dave", "erin"]);
+        online.follow(&ServerMessage::UserList {
+            room: "#dev".to_string(),
+            users: vec!["erin".to_string(), "frank".to_string()],
+        });
+        assert_eq!(online.names(), ["Alice", "bob", "dave", "erin", "frank"]);
+    }
+}
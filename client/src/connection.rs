@@ -0,0 +1,316 @@
+//! The transport under [`crate::Client`] and the CLI: connecting, with TLS
+//! if asked, joining, compressed if asked and the server agrees, and
+//! writing and reading messages in the chosen [`Protocol`].
+
+use std::{
+    io::Cursor,
+    path::{Path, PathBuf},
+};
+
+use async_compression::tokio::{bufread::DeflateDecoder, write::DeflateEncoder};
+use common::{
+    error_code::ErrorCode,
+    framing::{FrameDecoder, MAX_FRAME_LEN, encode_frame},
+    json_message::WireFormat,
+    tcp_message::{ClientMessage, ServerMessage},
+};
+use thiserror::Error;
+use tokio::{
+    io::{AsyncBufReadExt, AsyncRead, AsyncReadExt, AsyncWrite, AsyncWriteExt, BufReader},
+    net::TcpStream,
+};
+use tokio_rustls::rustls::pki_types::ServerName;
+
+use crate::tls;
+
+/// Either half of a plain TCP, Unix socket or TLS stream.
+pub type ServerWriter = Box<dyn AsyncWrite + Send + Unpin>;
+
+#[derive(Debug, Error)]
+pub enum ClientError {
+    #[error("connection failed: {0}")]
+    Connection(#[from] std::io::Error),
+
+    #[error("server error: {0}")]
+    ServerError(String),
+
+    #[error("refused ({code}): {reason}")]
+    Refused { code: ErrorCode, reason: String },
+
+    #[error("invalid TLS server name: {0}")]
+    TlsServerName(String),
+}
+
+/// What is said on the wire and how each message is delimited.
+#[derive(Debug, Clone, Copy, Default)]
+pub struct Protocol {
+    pub format: WireFormat,
+    pub framed: bool,
+}
+
+/// What the server said of itself in its `HELLO`. A server too old to send
+/// one is taken to offer nothing beyond plain chat.
+#[derive(Debug, Clone, Default, PartialEq, Eq)]
+pub struct ServerInfo {
+    /// Name and version, as `simple-chat/0.1.0`
+    pub server: Option<String>,
+    pub caps: Vec<String>,
+}
+
+impl ServerInfo {
+    /// Whether the server offers `cap`, one of the `CAP_*` names in
+    /// [`common::consts`].
+    #[must_use]
+    pub fn supports(&self, cap: &str) -> bool {
+        self.caps.iter().any(|offered| offered == cap)
+    }
+
+    const fn from_hello(server: String, caps: Vec<String>) -> Self {
+        Self {
+            server: Some(server),
+            caps,
+        }
+    }
+}
+
+/// Where to connect and who to join as.
+#[derive(Debug, Clone)]
+pub struct Options {
+    pub host: String,
+    pub port: u16,
+    /// Unix socket to connect to instead of `host:port`
+    pub unix: Option<PathBuf>,
+    pub username: String,
+    pub password: Option<String>,
+    /// Session token to resume instead of joining afresh
+    pub rejoin: Option<String>,
+    pub tls: bool,
+    /// Accept any certificate, e.g. a self-signed one; implies `tls`
+    pub tls_insecure: bool,
+    pub protocol: Protocol,
+    /// Ask for the connection to be deflate-compressed; it stays plain if
+    /// the server can't
+    pub compress: bool,
+}
+
+impl Options {
+    /// Joins `username` at `host:port` over plain TCP, in the text protocol.
+    pub fn new(host: impl Into<String>, port: u16, username: impl Into<String>) -> Self {
+        Self {
+            host: host.into(),
+            port,
+            unix: None,
+            username: username.into(),
+            password: None,
+            rejoin: None,
+            tls: false,
+            tls_insecure: false,
+            protocol: Protocol::default(),
+            compress: false,
+        }
+    }
+}
+
+/// The server's half of the connection, read a line or, with
+/// [`Protocol::framed`], a frame at a time.
+pub struct ServerReader {
+    reader: BufReader<Box<dyn AsyncRead + Send + Sync + Unpin>>,
+    frames: Option<FrameDecoder>,
+}
+
+impl ServerReader {
+    fn new(reader: Box<dyn AsyncRead + Send + Sync + Unpin>, protocol: Protocol) -> Self {
+        Self {
+            reader: BufReader::new(reader),
+            frames: protocol.framed.then(|| FrameDecoder::new(MAX_FRAME_LEN)),
+        }
+    }
+
+    /// Reads the rest of the connection as a deflate stream. Anything
+    /// already buffered is the start of it.
+    fn decompress(&mut self) {
+        let placeholder: Box<dyn AsyncRead + Send + Sync + Unpin> = Box::new(tokio::io::empty());
+        let reader = std::mem::replace(&mut self.reader, BufReader::new(placeholder));
+        let mut early = self.frames.as_mut().map(FrameDecoder::take_pending).unwrap_or_default();
+        early.extend_from_slice(reader.buffer());
+        let early = Cursor::new(early);
+        let compressed = BufReader::new(early.chain(reader.into_inner()));
+        self.reader = BufReader::new(Box::new(DeflateDecoder::new(compressed)));
+    }
+
+    /// Reads the server's `HELLO`, a text line it sends as soon as it accepts
+    /// whatever the protocol, told apart from what follows by its first
+    /// byte. An older server sends none, so this is only called once the
+    /// server has been sent something to answer.
+    async fn read_hello(&mut self) -> std::io::Result<ServerInfo> {
+        if self.reader.fill_buf().await?.first() != Some(&b'H') {
+            return Ok(ServerInfo::default());
+        }
+        let mut line = String::new();
+        self.reader.read_line(&mut line).await?;
+        Ok(match WireFormat::Text.decode_server(line.trim().as_bytes()) {
+            Ok(ServerMessage::Hello { server, caps }) => ServerInfo::from_hello(server, caps),
+            _ => ServerInfo::default(),
+        })
+    }
+
+    /// Appends the next message to `message`, returning 0 once the server has
+    /// closed the connection.
+    ///
+    /// # Errors
+    ///
+    /// Fails if the connection does, or a frame is too long.
+    pub async fn read_message(&mut self, message: &mut String) -> std::io::Result<usize> {
+        let Some(frames) = &mut self.frames else {
+            return self.reader.read_line(message).await;
+        };
+        loop {
+            match frames.next_frame().map_err(std::io::Error::other)? {
+                // an empty frame carries nothing, and 0 would read as closed
+                Some(frame) if frame.is_empty() => continue,
+                Some(frame) => {
+                    message.push_str(&String::from_utf8_lossy(&frame));
+                    return Ok(frame.len());
+                }
+                None => {}
+            }
+            let chunk = self.reader.fill_buf().await?;
+            if chunk.is_empty() {
+                return Ok(0);
+            }
+            let n = chunk.len();
+            frames.extend(chunk);
+            self.reader.consume(n);
+        }
+    }
+}
+
+/// Opens the connection `options` describe, without joining yet.
+///
+/// # Errors
+///
+/// Fails if the server can't be reached or the TLS handshake fails.
+pub async fn connect(options: &Options) -> Result<(ServerReader, ServerWriter), ClientError> {
+    if let Some(path) = &options.unix {
+        return connect_unix(path, options.protocol).await;
+    }
+    let stream = TcpStream::connect((options.host.as_str(), options.port)).await?;
+    let (reader, writer): (Box<dyn AsyncRead + Send + Sync + Unpin>, ServerWriter) =
+        if options.tls || options.tls_insecure {
+            let server_name = ServerName::try_from(options.host.clone())
+                .map_err(|_| ClientError::TlsServerName(options.host.clone()))?;
+            let stream = tls::connector(options.tls_insecure)
+                .connect(server_name, stream)
+                .await?;
+            let (reader, writer) = tokio::io::split(stream);
+            (Box::new(reader), Box::new(writer))
+        } else {
+            let (reader, writer) = stream.into_split();
+            (Box::new(reader), Box::new(writer))
+        };
+    Ok((ServerReader::new(reader, options.protocol), writer))
+}
+
+#[cfg(unix)]
+async fn connect_unix(path: &Path, protocol: Protocol) -> Result<(ServerReader, ServerWriter), ClientError> {
+    let (reader, writer) = tokio::net::UnixStream::connect(path).await?.into_split();
+    Ok((ServerReader::new(Box::new(reader), protocol), Box::new(writer)))
+}
+
+#[cfg(not(unix))]
+async fn connect_unix(path: &Path, _protocol: Protocol) -> Result<(ServerReader, ServerWriter), ClientError> {
+    Err(ClientError::Connection(std::io::Error::new(
+        std::io::ErrorKind::Unsupported,
+        format!("cannot connect to {}: no Unix sockets here", path.display()),
+    )))
+}
+
+/// Joins, or rejoins with `options.rejoin`, and waits for the server's `OK`,
+/// returning what its `HELLO` said. A session the server no longer holds,
+/// having run out or been evicted, is given up for an ordinary join under
+/// `options.username`.
+///
+/// # Errors
+///
+/// Returns the server's reason if it refuses, or what it said instead.
+pub async fn join(
+    options: &Options,
+    reader: &mut ServerReader,
+    writer: &mut ServerWriter,
+) -> Result<ServerInfo, ClientError> {
+    let fresh_join = || ClientMessage::Join {
+        username: options.username.clone(),
+        password: options.password.clone(),
+    };
+    let join_msg = options
+        .rejoin
+        .clone()
+        .map_or_else(fresh_join, |token| ClientMessage::Rejoin { token });
+    let mut rejoining = options.rejoin.is_some();
+    let first = if options.compress {
+        &ClientMessage::Compress
+    } else {
+        &join_msg
+    };
+    send(writer, options.protocol, first).await?;
+    // the `HELLO` comes ahead of the answer to whatever was sent first
+    let info = reader.read_hello().await?;
+    if options.compress {
+        compress(options, reader, writer).await?;
+        send(writer, options.protocol, &join_msg).await?;
+    }
+
+    let mut response = String::new();
+    loop {
+        response.clear();
+        reader.read_message(&mut response).await?;
+        match options.protocol.format.decode_server(response.trim().as_bytes()) {
+            Ok(ServerMessage::Ok) => return Ok(info),
+            // the connection is still open and not yet joined
+            Ok(ServerMessage::Err { code, .. }) if rejoining && code == ErrorCode::INVALID_SESSION => {
+                rejoining = false;
+                send(writer, options.protocol, &fresh_join()).await?;
+            }
+            Ok(ServerMessage::Err { code, reason }) => return Err(ClientError::Refused { code, reason }),
+            _ => return Err(ClientError::ServerError(response.trim().to_string())),
+        }
+    }
+}
+
+/// Reads the answer to a `COMPRESS` asking for the rest of the connection to
+/// be compressed, and compresses it both ways once the server says `OK`. A
+/// server that can't refuses with `ERR`, and the connection carries on
+/// uncompressed.
+async fn compress(options: &Options, reader: &mut ServerReader, writer: &mut ServerWriter) -> Result<(), ClientError> {
+    let mut response = String::new();
+    reader.read_message(&mut response).await?;
+    match options.protocol.format.decode_server(response.trim().as_bytes()) {
+        Ok(ServerMessage::Ok) => {
+            reader.decompress();
+            let placeholder: ServerWriter = Box::new(tokio::io::sink());
+            let plain = std::mem::replace(writer, placeholder);
+            *writer = Box::new(DeflateEncoder::new(plain));
+            Ok(())
+        }
+        Ok(ServerMessage::Err { .. }) => Ok(()),
+        _ => Err(ClientError::ServerError(response.trim().to_string())),
+    }
+}
+
+/// Writes a single command to the server, newline-terminated or framed.
+///
+/// # Errors
+///
+/// Fails if the connection does.
+pub async fn send(writer: &mut ServerWriter, protocol: Protocol, msg: &ClientMessage) -> std::io::Result<()> {
+    let encoded = protocol.format.encode_client(msg);
+    if protocol.framed {
+        writer
+            .write_all(&encode_frame(&encoded).map_err(std::io::Error::other)?)
+            .await?;
+    } else {
+        writer.write_all(&encoded).await?;
+        writer.write_all(b"\n").await?;
+    }
+    writer.flush().await
+}
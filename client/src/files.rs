@@ -0,0 +1,102 @@
+//! Files others shared with the room, held until the user keeps one with
+//! `savefile <name> [path]`.
+//!
+//! Only the last [`CAPACITY`] are held, in memory, and a newer file of the
+//! same name takes the place of an older one. Nothing is written to disk
+//! unless asked, and never over a file that is already there.
+
+use std::{
+    collections::VecDeque,
+    fs::OpenOptions,
+    io::{self, Write as _},
+    path::Path,
+    sync::{Arc, Mutex},
+};
+
+/// How many received files are held for a later `savefile`.
+pub const CAPACITY: usize = 20;
+
+/// Shared between the reader, which holds files as they arrive, and the
+/// input loop, which saves them.
+#[derive(Debug, Clone, Default)]
+pub struct ReceivedFiles {
+    inner: Arc<Mutex<VecDeque<(String, Vec<u8>)>>>,
+}
+
+impl ReceivedFiles {
+    /// Holds `bytes` as `name`, letting the oldest file go once there are
+    /// too many.
+    pub fn hold(&self, name: &str, bytes: Vec<u8>) {
+        let Ok(mut held) = self.inner.lock() else {
+            return;
+        };
+        held.retain(|(held_name, _)| held_name != name);
+        if held.len() >= CAPACITY {
+            held.pop_front();
+        }
+        held.push_back((name.to_string(), bytes));
+    }
+
+    /// Whether a file called `name` is held.
+    pub fn holds(&self, name: &str) -> bool {
+        self.inner
+            .lock()
+            .is_ok_and(|held| held.iter().any(|(held_name, _)| held_name == name))
+    }
+
+    /// Writes the file held as `name` to `path`, which must not exist yet.
+    /// Returns how many bytes went in.
+    ///
+    /// # Errors
+    ///
+    /// Fails if no such file is held, or `path` can't be created or written.
+    pub fn save(&self, name: &str, path: &Path) -> io::Result<usize> {
+        let bytes = self
+            .inner
+            .lock()
+            .map_err(|_| io::Error::other("received files unavailable"))?
+            .iter()
+            .find(|(held_name, _)| held_name == name)
+            .map(|(_, bytes)| bytes.clone())
+            .ok_or_else(|| io::Error::new(io::ErrorKind::NotFound, format!("nobody shared {name}")))?;
+        let mut file = OpenOptions::new().write(true).create_new(true).open(path)?;
+        file.write_all(&bytes)?;
+        Ok(bytes.len())
+    }
+}
+
+#[cfg(test)]
+#[allow(clippy::unwrap_used)]
+mod tests {
+    use std::fs;
+
+    use super::*;
+
+    #[test]
+    fn test_save_held_file() {
+        let files = ReceivedFiles::default();
+        files.hold("notes.txt", b"old".to_vec());
+        files.hold("notes.txt", b"new".to_vec());
+        assert!(files.holds("notes.txt"));
+        assert!(!files.holds("other.txt"));
+
+        let path = std::env::temp_dir().join(format!("simple-chat-file-{}", std::process::id()));
+        let _ = fs::remove_file(&path);
+        assert!(files.save("other.txt", &path).is_err());
+        assert_eq!(files.save("notes.txt", &path).unwrap(), 3);
+        assert_eq!(fs::read(&path).unwrap(), b"new");
+        // never over what is there
+        assert!(files.save("notes.txt", &path).is_err());
+        fs::remove_file(&path).unwrap();
+    }
+
+    #[test]
+    fn test_holds_the_latest() {
+        let files = ReceivedFiles::default();
+        for n in 0..=CAPACITY {
+            files.hold(&format!("{n}.txt"), Vec::new());
+        }
+        assert!(!files.holds("0.txt"));
+        assert!(files.holds(&format!("{CAPACITY}.txt")));
+    }
+}
@@ -0,0 +1,323 @@
+//! Talking to the chat server from Rust, e.g. for a bot.
+//!
+//! [`Client::connect`] joins, [`Client::on`] hands each [`Event`] that comes
+//! in to a handler, [`Client::send`] sends and [`Client::close`] leaves.
+//! Keepalive pings are answered along the way. The `client` CLI builds on
+//! [`connection`] directly, as it shows even what it can't decode.
+
+pub mod connection;
+mod tls;
+
+use std::{sync::Arc, time::Duration};
+
+use common::{
+    error_code::ErrorCode,
+    tcp_message::{ClientMessage, ServerMessage},
+};
+use connection::{ClientError, Options, Protocol, ServerInfo, ServerReader, ServerWriter};
+use tokio::{io::AsyncWriteExt, sync::Mutex, task::JoinHandle};
+
+/// How long [`Client::close`] waits for the server's goodbye.
+pub const CLOSE_TIMEOUT: Duration = Duration::from_secs(2);
+
+/// What the server tells a [`Client`], sorted out for a handler.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum Event {
+    /// Someone, maybe us, said something in the room; `id` is what an edit
+    /// or delete of it names, and `reply_to` the message it answers, if any
+    Message {
+        timestamp: String,
+        id: String,
+        from: String,
+        text: String,
+        reply_to: Option<String>,
+    },
+    /// The sender of message `id` changed its text
+    Edited {
+        timestamp: String,
+        id: String,
+        from: String,
+        text: String,
+    },
+    /// The sender of message `id` took it back
+    Deleted {
+        timestamp: String,
+        id: String,
+        from: String,
+    },
+    /// Someone emoted with `me`
+    Action {
+        timestamp: String,
+        from: String,
+        text: String,
+    },
+    /// A private message, to us or echoed back from us
+    Direct { from: String, to: String, text: String },
+    /// Someone, maybe us, came into a room
+    Joined {
+        timestamp: String,
+        username: String,
+        room: String,
+    },
+    /// Someone left a room, or their connection dropped
+    Left {
+        timestamp: String,
+        username: String,
+        room: String,
+        disconnected: bool,
+    },
+    /// The server refused what we last sent; `code` is what to go by
+    Error { code: ErrorCode, reason: String },
+    /// Anything else, as the server said it
+    Other(ServerMessage),
+    /// The connection is over; nothing follows
+    Closed,
+}
+
+impl From<ServerMessage> for Event {
+    fn from(msg: ServerMessage) -> Self {
+        match msg {
+            ServerMessage::Broadcast {
+                timestamp,
+                id,
+                username,
+                message,
+                reply_to,
+            } => Self::Message {
+                timestamp,
+                id,
+                from: username,
+                text: message,
+                reply_to,
+            },
+            ServerMessage::Edited {
+                timestamp,
+                id,
+                username,
+                message,
+            } => Self::Edited {
+                timestamp,
+                id,
+                from: username,
+                text: message,
+            },
+            ServerMessage::Deleted {
+                timestamp,
+                id,
+                username,
+            } => Self::Deleted {
+                timestamp,
+                id,
+                from: username,
+            },
+            ServerMessage::Action {
+                timestamp,
+                username,
+                text,
+            } => Self::Action {
+                timestamp,
+                from: username,
+                text,
+            },
+            ServerMessage::Direct { from, to, message } => Self::Direct {
+                from,
+                to,
+                text: message,
+            },
+            ServerMessage::UserJoined {
+                timestamp,
+                username,
+                room,
+            } => Self::Joined {
+                timestamp,
+                username,
+                room,
+            },
+            ServerMessage::UserLeft {
+                timestamp,
+                username,
+                room,
+                disconnected,
+            } => Self::Left {
+                timestamp,
+                username,
+                room,
+                disconnected,
+            },
+            ServerMessage::Err { code, reason } => Self::Error { code, reason },
+            ServerMessage::Goodbye => Self::Closed,
+            ServerMessage::Sequenced { message, .. } => Self::from(*message),
+            other => Self::Other(other),
+        }
+    }
+}
+
+/// A joined connection to the server.
+pub struct Client {
+    username: String,
+    protocol: Protocol,
+    server: ServerInfo,
+    // shared with the reader, which answers pings
+    writer: Arc<Mutex<ServerWriter>>,
+    reader: Option<ServerReader>,
+    reading: Option<JoinHandle<()>>,
+}
+
+impl Client {
+    /// Connects and joins as `options` say.
+    ///
+    /// # Errors
+    ///
+    /// Fails if the server can't be reached or refuses the join.
+    pub async fn connect(options: &Options) -> Result<Self, ClientError> {
+        let (mut reader, mut writer) = connection::connect(options).await?;
+        let server = connection::join(options, &mut reader, &mut writer).await?;
+        Ok(Self {
+            username: options.username.clone(),
+            protocol: options.protocol,
+            server,
+            writer: Arc::new(Mutex::new(writer)),
+            reader: Some(reader),
+            reading: None,
+        })
+    }
+
+    /// The name we joined as.
+    #[must_use]
+    pub fn username(&self) -> &str {
+        &self.username
+    }
+
+    /// The server's version and capabilities, as its `HELLO` gave them.
+    #[must_use]
+    pub const fn server(&self) -> &ServerInfo {
+        &self.server
+    }
+
+    /// Sends `msg` to the server.
+    ///
+    /// # Errors
+    ///
+    /// Fails if the connection does.
+    pub async fn send(&self, msg: &ClientMessage) -> std::io::Result<()> {
+        let mut writer = self.writer.lock().await;
+        connection::send(&mut writer, self.protocol, msg).await
+    }
+
+    /// Starts handing what the server says to `handler`, ending with
+    /// [`Event::Closed`]. Only the first handler is used; later calls do
+    /// nothing.
+    pub fn on(&mut self, handler: impl FnMut(Event) + Send + 'static) {
+        if let Some(reader) = self.reader.take() {
+            let writer = Arc::clone(&self.writer);
+            self.reading = Some(tokio::spawn(read_events(reader, writer, self.protocol, handler)));
+        }
+    }
+
+    /// Leaves, waiting up to [`CLOSE_TIMEOUT`] for the handler to see the
+    /// server's goodbye, and closes the connection.
+    ///
+    /// # Errors
+    ///
+    /// Fails if `LEAVE` can't be sent.
+    pub async fn close(self) -> std::io::Result<()> {
+        self.send(&ClientMessage::Leave).await?;
+        if let Some(mut reading) = self.reading
+            && tokio::time::timeout(CLOSE_TIMEOUT, &mut reading).await.is_err()
+        {
+            reading.abort();
+        }
+        // the server may have hung up already, which is just as good
+        let _ = self.writer.lock().await.shutdown().await;
+        Ok(())
+    }
+}
+
+async fn read_events(
+    mut reader: ServerReader,
+    writer: Arc<Mutex<ServerWriter>>,
+    protocol: Protocol,
+    mut handler: impl FnMut(Event),
+) {
+    let mut line = String::new();
+    loop {
+        line.clear();
+        match reader.read_message(&mut line).await {
+            Ok(0) | Err(_) => break,
+            Ok(_) => {}
+        }
+        let Ok(msg) = protocol.format.decode_server(line.trim().as_bytes()) else {
+            continue;
+        };
+        if matches!(msg, ServerMessage::Ping) {
+            let mut writer = writer.lock().await;
+            if connection::send(&mut writer, protocol, &ClientMessage::Pong)
+                .await
+                .is_err()
+            {
+                break;
+            }
+            continue;
+        }
+        let event = Event::from(msg);
+        if event == Event::Closed {
+            break;
+        }
+        handler(event);
+    }
+    handler(Event::Closed);
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_event_from_server_message() {
+        let said = ServerMessage::Broadcast {
+            timestamp: "2024-01-02T15:04:05Z".to_string(),
+            id: "7".to_string(),
+            username: "bob".to_string(),
+            message: "hi".to_string(),
+            reply_to: Some("3".to_string()),
+        };
+        assert_eq!(
+            Event::from(said),
+            Event::Message {
+                timestamp: "2024-01-02T15:04:05Z".to_string(),
+                id: "7".to_string(),
+                from: "bob".to_string(),
+                text: "hi".to_string(),
+                reply_to: Some("3".to_string()),
+            }
+        );
+        let deleted = ServerMessage::Deleted {
+            timestamp: "2024-01-02T15:04:09Z".to_string(),
+            id: "7".to_string(),
+            username: "bob".to_string(),
+        };
+        assert_eq!(
+            Event::from(deleted),
+            Event::Deleted {
+                timestamp: "2024-01-02T15:04:09Z".to_string(),
+                id: "7".to_string(),
+                from: "bob".to_string(),
+            }
+        );
+        assert_eq!(
+            Event::from(ServerMessage::Err {
+                code: ErrorCode::NAME_TAKEN,
+                reason: "name taken".to_string()
+            }),
+            Event::Error {
+                code: ErrorCode::NAME_TAKEN,
+                reason: "name taken".to_string()
+            }
+        );
+        assert_eq!(Event::from(ServerMessage::Goodbye), Event::Closed);
+        let info = ServerMessage::Info {
+            text: "Online in #general (1): bob".to_string(),
+        };
+        assert_eq!(Event::from(info.clone()), Event::Other(info));
+    }
+}
@@ -0,0 +1,227 @@
+//! `--clients N`: many virtual users in one process, for load testing.
+//!
+//! Each user is a [`Client`] of its own, joined as `<username>-<i>`, that
+//! sends a made-up line every so often until the run is over and then
+//! leaves. Counts are kept across all of them and reported at the end, so
+//! one command stands in for a shell loop starting clients by the hundred.
+
+use std::{
+    fmt,
+    sync::{
+        Arc, Mutex,
+        atomic::{AtomicU64, Ordering},
+    },
+    time::{Duration, Instant, SystemTime, UNIX_EPOCH},
+};
+
+use client::{Client, Event, connection::Options};
+use common::tcp_message::ClientMessage;
+use tokio::{task::JoinSet, time::MissedTickBehavior};
+
+/// What the generated lines are made of.
+const WORDS: [&str; 16] = [
+    "hello", "load", "test", "chat", "message", "server", "quick", "brown", "fox", "lazy", "dog", "ping", "room",
+    "random", "words", "again",
+];
+/// How many words a generated line has, at most.
+const MAX_WORDS: u64 = 8;
+
+/// How hard to push the server.
+#[derive(Debug, Clone, Copy)]
+pub struct Load {
+    /// Virtual users to join
+    pub clients: u32,
+    /// Lines each of them sends per second
+    pub rate: u32,
+    /// How long they keep sending
+    pub duration: Duration,
+}
+
+/// What all the virtual users saw, added up.
+#[derive(Debug)]
+pub struct Report {
+    counts: Arc<Counts>,
+    elapsed: Duration,
+}
+
+#[derive(Debug, Default)]
+struct Counts {
+    joined: AtomicU64,
+    join_failed: AtomicU64,
+    sent: AtomicU64,
+    received: AtomicU64,
+    // `ERR` replies, and sends that failed outright
+    errors: AtomicU64,
+    // connections the server closed before the run was over
+    dropped: AtomicU64,
+    // why the first user who couldn't join couldn't
+    join_error: Mutex<Option<String>>,
+}
+
+impl Report {
+    /// Whether any virtual user got in at all.
+    pub fn any_joined(&self) -> bool {
+        self.counts.joined.load(Ordering::Relaxed) > 0
+    }
+}
+
+impl fmt::Display for Report {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        let counts = &self.counts;
+        let sent = counts.sent.load(Ordering::Relaxed);
+        let received = counts.received.load(Ordering::Relaxed);
+        writeln!(
+            f,
+            "clients: {} joined, {} failed to join, {} dropped",
+            counts.joined.load(Ordering::Relaxed),
+            counts.join_failed.load(Ordering::Relaxed),
+            counts.dropped.load(Ordering::Relaxed)
+        )?;
+        if let Some(e) = counts.join_error.lock().ok().and_then(|e| e.clone()) {
+            writeln!(f, "first join error: {e}")?;
+        }
+        writeln!(f, "elapsed: {}ms", self.elapsed.as_millis())?;
+        writeln!(f, "sent: {sent} ({}/s)", per_second(sent, self.elapsed))?;
+        writeln!(f, "received: {received} ({}/s)", per_second(received, self.elapsed))?;
+        write!(f, "errors: {}", counts.errors.load(Ordering::Relaxed))
+    }
+}
+
+/// Joins `load.clients` users named after `options.username`, has them send
+/// for `load.duration`, and tells what happened.
+pub async fn run(options: &Options, load: Load) -> Report {
+    let counts = Arc::new(Counts::default());
+    let start = Instant::now();
+    let mut users = JoinSet::new();
+    for i in 1..=load.clients {
+        let mut options = options.clone();
+        options.username = username(&options.username, i);
+        users.spawn(virtual_user(options, load, Arc::clone(&counts), seed(i)));
+    }
+    while users.join_next().await.is_some() {}
+    Report {
+        counts,
+        elapsed: start.elapsed(),
+    }
+}
+
+/// The name virtual user `i` joins as.
+pub fn username(prefix: &str, i: u32) -> String {
+    format!("{prefix}-{i}")
+}
+
+async fn virtual_user(options: Options, load: Load, counts: Arc<Counts>, mut seed: u64) {
+    let mut client = match Client::connect(&options).await {
+        Ok(client) => client,
+        Err(e) => {
+            counts.join_failed.fetch_add(1, Ordering::Relaxed);
+            if let Ok(mut first) = counts.join_error.lock() {
+                first.get_or_insert_with(|| e.to_string());
+            }
+            return;
+        }
+    };
+    counts.joined.fetch_add(1, Ordering::Relaxed);
+
+    let (closed_tx, mut closed_rx) = tokio::sync::watch::channel(false);
+    let seen = Arc::clone(&counts);
+    client.on(move |event| match event {
+        Event::Message { .. } => {
+            seen.received.fetch_add(1, Ordering::Relaxed);
+        }
+        Event::Error { .. } => {
+            seen.errors.fetch_add(1, Ordering::Relaxed);
+        }
+        Event::Closed => {
+            let _ = closed_tx.send(true);
+        }
+        _ => {}
+    });
+
+    let every = Duration::from_secs(1)
+        .checked_div(load.rate)
+        .unwrap_or(Duration::from_secs(1));
+    let mut ticks = tokio::time::interval(every);
+    ticks.set_missed_tick_behavior(MissedTickBehavior::Delay);
+    let over = tokio::time::sleep(load.duration);
+    tokio::pin!(over);
+    loop {
+        tokio::select! {
+            () = &mut over => break,
+            _ = closed_rx.changed() => {
+                counts.dropped.fetch_add(1, Ordering::Relaxed);
+                return;
+            }
+            _ = ticks.tick() => {
+                let line = ClientMessage::Send { id: None, message: random_line(&mut seed) };
+                if client.send(&line).await.is_err() {
+                    counts.errors.fetch_add(1, Ordering::Relaxed);
+                    return;
+                }
+                counts.sent.fetch_add(1, Ordering::Relaxed);
+            }
+        }
+    }
+    if client.close().await.is_err() {
+        counts.errors.fetch_add(1, Ordering::Relaxed);
+    }
+}
+
+/// A starting point for user `i`'s lines, different on every run.
+fn seed(i: u32) -> u64 {
+    let nanos = SystemTime::now()
+        .duration_since(UNIX_EPOCH)
+        .map(|since| u64::from(since.subsec_nanos()))
+        .unwrap_or_default();
+    // xorshift never leaves zero, so keep a bit set
+    (nanos ^ u64::from(i).rotate_left(32)) | 1
+}
+
+/// xorshift64: plenty random for made-up chat, and no dependency.
+const fn next(seed: &mut u64) -> u64 {
+    *seed ^= seed.wrapping_shl(13);
+    *seed ^= seed.wrapping_shr(7);
+    *seed ^= seed.wrapping_shl(17);
+    *seed
+}
+
+fn random_line(seed: &mut u64) -> String {
+    let count = next(seed).checked_rem(MAX_WORDS).unwrap_or_default().saturating_add(1);
+    let words = u64::try_from(WORDS.len()).unwrap_or(u64::MAX);
+    (0..count)
+        .filter_map(|_| {
+            let pick = usize::try_from(next(seed).checked_rem(words).unwrap_or_default()).ok()?;
+            WORDS.get(pick).copied()
+        })
+        .collect::<Vec<_>>()
+        .join(" ")
+}
+
+/// `count` over `elapsed`, per whole second.
+fn per_second(count: u64, elapsed: Duration) -> u64 {
+    let millis = u64::try_from(elapsed.as_millis()).unwrap_or(u64::MAX);
+    count.saturating_mul(1000).checked_div(millis).unwrap_or(count)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_random_line() {
+        let mut seed = seed(1);
+        for _ in 0..100 {
+            let line = random_line(&mut seed);
+            let count = line.split(' ').count();
+            assert!((1..=8).contains(&count), "{line}");
+            assert!(line.split(' ').all(|word| WORDS.contains(&word)), "{line}");
+        }
+    }
+
+    #[test]
+    fn test_per_second() {
+        assert_eq!(per_second(500, Duration::from_secs(2)), 250);
+        assert_eq!(per_second(3, Duration::from_millis(1500)), 2);
+        assert_eq!(per_second(7, Duration::ZERO), 7);
+    }
+}
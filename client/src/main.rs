@@ -1,223 +1,1119 @@
+mod color;
+mod complete;
+mod files;
+mod load;
+mod mute;
+mod probe;
+mod screen;
+mod script;
+mod stamp;
+mod transcript;
+
 use std::{
+    env, fs,
+    io::{self, IsTerminal},
+    path::{Path, PathBuf},
     process::ExitCode,
     sync::{
-        Arc,
+        Arc, Mutex,
         atomic::{AtomicBool, Ordering},
     },
+    thread::JoinHandle,
+    time::{Duration, Instant},
 };
 
 use clap::Parser;
+use client::connection::{self, ClientError, Options, Protocol, ServerInfo, ServerReader, ServerWriter};
 use common::{
-    consts,
-    tcp_message::{ClientMessage, ServerMessage, WireDecode, WireEncode},
+    config, consts,
+    error_code::ErrorCode,
+    file,
+    json_message::WireFormat,
+    tcp_message::{ClientMessage, ServerMessage, ServerParseError},
+    username::normalized_username,
 };
-use rustyline::{DefaultEditor, error::ReadlineError};
-use thiserror::Error;
-use tokio::{
-    io::{AsyncBufReadExt, AsyncWriteExt, BufReader},
-    net::TcpStream,
-    sync::mpsc,
+use rustyline::{
+    Cmd, ConditionalEventHandler, Editor, Event, EventContext, EventHandler, RepeatCount, error::ReadlineError,
+    history::DefaultHistory,
 };
+use tokio::sync::mpsc;
 use tracing::{error, info, warn};
 
+use crate::{
+    complete::{ChatHelper, OnlineUsers},
+    files::ReceivedFiles,
+    mute::MuteList,
+    probe::{PING_TIMEOUT, Probes},
+    screen::{ConnectionState, StatusLine},
+    script::Step,
+    stamp::Stamps,
+    transcript::Transcript,
+};
+
+/// How long `--reconnect` waits before its first attempt; each failure doubles it.
+const RECONNECT_FIRST_DELAY: Duration = Duration::from_millis(500);
+/// The longest `--reconnect` waits between attempts.
+const RECONNECT_MAX_DELAY: Duration = Duration::from_secs(30);
+/// How long `leave` waits for the server's goodbye before exiting anyway.
+const LEAVE_TIMEOUT: Duration = Duration::from_secs(2);
+/// Where input history is kept between runs, in the user's home directory.
+const HISTORY_FILE_NAME: &str = ".simple-chat-history";
+/// What the line printed on joining starts with, ahead of the username.
+const JOINED_PREFIX: &str = "OK JOINED ";
+
+// each bool is a command-line switch
+#[allow(clippy::struct_excessive_bools)]
 #[derive(Parser, Debug)]
 #[command(author, version, about = "Chat client CLI")]
 struct Args {
+    /// Server address; a flag wins over `CHAT_HOST`, which wins over the default
     #[arg(long, env = consts::ENV_CHAT_HOST, default_value = "127.0.0.1")]
     host: String,
 
+    /// Server port; a flag wins over `CHAT_PORT`, which wins over the default
     #[arg(long, env = consts::ENV_CHAT_PORT, default_value = "8080")]
     port: u16,
 
-    #[arg(long, env = consts::ENV_CHAT_USERNAME,)]
+    /// Connect to the server's Unix socket at this path instead of --host and --port
+    #[arg(long, value_name = "PATH", conflicts_with_all = ["tls", "tls_insecure"])]
+    unix: Option<PathBuf>,
+
+    /// Name to join as; a flag wins over `CHAT_USERNAME`
+    #[arg(long, env = consts::ENV_CHAT_USERNAME)]
     username: String,
-}
 
-#[derive(Debug, Error)]
-pub enum ClientError {
-    #[error("connection failed: {0}")]
-    Connection(#[from] std::io::Error),
+    /// Only needed when the server sets `CHAT_PASSWORD`
+    #[arg(long, env = consts::ENV_CHAT_PASSWORD, hide_env_values = true)]
+    password: Option<String>,
+
+    /// Connect over TLS
+    #[arg(long)]
+    tls: bool,
+
+    /// Connect over TLS without verifying the server certificate (for self-signed certs; implies --tls)
+    #[arg(long)]
+    tls_insecure: bool,
+
+    /// Speak the JSON protocol instead of the default text one
+    #[arg(long)]
+    json: bool,
+
+    /// Send each message with a 4-byte length prefix instead of a trailing newline
+    #[arg(long)]
+    framed: bool,
+
+    /// Ask the server to deflate-compress the connection, e.g. on a slow link; stays plain if it can't
+    #[arg(long)]
+    compress: bool,
+
+    /// Resume a dropped session with the token the server printed when it dropped
+    #[arg(long, value_name = "TOKEN")]
+    rejoin: Option<String>,
+
+    /// When the connection drops, connect and join again instead of exiting
+    #[arg(long)]
+    reconnect: bool,
+
+    /// How many times `--reconnect` tries before giving up
+    #[arg(long, value_name = "N", default_value_t = 10)]
+    reconnect_attempts: u32,
+
+    /// Never color the output; it is plain anyway when stdout isn't a terminal
+    #[arg(long)]
+    no_color: bool,
+
+    /// Cut or pad the name in front of each chat line to this many characters, ending a cut one with `…`; only at a terminal
+    #[arg(long, value_name = "N", value_parser = clap::value_parser!(u16).range(2..))]
+    name_width: Option<u16>,
+
+    /// Show when each message arrived; toggle with `ts on` and `ts off`
+    #[arg(long)]
+    timestamps: bool,
+
+    /// strftime-style format for `--timestamps`
+    #[arg(long, value_name = "FORMAT", default_value = "%H:%M:%S")]
+    timestamp_format: String,
 
-    #[error("server error: {0}")]
-    ServerError(String),
+    /// Run the commands in this file, one per line, then leave; fails if the server refuses any
+    #[arg(long, value_name = "FILE")]
+    script: Option<PathBuf>,
 
-    #[error("readline error: {0}")]
-    Readline(#[from] ReadlineError),
+    /// On joining, print a welcome listing the commands instead of the `OK JOINED <username>` line
+    #[arg(long)]
+    welcome: bool,
+
+    /// Keep a line at the bottom of the terminal showing your name, room and connection
+    #[arg(long)]
+    status_line: bool,
+
+    /// Load test: join N virtual users, named <username>-1 to <username>-N, that send random lines
+    #[arg(
+        long,
+        value_name = "N",
+        value_parser = clap::value_parser!(u32).range(1..),
+        conflicts_with_all = ["rejoin", "reconnect", "script", "welcome", "status_line"]
+    )]
+    clients: Option<u32>,
+
+    /// Lines each `--clients` user sends per second
+    #[arg(long, value_name = "N", default_value_t = 1, value_parser = clap::value_parser!(u32).range(1..), requires = "clients")]
+    rate: u32,
+
+    /// Seconds the `--clients` users keep sending before they leave and the totals are printed
+    #[arg(long, value_name = "SECS", default_value_t = 10, requires = "clients")]
+    duration: u64,
 }
 
 struct DisconnectedClient {
-    host: String,
-    port: u16,
-    username: String,
+    options: Options,
+    // attempts allowed after a drop; `None` without `--reconnect`
+    reconnect_attempts: Option<u32>,
 }
 
 struct ConnectedClient {
-    username: String,
-    reader: BufReader<tokio::net::tcp::OwnedReadHalf>,
-    writer: tokio::net::tcp::OwnedWriteHalf,
+    options: Options,
+    reconnect: bool,
+    reader: ServerReader,
+    writer: ServerWriter,
 }
 
+#[derive(Clone)]
 struct JoinedClient {
     username: String,
+    protocol: Protocol,
+    reconnect: bool,
+    server: ServerInfo,
+    // the room we were last seen in, if any
+    room: Option<String>,
+    // joined afresh after a drop, so `room` has to be joined again
+    restore_room: bool,
+}
+
+/// How a joined session came to an end.
+enum Ended {
+    /// We left, or the connection is gone and we are not coming back.
+    Done,
+    /// We left on CTRL+C or SIGTERM, with the line editor still waiting on
+    /// a line that will never come.
+    Interrupted,
+    /// The connection dropped and `--reconnect` may take it up again, under
+    /// `username` (which may have changed since joining) and with `token` if
+    /// the server can still resume the session, and `room` the last room we
+    /// were seen in.
+    Dropped {
+        username: String,
+        token: Option<String>,
+        room: Option<String>,
+    },
+}
+
+/// The user's side of the client, which outlives any one connection: the
+/// line editor, or the script standing in for it, and what it and the reader
+/// hand to whichever writer is current.
+struct Console {
+    cmd_rx: mpsc::Receiver<String>,
+    // protocol replies (e.g. PONG) the reader needs written, kept apart from user input
+    reply_rx: mpsc::Receiver<ClientMessage>,
+    // CTRL+C or SIGTERM, for the session to leave cleanly rather than just die
+    signals: mpsc::Receiver<()>,
+    shared: Shared,
+    input: JoinHandle<()>,
+}
+
+/// What the console shares with the reader of each connection.
+#[derive(Clone)]
+struct Shared {
+    reply_tx: mpsc::Sender<ClientMessage>,
     shutdown: Arc<AtomicBool>,
+    peers: Peers,
+    stamps: Stamps,
+    probes: Probes,
+    transcript: Transcript,
+    // what others shared, for `savefile`
+    files: ReceivedFiles,
+    // set by `quiet`, to hide joins and leaves
+    quiet: Arc<AtomicBool>,
+    // set once the server answers anything with `ERR`, for `--script` to fail on
+    refused: Arc<AtomicBool>,
+    status: StatusLine,
 }
 
-impl DisconnectedClient {
-    fn new(args: Args) -> Self {
+/// What the client keeps track of about other users on its own.
+#[derive(Debug, Clone, Default)]
+struct Peers {
+    muted: MuteList,
+    online: OnlineUsers,
+}
+
+impl Console {
+    /// Reads commands from the terminal, or from `script` if there is one.
+    fn start(stamps: Stamps, script: Option<Vec<Step>>, status: StatusLine) -> Self {
+        let (cmd_tx, cmd_rx) = mpsc::channel::<String>(32);
+        let (reply_tx, reply_rx) = mpsc::channel::<ClientMessage>(8);
+        let (signal_tx, signals) = mpsc::channel::<()>(1);
+        tokio::spawn(forward_signals(signal_tx));
+        let shutdown = Arc::new(AtomicBool::new(false));
+        let shutdown_clone = Arc::clone(&shutdown);
+        let peers = Peers::default();
+        let input = if let Some(steps) = script {
+            std::thread::spawn(move || script::run(&steps, &cmd_tx, &shutdown_clone))
+        } else {
+            let typing = TypingNotifier::new(reply_tx.clone());
+            let history = history_file();
+            let helper = ChatHelper::new(peers.online.clone());
+            std::thread::spawn(move || {
+                read_joined_user_input(&cmd_tx, &shutdown_clone, typing, helper, history.as_deref());
+            })
+        };
         Self {
-            host: args.host,
-            port: args.port,
-            username: args.username,
+            cmd_rx,
+            reply_rx,
+            signals,
+            shared: Shared {
+                reply_tx,
+                shutdown,
+                peers,
+                stamps,
+                probes: Probes::default(),
+                transcript: Transcript::default(),
+                files: ReceivedFiles::default(),
+                quiet: Arc::new(AtomicBool::new(false)),
+                refused: Arc::new(AtomicBool::new(false)),
+                status,
+            },
+            input,
         }
     }
 
-    async fn connect(self) -> Result<ConnectedClient, ClientError> {
-        let addr = format!("{}:{}", self.host, self.port);
-        println!("Connecting to {addr}...");
+    /// Waits for the line editor, or the script, to notice the client is done.
+    fn close(self) {
+        self.shared.shutdown.store(true, Ordering::SeqCst);
+        let _ = self.input.join();
+        self.shared.status.stop();
+    }
 
-        let stream = TcpStream::connect(&addr).await?;
-        println!("Connected!");
+    /// Like [`Console::close`], but without waiting for the line editor,
+    /// which may be blocked on a line nobody is going to type.
+    fn abandon(self) {
+        self.shared.shutdown.store(true, Ordering::SeqCst);
+        self.shared.status.stop();
+    }
+}
 
-        let (reader, writer) = stream.into_split();
-        let reader = BufReader::new(reader);
+impl DisconnectedClient {
+    fn new(args: Args) -> Self {
+        Self {
+            options: Options {
+                host: config::unbracket(&args.host).to_string(),
+                port: args.port,
+                unix: args.unix,
+                username: args.username,
+                password: args.password,
+                rejoin: args.rejoin,
+                tls: args.tls || args.tls_insecure,
+                tls_insecure: args.tls_insecure,
+                protocol: Protocol {
+                    format: if args.json { WireFormat::Json } else { WireFormat::Text },
+                    framed: args.framed,
+                },
+                compress: args.compress,
+            },
+            reconnect_attempts: args.reconnect.then_some(args.reconnect_attempts),
+        }
+    }
 
+    async fn connect(&self) -> Result<ConnectedClient, ClientError> {
+        match &self.options.unix {
+            Some(path) => println!("Connecting to {}...", path.display()),
+            None => println!("Connecting to {}:{}...", self.options.host, self.options.port),
+        }
+        let (reader, writer) = connection::connect(&self.options).await?;
+        println!("Connected!{}", if self.options.tls { " (TLS)" } else { "" });
         Ok(ConnectedClient {
-            username: self.username,
+            options: self.options.clone(),
+            reconnect: self.reconnect_attempts.is_some(),
             reader,
             writer,
         })
     }
+
+    /// Connects and joins again after a drop, waiting longer after each
+    /// failed attempt. Gives up with `None` once the attempts run out.
+    async fn reconnect(&mut self, attempts: u32) -> Option<(JoinedClient, ServerReader, ServerWriter)> {
+        let mut delay = RECONNECT_FIRST_DELAY;
+        for attempt in 1..=attempts {
+            println!("Reconnecting... (attempt {attempt}/{attempts})");
+            tokio::time::sleep(delay).await;
+            delay = delay.saturating_mul(2).min(RECONNECT_MAX_DELAY);
+            let connected = match self.connect().await {
+                Ok(connected) => connected,
+                Err(e) => {
+                    eprintln!("Connection error: {e}");
+                    continue;
+                }
+            };
+            match connected.join().await {
+                Ok(joined) => {
+                    println!("Reconnected");
+                    return Some(joined);
+                }
+                Err(e) => {
+                    eprintln!("Join error: {e}");
+                    // the session is gone for good; join afresh under the same name
+                    self.options.rejoin = None;
+                }
+            }
+        }
+        None
+    }
 }
 
 impl ConnectedClient {
-    async fn join(
-        mut self,
-    ) -> Result<
-        (
-            JoinedClient,
-            BufReader<tokio::net::tcp::OwnedReadHalf>,
-            tokio::net::tcp::OwnedWriteHalf,
-        ),
-        ClientError,
-    > {
-        let join_msg = ClientMessage::Join {
-            username: self.username.clone(),
+    async fn join(mut self) -> Result<(JoinedClient, ServerReader, ServerWriter), ClientError> {
+        let server = connection::join(&self.options, &mut self.reader, &mut self.writer).await?;
+        let joined = JoinedClient {
+            username: self.options.username,
+            protocol: self.options.protocol,
+            reconnect: self.reconnect,
+            server,
+            room: None,
+            restore_room: false,
         };
-        let encoded = join_msg.encode();
-        self.writer.write_all(&encoded).await?;
-        self.writer.write_all(b"\n").await?;
-        self.writer.flush().await?;
-
-        let mut response = String::new();
-        self.reader.read_line(&mut response).await?;
+        Ok((joined, self.reader, self.writer))
+    }
+}
 
-        // Parse response using new wire protocol
-        match ServerMessage::decode(response.trim().as_bytes()) {
-            Ok(ServerMessage::Ok) => {}
-            Ok(ServerMessage::Err { reason }) => {
-                return Err(ClientError::ServerError(reason));
-            }
-            _ => {
-                return Err(ClientError::ServerError(response.trim().to_string()));
-            }
+impl JoinedClient {
+    /// The line scripts can wait for once joined, whatever the wording
+    /// elsewhere: `OK JOINED <username>`, or with `--json` an object shaped
+    /// like the server's own JSON events. A valid username needs no escaping.
+    fn print_joined(&self) {
+        match self.protocol.format {
+            WireFormat::Text => println!("{JOINED_PREFIX}{}", self.username),
+            WireFormat::Json => println!(r#"{{"type":"joined","username":"{}"}}"#, self.username),
         }
+    }
 
+    fn print_commands(&self) {
+        // an older server has only the one room, so don't offer to change it
+        let rooms = if self.server.supports(consts::CAP_ROOMS) {
+            "join #room, rooms, "
+        } else {
+            ""
+        };
+        let files = if self.server.supports(consts::CAP_FILES) {
+            "sendfile <path>, savefile <name> [path], "
+        } else {
+            ""
+        };
         println!(
-            "Joined as '{}'. Type 'send <message>' or 'leave' to exit.",
-            self.username
+            concat!(
+                "Joined as '{}'. Commands: send <message>, reply <id> <message>, me <action>, edit <id> <message>, delete <id>, ",
+                "away [message], dm <username> <message>, dm-history <username>, resync [number], {}who, nick <newname>, mute <username>, unmute <username>, muted, quiet, ping, save <path>, {}help, leave."
+            ),
+            self.username, rooms, files
         );
         println!("Use arrow keys for history navigation.\n");
-
-        let joined = JoinedClient {
-            username: self.username,
-            shutdown: Arc::new(AtomicBool::new(false)),
-        };
-
-        Ok((joined, self.reader, self.writer))
     }
-}
 
-impl JoinedClient {
     async fn run(
         self,
-        reader: BufReader<tokio::net::tcp::OwnedReadHalf>,
-        mut writer: tokio::net::tcp::OwnedWriteHalf,
-    ) -> Result<(), ClientError> {
-        let (cmd_tx, mut cmd_rx) = mpsc::channel::<String>(32);
-        let shutdown_clone = Arc::clone(&self.shutdown);
-        let reader_handle = tokio::spawn(async move {
-            read_server_messages(&self.username, reader, shutdown_clone).await;
-        });
-        let shutdown_clone = Arc::clone(&self.shutdown);
-        let readline_handle = std::thread::spawn(move || {
-            read_joined_user_input(&cmd_tx, &shutdown_clone);
-        });
-        while let Some(input) = cmd_rx.recv().await {
-            if self.shutdown.load(Ordering::SeqCst) {
+        reader: ServerReader,
+        mut writer: ServerWriter,
+        console: &mut Console,
+    ) -> Result<Ended, ClientError> {
+        // whatever was queued for a previous connection means nothing to this one
+        while console.reply_rx.try_recv().is_ok() {}
+        let (joined, shared) = (self.clone(), console.shared.clone());
+        let mut reader_handle = tokio::spawn(async move { read_server_messages(joined, reader, shared).await });
+        loop {
+            let input = tokio::select! {
+                ended = &mut reader_handle => return Ok(ended.unwrap_or(Ended::Done)),
+                Some(()) = console.signals.recv() => {
+                    println!();
+                    self.leave(&mut writer, console, &mut reader_handle).await?;
+                    return Ok(Ended::Interrupted);
+                }
+                Some(reply) = console.reply_rx.recv() => {
+                    if let Err(e) = connection::send(&mut writer, self.protocol, &reply).await {
+                        eprintln!("Failed to send: {e}");
+                    }
+                    continue;
+                }
+                input = console.cmd_rx.recv() => match input {
+                    Some(input) => input,
+                    None => break,
+                },
+            };
+            if console.shared.shutdown.load(Ordering::SeqCst) {
                 break;
             }
+            // `/clear` too, like `/ts` and `/save`
             let trimmed = input.trim();
-            if trimmed.eq_ignore_ascii_case(consts::CLIENT_LEAVE_CMD) {
-                let encoded = ClientMessage::Leave.encode();
-                writer.write_all(&encoded).await?;
-                writer.write_all(b"\n").await?;
-                writer.flush().await?;
-                println!("Goodbye!");
-                break;
-            } else if let Some(msg) = trimmed
-                .strip_prefix(consts::CLIENT_SEND_PREFIX.to_ascii_lowercase().as_str())
-                .or_else(|| trimmed.strip_prefix(consts::CLIENT_SEND_PREFIX))
+            if trimmed
+                .strip_prefix('/')
+                .unwrap_or(trimmed)
+                .eq_ignore_ascii_case(consts::CLIENT_CLEAR_CMD)
             {
-                let send_msg = ClientMessage::Send {
-                    message: msg.to_string(),
+                screen::clear(&console.shared.status);
+                continue;
+            }
+            if let Some(note) = local_command(input.trim(), &console.shared) {
+                println!("{note}");
+                continue;
+            }
+            if let Some(path) = strip_command(input.trim(), consts::CLIENT_SENDFILE_PREFIX).map(str::trim) {
+                let shared = if self.server.supports(consts::CAP_FILES) {
+                    file_to_share(Path::new(path))
+                } else {
+                    Err("This server doesn't take files.".to_string())
                 };
-                let encoded = send_msg.encode();
-                if let Err(e) = writer.write_all(&encoded).await {
+                match shared {
+                    Ok(msg) => {
+                        if let Err(e) = connection::send(&mut writer, self.protocol, &msg).await {
+                            eprintln!("Failed to send: {e}");
+                        }
+                    }
+                    Err(note) => println!("{note}"),
+                }
+                continue;
+            }
+            if input.trim().eq_ignore_ascii_case(consts::CLIENT_PING_PREFIX) {
+                if let Err(e) = send_ping(&mut writer, self.protocol, console).await {
                     eprintln!("Failed to send: {e}");
-                    break;
                 }
-                let _ = writer.write_all(b"\n").await;
-                let _ = writer.flush().await;
-            } else {
-                println!("Unknown command. Use 'send <message>' or 'leave'.");
+                continue;
+            }
+            match parse_user_command(input.trim()) {
+                Ok(ClientMessage::Leave) => {
+                    self.leave(&mut writer, console, &mut reader_handle).await?;
+                    return Ok(Ended::Done);
+                }
+                Ok(ClientMessage::Help) => {
+                    // the server knows only its own commands, not these
+                    println!(
+                        "Client commands: mute <username>, unmute <username>, muted, quiet, ts on|off, save <path>, savefile <name> [path], clear."
+                    );
+                    if let Err(e) = connection::send(&mut writer, self.protocol, &ClientMessage::Help).await {
+                        eprintln!("Failed to send: {e}");
+                    }
+                }
+                Ok(ClientMessage::JoinRoom { .. } | ClientMessage::ListRooms)
+                    if !self.server.supports(consts::CAP_ROOMS) =>
+                {
+                    println!("This server doesn't support rooms.");
+                }
+                Ok(msg) => {
+                    // a dead connection shows up on the reader's side soon enough
+                    if let Err(e) = connection::send(&mut writer, self.protocol, &msg).await {
+                        eprintln!("Failed to send: {e}");
+                    }
+                }
+                Err(hint) => println!("{hint}"),
             }
         }
-        self.shutdown.store(true, Ordering::SeqCst);
+        console.shared.shutdown.store(true, Ordering::SeqCst);
         let _ = reader_handle.await;
-        let _ = readline_handle.join();
+        Ok(Ended::Done)
+    }
+
+    /// Says `leave`, then gives the server [`LEAVE_TIMEOUT`] to answer with
+    /// the `GOODBYE` the reader is waiting for.
+    async fn leave(
+        &self,
+        writer: &mut ServerWriter,
+        console: &Console,
+        reader_handle: &mut tokio::task::JoinHandle<Ended>,
+    ) -> Result<(), ClientError> {
+        connection::send(writer, self.protocol, &ClientMessage::Leave).await?;
+        console.shared.shutdown.store(true, Ordering::SeqCst);
+        // the reader says goodbye once the server does
+        if tokio::time::timeout(LEAVE_TIMEOUT, &mut *reader_handle).await.is_err() {
+            reader_handle.abort();
+            eprintln!("Warning: the server did not acknowledge leave; exiting anyway.");
+        }
         Ok(())
     }
 }
 
-async fn read_server_messages(
-    username: &str,
-    mut reader: BufReader<tokio::net::tcp::OwnedReadHalf>,
-    shutdown: Arc<AtomicBool>,
-) {
+/// Resolves on CTRL+C or, on Unix, SIGTERM.
+async fn leave_signal() {
+    let ctrl_c = async {
+        if let Err(e) = tokio::signal::ctrl_c().await {
+            error!("Failed to listen for CTRL+C: {e}");
+            std::future::pending::<()>().await;
+        }
+    };
+
+    #[cfg(unix)]
+    let terminate = async {
+        match tokio::signal::unix::signal(tokio::signal::unix::SignalKind::terminate()) {
+            Ok(mut signal) => {
+                signal.recv().await;
+            }
+            Err(e) => {
+                error!("Failed to listen for SIGTERM: {e}");
+                std::future::pending::<()>().await;
+            }
+        }
+    };
+    #[cfg(not(unix))]
+    let terminate = std::future::pending::<()>();
+
+    tokio::select! {
+        () = ctrl_c => {}
+        () = terminate => {}
+    }
+}
+
+/// Passes each [`leave_signal`] on to `signals` for as long as anyone
+/// listens. Once the client has taken them over, a signal no longer kills
+/// it, so one left unseen, e.g. while a line is being sent, still counts.
+async fn forward_signals(signals: mpsc::Sender<()>) {
+    while !signals.is_closed() {
+        leave_signal().await;
+        // one already waiting stands for this one too
+        let _ = signals.try_send(());
+    }
+}
+
+/// Sends a `ping` probe and has `ping timed out` printed if its answer,
+/// which the reader times, has not come in by [`PING_TIMEOUT`].
+async fn send_ping(writer: &mut ServerWriter, protocol: Protocol, console: &Console) -> std::io::Result<()> {
+    let (probes, stamps) = (console.shared.probes.clone(), console.shared.stamps.clone());
+    let token = probes.start();
+    let ping = ClientMessage::Ping { token: token.clone() };
+    if let Err(e) = connection::send(writer, protocol, &ping).await {
+        probes.expire(&token);
+        return Err(e);
+    }
+    tokio::spawn(async move {
+        tokio::time::sleep(PING_TIMEOUT).await;
+        if probes.expire(&token) {
+            println!("\r{}{}", stamps.stamp(None), color::system("ping timed out"));
+        }
+    });
+    Ok(())
+}
+
+/// Runs a command that never leaves the client, returning what to print, or
+/// `None` if `input` is for the server.
+fn local_command(input: &str, shared: &Shared) -> Option<String> {
+    // also taken as `/ts` and `/save`, the way other chat clients spell them
+    let slashed = input.strip_prefix('/').unwrap_or(input);
+    if slashed.eq_ignore_ascii_case(consts::CLIENT_TS_CMD) {
+        return Some("Usage: ts on or ts off".to_string());
+    }
+    if let Some(setting) = strip_command(slashed, consts::CLIENT_TS_PREFIX).map(str::trim) {
+        return Some(match setting.to_lowercase().as_str() {
+            "on" => {
+                shared.stamps.set(true);
+                "Timestamps on.".to_string()
+            }
+            "off" => {
+                shared.stamps.set(false);
+                "Timestamps off.".to_string()
+            }
+            _ => "Usage: ts on or ts off".to_string(),
+        });
+    }
+    if input.eq_ignore_ascii_case(consts::CLIENT_QUIET_CMD) {
+        // `fetch_xor` hands back the old setting
+        return Some(if shared.quiet.fetch_xor(true, Ordering::SeqCst) {
+            "Showing joins and leaves again.".to_string()
+        } else {
+            "Hiding joins and leaves; type quiet again to show them.".to_string()
+        });
+    }
+    if slashed.eq_ignore_ascii_case(consts::CLIENT_SAVE_CMD) {
+        return Some("Usage: save <path>".to_string());
+    }
+    if let Some(path) = strip_command(slashed, consts::CLIENT_SAVE_PREFIX).map(str::trim) {
+        return Some(match shared.transcript.save(Path::new(path)) {
+            Ok(lines) => format!("Saved {lines} lines to {path}; new ones are appended as they arrive."),
+            Err(e) => color::system(&format!("Could not save to {path}: {e}")),
+        });
+    }
+    if input.eq_ignore_ascii_case(consts::CLIENT_SENDFILE_CMD) {
+        return Some("Usage: sendfile <path>".to_string());
+    }
+    if slashed.eq_ignore_ascii_case(consts::CLIENT_SAVEFILE_CMD) {
+        return Some("Usage: savefile <name> [path]".to_string());
+    }
+    if let Some(rest) = strip_command(slashed, consts::CLIENT_SAVEFILE_PREFIX).map(str::trim) {
+        return Some(save_file(rest, &shared.files));
+    }
+    mute_command(input, &shared.peers.muted)
+}
+
+/// Saves a file someone shared, from `savefile <name> [path]`. A name may
+/// have spaces in it, so the path is the last word only if what comes before
+/// it names a file; without one, the file is saved under its own name.
+fn save_file(args: &str, files: &ReceivedFiles) -> String {
+    let (name, path) = match args.rsplit_once(' ') {
+        Some((name, path)) if !files.holds(args) && files.holds(name.trim_end()) => (name.trim_end(), path),
+        _ => (args, args),
+    };
+    match files.save(name, Path::new(path)) {
+        Ok(size) => format!("Saved {name} ({size} bytes) to {path}."),
+        Err(e) => color::system(&format!("Could not save {name} to {path}: {e}")),
+    }
+}
+
+/// Reads the file at `path` into the command that shares it, under its own
+/// name without the directories, or says why it can't be shared.
+fn file_to_share(path: &Path) -> Result<ClientMessage, String> {
+    let name = path
+        .file_name()
+        .and_then(|name| name.to_str())
+        .filter(|name| file::is_valid_name(name))
+        .ok_or_else(|| format!("Can't share {}: its name won't do for others.", path.display()))?;
+    let size = fs::metadata(path)
+        .map_err(|e| format!("Can't read {}: {e}", path.display()))?
+        .len();
+    // the server says how large it takes; this only spares reading a huge file
+    if !usize::try_from(size).is_ok_and(|size| size <= file::MAX_SIZE) {
+        return Err(format!(
+            "Can't share {}: larger than {} bytes.",
+            path.display(),
+            file::MAX_SIZE
+        ));
+    }
+    let bytes = fs::read(path).map_err(|e| format!("Can't read {}: {e}", path.display()))?;
+    Ok(ClientMessage::File {
+        name: name.to_string(),
+        data: file::encode_data(&bytes),
+    })
+}
+
+/// `mute`, `unmute` and `muted`, or `None` if `input` is none of them.
+fn mute_command(input: &str, muted: &MuteList) -> Option<String> {
+    if input.eq_ignore_ascii_case(consts::CLIENT_MUTED_CMD) {
+        let names = muted.list();
+        return Some(if names.is_empty() {
+            "Nobody is muted.".to_string()
+        } else {
+            format!("Muted: {}", names.join(", "))
+        });
+    }
+    if input.eq_ignore_ascii_case(consts::CLIENT_MUTE_CMD) || input.eq_ignore_ascii_case(consts::CLIENT_UNMUTE_CMD) {
+        return Some("Usage: mute <username> or unmute <username>".to_string());
+    }
+    if let Some(username) = strip_command(input, consts::CLIENT_MUTE_PREFIX).map(str::trim) {
+        return Some(if muted.mute(username) {
+            format!("Muted {username}; their messages are hidden until you unmute them.")
+        } else {
+            format!("{username} is already muted.")
+        });
+    }
+    let username = strip_command(input, consts::CLIENT_UNMUTE_PREFIX)?.trim();
+    Some(if muted.unmute(username) {
+        format!("Unmuted {username}.")
+    } else {
+        format!("{username} isn't muted.")
+    })
+}
+
+/// Turns a line typed by the user into the command to send, or a hint to print.
+fn parse_user_command(input: &str) -> Result<ClientMessage, &'static str> {
+    if input.eq_ignore_ascii_case(consts::CLIENT_LEAVE_CMD) {
+        Ok(ClientMessage::Leave)
+    } else if let Some(msg) = strip_command(input, consts::CLIENT_SEND_PREFIX) {
+        Ok(ClientMessage::Send {
+            id: None,
+            message: msg.to_string(),
+        })
+    } else if input.eq_ignore_ascii_case(consts::CLIENT_SEND_CMD) {
+        // the server says what is wrong with it, as it does for a blank line
+        Ok(ClientMessage::Send {
+            id: None,
+            message: String::new(),
+        })
+    } else if let Some(rest) = strip_command(input, consts::CLIENT_SEND_ID_PREFIX) {
+        let (id, msg) = rest
+            .trim_start()
+            .split_once(' ')
+            .ok_or("Usage: sendid <id> <message>")?;
+        Ok(ClientMessage::Send {
+            id: Some(id.to_string()),
+            message: msg.to_string(),
+        })
+    } else if let Some(rest) = strip_command(input, consts::CLIENT_REPLY_PREFIX) {
+        let (id, msg) = rest.trim_start().split_once(' ').ok_or("Usage: reply <id> <message>")?;
+        Ok(ClientMessage::Reply {
+            id: None,
+            reply_to: message_id(id),
+            message: msg.to_string(),
+        })
+    } else if let Some(rest) = strip_command(input, consts::CLIENT_EDIT_PREFIX) {
+        let (id, msg) = rest.trim_start().split_once(' ').ok_or("Usage: edit <id> <message>")?;
+        Ok(ClientMessage::Edit {
+            id: message_id(id),
+            message: msg.to_string(),
+        })
+    } else if let Some(id) = strip_command(input, consts::CLIENT_DELETE_PREFIX) {
+        Ok(ClientMessage::Delete {
+            id: message_id(id.trim()),
+        })
+    } else if input.eq_ignore_ascii_case(consts::CLIENT_AWAY_CMD) {
+        Ok(ClientMessage::Away { message: String::new() })
+    } else if let Some(note) = strip_command(input, consts::CLIENT_AWAY_PREFIX) {
+        Ok(ClientMessage::Away {
+            message: note.trim().to_string(),
+        })
+    } else if let Some(rest) = strip_command(input, consts::CLIENT_DM_PREFIX) {
+        let (to, msg) = rest
+            .trim_start()
+            .split_once(' ')
+            .ok_or("Usage: dm <username> <message>")?;
+        Ok(ClientMessage::Direct {
+            to: to.to_string(),
+            message: msg.to_string(),
+        })
+    } else if let Some(username) = strip_command(input, consts::CLIENT_DM_HISTORY_PREFIX) {
+        Ok(ClientMessage::DirectHistory {
+            username: username.trim().to_string(),
+        })
+    } else if input.eq_ignore_ascii_case(consts::CLIENT_RESYNC_CMD) {
+        Ok(ClientMessage::Resync { after: None })
+    } else if let Some(after) = strip_command(input, consts::CLIENT_RESYNC_PREFIX) {
+        let after = message_id(after.trim()).parse().map_err(|_| "Usage: resync [number]")?;
+        Ok(ClientMessage::Resync { after: Some(after) })
+    } else if input.eq_ignore_ascii_case(consts::CLIENT_ME_CMD) {
+        // let the server explain why an empty action is refused
+        Ok(ClientMessage::Action { text: String::new() })
+    } else if let Some(text) = strip_command(input, consts::CLIENT_ME_PREFIX) {
+        Ok(ClientMessage::Action { text: text.to_string() })
+    } else if let Some(room) = strip_command(input, consts::CLIENT_ROOM_PREFIX) {
+        Ok(ClientMessage::JoinRoom {
+            room: room.trim().to_string(),
+        })
+    } else if let Some(username) = strip_command(input, consts::CLIENT_NICK_PREFIX) {
+        Ok(ClientMessage::Nick {
+            username: username.trim().to_string(),
+        })
+    } else if input.eq_ignore_ascii_case(consts::CLIENT_ROOMS_CMD) {
+        Ok(ClientMessage::ListRooms)
+    } else if input.eq_ignore_ascii_case(consts::CLIENT_WHO_CMD) || input.eq_ignore_ascii_case(consts::CLIENT_WHO_ALIAS)
+    {
+        Ok(ClientMessage::Who)
+    } else if input.eq_ignore_ascii_case(consts::CLIENT_HELP_CMD) {
+        Ok(ClientMessage::Help)
+    } else if let Some(token) = strip_command(input, consts::CLIENT_AUTH_PREFIX) {
+        Ok(ClientMessage::Auth {
+            token: token.trim().to_string(),
+        })
+    } else if let Some(username) = strip_command(input, consts::CLIENT_KICK_PREFIX) {
+        Ok(ClientMessage::Kick {
+            username: username.trim().to_string(),
+        })
+    } else if let Some(username) = strip_command(input, consts::CLIENT_BAN_PREFIX) {
+        Ok(ClientMessage::Ban {
+            username: username.trim().to_string(),
+        })
+    } else if let Some(username) = strip_command(input, consts::CLIENT_UNBAN_PREFIX) {
+        Ok(ClientMessage::Unban {
+            username: username.trim().to_string(),
+        })
+    } else if input.eq_ignore_ascii_case(consts::CLIENT_STATS_CMD) {
+        Ok(ClientMessage::Stats)
+    } else if input.eq_ignore_ascii_case(consts::CLIENT_WHO_ALL_INPUT) {
+        Ok(ClientMessage::WhoAll)
+    } else if input.eq_ignore_ascii_case(consts::CLIENT_CONNS_CMD) {
+        Ok(ClientMessage::Connections)
+    } else if let Some(addr) = strip_command(input, consts::CLIENT_DROP_PREFIX) {
+        Ok(ClientMessage::DropConnection {
+            addr: addr.trim().to_string(),
+        })
+    } else if let Some(message) = strip_command(input, consts::CLIENT_BROADCAST_PREFIX) {
+        Ok(ClientMessage::Broadcast {
+            message: message.to_string(),
+        })
+    } else if let Some(rest) = strip_command(input, consts::CLIENT_ROOM_POLICY_PREFIX) {
+        let (room, policy) = rest.trim().split_once(' ').unwrap_or((rest.trim(), ""));
+        Ok(ClientMessage::RoomPolicy {
+            room: room.to_string(),
+            policy: policy.trim().to_string(),
+        })
+    } else if let Some(typed) = input.strip_prefix('/').filter(|typed| !typed.is_empty()) {
+        // the server may know it by that name, e.g. `/w bob hi` or `/quit`
+        let (command, args) = typed.split_once(' ').unwrap_or((typed, ""));
+        Ok(ClientMessage::Typed {
+            command: command.to_string(),
+            args: args.trim_start().to_string(),
+        })
+    } else {
+        Err(concat!(
+            "Unknown command. Use 'send <message>', 'reply <id> <message>', 'me <action>', 'edit <id> <message>', 'delete <id>', ",
+            "'away [message]', 'dm <username> <message>', 'dm-history <username>', 'resync [number]', 'join #room', 'rooms', 'who', 'nick <newname>', 'mute <username>', 'unmute <username>', ",
+            "'muted', 'quiet', 'ping', 'save <path>', 'sendfile <path>', 'savefile <name> [path]', 'help' or 'leave'."
+        ))
+    }
+}
+
+/// A message id as typed, taken with or without the `#` it is shown with.
+fn message_id(typed: &str) -> String {
+    typed.strip_prefix('#').unwrap_or(typed).to_string()
+}
+
+/// Strips a command keyword such as `SEND ` from user input, ignoring ASCII case.
+fn strip_command<'a>(input: &'a str, prefix: &str) -> Option<&'a str> {
+    input
+        .get(..prefix.len())
+        .filter(|head| head.eq_ignore_ascii_case(prefix))
+        .and_then(|_| input.get(prefix.len()..))
+}
+
+async fn read_server_messages(joined: JoinedClient, mut reader: ServerReader, shared: Shared) -> Ended {
+    let JoinedClient {
+        mut username,
+        protocol,
+        reconnect,
+        mut room,
+        restore_room,
+        ..
+    } = joined;
+    let Shared {
+        reply_tx,
+        shutdown,
+        peers,
+        stamps,
+        probes,
+        transcript,
+        files,
+        quiet,
+        refused,
+        status,
+    } = shared;
     let mut line = String::new();
+    let mut server_closing = false;
+    // another connection took the session over; coming back would take it back
+    let mut superseded = false;
+    let mut session = None;
+    // after a fresh join, the room to go back to and whether it was asked for
+    let mut rejoining = room.clone().filter(|_| restore_room).map(|room| (room, false));
     loop {
         line.clear();
-        match reader.read_line(&mut line).await {
+        let read = reader.read_message(&mut line).await;
+        // after our own `leave` there is nothing to come back to; read once
+        // the read returns, as the leave may come while it waits
+        let left = shutdown.load(Ordering::SeqCst);
+        match read {
+            Ok(0) if superseded => {
+                println!("\nThe session was resumed from another connection.");
+                shutdown.store(true, Ordering::SeqCst);
+                return Ended::Done;
+            }
+            Ok(0) if reconnect && !left => {
+                println!(
+                    "\n{}",
+                    if server_closing {
+                        "Server shut down."
+                    } else {
+                        "Disconnected from server."
+                    }
+                );
+                // a server that shut down has forgotten every session
+                let token = session.filter(|_| !server_closing).map(|(token, _)| token);
+                return Ended::Dropped { username, token, room };
+            }
+            Ok(0) if server_closing => {
+                println!("\nServer shut down. Goodbye!");
+                shutdown.store(true, Ordering::SeqCst);
+                return Ended::Done;
+            }
+            Ok(0) if left => {
+                eprintln!("\nWarning: the server closed the connection without acknowledging leave.");
+                return Ended::Done;
+            }
             Ok(0) => {
                 println!("\nDisconnected from server.");
+                if let Some((token, seconds)) = &session
+                    && !left
+                {
+                    println!("Within {seconds}s, resume with: --username {username} --rejoin {token}");
+                }
                 shutdown.store(true, Ordering::SeqCst);
-                break;
+                return Ended::Done;
+            }
+            Ok(_) => {
+                let trimmed = line.trim();
+                let decoded = protocol.format.decode_server(trimmed.as_bytes()).map(unnumbered);
+                server_closing |= matches!(decoded, Ok(ServerMessage::ShuttingDown { .. }));
+                superseded |=
+                    matches!(&decoded, Ok(ServerMessage::Err { code, .. }) if *code == ErrorCode::SESSION_SUPERSEDED);
+                if matches!(decoded, Ok(ServerMessage::Err { .. })) {
+                    refused.store(true, Ordering::SeqCst);
+                }
+                if let Ok(ServerMessage::Session { token, seconds }) = &decoded {
+                    session = Some((token.clone(), *seconds));
+                }
+                if let Ok(ServerMessage::UserJoined {
+                    username: who,
+                    room: to,
+                    ..
+                }) = &decoded
+                    && *who == username
+                {
+                    status.set_room(to);
+                    match rejoining.take() {
+                        Some((wanted, _)) if wanted.eq_ignore_ascii_case(to) => {
+                            println!("\r{}", color::system(&format!("Rejoined {to}")));
+                        }
+                        // a fresh join lands in the default room; go back from there
+                        Some((wanted, false)) => {
+                            let join = ClientMessage::JoinRoom { room: wanted.clone() };
+                            if reply_tx.send(join).await.is_err() {
+                                return Ended::Done;
+                            }
+                            rejoining = Some((wanted, true));
+                        }
+                        // asked for already, and somewhere else since
+                        _ => {}
+                    }
+                    room = Some(to.clone());
+                }
+                if let Err(e) = transcript.record(decoded.as_ref().ok(), trimmed) {
+                    println!("\r{}", color::system(&e));
+                }
+                if let Ok(msg) = &decoded {
+                    peers.muted.follow(msg);
+                    peers.online.follow(msg);
+                    if peers.muted.hides(msg) {
+                        continue;
+                    }
+                    if quiet.load(Ordering::SeqCst)
+                        && matches!(msg, ServerMessage::UserJoined { .. } | ServerMessage::UserLeft { .. })
+                    {
+                        continue;
+                    }
+                }
+                if let Ok(ServerMessage::File {
+                    username: from,
+                    name,
+                    data,
+                    ..
+                }) = &decoded
+                    && *from != username
+                    && file::is_valid_name(name)
+                    && let Some(bytes) = file::decode_data(data)
+                {
+                    files.hold(name, bytes);
+                }
+                let stamp = stamps.stamp(decoded.as_ref().ok());
+                if matches!(decoded, Ok(ServerMessage::Goodbye)) {
+                    println!("\r{stamp}Goodbye!");
+                    shutdown.store(true, Ordering::SeqCst);
+                    return Ended::Done;
+                }
+                if let Ok(ServerMessage::Pong { token }) = &decoded {
+                    if let Some(round_trip) = probes.finish(token) {
+                        println!("\r{stamp}Round-trip: {}ms", round_trip.as_millis());
+                    }
+                    continue;
+                }
+                let reply = show_server_message(&mut username, decoded, trimmed, &stamp);
+                // after a rename
+                status.set_username(&username);
+                if let Some(reply) = reply
+                    && reply_tx.send(reply).await.is_err()
+                {
+                    return Ended::Done;
+                }
             }
-            Ok(_) => parse_server_message(username, &line),
             Err(e) => {
                 eprintln!("\nRead error: {e}");
+                if reconnect && !left {
+                    let token = session.map(|(token, _)| token);
+                    return Ended::Dropped { username, token, room };
+                }
                 shutdown.store(true, Ordering::SeqCst);
-                break;
+                return Ended::Done;
             }
         }
     }
 }
 
-fn read_joined_user_input(cmd_tx: &mpsc::Sender<String>, shutdown: &Arc<AtomicBool>) {
-    let Ok(mut rl) = DefaultEditor::new() else {
-        error!("unable to create DefaultEditor");
+/// Tells the server we are typing while a chat line is being composed,
+/// at most once per [`consts::TYPING_DEBOUNCE`]. The server works out
+/// when we stop.
+struct TypingNotifier {
+    tx: mpsc::Sender<ClientMessage>,
+    last_sent: Mutex<Option<Instant>>,
+}
+
+impl TypingNotifier {
+    const fn new(tx: mpsc::Sender<ClientMessage>) -> Self {
+        Self {
+            tx,
+            last_sent: Mutex::new(None),
+        }
+    }
+
+    /// Only `send`, `sendid` and `me` lines reach the room; DMs and commands don't.
+    fn is_chat_line(line: &str) -> bool {
+        let Some((cmd, _)) = line.trim_start().split_once(' ') else {
+            return false;
+        };
+        [
+            consts::CLIENT_SEND_CMD,
+            consts::CLIENT_SEND_ID_CMD,
+            consts::CLIENT_ME_CMD,
+        ]
+        .iter()
+        .any(|chat| cmd.eq_ignore_ascii_case(chat))
+    }
+}
+
+impl ConditionalEventHandler for TypingNotifier {
+    fn handle(&self, _evt: &Event, _n: RepeatCount, _positive: bool, ctx: &EventContext<'_>) -> Option<Cmd> {
+        if !Self::is_chat_line(ctx.line()) {
+            return None;
+        }
+        let Ok(mut last_sent) = self.last_sent.lock() else {
+            return None;
+        };
+        let now = Instant::now();
+        if last_sent.is_none_or(|at| now.duration_since(at) >= consts::TYPING_DEBOUNCE) {
+            // best effort: a full reply queue just skips this one
+            if self.tx.try_send(ClientMessage::Typing).is_ok() {
+                *last_sent = Some(now);
+            }
+        }
+        // fall through to the default binding, so the key is still inserted
+        None
+    }
+}
+
+/// The file input history is kept in across runs, if there is a home to
+/// keep it in and someone is typing at a terminal. Piped input, as from a
+/// script, is neither recalled nor recorded.
+fn history_file() -> Option<PathBuf> {
+    if !io::stdin().is_terminal() {
+        return None;
+    }
+    env::var_os("HOME")
+        .or_else(|| env::var_os("USERPROFILE"))
+        .map(|home| PathBuf::from(home).join(HISTORY_FILE_NAME))
+}
+
+fn read_joined_user_input(
+    cmd_tx: &mpsc::Sender<String>,
+    shutdown: &Arc<AtomicBool>,
+    typing: TypingNotifier,
+    helper: ChatHelper,
+    history: Option<&Path>,
+) {
+    let Ok(mut rl) = Editor::<ChatHelper, DefaultHistory>::new() else {
+        error!("unable to create Editor");
         return;
     };
+    rl.set_helper(Some(helper));
+    rl.bind_sequence(Event::Any, EventHandler::Conditional(Box::new(typing)));
+    // there is nothing to load on the first run
+    if let Some(path) = history {
+        let _ = rl.load_history(path);
+    }
 
     loop {
         if shutdown.load(Ordering::SeqCst) {
@@ -249,46 +1145,331 @@ fn read_joined_user_input(cmd_tx: &mpsc::Sender<String>, shutdown: &Arc<AtomicBo
             }
         }
     }
+    if let Some(path) = history
+        && let Err(e) = rl.save_history(path)
+    {
+        warn!("unable to save history to {}: {e}", path.display());
+    }
 }
 
-/// Parse server message using new wire protocol
-fn parse_server_message(this_user: &str, line: &str) {
-    let trimmed = line.trim();
-    match ServerMessage::decode(trimmed.as_bytes()) {
-        Ok(ServerMessage::Ok) => {
-            // Silent acknowledgment
+/// Prints a message from the server, or the raw `line` it came from if it
+/// could not be decoded.
+///
+/// Returns the reply the server expects, if any. `this_user` follows our own renames.
+fn show_server_message(
+    this_user: &mut String,
+    decoded: Result<ServerMessage, ServerParseError>,
+    line: &str,
+    stamp: &str,
+) -> Option<ClientMessage> {
+    match decoded {
+        Ok(ServerMessage::Ping) => return Some(ClientMessage::Pong),
+        // Silent acknowledgment; the session is only shown if we drop, and a
+        // pong or goodbye is handled by the reader. A room's list of users
+        // only feeds completion.
+        Ok(
+            ServerMessage::Ok
+            | ServerMessage::Session { .. }
+            | ServerMessage::Pong { .. }
+            | ServerMessage::Goodbye
+            | ServerMessage::Hello { .. }
+            | ServerMessage::UserList { .. },
+        ) => {}
+        Ok(ServerMessage::Err { code, reason }) => {
+            println!("\r{stamp}{}", color::system(&format!("[ERROR {code}]: {reason}")));
+        }
+        Ok(ServerMessage::UserJoined {
+            timestamp,
+            username,
+            room,
+        }) => {
+            if username == *this_user {
+                println!(
+                    "\r{stamp}{}",
+                    color::dim(&format!("{timestamp} *** You are now in {room} ***"))
+                );
+            } else {
+                println!(
+                    "\r{stamp}{}",
+                    color::dim(&format!("{timestamp} *** {username} joined {room} ***"))
+                );
+            }
+        }
+        Ok(ServerMessage::UserLeft {
+            timestamp,
+            username,
+            room,
+            disconnected,
+        }) => {
+            if username != *this_user {
+                let how = if disconnected { "disconnected from" } else { "left" };
+                println!(
+                    "\r{stamp}{}",
+                    color::dim(&format!("{timestamp} *** {username} {how} {room} ***"))
+                );
+            }
+        }
+        Ok(ServerMessage::Broadcast {
+            timestamp,
+            id,
+            username,
+            message,
+            reply_to,
+        }) => {
+            if username == *this_user {
+                // what we typed is on screen already; the id is what `edit` needs
+                println!("\r{stamp}{}", color::dim(&format!("{timestamp} sent #{id}")));
+            } else if let Some(reply_to) = reply_to {
+                println!(
+                    "\r{stamp}{timestamp} [{}] {}: {message}",
+                    color::speaker(&username),
+                    color::dim(&format!("re #{reply_to}"))
+                );
+            } else {
+                println!("\r{stamp}{timestamp} [{}]: {message}", color::speaker(&username));
+            }
+        }
+        Ok(ServerMessage::Edited {
+            timestamp,
+            id,
+            username,
+            message,
+        }) => {
+            if username == *this_user {
+                println!("\r{stamp}{}", color::dim(&format!("{timestamp} edited #{id}")));
+            } else {
+                println!(
+                    "\r{stamp}{timestamp} [{}] {}: {message}",
+                    color::speaker(&username),
+                    color::dim(&format!("edited #{id}"))
+                );
+            }
         }
-        Ok(ServerMessage::Err { reason }) => {
-            println!("\r[ERROR]: {reason}");
+        Ok(ServerMessage::Deleted {
+            timestamp,
+            id,
+            username,
+        }) => {
+            let who = if username == *this_user { "You" } else { &username };
+            println!(
+                "\r{stamp}{}",
+                color::dim(&format!("{timestamp} *** {who} deleted #{id} ***"))
+            );
         }
-        Ok(ServerMessage::UserJoined { username }) => {
-            if username != this_user {
-                println!("\r*** {username} joined the chat ***");
+        Ok(ServerMessage::Action {
+            timestamp,
+            username,
+            text,
+        }) => {
+            if username != *this_user {
+                println!("\r{stamp}{timestamp} * {} {text}", color::user(&username));
+            }
+        }
+        Ok(ServerMessage::Direct { from, to, message }) => {
+            println!("\r{stamp}{} {message}", dm_label(this_user, &from, &to));
+        }
+        Ok(ServerMessage::File {
+            timestamp,
+            username,
+            name,
+            size,
+            ..
+        }) => {
+            if username == *this_user {
+                println!(
+                    "\r{stamp}{}",
+                    color::dim(&format!("{timestamp} shared {name} ({size} bytes)"))
+                );
+            } else {
+                println!(
+                    "\r{stamp}{timestamp} [{}] shared {name} ({size} bytes); savefile {name} to keep it",
+                    color::speaker(&username)
+                );
             }
         }
-        Ok(ServerMessage::UserLeft { username }) => {
-            if username != this_user {
-                println!("\r*** {username} left the chat ***");
+        Ok(ServerMessage::Renamed { timestamp, from, to }) => {
+            if from == *this_user {
+                println!(
+                    "\r{stamp}{}",
+                    color::dim(&format!("{timestamp} *** You are now known as {to} ***"))
+                );
+                *this_user = to;
+            } else {
+                println!(
+                    "\r{stamp}{}",
+                    color::dim(&format!("{timestamp} *** {from} is now known as {to} ***"))
+                );
             }
         }
-        Ok(ServerMessage::Broadcast { username, message }) => {
-            if username != this_user {
-                println!("\r[{username}]: {message}");
+        Ok(ServerMessage::Info { text }) => {
+            println!("\r{stamp}{}", color::system(&text));
+        }
+        Ok(ServerMessage::Presence {
+            timestamp,
+            username,
+            away,
+        }) => {
+            let (who, is) = if username == *this_user {
+                ("You", "are")
+            } else {
+                (username.as_str(), "is")
+            };
+            let status = match away.as_deref() {
+                Some("") => "now away".to_string(),
+                Some(note) => format!("now away: {note}"),
+                None => "back".to_string(),
+            };
+            println!(
+                "\r{stamp}{}",
+                color::dim(&format!("{timestamp} *** {who} {is} {status} ***"))
+            );
+        }
+        Ok(ServerMessage::Typing { username, active }) => {
+            // the stop is implied by their next line, so only the start is shown
+            if active && username != *this_user {
+                println!("\r{stamp}{}", color::dim(&format!("{username} is typing...")));
             }
         }
+        // as sent, for scripts waiting on them
+        Ok(ServerMessage::Ack { id }) => {
+            println!("\r{stamp}{} {id}", consts::SERVER_EVENT_ACK);
+        }
+        Ok(ServerMessage::Nack { id, reason, .. }) => {
+            println!("\r{stamp}{} {id} {reason}", consts::SERVER_EVENT_NACK);
+        }
+        Ok(ServerMessage::Truncated { .. }) => println!("\r{stamp}{}", color::dim("[history truncated]")),
+        Ok(ServerMessage::ShuttingDown { seconds }) => {
+            println!(
+                "\r{stamp}{}",
+                color::system(&format!("SERVER: shutting down in {seconds}s"))
+            );
+        }
+        Ok(ServerMessage::Announcement { text, .. }) => {
+            println!("\r{stamp}{}", color::system(&format!("SERVER: {text}")));
+        }
+        Ok(ServerMessage::History { message }) => show_history(this_user, *message, stamp),
+        Ok(ServerMessage::Sequenced { message, .. }) => {
+            return show_server_message(this_user, Ok(*message), line, stamp);
+        }
         Err(_) => {
-            if !trimmed.is_empty() {
-                println!("\r{trimmed}");
+            if !line.is_empty() {
+                println!("\r{stamp}{line}");
             }
         }
     }
+    None
+}
+
+/// Prints a line replayed from the room's or a private conversation's history.
+fn show_history(this_user: &str, message: ServerMessage, stamp: &str) {
+    match message {
+        // unlike live lines, replayed ones include our own
+        ServerMessage::Broadcast {
+            timestamp,
+            username,
+            message,
+            ..
+        } => println!(
+            "\r{stamp}{} {timestamp} [{}]: {message}",
+            color::dim("[history]"),
+            color::speaker(&username)
+        ),
+        ServerMessage::Edited {
+            timestamp,
+            id,
+            username,
+            message,
+        } => println!(
+            "\r{stamp}{} {timestamp} [{}] {}: {message}",
+            color::dim("[history]"),
+            color::speaker(&username),
+            color::dim(&format!("edited #{id}"))
+        ),
+        ServerMessage::Deleted {
+            timestamp,
+            id,
+            username,
+        } => println!(
+            "\r{stamp}{} {}",
+            color::dim("[history]"),
+            color::dim(&format!("{timestamp} *** {username} deleted #{id} ***"))
+        ),
+        ServerMessage::Action {
+            timestamp,
+            username,
+            text,
+        } => println!(
+            "\r{stamp}{} {timestamp} * {} {text}",
+            color::dim("[history]"),
+            color::user(&username)
+        ),
+        ServerMessage::Direct { from, to, message } => println!(
+            "\r{stamp}{} {} {message}",
+            color::dim("[history]"),
+            dm_label(this_user, &from, &to)
+        ),
+        other => println!("\r{stamp}{} {other}", color::dim("[history]")),
+    }
+}
+
+/// `msg` without the number a chat line comes with over JSON, replayed or
+/// live; we show lines as they come rather than look for gaps.
+fn unnumbered(msg: ServerMessage) -> ServerMessage {
+    match msg {
+        ServerMessage::Sequenced { message, .. } => *message,
+        ServerMessage::History { message } => ServerMessage::History {
+            message: Box::new(unnumbered(*message)),
+        },
+        other => other,
+    }
+}
+
+/// Who a DM was from, or who we sent it to.
+fn dm_label(this_user: &str, from: &str, to: &str) -> String {
+    color::direct(&if from == this_user {
+        format!("[dm to {to}]")
+    } else {
+        format!("[dm from {from}]")
+    })
 }
 
 #[tokio::main]
 async fn main() -> ExitCode {
-    let args = Args::parse();
+    let mut args = Args::parse();
+    color::init(!args.no_color, args.name_width.map(usize::from));
+    // over JSON the server's own `ts` is there to be used
+    let stamps = match Stamps::new(args.timestamps, &args.timestamp_format, args.json) {
+        Ok(stamps) => stamps,
+        Err(e) => {
+            eprintln!("{e}");
+            return ExitCode::FAILURE;
+        }
+    };
+
+    // the server checks too; this saves a round trip, and lets us know our
+    // name as the server will spell it
+    match normalized_username(&args.username) {
+        Ok(username) => args.username = username,
+        Err(e) => {
+            eprintln!("Invalid username: {e}");
+            return ExitCode::FAILURE;
+        }
+    }
+    if let Some(clients) = args.clients {
+        return run_load(args, clients).await;
+    }
+    let script = match args.script.as_deref().map(script::load).transpose() {
+        Ok(script) => script,
+        Err(e) => {
+            eprintln!("Invalid script: {e}");
+            return ExitCode::FAILURE;
+        }
+    };
+    let scripted = script.is_some();
+    let welcome = args.welcome;
+    let status_line = args.status_line;
 
-    let disconnected = DisconnectedClient::new(args);
+    let mut disconnected = DisconnectedClient::new(args);
 
     let connected = match disconnected.connect().await {
         Ok(c) => c,
@@ -298,18 +1479,88 @@ async fn main() -> ExitCode {
         }
     };
 
-    let (joined, reader, writer) = match connected.join().await {
+    let (mut joined, mut reader, mut writer) = match connected.join().await {
         Ok(j) => j,
         Err(e) => {
             eprintln!("Join error: {e}");
             return ExitCode::FAILURE;
         }
     };
+    if welcome {
+        joined.print_commands();
+    } else {
+        joined.print_joined();
+    }
 
-    if let Err(e) = joined.run(reader, writer).await {
-        eprintln!("Error: {e}");
+    let status = StatusLine::start(status_line, &joined.username);
+    let mut console = Console::start(stamps, script, status);
+    loop {
+        let (username, token, room) = match joined.run(reader, writer, &mut console).await {
+            Ok(Ended::Done) => break,
+            Ok(Ended::Interrupted) => {
+                console.abandon();
+                return ExitCode::SUCCESS;
+            }
+            Ok(Ended::Dropped { username, token, room }) => (username, token, room),
+            Err(e) => {
+                eprintln!("Error: {e}");
+                console.close();
+                return ExitCode::FAILURE;
+            }
+        };
+        disconnected.options.username = username;
+        disconnected.options.rejoin = token;
+        console.shared.status.set_state(ConnectionState::Reconnecting);
+        let attempts = disconnected.reconnect_attempts.unwrap_or_default();
+        // with nothing to leave, a signal just stops the trying
+        let rejoined = tokio::select! {
+            rejoined = disconnected.reconnect(attempts) => rejoined,
+            Some(()) = console.signals.recv() => {
+                console.abandon();
+                return ExitCode::SUCCESS;
+            }
+        };
+        let Some(rejoined) = rejoined else {
+            console.shared.status.set_state(ConnectionState::Disconnected);
+            eprintln!("Giving up after {attempts} attempt(s).");
+            console.close();
+            return ExitCode::FAILURE;
+        };
+        (joined, reader, writer) = rejoined;
+        // a resumed session is still in its room; a fresh join has to go back
+        joined.restore_room = disconnected.options.rejoin.is_none();
+        joined.room = room;
+        console.shared.status.set_state(ConnectionState::Connected);
+    }
+    let refused = console.shared.refused.load(Ordering::SeqCst);
+    console.close();
+    if scripted && refused {
+        eprintln!("The server refused at least one command.");
         return ExitCode::FAILURE;
     }
 
     ExitCode::SUCCESS
 }
+
+/// `--clients`: runs the load test and prints the totals; fails only if no
+/// virtual user could join.
+async fn run_load(args: Args, clients: u32) -> ExitCode {
+    // the longest name is the one most likely to be refused
+    if let Err(e) = normalized_username(&load::username(&args.username, clients)) {
+        eprintln!("Invalid username: {e}");
+        return ExitCode::FAILURE;
+    }
+    let load = load::Load {
+        clients,
+        rate: args.rate,
+        duration: Duration::from_secs(args.duration),
+    };
+    let options = DisconnectedClient::new(args).options;
+    let report = load::run(&options, load).await;
+    println!("{report}");
+    if report.any_joined() {
+        ExitCode::SUCCESS
+    } else {
+        ExitCode::FAILURE
+    }
+}
@@ -0,0 +1,129 @@
+//! Users muted with `mute`, whose messages this client stops showing.
+//!
+//! Nothing here reaches the server: a muted user still gets everything we
+//! send, and still shows up joining, leaving and changing name.
+
+use std::{
+    collections::BTreeSet,
+    sync::{Arc, Mutex},
+};
+
+use common::tcp_message::ServerMessage;
+
+/// Shared between the input loop, which edits it, and the reader, which
+/// consults it.
+#[derive(Debug, Clone, Default)]
+pub struct MuteList {
+    // lowercased, as the server matches names regardless of case
+    names: Arc<Mutex<BTreeSet<String>>>,
+}
+
+impl MuteList {
+    /// Mutes `username`; false if they already were.
+    pub fn mute(&self, username: &str) -> bool {
+        self.names
+            .lock()
+            .is_ok_and(|mut names| names.insert(username.to_lowercase()))
+    }
+
+    /// Unmutes `username`; false if they weren't muted.
+    pub fn unmute(&self, username: &str) -> bool {
+        self.names
+            .lock()
+            .is_ok_and(|mut names| names.remove(&username.to_lowercase()))
+    }
+
+    /// Everyone muted, in order.
+    pub fn list(&self) -> Vec<String> {
+        self.names
+            .lock()
+            .map(|names| names.iter().cloned().collect())
+            .unwrap_or_default()
+    }
+
+    fn is_muted(&self, username: &str) -> bool {
+        self.names
+            .lock()
+            .is_ok_and(|names| names.contains(&username.to_lowercase()))
+    }
+
+    /// Whether `msg` comes from a muted user and should not be shown.
+    /// Presence changes always are.
+    pub fn hides(&self, msg: &ServerMessage) -> bool {
+        match msg {
+            ServerMessage::Broadcast { username, .. }
+            | ServerMessage::Edited { username, .. }
+            | ServerMessage::Deleted { username, .. }
+            | ServerMessage::Action { username, .. }
+            | ServerMessage::File { username, .. }
+            | ServerMessage::Typing { username, .. } => self.is_muted(username),
+            ServerMessage::Direct { from, .. } => self.is_muted(from),
+            ServerMessage::History { message } => self.hides(message),
+            _ => false,
+        }
+    }
+
+    /// Keeps a muted user muted under the new name from a `Renamed` event.
+    pub fn follow(&self, msg: &ServerMessage) {
+        if let ServerMessage::Renamed { from, to, .. } = msg
+            && self.unmute(from)
+        {
+            self.mute(to);
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn broadcast(username: &str) -> ServerMessage {
+        ServerMessage::Broadcast {
+            timestamp: "2024-01-02T15:04:05Z".to_string(),
+            id: "1".to_string(),
+            username: username.to_string(),
+            message: "hi".to_string(),
+            reply_to: None,
+        }
+    }
+
+    #[test]
+    fn test_mute_ignores_case() {
+        let muted = MuteList::default();
+        assert!(muted.mute("Bob"));
+        assert!(!muted.mute("bob"));
+        assert!(muted.hides(&broadcast("BOB")));
+        assert!(!muted.hides(&broadcast("alice")));
+        assert_eq!(muted.list(), ["bob"]);
+        assert!(muted.unmute("BOB"));
+        assert!(!muted.unmute("bob"));
+        assert!(!muted.hides(&broadcast("bob")));
+    }
+
+    #[test]
+    fn test_presence_is_never_hidden() {
+        let muted = MuteList::default();
+        muted.mute("bob");
+        let joined = ServerMessage::UserJoined {
+            timestamp: "2024-01-02T15:04:05Z".to_string(),
+            username: "bob".to_string(),
+            room: "#general".to_string(),
+        };
+        assert!(!muted.hides(&joined));
+        assert!(muted.hides(&ServerMessage::History {
+            message: Box::new(broadcast("bob")),
+        }));
+    }
+
+    #[test]
+    fn test_follow_rename() {
+        let muted = MuteList::default();
+        muted.mute("bob");
+        muted.follow(&ServerMessage::Renamed {
+            timestamp: "2024-01-02T15:04:05Z".to_string(),
+            from: "bob".to_string(),
+            to: "bobby".to_string(),
+        });
+        assert_eq!(muted.list(), ["bobby"]);
+    }
+}
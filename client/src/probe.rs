@@ -0,0 +1,74 @@
+//! Round-trip probes sent with `ping`.
+//!
+//! Each probe carries a token of its own, which the server echoes back in a
+//! `PONG`; the time between the two is the round trip. A probe that is not
+//! answered within [`PING_TIMEOUT`] is given up on, and a late answer to it is
+//! ignored, as is a `PONG` for a token this client never sent.
+
+use std::{
+    collections::HashMap,
+    sync::{
+        Arc, Mutex,
+        atomic::{AtomicU64, Ordering},
+    },
+    time::{Duration, Instant},
+};
+
+/// How long `ping` waits for its answer.
+pub const PING_TIMEOUT: Duration = Duration::from_secs(5);
+
+/// Shared between the writer, which sends probes, and the reader, which sees
+/// them answered.
+#[derive(Debug, Clone, Default)]
+pub struct Probes {
+    pending: Arc<Mutex<HashMap<String, Instant>>>,
+    next: Arc<AtomicU64>,
+}
+
+impl Probes {
+    /// Starts timing a new probe and returns the token to send with it.
+    pub fn start(&self) -> String {
+        let token = self.next.fetch_add(1, Ordering::Relaxed).to_string();
+        if let Ok(mut pending) = self.pending.lock() {
+            pending.insert(token.clone(), Instant::now());
+        }
+        token
+    }
+
+    /// The round trip of the probe with `token`, if it is still awaited.
+    pub fn finish(&self, token: &str) -> Option<Duration> {
+        let sent = self.pending.lock().ok()?.remove(token)?;
+        Some(sent.elapsed())
+    }
+
+    /// Gives up on the probe with `token`; `true` if it was still awaited.
+    pub fn expire(&self, token: &str) -> bool {
+        self.pending
+            .lock()
+            .is_ok_and(|mut pending| pending.remove(token).is_some())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_probe_is_answered_once() {
+        let probes = Probes::default();
+        let token = probes.start();
+        assert_ne!(probes.start(), token);
+        assert!(probes.finish(&token).is_some());
+        assert!(probes.finish(&token).is_none());
+        assert!(!probes.expire(&token));
+        assert!(probes.finish("unknown").is_none());
+    }
+
+    #[test]
+    fn test_expired_probe_ignores_late_answer() {
+        let probes = Probes::default();
+        let token = probes.start();
+        assert!(probes.expire(&token));
+        assert!(probes.finish(&token).is_none());
+    }
+}
@@ -0,0 +1,220 @@
+//! Managing the terminal itself: `clear`, and the optional status line.
+//!
+//! With `--status-line` the bottom row shows who we are, the room we are in
+//! and whether we are connected, and stays put while the conversation
+//! scrolls above it: everything else is printed inside a scroll region one
+//! row short of the terminal. The terminal's size is read once, at startup,
+//! so the line goes astray if the terminal is resized; `clear` draws it
+//! again should anything have written over it.
+//!
+//! Nothing here writes a byte when stdout is not a terminal, so piped output,
+//! as in the integration tests, is never touched.
+
+use std::{
+    env,
+    fs::File,
+    io::{self, IsTerminal, Write as _},
+    process::Command,
+    sync::{Arc, Mutex},
+};
+
+const CLEAR_SCREEN: &str = "\x1b[2J\x1b[H";
+const SAVE_CURSOR: &str = "\x1b7";
+const RESTORE_CURSOR: &str = "\x1b8";
+const CLEAR_LINE: &str = "\x1b[2K";
+const RESET_SCROLL_REGION: &str = "\x1b[r";
+const REVERSE: &str = "\x1b[7m";
+const RESET: &str = "\x1b[0m";
+
+/// How the connection stands, as the status line shows it.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum ConnectionState {
+    Connected,
+    Reconnecting,
+    Disconnected,
+}
+
+impl ConnectionState {
+    const fn label(self) -> &'static str {
+        match self {
+            Self::Connected => "connected",
+            Self::Reconnecting => "reconnecting...",
+            Self::Disconnected => "disconnected",
+        }
+    }
+}
+
+/// Shared between the input loop, the reader and whatever reconnects; a
+/// no-op unless it was started on a terminal.
+#[derive(Debug, Clone, Default)]
+pub struct StatusLine {
+    inner: Option<Arc<Mutex<Status>>>,
+}
+
+#[derive(Debug)]
+struct Status {
+    rows: u16,
+    username: String,
+    room: Option<String>,
+    state: ConnectionState,
+}
+
+impl StatusLine {
+    /// Reserves the bottom row for the status line if `wanted`, stdout is a
+    /// terminal and its height can be found out.
+    pub fn start(wanted: bool, username: &str) -> Self {
+        let rows = if wanted && io::stdout().is_terminal() {
+            terminal_rows().filter(|&rows| rows > 2)
+        } else {
+            None
+        };
+        let Some(rows) = rows else {
+            return Self::default();
+        };
+        let status = Status {
+            rows,
+            username: username.to_string(),
+            room: None,
+            state: ConnectionState::Connected,
+        };
+        let above = rows.saturating_sub(1);
+        // setting the region homes the cursor; put it back at the bottom of it
+        write_out(&format!("\x1b[1;{above}r\x1b[{above};1H{}", status.render()));
+        Self {
+            inner: Some(Arc::new(Mutex::new(status))),
+        }
+    }
+
+    pub fn set_username(&self, username: &str) {
+        self.update(|status| {
+            if status.username == username {
+                return false;
+            }
+            status.username = username.to_string();
+            true
+        });
+    }
+
+    pub fn set_room(&self, room: &str) {
+        self.update(|status| {
+            if status.room.as_deref() == Some(room) {
+                return false;
+            }
+            status.room = Some(room.to_string());
+            true
+        });
+    }
+
+    pub fn set_state(&self, state: ConnectionState) {
+        self.update(|status| {
+            if status.state == state {
+                return false;
+            }
+            status.state = state;
+            true
+        });
+    }
+
+    /// Hands the whole terminal back, as it was before [`StatusLine::start`].
+    pub fn stop(&self) {
+        if let Some(status) = self.inner.as_ref().and_then(|inner| inner.lock().ok()) {
+            write_out(&format!(
+                "{SAVE_CURSOR}\x1b[{};1H{CLEAR_LINE}{RESTORE_CURSOR}{RESET_SCROLL_REGION}",
+                status.rows
+            ));
+        }
+    }
+
+    /// Applies `change`, and draws the line again if it says something changed.
+    fn update(&self, change: impl FnOnce(&mut Status) -> bool) {
+        let Some(mut status) = self.inner.as_ref().and_then(|inner| inner.lock().ok()) else {
+            return;
+        };
+        if change(&mut status) {
+            write_out(&status.render());
+        }
+    }
+
+    fn redraw(&self) {
+        self.update(|_| true);
+    }
+}
+
+impl Status {
+    /// The escape codes that draw the line in place, leaving the cursor where it was.
+    fn render(&self) -> String {
+        format!(
+            "{SAVE_CURSOR}\x1b[{};1H{CLEAR_LINE}{REVERSE} {} {RESET}{RESTORE_CURSOR}",
+            self.rows,
+            self.text()
+        )
+    }
+
+    fn text(&self) -> String {
+        let room = self.room.as_deref().unwrap_or("-");
+        format!("{} | {room} | {}", self.username, self.state.label())
+    }
+}
+
+/// Clears the screen, keeping the status line if there is one. Returns
+/// whether it did anything, which it doesn't when stdout is not a terminal.
+pub fn clear(status: &StatusLine) -> bool {
+    if !io::stdout().is_terminal() {
+        return false;
+    }
+    write_out(CLEAR_SCREEN);
+    status.redraw();
+    true
+}
+
+fn write_out(codes: &str) {
+    let mut stdout = io::stdout().lock();
+    let _ = stdout.write_all(codes.as_bytes());
+    let _ = stdout.flush();
+}
+
+/// The terminal's height: `LINES` if the shell exported it, or else what
+/// `stty size` says about the controlling terminal.
+fn terminal_rows() -> Option<u16> {
+    if let Some(rows) = env::var("LINES").ok().and_then(|lines| lines.trim().parse().ok()) {
+        return Some(rows);
+    }
+    let tty = File::open("/dev/tty").ok()?;
+    let output = Command::new("stty").arg("size").stdin(tty).output().ok()?;
+    String::from_utf8(output.stdout)
+        .ok()?
+        .split_whitespace()
+        .next()?
+        .parse()
+        .ok()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_status_text() {
+        let mut status = Status {
+            rows: 24,
+            username: "alice".to_string(),
+            room: None,
+            state: ConnectionState::Connected,
+        };
+        assert_eq!(status.text(), "alice | - | connected");
+        status.room = Some("#dev".to_string());
+        status.state = ConnectionState::Reconnecting;
+        assert_eq!(status.text(), "alice | #dev | reconnecting...");
+        assert!(status.render().starts_with("\x1b7\x1b[24;1H"));
+        assert!(status.render().ends_with("\x1b8"));
+    }
+
+    #[test]
+    fn test_off_unless_wanted() {
+        let status = StatusLine::start(false, "alice");
+        assert!(status.inner.is_none());
+        // and so draws nothing
+        status.set_room("#dev");
+        status.stop();
+    }
+}
@@ -0,0 +1,123 @@
+//! `--script`: commands read from a file instead of typed.
+//!
+//! Each line is a command as it would be typed, run in order, after which the
+//! client leaves. `sleep <ms>` waits before the next line; blank lines and
+//! lines starting with `#` are skipped.
+
+use std::{
+    fs,
+    path::Path,
+    sync::atomic::{AtomicBool, Ordering},
+    thread,
+    time::Duration,
+};
+
+use common::consts;
+use tokio::sync::mpsc;
+
+/// How often a `sleep` looks up to see whether the client is done already.
+const SLEEP_SLICE: Duration = Duration::from_millis(100);
+
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum Step {
+    Command(String),
+    Sleep(Duration),
+}
+
+/// The steps in the script at `path`, or why there are none to run.
+pub fn load(path: &Path) -> Result<Vec<Step>, String> {
+    let script = fs::read_to_string(path).map_err(|e| format!("cannot read {}: {e}", path.display()))?;
+    parse(&script).map_err(|e| format!("{}: {e}", path.display()))
+}
+
+/// The steps in a script, or which line is wrong and why.
+pub fn parse(script: &str) -> Result<Vec<Step>, String> {
+    let mut steps = Vec::new();
+    for (number, line) in (1_usize..).zip(script.lines()) {
+        let line = line.trim();
+        if line.is_empty() || line.starts_with('#') {
+            continue;
+        }
+        let sleep = line
+            .split_once(' ')
+            .filter(|(directive, _)| directive.eq_ignore_ascii_case(consts::CLIENT_SCRIPT_SLEEP))
+            .map(|(_, ms)| ms.trim());
+        let is_sleep = sleep.is_some() || line.eq_ignore_ascii_case(consts::CLIENT_SCRIPT_SLEEP);
+        if is_sleep {
+            let ms = sleep
+                .and_then(|ms| ms.parse().ok())
+                .ok_or_else(|| format!("line {number}: usage: sleep <milliseconds>"))?;
+            steps.push(Step::Sleep(Duration::from_millis(ms)));
+        } else {
+            steps.push(Step::Command(line.to_string()));
+        }
+    }
+    Ok(steps)
+}
+
+/// Feeds `steps` to the client as if typed, then leaves. Stops early once
+/// `shutdown` is set, e.g. because the server went away.
+pub fn run(steps: &[Step], cmd_tx: &mpsc::Sender<String>, shutdown: &AtomicBool) {
+    for step in steps {
+        if shutdown.load(Ordering::SeqCst) {
+            return;
+        }
+        match step {
+            Step::Command(command) => {
+                if cmd_tx.blocking_send(command.clone()).is_err() {
+                    return;
+                }
+            }
+            Step::Sleep(duration) => sleep(*duration, shutdown),
+        }
+    }
+    // the script may have left already, in which case nobody is listening
+    let _ = cmd_tx.blocking_send(consts::CLIENT_LEAVE_CMD.to_lowercase());
+}
+
+fn sleep(duration: Duration, shutdown: &AtomicBool) {
+    let mut left = duration;
+    while !left.is_zero() && !shutdown.load(Ordering::SeqCst) {
+        let slice = left.min(SLEEP_SLICE);
+        thread::sleep(slice);
+        left = left.saturating_sub(slice);
+    }
+}
+
+#[cfg(test)]
+#[allow(clippy::unwrap_used)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_parse_script() {
+        let script = "# greet\nsend hi\n\n  SLEEP 250 \nsleepy send\nwho\n";
+        assert_eq!(
+            parse(script).unwrap(),
+            vec![
+                Step::Command("send hi".to_string()),
+                Step::Sleep(Duration::from_millis(250)),
+                Step::Command("sleepy send".to_string()),
+                Step::Command("who".to_string()),
+            ]
+        );
+    }
+
+    #[test]
+    fn test_parse_bad_sleep() {
+        assert_eq!(
+            parse("who\nsleep soon").unwrap_err(),
+            "line 2: usage: sleep <milliseconds>"
+        );
+        assert!(parse("sleep").is_err());
+    }
+
+    #[test]
+    fn test_run_leaves_at_the_end() {
+        let (cmd_tx, mut cmd_rx) = mpsc::channel(8);
+        let steps = parse("send hi\nsleep 1\nwho").unwrap();
+        run(&steps, &cmd_tx, &AtomicBool::new(false));
+        let sent: Vec<String> = std::iter::from_fn(|| cmd_rx.try_recv().ok()).collect();
+        assert_eq!(sent, ["send hi", "who", "leave"]);
+    }
+}
@@ -0,0 +1,111 @@
+//! Times put in front of what the client prints, with `--timestamps` or
+//! `ts on`.
+//!
+//! Over JSON a message that carries the server's `ts` is shown at that time;
+//! anything else, and everything over the text protocol, at the moment it
+//! arrived. Either way the time is local and in the `--timestamp-format`.
+
+use std::{
+    fmt::Write as _,
+    str::FromStr,
+    sync::{
+        Arc,
+        atomic::{AtomicBool, Ordering},
+    },
+};
+
+use common::tcp_message::ServerMessage;
+use jiff::{Timestamp, Zoned, tz::TimeZone};
+
+#[derive(Debug, Clone)]
+pub struct Stamps {
+    on: Arc<AtomicBool>,
+    format: Arc<str>,
+    from_server: bool,
+}
+
+impl Stamps {
+    /// Fails with a reason if `format` is not one jiff can render.
+    pub fn new(on: bool, format: &str, from_server: bool) -> Result<Self, String> {
+        render(&Zoned::now(), format).ok_or_else(|| format!("invalid timestamp format: {format}"))?;
+        Ok(Self {
+            on: Arc::new(AtomicBool::new(on)),
+            format: Arc::from(format),
+            from_server,
+        })
+    }
+
+    pub fn set(&self, on: bool) {
+        self.on.store(on, Ordering::Relaxed);
+    }
+
+    /// What to print ahead of `msg`, empty while timestamps are off.
+    pub fn stamp(&self, msg: Option<&ServerMessage>) -> String {
+        if !self.on.load(Ordering::Relaxed) {
+            return String::new();
+        }
+        let at = msg
+            .filter(|_| self.from_server)
+            .and_then(server_time)
+            .and_then(|ts| Timestamp::from_str(ts).ok())
+            .map_or_else(Zoned::now, |ts| ts.to_zoned(TimeZone::system()));
+        render(&at, &self.format).map_or_else(String::new, |time| format!("[{time}] "))
+    }
+}
+
+/// `at` in `format`, or `None` if the format is no good.
+fn render(at: &Zoned, format: &str) -> Option<String> {
+    let mut rendered = String::new();
+    write!(rendered, "{}", at.strftime(format)).ok()?;
+    Some(rendered)
+}
+
+/// When the server says `msg` happened, if it says.
+fn server_time(msg: &ServerMessage) -> Option<&str> {
+    match msg {
+        ServerMessage::Broadcast { timestamp, .. }
+        | ServerMessage::Edited { timestamp, .. }
+        | ServerMessage::Deleted { timestamp, .. }
+        | ServerMessage::Presence { timestamp, .. }
+        | ServerMessage::Action { timestamp, .. }
+        | ServerMessage::UserJoined { timestamp, .. }
+        | ServerMessage::UserLeft { timestamp, .. }
+        | ServerMessage::Renamed { timestamp, .. }
+        | ServerMessage::File { timestamp, .. }
+        | ServerMessage::Announcement { timestamp, .. } => Some(timestamp),
+        ServerMessage::History { message } => server_time(message),
+        _ => None,
+    }
+}
+
+#[cfg(test)]
+#[allow(clippy::unwrap_used)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_stamp_only_when_on() {
+        let stamps = Stamps::new(false, "%H:%M:%S", false).unwrap();
+        assert_eq!(stamps.stamp(None), "");
+        stamps.set(true);
+        let stamp = stamps.stamp(None);
+        assert!(stamp.starts_with('[') && stamp.ends_with("] "));
+    }
+
+    #[test]
+    fn test_server_time() {
+        let line = ServerMessage::Broadcast {
+            timestamp: "2024-01-02T15:04:05Z".to_string(),
+            id: "1".to_string(),
+            username: "bob".to_string(),
+            message: "hi".to_string(),
+            reply_to: None,
+        };
+        assert_eq!(server_time(&line), Some("2024-01-02T15:04:05Z"));
+        let replayed = ServerMessage::History {
+            message: Box::new(line),
+        };
+        assert_eq!(server_time(&replayed), Some("2024-01-02T15:04:05Z"));
+        assert_eq!(server_time(&ServerMessage::Info { text: String::new() }), None);
+    }
+}
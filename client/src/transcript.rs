@@ -0,0 +1,141 @@
+//! A copy of the conversation kept on the user's side, written out with
+//! `save <path>`.
+//!
+//! Every line the server sends, keepalives and typing notices aside, is kept
+//! from the moment the client starts, up to the last [`CAPACITY`] of them.
+//! Saving writes those to the file, each behind the local time it arrived,
+//! and every line after that is appended as it comes in. Nothing here has to
+//! do with the server's own `CHAT_LOG_FILE`.
+
+use std::{
+    collections::VecDeque,
+    fs::{File, OpenOptions},
+    io::{self, Write as _},
+    path::{Path, PathBuf},
+    sync::{Arc, Mutex},
+};
+
+use common::{
+    consts,
+    tcp_message::{FIELD_SEPARATOR, ServerMessage},
+};
+use jiff::Zoned;
+
+/// How many received lines are kept for a later `save`.
+pub const CAPACITY: usize = 10_000;
+
+const TIME_FORMAT: &str = "%Y-%m-%d %H:%M:%S%:z";
+
+/// Shared between the input loop, which starts saving, and the reader, which
+/// records.
+#[derive(Debug, Clone, Default)]
+pub struct Transcript {
+    inner: Arc<Mutex<Kept>>,
+}
+
+#[derive(Debug, Default)]
+struct Kept {
+    lines: VecDeque<String>,
+    saving: Option<(PathBuf, File)>,
+}
+
+impl Transcript {
+    /// Keeps `line`, as received, and appends it to the file being saved to.
+    /// A failed write stops the saving, and comes back with the reason.
+    pub fn record(&self, msg: Option<&ServerMessage>, line: &str) -> Result<(), String> {
+        if matches!(
+            msg,
+            Some(
+                ServerMessage::Ping
+                    | ServerMessage::Pong { .. }
+                    | ServerMessage::Typing { .. }
+                    | ServerMessage::UserList { .. }
+            )
+        ) {
+            return Ok(());
+        }
+        let Ok(mut kept) = self.inner.lock() else {
+            return Ok(());
+        };
+        // over JSON too, the transcript reads like the text protocol; a
+        // shared file is kept by its name and size, not what is in it
+        let received = match msg {
+            Some(ServerMessage::File {
+                timestamp,
+                username,
+                name,
+                size,
+                ..
+            }) => [consts::SERVER_EVENT_FILE, timestamp, username, name, &size.to_string()].join(FIELD_SEPARATOR),
+            Some(msg) => msg.to_string(),
+            None => line.to_string(),
+        };
+        let line = format!("[{}] {received}", Zoned::now().strftime(TIME_FORMAT));
+        let written = match &mut kept.saving {
+            Some((path, file)) => writeln!(file, "{line}").map_err(|e| (path.clone(), e)),
+            None => Ok(()),
+        };
+        if kept.lines.len() >= CAPACITY {
+            kept.lines.pop_front();
+        }
+        kept.lines.push_back(line);
+        written.map_err(|(path, e)| {
+            kept.saving = None;
+            format!("Stopped saving to {}: {e}", path.display())
+        })
+    }
+
+    /// Writes what was received so far to `path`, appending to whatever is
+    /// there, and keeps appending from now on. Returns how many lines went in.
+    ///
+    /// # Errors
+    ///
+    /// Fails if the file can't be opened or written; any earlier `save`
+    /// carries on as before.
+    pub fn save(&self, path: &Path) -> io::Result<usize> {
+        let mut file = OpenOptions::new().create(true).append(true).open(path)?;
+        let mut kept = self
+            .inner
+            .lock()
+            .map_err(|_| io::Error::other("transcript unavailable"))?;
+        for line in &kept.lines {
+            writeln!(file, "{line}")?;
+        }
+        let saved = kept.lines.len();
+        kept.saving = Some((path.to_path_buf(), file));
+        drop(kept);
+        Ok(saved)
+    }
+}
+
+#[cfg(test)]
+#[allow(clippy::unwrap_used)]
+mod tests {
+    use std::fs;
+
+    use super::*;
+
+    #[test]
+    fn test_transcript_saves_and_appends() {
+        let path = std::env::temp_dir().join(format!("simple-chat-transcript-{}", std::process::id()));
+        let _ = fs::remove_file(&path);
+        let transcript = Transcript::default();
+        let hello = ServerMessage::Info {
+            text: "hello".to_string(),
+        };
+        transcript.record(Some(&hello), "INFO|hello").unwrap();
+        transcript.record(Some(&ServerMessage::Ping), "PING").unwrap();
+        assert_eq!(transcript.save(&path).unwrap(), 1);
+
+        transcript.record(None, "not a message").unwrap();
+        let saved = fs::read_to_string(&path).unwrap();
+        let lines: Vec<_> = saved.lines().collect();
+        assert_eq!(lines.len(), 2);
+        assert!(lines.first().unwrap().starts_with('['));
+        assert!(lines.first().unwrap().ends_with("] INFO|hello"));
+        assert!(lines.get(1).unwrap().ends_with("] not a message"));
+        fs::remove_file(&path).unwrap();
+
+        assert!(transcript.save(Path::new("/nonexistent/dir/chat.log")).is_err());
+    }
+}
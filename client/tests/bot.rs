@@ -0,0 +1,93 @@
+//! Drives [`client::Client`] against a server running in-process, the way a
+//! bot would.
+
+#![allow(clippy::unwrap_used)]
+
+use std::time::Duration;
+
+use client::{Client, Event, connection::Options};
+use common::{consts, tcp_message::ClientMessage};
+use server::{Config, Server};
+use tokio::{
+    sync::{mpsc, oneshot},
+    time::timeout,
+};
+
+const EVENT_TIMEOUT: Duration = Duration::from_secs(5);
+
+/// The next event `events` has that `wanted` accepts.
+async fn next_matching(events: &mut mpsc::UnboundedReceiver<Event>, wanted: fn(&Event) -> bool) -> Event {
+    timeout(EVENT_TIMEOUT, async {
+        loop {
+            let event = events.recv().await.unwrap();
+            if wanted(&event) {
+                return event;
+            }
+        }
+    })
+    .await
+    .unwrap()
+}
+
+#[tokio::test]
+async fn test_bot_hears_the_room() {
+    let config = Config {
+        port: 0,
+        shutdown_grace: Duration::ZERO,
+        ..Config::default()
+    };
+    let (stop, stopped) = oneshot::channel::<()>();
+    let running = Server::new(config)
+        .start(async {
+            let _ = stopped.await;
+        })
+        .await
+        .unwrap();
+    let port = running.local_addr().unwrap().port();
+
+    let mut bot = Client::connect(&Options::new("127.0.0.1", port, "bot")).await.unwrap();
+    assert!(bot.server().supports(consts::CAP_ROOMS));
+    assert!(!bot.server().supports(consts::CAP_TLS));
+    let (events_tx, mut events) = mpsc::unbounded_channel();
+    bot.on(move |event| {
+        let _ = events_tx.send(event);
+    });
+
+    let carol = Client::connect(&Options::new("127.0.0.1", port, "carol"))
+        .await
+        .unwrap();
+    let joined = next_matching(
+        &mut events,
+        |event| matches!(event, Event::Joined { username, .. } if username == "carol"),
+    )
+    .await;
+    assert!(matches!(joined, Event::Joined { room, .. } if room == "#general"));
+
+    carol
+        .send(&ClientMessage::Send {
+            id: None,
+            message: "hello bot".to_string(),
+        })
+        .await
+        .unwrap();
+    let heard = next_matching(&mut events, |event| matches!(event, Event::Message { .. })).await;
+    assert!(matches!(heard, Event::Message { from, text, .. } if from == "carol" && text == "hello bot"));
+
+    assert!(
+        Client::connect(&Options::new("127.0.0.1", port, "CAROL"))
+            .await
+            .is_err()
+    );
+
+    carol.close().await.unwrap();
+    next_matching(
+        &mut events,
+        |event| matches!(event, Event::Left { username, .. } if username == "carol"),
+    )
+    .await;
+    bot.close().await.unwrap();
+    next_matching(&mut events, |event| *event == Event::Closed).await;
+
+    stop.send(()).unwrap();
+    timeout(EVENT_TIMEOUT, running.stopped()).await.unwrap();
+}
@@ -0,0 +1,62 @@
+//! The color each username is shown in, the same on every client.
+//!
+//! A name's color is picked by a hash of its lowercased form, as the server
+//! matches names regardless of case. JSON clients get it as `color` on every
+//! event that names a user; the terminal client paints with the nearest ANSI
+//! color, by the same index.
+
+/// Colors a username may get, as `#rrggbb`. None of them is used for
+/// anything but usernames.
+pub const USER_COLORS: [&str; 10] = [
+    "#cd3131", "#0dbc79", "#e5e510", "#2472c8", "#11a8cd", "#f14c4c", "#23d18b", "#f5f543", "#3b8eea", "#29b8db",
+];
+
+/// Where `username`'s color is in [`USER_COLORS`].
+///
+/// FNV-1a over the lowercased name; unlike `DefaultHasher` it gives the same
+/// answer on every build.
+#[must_use]
+pub fn user_color_index(username: &str) -> usize {
+    let hash = username
+        .to_lowercase()
+        .bytes()
+        .fold(0xcbf2_9ce4_8422_2325_u64, |hash, byte| {
+            (hash ^ u64::from(byte)).wrapping_mul(0x0100_0000_01b3)
+        });
+    let count = u64::try_from(USER_COLORS.len()).unwrap_or(u64::MAX);
+    usize::try_from(hash.checked_rem(count).unwrap_or_default()).unwrap_or_default()
+}
+
+/// `username`'s color, as `#rrggbb`.
+#[must_use]
+pub fn user_color(username: &str) -> &'static str {
+    USER_COLORS
+        .get(user_color_index(username))
+        .copied()
+        .unwrap_or(USER_COLORS[0])
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_user_color_is_stable_and_ignores_case() {
+        assert_eq!(user_color("alice"), user_color("ALICE"));
+        assert_eq!(user_color("alice"), user_color("alice"));
+        let names = ["alice", "bob", "carol", "dave", "erin", "frank"];
+        assert!(names.iter().any(|name| user_color(name) != user_color("alice")));
+        // pinned: every client that ever saw alice has her in this color
+        assert_eq!(user_color("alice"), "#2472c8");
+        assert_eq!(user_color("bob"), "#e5e510");
+    }
+
+    #[test]
+    fn test_user_colors_are_hex() {
+        for color in USER_COLORS {
+            assert_eq!(color.len(), 7);
+            assert!(color.starts_with('#'));
+            assert!(color.chars().skip(1).all(|c| c.is_ascii_hexdigit()));
+        }
+    }
+}
@@ -30,18 +30,43 @@ impl fmt::Display for InvalidLogLevelError {
 
 impl std::error::Error for InvalidLogLevelError {}
 
+/// Error returned when an invalid log format is specified.
+#[derive(Debug, Clone)]
+pub struct InvalidLogFormatError {
+    pub format: String,
+}
+
+impl fmt::Display for InvalidLogFormatError {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "Invalid log format: '{}'. Must be one of: text, json", self.format)
+    }
+}
+
+impl std::error::Error for InvalidLogFormatError {}
+
+/// How log events are written.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum LogFormat {
+    /// Human-readable, with colors
+    Text,
+    /// One JSON object per event, for log aggregation
+    Json,
+}
+
 #[must_use]
 pub fn app_env() -> String {
     env::var(consts::APP_ENV).unwrap_or_else(|_| consts::APP_ENV_DEFAULT_VALUE.to_owned())
 }
 
-/// Returns the configured log level.
+/// Returns the configured log level, from `CHAT_LOG_LEVEL`, `CHAT_APP_LOG_LEVEL`
+/// or `RUST_LOG`, in that order.
 ///
 /// # Errors
 ///
 /// Returns an error if the log level is not one of: trace, debug, info, warn, error, off.
 pub fn log_level() -> Result<String, InvalidLogLevelError> {
-    let level = env::var(consts::DEFAULT_LOG_LEVEL)
+    let level = env::var(consts::ENV_CHAT_LOG_LEVEL)
+        .or_else(|_| env::var(consts::DEFAULT_LOG_LEVEL))
         .or_else(|_| env::var("RUST_LOG"))
         .unwrap_or_else(|_| consts::DEFAULT_LOG_LEVEL_DEFAULT_VALUE.to_owned());
 
@@ -52,7 +77,37 @@ pub fn log_level() -> Result<String, InvalidLogLevelError> {
     }
 }
 
+/// Returns the configured log format from `CHAT_LOG_FORMAT`. Without it,
+/// production logs JSON and anything else text.
+///
+/// # Errors
+///
+/// Returns an error if the log format is not one of: text, json.
+pub fn log_format() -> Result<LogFormat, InvalidLogFormatError> {
+    let Ok(format) = env::var(consts::ENV_CHAT_LOG_FORMAT) else {
+        return Ok(if is_production() {
+            LogFormat::Json
+        } else {
+            LogFormat::Text
+        });
+    };
+    match format.to_lowercase().as_str() {
+        "text" => Ok(LogFormat::Text),
+        "json" => Ok(LogFormat::Json),
+        _ => Err(InvalidLogFormatError { format }),
+    }
+}
+
 #[must_use]
 pub fn is_production() -> bool {
     app_env() == consts::APP_ENV_PROD_VALUE
 }
+
+/// `host` without the brackets an IPv6 literal may be written in, as in a
+/// URL: `[::1]` is `::1`. Anything else is returned as it is.
+#[must_use]
+pub fn unbracket(host: &str) -> &str {
+    host.strip_prefix('[')
+        .and_then(|host| host.strip_suffix(']'))
+        .unwrap_or(host)
+}
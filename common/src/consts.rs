@@ -4,32 +4,301 @@ pub const BACKBONE_DEFAULT_SEND_TIMEOUT: Duration = Duration::from_millis(100);
 pub const BACKBONE_DEFAULT_RECV_TIMEOUT: Duration = Duration::from_millis(100);
 pub const ENV_CHAT_HOST: &str = "CHAT_HOST";
 pub const ENV_CHAT_PORT: &str = "CHAT_PORT";
+pub const ENV_CHAT_LISTEN: &str = "CHAT_LISTEN";
 pub const ENV_CHAT_USERNAME: &str = "CHAT_USERNAME";
+pub const ENV_CHAT_HISTORY_SIZE: &str = "CHAT_HISTORY_SIZE";
+pub const ENV_CHAT_ROOM_HISTORY_SIZES: &str = "CHAT_ROOM_HISTORY_SIZES";
+pub const ENV_CHAT_PING_INTERVAL: &str = "CHAT_PING_INTERVAL";
+pub const ENV_CHAT_PONG_TIMEOUT: &str = "CHAT_PONG_TIMEOUT";
+pub const ENV_CHAT_IDLE_TIMEOUT: &str = "CHAT_IDLE_TIMEOUT";
+pub const ENV_CHAT_READ_TIMEOUT: &str = "CHAT_READ_TIMEOUT";
+pub const ENV_CHAT_WRITE_TIMEOUT: &str = "CHAT_WRITE_TIMEOUT";
+pub const ENV_CHAT_RATE_LIMIT: &str = "CHAT_RATE_LIMIT";
+pub const ENV_CHAT_RATE_BURST: &str = "CHAT_RATE_BURST";
+pub const ENV_CHAT_MAX_MSG_LEN: &str = "CHAT_MAX_MSG_LEN";
+pub const ENV_CHAT_MAX_FILE_SIZE: &str = "CHAT_MAX_FILE_SIZE";
+pub const ENV_CHAT_FILE_QUOTA: &str = "CHAT_FILE_QUOTA";
+pub const ENV_CHAT_MAX_CLIENTS: &str = "CHAT_MAX_CLIENTS";
+pub const ENV_CHAT_PASSWORD: &str = "CHAT_PASSWORD";
+pub const ENV_CHAT_TLS_CERT: &str = "CHAT_TLS_CERT";
+pub const ENV_CHAT_TLS_KEY: &str = "CHAT_TLS_KEY";
+pub const ENV_CHAT_TLS_MIN_VERSION: &str = "CHAT_TLS_MIN_VERSION";
+pub const ENV_CHAT_SHUTDOWN_GRACE: &str = "CHAT_SHUTDOWN_GRACE";
+pub const ENV_CHAT_ADMIN_TOKEN: &str = "CHAT_ADMIN_TOKEN";
+pub const ENV_CHAT_BANFILE: &str = "CHAT_BANFILE";
+pub const ENV_CHAT_RESERVED_NAMES: &str = "CHAT_RESERVED_NAMES";
+pub const ENV_CHAT_MOTD: &str = "CHAT_MOTD";
+pub const ENV_CHAT_MOTD_FILE: &str = "CHAT_MOTD_FILE";
+pub const ENV_CHAT_LOG_FILE: &str = "CHAT_LOG_FILE";
+pub const ENV_CHAT_LOG_STRICT: &str = "CHAT_LOG_STRICT";
+pub const ENV_CHAT_METRICS_ADDR: &str = "CHAT_METRICS_ADDR";
+pub const ENV_CHAT_HEALTH_ADDR: &str = "CHAT_HEALTH_ADDR";
+pub const ENV_CHAT_LOG_FORMAT: &str = "CHAT_LOG_FORMAT";
+pub const ENV_CHAT_LOG_LEVEL: &str = "CHAT_LOG_LEVEL";
+pub const ENV_CHAT_CONFIG: &str = "CHAT_CONFIG";
+pub const ENV_CHAT_SESSION_GRACE: &str = "CHAT_SESSION_GRACE";
+pub const ENV_CHAT_SESSION_MAX_HELD: &str = "CHAT_SESSION_MAX_HELD";
+pub const ENV_CHAT_FILTER_FILE: &str = "CHAT_FILTER_FILE";
+pub const ENV_CHAT_CONNECT_RATE: &str = "CHAT_CONNECT_RATE";
+pub const ENV_CHAT_NOTIFY: &str = "CHAT_NOTIFY";
+pub const ENV_CHAT_ALIASES: &str = "CHAT_ALIASES";
+pub const ENV_CHAT_ROOM_POLICIES: &str = "CHAT_ROOM_POLICIES";
+pub const ENV_CHAT_STORE: &str = "CHAT_STORE";
+pub const ENV_CHAT_TS_FORMAT: &str = "CHAT_TS_FORMAT";
+pub const ENV_CHAT_NAME_COOLDOWN: &str = "CHAT_NAME_COOLDOWN";
+
+// the server's first line: its name and version, then what it supports
+pub const SERVER_EVENT_HELLO: &str = "HELLO";
+pub const SERVER_EVENT_HELLO_PREFIX: &str = "HELLO ";
+pub const SERVER_NAME: &str = "simple-chat";
+pub const HELLO_CAPS_PREFIX: &str = "caps=";
+pub const CAP_JSON: &str = "json";
+pub const CAP_TLS: &str = "tls";
+pub const CAP_ROOMS: &str = "rooms";
+pub const CAP_HISTORY: &str = "history";
+pub const CAP_DEFLATE: &str = "deflate";
+pub const CAP_FILES: &str = "files";
+pub const CAP_SEQ: &str = "seq";
+pub const CAP_BINARY: &str = "binary";
 
 pub const SERVER_EVENT_OK: &str = "OK";
 pub const SERVER_EVENT_OK_PREFIX: &str = "OK";
 
 pub const SERVER_EVENT_BROADCAST: &str = "BROADCAST";
 pub const SERVER_EVENT_BROADCAST_PREFIX: &str = "BROADCAST ";
+// a `BROADCAST` that replies to an earlier line, named by its id
+pub const SERVER_EVENT_REPLY: &str = "REPLY";
 
 pub const SERVER_EVENT_ERR: &str = "ERR";
 pub const SERVER_EVENT_ERR_PREFIX: &str = "ERR ";
+// the answer to a `rejoin` whose token was spent, ran out or was evicted
+pub const ERR_SESSION_INVALID: &str = "invalid or expired session";
 
 pub const SERVER_EVENT_USER_JOINED: &str = "JOINED";
 pub const SERVER_EVENT_USER_JOINED_PREFIX: &str = "JOINED ";
 
 pub const SERVER_EVENT_USER_LEFT: &str = "LEFT";
 pub const SERVER_EVENT_USER_LEFT_PREFIX: &str = "LEFT ";
+// after the room, when the connection dropped rather than the user leaving
+pub const LEFT_DISCONNECTED: &str = "disconnected";
+
+pub const SERVER_EVENT_DM: &str = "DM";
+pub const SERVER_EVENT_DM_PREFIX: &str = "DM ";
+
+pub const SERVER_EVENT_ACTION: &str = "ACTION";
+pub const SERVER_EVENT_ACTION_PREFIX: &str = "ACTION ";
+
+pub const SERVER_EVENT_INFO: &str = "INFO";
+pub const SERVER_EVENT_INFO_PREFIX: &str = "INFO ";
+
+pub const SERVER_EVENT_HISTORY: &str = "HISTORY";
+pub const SERVER_EVENT_HISTORY_PREFIX: &str = "HISTORY ";
+// a room's chat line with its number in the room, `SEQ|<n>|<line>`
+pub const SERVER_EVENT_SEQ: &str = "SEQ";
+// ahead of a resync replay, the first number the room's history still has
+pub const SERVER_EVENT_TRUNCATED: &str = "TRUNCATED";
+
+pub const SERVER_EVENT_PING: &str = "PING";
+pub const SERVER_EVENT_PING_PREFIX: &str = "PING";
+
+// answers a client `PING`, echoing its token
+pub const SERVER_EVENT_PONG: &str = "PONG";
+
+// the last line after a `LEAVE`, once the room has been told
+pub const SERVER_EVENT_GOODBYE: &str = "GOODBYE";
+
+pub const SERVER_EVENT_RENAMED: &str = "RENAMED";
+pub const SERVER_EVENT_RENAMED_PREFIX: &str = "RENAMED ";
+
+pub const SERVER_EVENT_SHUTDOWN: &str = "SHUTDOWN";
+pub const SERVER_EVENT_SHUTDOWN_PREFIX: &str = "SHUTDOWN";
+
+pub const SERVER_EVENT_SESSION: &str = "SESSION";
+pub const SERVER_EVENT_SESSION_PREFIX: &str = "SESSION ";
+
+pub const SERVER_EVENT_TYPING: &str = "TYPING";
+pub const SERVER_EVENT_TYPING_PREFIX: &str = "TYPING ";
+pub const TYPING_STARTED: &str = "start";
+pub const TYPING_STOPPED: &str = "stop";
+
+pub const SERVER_EVENT_ACK: &str = "ACK";
+pub const SERVER_EVENT_ACK_PREFIX: &str = "ACK ";
+
+pub const SERVER_EVENT_NACK: &str = "NACK";
+pub const SERVER_EVENT_NACK_PREFIX: &str = "NACK ";
+
+// a chat line, known by the id its `BROADCAST` carried, was changed or taken back by its sender
+pub const SERVER_EVENT_EDITED: &str = "EDITED";
+pub const SERVER_EVENT_EDITED_PREFIX: &str = "EDITED ";
+
+pub const SERVER_EVENT_DELETED: &str = "DELETED";
+pub const SERVER_EVENT_DELETED_PREFIX: &str = "DELETED ";
+
+// someone in the room went away, with an optional note, or came back
+pub const SERVER_EVENT_PRESENCE: &str = "PRESENCE";
+pub const SERVER_EVENT_PRESENCE_PREFIX: &str = "PRESENCE ";
+pub const PRESENCE_AWAY: &str = "away";
+pub const PRESENCE_BACK: &str = "back";
+
+// an operator's notice to everyone online, whatever their room
+pub const SERVER_EVENT_ANNOUNCE: &str = "ANNOUNCE";
+pub const SERVER_EVENT_ANNOUNCE_PREFIX: &str = "ANNOUNCE ";
+
+// a file someone shared with the room, its contents base64-encoded
+pub const SERVER_EVENT_FILE: &str = "FILE";
+pub const SERVER_EVENT_FILE_PREFIX: &str = "FILE ";
+
+// everyone in a room, sent after its members change; only JSON clients get it
+pub const SERVER_EVENT_USERLIST: &str = "USERLIST";
+pub const SERVER_EVENT_USERLIST_PREFIX: &str = "USERLIST ";
 
 pub const CLIENT_JOIN_CMD: &str = "JOIN";
 pub const CLIENT_JOIN_PREFIX: &str = "JOIN";
 
+// resumes a dropped session, in place of `JOIN`
+pub const CLIENT_REJOIN_CMD: &str = "REJOIN";
+pub const CLIENT_REJOIN_PREFIX: &str = "REJOIN ";
+
+// before joining, asks for the rest of the connection to be deflate-compressed
+pub const CLIENT_COMPRESS_CMD: &str = "COMPRESS";
+
+// asks for chat lines to come numbered, as `SEQ|<n>|<line>`
+pub const CLIENT_SEQ_CMD: &str = "SEQ";
+
+// lets `send` carry bytes that aren't UTF-8, which the room gets as a file
+pub const CLIENT_BINARY_CMD: &str = "BINARY";
+// the name such a `send` is shared under
+pub const BINARY_FILE_NAME: &str = "message.bin";
+
+// asks for the room's history again, all of it or the lines after a number
+pub const CLIENT_RESYNC_CMD: &str = "RESYNC";
+pub const CLIENT_RESYNC_PREFIX: &str = "RESYNC ";
+
 pub const CLIENT_SEND_CMD: &str = "SEND";
 pub const CLIENT_SEND_PREFIX: &str = "SEND ";
 
+// `send` with an id the server echoes back in `ACK` or `NACK`; a verb of its
+// own, since all of a `SEND` after the command, `|` included, is its text
+pub const CLIENT_SEND_ID_CMD: &str = "SENDID";
+pub const CLIENT_SEND_ID_PREFIX: &str = "SENDID ";
+
+// `send` in reply to an earlier line in the room, and the same with an id
+pub const CLIENT_REPLY_CMD: &str = "REPLY";
+pub const CLIENT_REPLY_PREFIX: &str = "REPLY ";
+pub const CLIENT_REPLY_ID_CMD: &str = "REPLYID";
+
+pub const CLIENT_ME_CMD: &str = "ME";
+pub const CLIENT_ME_PREFIX: &str = "ME ";
+
 pub const CLIENT_LEAVE_CMD: &str = "LEAVE";
 pub const CLIENT_LEAVE_PREFIX: &str = "LEAVE ";
 
+pub const CLIENT_DM_CMD: &str = "DM";
+pub const CLIENT_DM_PREFIX: &str = "DM ";
+
+// typed as `dm-history <user>`; the server replays its own copy of the conversation
+pub const CLIENT_DM_HISTORY_CMD: &str = "DMHISTORY";
+pub const CLIENT_DM_HISTORY_PREFIX: &str = "DM-HISTORY ";
+
+// typed as `join #room`, sent as `ROOM|#room` so it never clashes with the `JOIN` handshake
+pub const CLIENT_ROOM_CMD: &str = "ROOM";
+pub const CLIENT_ROOM_PREFIX: &str = "JOIN ";
+
+pub const CLIENT_ROOMS_CMD: &str = "ROOMS";
+
+pub const CLIENT_WHO_CMD: &str = "WHO";
+pub const CLIENT_WHO_ALIAS: &str = "LIST";
+
+// answered by the server with the commands it takes from this user
+pub const CLIENT_HELP_CMD: &str = "HELP";
+
+pub const CLIENT_PONG_CMD: &str = "PONG";
+
+// typed as `ping`; a round-trip probe the server answers with `PONG`
+pub const CLIENT_PING_CMD: &str = "PING";
+pub const CLIENT_PING_PREFIX: &str = "PING";
+
+// sent by the client on its own while a chat line is being typed
+pub const CLIENT_TYPING_CMD: &str = "TYPING";
+
+pub const CLIENT_NICK_CMD: &str = "NICK";
+pub const CLIENT_NICK_PREFIX: &str = "NICK ";
+
+// operator commands
+pub const CLIENT_AUTH_CMD: &str = "AUTH";
+pub const CLIENT_AUTH_PREFIX: &str = "AUTH ";
+
+pub const CLIENT_KICK_CMD: &str = "KICK";
+pub const CLIENT_KICK_PREFIX: &str = "KICK ";
+
+pub const CLIENT_BAN_CMD: &str = "BAN";
+pub const CLIENT_BAN_PREFIX: &str = "BAN ";
+
+pub const CLIENT_UNBAN_CMD: &str = "UNBAN";
+pub const CLIENT_UNBAN_PREFIX: &str = "UNBAN ";
+
+pub const CLIENT_STATS_CMD: &str = "STATS";
+
+// typed as `who-all`
+pub const CLIENT_WHO_ALL_CMD: &str = "WHOALL";
+pub const CLIENT_WHO_ALL_INPUT: &str = "WHO-ALL";
+
+pub const CLIENT_CONNS_CMD: &str = "CONNS";
+
+pub const CLIENT_DROP_CMD: &str = "DROP";
+pub const CLIENT_DROP_PREFIX: &str = "DROP ";
+
+pub const CLIENT_BROADCAST_CMD: &str = "BROADCAST";
+pub const CLIENT_BROADCAST_PREFIX: &str = "BROADCAST ";
+
+// typed as `room-policy #room [limits]`
+pub const CLIENT_ROOM_POLICY_CMD: &str = "ROOMPOLICY";
+pub const CLIENT_ROOM_POLICY_PREFIX: &str = "ROOM-POLICY ";
+
+// typed as `sendfile <path>`; the client reads the file and sends it as `FILE|name|data`
+pub const CLIENT_FILE_CMD: &str = "FILE";
+pub const CLIENT_SENDFILE_CMD: &str = "SENDFILE";
+pub const CLIENT_SENDFILE_PREFIX: &str = "SENDFILE ";
+
+// typed as `edit <id> <text>` and `delete <id>`, for one's own recent chat lines
+pub const CLIENT_EDIT_CMD: &str = "EDIT";
+pub const CLIENT_EDIT_PREFIX: &str = "EDIT ";
+
+pub const CLIENT_DELETE_CMD: &str = "DELETE";
+pub const CLIENT_DELETE_PREFIX: &str = "DELETE ";
+
+// `away` alone, or with a note; the next `send` clears it
+pub const CLIENT_AWAY_CMD: &str = "AWAY";
+pub const CLIENT_AWAY_PREFIX: &str = "AWAY ";
+
+// handled by the client alone; the server never hears of them
+pub const CLIENT_MUTE_CMD: &str = "MUTE";
+pub const CLIENT_MUTE_PREFIX: &str = "MUTE ";
+
+pub const CLIENT_UNMUTE_CMD: &str = "UNMUTE";
+pub const CLIENT_UNMUTE_PREFIX: &str = "UNMUTE ";
+
+pub const CLIENT_MUTED_CMD: &str = "MUTED";
+
+// hides joins and leaves, or shows them again
+pub const CLIENT_QUIET_CMD: &str = "QUIET";
+
+pub const CLIENT_TS_CMD: &str = "TS";
+pub const CLIENT_TS_PREFIX: &str = "TS ";
+
+pub const CLIENT_SAVE_CMD: &str = "SAVE";
+pub const CLIENT_SAVE_PREFIX: &str = "SAVE ";
+
+// writes out a file shared with the room, `savefile <name> [path]`
+pub const CLIENT_SAVEFILE_CMD: &str = "SAVEFILE";
+pub const CLIENT_SAVEFILE_PREFIX: &str = "SAVEFILE ";
+
+// clears the screen; nothing at all when stdout is not a terminal
+pub const CLIENT_CLEAR_CMD: &str = "CLEAR";
+
+// a `--script` line that waits, `sleep <ms>`, rather than a command
+pub const CLIENT_SCRIPT_SLEEP: &str = "SLEEP";
+
 pub const APP_ENV: &str = "CHAT_APP_ENV";
 pub const DEFAULT_LOG_LEVEL: &str = "CHAT_APP_LOG_LEVEL";
 pub const DEFAULT_TZ: &str = "Etc/UTC";
@@ -43,16 +312,25 @@ pub const CHECK_INTERVAL_TCP_READER: Duration = Duration::from_millis(600);
 
 pub const MAX_CLIENT_BUFFER_SIZE: usize = 1024;
 
-pub const MAX_CLIENT_MESSAGE_LENGTH: usize = 4096;
+/// How often a client repeats `TYPING` while its user keeps typing.
+pub const TYPING_DEBOUNCE: Duration = Duration::from_secs(1);
+
+/// How long after the last `TYPING` the server says the user has stopped.
+pub const TYPING_TIMEOUT: Duration = Duration::from_secs(3);
 
-/// Read timeout for socket operations.
+/// How long a client gets to finish a message it has started sending, or
+/// to join once connected.
 pub const READ_TIMEOUT: Duration = Duration::from_secs(30);
 
+/// How long a client's socket gets to take one write before the client is
+/// dropped.
+pub const WRITE_TIMEOUT: Duration = Duration::from_secs(10);
+
 /// Maximum concurrent connections the server will accept.
 pub const MAX_CONNECTIONS: usize = 10_000;
 
 /// Rate limit: maximum messages per second per user.
-pub const MAX_MESSAGES_PER_SECOND: u32 = 10;
+pub const MAX_MESSAGES_PER_SECOND: u32 = 5;
 
 /// Rate limit: burst capacity for message rate limiting.
-pub const MESSAGE_BURST_CAPACITY: u32 = 20;
+pub const MESSAGE_BURST_CAPACITY: u32 = 10;
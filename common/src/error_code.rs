@@ -0,0 +1,124 @@
+//! Stable codes for the server's refusals, so that clients and scripts can
+//! tell one `ERR` from another without matching on its wording, which may
+//! change.
+//!
+//! Each has a number, after the HTTP status nearest in meaning, and a name
+//! in lower case with dashes, e.g. `409 name-taken`. Several names share a
+//! number; the name is what tells them apart, the number how to treat them:
+//! a 4xx is down to what was sent, a 5xx to the server.
+
+use std::{
+    borrow::Cow,
+    fmt::{Display, Formatter},
+};
+
+#[derive(Debug, Clone, PartialEq, Eq, Hash)]
+pub struct ErrorCode {
+    pub status: u16,
+    pub name: Cow<'static, str>,
+}
+
+impl ErrorCode {
+    /// What an `ERR` or `NACK` from a server that predates codes is read as
+    pub const UNKNOWN: Self = Self::new(0, "unknown");
+
+    /// A command the server could not make sense of
+    pub const BAD_REQUEST: Self = Self::new(400, "bad-request");
+    pub const UNKNOWN_COMMAND: Self = Self::new(400, "unknown-command");
+    pub const INVALID_USERNAME: Self = Self::new(400, "invalid-username");
+    pub const INVALID_ROOM: Self = Self::new(400, "invalid-room");
+    pub const EMPTY_MESSAGE: Self = Self::new(400, "empty-message");
+    pub const ILLEGAL_CHARACTERS: Self = Self::new(400, "illegal-characters");
+    /// A command whose bytes aren't UTF-8
+    pub const INVALID_ENCODING: Self = Self::new(400, "invalid-encoding");
+
+    pub const AUTH_FAILED: Self = Self::new(401, "auth-failed");
+    pub const INVALID_SESSION: Self = Self::new(401, "invalid-session");
+    /// A command that needs a `join` first
+    pub const NOT_JOINED: Self = Self::new(401, "not-joined");
+
+    /// An operator command from someone who isn't one
+    pub const NOT_AUTHORIZED: Self = Self::new(403, "not-authorized");
+    pub const BANNED: Self = Self::new(403, "banned");
+    pub const NAME_RESERVED: Self = Self::new(403, "name-reserved");
+    pub const CANNOT_EDIT: Self = Self::new(403, "cannot-edit");
+    /// A `sendfile` to a server that doesn't take files
+    pub const FILES_DISABLED: Self = Self::new(403, "files-disabled");
+
+    pub const NO_SUCH_USER: Self = Self::new(404, "no-such-user");
+    pub const NOT_BANNED: Self = Self::new(404, "not-banned");
+    /// A `drop` naming an address nobody is connected from
+    pub const NO_SUCH_CONNECTION: Self = Self::new(404, "no-such-connection");
+    /// A reply to a line no longer in the room's history
+    pub const NO_SUCH_MESSAGE: Self = Self::new(404, "no-such-message");
+
+    /// A line left unfinished for too long
+    pub const READ_TIMEOUT: Self = Self::new(408, "read-timeout");
+    pub const IDLE_TIMEOUT: Self = Self::new(408, "idle-timeout");
+    /// A client that stopped reading what it was sent
+    pub const TOO_SLOW: Self = Self::new(408, "too-slow");
+
+    pub const NAME_TAKEN: Self = Self::new(409, "name-taken");
+    /// A name its owner gave up moments ago, kept for their session token
+    pub const NAME_COOLING_DOWN: Self = Self::new(409, "name-cooling-down");
+    pub const ALREADY_IN_ROOM: Self = Self::new(409, "already-in-room");
+    /// Told to a connection whose session a `rejoin` took over
+    pub const SESSION_SUPERSEDED: Self = Self::new(409, "session-superseded");
+    pub const ALREADY_COMPRESSED: Self = Self::new(409, "already-compressed");
+
+    pub const MESSAGE_TOO_LONG: Self = Self::new(413, "message-too-long");
+    pub const FILE_TOO_LARGE: Self = Self::new(413, "file-too-large");
+    /// A line or frame too long to read, which closes the connection
+    pub const LINE_TOO_LONG: Self = Self::new(413, "line-too-long");
+
+    pub const RATE_LIMITED: Self = Self::new(429, "rate-limited");
+    pub const TOO_MANY_CONNECTIONS: Self = Self::new(429, "too-many-connections");
+    /// A file past what the user may share in all
+    pub const QUOTA_EXCEEDED: Self = Self::new(429, "quota-exceeded");
+
+    pub const SERVER_ERROR: Self = Self::new(500, "server-error");
+
+    pub const SERVER_FULL: Self = Self::new(503, "server-full");
+    /// Something on the server was too busy to answer in time; try again
+    pub const BUSY: Self = Self::new(503, "busy");
+    pub const UNDELIVERABLE: Self = Self::new(503, "undeliverable");
+
+    #[must_use]
+    pub const fn new(status: u16, name: &'static str) -> Self {
+        Self {
+            status,
+            name: Cow::Borrowed(name),
+        }
+    }
+
+    /// Whether the server, not what was sent, is to blame.
+    #[must_use]
+    pub const fn is_server_error(&self) -> bool {
+        self.status >= 500
+    }
+}
+
+impl Display for ErrorCode {
+    fn fmt(&self, f: &mut Formatter<'_>) -> std::fmt::Result {
+        write!(f, "{} {}", self.status, self.name)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_error_code_display() {
+        assert_eq!(ErrorCode::NAME_TAKEN.to_string(), "409 name-taken");
+        assert_eq!(
+            ErrorCode::NAME_TAKEN,
+            ErrorCode {
+                status: 409,
+                name: Cow::Owned("name-taken".to_string()),
+            }
+        );
+        assert!(ErrorCode::BUSY.is_server_error());
+        assert!(!ErrorCode::RATE_LIMITED.is_server_error());
+    }
+}
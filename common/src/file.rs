@@ -0,0 +1,75 @@
+//! Files shared with a room, sent with `sendfile` and kept with `savefile`.
+//!
+//! A file travels whole in one message, its contents base64-encoded so they
+//! fit a line of the text protocol or a JSON string. Only its name goes with
+//! it, never a directory, so a recipient's client decides where it lands.
+
+use base64::{Engine as _, engine::general_purpose::STANDARD};
+
+use crate::tcp_message::FIELD_SEPARATOR;
+
+/// Longest name a shared file may have, in bytes.
+pub const MAX_NAME_LEN: usize = 255;
+
+/// No server takes files larger than this, in bytes, whatever it is set to,
+/// so no client need read one.
+pub const MAX_SIZE: usize = 8 * 1024 * 1024;
+
+/// `bytes` as they are sent.
+#[must_use]
+pub fn encode_data(bytes: &[u8]) -> String {
+    STANDARD.encode(bytes)
+}
+
+/// The bytes `data` carries, or `None` if it isn't base64.
+#[must_use]
+pub fn decode_data(data: &str) -> Option<Vec<u8>> {
+    STANDARD.decode(data).ok()
+}
+
+/// How long `size` bytes are once encoded.
+#[must_use]
+pub const fn encoded_len(size: usize) -> usize {
+    size.div_ceil(3).saturating_mul(4)
+}
+
+/// Whether `name` will do for a shared file: a single path component, not
+/// `.` or `..`, without control characters or the field separator.
+#[must_use]
+pub fn is_valid_name(name: &str) -> bool {
+    !name.is_empty()
+        && name.len() <= MAX_NAME_LEN
+        && name != "."
+        && name != ".."
+        && !name.contains(['/', '\\'])
+        && !name.contains(FIELD_SEPARATOR)
+        && !name.chars().any(char::is_control)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_data_roundtrip() {
+        let data = encode_data(b"hello\n\x00\xff");
+        assert_eq!(data.len(), encoded_len(8));
+        assert_eq!(decode_data(&data).as_deref(), Some(&b"hello\n\x00\xff"[..]));
+        assert_eq!(encoded_len(0), 0);
+        assert_eq!(encoded_len(3), 4);
+        assert_eq!(decode_data("not base64!"), None);
+    }
+
+    #[test]
+    fn test_valid_names() {
+        assert!(is_valid_name("notes.txt"));
+        assert!(is_valid_name("résumé v2.pdf"));
+        assert!(!is_valid_name(""));
+        assert!(!is_valid_name(".."));
+        assert!(!is_valid_name("../etc/passwd"));
+        assert!(!is_valid_name("a\\b"));
+        assert!(!is_valid_name("a|b"));
+        assert!(!is_valid_name("a\nb"));
+        assert!(!is_valid_name(&"x".repeat(MAX_NAME_LEN + 1)));
+    }
+}
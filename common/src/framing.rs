@@ -0,0 +1,202 @@
+//! Length-prefixed framing, an alternative to ending each message with a newline.
+//!
+//! Each message, text or JSON, is sent as a 4-byte big-endian length followed
+//! by exactly that many bytes, so a message may itself contain newlines.
+//!
+//! No frame is ever [`MAX_FRAME_LEN`] bytes or longer, so the first byte of
+//! a connection is `0` exactly when it is framed; no text or JSON command
+//! starts with a NUL. That is how the server tells framed clients apart.
+
+use thiserror::Error;
+
+/// Bytes in the length prefix
+pub const FRAME_HEADER_LEN: usize = 4;
+
+/// Frames are shorter than this in any case, keeping the first header byte `0`.
+pub const MAX_FRAME_LEN: usize = 1 << 24;
+
+/// Framing errors
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Error)]
+pub enum FrameError {
+    #[error("frame of {len} bytes exceeds the limit of {max}")]
+    TooLong { len: usize, max: usize },
+}
+
+/// Whether a connection whose first byte is `first_byte` is framed.
+#[inline]
+#[must_use]
+pub const fn is_framed(first_byte: u8) -> bool {
+    first_byte == 0
+}
+
+/// Prefixes `payload` with its length.
+///
+/// # Errors
+///
+/// Returns [`FrameError::TooLong`] if `payload` is [`MAX_FRAME_LEN`] bytes or more.
+///
+/// # Examples
+///
+/// ```
+/// use common::framing::encode_frame;
+///
+/// assert_eq!(encode_frame(b"WHO").unwrap(), b"\0\0\0\x03WHO");
+/// ```
+pub fn encode_frame(payload: &[u8]) -> Result<Vec<u8>, FrameError> {
+    let too_long = FrameError::TooLong {
+        len: payload.len(),
+        max: MAX_FRAME_LEN.saturating_sub(1),
+    };
+    if payload.len() >= MAX_FRAME_LEN {
+        return Err(too_long);
+    }
+    let len = u32::try_from(payload.len()).map_err(|_| too_long)?;
+    let mut frame = Vec::with_capacity(FRAME_HEADER_LEN.saturating_add(payload.len()));
+    frame.extend_from_slice(&len.to_be_bytes());
+    frame.extend_from_slice(payload);
+    Ok(frame)
+}
+
+/// Reassembles frames from bytes however the network happens to split them.
+///
+/// Feed it whatever was read with [`FrameDecoder::extend`] and take complete
+/// frames with [`FrameDecoder::next_frame`]. Nothing is lost between calls, so
+/// a read abandoned half way, e.g. in `select!`, just resumes later.
+#[derive(Debug)]
+pub struct FrameDecoder {
+    pending: Vec<u8>,
+    max_len: usize,
+    /// Payload bytes of a rejected frame still to be thrown away
+    skip: usize,
+}
+
+impl FrameDecoder {
+    /// A decoder refusing frames over `max_len` bytes.
+    #[must_use]
+    pub const fn new(max_len: usize) -> Self {
+        Self {
+            pending: Vec::new(),
+            max_len,
+            skip: 0,
+        }
+    }
+
+    pub fn extend(&mut self, data: &[u8]) {
+        let skipped = self.skip.min(data.len());
+        self.skip = self.skip.saturating_sub(skipped);
+        self.pending.extend_from_slice(data.get(skipped..).unwrap_or_default());
+    }
+
+    /// Whether nothing is buffered, i.e. no frame has started arriving.
+    #[must_use]
+    pub const fn is_empty(&self) -> bool {
+        self.pending.is_empty() && self.skip == 0
+    }
+
+    /// Hands back what has been buffered towards the next frame, e.g. when
+    /// the bytes after the last complete one are to be read some other way.
+    pub fn take_pending(&mut self) -> Vec<u8> {
+        std::mem::take(&mut self.pending)
+    }
+
+    /// The next complete frame's payload, if one has arrived.
+    ///
+    /// # Errors
+    ///
+    /// Returns [`FrameError::TooLong`] for a frame over the limit. Its payload
+    /// is discarded as it arrives, so decoding carries on with the frame after it.
+    pub fn next_frame(&mut self) -> Result<Option<Vec<u8>>, FrameError> {
+        let Some(header) = self.pending.first_chunk::<FRAME_HEADER_LEN>() else {
+            return Ok(None);
+        };
+        let len = usize::try_from(u32::from_be_bytes(*header)).unwrap_or(usize::MAX);
+        if len > self.max_len {
+            let buffered = self.pending.len().saturating_sub(FRAME_HEADER_LEN);
+            let dropped = buffered.min(len);
+            self.skip = len.saturating_sub(dropped);
+            self.pending.drain(..FRAME_HEADER_LEN.saturating_add(dropped));
+            return Err(FrameError::TooLong { len, max: self.max_len });
+        }
+        let end = FRAME_HEADER_LEN.saturating_add(len);
+        if self.pending.len() < end {
+            return Ok(None);
+        }
+        let frame = self.pending.get(FRAME_HEADER_LEN..end).map(<[u8]>::to_vec);
+        self.pending.drain(..end);
+        Ok(frame)
+    }
+}
+
+#[cfg(test)]
+#[allow(clippy::unwrap_used)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_encode_frame() {
+        assert_eq!(encode_frame(b"").unwrap(), b"\0\0\0\0");
+        let frame = encode_frame(&[b'x'; 300]).unwrap();
+        assert_eq!(frame.get(..4).unwrap(), &[0, 0, 1, 44]);
+        assert_eq!(frame.len(), 304);
+        assert!(encode_frame(&vec![0; MAX_FRAME_LEN]).is_err());
+    }
+
+    #[test]
+    fn test_is_framed() {
+        let longest = encode_frame(&vec![b'x'; MAX_FRAME_LEN - 1]).unwrap();
+        assert!(is_framed(*longest.first().unwrap()));
+        assert!(!is_framed(b'J'));
+        assert!(!is_framed(b'{'));
+    }
+
+    #[test]
+    fn test_frames_split_across_reads() {
+        let mut bytes = encode_frame(b"SEND|line one\nline two").unwrap();
+        bytes.extend(encode_frame(b"WHO").unwrap());
+        let mut decoder = FrameDecoder::new(64);
+        let mut frames = Vec::new();
+        // one byte at a time is as fragmented as TCP gets
+        for byte in bytes {
+            decoder.extend(&[byte]);
+            while let Some(frame) = decoder.next_frame().unwrap() {
+                frames.push(frame);
+            }
+        }
+        assert_eq!(frames, [b"SEND|line one\nline two".to_vec(), b"WHO".to_vec()]);
+    }
+
+    #[test]
+    fn test_several_frames_in_one_read() {
+        let mut decoder = FrameDecoder::new(64);
+        let mut bytes = encode_frame(b"A").unwrap();
+        bytes.extend(encode_frame(b"").unwrap());
+        bytes.extend(encode_frame(b"BC").unwrap());
+        bytes.extend(&[0, 0]);
+        decoder.extend(&bytes);
+        assert_eq!(decoder.next_frame().unwrap().unwrap(), b"A");
+        assert_eq!(decoder.next_frame().unwrap().unwrap(), b"");
+        assert_eq!(decoder.next_frame().unwrap().unwrap(), b"BC");
+        assert_eq!(decoder.next_frame().unwrap(), None);
+        // the start of a fourth frame is still waiting for the rest
+        assert!(!decoder.is_empty());
+        assert_eq!(decoder.take_pending(), [0, 0]);
+        assert!(decoder.is_empty());
+    }
+
+    #[test]
+    fn test_oversized_frame_is_skipped() {
+        let mut decoder = FrameDecoder::new(8);
+        let big = encode_frame(&[b'x'; 20]).unwrap();
+        let (head, tail) = big.split_at(10);
+        decoder.extend(head);
+        assert_eq!(decoder.next_frame(), Err(FrameError::TooLong { len: 20, max: 8 }));
+        assert_eq!(decoder.next_frame().unwrap(), None);
+        assert!(!decoder.is_empty());
+
+        let mut rest = tail.to_vec();
+        rest.extend(encode_frame(b"WHO").unwrap());
+        decoder.extend(&rest);
+        assert_eq!(decoder.next_frame().unwrap().unwrap(), b"WHO");
+        assert!(decoder.is_empty());
+    }
+}
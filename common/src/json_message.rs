@@ -0,0 +1,1333 @@
+//! JSON flavour of the wire protocol, for bots and anything else that would
+//! rather not split pipe-delimited lines.
+//!
+//! A connection speaks JSON when the client's first line is a JSON object,
+//! and the text protocol of [`crate::tcp_message`] otherwise. Either way it is
+//! one message per line.
+//!
+//! Every server message has the same five fields, `null` where they don't
+//! apply. `type` is the text protocol's event name in lower case:
+//!
+//! ```json
+//! {"type":"broadcast","from":"alice","room":"#general","ts":"2024-01-02T15:04:05Z","text":"hello"}
+//! {"type":"err","from":null,"room":null,"ts":null,"text":"name taken","code":409,"reason":"name-taken"}
+//! ```
+//!
+//! An `err` adds the number of its [`crate::error_code::ErrorCode`] as `code`
+//! and its name as `reason`, which are what to go by; `text` is for people.
+//!
+//! More show up only where needed: `to`, the recipient of a `dm` or the new
+//! name in `renamed`; `id`, which the server gives every `broadcast` and which
+//! an `edited` or `deleted` names to say which line changed;
+//! `"history":true` on a line replayed from history; and `seq` on every line
+//! sent to a room, its number among the room's lines, one more each line, so
+//! that a client can tell it missed one. A JSON client always gets `seq`; a
+//! text client asks for it with `SEQ`. A `truncated` event carries, as its
+//! `text`, the first number the room's history still has. Every event with a `from`
+//! adds `color`, the `#rrggbb` that user is shown in (see [`crate::color`]),
+//! so rich clients agree on it; the text protocol has no such field.
+//! `shutdown` carries the seconds left as its `text`, and `typing` carries
+//! `start` or `stop`. Typing events are never replayed or logged; render them
+//! apart from the conversation. `presence` carries the note of someone gone
+//! away as its `text`, empty if they left none, and `null` once they are back.
+//! `userlist`, sent after anyone joins or leaves a room, adds `users`, the
+//! names of everyone in the room sorted case-insensitively; a burst of
+//! changes is sent as one. Only JSON clients are sent it. `file` carries the
+//! file's name as its `text`, its length in bytes as `size` and its contents,
+//! base64-encoded, as `data`.
+//!
+//! Client commands name the command the same way and add its arguments:
+//!
+//! ```json
+//! {"type":"join","username":"alice","password":"secret"}
+//! {"type":"send","text":"hello"}
+//! {"type":"dm","to":"bob","text":"hi"}
+//! ```
+//!
+//! `text` also carries `me`; `room` carries `room`; `username` carries `nick`,
+//! `kick`, `ban` and `unban`; `token` carries `auth`, and a `ping`'s token,
+//! which the `pong` answering it repeats. A `send` may add an `id`, which comes
+//! back in an `ack`, or a `nack` with the reason as its `text`, and a
+//! `reply_to`, the `id` of a line still in the room's history that it
+//! answers; the `broadcast` of a reply carries the same `reply_to`. `edit` takes
+//! the `id` of one's own `broadcast` and its new `text`; `delete` just the `id`.
+//! `away` takes an optional `text`, and `resync` an optional `seq`, the
+//! last number the client saw. `file` takes the name as its `text` and the
+//! contents as `data`, as the `file` event carries them. `roompolicy` takes a
+//! `room` and, to set its limits rather than show them, a `text` such as
+//! `rate=1 len=8192`. A `/command` the client doesn't know has the `/` and its
+//! name as its `type` and whatever was typed after it as its `text`, e.g.
+//! `{"type":"/w","text":"bob hi"}`, for the server to resolve.
+
+use serde::{Deserialize, Serialize};
+
+use crate::{
+    color::user_color,
+    consts,
+    error_code::ErrorCode,
+    tcp_message::{
+        ClientMessage, ClientParseError, ServerMessage, ServerParseError, WireDecode, WireEncode, parse_typing_state,
+        typing_state,
+    },
+};
+
+/// How a connection's messages are written on the wire
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+pub enum WireFormat {
+    /// Pipe-delimited, see [`crate::tcp_message`]
+    #[default]
+    Text,
+    /// One JSON object per line
+    Json,
+}
+
+impl WireFormat {
+    /// The format `line` is written in.
+    #[must_use]
+    pub fn detect(line: &[u8]) -> Self {
+        if line.trim_ascii_start().starts_with(b"{") {
+            Self::Json
+        } else {
+            Self::Text
+        }
+    }
+
+    /// Encodes `msg`; in JSON, `room` fills in the room for messages that
+    /// don't name one themselves.
+    #[must_use]
+    pub fn encode_server(self, msg: &ServerMessage, room: Option<&str>) -> Vec<u8> {
+        match self {
+            Self::Text => msg.encode(),
+            Self::Json => to_json(&JsonServerMessage::new(msg, room)),
+        }
+    }
+
+    /// # Errors
+    ///
+    /// Returns an error if the bytes are not a valid message in this format.
+    pub fn decode_server(self, bytes: &[u8]) -> Result<ServerMessage, ServerParseError> {
+        match self {
+            Self::Text => ServerMessage::decode(bytes),
+            Self::Json => serde_json::from_slice::<JsonServerMessage>(bytes)
+                .map_err(|e| ServerParseError::InvalidJson(e.to_string()))?
+                .into_message(),
+        }
+    }
+
+    #[must_use]
+    pub fn encode_client(self, msg: &ClientMessage) -> Vec<u8> {
+        match self {
+            Self::Text => msg.encode(),
+            Self::Json => to_json(&JsonClientMessage::new(msg)),
+        }
+    }
+
+    /// # Errors
+    ///
+    /// Returns an error if the bytes are not a valid command in this format.
+    pub fn decode_client(self, bytes: &[u8]) -> Result<ClientMessage, ClientParseError> {
+        match self {
+            Self::Text => ClientMessage::decode(bytes),
+            Self::Json => {
+                // serde_json would refuse it too, but as malformed JSON
+                let s = std::str::from_utf8(bytes).map_err(|_| ClientParseError::InvalidUtf8)?;
+                serde_json::from_str::<JsonClientMessage>(s)
+                    .map_err(|e| ClientParseError::InvalidJson(e.to_string()))?
+                    .into_message()
+            }
+        }
+    }
+}
+
+/// Serializing plain strings and options can't fail, but an empty object
+/// beats a panic should that ever change.
+fn to_json(value: &impl Serialize) -> Vec<u8> {
+    serde_json::to_vec(value).unwrap_or_else(|_| b"{}".to_vec())
+}
+
+#[derive(Debug, Default, PartialEq, Eq, Serialize, Deserialize)]
+struct JsonServerMessage {
+    #[serde(rename = "type")]
+    kind: String,
+    #[serde(default)]
+    from: Option<String>,
+    #[serde(default)]
+    room: Option<String>,
+    #[serde(default)]
+    ts: Option<String>,
+    #[serde(default)]
+    text: Option<String>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    to: Option<String>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    token: Option<String>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    id: Option<String>,
+    #[serde(default, skip_serializing_if = "std::ops::Not::not")]
+    history: bool,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    caps: Option<Vec<String>>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    color: Option<String>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    users: Option<Vec<String>>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    code: Option<u16>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    reason: Option<String>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    size: Option<u64>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    data: Option<String>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    reply_to: Option<String>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    seq: Option<u64>,
+}
+
+impl JsonServerMessage {
+    fn new(msg: &ServerMessage, room: Option<&str>) -> Self {
+        if let ServerMessage::History { message } = msg {
+            return Self {
+                history: true,
+                ..Self::new(message, room)
+            };
+        }
+        if let ServerMessage::Sequenced { seq, message } = msg {
+            return Self {
+                seq: Some(*seq),
+                ..Self::new(message, room)
+            };
+        }
+        let mut json = Self::of(msg);
+        json.color = json.from.as_deref().map(|from| user_color(from).to_string());
+        if json.room.is_none()
+            && matches!(
+                msg,
+                ServerMessage::Broadcast { .. }
+                    | ServerMessage::Edited { .. }
+                    | ServerMessage::Deleted { .. }
+                    | ServerMessage::Action { .. }
+                    | ServerMessage::Typing { .. }
+                    | ServerMessage::Presence { .. }
+                    | ServerMessage::File { .. }
+            )
+        {
+            json.room = room.map(str::to_string);
+        }
+        json
+    }
+
+    /// A message of type `event` with every other field unset.
+    fn event(event: &str) -> Self {
+        Self {
+            kind: event.to_lowercase(),
+            ..Self::default()
+        }
+    }
+
+    /// The fields for a single, non-history message; `new` adds the room.
+    fn of(msg: &ServerMessage) -> Self {
+        let some = |s: &String| Some(s.clone());
+        match msg {
+            ServerMessage::Ok => Self::event(consts::SERVER_EVENT_OK),
+            ServerMessage::Err { code, reason } => Self {
+                text: some(reason),
+                code: Some(code.status),
+                reason: Some(code.name.to_string()),
+                ..Self::event(consts::SERVER_EVENT_ERR)
+            },
+            ServerMessage::UserJoined {
+                timestamp,
+                username,
+                room,
+            } => Self {
+                from: some(username),
+                room: some(room),
+                ts: some(timestamp),
+                ..Self::event(consts::SERVER_EVENT_USER_JOINED)
+            },
+            ServerMessage::UserLeft {
+                timestamp,
+                username,
+                room,
+                disconnected,
+            } => Self {
+                from: some(username),
+                room: some(room),
+                ts: some(timestamp),
+                text: disconnected.then(|| consts::LEFT_DISCONNECTED.to_string()),
+                ..Self::event(consts::SERVER_EVENT_USER_LEFT)
+            },
+            ServerMessage::Broadcast {
+                timestamp,
+                id,
+                username,
+                message,
+                reply_to,
+            } => Self {
+                from: some(username),
+                ts: some(timestamp),
+                text: some(message),
+                id: some(id),
+                reply_to: reply_to.clone(),
+                ..Self::event(consts::SERVER_EVENT_BROADCAST)
+            },
+            ServerMessage::Edited {
+                timestamp,
+                id,
+                username,
+                message,
+            } => Self {
+                from: some(username),
+                ts: some(timestamp),
+                text: some(message),
+                id: some(id),
+                ..Self::event(consts::SERVER_EVENT_EDITED)
+            },
+            ServerMessage::Deleted {
+                timestamp,
+                id,
+                username,
+            } => Self {
+                from: some(username),
+                ts: some(timestamp),
+                id: some(id),
+                ..Self::event(consts::SERVER_EVENT_DELETED)
+            },
+            ServerMessage::Direct { from, to, message } => Self {
+                from: some(from),
+                text: some(message),
+                to: some(to),
+                ..Self::event(consts::SERVER_EVENT_DM)
+            },
+            ServerMessage::Action {
+                timestamp,
+                username,
+                text,
+            } => Self {
+                from: some(username),
+                ts: some(timestamp),
+                text: some(text),
+                ..Self::event(consts::SERVER_EVENT_ACTION)
+            },
+            ServerMessage::Renamed { timestamp, from, to } => Self {
+                from: some(from),
+                ts: some(timestamp),
+                to: some(to),
+                ..Self::event(consts::SERVER_EVENT_RENAMED)
+            },
+            ServerMessage::Info { text } => Self {
+                text: some(text),
+                ..Self::event(consts::SERVER_EVENT_INFO)
+            },
+            // unwrapped by `new` before it gets here
+            ServerMessage::History { .. } | ServerMessage::Sequenced { .. } => Self::default(),
+            ServerMessage::Truncated { first } => Self {
+                text: Some(first.to_string()),
+                ..Self::event(consts::SERVER_EVENT_TRUNCATED)
+            },
+            ServerMessage::Ping => Self::event(consts::SERVER_EVENT_PING),
+            ServerMessage::ShuttingDown { seconds } => Self {
+                text: Some(seconds.to_string()),
+                ..Self::event(consts::SERVER_EVENT_SHUTDOWN)
+            },
+            ServerMessage::Session { token, seconds } => Self {
+                text: Some(seconds.to_string()),
+                token: some(token),
+                ..Self::event(consts::SERVER_EVENT_SESSION)
+            },
+            ServerMessage::Typing { username, active } => Self {
+                from: some(username),
+                text: Some(typing_state(*active).to_string()),
+                ..Self::event(consts::SERVER_EVENT_TYPING)
+            },
+            ServerMessage::Presence {
+                timestamp,
+                username,
+                away,
+            } => Self {
+                from: some(username),
+                ts: some(timestamp),
+                text: away.clone(),
+                ..Self::event(consts::SERVER_EVENT_PRESENCE)
+            },
+            ServerMessage::Announcement { timestamp, text } => Self {
+                ts: some(timestamp),
+                text: some(text),
+                ..Self::event(consts::SERVER_EVENT_ANNOUNCE)
+            },
+            ServerMessage::File {
+                timestamp,
+                username,
+                name,
+                size,
+                data,
+            } => Self {
+                from: some(username),
+                ts: some(timestamp),
+                text: some(name),
+                size: Some(*size),
+                data: some(data),
+                ..Self::event(consts::SERVER_EVENT_FILE)
+            },
+            ServerMessage::Ack { id } => Self {
+                id: some(id),
+                ..Self::event(consts::SERVER_EVENT_ACK)
+            },
+            ServerMessage::Nack { id, code, reason } => Self {
+                text: some(reason),
+                id: some(id),
+                code: Some(code.status),
+                reason: Some(code.name.to_string()),
+                ..Self::event(consts::SERVER_EVENT_NACK)
+            },
+            ServerMessage::Pong { token } => Self {
+                token: some(token),
+                ..Self::event(consts::SERVER_EVENT_PONG)
+            },
+            ServerMessage::UserList { room, users } => Self {
+                room: some(room),
+                users: Some(users.clone()),
+                ..Self::event(consts::SERVER_EVENT_USERLIST)
+            },
+            ServerMessage::Goodbye => Self::event(consts::SERVER_EVENT_GOODBYE),
+            ServerMessage::Hello { server, caps } => Self {
+                text: some(server),
+                caps: Some(caps.clone()),
+                ..Self::event(consts::SERVER_EVENT_HELLO)
+            },
+        }
+    }
+
+    fn into_message(self) -> Result<ServerMessage, ServerParseError> {
+        let Self {
+            kind,
+            from,
+            room,
+            ts,
+            text: optional_text,
+            to,
+            token,
+            id,
+            history,
+            caps,
+            color: _,
+            users,
+            code,
+            reason,
+            size,
+            data,
+            reply_to,
+            seq,
+        } = self;
+        let from = || from.ok_or(ServerParseError::MissingField("from"));
+        let room = || room.ok_or(ServerParseError::MissingField("room"));
+        let ts = || ts.ok_or(ServerParseError::MissingField("ts"));
+        // borrowed, so the events whose text is optional can still take it
+        let text = || optional_text.clone().ok_or(ServerParseError::MissingField("text"));
+        let to = || to.ok_or(ServerParseError::MissingField("to"));
+        let id = || id.ok_or(ServerParseError::MissingField("id"));
+
+        let message = match kind.to_uppercase().as_str() {
+            consts::SERVER_EVENT_OK => ServerMessage::Ok,
+            consts::SERVER_EVENT_ERR => ServerMessage::Err {
+                code: ErrorCode {
+                    status: code.ok_or(ServerParseError::MissingField("code"))?,
+                    name: reason.ok_or(ServerParseError::MissingField("reason"))?.into(),
+                },
+                reason: text()?,
+            },
+            consts::SERVER_EVENT_USER_JOINED => ServerMessage::UserJoined {
+                timestamp: ts()?,
+                username: from()?,
+                room: room()?,
+            },
+            consts::SERVER_EVENT_USER_LEFT => ServerMessage::UserLeft {
+                timestamp: ts()?,
+                username: from()?,
+                room: room()?,
+                disconnected: optional_text.as_deref() == Some(consts::LEFT_DISCONNECTED),
+            },
+            consts::SERVER_EVENT_BROADCAST => ServerMessage::Broadcast {
+                timestamp: ts()?,
+                id: id()?,
+                username: from()?,
+                message: text()?,
+                reply_to,
+            },
+            consts::SERVER_EVENT_EDITED => ServerMessage::Edited {
+                timestamp: ts()?,
+                id: id()?,
+                username: from()?,
+                message: text()?,
+            },
+            consts::SERVER_EVENT_DELETED => ServerMessage::Deleted {
+                timestamp: ts()?,
+                id: id()?,
+                username: from()?,
+            },
+            consts::SERVER_EVENT_DM => ServerMessage::Direct {
+                from: from()?,
+                to: to()?,
+                message: text()?,
+            },
+            consts::SERVER_EVENT_ACTION => ServerMessage::Action {
+                timestamp: ts()?,
+                username: from()?,
+                text: text()?,
+            },
+            consts::SERVER_EVENT_RENAMED => ServerMessage::Renamed {
+                timestamp: ts()?,
+                from: from()?,
+                to: to()?,
+            },
+            consts::SERVER_EVENT_INFO => ServerMessage::Info { text: text()? },
+            consts::SERVER_EVENT_TRUNCATED => ServerMessage::Truncated {
+                first: text()?.parse().map_err(|_| ServerParseError::InvalidField("text"))?,
+            },
+            consts::SERVER_EVENT_PING => ServerMessage::Ping,
+            consts::SERVER_EVENT_SHUTDOWN => ServerMessage::ShuttingDown {
+                seconds: text()?.parse().map_err(|_| ServerParseError::InvalidField("text"))?,
+            },
+            consts::SERVER_EVENT_SESSION => ServerMessage::Session {
+                token: token.ok_or(ServerParseError::MissingField("token"))?,
+                seconds: text()?.parse().map_err(|_| ServerParseError::InvalidField("text"))?,
+            },
+            consts::SERVER_EVENT_TYPING => ServerMessage::Typing {
+                username: from()?,
+                active: parse_typing_state(&text()?).ok_or(ServerParseError::InvalidField("text"))?,
+            },
+            consts::SERVER_EVENT_PRESENCE => ServerMessage::Presence {
+                timestamp: ts()?,
+                username: from()?,
+                away: optional_text,
+            },
+            consts::SERVER_EVENT_ANNOUNCE => ServerMessage::Announcement {
+                timestamp: ts()?,
+                text: text()?,
+            },
+            consts::SERVER_EVENT_FILE => ServerMessage::File {
+                timestamp: ts()?,
+                username: from()?,
+                name: text()?,
+                size: size.ok_or(ServerParseError::MissingField("size"))?,
+                data: data.ok_or(ServerParseError::MissingField("data"))?,
+            },
+            consts::SERVER_EVENT_ACK => ServerMessage::Ack { id: id()? },
+            consts::SERVER_EVENT_NACK => ServerMessage::Nack {
+                id: id()?,
+                // a server that predates codes sent none
+                code: code.zip(reason).map_or(ErrorCode::UNKNOWN, |(status, name)| ErrorCode {
+                    status,
+                    name: name.into(),
+                }),
+                reason: text()?,
+            },
+            consts::SERVER_EVENT_PONG => ServerMessage::Pong {
+                token: token.ok_or(ServerParseError::MissingField("token"))?,
+            },
+            consts::SERVER_EVENT_USERLIST => ServerMessage::UserList {
+                room: room()?,
+                users: users.ok_or(ServerParseError::MissingField("users"))?,
+            },
+            consts::SERVER_EVENT_GOODBYE => ServerMessage::Goodbye,
+            consts::SERVER_EVENT_HELLO => ServerMessage::Hello {
+                server: text()?,
+                caps: caps.unwrap_or_default(),
+            },
+            _ => return Err(ServerParseError::UnknownEventType(kind)),
+        };
+        // numbered, then replayed, as the text protocol nests them
+        let message = match seq {
+            Some(seq) => ServerMessage::Sequenced {
+                seq,
+                message: Box::new(message),
+            },
+            None => message,
+        };
+        Ok(if history {
+            ServerMessage::History {
+                message: Box::new(message),
+            }
+        } else {
+            message
+        })
+    }
+}
+
+#[derive(Debug, Default, PartialEq, Eq, Serialize, Deserialize)]
+struct JsonClientMessage {
+    #[serde(rename = "type")]
+    kind: String,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    username: Option<String>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    password: Option<String>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    to: Option<String>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    room: Option<String>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    text: Option<String>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    token: Option<String>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    id: Option<String>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    data: Option<String>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    addr: Option<String>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    reply_to: Option<String>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    seq: Option<u64>,
+}
+
+impl JsonClientMessage {
+    fn new(msg: &ClientMessage) -> Self {
+        let kind = |command: &str| command.to_lowercase();
+        let some = |s: &String| Some(s.clone());
+        match msg {
+            ClientMessage::Join { username, password } => Self {
+                kind: kind(consts::CLIENT_JOIN_CMD),
+                username: some(username),
+                password: password.clone(),
+                ..Self::default()
+            },
+            ClientMessage::Send { id, message } => Self {
+                kind: kind(consts::CLIENT_SEND_CMD),
+                text: some(message),
+                id: id.clone(),
+                ..Self::default()
+            },
+            ClientMessage::Reply { id, reply_to, message } => Self {
+                kind: kind(consts::CLIENT_SEND_CMD),
+                text: some(message),
+                id: id.clone(),
+                reply_to: some(reply_to),
+                ..Self::default()
+            },
+            ClientMessage::Action { text } => Self {
+                kind: kind(consts::CLIENT_ME_CMD),
+                text: some(text),
+                ..Self::default()
+            },
+            ClientMessage::Direct { to, message } => Self {
+                kind: kind(consts::CLIENT_DM_CMD),
+                to: some(to),
+                text: some(message),
+                ..Self::default()
+            },
+            ClientMessage::JoinRoom { room } => Self {
+                kind: kind(consts::CLIENT_ROOM_CMD),
+                room: some(room),
+                ..Self::default()
+            },
+            ClientMessage::Compress => Self {
+                kind: kind(consts::CLIENT_COMPRESS_CMD),
+                ..Self::default()
+            },
+            ClientMessage::Sequence => Self {
+                kind: kind(consts::CLIENT_SEQ_CMD),
+                ..Self::default()
+            },
+            ClientMessage::Binary => Self {
+                kind: kind(consts::CLIENT_BINARY_CMD),
+                ..Self::default()
+            },
+            ClientMessage::Resync { after } => Self {
+                kind: kind(consts::CLIENT_RESYNC_CMD),
+                seq: *after,
+                ..Self::default()
+            },
+            ClientMessage::ListRooms => Self {
+                kind: kind(consts::CLIENT_ROOMS_CMD),
+                ..Self::default()
+            },
+            ClientMessage::Who => Self {
+                kind: kind(consts::CLIENT_WHO_CMD),
+                ..Self::default()
+            },
+            ClientMessage::Stats => Self {
+                kind: kind(consts::CLIENT_STATS_CMD),
+                ..Self::default()
+            },
+            ClientMessage::WhoAll => Self {
+                kind: kind(consts::CLIENT_WHO_ALL_CMD),
+                ..Self::default()
+            },
+            ClientMessage::Connections => Self {
+                kind: kind(consts::CLIENT_CONNS_CMD),
+                ..Self::default()
+            },
+            ClientMessage::DropConnection { addr } => Self {
+                kind: kind(consts::CLIENT_DROP_CMD),
+                addr: some(addr),
+                ..Self::default()
+            },
+            ClientMessage::Help => Self {
+                kind: kind(consts::CLIENT_HELP_CMD),
+                ..Self::default()
+            },
+            ClientMessage::Broadcast { message } => Self {
+                kind: kind(consts::CLIENT_BROADCAST_CMD),
+                text: some(message),
+                ..Self::default()
+            },
+            ClientMessage::File { name, data } => Self {
+                kind: kind(consts::CLIENT_FILE_CMD),
+                text: some(name),
+                data: some(data),
+                ..Self::default()
+            },
+            ClientMessage::RoomPolicy { room, policy } => Self {
+                kind: kind(consts::CLIENT_ROOM_POLICY_CMD),
+                room: some(room),
+                text: Some(policy.clone()).filter(|p| !p.is_empty()),
+                ..Self::default()
+            },
+            ClientMessage::Edit { id, message } => Self {
+                kind: kind(consts::CLIENT_EDIT_CMD),
+                text: some(message),
+                id: some(id),
+                ..Self::default()
+            },
+            ClientMessage::Delete { id } => Self {
+                kind: kind(consts::CLIENT_DELETE_CMD),
+                id: some(id),
+                ..Self::default()
+            },
+            ClientMessage::Away { message } => Self {
+                kind: kind(consts::CLIENT_AWAY_CMD),
+                text: Some(message.clone()).filter(|m| !m.is_empty()),
+                ..Self::default()
+            },
+            ClientMessage::Pong => Self {
+                kind: kind(consts::CLIENT_PONG_CMD),
+                ..Self::default()
+            },
+            ClientMessage::Typing => Self {
+                kind: kind(consts::CLIENT_TYPING_CMD),
+                ..Self::default()
+            },
+            ClientMessage::Nick { username } => Self {
+                kind: kind(consts::CLIENT_NICK_CMD),
+                username: some(username),
+                ..Self::default()
+            },
+            ClientMessage::Rejoin { token } => Self {
+                kind: kind(consts::CLIENT_REJOIN_CMD),
+                token: some(token),
+                ..Self::default()
+            },
+            ClientMessage::Auth { token } => Self {
+                kind: kind(consts::CLIENT_AUTH_CMD),
+                token: some(token),
+                ..Self::default()
+            },
+            ClientMessage::Ping { token } => Self {
+                kind: kind(consts::CLIENT_PING_CMD),
+                token: some(token),
+                ..Self::default()
+            },
+            ClientMessage::DirectHistory { username } => Self {
+                kind: kind(consts::CLIENT_DM_HISTORY_CMD),
+                username: some(username),
+                ..Self::default()
+            },
+            ClientMessage::Kick { username } => Self {
+                kind: kind(consts::CLIENT_KICK_CMD),
+                username: some(username),
+                ..Self::default()
+            },
+            ClientMessage::Ban { username } => Self {
+                kind: kind(consts::CLIENT_BAN_CMD),
+                username: some(username),
+                ..Self::default()
+            },
+            ClientMessage::Unban { username } => Self {
+                kind: kind(consts::CLIENT_UNBAN_CMD),
+                username: some(username),
+                ..Self::default()
+            },
+            ClientMessage::Leave => Self {
+                kind: kind(consts::CLIENT_LEAVE_CMD),
+                ..Self::default()
+            },
+            ClientMessage::Typed { command, args } => Self {
+                kind: format!("/{command}"),
+                text: Some(args.clone()).filter(|a| !a.is_empty()),
+                ..Self::default()
+            },
+        }
+    }
+
+    /// Applies the same rules as the text decoder: fields the server refuses
+    /// with a clearer reason of its own may be empty, the rest may not.
+    fn into_message(self) -> Result<ClientMessage, ClientParseError> {
+        let Self {
+            kind,
+            username,
+            password,
+            to,
+            room,
+            text,
+            token,
+            id,
+            data,
+            addr,
+            reply_to,
+            seq,
+        } = self;
+        let required = |value: Option<String>, name| {
+            value
+                .filter(|v| !v.is_empty())
+                .ok_or(ClientParseError::MissingField(name))
+        };
+
+        if let Some(command) = kind.strip_prefix('/').filter(|c| !c.is_empty()) {
+            return Ok(ClientMessage::Typed {
+                command: command.to_string(),
+                args: text.unwrap_or_default(),
+            });
+        }
+
+        Ok(match kind.to_uppercase().as_str() {
+            consts::CLIENT_JOIN_CMD => ClientMessage::Join {
+                username: username.ok_or(ClientParseError::MissingField("username"))?,
+                password: password.filter(|p| !p.is_empty()),
+            },
+            consts::CLIENT_REJOIN_CMD => ClientMessage::Rejoin {
+                token: required(token, "token")?,
+            },
+            // an empty message is the server's to refuse, with a clearer reason
+            consts::CLIENT_SEND_CMD => match reply_to.filter(|reply_to| !reply_to.is_empty()) {
+                Some(reply_to) => ClientMessage::Reply {
+                    id: id.filter(|id| !id.is_empty()),
+                    reply_to,
+                    message: text.unwrap_or_default(),
+                },
+                None => ClientMessage::Send {
+                    id: id.filter(|id| !id.is_empty()),
+                    message: text.unwrap_or_default(),
+                },
+            },
+            consts::CLIENT_ME_CMD => ClientMessage::Action {
+                text: text.unwrap_or_default(),
+            },
+            consts::CLIENT_DM_CMD => ClientMessage::Direct {
+                to: required(to, "to")?,
+                message: required(text, "text")?,
+            },
+            consts::CLIENT_ROOM_CMD => ClientMessage::JoinRoom {
+                room: required(room, "room")?,
+            },
+            consts::CLIENT_ROOMS_CMD => ClientMessage::ListRooms,
+            consts::CLIENT_COMPRESS_CMD => ClientMessage::Compress,
+            consts::CLIENT_SEQ_CMD => ClientMessage::Sequence,
+            consts::CLIENT_BINARY_CMD => ClientMessage::Binary,
+            consts::CLIENT_RESYNC_CMD => ClientMessage::Resync { after: seq },
+            consts::CLIENT_WHO_CMD => ClientMessage::Who,
+            consts::CLIENT_HELP_CMD => ClientMessage::Help,
+            consts::CLIENT_PONG_CMD => ClientMessage::Pong,
+            consts::CLIENT_TYPING_CMD => ClientMessage::Typing,
+            consts::CLIENT_NICK_CMD => ClientMessage::Nick {
+                username: required(username, "username")?,
+            },
+            consts::CLIENT_AUTH_CMD => ClientMessage::Auth {
+                token: required(token, "token")?,
+            },
+            consts::CLIENT_PING_CMD => ClientMessage::Ping {
+                token: required(token, "token")?,
+            },
+            consts::CLIENT_DM_HISTORY_CMD => ClientMessage::DirectHistory {
+                username: required(username, "username")?,
+            },
+            consts::CLIENT_KICK_CMD => ClientMessage::Kick {
+                username: required(username, "username")?,
+            },
+            consts::CLIENT_BAN_CMD => ClientMessage::Ban {
+                username: required(username, "username")?,
+            },
+            consts::CLIENT_UNBAN_CMD => ClientMessage::Unban {
+                username: required(username, "username")?,
+            },
+            consts::CLIENT_STATS_CMD => ClientMessage::Stats,
+            consts::CLIENT_WHO_ALL_CMD => ClientMessage::WhoAll,
+            consts::CLIENT_CONNS_CMD => ClientMessage::Connections,
+            consts::CLIENT_DROP_CMD => ClientMessage::DropConnection {
+                addr: required(addr, "addr")?,
+            },
+            consts::CLIENT_BROADCAST_CMD => ClientMessage::Broadcast {
+                message: required(text, "text")?,
+            },
+            // an empty file is still a file
+            consts::CLIENT_FILE_CMD => ClientMessage::File {
+                name: required(text, "text")?,
+                data: data.ok_or(ClientParseError::MissingField("data"))?,
+            },
+            consts::CLIENT_ROOM_POLICY_CMD => ClientMessage::RoomPolicy {
+                room: required(room, "room")?,
+                policy: text.unwrap_or_default(),
+            },
+            consts::CLIENT_EDIT_CMD => ClientMessage::Edit {
+                id: required(id, "id")?,
+                message: required(text, "text")?,
+            },
+            consts::CLIENT_DELETE_CMD => ClientMessage::Delete {
+                id: required(id, "id")?,
+            },
+            consts::CLIENT_AWAY_CMD => ClientMessage::Away {
+                message: text.unwrap_or_default(),
+            },
+            consts::CLIENT_LEAVE_CMD => ClientMessage::Leave,
+            _ => return Err(ClientParseError::UnknownCommand(kind)),
+        })
+    }
+}
+
+#[cfg(test)]
+#[allow(clippy::unwrap_used)]
+mod tests {
+    use super::*;
+
+    const TS: &str = "2024-01-02T15:04:05Z";
+
+    fn json(msg: &ServerMessage, room: Option<&str>) -> String {
+        String::from_utf8(WireFormat::Json.encode_server(msg, room)).unwrap()
+    }
+
+    #[test]
+    fn test_detect() {
+        assert_eq!(
+            WireFormat::detect(br#"{"type":"join","username":"alice"}"#),
+            WireFormat::Json
+        );
+        assert_eq!(WireFormat::detect(b"  {\"type\":\"who\"}\n"), WireFormat::Json);
+        assert_eq!(WireFormat::detect(b"JOIN|alice"), WireFormat::Text);
+        assert_eq!(WireFormat::detect(b""), WireFormat::Text);
+    }
+
+    #[test]
+    fn test_server_message_has_all_fields() {
+        let broadcast = ServerMessage::Broadcast {
+            timestamp: TS.to_string(),
+            id: "42".to_string(),
+            username: "alice".to_string(),
+            message: "hello \"world\" | again".to_string(),
+            reply_to: None,
+        };
+        assert_eq!(
+            json(&broadcast, Some("#general")),
+            r##"{"type":"broadcast","from":"alice","room":"#general","ts":"2024-01-02T15:04:05Z","text":"hello \"world\" | again","id":"42","color":"#2472c8"}"##
+        );
+        assert_eq!(
+            json(&ServerMessage::Ok, Some("#general")),
+            r#"{"type":"ok","from":null,"room":null,"ts":null,"text":null}"#
+        );
+    }
+
+    #[test]
+    fn test_err_has_its_code() {
+        let err = ServerMessage::Err {
+            code: ErrorCode::RATE_LIMITED,
+            reason: "rate limited, slow down".to_string(),
+        };
+        assert_eq!(
+            json(&err, None),
+            r#"{"type":"err","from":null,"room":null,"ts":null,"text":"rate limited, slow down","code":429,"reason":"rate-limited"}"#
+        );
+    }
+
+    #[test]
+    fn test_room_comes_from_the_message_first() {
+        let joined = ServerMessage::UserJoined {
+            timestamp: TS.to_string(),
+            username: "bob".to_string(),
+            room: "#random".to_string(),
+        };
+        assert!(json(&joined, Some("#general")).contains(r##""room":"#random""##));
+    }
+
+    #[test]
+    fn test_typing_is_its_own_type() {
+        let typing = ServerMessage::Typing {
+            username: "alice".to_string(),
+            active: true,
+        };
+        assert_eq!(
+            json(&typing, Some("#dev")),
+            r##"{"type":"typing","from":"alice","room":"#dev","ts":null,"text":"start","color":"#2472c8"}"##
+        );
+    }
+
+    #[test]
+    fn test_userlist_lists_users() {
+        let userlist = ServerMessage::UserList {
+            room: "#dev".to_string(),
+            users: vec!["alice".to_string(), "bob".to_string()],
+        };
+        assert_eq!(
+            json(&userlist, Some("#general")),
+            r##"{"type":"userlist","from":null,"room":"#dev","ts":null,"text":null,"users":["alice","bob"]}"##
+        );
+    }
+
+    #[test]
+    fn test_color_follows_from() {
+        let joined = ServerMessage::UserJoined {
+            timestamp: TS.to_string(),
+            username: "Alice".to_string(),
+            room: "#general".to_string(),
+        };
+        assert!(json(&joined, None).ends_with(r##","color":"#2472c8"}"##));
+        let dm = ServerMessage::Direct {
+            from: "bob".to_string(),
+            to: "alice".to_string(),
+            message: "hi".to_string(),
+        };
+        assert!(json(&dm, None).contains(r##""color":"#e5e510""##));
+        assert!(!json(&ServerMessage::Ok, None).contains("color"));
+        // text clients never see it
+        assert!(
+            !String::from_utf8(WireFormat::Text.encode_server(&joined, None))
+                .unwrap()
+                .contains("#2472c8")
+        );
+    }
+
+    #[test]
+    fn test_history_is_flagged() {
+        let history = ServerMessage::History {
+            message: Box::new(ServerMessage::Action {
+                timestamp: TS.to_string(),
+                username: "alice".to_string(),
+                text: "waves".to_string(),
+            }),
+        };
+        assert_eq!(
+            json(&history, Some("#dev")),
+            r##"{"type":"action","from":"alice","room":"#dev","ts":"2024-01-02T15:04:05Z","text":"waves","history":true,"color":"#2472c8"}"##
+        );
+    }
+
+    #[test]
+    fn test_seq_is_a_field() {
+        let numbered = ServerMessage::History {
+            message: Box::new(ServerMessage::Sequenced {
+                seq: 12,
+                message: Box::new(ServerMessage::Action {
+                    timestamp: TS.to_string(),
+                    username: "alice".to_string(),
+                    text: "waves".to_string(),
+                }),
+            }),
+        };
+        let encoded = json(&numbered, Some("#dev"));
+        assert_eq!(
+            encoded,
+            r##"{"type":"action","from":"alice","room":"#dev","ts":"2024-01-02T15:04:05Z","text":"waves","history":true,"color":"#2472c8","seq":12}"##
+        );
+        assert_eq!(WireFormat::Json.decode_server(encoded.as_bytes()).unwrap(), numbered);
+    }
+
+    #[test]
+    fn test_server_roundtrip() {
+        let messages = [
+            ServerMessage::Ok,
+            ServerMessage::Err {
+                code: ErrorCode::NAME_TAKEN,
+                reason: "name taken".to_string(),
+            },
+            ServerMessage::UserLeft {
+                timestamp: TS.to_string(),
+                username: "bob".to_string(),
+                room: "#general".to_string(),
+                disconnected: false,
+            },
+            ServerMessage::UserLeft {
+                timestamp: TS.to_string(),
+                username: "bob".to_string(),
+                room: "#general".to_string(),
+                disconnected: true,
+            },
+            ServerMessage::Direct {
+                from: "alice".to_string(),
+                to: "bob".to_string(),
+                message: "line one\nline two".to_string(),
+            },
+            ServerMessage::Renamed {
+                timestamp: TS.to_string(),
+                from: "alice".to_string(),
+                to: "alice2".to_string(),
+            },
+            ServerMessage::History {
+                message: Box::new(ServerMessage::Broadcast {
+                    timestamp: TS.to_string(),
+                    id: "41".to_string(),
+                    username: "bob".to_string(),
+                    message: "earlier".to_string(),
+                    reply_to: None,
+                }),
+            },
+            ServerMessage::Broadcast {
+                timestamp: TS.to_string(),
+                id: "42".to_string(),
+                username: "alice".to_string(),
+                message: "agreed".to_string(),
+                reply_to: Some("41".to_string()),
+            },
+            ServerMessage::Edited {
+                timestamp: TS.to_string(),
+                id: "41".to_string(),
+                username: "bob".to_string(),
+                message: "earlier, fixed".to_string(),
+            },
+            ServerMessage::Deleted {
+                timestamp: TS.to_string(),
+                id: "41".to_string(),
+                username: "bob".to_string(),
+            },
+            ServerMessage::Truncated { first: 5 },
+            ServerMessage::Ping,
+            ServerMessage::ShuttingDown { seconds: 3 },
+            ServerMessage::Session {
+                token: "0f3a".to_string(),
+                seconds: 60,
+            },
+            ServerMessage::Typing {
+                username: "alice".to_string(),
+                active: false,
+            },
+            ServerMessage::Presence {
+                timestamp: TS.to_string(),
+                username: "alice".to_string(),
+                away: Some(String::new()),
+            },
+            ServerMessage::Presence {
+                timestamp: TS.to_string(),
+                username: "alice".to_string(),
+                away: None,
+            },
+            ServerMessage::Announcement {
+                timestamp: TS.to_string(),
+                text: "back in 5".to_string(),
+            },
+            ServerMessage::File {
+                timestamp: TS.to_string(),
+                username: "alice".to_string(),
+                name: "notes.txt".to_string(),
+                size: 2,
+                data: "aGk=".to_string(),
+            },
+            ServerMessage::Ack { id: "7".to_string() },
+            ServerMessage::Nack {
+                id: "8".to_string(),
+                code: ErrorCode::RATE_LIMITED,
+                reason: "rate limited, slow down".to_string(),
+            },
+            ServerMessage::Pong { token: "3".to_string() },
+            ServerMessage::Goodbye,
+            ServerMessage::Hello {
+                server: "simple-chat/0.1.0".to_string(),
+                caps: vec!["json".to_string(), "history".to_string()],
+            },
+            ServerMessage::UserList {
+                room: "#general".to_string(),
+                users: Vec::new(),
+            },
+        ];
+        for msg in messages {
+            let encoded = WireFormat::Json.encode_server(&msg, None);
+            assert!(!encoded.contains(&b'\n'));
+            assert_eq!(WireFormat::Json.decode_server(&encoded).unwrap(), msg);
+        }
+    }
+
+    #[test]
+    fn test_server_decode_invalid() {
+        assert!(matches!(
+            WireFormat::Json.decode_server(b"OK"),
+            Err(ServerParseError::InvalidJson(_))
+        ));
+        assert!(matches!(
+            WireFormat::Json.decode_server(br#"{"type":"nope"}"#),
+            Err(ServerParseError::UnknownEventType(_))
+        ));
+        assert!(matches!(
+            WireFormat::Json.decode_server(br#"{"type":"dm","from":"a","text":"hi"}"#),
+            Err(ServerParseError::MissingField("to"))
+        ));
+    }
+
+    #[test]
+    fn test_client_encode() {
+        let dm = ClientMessage::Direct {
+            to: "bob".to_string(),
+            message: "hi".to_string(),
+        };
+        assert_eq!(
+            WireFormat::Json.encode_client(&dm),
+            br#"{"type":"dm","to":"bob","text":"hi"}"#
+        );
+        assert_eq!(
+            WireFormat::Json.encode_client(&ClientMessage::Who),
+            br#"{"type":"who"}"#
+        );
+        assert_eq!(WireFormat::Text.encode_client(&dm), b"DM|bob|hi");
+    }
+
+    #[test]
+    fn test_client_roundtrip() {
+        let messages = [
+            ClientMessage::Join {
+                username: "alice".to_string(),
+                password: Some("secret".to_string()),
+            },
+            ClientMessage::Send {
+                id: None,
+                message: "a|b".to_string(),
+            },
+            ClientMessage::Send {
+                id: Some("7".to_string()),
+                message: "hi".to_string(),
+            },
+            ClientMessage::Reply {
+                id: None,
+                reply_to: "41".to_string(),
+                message: "agreed".to_string(),
+            },
+            ClientMessage::Action { text: String::new() },
+            ClientMessage::JoinRoom {
+                room: "#dev".to_string(),
+            },
+            ClientMessage::ListRooms,
+            ClientMessage::Compress,
+            ClientMessage::Sequence,
+            ClientMessage::Binary,
+            ClientMessage::Resync { after: None },
+            ClientMessage::Resync { after: Some(12) },
+            ClientMessage::Typed {
+                command: "w".to_string(),
+                args: "bob hi".to_string(),
+            },
+            ClientMessage::Stats,
+            ClientMessage::WhoAll,
+            ClientMessage::Connections,
+            ClientMessage::DropConnection {
+                addr: "[::1]:54321".to_string(),
+            },
+            ClientMessage::Help,
+            ClientMessage::Broadcast {
+                message: "back in 5".to_string(),
+            },
+            ClientMessage::File {
+                name: "notes.txt".to_string(),
+                data: "aGk=".to_string(),
+            },
+            ClientMessage::RoomPolicy {
+                room: "#news".to_string(),
+                policy: "rate=1 len=8192".to_string(),
+            },
+            ClientMessage::RoomPolicy {
+                room: "#news".to_string(),
+                policy: String::new(),
+            },
+            ClientMessage::Edit {
+                id: "41".to_string(),
+                message: "fixed".to_string(),
+            },
+            ClientMessage::Delete { id: "41".to_string() },
+            ClientMessage::Away {
+                message: "lunch".to_string(),
+            },
+            ClientMessage::Away { message: String::new() },
+            ClientMessage::Pong,
+            ClientMessage::Ping { token: "3".to_string() },
+            ClientMessage::Typing,
+            ClientMessage::Nick {
+                username: "alice2".to_string(),
+            },
+            ClientMessage::Auth {
+                token: "t0ken".to_string(),
+            },
+            ClientMessage::Rejoin {
+                token: "0f3a".to_string(),
+            },
+            ClientMessage::Unban {
+                username: "bob".to_string(),
+            },
+            ClientMessage::DirectHistory {
+                username: "bob".to_string(),
+            },
+            ClientMessage::Leave,
+        ];
+        for msg in messages {
+            let encoded = WireFormat::Json.encode_client(&msg);
+            assert_eq!(WireFormat::Json.decode_client(&encoded).unwrap(), msg);
+        }
+    }
+
+    #[test]
+    fn test_client_decode_rules() {
+        let decode = |s: &str| WireFormat::Json.decode_client(s.as_bytes());
+        assert_eq!(
+            decode(r#"{"type":"JOIN","username":""}"#).unwrap(),
+            ClientMessage::Join {
+                username: String::new(),
+                password: None
+            }
+        );
+        assert!(matches!(
+            decode(r#"{"type":"join"}"#),
+            Err(ClientParseError::MissingField("username"))
+        ));
+        assert_eq!(
+            decode(r#"{"type":"send","text":""}"#).unwrap(),
+            ClientMessage::Send {
+                id: None,
+                message: String::new()
+            }
+        );
+        assert_eq!(
+            decode(r#"{"type":"send","id":"7","text":""}"#).unwrap(),
+            ClientMessage::Send {
+                id: Some("7".to_string()),
+                message: String::new()
+            }
+        );
+        // an empty reply_to is no reply at all
+        assert_eq!(
+            decode(r#"{"type":"send","reply_to":"","text":"hi"}"#).unwrap(),
+            ClientMessage::Send {
+                id: None,
+                message: "hi".to_string()
+            }
+        );
+        assert!(matches!(
+            decode(r#"{"type":"dm","text":"hi"}"#),
+            Err(ClientParseError::MissingField("to"))
+        ));
+        assert!(matches!(
+            decode(r#"{"type":"fly"}"#),
+            Err(ClientParseError::UnknownCommand(_))
+        ));
+        assert!(matches!(
+            decode(r#"{"text":"hi"}"#),
+            Err(ClientParseError::InvalidJson(_))
+        ));
+        assert!(matches!(decode("SEND|hi"), Err(ClientParseError::InvalidJson(_))));
+        assert!(matches!(
+            WireFormat::Json.decode_client(b"{\"type\":\"send\",\"text\":\"caf\xe9\"}"),
+            Err(ClientParseError::InvalidUtf8)
+        ));
+        assert_eq!(
+            decode("{\"type\":\"join\",\"username\":\"bob\"}\r\n").unwrap(),
+            ClientMessage::Join {
+                username: "bob".to_string(),
+                password: None
+            }
+        );
+    }
+}
@@ -1,5 +1,11 @@
+pub mod color;
 pub mod config;
 pub mod consts;
+pub mod error_code;
+pub mod file;
+pub mod framing;
+pub mod json_message;
 pub mod security;
 pub mod tcp_message;
 pub mod telemetry;
+pub mod username;
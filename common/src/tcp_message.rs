@@ -4,13 +4,34 @@
 //!
 //! Fixed positions:
 //! - 1st: `EVENT_TYPE`
-//! - 2nd: reason (error), username (join/left/broadcast)
-//! - 3rd: message (broadcast only)
+//! - 2nd: status (error, see [`crate::error_code`]), text (info), timestamp (join/left/broadcast/action/renamed), sender (dm),
+//!   the complete replayed message (history), the line's number in its room (seq), the first number still kept (truncated),
+//!   seconds until close (shutdown), username (typing),
+//!   message id (ack/nack), room (userlist)
+//! - 3rd: code name (error), username (join/left/broadcast/action), recipient (dm), old name (renamed), `start` or `stop` (typing),
+//!   the complete numbered message (seq),
+//!   reason (nack), every username in the room, comma separated (userlist)
+//! - 4th: reason (error), room (join/left), message (broadcast/dm), text (action), new name (renamed)
+//!
+//! Client `JOIN` carries the username 2nd and an optional password 3rd;
+//! `SENDID` carries a message id 2nd and the message 3rd; `REPLY` the id of
+//! the line it answers 2nd and the message 3rd, and `REPLYID` its own id
+//! ahead of both; `RESYNC` an optional number 2nd. A server `REPLY` is a broadcast with the id of the line it
+//! answers between the username and the message. A server `FILE`
+//! carries the timestamp, sender, file name, size in bytes and contents, in
+//! that order, and a client `FILE` just the name and contents; the contents
+//! are base64, see [`crate::file`]. A client command
+//! starting with `/`, e.g. `/w|bob hi` or just `/w bob hi`, is passed on as
+//! typed, with everything after the name as its arguments.
+//!
+//! Timestamps are ISO-8601 UTC to the second, e.g. `2024-01-02T15:04:05Z`.
+//!
+//! This is the default; [`crate::json_message`] carries the same messages as JSON.
 
 use stringzilla::sz;
 use thiserror::Error;
 
-use crate::consts;
+use crate::{consts, error_code::ErrorCode};
 
 /// Separator for wire protocol fields
 pub const FIELD_SEPARATOR: &str = "|";
@@ -39,14 +60,112 @@ pub trait WireDecode: Sized {
 pub enum ServerMessage {
     /// Acknowledgment
     Ok,
-    /// Error response with reason
-    Err { reason: String },
-    /// User joined notification
-    UserJoined { username: String },
-    /// User left notification
-    UserLeft { username: String },
-    /// Broadcast message from a user
-    Broadcast { username: String, message: String },
+    /// Error response: the code to go by, and the reason for people
+    Err { code: ErrorCode, reason: String },
+    /// User joined a room
+    UserJoined {
+        timestamp: String,
+        username: String,
+        room: String,
+    },
+    /// User left a room, or `disconnected` without saying so
+    UserLeft {
+        timestamp: String,
+        username: String,
+        room: String,
+        disconnected: bool,
+    },
+    /// Broadcast message from a user, with the id the server gave it and,
+    /// for a reply, the id of the line it answers; sent as `REPLY` then
+    Broadcast {
+        timestamp: String,
+        id: String,
+        username: String,
+        message: String,
+        reply_to: Option<String>,
+    },
+    /// The sender of the chat line `id` changed it to `message`
+    Edited {
+        timestamp: String,
+        id: String,
+        username: String,
+        message: String,
+    },
+    /// The sender of the chat line `id` took it back
+    Deleted {
+        timestamp: String,
+        id: String,
+        username: String,
+    },
+    /// Direct message, delivered to the recipient and echoed to the sender
+    Direct { from: String, to: String, message: String },
+    /// An emote, shown as `* alice waves hello`
+    Action {
+        timestamp: String,
+        username: String,
+        text: String,
+    },
+    /// A user changed their name
+    Renamed {
+        timestamp: String,
+        from: String,
+        to: String,
+    },
+    /// Informational reply meant only for the requesting client
+    Info { text: String },
+    /// A message replayed from the room's recent history
+    History { message: Box<Self> },
+    /// A chat line and its number among the lines sent to its room, which
+    /// goes up by one each line, so a client can tell it missed one. Text
+    /// clients are sent these only once they ask with `SEQ`.
+    Sequenced { seq: u64, message: Box<Self> },
+    /// Ahead of a `RESYNC` replay: the lines of the room before `first` are
+    /// gone from its history, so some of those asked for can't be replayed
+    Truncated { first: u64 },
+    /// Keepalive probe; the client answers with `PONG`
+    Ping,
+    /// The server is going down and will close the connection shortly
+    ShuttingDown { seconds: u64 },
+    /// Token to `rejoin` with for `seconds` after the connection drops
+    Session { token: String, seconds: u64 },
+    /// Someone else in the room started or stopped typing
+    Typing { username: String, active: bool },
+    /// Someone in the room went away, with a note that may be empty, or,
+    /// with no note at all, came back
+    Presence {
+        timestamp: String,
+        username: String,
+        away: Option<String>,
+    },
+    /// A notice from an operator to everyone online, shown as `SERVER: text`
+    Announcement { timestamp: String, text: String },
+    /// A file someone shared with the room, `size` bytes long once `data`,
+    /// its base64-encoded contents, is decoded
+    File {
+        timestamp: String,
+        username: String,
+        name: String,
+        size: u64,
+        data: String,
+    },
+    /// The message sent with this id is on its way to the room
+    Ack { id: String },
+    /// The message sent with this id was refused, with the code and reason
+    /// an `ERR` would have carried
+    Nack {
+        id: String,
+        code: ErrorCode,
+        reason: String,
+    },
+    /// Answer to a client `PING`, with the token it carried
+    Pong { token: String },
+    /// Everyone in `room` right now, sorted; sent after joins and leaves
+    UserList { room: String, users: Vec<String> },
+    /// The client's `LEAVE` went through; the connection closes next
+    Goodbye,
+    /// The server's name and version, as `simple-chat/0.1.0`, and the
+    /// capabilities it offers; the first thing it sends
+    Hello { server: String, caps: Vec<String> },
 }
 
 /// Parse error for server messages
@@ -60,18 +179,152 @@ pub enum ServerParseError {
     UnknownEventType(String),
     #[error("missing field: {0}")]
     MissingField(&'static str),
+    #[error("invalid field: {0}")]
+    InvalidField(&'static str),
+    #[error("invalid json: {0}")]
+    InvalidJson(String),
 }
 
 impl WireEncode for ServerMessage {
     fn encode(&self) -> Vec<u8> {
         let s = match self {
             Self::Ok => consts::SERVER_EVENT_OK.to_string(),
-            Self::Err { reason } => [consts::SERVER_EVENT_ERR, reason].join(FIELD_SEPARATOR),
-            Self::UserJoined { username } => [consts::SERVER_EVENT_USER_JOINED, username].join(FIELD_SEPARATOR),
-            Self::UserLeft { username } => [consts::SERVER_EVENT_USER_LEFT, username].join(FIELD_SEPARATOR),
-            Self::Broadcast { username, message } => {
-                [consts::SERVER_EVENT_BROADCAST, username, message].join(FIELD_SEPARATOR)
+            Self::Err { code, reason } => {
+                [consts::SERVER_EVENT_ERR, &code.status.to_string(), &code.name, reason].join(FIELD_SEPARATOR)
+            }
+            Self::UserJoined {
+                timestamp,
+                username,
+                room,
+            } => [consts::SERVER_EVENT_USER_JOINED, timestamp, username, room].join(FIELD_SEPARATOR),
+            Self::UserLeft {
+                timestamp,
+                username,
+                room,
+                disconnected: false,
+            } => [consts::SERVER_EVENT_USER_LEFT, timestamp, username, room].join(FIELD_SEPARATOR),
+            Self::UserLeft {
+                timestamp,
+                username,
+                room,
+                disconnected: true,
+            } => [
+                consts::SERVER_EVENT_USER_LEFT,
+                timestamp,
+                username,
+                room,
+                consts::LEFT_DISCONNECTED,
+            ]
+            .join(FIELD_SEPARATOR),
+            Self::Broadcast {
+                timestamp,
+                id,
+                username,
+                message,
+                reply_to: None,
+            } => [consts::SERVER_EVENT_BROADCAST, timestamp, id, username, message].join(FIELD_SEPARATOR),
+            Self::Broadcast {
+                timestamp,
+                id,
+                username,
+                message,
+                reply_to: Some(reply_to),
+            } => [consts::SERVER_EVENT_REPLY, timestamp, id, username, reply_to, message].join(FIELD_SEPARATOR),
+            Self::Edited {
+                timestamp,
+                id,
+                username,
+                message,
+            } => [consts::SERVER_EVENT_EDITED, timestamp, id, username, message].join(FIELD_SEPARATOR),
+            Self::Deleted {
+                timestamp,
+                id,
+                username,
+            } => [consts::SERVER_EVENT_DELETED, timestamp, id, username].join(FIELD_SEPARATOR),
+            Self::Direct { from, to, message } => [consts::SERVER_EVENT_DM, from, to, message].join(FIELD_SEPARATOR),
+            Self::Action {
+                timestamp,
+                username,
+                text,
+            } => [consts::SERVER_EVENT_ACTION, timestamp, username, text].join(FIELD_SEPARATOR),
+            Self::Renamed { timestamp, from, to } => {
+                [consts::SERVER_EVENT_RENAMED, timestamp, from, to].join(FIELD_SEPARATOR)
+            }
+            Self::Info { text } => [consts::SERVER_EVENT_INFO, text].join(FIELD_SEPARATOR),
+            Self::History { message } => [consts::SERVER_EVENT_HISTORY, &message.to_string()].join(FIELD_SEPARATOR),
+            Self::Sequenced { seq, message } => {
+                [consts::SERVER_EVENT_SEQ, &seq.to_string(), &message.to_string()].join(FIELD_SEPARATOR)
+            }
+            Self::Truncated { first } => format!("{}{FIELD_SEPARATOR}{first}", consts::SERVER_EVENT_TRUNCATED),
+            Self::Ping => consts::SERVER_EVENT_PING.to_string(),
+            Self::ShuttingDown { seconds } => format!("{}{FIELD_SEPARATOR}{seconds}", consts::SERVER_EVENT_SHUTDOWN),
+            Self::Session { token, seconds } => {
+                [consts::SERVER_EVENT_SESSION, token, &seconds.to_string()].join(FIELD_SEPARATOR)
+            }
+            Self::Typing { username, active } => {
+                [consts::SERVER_EVENT_TYPING, username, typing_state(*active)].join(FIELD_SEPARATOR)
+            }
+            Self::Presence {
+                timestamp,
+                username,
+                away: Some(note),
+            } => [
+                consts::SERVER_EVENT_PRESENCE,
+                timestamp,
+                username,
+                consts::PRESENCE_AWAY,
+                note,
+            ]
+            .join(FIELD_SEPARATOR),
+            Self::Presence {
+                timestamp,
+                username,
+                away: None,
+            } => [
+                consts::SERVER_EVENT_PRESENCE,
+                timestamp,
+                username,
+                consts::PRESENCE_BACK,
+            ]
+            .join(FIELD_SEPARATOR),
+            Self::Announcement { timestamp, text } => {
+                [consts::SERVER_EVENT_ANNOUNCE, timestamp, text].join(FIELD_SEPARATOR)
             }
+            Self::File {
+                timestamp,
+                username,
+                name,
+                size,
+                data,
+            } => [
+                consts::SERVER_EVENT_FILE,
+                timestamp,
+                username,
+                name,
+                &size.to_string(),
+                data,
+            ]
+            .join(FIELD_SEPARATOR),
+            Self::Ack { id } => [consts::SERVER_EVENT_ACK, id].join(FIELD_SEPARATOR),
+            Self::Nack { id, code, reason } => [
+                consts::SERVER_EVENT_NACK,
+                id,
+                &code.status.to_string(),
+                &code.name,
+                reason,
+            ]
+            .join(FIELD_SEPARATOR),
+            Self::Pong { token } => [consts::SERVER_EVENT_PONG, token].join(FIELD_SEPARATOR),
+            Self::UserList { room, users } => {
+                [consts::SERVER_EVENT_USERLIST, room, &users.join(",")].join(FIELD_SEPARATOR)
+            }
+            Self::Goodbye => consts::SERVER_EVENT_GOODBYE.to_string(),
+            Self::Hello { server, caps } => [
+                consts::SERVER_EVENT_HELLO,
+                server,
+                &format!("{}{}", consts::HELLO_CAPS_PREFIX, caps.join(",")),
+            ]
+            .join(FIELD_SEPARATOR),
         };
         s.into_bytes()
     }
@@ -100,37 +353,364 @@ impl WireDecode for ServerMessage {
         match event_type.to_uppercase().as_str() {
             consts::SERVER_EVENT_OK => Ok(Self::Ok),
             consts::SERVER_EVENT_ERR => {
-                let reason = rest.ok_or(ServerParseError::MissingField("reason"))?.to_string();
-                Ok(Self::Err { reason })
+                let (code, reason) = coded_reason(rest)?;
+                Ok(Self::Err { code, reason })
             }
             consts::SERVER_EVENT_USER_JOINED => {
-                let username = rest.ok_or(ServerParseError::MissingField("username"))?.to_string();
-                Ok(Self::UserJoined { username })
-            }
-            consts::SERVER_EVENT_USER_LEFT => {
-                let username = rest.ok_or(ServerParseError::MissingField("username"))?.to_string();
-                Ok(Self::UserLeft { username })
+                let (timestamp, username, room) = three_fields(rest, ["timestamp", "username", "room"])?;
+                Ok(Self::UserJoined {
+                    timestamp: timestamp.to_string(),
+                    username: username.to_string(),
+                    room: room.to_string(),
+                })
             }
+            consts::SERVER_EVENT_USER_LEFT => decode_left(rest),
             consts::SERVER_EVENT_BROADCAST => {
-                let rest = rest.ok_or(ServerParseError::MissingField("username"))?;
-                // Find second separator for message
-                let (username, message) = match sz::find(rest, FIELD_SEPARATOR) {
-                    Some(idx) => (
-                        rest.get(..idx).ok_or(ServerParseError::MissingField("username"))?,
-                        rest.get(idx.saturating_add(1)..).unwrap_or(""),
-                    ),
-                    None => (rest, ""),
-                };
+                let (timestamp, id, username, message) = chat_line_fields(rest)?;
+                Ok(Self::Broadcast {
+                    timestamp,
+                    id,
+                    username,
+                    message,
+                    reply_to: None,
+                })
+            }
+            consts::SERVER_EVENT_REPLY => {
+                let (timestamp, id, username, rest) = chat_line_fields(rest)?;
+                let (reply_to, message) = split_field(&rest).ok_or(ServerParseError::MissingField("message"))?;
+                if reply_to.is_empty() {
+                    return Err(ServerParseError::MissingField("reply_to"));
+                }
                 Ok(Self::Broadcast {
+                    timestamp,
+                    id,
+                    username,
+                    message: message.to_string(),
+                    reply_to: Some(reply_to.to_string()),
+                })
+            }
+            consts::SERVER_EVENT_EDITED => {
+                let (timestamp, id, username, message) = chat_line_fields(rest)?;
+                Ok(Self::Edited {
+                    timestamp,
+                    id,
+                    username,
+                    message,
+                })
+            }
+            consts::SERVER_EVENT_DELETED => {
+                let (timestamp, id, username) = three_fields(rest, ["timestamp", "id", "username"])?;
+                if id.is_empty() {
+                    return Err(ServerParseError::MissingField("id"));
+                }
+                Ok(Self::Deleted {
+                    timestamp: timestamp.to_string(),
+                    id: id.to_string(),
                     username: username.to_string(),
+                })
+            }
+            consts::SERVER_EVENT_DM => {
+                let (from, to, message) = three_fields(rest, ["from", "to", "message"])?;
+                Ok(Self::Direct {
+                    from: from.to_string(),
+                    to: to.to_string(),
                     message: message.to_string(),
                 })
             }
+            consts::SERVER_EVENT_ACTION => {
+                let (timestamp, username, text) = three_fields(rest, ["timestamp", "username", "text"])?;
+                Ok(Self::Action {
+                    timestamp: timestamp.to_string(),
+                    username: username.to_string(),
+                    text: text.to_string(),
+                })
+            }
+            consts::SERVER_EVENT_RENAMED => {
+                let (timestamp, from, to) = three_fields(rest, ["timestamp", "from", "to"])?;
+                Ok(Self::Renamed {
+                    timestamp: timestamp.to_string(),
+                    from: from.to_string(),
+                    to: to.to_string(),
+                })
+            }
+            consts::SERVER_EVENT_INFO => {
+                let text = rest.ok_or(ServerParseError::MissingField("text"))?.to_string();
+                Ok(Self::Info { text })
+            }
+            consts::SERVER_EVENT_PING => Ok(Self::Ping),
+            consts::SERVER_EVENT_SHUTDOWN => {
+                let seconds = rest.ok_or(ServerParseError::MissingField("seconds"))?;
+                Ok(Self::ShuttingDown {
+                    seconds: seconds.parse().map_err(|_| ServerParseError::InvalidField("seconds"))?,
+                })
+            }
+            consts::SERVER_EVENT_SESSION => decode_session(rest),
+            consts::SERVER_EVENT_TYPING => decode_typing(rest),
+            consts::SERVER_EVENT_PRESENCE => decode_presence(rest),
+            consts::SERVER_EVENT_ANNOUNCE => {
+                let rest = rest.ok_or(ServerParseError::MissingField("timestamp"))?;
+                let (timestamp, text) = split_field(rest).ok_or(ServerParseError::MissingField("text"))?;
+                Ok(Self::Announcement {
+                    timestamp: timestamp.to_string(),
+                    text: text.to_string(),
+                })
+            }
+            consts::SERVER_EVENT_FILE => decode_file(rest),
+            consts::SERVER_EVENT_ACK => decode_ack(rest),
+            consts::SERVER_EVENT_NACK => decode_nack(rest),
+            consts::SERVER_EVENT_PONG => decode_pong(rest),
+            consts::SERVER_EVENT_USERLIST => decode_userlist(rest),
+            consts::SERVER_EVENT_GOODBYE => Ok(Self::Goodbye),
+            consts::SERVER_EVENT_HELLO => decode_hello(rest),
+            consts::SERVER_EVENT_HISTORY => {
+                let rest = rest.ok_or(ServerParseError::MissingField("message"))?;
+                Ok(Self::History {
+                    message: Box::new(Self::decode(rest.as_bytes())?),
+                })
+            }
+            consts::SERVER_EVENT_SEQ => {
+                let rest = rest.ok_or(ServerParseError::MissingField("seq"))?;
+                let (seq, message) = split_field(rest).ok_or(ServerParseError::MissingField("message"))?;
+                Ok(Self::Sequenced {
+                    seq: seq.parse().map_err(|_| ServerParseError::InvalidField("seq"))?,
+                    message: Box::new(Self::decode(message.as_bytes())?),
+                })
+            }
+            consts::SERVER_EVENT_TRUNCATED => {
+                let first = rest.ok_or(ServerParseError::MissingField("first"))?;
+                Ok(Self::Truncated {
+                    first: first.parse().map_err(|_| ServerParseError::InvalidField("first"))?,
+                })
+            }
             _ => Err(ServerParseError::UnknownEventType(event_type.to_string())),
         }
     }
 }
 
+/// The timestamp, id, sender and text of a `BROADCAST` or `EDITED` event,
+/// from the fields after its type. The text may be missing, and is then empty.
+fn chat_line_fields(rest: Option<&str>) -> Result<(String, String, String, String), ServerParseError> {
+    let rest = rest.ok_or(ServerParseError::MissingField("timestamp"))?;
+    let (timestamp, rest) = split_field(rest).ok_or(ServerParseError::MissingField("id"))?;
+    let (id, rest) = split_field(rest).ok_or(ServerParseError::MissingField("username"))?;
+    if id.is_empty() {
+        return Err(ServerParseError::MissingField("id"));
+    }
+    let (username, message) = split_field(rest).unwrap_or((rest, ""));
+    Ok((
+        timestamp.to_string(),
+        id.to_string(),
+        username.to_string(),
+        message.to_string(),
+    ))
+}
+
+/// A `SESSION` event from the fields after its type.
+fn decode_session(rest: Option<&str>) -> Result<ServerMessage, ServerParseError> {
+    let rest = rest.ok_or(ServerParseError::MissingField("token"))?;
+    let (token, seconds) = split_field(rest).ok_or(ServerParseError::MissingField("seconds"))?;
+    if token.is_empty() {
+        return Err(ServerParseError::MissingField("token"));
+    }
+    Ok(ServerMessage::Session {
+        token: token.to_string(),
+        seconds: seconds.parse().map_err(|_| ServerParseError::InvalidField("seconds"))?,
+    })
+}
+
+/// A `TYPING` event from the fields after its type.
+fn decode_typing(rest: Option<&str>) -> Result<ServerMessage, ServerParseError> {
+    let rest = rest.ok_or(ServerParseError::MissingField("username"))?;
+    let (username, state) = split_field(rest).ok_or(ServerParseError::MissingField("state"))?;
+    Ok(ServerMessage::Typing {
+        username: username.to_string(),
+        active: parse_typing_state(state).ok_or(ServerParseError::InvalidField("state"))?,
+    })
+}
+
+/// A `PRESENCE` event from the fields after its type. Going away always
+/// carries a note field, if only an empty one; coming back never does.
+fn decode_presence(rest: Option<&str>) -> Result<ServerMessage, ServerParseError> {
+    let (timestamp, username, status) = three_fields(rest, ["timestamp", "username", "status"])?;
+    let away = match split_field(status) {
+        Some((consts::PRESENCE_AWAY, note)) => Some(note.to_string()),
+        None if status == consts::PRESENCE_BACK => None,
+        _ => return Err(ServerParseError::InvalidField("status")),
+    };
+    Ok(ServerMessage::Presence {
+        timestamp: timestamp.to_string(),
+        username: username.to_string(),
+        away,
+    })
+}
+
+/// A `LEFT` event from the fields after its type. A dropped connection adds
+/// a field after the room; a user who left has none.
+fn decode_left(rest: Option<&str>) -> Result<ServerMessage, ServerParseError> {
+    let (timestamp, username, room) = three_fields(rest, ["timestamp", "username", "room"])?;
+    let (room, disconnected) = match split_field(room) {
+        Some((room, consts::LEFT_DISCONNECTED)) => (room, true),
+        Some(_) => return Err(ServerParseError::InvalidField("reason")),
+        None => (room, false),
+    };
+    Ok(ServerMessage::UserLeft {
+        timestamp: timestamp.to_string(),
+        username: username.to_string(),
+        room: room.to_string(),
+        disconnected,
+    })
+}
+
+/// A `HELLO` event from the fields after its type. A server that offers
+/// nothing still sends an empty `caps=`.
+fn decode_hello(rest: Option<&str>) -> Result<ServerMessage, ServerParseError> {
+    let rest = rest.ok_or(ServerParseError::MissingField("server"))?;
+    let (server, caps) = split_field(rest).ok_or(ServerParseError::MissingField("caps"))?;
+    if server.is_empty() {
+        return Err(ServerParseError::MissingField("server"));
+    }
+    let caps = caps
+        .strip_prefix(consts::HELLO_CAPS_PREFIX)
+        .ok_or(ServerParseError::InvalidField("caps"))?;
+    Ok(ServerMessage::Hello {
+        server: server.to_string(),
+        caps: caps
+            .split(',')
+            .filter(|cap| !cap.is_empty())
+            .map(str::to_string)
+            .collect(),
+    })
+}
+
+/// A `USERLIST` event from the fields after its type. An empty room still
+/// sends its empty list of names.
+fn decode_userlist(rest: Option<&str>) -> Result<ServerMessage, ServerParseError> {
+    let rest = rest.ok_or(ServerParseError::MissingField("room"))?;
+    let (room, users) = split_field(rest).ok_or(ServerParseError::MissingField("users"))?;
+    if room.is_empty() {
+        return Err(ServerParseError::MissingField("room"));
+    }
+    Ok(ServerMessage::UserList {
+        room: room.to_string(),
+        users: users
+            .split(',')
+            .filter(|user| !user.is_empty())
+            .map(str::to_string)
+            .collect(),
+    })
+}
+
+/// A `FILE` event from the fields after its type. Neither a file's name nor
+/// base64 has a separator in it, so each field ends at the next one.
+fn decode_file(rest: Option<&str>) -> Result<ServerMessage, ServerParseError> {
+    let (timestamp, username, rest) = three_fields(rest, ["timestamp", "username", "name"])?;
+    let (name, rest) = split_field(rest).ok_or(ServerParseError::MissingField("size"))?;
+    let (size, data) = split_field(rest).ok_or(ServerParseError::MissingField("data"))?;
+    if name.is_empty() {
+        return Err(ServerParseError::MissingField("name"));
+    }
+    Ok(ServerMessage::File {
+        timestamp: timestamp.to_string(),
+        username: username.to_string(),
+        name: name.to_string(),
+        size: size.parse().map_err(|_| ServerParseError::InvalidField("size"))?,
+        data: data.to_string(),
+    })
+}
+
+/// An `ACK` event from the field after its type.
+fn decode_ack(rest: Option<&str>) -> Result<ServerMessage, ServerParseError> {
+    let id = rest
+        .filter(|id| !id.is_empty())
+        .ok_or(ServerParseError::MissingField("id"))?;
+    Ok(ServerMessage::Ack { id: id.to_string() })
+}
+
+/// A `PONG` event from the field after its type.
+fn decode_pong(rest: Option<&str>) -> Result<ServerMessage, ServerParseError> {
+    let token = rest
+        .filter(|token| !token.is_empty())
+        .ok_or(ServerParseError::MissingField("token"))?;
+    Ok(ServerMessage::Pong {
+        token: token.to_string(),
+    })
+}
+
+/// A `NACK` event from the fields after its type.
+fn decode_nack(rest: Option<&str>) -> Result<ServerMessage, ServerParseError> {
+    let rest = rest.ok_or(ServerParseError::MissingField("id"))?;
+    let (id, reason) = split_field(rest).ok_or(ServerParseError::MissingField("reason"))?;
+    if id.is_empty() {
+        return Err(ServerParseError::MissingField("id"));
+    }
+    let (code, reason) = coded_reason(Some(reason))?;
+    Ok(ServerMessage::Nack {
+        id: id.to_string(),
+        code,
+        reason,
+    })
+}
+
+/// The code and reason of an `ERR` or `NACK`, from `<status>|<name>|<reason>`,
+/// or from a bare `<reason>` as a server that predates codes sends it, which
+/// is read as [`ErrorCode::UNKNOWN`].
+fn coded_reason(rest: Option<&str>) -> Result<(ErrorCode, String), ServerParseError> {
+    let rest = rest.ok_or(ServerParseError::MissingField("reason"))?;
+    let first = split_field(rest).map_or(rest, |(first, _)| first);
+    if first.is_empty() || !first.bytes().all(|b| b.is_ascii_digit()) {
+        return Ok((ErrorCode::UNKNOWN, rest.to_string()));
+    }
+    let (status, name, reason) = three_fields(Some(rest), ["status", "name", "reason"])?;
+    let status = status.parse().map_err(|_| ServerParseError::InvalidField("status"))?;
+    let code = ErrorCode {
+        status,
+        name: name.to_string().into(),
+    };
+    Ok((code, reason.to_string()))
+}
+
+/// How a typing state is written: `start` or `stop`.
+#[must_use]
+pub const fn typing_state(active: bool) -> &'static str {
+    if active {
+        consts::TYPING_STARTED
+    } else {
+        consts::TYPING_STOPPED
+    }
+}
+
+/// The inverse of [`typing_state`].
+#[must_use]
+pub fn parse_typing_state(state: &str) -> Option<bool> {
+    match state {
+        consts::TYPING_STARTED => Some(true),
+        consts::TYPING_STOPPED => Some(false),
+        _ => None,
+    }
+}
+
+/// Splits `s` at the first field separator.
+///
+/// Everything after the separator is returned untouched, so trailing fields
+/// may themselves contain separators.
+fn split_field(s: &str) -> Option<(&str, &str)> {
+    let idx = sz::find(s, FIELD_SEPARATOR)?;
+    Some((s.get(..idx)?, s.get(idx.saturating_add(1)..)?))
+}
+
+/// Splits the fields after the event type into three, the last taking the
+/// rest of the line; `names` label each field in the error.
+fn three_fields<'a>(
+    rest: Option<&'a str>,
+    names: [&'static str; 3],
+) -> Result<(&'a str, &'a str, &'a str), ServerParseError> {
+    let [first_name, second_name, third_name] = names;
+    let rest = rest.ok_or(ServerParseError::MissingField(first_name))?;
+    let (first, rest) = split_field(rest).ok_or(ServerParseError::MissingField(second_name))?;
+    let (second, third) = split_field(rest).ok_or(ServerParseError::MissingField(third_name))?;
+    Ok((first, second, third))
+}
+
 impl std::fmt::Display for ServerMessage {
     fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
         let bytes = self.encode();
@@ -142,12 +722,86 @@ impl std::fmt::Display for ServerMessage {
 /// Client command types
 #[derive(Debug, Clone, PartialEq, Eq)]
 pub enum ClientMessage {
-    /// Join with username
-    Join { username: String },
-    /// Send a message
-    Send { message: String },
+    /// Join with username, and the password if the server requires one
+    Join { username: String, password: Option<String> },
+    /// Take back a dropped session with the token it was given
+    Rejoin { token: String },
+    /// Before joining, compress the rest of the connection, both ways, once
+    /// the server answers `OK`
+    Compress,
+    /// Have chat lines sent numbered, as [`ServerMessage::Sequenced`]
+    Sequence,
+    /// Let `send` carry bytes that aren't UTF-8, shared with the room as a
+    /// file named [`consts::BINARY_FILE_NAME`]
+    Binary,
+    /// Replay the room's history again, only the lines numbered after
+    /// `after` if given, to fill a gap
+    Resync { after: Option<u64> },
+    /// Send a message, with an id if the sender wants an `ACK` or `NACK` for it
+    Send { id: Option<String>, message: String },
+    /// Send a message in reply to the line `reply_to` in the room, which the
+    /// server must still have in its history; `id` as for `Send`
+    Reply {
+        id: Option<String>,
+        reply_to: String,
+        message: String,
+    },
+    /// Emote to the room, e.g. `me waves hello`
+    Action { text: String },
+    /// Send a private message to a single user
+    Direct { to: String, message: String },
+    /// Replay one's recent private messages with a user
+    DirectHistory { username: String },
+    /// Move into a named room
+    JoinRoom { room: String },
+    /// List non-empty rooms
+    ListRooms,
+    /// List online users
+    Who,
+    /// List the commands the server takes, as `INFO` lines
+    Help,
+    /// Answer to a server `PING`
+    Pong,
+    /// Round-trip probe; the server answers with `PONG` and the same token
+    Ping { token: String },
+    /// The user is typing a chat line; repeated while they keep at it
+    Typing,
+    /// Change one's own username
+    Nick { username: String },
+    /// Claim operator rights with the server's admin token
+    Auth { token: String },
+    /// Disconnect a user; operators only
+    Kick { username: String },
+    /// Ban a user and their address; operators only
+    Ban { username: String },
+    /// Lift a ban; operators only
+    Unban { username: String },
+    /// Server uptime, load and memory; operators only
+    Stats,
+    /// Everyone online, grouped by room; operators only
+    WhoAll,
+    /// Every open connection, joined or not, by address; operators only
+    Connections,
+    /// Close the connections from `addr`, an `ip:port`; operators only
+    DropConnection { addr: String },
+    /// Announce `message` to everyone online, in every room; operators only
+    Broadcast { message: String },
+    /// Share a file with the room: its name, and its contents base64-encoded
+    File { name: String, data: String },
+    /// Set `room`'s limits, e.g. `rate=1 len=8192`, `default` to drop them,
+    /// or with `policy` empty show them; operators only
+    RoomPolicy { room: String, policy: String },
+    /// Change the text of one's own recent chat line `id`
+    Edit { id: String, message: String },
+    /// Take back one's own recent chat line `id`
+    Delete { id: String },
+    /// Show as away, with a note that may be empty, until the next `send`
+    Away { message: String },
     /// Leave the chat
     Leave,
+    /// A `/command` the client doesn't know, passed on as the user typed it,
+    /// e.g. `/w bob hi`, for the server to resolve; `command` is without the `/`
+    Typed { command: String, args: String },
 }
 
 /// Parse error for client messages
@@ -157,18 +811,80 @@ pub enum ClientParseError {
     Empty,
     #[error("invalid utf-8")]
     InvalidUtf8,
+    /// Not UTF-8, in a command that names the sender
+    #[error("invalid username encoding")]
+    InvalidUsernameEncoding,
     #[error("unknown command: {0}")]
     UnknownCommand(String),
     #[error("missing field: {0}")]
     MissingField(&'static str),
+    #[error("invalid field: {0}")]
+    InvalidField(&'static str),
+    #[error("invalid json: {0}")]
+    InvalidJson(String),
 }
 
 impl WireEncode for ClientMessage {
     fn encode(&self) -> Vec<u8> {
         let s = match self {
-            Self::Join { username } => [consts::CLIENT_JOIN_CMD, username].join(FIELD_SEPARATOR),
-            Self::Send { message } => [consts::CLIENT_SEND_CMD, message].join(FIELD_SEPARATOR),
+            Self::Join {
+                username,
+                password: None,
+            } => [consts::CLIENT_JOIN_CMD, username].join(FIELD_SEPARATOR),
+            Self::Join {
+                username,
+                password: Some(password),
+            } => [consts::CLIENT_JOIN_CMD, username, password].join(FIELD_SEPARATOR),
+            Self::Rejoin { token } => [consts::CLIENT_REJOIN_CMD, token].join(FIELD_SEPARATOR),
+            Self::Compress => consts::CLIENT_COMPRESS_CMD.to_string(),
+            Self::Sequence => consts::CLIENT_SEQ_CMD.to_string(),
+            Self::Binary => consts::CLIENT_BINARY_CMD.to_string(),
+            Self::Resync { after: None } => consts::CLIENT_RESYNC_CMD.to_string(),
+            Self::Resync { after: Some(after) } => format!("{}{FIELD_SEPARATOR}{after}", consts::CLIENT_RESYNC_CMD),
+            Self::Send { id: None, message } => [consts::CLIENT_SEND_CMD, message].join(FIELD_SEPARATOR),
+            Self::Send { id: Some(id), message } => [consts::CLIENT_SEND_ID_CMD, id, message].join(FIELD_SEPARATOR),
+            Self::Reply {
+                id: None,
+                reply_to,
+                message,
+            } => [consts::CLIENT_REPLY_CMD, reply_to, message].join(FIELD_SEPARATOR),
+            Self::Reply {
+                id: Some(id),
+                reply_to,
+                message,
+            } => [consts::CLIENT_REPLY_ID_CMD, id, reply_to, message].join(FIELD_SEPARATOR),
+            Self::Action { text } => [consts::CLIENT_ME_CMD, text].join(FIELD_SEPARATOR),
+            Self::Direct { to, message } => [consts::CLIENT_DM_CMD, to, message].join(FIELD_SEPARATOR),
+            Self::DirectHistory { username } => [consts::CLIENT_DM_HISTORY_CMD, username].join(FIELD_SEPARATOR),
+            Self::JoinRoom { room } => [consts::CLIENT_ROOM_CMD, room].join(FIELD_SEPARATOR),
+            Self::ListRooms => consts::CLIENT_ROOMS_CMD.to_string(),
+            Self::Who => consts::CLIENT_WHO_CMD.to_string(),
+            Self::Help => consts::CLIENT_HELP_CMD.to_string(),
+            Self::Pong => consts::CLIENT_PONG_CMD.to_string(),
+            Self::Ping { token } => [consts::CLIENT_PING_CMD, token].join(FIELD_SEPARATOR),
+            Self::Typing => consts::CLIENT_TYPING_CMD.to_string(),
+            Self::Nick { username } => [consts::CLIENT_NICK_CMD, username].join(FIELD_SEPARATOR),
+            Self::Auth { token } => [consts::CLIENT_AUTH_CMD, token].join(FIELD_SEPARATOR),
+            Self::Kick { username } => [consts::CLIENT_KICK_CMD, username].join(FIELD_SEPARATOR),
+            Self::Ban { username } => [consts::CLIENT_BAN_CMD, username].join(FIELD_SEPARATOR),
+            Self::Unban { username } => [consts::CLIENT_UNBAN_CMD, username].join(FIELD_SEPARATOR),
+            Self::Stats => consts::CLIENT_STATS_CMD.to_string(),
+            Self::WhoAll => consts::CLIENT_WHO_ALL_CMD.to_string(),
+            Self::Connections => consts::CLIENT_CONNS_CMD.to_string(),
+            Self::DropConnection { addr } => [consts::CLIENT_DROP_CMD, addr].join(FIELD_SEPARATOR),
+            Self::Broadcast { message } => [consts::CLIENT_BROADCAST_CMD, message].join(FIELD_SEPARATOR),
+            Self::File { name, data } => [consts::CLIENT_FILE_CMD, name, data].join(FIELD_SEPARATOR),
+            Self::RoomPolicy { room, policy } if policy.is_empty() => {
+                [consts::CLIENT_ROOM_POLICY_CMD, room].join(FIELD_SEPARATOR)
+            }
+            Self::RoomPolicy { room, policy } => [consts::CLIENT_ROOM_POLICY_CMD, room, policy].join(FIELD_SEPARATOR),
+            Self::Edit { id, message } => [consts::CLIENT_EDIT_CMD, id, message].join(FIELD_SEPARATOR),
+            Self::Delete { id } => [consts::CLIENT_DELETE_CMD, id].join(FIELD_SEPARATOR),
+            Self::Away { message } if message.is_empty() => consts::CLIENT_AWAY_CMD.to_string(),
+            Self::Away { message } => [consts::CLIENT_AWAY_CMD, message].join(FIELD_SEPARATOR),
             Self::Leave => consts::CLIENT_LEAVE_CMD.to_string(),
+            Self::Typed { command, args } if args.is_empty() => format!("/{command}"),
+            Self::Typed { command, args } => [&format!("/{command}"), args.as_str()].join(FIELD_SEPARATOR),
         };
         s.into_bytes()
     }
@@ -178,13 +894,27 @@ impl WireDecode for ClientMessage {
     type Error = ClientParseError;
 
     fn decode(bytes: &[u8]) -> Result<Self, Self::Error> {
-        let s = std::str::from_utf8(bytes).map_err(|_| ClientParseError::InvalidUtf8)?;
+        let s = std::str::from_utf8(bytes).map_err(|_| invalid_utf8(bytes))?;
+        // takes the `\r` of a Windows client's CRLF along with the newline, so
+        // `bob\r` is the same name as `bob`
         let trimmed = s.trim();
 
         if trimmed.is_empty() {
             return Err(ClientParseError::Empty);
         }
 
+        // typed by hand, the name may end at a space rather than a separator
+        if let Some(typed) = trimmed.strip_prefix('/') {
+            let (command, args) = typed.split_once([' ', '|']).unwrap_or((typed, ""));
+            if command.is_empty() {
+                return Err(ClientParseError::UnknownCommand(trimmed.to_string()));
+            }
+            return Ok(Self::Typed {
+                command: command.to_string(),
+                args: args.trim_start().to_string(),
+            });
+        }
+
         // Find first separator
         let (command, rest) = match sz::find(trimmed, FIELD_SEPARATOR) {
             Some(idx) => (
@@ -196,25 +926,217 @@ impl WireDecode for ClientMessage {
 
         match command.to_uppercase().as_str() {
             consts::CLIENT_JOIN_CMD => {
-                let username = rest.ok_or(ClientParseError::MissingField("username"))?.to_string();
-                if username.is_empty() {
-                    return Err(ClientParseError::MissingField("username"));
+                let rest = rest.ok_or(ClientParseError::MissingField("username"))?;
+                // an empty name is left for the server to reject with a reason
+                let (username, password) = split_field(rest).map_or((rest, None), |(u, p)| (u, Some(p)));
+                Ok(Self::Join {
+                    username: username.to_string(),
+                    password: password.filter(|p| !p.is_empty()).map(str::to_string),
+                })
+            }
+            consts::CLIENT_REJOIN_CMD => Ok(Self::Rejoin {
+                token: required_field(rest, "token")?,
+            }),
+            // an empty message is the server's to refuse, with a clearer reason
+            consts::CLIENT_SEND_CMD => Ok(Self::Send {
+                id: None,
+                message: rest.unwrap_or_default().to_string(),
+            }),
+            consts::CLIENT_SEND_ID_CMD => decode_send_id(rest),
+            consts::CLIENT_REPLY_CMD => decode_reply(None, rest),
+            consts::CLIENT_REPLY_ID_CMD => {
+                let rest = rest.ok_or(ClientParseError::MissingField("id"))?;
+                let (id, rest) = split_field(rest).ok_or(ClientParseError::MissingField("reply_to"))?;
+                if id.is_empty() {
+                    return Err(ClientParseError::MissingField("id"));
                 }
-                Ok(Self::Join { username })
+                decode_reply(Some(id.to_string()), Some(rest))
             }
-            consts::CLIENT_SEND_CMD => {
-                let message = rest.ok_or(ClientParseError::MissingField("message"))?.to_string();
+            // an empty action is the server's to refuse, with a clearer reason
+            consts::CLIENT_ME_CMD => Ok(Self::Action {
+                text: rest.unwrap_or_default().to_string(),
+            }),
+            consts::CLIENT_DM_CMD => {
+                let rest = rest.ok_or(ClientParseError::MissingField("username"))?;
+                let (to, message) = split_field(rest).ok_or(ClientParseError::MissingField("message"))?;
+                if to.is_empty() {
+                    return Err(ClientParseError::MissingField("username"));
+                }
                 if message.is_empty() {
                     return Err(ClientParseError::MissingField("message"));
                 }
-                Ok(Self::Send { message })
+                Ok(Self::Direct {
+                    to: to.to_string(),
+                    message: message.to_string(),
+                })
+            }
+            consts::CLIENT_DM_HISTORY_CMD => Ok(Self::DirectHistory {
+                username: required_field(rest, "username")?,
+            }),
+            consts::CLIENT_ROOM_CMD => {
+                let room = rest.ok_or(ClientParseError::MissingField("room"))?.to_string();
+                if room.is_empty() {
+                    return Err(ClientParseError::MissingField("room"));
+                }
+                Ok(Self::JoinRoom { room })
             }
+            consts::CLIENT_ROOMS_CMD => Ok(Self::ListRooms),
+            consts::CLIENT_COMPRESS_CMD => Ok(Self::Compress),
+            consts::CLIENT_SEQ_CMD => Ok(Self::Sequence),
+            consts::CLIENT_BINARY_CMD => Ok(Self::Binary),
+            consts::CLIENT_RESYNC_CMD => Ok(Self::Resync {
+                after: rest
+                    .filter(|after| !after.is_empty())
+                    .map(|after| after.parse().map_err(|_| ClientParseError::InvalidField("seq")))
+                    .transpose()?,
+            }),
+            consts::CLIENT_WHO_CMD => Ok(Self::Who),
+            consts::CLIENT_HELP_CMD => Ok(Self::Help),
+            consts::CLIENT_PONG_CMD => Ok(Self::Pong),
+            consts::CLIENT_PING_CMD => Ok(Self::Ping {
+                token: required_field(rest, "token")?,
+            }),
+            consts::CLIENT_TYPING_CMD => Ok(Self::Typing),
+            consts::CLIENT_NICK_CMD => Ok(Self::Nick {
+                username: required_field(rest, "username")?,
+            }),
+            consts::CLIENT_AUTH_CMD => Ok(Self::Auth {
+                token: required_field(rest, "token")?,
+            }),
+            consts::CLIENT_KICK_CMD => Ok(Self::Kick {
+                username: required_field(rest, "username")?,
+            }),
+            consts::CLIENT_BAN_CMD => Ok(Self::Ban {
+                username: required_field(rest, "username")?,
+            }),
+            consts::CLIENT_UNBAN_CMD => Ok(Self::Unban {
+                username: required_field(rest, "username")?,
+            }),
+            consts::CLIENT_STATS_CMD => Ok(Self::Stats),
+            consts::CLIENT_WHO_ALL_CMD => Ok(Self::WhoAll),
+            consts::CLIENT_CONNS_CMD => Ok(Self::Connections),
+            consts::CLIENT_DROP_CMD => Ok(Self::DropConnection {
+                addr: required_field(rest, "addr")?,
+            }),
+            consts::CLIENT_BROADCAST_CMD => Ok(Self::Broadcast {
+                message: required_field(rest, "message")?,
+            }),
+            consts::CLIENT_FILE_CMD => {
+                let rest = rest.ok_or(ClientParseError::MissingField("name"))?;
+                // an empty file is still a file
+                let (name, data) = split_field(rest).ok_or(ClientParseError::MissingField("data"))?;
+                if name.is_empty() {
+                    return Err(ClientParseError::MissingField("name"));
+                }
+                Ok(Self::File {
+                    name: name.to_string(),
+                    data: data.to_string(),
+                })
+            }
+            consts::CLIENT_ROOM_POLICY_CMD => {
+                let rest = rest.ok_or(ClientParseError::MissingField("room"))?;
+                let (room, policy) = split_field(rest).unwrap_or((rest, ""));
+                if room.is_empty() {
+                    return Err(ClientParseError::MissingField("room"));
+                }
+                Ok(Self::RoomPolicy {
+                    room: room.to_string(),
+                    policy: policy.to_string(),
+                })
+            }
+            consts::CLIENT_EDIT_CMD => decode_edit(rest),
+            consts::CLIENT_DELETE_CMD => Ok(Self::Delete {
+                id: required_field(rest, "id")?,
+            }),
+            consts::CLIENT_AWAY_CMD => Ok(Self::Away {
+                message: rest.unwrap_or_default().to_string(),
+            }),
             consts::CLIENT_LEAVE_CMD => Ok(Self::Leave),
             _ => Err(ClientParseError::UnknownCommand(command.to_string())),
         }
     }
 }
 
+/// A `SENDID` command from the fields after its type. Its message may be
+/// empty, so the server can `NACK` it rather than leave the id unanswered.
+/// A `SEND` can't take the id instead: `SEND|42|done` says `42|done`.
+fn decode_send_id(rest: Option<&str>) -> Result<ClientMessage, ClientParseError> {
+    let rest = rest.ok_or(ClientParseError::MissingField("id"))?;
+    let (id, message) = split_field(rest).unwrap_or((rest, ""));
+    if id.is_empty() {
+        return Err(ClientParseError::MissingField("id"));
+    }
+    Ok(ClientMessage::Send {
+        id: Some(id.to_string()),
+        message: message.to_string(),
+    })
+}
+
+/// A `REPLY` from the fields after its type, or after the id of a
+/// `REPLYID`. Like a `SENDID`, its message may be empty.
+fn decode_reply(id: Option<String>, rest: Option<&str>) -> Result<ClientMessage, ClientParseError> {
+    let rest = rest.ok_or(ClientParseError::MissingField("reply_to"))?;
+    let (reply_to, message) = split_field(rest).unwrap_or((rest, ""));
+    if reply_to.is_empty() {
+        return Err(ClientParseError::MissingField("reply_to"));
+    }
+    Ok(ClientMessage::Reply {
+        id,
+        reply_to: reply_to.to_string(),
+        message: message.to_string(),
+    })
+}
+
+/// An `EDIT` command from the fields after its type; both are required.
+fn decode_edit(rest: Option<&str>) -> Result<ClientMessage, ClientParseError> {
+    let rest = rest.ok_or(ClientParseError::MissingField("id"))?;
+    let (id, message) = split_field(rest).ok_or(ClientParseError::MissingField("text"))?;
+    if id.is_empty() {
+        return Err(ClientParseError::MissingField("id"));
+    }
+    if message.is_empty() {
+        return Err(ClientParseError::MissingField("text"));
+    }
+    Ok(ClientMessage::Edit {
+        id: id.to_string(),
+        message: message.to_string(),
+    })
+}
+
+/// The rest of the line as one non-empty field.
+/// Why `bytes` that aren't UTF-8 were refused: a `join` or `nick` says it is
+/// the name, which is where a bad byte would do harm.
+fn invalid_utf8(bytes: &[u8]) -> ClientParseError {
+    let command = bytes.split(|b| *b == b'|').next().unwrap_or_default().trim_ascii();
+    if [consts::CLIENT_JOIN_CMD, consts::CLIENT_NICK_CMD]
+        .iter()
+        .any(|name| command.eq_ignore_ascii_case(name.as_bytes()))
+    {
+        ClientParseError::InvalidUsernameEncoding
+    } else {
+        ClientParseError::InvalidUtf8
+    }
+}
+
+/// The payload of a `send` in `bytes`, which needn't be UTF-8, or `None` if
+/// they are some other command.
+pub fn binary_payload(bytes: &[u8]) -> Option<&[u8]> {
+    let line = bytes.trim_ascii();
+    let separator = line.iter().position(|b| *b == b'|')?;
+    let (command, payload) = line.split_at(separator);
+    let payload = payload.get(1..).filter(|payload| !payload.is_empty())?;
+    command
+        .eq_ignore_ascii_case(consts::CLIENT_SEND_CMD.as_bytes())
+        .then_some(payload)
+}
+
+fn required_field(rest: Option<&str>, name: &'static str) -> Result<String, ClientParseError> {
+    match rest {
+        Some(value) if !value.is_empty() => Ok(value.to_string()),
+        _ => Err(ClientParseError::MissingField(name)),
+    }
+}
+
 impl std::fmt::Display for ClientMessage {
     fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
         let bytes = self.encode();
@@ -244,101 +1166,388 @@ mod tests {
     #[test]
     fn test_server_error_encode() {
         let msg = ServerMessage::Err {
+            code: ErrorCode::NAME_TAKEN,
             reason: "username taken".to_string(),
         };
-        assert_eq!(msg.encode(), b"ERR|username taken");
+        assert_eq!(msg.encode(), b"ERR|409|name-taken|username taken");
     }
 
     #[test]
     fn test_server_error_decode() {
-        let msg = ServerMessage::decode(b"ERR|username taken").expect("should decode");
+        let msg = ServerMessage::decode(b"ERR|409|name-taken|username taken").expect("should decode");
         assert_eq!(
             msg,
             ServerMessage::Err {
+                code: ErrorCode::NAME_TAKEN,
                 reason: "username taken".to_string()
             }
         );
+        assert!(matches!(
+            ServerMessage::decode(b"ERR|99999|name-taken|username taken"),
+            Err(ServerParseError::InvalidField("status"))
+        ));
+        assert!(matches!(
+            ServerMessage::decode(b"ERR|409|name-taken"),
+            Err(ServerParseError::MissingField("reason"))
+        ));
+        assert!(matches!(
+            ServerMessage::decode(b"ERR"),
+            Err(ServerParseError::MissingField(_))
+        ));
+    }
+
+    #[test]
+    fn test_server_error_decode_without_a_code() {
+        // what a server that predates codes sends, e.g. refusing COMPRESS
+        let legacy = |reason: &str| ServerMessage::Err {
+            code: ErrorCode::UNKNOWN,
+            reason: reason.to_string(),
+        };
+        assert_eq!(
+            ServerMessage::decode(b"ERR|unknown command: COMPRESS").expect("should decode"),
+            legacy("unknown command: COMPRESS")
+        );
+        assert_eq!(
+            ServerMessage::decode(b"ERR|username taken").expect("should decode"),
+            legacy("username taken")
+        );
+        assert_eq!(
+            ServerMessage::decode(b"ERR|taken|name-taken|username taken").expect("should decode"),
+            legacy("taken|name-taken|username taken")
+        );
     }
 
     #[test]
     fn test_server_user_joined_encode() {
         let msg = ServerMessage::UserJoined {
+            timestamp: "2024-01-02T15:04:05Z".to_string(),
             username: "alice".to_string(),
+            room: "#random".to_string(),
         };
-        assert_eq!(msg.encode(), b"JOINED|alice");
+        assert_eq!(msg.encode(), b"JOINED|2024-01-02T15:04:05Z|alice|#random");
     }
 
     #[test]
     fn test_server_user_joined_decode() {
-        let msg = ServerMessage::decode(b"JOINED|alice").expect("should decode");
+        let msg = ServerMessage::decode(b"JOINED|2024-01-02T15:04:05Z|alice|#random").expect("should decode");
         assert_eq!(
             msg,
             ServerMessage::UserJoined {
-                username: "alice".to_string()
+                timestamp: "2024-01-02T15:04:05Z".to_string(),
+                username: "alice".to_string(),
+                room: "#random".to_string()
             }
         );
     }
 
+    #[test]
+    fn test_server_user_joined_decode_missing_room() {
+        assert!(ServerMessage::decode(b"JOINED|2024-01-02T15:04:05Z|alice").is_err());
+    }
+
+    #[test]
+    fn test_server_user_joined_decode_missing_timestamp() {
+        assert!(ServerMessage::decode(b"JOINED").is_err());
+        assert!(ServerMessage::decode(b"BROADCAST").is_err());
+    }
+
     #[test]
     fn test_server_user_left_encode() {
         let msg = ServerMessage::UserLeft {
+            timestamp: "2024-01-02T15:04:05Z".to_string(),
             username: "bob".to_string(),
+            room: "#general".to_string(),
+            disconnected: false,
+        };
+        assert_eq!(msg.encode(), b"LEFT|2024-01-02T15:04:05Z|bob|#general");
+
+        let dropped = ServerMessage::UserLeft {
+            disconnected: true,
+            ..msg
         };
-        assert_eq!(msg.encode(), b"LEFT|bob");
+        assert_eq!(dropped.encode(), b"LEFT|2024-01-02T15:04:05Z|bob|#general|disconnected");
     }
 
     #[test]
     fn test_server_user_left_decode() {
-        let msg = ServerMessage::decode(b"LEFT|bob").expect("should decode");
+        let msg = ServerMessage::decode(b"LEFT|2024-01-02T15:04:05Z|bob|#general").expect("should decode");
         assert_eq!(
             msg,
             ServerMessage::UserLeft {
-                username: "bob".to_string()
+                timestamp: "2024-01-02T15:04:05Z".to_string(),
+                username: "bob".to_string(),
+                room: "#general".to_string(),
+                disconnected: false,
             }
         );
+
+        let msg = ServerMessage::decode(b"LEFT|2024-01-02T15:04:05Z|bob|#general|disconnected").expect("should decode");
+        assert!(matches!(msg, ServerMessage::UserLeft { room, disconnected: true, .. } if room == "#general"));
+        assert!(ServerMessage::decode(b"LEFT|2024-01-02T15:04:05Z|bob|#general|vanished").is_err());
+    }
+
+    #[test]
+    fn test_server_info_roundtrip() {
+        let msg = ServerMessage::Info {
+            text: "Rooms (1): #general (2)".to_string(),
+        };
+        assert_eq!(msg.encode(), b"INFO|Rooms (1): #general (2)");
+        assert_eq!(ServerMessage::decode(&msg.encode()).expect("should decode"), msg);
+    }
+
+    #[test]
+    fn test_server_history_roundtrip() {
+        let msg = ServerMessage::History {
+            message: Box::new(ServerMessage::Broadcast {
+                timestamp: "2024-01-02T15:04:05Z".to_string(),
+                id: "7".to_string(),
+                username: "bob".to_string(),
+                message: "earlier|on".to_string(),
+                reply_to: None,
+            }),
+        };
+        assert_eq!(msg.encode(), b"HISTORY|BROADCAST|2024-01-02T15:04:05Z|7|bob|earlier|on");
+        assert_eq!(ServerMessage::decode(&msg.encode()).expect("should decode"), msg);
+    }
+
+    #[test]
+    fn test_server_sequenced_roundtrip() {
+        let msg = ServerMessage::History {
+            message: Box::new(ServerMessage::Sequenced {
+                seq: 12,
+                message: Box::new(ServerMessage::Action {
+                    timestamp: "2024-01-02T15:04:05Z".to_string(),
+                    username: "bob".to_string(),
+                    text: "waves|back".to_string(),
+                }),
+            }),
+        };
+        assert_eq!(
+            msg.encode(),
+            b"HISTORY|SEQ|12|ACTION|2024-01-02T15:04:05Z|bob|waves|back"
+        );
+        assert_eq!(ServerMessage::decode(&msg.encode()).expect("should decode"), msg);
+        assert!(ServerMessage::decode(b"SEQ|12").is_err());
+        assert!(ServerMessage::decode(b"SEQ|twelve|OK").is_err());
+
+        assert_eq!(ClientMessage::Sequence.encode(), b"SEQ");
+        assert_eq!(
+            ClientMessage::decode(b"seq").expect("should decode"),
+            ClientMessage::Sequence
+        );
+    }
+
+    #[test]
+    fn test_binary_payload() {
+        assert_eq!(ClientMessage::Binary.encode(), b"BINARY");
+        assert_eq!(
+            ClientMessage::decode(b"binary").expect("should decode"),
+            ClientMessage::Binary
+        );
+        assert_eq!(binary_payload(b"SEND|\xff\xfe|x\n"), Some(&b"\xff\xfe|x"[..]));
+        assert_eq!(binary_payload(b"send|\xc3"), Some(&b"\xc3"[..]));
+        assert_eq!(binary_payload(b"SEND|"), None);
+        assert_eq!(binary_payload(b"DM|bob|\xff"), None);
+        assert_eq!(binary_payload(b"\xff"), None);
+    }
+
+    #[test]
+    fn test_resync_roundtrip() {
+        let truncated = ServerMessage::Truncated { first: 5 };
+        assert_eq!(truncated.encode(), b"TRUNCATED|5");
+        assert_eq!(ServerMessage::decode(b"TRUNCATED|5").expect("should decode"), truncated);
+        assert!(ServerMessage::decode(b"TRUNCATED").is_err());
+        assert!(ServerMessage::decode(b"TRUNCATED|five").is_err());
+
+        for msg in [
+            ClientMessage::Resync { after: None },
+            ClientMessage::Resync { after: Some(12) },
+        ] {
+            assert_eq!(ClientMessage::decode(&msg.encode()).expect("should decode"), msg);
+        }
+        assert_eq!(ClientMessage::Resync { after: Some(12) }.encode(), b"RESYNC|12");
+        assert_eq!(
+            ClientMessage::decode(b"RESYNC|").expect("should decode"),
+            ClientMessage::Resync { after: None }
+        );
+        assert!(matches!(
+            ClientMessage::decode(b"RESYNC|twelve"),
+            Err(ClientParseError::InvalidField("seq"))
+        ));
+    }
+
+    #[test]
+    fn test_server_history_decode_invalid() {
+        assert!(ServerMessage::decode(b"HISTORY").is_err());
+        assert!(ServerMessage::decode(b"HISTORY|NOPE|x").is_err());
     }
 
     #[test]
     fn test_server_broadcast_encode() {
         let msg = ServerMessage::Broadcast {
+            timestamp: "2024-01-02T15:04:05Z".to_string(),
+            id: "42".to_string(),
             username: "alex".to_string(),
             message: "hello world".to_string(),
+            reply_to: None,
         };
-        assert_eq!(msg.encode(), b"BROADCAST|alex|hello world");
+        assert_eq!(msg.encode(), b"BROADCAST|2024-01-02T15:04:05Z|42|alex|hello world");
     }
 
     #[test]
     fn test_server_broadcast_decode() {
-        let msg = ServerMessage::decode(b"BROADCAST|alex|hello world").expect("should decode");
+        let msg = ServerMessage::decode(b"BROADCAST|2024-01-02T15:04:05Z|42|alex|hello world").expect("should decode");
         assert_eq!(
             msg,
             ServerMessage::Broadcast {
+                timestamp: "2024-01-02T15:04:05Z".to_string(),
+                id: "42".to_string(),
                 username: "alex".to_string(),
-                message: "hello world".to_string()
+                message: "hello world".to_string(),
+                reply_to: None,
             }
         );
     }
 
     #[test]
     fn test_server_broadcast_with_pipes_in_message() {
-        // Pipes in message content should be preserved (everything after second | is message)
-        let msg = ServerMessage::decode(b"BROADCAST|alex|hello|world|test").expect("should decode");
+        // Pipes in message content should be preserved (everything after the username is message)
+        let msg =
+            ServerMessage::decode(b"BROADCAST|2024-01-02T15:04:05Z|42|alex|hello|world|test").expect("should decode");
         assert_eq!(
             msg,
             ServerMessage::Broadcast {
+                timestamp: "2024-01-02T15:04:05Z".to_string(),
+                id: "42".to_string(),
                 username: "alex".to_string(),
-                message: "hello|world|test".to_string()
+                message: "hello|world|test".to_string(),
+                reply_to: None,
+            }
+        );
+    }
+
+    #[test]
+    fn test_server_broadcast_decode_invalid() {
+        assert!(ServerMessage::decode(b"BROADCAST|2024-01-02T15:04:05Z").is_err());
+        assert!(ServerMessage::decode(b"BROADCAST|2024-01-02T15:04:05Z|42").is_err());
+        assert!(ServerMessage::decode(b"BROADCAST|2024-01-02T15:04:05Z||alex|hi").is_err());
+    }
+
+    #[test]
+    fn test_server_edited_roundtrip() {
+        let edited = ServerMessage::Edited {
+            timestamp: "2024-01-02T15:04:05Z".to_string(),
+            id: "42".to_string(),
+            username: "alex".to_string(),
+            message: "hello|again".to_string(),
+        };
+        assert_eq!(edited.encode(), b"EDITED|2024-01-02T15:04:05Z|42|alex|hello|again");
+        assert_eq!(ServerMessage::decode(&edited.encode()).expect("should decode"), edited);
+
+        let deleted = ServerMessage::Deleted {
+            timestamp: "2024-01-02T15:04:05Z".to_string(),
+            id: "42".to_string(),
+            username: "alex".to_string(),
+        };
+        assert_eq!(deleted.encode(), b"DELETED|2024-01-02T15:04:05Z|42|alex");
+        assert_eq!(
+            ServerMessage::decode(&deleted.encode()).expect("should decode"),
+            deleted
+        );
+        assert!(ServerMessage::decode(b"DELETED|2024-01-02T15:04:05Z|42").is_err());
+        assert!(ServerMessage::decode(b"DELETED|2024-01-02T15:04:05Z||alex").is_err());
+    }
+
+    #[test]
+    fn test_client_edit_delete() {
+        let edit = ClientMessage::Edit {
+            id: "42".to_string(),
+            message: "fixed|typo".to_string(),
+        };
+        assert_eq!(edit.encode(), b"EDIT|42|fixed|typo");
+        assert_eq!(ClientMessage::decode(&edit.encode()).expect("should decode"), edit);
+        assert!(ClientMessage::decode(b"EDIT|42").is_err());
+        assert!(ClientMessage::decode(b"EDIT|42|").is_err());
+        assert!(ClientMessage::decode(b"EDIT||text").is_err());
+
+        let delete = ClientMessage::Delete { id: "42".to_string() };
+        assert_eq!(delete.encode(), b"DELETE|42");
+        assert_eq!(ClientMessage::decode(b"delete|42").expect("should decode"), delete);
+        assert!(ClientMessage::decode(b"DELETE").is_err());
+    }
+
+    #[test]
+    fn test_presence_roundtrip() {
+        let away = ServerMessage::Presence {
+            timestamp: "2024-01-02T15:04:05Z".to_string(),
+            username: "alice".to_string(),
+            away: Some("lunch|then a walk".to_string()),
+        };
+        assert_eq!(
+            away.encode(),
+            b"PRESENCE|2024-01-02T15:04:05Z|alice|away|lunch|then a walk"
+        );
+        assert_eq!(ServerMessage::decode(&away.encode()).expect("should decode"), away);
+
+        let back = ServerMessage::Presence {
+            timestamp: "2024-01-02T15:04:05Z".to_string(),
+            username: "alice".to_string(),
+            away: None,
+        };
+        assert_eq!(back.encode(), b"PRESENCE|2024-01-02T15:04:05Z|alice|back");
+        assert_eq!(ServerMessage::decode(&back.encode()).expect("should decode"), back);
+        assert!(ServerMessage::decode(b"PRESENCE|2024-01-02T15:04:05Z|alice|away").is_err());
+        assert!(ServerMessage::decode(b"PRESENCE|2024-01-02T15:04:05Z|alice|gone").is_err());
+
+        assert_eq!(
+            ClientMessage::decode(b"away").expect("should decode"),
+            ClientMessage::Away { message: String::new() }
+        );
+        let lunch = ClientMessage::Away {
+            message: "lunch".to_string(),
+        };
+        assert_eq!(lunch.encode(), b"AWAY|lunch");
+        assert_eq!(ClientMessage::decode(&lunch.encode()).expect("should decode"), lunch);
+    }
+
+    #[test]
+    fn test_server_dm_encode() {
+        let msg = ServerMessage::Direct {
+            from: "alice".to_string(),
+            to: "bob".to_string(),
+            message: "hey there".to_string(),
+        };
+        assert_eq!(msg.encode(), b"DM|alice|bob|hey there");
+    }
+
+    #[test]
+    fn test_server_dm_decode() {
+        let msg = ServerMessage::decode(b"DM|alice|bob|hey|there").expect("should decode");
+        assert_eq!(
+            msg,
+            ServerMessage::Direct {
+                from: "alice".to_string(),
+                to: "bob".to_string(),
+                message: "hey|there".to_string()
             }
         );
     }
 
+    #[test]
+    fn test_server_dm_decode_missing_message() {
+        assert!(ServerMessage::decode(b"DM|alice").is_err());
+        assert!(ServerMessage::decode(b"DM|alice|bob").is_err());
+    }
+
     #[test]
     fn test_server_decode_case_insensitive() {
-        let msg = ServerMessage::decode(b"joined|alice").expect("should decode");
+        let msg = ServerMessage::decode(b"joined|2024-01-02T15:04:05Z|alice|#general").expect("should decode");
         assert_eq!(
             msg,
             ServerMessage::UserJoined {
-                username: "alice".to_string()
+                timestamp: "2024-01-02T15:04:05Z".to_string(),
+                username: "alice".to_string(),
+                room: "#general".to_string()
             }
         );
     }
@@ -360,24 +1569,68 @@ mod tests {
     fn test_client_join_encode() {
         let msg = ClientMessage::Join {
             username: "alice".to_string(),
+            password: None,
         };
         assert_eq!(msg.encode(), b"JOIN|alice");
     }
 
+    #[test]
+    fn test_client_join_with_password_encode() {
+        let msg = ClientMessage::Join {
+            username: "alice".to_string(),
+            password: Some("s3cret".to_string()),
+        };
+        assert_eq!(msg.encode(), b"JOIN|alice|s3cret");
+    }
+
     #[test]
     fn test_client_join_decode() {
         let msg = ClientMessage::decode(b"JOIN|alice").expect("should decode");
         assert_eq!(
             msg,
             ClientMessage::Join {
-                username: "alice".to_string()
+                username: "alice".to_string(),
+                password: None,
             }
         );
     }
 
+    #[test]
+    fn test_client_join_with_password_decode() {
+        let msg = ClientMessage::decode(b"JOIN|alice|pa|ss").expect("should decode");
+        assert_eq!(
+            msg,
+            ClientMessage::Join {
+                username: "alice".to_string(),
+                password: Some("pa|ss".to_string()),
+            }
+        );
+
+        let msg = ClientMessage::decode(b"JOIN|alice|").expect("should decode");
+        assert_eq!(
+            msg,
+            ClientMessage::Join {
+                username: "alice".to_string(),
+                password: None,
+            }
+        );
+
+        // validating the name is the server's job
+        let msg = ClientMessage::decode(b"JOIN|").expect("should decode");
+        assert_eq!(
+            msg,
+            ClientMessage::Join {
+                username: String::new(),
+                password: None,
+            }
+        );
+        assert!(ClientMessage::decode(b"JOIN").is_err());
+    }
+
     #[test]
     fn test_client_send_encode() {
         let msg = ClientMessage::Send {
+            id: None,
             message: "hello world".to_string(),
         };
         assert_eq!(msg.encode(), b"SEND|hello world");
@@ -389,9 +1642,389 @@ mod tests {
         assert_eq!(
             msg,
             ClientMessage::Send {
+                id: None,
                 message: "hello world".to_string()
             }
         );
+        // left for the server to refuse
+        for bare in [&b"SEND"[..], b"SEND|", b"SEND|   "] {
+            assert_eq!(
+                ClientMessage::decode(bare).expect("should decode"),
+                ClientMessage::Send {
+                    id: None,
+                    message: String::new()
+                }
+            );
+        }
+    }
+
+    #[test]
+    fn test_client_dm_encode() {
+        let msg = ClientMessage::Direct {
+            to: "bob".to_string(),
+            message: "hey there".to_string(),
+        };
+        assert_eq!(msg.encode(), b"DM|bob|hey there");
+    }
+
+    #[test]
+    fn test_client_dm_decode() {
+        let msg = ClientMessage::decode(b"DM|bob|hey there").expect("should decode");
+        assert_eq!(
+            msg,
+            ClientMessage::Direct {
+                to: "bob".to_string(),
+                message: "hey there".to_string()
+            }
+        );
+    }
+
+    #[test]
+    fn test_client_dm_decode_missing_fields() {
+        assert!(ClientMessage::decode(b"DM").is_err());
+        assert!(ClientMessage::decode(b"DM|bob").is_err());
+        assert!(ClientMessage::decode(b"DM|bob|").is_err());
+        assert!(ClientMessage::decode(b"DM||hello").is_err());
+    }
+
+    #[test]
+    fn test_client_join_room_roundtrip() {
+        let msg = ClientMessage::JoinRoom {
+            room: "#random".to_string(),
+        };
+        assert_eq!(msg.encode(), b"ROOM|#random");
+        assert_eq!(ClientMessage::decode(b"ROOM|#random").expect("should decode"), msg);
+        assert!(ClientMessage::decode(b"ROOM").is_err());
+        assert!(ClientMessage::decode(b"ROOM|").is_err());
+    }
+
+    #[test]
+    fn test_client_compress_roundtrip() {
+        assert_eq!(ClientMessage::Compress.encode(), b"COMPRESS");
+        assert_eq!(
+            ClientMessage::decode(b"compress").expect("should decode"),
+            ClientMessage::Compress
+        );
+    }
+
+    #[test]
+    fn test_client_typed_roundtrip() {
+        let whisper = ClientMessage::Typed {
+            command: "w".to_string(),
+            args: "bob hi there".to_string(),
+        };
+        assert_eq!(whisper.encode(), b"/w|bob hi there");
+        assert_eq!(
+            ClientMessage::decode(b"/w|bob hi there").expect("should decode"),
+            whisper
+        );
+        assert_eq!(
+            ClientMessage::decode(b"/w bob hi there\n").expect("should decode"),
+            whisper
+        );
+
+        let quit = ClientMessage::Typed {
+            command: "quit".to_string(),
+            args: String::new(),
+        };
+        assert_eq!(quit.encode(), b"/quit");
+        assert_eq!(ClientMessage::decode(b"/quit").expect("should decode"), quit);
+        assert!(matches!(
+            ClientMessage::decode(b"/ hi"),
+            Err(ClientParseError::UnknownCommand(_))
+        ));
+    }
+
+    #[test]
+    fn test_client_list_rooms_roundtrip() {
+        assert_eq!(ClientMessage::ListRooms.encode(), b"ROOMS");
+        assert_eq!(
+            ClientMessage::decode(b"rooms").expect("should decode"),
+            ClientMessage::ListRooms
+        );
+    }
+
+    #[test]
+    fn test_client_who_roundtrip() {
+        assert_eq!(ClientMessage::Who.encode(), b"WHO");
+        assert_eq!(
+            ClientMessage::decode(b"who").expect("should decode"),
+            ClientMessage::Who
+        );
+    }
+
+    #[test]
+    fn test_heartbeat_roundtrip() {
+        assert_eq!(ServerMessage::Ping.encode(), b"PING");
+        assert_eq!(
+            ServerMessage::decode(b"PING\n").expect("should decode"),
+            ServerMessage::Ping
+        );
+        assert_eq!(ClientMessage::Pong.encode(), b"PONG");
+        assert_eq!(
+            ClientMessage::decode(b"pong").expect("should decode"),
+            ClientMessage::Pong
+        );
+    }
+
+    #[test]
+    fn test_goodbye_roundtrip() {
+        assert_eq!(ServerMessage::Goodbye.encode(), b"GOODBYE");
+        assert_eq!(
+            ServerMessage::decode(b"goodbye\n").expect("should decode"),
+            ServerMessage::Goodbye
+        );
+    }
+
+    #[test]
+    fn test_probe_roundtrip() {
+        let probe = ClientMessage::Ping { token: "7".to_string() };
+        assert_eq!(probe.encode(), b"PING|7");
+        assert_eq!(ClientMessage::decode(b"ping|7").expect("should decode"), probe);
+        assert!(ClientMessage::decode(b"PING").is_err());
+
+        let answer = ServerMessage::Pong { token: "7".to_string() };
+        assert_eq!(answer.encode(), b"PONG|7");
+        assert_eq!(ServerMessage::decode(b"PONG|7\n").expect("should decode"), answer);
+        assert!(matches!(
+            ServerMessage::decode(b"PONG|"),
+            Err(ServerParseError::MissingField("token"))
+        ));
+    }
+
+    #[test]
+    fn test_operator_commands_roundtrip() {
+        let auth = ClientMessage::Auth {
+            token: "t0k|en".to_string(),
+        };
+        assert_eq!(auth.encode(), b"AUTH|t0k|en");
+        assert_eq!(ClientMessage::decode(&auth.encode()).expect("should decode"), auth);
+
+        let kick = ClientMessage::Kick {
+            username: "mallory".to_string(),
+        };
+        assert_eq!(kick.encode(), b"KICK|mallory");
+        assert_eq!(ClientMessage::decode(b"kick|mallory").expect("should decode"), kick);
+
+        assert!(ClientMessage::decode(b"AUTH|").is_err());
+        assert!(ClientMessage::decode(b"KICK").is_err());
+
+        let ban = ClientMessage::Ban {
+            username: "mallory".to_string(),
+        };
+        assert_eq!(ban.encode(), b"BAN|mallory");
+        assert_eq!(ClientMessage::decode(b"BAN|mallory").expect("should decode"), ban);
+
+        let unban = ClientMessage::Unban {
+            username: "mallory".to_string(),
+        };
+        assert_eq!(unban.encode(), b"UNBAN|mallory");
+        assert_eq!(ClientMessage::decode(b"unban|mallory").expect("should decode"), unban);
+        assert!(ClientMessage::decode(b"UNBAN|").is_err());
+    }
+
+    #[test]
+    fn test_action_roundtrip() {
+        let me = ClientMessage::Action {
+            text: "waves | hello".to_string(),
+        };
+        assert_eq!(me.encode(), b"ME|waves | hello");
+        assert_eq!(ClientMessage::decode(b"me|waves | hello").expect("should decode"), me);
+        assert_eq!(
+            ClientMessage::decode(b"ME").expect("should decode"),
+            ClientMessage::Action { text: String::new() }
+        );
+
+        let action = ServerMessage::Action {
+            timestamp: "2024-01-02T15:04:05Z".to_string(),
+            username: "alice".to_string(),
+            text: "waves | hello".to_string(),
+        };
+        assert_eq!(action.encode(), b"ACTION|2024-01-02T15:04:05Z|alice|waves | hello");
+        assert_eq!(ServerMessage::decode(&action.encode()).expect("should decode"), action);
+        assert!(ServerMessage::decode(b"ACTION|2024-01-02T15:04:05Z|alice").is_err());
+    }
+
+    #[test]
+    fn test_nick_roundtrip() {
+        let nick = ClientMessage::Nick {
+            username: "alice2".to_string(),
+        };
+        assert_eq!(nick.encode(), b"NICK|alice2");
+        assert_eq!(ClientMessage::decode(b"nick|alice2").expect("should decode"), nick);
+        assert!(ClientMessage::decode(b"NICK").is_err());
+
+        let renamed = ServerMessage::Renamed {
+            timestamp: "2024-01-02T15:04:05Z".to_string(),
+            from: "alice".to_string(),
+            to: "alice2".to_string(),
+        };
+        assert_eq!(renamed.encode(), b"RENAMED|2024-01-02T15:04:05Z|alice|alice2");
+        assert_eq!(
+            ServerMessage::decode(&renamed.encode()).expect("should decode"),
+            renamed
+        );
+        assert!(ServerMessage::decode(b"RENAMED|2024-01-02T15:04:05Z|alice").is_err());
+    }
+
+    #[test]
+    fn test_direct_history_roundtrip() {
+        let msg = ClientMessage::DirectHistory {
+            username: "bob".to_string(),
+        };
+        assert_eq!(msg.encode(), b"DMHISTORY|bob");
+        assert_eq!(ClientMessage::decode(b"dmhistory|bob").expect("should decode"), msg);
+        assert!(ClientMessage::decode(b"DMHISTORY").is_err());
+        assert!(ClientMessage::decode(b"DMHISTORY|").is_err());
+    }
+
+    #[test]
+    fn test_shutdown_roundtrip() {
+        let msg = ServerMessage::ShuttingDown { seconds: 3 };
+        assert_eq!(msg.encode(), b"SHUTDOWN|3");
+        assert_eq!(ServerMessage::decode(b"SHUTDOWN|3\n").expect("should decode"), msg);
+        assert!(ServerMessage::decode(b"SHUTDOWN|soon").is_err());
+        assert!(ServerMessage::decode(b"SHUTDOWN").is_err());
+    }
+
+    #[test]
+    fn test_session_roundtrip() {
+        let msg = ServerMessage::Session {
+            token: "0f3a".to_string(),
+            seconds: 60,
+        };
+        assert_eq!(msg.encode(), b"SESSION|0f3a|60");
+        assert_eq!(ServerMessage::decode(b"SESSION|0f3a|60\n").expect("should decode"), msg);
+        assert!(ServerMessage::decode(b"SESSION|0f3a").is_err());
+        assert!(ServerMessage::decode(b"SESSION||60").is_err());
+        assert!(ServerMessage::decode(b"SESSION|0f3a|soon").is_err());
+
+        let rejoin = ClientMessage::Rejoin {
+            token: "0f3a".to_string(),
+        };
+        assert_eq!(rejoin.encode(), b"REJOIN|0f3a");
+        assert_eq!(ClientMessage::decode(b"rejoin|0f3a").expect("should decode"), rejoin);
+        assert!(ClientMessage::decode(b"REJOIN|").is_err());
+    }
+
+    #[test]
+    fn test_typing_roundtrip() {
+        let msg = ServerMessage::Typing {
+            username: "alice".to_string(),
+            active: true,
+        };
+        assert_eq!(msg.encode(), b"TYPING|alice|start");
+        assert_eq!(
+            ServerMessage::decode(b"TYPING|alice|start").expect("should decode"),
+            msg
+        );
+        assert_eq!(
+            ServerMessage::decode(b"TYPING|alice|stop").expect("should decode"),
+            ServerMessage::Typing {
+                username: "alice".to_string(),
+                active: false,
+            }
+        );
+        assert!(ServerMessage::decode(b"TYPING|alice").is_err());
+        assert!(ServerMessage::decode(b"TYPING|alice|maybe").is_err());
+
+        assert_eq!(ClientMessage::Typing.encode(), b"TYPING");
+        assert_eq!(
+            ClientMessage::decode(b"typing").expect("should decode"),
+            ClientMessage::Typing
+        );
+    }
+
+    #[test]
+    fn test_send_id_roundtrip() {
+        let msg = ClientMessage::Send {
+            id: Some("42".to_string()),
+            message: "a|b".to_string(),
+        };
+        assert_eq!(msg.encode(), b"SENDID|42|a|b");
+        assert_eq!(ClientMessage::decode(b"SENDID|42|a|b").expect("should decode"), msg);
+        // left for the server to NACK, so the id is still answered
+        assert_eq!(
+            ClientMessage::decode(b"sendid|42").expect("should decode"),
+            ClientMessage::Send {
+                id: Some("42".to_string()),
+                message: String::new(),
+            }
+        );
+        assert!(ClientMessage::decode(b"SENDID").is_err());
+        assert!(ClientMessage::decode(b"SENDID||hi").is_err());
+        // a plain `SEND` takes no id, so its text keeps what looks like one
+        assert_eq!(
+            ClientMessage::decode(b"SEND|42|done").expect("should decode"),
+            ClientMessage::Send {
+                id: None,
+                message: "42|done".to_string(),
+            }
+        );
+
+        let ack = ServerMessage::Ack { id: "42".to_string() };
+        assert_eq!(ack.encode(), b"ACK|42");
+        assert_eq!(ServerMessage::decode(b"ACK|42").expect("should decode"), ack);
+        assert!(ServerMessage::decode(b"ACK").is_err());
+
+        let nack = ServerMessage::Nack {
+            id: "42".to_string(),
+            code: ErrorCode::RATE_LIMITED,
+            reason: "rate limited, slow down".to_string(),
+        };
+        assert_eq!(nack.encode(), b"NACK|42|429|rate-limited|rate limited, slow down");
+        assert_eq!(
+            ServerMessage::decode(b"NACK|42|429|rate-limited|rate limited, slow down").expect("should decode"),
+            nack
+        );
+        // as a server before codes sent it
+        assert_eq!(
+            ServerMessage::decode(b"NACK|42|rate limited, slow down").expect("should decode"),
+            ServerMessage::Nack {
+                id: "42".to_string(),
+                code: ErrorCode::UNKNOWN,
+                reason: "rate limited, slow down".to_string(),
+            }
+        );
+        assert!(ServerMessage::decode(b"NACK|42").is_err());
+    }
+
+    #[test]
+    fn test_reply_roundtrip() {
+        let reply = ClientMessage::Reply {
+            id: None,
+            reply_to: "41".to_string(),
+            message: "a|b".to_string(),
+        };
+        assert_eq!(reply.encode(), b"REPLY|41|a|b");
+        assert_eq!(ClientMessage::decode(b"REPLY|41|a|b").expect("should decode"), reply);
+        let with_id = ClientMessage::Reply {
+            id: Some("7".to_string()),
+            reply_to: "41".to_string(),
+            message: "agreed".to_string(),
+        };
+        assert_eq!(with_id.encode(), b"REPLYID|7|41|agreed");
+        assert_eq!(
+            ClientMessage::decode(b"replyid|7|41|agreed").expect("should decode"),
+            with_id
+        );
+        assert!(ClientMessage::decode(b"REPLY").is_err());
+        assert!(ClientMessage::decode(b"REPLY||hi").is_err());
+        assert!(ClientMessage::decode(b"REPLYID|7").is_err());
+
+        let relayed = ServerMessage::Broadcast {
+            timestamp: "2024-01-02T15:04:05Z".to_string(),
+            id: "42".to_string(),
+            username: "alice".to_string(),
+            message: "a|b".to_string(),
+            reply_to: Some("41".to_string()),
+        };
+        assert_eq!(relayed.encode(), b"REPLY|2024-01-02T15:04:05Z|42|alice|41|a|b");
+        assert_eq!(
+            ServerMessage::decode(b"REPLY|2024-01-02T15:04:05Z|42|alice|41|a|b").expect("should decode"),
+            relayed
+        );
+        assert!(ServerMessage::decode(b"REPLY|2024-01-02T15:04:05Z|42|alice||hi").is_err());
     }
 
     #[test]
@@ -406,13 +2039,180 @@ mod tests {
         assert_eq!(msg, ClientMessage::Leave);
     }
 
+    #[test]
+    fn test_client_stats() {
+        assert_eq!(ClientMessage::Stats.encode(), b"STATS");
+        assert_eq!(
+            ClientMessage::decode(b"stats").expect("should decode"),
+            ClientMessage::Stats
+        );
+    }
+
+    #[test]
+    fn test_client_who_all() {
+        assert_eq!(ClientMessage::WhoAll.encode(), b"WHOALL");
+        assert_eq!(
+            ClientMessage::decode(b"WhoAll").expect("should decode"),
+            ClientMessage::WhoAll
+        );
+    }
+
+    #[test]
+    fn test_client_connections() {
+        assert_eq!(ClientMessage::Connections.encode(), b"CONNS");
+        let drop = ClientMessage::DropConnection {
+            addr: "127.0.0.1:54321".to_string(),
+        };
+        assert_eq!(drop.encode(), b"DROP|127.0.0.1:54321");
+        assert_eq!(
+            ClientMessage::decode(b"drop|127.0.0.1:54321").expect("should decode"),
+            drop
+        );
+        assert!(ClientMessage::decode(b"DROP").is_err());
+    }
+
+    #[test]
+    fn test_client_room_policy() {
+        let set = ClientMessage::RoomPolicy {
+            room: "#news".to_string(),
+            policy: "rate=1 len=8192".to_string(),
+        };
+        assert_eq!(set.encode(), b"ROOMPOLICY|#news|rate=1 len=8192");
+        assert_eq!(
+            ClientMessage::decode(b"ROOMPOLICY|#news|rate=1 len=8192").expect("should decode"),
+            set
+        );
+        let show = ClientMessage::RoomPolicy {
+            room: "#news".to_string(),
+            policy: String::new(),
+        };
+        assert_eq!(show.encode(), b"ROOMPOLICY|#news");
+        assert_eq!(ClientMessage::decode(b"roompolicy|#news").expect("should decode"), show);
+        assert!(ClientMessage::decode(b"ROOMPOLICY").is_err());
+    }
+
+    #[test]
+    fn test_client_help() {
+        assert_eq!(ClientMessage::Help.encode(), b"HELP");
+        assert_eq!(
+            ClientMessage::decode(b"help").expect("should decode"),
+            ClientMessage::Help
+        );
+    }
+
+    #[test]
+    fn test_hello_roundtrip() {
+        let hello = ServerMessage::Hello {
+            server: "simple-chat/0.1.0".to_string(),
+            caps: vec!["json".to_string(), "rooms".to_string()],
+        };
+        assert_eq!(hello.encode(), b"HELLO|simple-chat/0.1.0|caps=json,rooms");
+        assert_eq!(ServerMessage::decode(&hello.encode()).expect("should decode"), hello);
+
+        let bare = ServerMessage::decode(b"HELLO|simple-chat/0.1.0|caps=").expect("should decode");
+        assert_eq!(
+            bare,
+            ServerMessage::Hello {
+                server: "simple-chat/0.1.0".to_string(),
+                caps: Vec::new(),
+            }
+        );
+        assert!(ServerMessage::decode(b"HELLO|simple-chat/0.1.0").is_err());
+        assert!(ServerMessage::decode(b"HELLO|simple-chat/0.1.0|json").is_err());
+    }
+
+    #[test]
+    fn test_userlist_roundtrip() {
+        let userlist = ServerMessage::UserList {
+            room: "#general".to_string(),
+            users: vec!["alice".to_string(), "bob".to_string()],
+        };
+        assert_eq!(userlist.encode(), b"USERLIST|#general|alice,bob");
+        assert_eq!(
+            ServerMessage::decode(&userlist.encode()).expect("should decode"),
+            userlist
+        );
+        assert_eq!(
+            ServerMessage::decode(b"USERLIST|#general|").expect("should decode"),
+            ServerMessage::UserList {
+                room: "#general".to_string(),
+                users: Vec::new(),
+            }
+        );
+        assert!(ServerMessage::decode(b"USERLIST|#general").is_err());
+        assert!(ServerMessage::decode(b"USERLIST||alice").is_err());
+    }
+
+    #[test]
+    fn test_file_roundtrip() {
+        let msg = ClientMessage::File {
+            name: "notes.txt".to_string(),
+            data: "aGk=".to_string(),
+        };
+        assert_eq!(msg.encode(), b"FILE|notes.txt|aGk=");
+        assert_eq!(
+            ClientMessage::decode(b"file|notes.txt|aGk=").expect("should decode"),
+            msg
+        );
+        assert_eq!(
+            ClientMessage::decode(b"FILE|empty.txt|").expect("should decode"),
+            ClientMessage::File {
+                name: "empty.txt".to_string(),
+                data: String::new(),
+            }
+        );
+        assert!(ClientMessage::decode(b"FILE|notes.txt").is_err());
+        assert!(ClientMessage::decode(b"FILE||aGk=").is_err());
+
+        let shared = ServerMessage::File {
+            timestamp: "2024-01-02T15:04:05Z".to_string(),
+            username: "alice".to_string(),
+            name: "notes.txt".to_string(),
+            size: 2,
+            data: "aGk=".to_string(),
+        };
+        assert_eq!(shared.encode(), b"FILE|2024-01-02T15:04:05Z|alice|notes.txt|2|aGk=");
+        assert_eq!(ServerMessage::decode(&shared.encode()).expect("should decode"), shared);
+        assert!(ServerMessage::decode(b"FILE|2024-01-02T15:04:05Z|alice|notes.txt|two|aGk=").is_err());
+        assert!(ServerMessage::decode(b"FILE|2024-01-02T15:04:05Z|alice|notes.txt|2").is_err());
+    }
+
+    #[test]
+    fn test_broadcast_roundtrip() {
+        let msg = ClientMessage::Broadcast {
+            message: "restarting at 5|ish".to_string(),
+        };
+        assert_eq!(msg.encode(), b"BROADCAST|restarting at 5|ish");
+        assert_eq!(
+            ClientMessage::decode(b"broadcast|restarting at 5|ish").expect("should decode"),
+            msg
+        );
+        assert!(ClientMessage::decode(b"BROADCAST").is_err());
+        assert!(ClientMessage::decode(b"BROADCAST|").is_err());
+
+        let announcement = ServerMessage::Announcement {
+            timestamp: "2024-01-02T15:04:05Z".to_string(),
+            text: "restarting at 5|ish".to_string(),
+        };
+        assert_eq!(
+            announcement.encode(),
+            b"ANNOUNCE|2024-01-02T15:04:05Z|restarting at 5|ish"
+        );
+        assert_eq!(
+            ServerMessage::decode(&announcement.encode()).expect("should decode"),
+            announcement
+        );
+        assert!(ServerMessage::decode(b"ANNOUNCE|2024-01-02T15:04:05Z").is_err());
+    }
+
     #[test]
     fn test_client_decode_case_insensitive() {
         let msg = ClientMessage::decode(b"join|alice").expect("should decode");
         assert_eq!(
             msg,
             ClientMessage::Join {
-                username: "alice".to_string()
+                username: "alice".to_string(),
+                password: None,
             }
         );
     }
@@ -423,16 +2223,67 @@ mod tests {
         assert_eq!(
             msg,
             ClientMessage::Join {
-                username: "alice".to_string()
+                username: "alice".to_string(),
+                password: None,
+            }
+        );
+    }
+
+    #[test]
+    fn test_client_decode_crlf() {
+        assert_eq!(
+            ClientMessage::decode(b"JOIN|bob\r\n").unwrap(),
+            ClientMessage::Join {
+                username: "bob".to_string(),
+                password: None,
+            }
+        );
+        assert_eq!(
+            ClientMessage::decode(b"JOIN|bob|secret\r\n").unwrap(),
+            ClientMessage::Join {
+                username: "bob".to_string(),
+                password: Some("secret".to_string()),
             }
         );
+        assert_eq!(
+            ClientMessage::decode(b"SEND|hi there \r\n").unwrap(),
+            ClientMessage::Send {
+                id: None,
+                message: "hi there".to_string(),
+            }
+        );
+        assert_eq!(ClientMessage::decode(b"WHO\r\n").unwrap(), ClientMessage::Who);
+        assert!(matches!(ClientMessage::decode(b"\r\n"), Err(ClientParseError::Empty)));
+    }
+
+    #[test]
+    fn test_client_decode_invalid_utf8() {
+        assert!(matches!(
+            ClientMessage::decode(b"join|al\xffice"),
+            Err(ClientParseError::InvalidUsernameEncoding)
+        ));
+        assert!(matches!(
+            ClientMessage::decode(b"NICK|\xc3"),
+            Err(ClientParseError::InvalidUsernameEncoding)
+        ));
+        assert!(matches!(
+            ClientMessage::decode(b"SEND|caf\xe9"),
+            Err(ClientParseError::InvalidUtf8)
+        ));
+        assert_eq!(
+            ClientParseError::InvalidUsernameEncoding.to_string(),
+            "invalid username encoding"
+        );
     }
 
     #[test]
     fn test_roundtrip_server_broadcast() {
         let original = ServerMessage::Broadcast {
+            timestamp: "2024-01-02T15:04:05Z".to_string(),
+            id: "1".to_string(),
             username: "test".to_string(),
             message: "hello".to_string(),
+            reply_to: None,
         };
         let encoded = original.encode();
         let decoded = ServerMessage::decode(&encoded).expect("should roundtrip");
@@ -442,6 +2293,7 @@ mod tests {
     #[test]
     fn test_roundtrip_client_send() {
         let original = ClientMessage::Send {
+            id: None,
             message: "test message".to_string(),
         };
         let encoded = original.encode();
@@ -458,6 +2310,7 @@ mod special_char_tests {
     #[test]
     fn test_semicolon_in_message() {
         let msg = ClientMessage::Send {
+            id: None,
             message: "ola;".to_string(),
         };
         let encoded = msg.encode();
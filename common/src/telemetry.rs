@@ -3,13 +3,13 @@
 use tracing_appender::non_blocking::WorkerGuard;
 use tracing_subscriber::{EnvFilter, Layer, Registry, fmt, layer::SubscriberExt, util::SubscriberInitExt};
 
-use crate::{config, consts};
+use crate::config::{self, LogFormat};
 
 /// Initialize the logging/tracing subsystem.
 ///
-/// The logging format depends on the `APP_ENV` environment variable:
-/// - `production`: JSON format (field values are JSON-escaped, preventing injection)
-/// - other: Pretty format with colors (default)
+/// The logging format is set by `CHAT_LOG_FORMAT`, see [`config::log_format`]:
+/// - `json`: one JSON object per event, fields included (values are JSON-escaped, preventing injection)
+/// - `text`: Pretty format with colors (default outside production)
 ///
 /// # Errors
 ///
@@ -18,12 +18,12 @@ use crate::{config, consts};
 pub fn init_logging() -> Result<WorkerGuard, Box<dyn std::error::Error + Send + Sync>> {
     let _ = config::server_tz()?;
     let log_level = config::log_level()?;
-    let app_env = config::app_env();
+    let log_format = config::log_format()?;
     let env_filter = EnvFilter::try_new(&log_level)?;
 
     let (non_blocking_writer, guard) = tracing_appender::non_blocking(std::io::stdout());
 
-    let formatting_layer = if app_env == consts::APP_ENV_PROD_VALUE {
+    let formatting_layer = if log_format == LogFormat::Json {
         fmt::layer()
             .json()
             .flatten_event(true)
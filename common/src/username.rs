@@ -0,0 +1,250 @@
+//! Username rules shared by the server and the client.
+//!
+//! A username is 1 to [`MAX_USERNAME_LEN`] characters of letters, digits,
+//! `_` and `-`. Letters and digits may come from any script. Surrounding
+//! whitespace is ignored; whitespace inside the name is not.
+//!
+//! Names are compared in Unicode NFC, so `é` typed as one character and as
+//! `e` with a combining accent are the same name; see [`normalized_username`].
+
+use std::borrow::Cow;
+
+use stringzilla::sz;
+use thiserror::Error;
+use unicode_normalization::{UnicodeNormalization, is_nfc};
+
+/// Longest allowed username, in characters.
+pub const MAX_USERNAME_LEN: usize = 32;
+
+const ASCII_VALID_CHARS: &str = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_-";
+
+/// Why a username was refused
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Error)]
+pub enum UsernameError {
+    #[error("empty")]
+    Empty,
+    #[error("longer than {MAX_USERNAME_LEN} characters")]
+    TooLong,
+    #[error("contains whitespace")]
+    Whitespace,
+    #[error("contains control characters")]
+    ControlChar,
+    #[error("'{0}' is not allowed, only letters, digits, '_' and '-'")]
+    InvalidChar(char),
+}
+
+/// Whether `c` may appear in a username.
+#[inline]
+#[must_use]
+pub fn is_valid_username_char(c: char) -> bool {
+    c.is_alphanumeric() || c == '_' || c == '-'
+}
+
+#[inline]
+fn is_ascii_valid_fast(s: &str) -> bool {
+    sz::find_byte_not_from(s, ASCII_VALID_CHARS).is_none()
+}
+
+/// Checks `s` against the username rules, ignoring surrounding whitespace.
+///
+/// # Errors
+///
+/// Returns the first rule the name breaks.
+///
+/// # Examples
+///
+/// ```
+/// use common::username::{UsernameError, validate_username};
+///
+/// assert_eq!(validate_username("alice-2"), Ok(()));
+/// assert_eq!(validate_username("alice smith"), Err(UsernameError::Whitespace));
+/// ```
+pub fn validate_username(s: &str) -> Result<(), UsernameError> {
+    validated_username(s).map(|_| ())
+}
+
+/// Like [`validate_username`], but hands back the trimmed name.
+///
+/// # Errors
+///
+/// Returns the first rule the name breaks.
+pub fn validated_username(s: &str) -> Result<&str, UsernameError> {
+    let trimmed = s.trim();
+    if trimmed.is_empty() {
+        return Err(UsernameError::Empty);
+    }
+    if trimmed.chars().count() > MAX_USERNAME_LEN {
+        return Err(UsernameError::TooLong);
+    }
+    if trimmed.is_ascii() && is_ascii_valid_fast(trimmed) {
+        return Ok(trimmed);
+    }
+    match trimmed.chars().find(|c| !is_valid_username_char(*c)) {
+        None => Ok(trimmed),
+        Some(c) if c.is_whitespace() => Err(UsernameError::Whitespace),
+        Some(c) if c.is_control() => Err(UsernameError::ControlChar),
+        Some(c) => Err(UsernameError::InvalidChar(c)),
+    }
+}
+
+/// Like [`validated_username`], but puts the name in NFC first, which lets
+/// in letters typed with combining accents. This is the name to go by.
+///
+/// # Errors
+///
+/// Returns the first rule the composed name breaks.
+///
+/// # Examples
+///
+/// ```
+/// use common::username::normalized_username;
+///
+/// assert_eq!(normalized_username(" Jose\u{301} "), Ok("Jos\u{e9}".to_string()));
+/// ```
+pub fn normalized_username(s: &str) -> Result<String, UsernameError> {
+    validated_username(&composed(s)).map(str::to_string)
+}
+
+/// `s` in Unicode NFC, borrowed when it already is.
+#[must_use]
+pub fn composed(s: &str) -> Cow<'_, str> {
+    if is_nfc(s) {
+        Cow::Borrowed(s)
+    } else {
+        Cow::Owned(s.nfc().collect())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_ascii_valid_fast() {
+        assert!(is_ascii_valid_fast("john"));
+        assert!(is_ascii_valid_fast("john_doe"));
+        assert!(is_ascii_valid_fast("User123"));
+        assert!(is_ascii_valid_fast("ABC_123_xyz"));
+        assert!(is_ascii_valid_fast("jean-luc"));
+
+        assert!(!is_ascii_valid_fast("john doe"));
+        assert!(!is_ascii_valid_fast("user@name"));
+        assert!(!is_ascii_valid_fast("hello!"));
+        assert!(!is_ascii_valid_fast("test#123"));
+    }
+
+    #[test]
+    fn test_valid_username_chars() {
+        assert!(is_valid_username_char('a'));
+        assert!(is_valid_username_char('Z'));
+        assert!(is_valid_username_char('5'));
+        assert!(is_valid_username_char('_'));
+        assert!(is_valid_username_char('-'));
+
+        assert!(is_valid_username_char('你'));
+        assert!(is_valid_username_char('好'));
+        assert!(is_valid_username_char('अ'));
+        assert!(is_valid_username_char('ਅ'));
+        assert!(is_valid_username_char('α'));
+        assert!(is_valid_username_char('ñ'));
+
+        assert!(!is_valid_username_char(' '));
+        assert!(!is_valid_username_char('@'));
+        assert!(!is_valid_username_char('#'));
+        assert!(!is_valid_username_char('!'));
+        assert!(!is_valid_username_char('|'));
+        assert!(!is_valid_username_char('\n'));
+        assert!(!is_valid_username_char('\0'));
+    }
+
+    #[test]
+    fn test_validate_username_valid() {
+        assert_eq!(validate_username("john"), Ok(()));
+        assert_eq!(validate_username("john_doe"), Ok(()));
+        assert_eq!(validate_username("user123"), Ok(()));
+        assert_eq!(validate_username("jean-luc"), Ok(()));
+
+        assert_eq!(validate_username("你好"), Ok(()));
+        assert_eq!(validate_username("अमृत"), Ok(()));
+        assert_eq!(validate_username("ਸਿੰਘ"), Ok(()));
+        assert_eq!(validate_username("Ελληνικά"), Ok(()));
+        assert_eq!(validate_username("日本語"), Ok(()));
+    }
+
+    #[test]
+    fn test_validate_username_empty() {
+        assert_eq!(validate_username(""), Err(UsernameError::Empty));
+        assert_eq!(validate_username("   "), Err(UsernameError::Empty));
+        assert_eq!(validate_username("\t"), Err(UsernameError::Empty));
+    }
+
+    #[test]
+    fn test_validate_username_too_long() {
+        let long_name = "a".repeat(MAX_USERNAME_LEN + 1);
+        assert_eq!(validate_username(&long_name), Err(UsernameError::TooLong));
+
+        let max_name = "a".repeat(MAX_USERNAME_LEN);
+        assert_eq!(validate_username(&max_name), Ok(()));
+        assert_eq!(validate_username(&"你".repeat(MAX_USERNAME_LEN)), Ok(()));
+    }
+
+    #[test]
+    fn test_validate_username_whitespace_and_control() {
+        assert_eq!(validate_username("john doe"), Err(UsernameError::Whitespace));
+        assert_eq!(validate_username("john\tdoe"), Err(UsernameError::Whitespace));
+        assert_eq!(validate_username("你好 世界"), Err(UsernameError::Whitespace));
+        assert_eq!(validate_username("ਸਿੰਘ ਜੀ"), Err(UsernameError::Whitespace));
+        assert_eq!(validate_username("Привет мир"), Err(UsernameError::Whitespace));
+        // the virama in नमस्ते is not alphanumeric, so that is reported first
+        assert!(validate_username("नमस्ते दुनिया").is_err());
+
+        assert_eq!(validate_username("john\0"), Err(UsernameError::ControlChar));
+        assert_eq!(validate_username("a\x1b[31m"), Err(UsernameError::ControlChar));
+    }
+
+    #[test]
+    fn test_validate_username_invalid_chars() {
+        assert_eq!(validate_username("user@name"), Err(UsernameError::InvalidChar('@')));
+        assert_eq!(validate_username("hello!"), Err(UsernameError::InvalidChar('!')));
+        assert_eq!(validate_username("test#123"), Err(UsernameError::InvalidChar('#')));
+        assert_eq!(validate_username("a|b"), Err(UsernameError::InvalidChar('|')));
+
+        assert_eq!(validate_username("你好@世界"), Err(UsernameError::InvalidChar('@')));
+        assert_eq!(validate_username("你好!"), Err(UsernameError::InvalidChar('!')));
+        assert!(validate_username("ਅਮ੍ਰਿਤ@").is_err());
+        assert_eq!(validate_username("ਪੰਜਾਬੀ#"), Err(UsernameError::InvalidChar('#')));
+        assert_eq!(validate_username("Иван@почта"), Err(UsernameError::InvalidChar('@')));
+        assert_eq!(validate_username("Москва!"), Err(UsernameError::InvalidChar('!')));
+        assert_eq!(validate_username("अमृत@सिंह"), Err(UsernameError::InvalidChar('@')));
+        assert_eq!(validate_username("भारत#"), Err(UsernameError::InvalidChar('#')));
+    }
+
+    #[test]
+    fn test_validated_username() {
+        assert_eq!(validated_username("  john_doe  "), Ok("john_doe"));
+        assert_eq!(validated_username("你好"), Ok("你好"));
+        assert!(validated_username("").is_err());
+        assert!(validated_username("john@doe").is_err());
+    }
+
+    #[test]
+    fn test_normalized_username() {
+        let precomposed = "Ren\u{e9}e";
+        let combining = "Rene\u{301}e";
+        assert_ne!(precomposed, combining);
+        assert!(validated_username(combining).is_err());
+        assert_eq!(normalized_username(combining), Ok(precomposed.to_string()));
+        assert_eq!(normalized_username(precomposed), Ok(precomposed.to_string()));
+        assert!(matches!(composed("alice"), Cow::Borrowed("alice")));
+        assert_eq!(normalized_username("a\u{301}@"), Err(UsernameError::InvalidChar('@')));
+    }
+
+    #[test]
+    fn test_username_error_display() {
+        assert_eq!(UsernameError::TooLong.to_string(), "longer than 32 characters");
+        assert_eq!(
+            UsernameError::InvalidChar('@').to_string(),
+            "'@' is not allowed, only letters, digits, '_' and '-'"
+        );
+    }
+}
@@ -0,0 +1,3 @@
+module github.com/amritsingh183/simple-chat
+
+go 1.21
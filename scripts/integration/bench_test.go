@@ -0,0 +1,147 @@
+package integration
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// broadcastWindow is how many lines the benchmark's sender lets run ahead of
+// the slowest client, well inside the server's outbound queue, so nobody is
+// dropped for falling behind.
+const broadcastWindow = 64
+
+// benchmarkRuns tells one run's usernames from the last's, whose
+// connections the server may not have let go of yet.
+var benchmarkRuns atomic.Int64
+
+// BenchmarkBroadcast measures how fast one sender's lines reach a room as it
+// grows: N raw clients join #general, one of them sends b.N lines, and the
+// clock stops once every client has read every line. It reports lines per
+// second sent and copies per second delivered.
+//
+// With CHAT_BENCH_BASELINE naming another build's server binary, e.g. one
+// from before the fan-out stopped spawning a task per line and copying its
+// recipients, each room size runs on that build too, as before/, and on this
+// one, as after/, and the log sets the two side by side:
+//
+//	CHAT_BENCH_BASELINE=/tmp/before/target/release/server \
+//		go test -run '^$' -bench Broadcast -benchtime 2000x
+//
+// A thousand clients need more open files on both sides than some systems
+// allow by default; raise ulimit -n.
+func BenchmarkBroadcast(b *testing.B) {
+	builds := []struct{ name, bin string }{{"after", serverBin}}
+	if baseline := os.Getenv("CHAT_BENCH_BASELINE"); baseline != "" {
+		builds = append([]struct{ name, bin string }{{"before", baseline}}, builds...)
+	}
+	sizes := []int{10, 100, 1000}
+	// lines per second by build and room size, from each size's last run
+	rates := map[string]map[int]float64{}
+
+	for _, build := range builds {
+		rates[build.name] = map[int]float64{}
+		b.Run(build.name, func(b *testing.B) {
+			server, err := startBinaryWith(build.bin, nil,
+				fmt.Sprintf("CHAT_HOST=%s", testHost),
+				fmt.Sprintf("CHAT_PORT=%s", altPort),
+				"CHAT_PING_INTERVAL=0",
+				"CHAT_MAX_CLIENTS=0",
+				"CHAT_HISTORY_SIZE=0",
+				"CHAT_NOTIFY=none",
+				"CHAT_RATE_LIMIT=1000000",
+				"CHAT_RATE_BURST=1000000",
+			)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer stopServer(server)
+
+			for _, clients := range sizes {
+				b.Run(fmt.Sprintf("clients=%d", clients), func(b *testing.B) {
+					rates[build.name][clients] = benchmarkBroadcast(b, clients)
+				})
+			}
+		})
+	}
+
+	if len(builds) < 2 {
+		return
+	}
+	for _, clients := range sizes {
+		before, after := rates["before"][clients], rates["after"][clients]
+		if before > 0 && after > 0 {
+			b.Logf("clients=%d: %.0f lines/s before, %.0f after, %.2fx", clients, before, after, after/before)
+		}
+	}
+}
+
+// benchmarkBroadcast runs one room size and returns the lines per second it
+// reported.
+func benchmarkBroadcast(b *testing.B, clients int) float64 {
+	run := benchmarkRuns.Add(1)
+	var delivered atomic.Int64
+	var readers sync.WaitGroup
+	conns := make([]net.Conn, 0, clients)
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+	for i := 0; i < clients; i++ {
+		conn, reader, err := dialAndJoin(altPort, fmt.Sprintf("bench%dn%d", run, i))
+		if err != nil {
+			b.Fatalf("client %d of %d could not join: %v", i+1, clients, err)
+		}
+		conns = append(conns, conn)
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for seen := 0; seen < b.N; {
+				line, err := reader.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if strings.HasPrefix(line, "BROADCAST|") {
+					seen++
+					delivered.Add(1)
+				}
+			}
+		}()
+	}
+
+	// the sender is in the room too, and reads its own lines like the rest
+	sender := conns[0]
+	b.ResetTimer()
+	start := time.Now()
+	for i := 0; i < b.N; i++ {
+		stalled := time.Now().Add(responseTimeout)
+		for i >= broadcastWindow && delivered.Load() < int64((i-broadcastWindow)*clients) {
+			if time.Now().After(stalled) {
+				b.Fatalf("line %d of %d stalled, %d copies delivered", i, b.N, delivered.Load())
+			}
+			time.Sleep(50 * time.Microsecond)
+		}
+		fmt.Fprintf(sender, "SEND|line %d\n", i)
+	}
+	// whatever is still in flight is at most a window behind
+	for _, conn := range conns {
+		_ = conn.SetReadDeadline(time.Now().Add(responseTimeout))
+	}
+	readers.Wait()
+	elapsed := time.Since(start)
+	b.StopTimer()
+
+	if got, want := delivered.Load(), int64(b.N*clients); got != want {
+		b.Fatalf("%d of %d lines delivered", got, want)
+	}
+	rate := float64(b.N) / elapsed.Seconds()
+	b.ReportMetric(rate, "lines/s")
+	b.ReportMetric(float64(b.N*clients)/elapsed.Seconds(), "deliveries/s")
+	return rate
+}
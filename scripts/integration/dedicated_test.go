@@ -0,0 +1,2501 @@
+package integration
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestDedicatedServers runs the scenarios that need a server configured
+// differently from the shared one. Each starts its own on altPort, so they
+// run one at a time.
+func TestDedicatedServers(t *testing.T) {
+	scenarios := []struct {
+		name string
+		run  func(*testing.T)
+	}{
+		{"IdleTimeout", testIdleTimeout},
+		{"MaxClients", testMaxClients},
+		{"ConnectRate", testConnectRate},
+		{"Password", testPassword},
+		{"TLS", testTLS},
+		{"Kick", testKick},
+		{"Ban", testBan},
+		{"MOTD", testMOTD},
+		{"Transcript", testTranscript},
+		{"UnwritableTranscript", testUnwritableTranscript},
+		{"Metrics", testMetrics},
+		{"HealthCheck", testHealthCheck},
+		{"ConfigFile", testConfigFile},
+		{"SessionRejoin", testSessionRejoin},
+		{"SessionSuperseded", testSessionSuperseded},
+		{"SessionEviction", testSessionEviction},
+		{"LoadClients", testLoadClients},
+		{"Typing", testTyping},
+		{"WordFilter", testWordFilter},
+		{"Reconnect", testReconnect},
+		{"ReadTimeout", testReadTimeout},
+		{"SlowReader", testSlowReader},
+		{"WriteTimeout", testWriteTimeout},
+		{"RoomHistorySizes", testRoomHistorySizes},
+		{"UnixSocket", testUnixSocket},
+		{"IPv6", testIPv6},
+		{"Stats", testStats},
+		{"Broadcast", testBroadcast},
+		{"Help", testHelp},
+		{"SQLiteStore", testSQLiteStore},
+		{"WhoAll", testWhoAll},
+		{"Notify", testNotify},
+		{"Reload", testReload},
+		{"RoomPolicies", testRoomPolicies},
+		{"FileSharing", testFileSharing},
+		{"RacingJoins", testRacingJoins},
+		{"LineTooLong", testLineTooLong},
+		{"ConnsAndDrop", testConnsAndDrop},
+		{"GracefulShutdown", testGracefulShutdown},
+		{"TimestampFormat", testTimestampFormat},
+		{"NameCooldown", testNameCooldown},
+	}
+	for _, s := range scenarios {
+		t.Run(s.name, s.run)
+	}
+}
+
+func testIdleTimeout(t *testing.T) {
+	server, err := startAltServer(
+		fmt.Sprintf("CHAT_IDLE_TIMEOUT=%dms", idleTimeout.Milliseconds()),
+		"CHAT_PING_INTERVAL=0",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stopServer(server)
+
+	watcher, watcherReader, err := dialAndJoin(altPort, "rita")
+	if err != nil {
+		t.Fatalf("Rita could not join: %v", err)
+	}
+	defer watcher.Close()
+
+	idler, idlerReader, err := dialAndJoin(altPort, "sam")
+	if err != nil {
+		t.Fatalf("Sam could not join: %v", err)
+	}
+	defer idler.Close()
+
+	// Rita keeps asking "who" so her own idle timer keeps resetting
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(idleTimeout / 4)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				_, _ = fmt.Fprintln(watcher, "WHO")
+			}
+		}
+	}()
+
+	samLines, samClosed := readUntilClosed(idler, idlerReader, time.Now().Add(3*idleTimeout))
+	time.Sleep(2 * idleTimeout)
+	close(stop)
+	ritaLines, ritaClosed := readUntilClosed(watcher, watcherReader, time.Now().Add(messageReceiveDelay))
+
+	ritaOutput := strings.Join(ritaLines, "\n")
+	announced := strings.Contains(ritaOutput, "|sam|#general")
+	stillOnline := strings.Contains(ritaOutput, "Online in #general (1): rita")
+
+	if samClosed && announced && stillOnline && !ritaClosed {
+		return
+	}
+
+	t.Errorf("samClosed=%v announced=%v ritaStillOnline=%v ritaClosed=%v",
+		samClosed, announced, stillOnline, ritaClosed)
+	t.Log("Sam's output:")
+	t.Log(strings.Join(samLines, "\n"))
+	t.Log("Rita's output:")
+	t.Log(ritaOutput)
+}
+
+func testMaxClients(t *testing.T) {
+	// without sessions, a dropped client's name isn't held for a rejoin
+	server, err := startAltServer("CHAT_MAX_CLIENTS=2", "CHAT_PING_INTERVAL=0", "CHAT_SESSION_GRACE=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stopServer(server)
+
+	var joined []net.Conn
+	defer func() {
+		for _, conn := range joined {
+			conn.Close()
+		}
+	}()
+	for _, username := range []string{"yara", "zack"} {
+		conn, _, err := dialAndJoin(altPort, username)
+		if err != nil {
+			t.Fatalf("%s could not join: %v", username, err)
+		}
+		joined = append(joined, conn)
+	}
+
+	extra, extraReader, err := dial(altPort)
+	if err != nil {
+		t.Fatalf("third client could not connect: %v", err)
+	}
+	defer extra.Close()
+	if _, err := fmt.Fprintln(extra, "JOIN|abe"); err != nil {
+		t.Fatal("third client failed to send JOIN")
+	}
+	extraLines, extraClosed := readUntilClosed(extra, extraReader, time.Now().Add(2*time.Second))
+	rejected := len(extraLines) == 1 && extraLines[0] == "ERR|503|server-full|server full"
+
+	// dropping a client must free its slot, as soon as the server notices
+	joined[1].Close()
+	conn, _, err := dialAndJoin(altPort, "abe")
+	for deadline := time.Now().Add(responseTimeout); err != nil && time.Now().Before(deadline); {
+		time.Sleep(50 * time.Millisecond)
+		conn, _, err = dialAndJoin(altPort, "abe")
+	}
+	if err == nil {
+		joined = append(joined, conn)
+	}
+
+	if rejected && extraClosed && err == nil {
+		return
+	}
+
+	t.Errorf("rejected=%v closed=%v rejoinErr=%v", rejected, extraClosed, err)
+	t.Log("Third client's output:")
+	t.Log(strings.Join(extraLines, "\n"))
+}
+
+func testConnectRate(t *testing.T) {
+	server, err := startAltServer("CHAT_CONNECT_RATE=3", "CHAT_PING_INTERVAL=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stopServer(server)
+
+	// every join comes from 127.0.0.1, so only the first three in a minute get in
+	var joined []net.Conn
+	defer func() {
+		for _, conn := range joined {
+			conn.Close()
+		}
+	}()
+	var refusals []string
+	for i := 0; i < 6; i++ {
+		conn, _, err := dialAndJoin(altPort, fmt.Sprintf("flood%d", i))
+		if err != nil {
+			refusals = append(refusals, err.Error())
+			continue
+		}
+		joined = append(joined, conn)
+	}
+	throttled := len(joined) == 3 && len(refusals) == 3
+	for _, refusal := range refusals {
+		throttled = throttled && strings.HasSuffix(refusal, "ERR|429|too-many-connections|too many connections")
+	}
+
+	// a refused join closes the connection, and leaving frees no slot
+	if len(joined) > 0 {
+		joined[0].Close()
+	}
+	extra, extraReader, err := dial(altPort)
+	if err != nil {
+		t.Fatalf("extra client could not connect: %v", err)
+	}
+	defer extra.Close()
+	fmt.Fprintln(extra, "JOIN|flood9")
+	extraLines, extraClosed := readUntilClosed(extra, extraReader, time.Now().Add(2*time.Second))
+	stillRefused := len(extraLines) == 1 && extraLines[0] == "ERR|429|too-many-connections|too many connections"
+
+	if throttled && stillRefused && extraClosed {
+		return
+	}
+
+	t.Errorf("throttled=%v stillRefused=%v closed=%v", throttled, stillRefused, extraClosed)
+	t.Log("Refusals:")
+	t.Log(strings.Join(refusals, "\n"))
+	t.Log("Extra client's output:")
+	t.Log(strings.Join(extraLines, "\n"))
+}
+
+func testPassword(t *testing.T) {
+	const password = "hunter2"
+	server, err := startAltServer("CHAT_PASSWORD="+password, "CHAT_PING_INTERVAL=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stopServer(server)
+
+	// rejectedJoin sends a JOIN line and reports whether the server refused it and hung up.
+	rejectedJoin := func(join string) bool {
+		conn, reader, err := dial(altPort)
+		if err != nil {
+			return false
+		}
+		defer conn.Close()
+		if _, err := fmt.Fprintln(conn, join); err != nil {
+			return false
+		}
+		lines, closed := readUntilClosed(conn, reader, time.Now().Add(2*time.Second))
+		return closed && len(lines) == 1 && lines[0] == "ERR|401|auth-failed|authentication failed"
+	}
+	wrongRejected := rejectedJoin("JOIN|ann|hunter3")
+	missingRejected := rejectedJoin("JOIN|ann")
+
+	// dialAndJoin writes "JOIN|<name>", so the password rides along as a third field
+	conn, _, joinErr := dialAndJoin(altPort, "ann|"+password)
+	if joinErr == nil {
+		conn.Close()
+	}
+
+	if wrongRejected && missingRejected && joinErr == nil {
+		return
+	}
+
+	t.Fatalf("wrongRejected=%v missingRejected=%v joinErr=%v",
+		wrongRejected, missingRejected, joinErr)
+}
+
+func testTLS(t *testing.T) {
+	certPath, keyPath, err := writeSelfSignedCert()
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	server, err := startAltServer("CHAT_TLS_CERT="+certPath, "CHAT_TLS_KEY="+keyPath, "CHAT_PING_INTERVAL=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stopServer(server)
+
+	dialer := &net.Dialer{Timeout: 2 * time.Second}
+	conn, err := tls.DialWithDialer(dialer, "tcp", net.JoinHostPort(testHost, altPort), &tls.Config{
+		InsecureSkipVerify: true,
+		MinVersion:         tls.VersionTLS12,
+	})
+	if err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+	defer conn.Close()
+	listenerReader := bufio.NewReader(conn)
+	fmt.Fprintln(conn, "JOIN|tess")
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	hello, _ := listenerReader.ReadString('\n')
+	if !strings.HasPrefix(hello, "HELLO|") || !strings.Contains(hello, "tls") {
+		t.Fatalf("Tess was not told the server speaks TLS: %q", hello)
+	}
+	reply, err := listenerReader.ReadString('\n')
+	if err != nil || strings.TrimSpace(reply) != "OK" {
+		t.Fatalf("Tess could not join: %q %v", reply, err)
+	}
+
+	output, err := createTempFile()
+	if err != nil {
+		t.Fatal("failed to create temp file")
+	}
+	inputs := []string{"send hello over tls", "leave"}
+	if _, err := runClientWithInputOn(altPort, "uri", inputs, output, 3*time.Second, "--tls-insecure"); err != nil {
+		t.Fatalf("client failed: %v", err)
+	}
+	tessLines, _ := readUntilClosed(conn, listenerReader, time.Now().Add(messageReceiveDelay))
+	received := false
+	for _, line := range tessLines {
+		if strings.HasPrefix(line, "BROADCAST|") && strings.HasSuffix(line, "|uri|hello over tls") {
+			received = true
+		}
+	}
+
+	// a plaintext client just sees the handshake fail
+	plain, _, plainErr := dialAndJoin(altPort, "plain")
+	if plainErr == nil {
+		plain.Close()
+	}
+
+	if received && plainErr != nil {
+		return
+	}
+
+	t.Errorf("received=%v plaintextRejected=%v", received, plainErr != nil)
+	clientOutput, _ := os.ReadFile(output)
+	t.Log("Uri's output:")
+	t.Log(string(clientOutput))
+}
+
+func testKick(t *testing.T) {
+	const token = "opsecret"
+	server, err := startAltServer("CHAT_ADMIN_TOKEN="+token, "CHAT_PING_INTERVAL=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stopServer(server)
+
+	conns := map[string]net.Conn{}
+	readers := map[string]*bufio.Reader{}
+	for _, username := range []string{"oscar", "mal", "pat"} {
+		conn, reader, err := dialAndJoin(altPort, username)
+		if err != nil {
+			t.Fatalf("%s could not join: %v", username, err)
+		}
+		defer conn.Close()
+		conns[username], readers[username] = conn, reader
+	}
+
+	fmt.Fprintln(conns["pat"], "KICK|mal")
+	patRefused := handled(conns["pat"], readers["pat"])
+	fmt.Fprintf(conns["oscar"], "AUTH|wrong\nAUTH|%s\nKICK|mal\n", token)
+
+	read := func(username string) ([]string, bool) {
+		return readUntilClosed(conns[username], readers[username], time.Now().Add(messageReceiveDelay))
+	}
+	contains := func(lines []string, want string) bool {
+		for _, line := range lines {
+			if line == want {
+				return true
+			}
+		}
+		return false
+	}
+	oscarLines, _ := read("oscar")
+	malLines, malClosed := read("mal")
+	patLines, patClosed := read("pat")
+	patLines = append(patRefused, patLines...)
+
+	refused := contains(patLines, "ERR|403|not-authorized|not authorized") && contains(oscarLines, "ERR|403|not-authorized|not authorized")
+	kicked := contains(oscarLines, "INFO|Kicked mal") &&
+		contains(malLines, "INFO|You were kicked by an operator") && malClosed
+	announced := contains(patLines, "INFO|mal was kicked")
+
+	if refused && kicked && announced && !patClosed {
+		return
+	}
+
+	t.Errorf("refused=%v kicked=%v announced=%v patClosed=%v",
+		refused, kicked, announced, patClosed)
+	t.Log("Oscar's output:")
+	t.Log(strings.Join(oscarLines, "\n"))
+	t.Log("Mal's output:")
+	t.Log(strings.Join(malLines, "\n"))
+}
+
+func testBan(t *testing.T) {
+	const token = "opsecret"
+	banFile, err := createTempFile()
+	if err != nil {
+		t.Fatal("failed to create ban file")
+	}
+	if err := os.WriteFile(banFile, []byte("# seeded\ntrent\n"), 0o600); err != nil {
+		t.Fatalf("failed to seed ban file: %v", err)
+	}
+	server, err := startAltServer("CHAT_ADMIN_TOKEN="+token, "CHAT_BANFILE="+banFile, "CHAT_PING_INTERVAL=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stopServer(server)
+
+	// everyone dials from 127.0.0.1, so banning mal's address shuts out all new joins
+	isBanned := func(username string) bool {
+		conn, _, err := dialAndJoin(altPort, username)
+		if err == nil {
+			conn.Close()
+		}
+		return err != nil && strings.Contains(err.Error(), "ERR|403|banned|you are banned")
+	}
+	contains := func(lines []string, want string) bool {
+		for _, line := range lines {
+			if line == want {
+				return true
+			}
+		}
+		return false
+	}
+	seeded := isBanned("Trent")
+
+	oscar, oscarReader, err := dialAndJoin(altPort, "oscar")
+	if err != nil {
+		t.Fatalf("oscar could not join: %v", err)
+	}
+	defer oscar.Close()
+	mal, malReader, err := dialAndJoin(altPort, "mal")
+	if err != nil {
+		t.Fatalf("mal could not join: %v", err)
+	}
+	defer mal.Close()
+
+	fmt.Fprintf(oscar, "AUTH|%s\nBAN|mal\n", token)
+	oscarLines, _ := readUntilClosed(oscar, oscarReader, time.Now().Add(messageReceiveDelay))
+	malLines, malClosed := readUntilClosed(mal, malReader, time.Now().Add(messageReceiveDelay))
+	banned := contains(oscarLines, "INFO|Banned mal") &&
+		contains(malLines, "INFO|You were banned by an operator") && malClosed
+	refused := isBanned("MAL") && isBanned("newbie")
+	saved, _ := os.ReadFile(banFile)
+	persisted := strings.Contains(string(saved), "mal 127.0.0.1")
+
+	fmt.Fprintln(oscar, "UNBAN|mal")
+	unbanLines, _ := readUntilClosed(oscar, oscarReader, time.Now().Add(messageReceiveDelay))
+	oscarLines = append(oscarLines, unbanLines...)
+	rejoin, _, err := dialAndJoin(altPort, "mal")
+	lifted := contains(unbanLines, "INFO|Unbanned mal") && err == nil
+	if err == nil {
+		rejoin.Close()
+	}
+
+	if seeded && banned && refused && persisted && lifted {
+		return
+	}
+
+	t.Errorf("seeded=%v banned=%v refused=%v persisted=%v lifted=%v",
+		seeded, banned, refused, persisted, lifted)
+	t.Log("Oscar's output:")
+	t.Log(strings.Join(oscarLines, "\n"))
+	t.Log("Mal's output:")
+	t.Log(strings.Join(malLines, "\n"))
+	t.Log("Ban file:")
+	t.Log(string(saved))
+}
+
+func testMOTD(t *testing.T) {
+	motdFile, err := createTempFile()
+	if err != nil {
+		t.Fatal("failed to create MOTD file")
+	}
+	if err := os.WriteFile(motdFile, []byte("Welcome!\n\nBe nice | no spam\n"), 0o600); err != nil {
+		t.Fatalf("failed to write MOTD file: %v", err)
+	}
+	server, err := startAltServer("CHAT_MOTD_FILE="+motdFile, "CHAT_PING_INTERVAL=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stopServer(server)
+
+	// leave something in history so we can see the MOTD arrives first
+	first, firstReader, err := dialAndJoin(altPort, "mona")
+	if err != nil {
+		t.Fatalf("Mona could not join: %v", err)
+	}
+	defer first.Close()
+	fmt.Fprintln(first, "SEND|before you came")
+	handled(first, firstReader)
+
+	conn, reader, err := dialAndJoin(altPort, "ned")
+	if err != nil {
+		t.Fatalf("Ned could not join: %v", err)
+	}
+	defer conn.Close()
+	lines, _ := readUntilClosed(conn, reader, time.Now().Add(messageReceiveDelay/2))
+	lines = withoutSession(lines)
+
+	want := []string{"INFO|Welcome!", "INFO|", "INFO|Be nice | no spam"}
+	if len(lines) > len(want) && slices.Equal(lines[:len(want)], want) &&
+		strings.HasPrefix(lines[len(want)], "HISTORY|") {
+		return
+	}
+
+	t.Error("expected the MOTD lines before the history replay")
+	t.Log(strings.Join(lines, "\n"))
+}
+
+func testTranscript(t *testing.T) {
+	logFile, err := createTempFile()
+	if err != nil {
+		t.Fatal("failed to create log file")
+	}
+	if err := os.WriteFile(logFile, []byte("from an earlier run\n"), 0o600); err != nil {
+		t.Fatalf("failed to seed log file: %v", err)
+	}
+	server, err := startAltServer("CHAT_LOG_FILE="+logFile, "CHAT_PING_INTERVAL=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stopServer(server)
+
+	conn, reader, err := dialAndJoin(altPort, "tess")
+	if err != nil {
+		t.Fatalf("Tess could not join: %v", err)
+	}
+	defer conn.Close()
+	for _, line := range []string{"SEND|hello | all", "ME|waves", "ROOM|#audit", "SEND|in audit", "DM|tess|not logged"} {
+		fmt.Fprintln(conn, line)
+	}
+	handled(conn, reader)
+	// no clean shutdown: what was said must already be on disk
+	stopServer(server)
+
+	content := readFileContent(logFile)
+	ts := `\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}Z`
+	want := regexp.MustCompile(`^from an earlier run\n` +
+		ts + ` #general <tess> hello \| all\n` +
+		ts + ` #general \* tess waves\n` +
+		ts + ` #audit <tess> in audit\n$`)
+	if want.MatchString(content) {
+		return
+	}
+
+	t.Error("unexpected log file contents")
+	t.Log(content)
+}
+
+func testUnwritableTranscript(t *testing.T) {
+	logFile := filepath.Join(t.TempDir(), "missing", "chat.log")
+
+	// lenient by default: the server starts and chat works without a transcript
+	server, err := startAltServer("CHAT_LOG_FILE="+logFile, "CHAT_PING_INTERVAL=0")
+	if err != nil {
+		t.Fatalf("the server would not start without its log file: %v", err)
+	}
+	defer stopServer(server)
+	conn, reader, err := dialAndJoin(altPort, "ursa")
+	if err != nil {
+		t.Fatalf("ursa could not join: %v", err)
+	}
+	defer conn.Close()
+	fmt.Fprintln(conn, "SEND|unlogged")
+	lines := handled(conn, reader)
+	chatted := slices.ContainsFunc(lines, func(line string) bool {
+		return strings.HasSuffix(line, "|ursa|unlogged")
+	})
+
+	// strict: it refuses to start, and says why
+	ctx, cancel := context.WithTimeout(context.Background(), startTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, serverBin)
+	cmd.Env = append(os.Environ(), "CHAT_HOST="+testHost, "CHAT_PORT=0", "CHAT_LOG_FILE="+logFile, "CHAT_LOG_STRICT=1")
+	output, err := cmd.CombinedOutput()
+	refused := err != nil && ctx.Err() == nil && strings.Contains(string(output), "Cannot open CHAT_LOG_FILE")
+
+	if chatted && refused {
+		return
+	}
+
+	t.Errorf("chatted=%v refused=%v", chatted, refused)
+	t.Logf("Ursa's lines: %q\nOutput of the strict server: %s", lines, output)
+}
+
+func testMetrics(t *testing.T) {
+	metricsAddr := net.JoinHostPort(testHost, metricsPort)
+	server, err := startAltServer("CHAT_MAX_CLIENTS=1", "CHAT_PING_INTERVAL=0", "CHAT_SHUTDOWN_GRACE=0",
+		"CHAT_SESSION_GRACE=0", "CHAT_METRICS_ADDR="+metricsAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stopServer(server)
+	if _, err := waitForPort(metricsAddr, startTimeout); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, reader, err := dialAndJoin(altPort, "nia")
+	if err != nil {
+		t.Fatalf("nia could not join: %v", err)
+	}
+	fmt.Fprintln(conn, "SEND|counted")
+	handled(conn, reader)
+	if _, _, err := dialAndJoin(altPort, "olaf"); err == nil {
+		t.Fatal("olaf joined a full server")
+	}
+	during, err := scrapeMetrics(metricsAddr)
+	if err != nil {
+		t.Fatalf("scrape failed: %v", err)
+	}
+
+	// no LEAVE: the gauge must still come back down, once the server notices
+	conn.Close()
+	after, err := scrapeMetrics(metricsAddr)
+	for deadline := time.Now().Add(responseTimeout); err == nil && after["chat_connected_clients"] != "0" &&
+		time.Now().Before(deadline); {
+		time.Sleep(50 * time.Millisecond)
+		after, err = scrapeMetrics(metricsAddr)
+	}
+	if err != nil {
+		t.Fatalf("second scrape failed: %v", err)
+	}
+
+	counted := during["chat_connected_clients"] == "1" && during["chat_joins_total"] == "1" &&
+		during["chat_messages_broadcast_total"] == "1" &&
+		during[`chat_rejected_connections_total{reason="server_full"}`] == "1"
+	released := after["chat_connected_clients"] == "0" && after["chat_leaves_total"] == "1"
+
+	_ = server.Process.Signal(syscall.SIGTERM)
+	exited := make(chan error, 1)
+	go func() { exited <- server.Wait() }()
+	var stopped bool
+	select {
+	case err := <-exited:
+		_, dialErr := net.DialTimeout("tcp", metricsAddr, time.Second)
+		stopped = err == nil && dialErr != nil
+	case <-time.After(10 * time.Second):
+	}
+
+	if counted && released && stopped {
+		return
+	}
+
+	t.Errorf("counted=%v released=%v stopped=%v", counted, released, stopped)
+	t.Logf("During: %v\nAfter: %v\n", during, after)
+}
+
+// testHealthCheck checks that CHAT_HEALTH_ADDR answers over HTTP and plain
+// TCP while the server is up, even when it is full, fails once shutdown has
+// begun, and goes away with the server.
+func testHealthCheck(t *testing.T) {
+	healthAddr := net.JoinHostPort(testHost, freePort(t))
+	server, err := startAltServer("CHAT_MAX_CLIENTS=1", "CHAT_PING_INTERVAL=0", "CHAT_SHUTDOWN_GRACE=2",
+		"CHAT_HEALTH_ADDR="+healthAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stopServer(server)
+	if _, err := waitForPort(healthAddr, startTimeout); err != nil {
+		t.Fatal(err)
+	}
+
+	probeHTTP := func() int {
+		client := http.Client{Timeout: responseTimeout}
+		resp, err := client.Get("http://" + healthAddr + "/health")
+		if err != nil {
+			return 0
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	probeTCP := func() string {
+		conn, err := net.DialTimeout("tcp", healthAddr, time.Second)
+		if err != nil {
+			return ""
+		}
+		defer conn.Close()
+		_ = conn.SetReadDeadline(time.Now().Add(responseTimeout))
+		fmt.Fprintln(conn, "PING")
+		reply, _ := io.ReadAll(conn)
+		return string(reply)
+	}
+
+	conn, _, err := dialAndJoin(altPort, "pia")
+	if err != nil {
+		t.Fatalf("pia could not join: %v", err)
+	}
+	defer conn.Close()
+	// the one client slot is taken, and probes still get through
+	healthy := probeHTTP() == http.StatusOK && probeTCP() == "OK\n"
+
+	_ = server.Process.Signal(syscall.SIGTERM)
+	time.Sleep(500 * time.Millisecond)
+	draining := probeHTTP() == http.StatusServiceUnavailable && probeTCP() == "FAIL\n"
+
+	exited := make(chan error, 1)
+	go func() { exited <- server.Wait() }()
+	var stopped bool
+	select {
+	case <-exited:
+		_, dialErr := net.DialTimeout("tcp", healthAddr, time.Second)
+		stopped = dialErr != nil
+	case <-time.After(10 * time.Second):
+	}
+
+	if healthy && draining && stopped {
+		return
+	}
+	t.Errorf("healthy=%v draining=%v stopped=%v", healthy, draining, stopped)
+}
+
+func testConfigFile(t *testing.T) {
+	configFile, err := createTempFile()
+	if err != nil {
+		t.Fatal("failed to create config file")
+	}
+	// a port of its own rather than 0, to tell the file was read
+	port := freePort(t)
+	config := fmt.Sprintf(strings.Join([]string{
+		"# everything but the host comes from here",
+		"port: %s",
+		"max_clients: 1  # overridden below",
+		"ping_interval: 0",
+		"motd: |",
+		"  From the file.",
+		"  Be nice.",
+		"",
+	}, "\n"), port)
+	if err := os.WriteFile(configFile, []byte(config), 0o600); err != nil {
+		t.Fatalf("failed to write config file: %v", err)
+	}
+	server, err := startServerWith([]string{"--config", configFile}, "CHAT_HOST="+testHost, "CHAT_MAX_CLIENTS=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stopServer(server)
+	fromFile := altPort == port
+
+	first, reader, err := dialAndJoin(altPort, "otto")
+	if err != nil {
+		t.Fatalf("otto could not join: %v", err)
+	}
+	defer first.Close()
+	lines, _ := readUntilClosed(first, reader, time.Now().Add(messageReceiveDelay/2))
+	lines = withoutSession(lines)
+	want := []string{"INFO|From the file.", "INFO|Be nice."}
+	motd := len(lines) >= len(want) && slices.Equal(lines[:len(want)], want)
+
+	// the environment allows two clients where the file said one
+	second, _, err := dialAndJoin(altPort, "pia")
+	overridden := err == nil
+	if overridden {
+		defer second.Close()
+	}
+	_, _, err = dialAndJoin(altPort, "quin")
+	capped := err != nil && strings.Contains(err.Error(), "server full")
+
+	if err := os.WriteFile(configFile, []byte("port: 1\nmax_clients: lots\n"), 0o600); err != nil {
+		t.Fatalf("failed to write config file: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), startTimeout)
+	defer cancel()
+	output, err := exec.CommandContext(ctx, serverBin, "--config", configFile).CombinedOutput()
+	rejected := err != nil && ctx.Err() == nil && strings.Contains(string(output), "invalid max_clients")
+
+	if fromFile && motd && overridden && capped && rejected {
+		return
+	}
+
+	t.Errorf("fromFile=%v motd=%v overridden=%v capped=%v rejected=%v",
+		fromFile, motd, overridden, capped, rejected)
+	t.Logf("Lines: %q\nOutput of the bad config: %s\n", lines, output)
+}
+
+func testSessionRejoin(t *testing.T) {
+	grace := time.Second
+	// no cooldown, so an expired token reclaims nothing
+	server, err := startAltServer(fmt.Sprintf("CHAT_SESSION_GRACE=%dms", grace.Milliseconds()),
+		"CHAT_PING_INTERVAL=0", "CHAT_NAME_COOLDOWN=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stopServer(server)
+
+	watcher, watcherReader, err := dialAndJoin(altPort, "rita")
+	if err != nil {
+		t.Fatalf("rita could not join: %v", err)
+	}
+	defer watcher.Close()
+
+	// readToken reads the SESSION line that follows OK
+	readToken := func(reader *bufio.Reader) string {
+		line, _ := reader.ReadString('\n')
+		fields := strings.Split(strings.TrimSpace(line), "|")
+		if len(fields) != 3 || fields[0] != "SESSION" {
+			return ""
+		}
+		return fields[1]
+	}
+
+	conn, reader, err := dialAndJoin(altPort, "sam")
+	if err != nil {
+		t.Fatalf("sam could not join: %v", err)
+	}
+	token := readToken(reader)
+	// whether or not the server has noticed yet, the name stays taken
+	conn.Close()
+
+	// the name is held, not free
+	_, _, err = dialAndJoin(altPort, "sam")
+	held := err != nil && strings.Contains(err.Error(), "already taken")
+
+	var newToken, backIn string
+	resumed, resumedReader, err := dialAndRejoin(altPort, token)
+	if err == nil {
+		newToken = readToken(resumedReader)
+		backIn, _ = resumedReader.ReadString('\n')
+	}
+	rejoined := err == nil && newToken != "" && newToken != token &&
+		strings.TrimSpace(backIn) == "INFO|Rejoined #general"
+
+	_, _, err = dialAndRejoin(altPort, token)
+	singleUse := err != nil && strings.Contains(err.Error(), "invalid or expired session")
+
+	// dropped again and left too long, sam is gone for good
+	if resumed != nil {
+		resumed.Close()
+	}
+	time.Sleep(grace + messageReceiveDelay)
+	_, _, err = dialAndRejoin(altPort, newToken)
+	expired := err != nil && strings.Contains(err.Error(), "invalid or expired session")
+
+	watcherLines, _ := readUntilClosed(watcher, watcherReader, time.Now().Add(messageReceiveDelay/2))
+	watcherOutput := strings.Join(watcherLines, "\n")
+	announced := strings.Contains(watcherOutput, "INFO|sam reconnected") &&
+		strings.Count(watcherOutput, "|sam|#general") == 2 // JOINED once, LEFT once
+
+	if token != "" && held && rejoined && singleUse && expired && announced {
+		return
+	}
+
+	t.Errorf("token=%q held=%v rejoined=%v (%q) singleUse=%v expired=%v announced=%v",
+		token, held, rejoined, backIn, singleUse, expired, announced)
+	t.Log("Rita's output:")
+	t.Log(watcherOutput)
+}
+
+func testSessionSuperseded(t *testing.T) {
+	server, err := startAltServer("CHAT_PING_INTERVAL=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stopServer(server)
+
+	watcher, watcherReader, err := dialAndJoin(altPort, "rita")
+	if err != nil {
+		t.Fatalf("rita could not join: %v", err)
+	}
+	defer watcher.Close()
+	first, firstReader, err := dialAndJoin(altPort, "sam")
+	if err != nil {
+		t.Fatalf("sam could not join: %v", err)
+	}
+	defer first.Close()
+	line, _ := firstReader.ReadString('\n')
+	fields := strings.Split(strings.TrimSpace(line), "|")
+	if len(fields) != 3 || fields[0] != "SESSION" {
+		t.Fatalf("no session token after joining: %q", line)
+	}
+
+	// the first connection is still open when the second takes over
+	second, secondReader, err := dialAndRejoin(altPort, fields[1])
+	if err != nil {
+		t.Fatalf("sam could not rejoin: %v", err)
+	}
+	defer second.Close()
+	firstLines, closed := readUntilClosed(first, firstReader, time.Now().Add(responseTimeout))
+	superseded := closed && slices.Contains(firstLines, "ERR|409|session-superseded|session superseded")
+
+	// rita's line reaches the one connection sam has left, and only once
+	fmt.Fprintln(watcher, "SEND|once only")
+	handled(watcher, watcherReader)
+	secondLines, _ := readUntilClosed(second, secondReader, time.Now().Add(messageReceiveDelay))
+	deliveries := 0
+	for _, line := range secondLines {
+		if strings.HasSuffix(line, "|rita|once only") {
+			deliveries++
+		}
+	}
+
+	if superseded && deliveries == 1 {
+		return
+	}
+
+	t.Errorf("superseded=%v deliveries=%d", superseded, deliveries)
+	t.Log("First connection's output:")
+	t.Log(strings.Join(firstLines, "\n"))
+	t.Log("Second connection's output:")
+	t.Log(strings.Join(secondLines, "\n"))
+}
+
+// testSessionEviction checks that past CHAT_SESSION_MAX_HELD the session
+// held longest is dropped for a newer one, and that the client joins afresh
+// when its token is no good.
+func testSessionEviction(t *testing.T) {
+	// no cooldown, so an evicted token reclaims nothing
+	server, err := startAltServer("CHAT_SESSION_MAX_HELD=1", "CHAT_PING_INTERVAL=0", "CHAT_NAME_COOLDOWN=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stopServer(server)
+
+	watcher, watcherReader, err := dialAndJoin(altPort, "rita")
+	if err != nil {
+		t.Fatalf("rita could not join: %v", err)
+	}
+	defer watcher.Close()
+
+	tokens := map[string]string{}
+	for _, username := range []string{"sam", "tom"} {
+		conn, reader, err := dialAndJoin(altPort, username)
+		if err != nil {
+			t.Fatalf("%s could not join: %v", username, err)
+		}
+		line, _ := reader.ReadString('\n')
+		fields := strings.Split(strings.TrimSpace(line), "|")
+		if len(fields) != 3 || fields[0] != "SESSION" {
+			t.Fatalf("no session token for %s: %q", username, line)
+		}
+		tokens[username] = fields[1]
+		// sam's session is held first, so it is the one pushed out
+		conn.Close()
+		time.Sleep(messageReceiveDelay / 2)
+	}
+
+	watcherLines := readThrough(watcher, watcherReader, "LEFT|")
+	_, _, err = dialAndRejoin(altPort, tokens["sam"])
+	evicted := err != nil && strings.Contains(err.Error(), "invalid or expired session")
+	// both stay connected: another drop would push tom's session out in turn
+	tomBack, _, err := dialAndRejoin(altPort, tokens["tom"])
+	tomKept := err == nil
+	if tomKept {
+		defer tomBack.Close()
+	}
+	samBack, _, err := dialAndJoin(altPort, "sam")
+	nameFreed := err == nil
+	if nameFreed {
+		defer samBack.Close()
+	}
+
+	output, err := createTempFile()
+	if err != nil {
+		t.Fatal("failed to create temp file")
+	}
+	err = runClientScript(altPort, "uma", []string{"leave"}, output, 5*time.Second, "--rejoin", tokens["sam"])
+	content := readFileContent(output)
+	fellBack := err == nil && joinedAs(content, "uma")
+
+	if evicted && nameFreed && tomKept && fellBack {
+		return
+	}
+	t.Errorf("evicted=%v nameFreed=%v tomKept=%v fellBack=%v", evicted, nameFreed, tomKept, fellBack)
+	t.Log("Rita's output:")
+	t.Log(strings.Join(watcherLines, "\n"))
+	t.Log("Client output:")
+	t.Log(content)
+}
+
+// testLoadClients checks that --clients joins that many virtual users, has
+// them send for --duration, and reports totals that add up.
+func testLoadClients(t *testing.T) {
+	server, err := startAltServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stopServer(server)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, clientBin, "--host", testHost, "--port", altPort,
+		"--username", "loader", "--clients", "5", "--rate", "2", "--duration", "2").CombinedOutput()
+	output := string(out)
+	if err != nil {
+		t.Fatalf("load run failed: %v\n%s", err, output)
+	}
+
+	var sent, received int
+	for _, line := range strings.Split(output, "\n") {
+		fmt.Sscanf(line, "sent: %d", &sent)
+		fmt.Sscanf(line, "received: %d", &received)
+	}
+	joined := strings.Contains(output, "clients: 5 joined, 0 failed to join, 0 dropped")
+	clean := strings.Contains(output, "errors: 0")
+	// everyone is in #general, so most lines are read by all five; the last
+	// few may still be on their way when the readers leave
+	if joined && clean && sent >= 5*3 && received > 4*sent-5*5 {
+		return
+	}
+	t.Errorf("joined=%v clean=%v sent=%d received=%d", joined, clean, sent, received)
+	t.Log(output)
+}
+
+func testTyping(t *testing.T) {
+	// typingTimeout mirrors TYPING_TIMEOUT in common/src/consts.rs
+	const typingTimeout = 3 * time.Second
+	server, err := startAltServer("CHAT_PING_INTERVAL=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stopServer(server)
+
+	conns := map[string]net.Conn{}
+	readers := map[string]*bufio.Reader{}
+	for _, username := range []string{"tess", "uma", "vic"} {
+		conn, reader, err := dialAndJoin(altPort, username)
+		if err != nil {
+			t.Fatalf("%s could not join: %v", username, err)
+		}
+		defer conn.Close()
+		conns[username], readers[username] = conn, reader
+	}
+	// vic stays behind in #general
+	fmt.Fprintln(conns["tess"], "ROOM|#drafts")
+	fmt.Fprintln(conns["uma"], "ROOM|#drafts")
+	tessEarly := handled(conns["tess"], readers["tess"])
+	umaEarly := handled(conns["uma"], readers["uma"])
+
+	// repeated TYPING while composing is announced once, and sending ends it
+	fmt.Fprint(conns["tess"], "TYPING\nTYPING\n")
+	fmt.Fprintln(conns["tess"], "SEND|done")
+	tessEarly = append(tessEarly, handled(conns["tess"], readers["tess"])...)
+	// left alone, the indicator runs out by itself
+	fmt.Fprintln(conns["tess"], "TYPING")
+	time.Sleep(typingTimeout + messageReceiveDelay)
+	// and leaving ends it too, ahead of the leave itself
+	fmt.Fprint(conns["tess"], "TYPING\nLEAVE\n")
+
+	tessLines, _ := readUntilClosed(conns["tess"], readers["tess"], time.Now().Add(responseTimeout))
+	umaLines, _ := readUntil(conns["uma"], readers["uma"], "|tess|#drafts")
+	tessLines, umaLines = append(tessEarly, tessLines...), append(umaEarly, umaLines...)
+	vicLines, _ := readUntilClosed(conns["vic"], readers["vic"], time.Now().Add(messageReceiveDelay/2))
+	relayed := func(lines []string) []string {
+		var kept []string
+		for _, line := range lines {
+			if strings.HasPrefix(line, "TYPING|") || strings.HasPrefix(line, "BROADCAST|") {
+				kept = append(kept, line)
+			}
+		}
+		return kept
+	}
+
+	umaSaw := relayed(umaLines)
+	ordered := len(umaSaw) == 7 &&
+		umaSaw[0] == "TYPING|tess|start" &&
+		umaSaw[1] == "TYPING|tess|stop" &&
+		strings.HasSuffix(umaSaw[2], "|tess|done") &&
+		umaSaw[3] == "TYPING|tess|start" &&
+		umaSaw[4] == "TYPING|tess|stop" &&
+		umaSaw[5] == "TYPING|tess|start" &&
+		umaSaw[6] == "TYPING|tess|stop"
+	notEchoed := !strings.Contains(strings.Join(tessLines, "\n"), "TYPING|")
+	scoped := !strings.Contains(strings.Join(vicLines, "\n"), "TYPING|")
+
+	if ordered && notEchoed && scoped {
+		return
+	}
+
+	t.Errorf("ordered=%v notEchoed=%v scoped=%v", ordered, notEchoed, scoped)
+	t.Log("Uma's output:")
+	t.Log(strings.Join(umaLines, "\n"))
+}
+
+func testWordFilter(t *testing.T) {
+	filterFile, err := createTempFile()
+	if err != nil {
+		t.Fatal("failed to create filter file")
+	}
+	if err := os.WriteFile(filterFile, []byte("# keep it clean\ndarn\nASS\n"), 0o600); err != nil {
+		t.Fatalf("failed to write filter file: %v", err)
+	}
+	server, err := startAltServer("CHAT_FILTER_FILE="+filterFile, "CHAT_PING_INTERVAL=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stopServer(server)
+
+	sender, senderReader, err := dialAndJoin(altPort, "wes")
+	if err != nil {
+		t.Fatalf("wes could not join: %v", err)
+	}
+	defer sender.Close()
+	watcher, watcherReader, err := dialAndJoin(altPort, "xia")
+	if err != nil {
+		t.Fatalf("xia could not join: %v", err)
+	}
+	defer watcher.Close()
+
+	fmt.Fprint(sender, "SEND|Darn, the class ran late\nME|mutters ass\n")
+	senderEarly := handled(sender, senderReader)
+
+	late, lateReader, err := dialAndJoin(altPort, "yves")
+	if err != nil {
+		t.Fatalf("yves could not join: %v", err)
+	}
+	defer late.Close()
+
+	senderLines, _ := readUntilClosed(sender, senderReader, time.Now().Add(messageReceiveDelay/2))
+	senderLines = append(senderEarly, senderLines...)
+	watcherLines, _ := readUntilClosed(watcher, watcherReader, time.Now().Add(messageReceiveDelay/2))
+	lateLines, _ := readUntilClosed(late, lateReader, time.Now().Add(messageReceiveDelay/2))
+	senderOutput := strings.Join(senderLines, "\n")
+	watcherOutput := strings.Join(watcherLines, "\n")
+	lateOutput := strings.Join(lateLines, "\n")
+
+	censored := strings.Contains(watcherOutput, "|wes|****, the class ran late") &&
+		strings.Contains(watcherOutput, "|wes|mutters ***") && !strings.Contains(watcherOutput, "Darn")
+	original := strings.Contains(senderOutput, "|wes|Darn, the class ran late") &&
+		strings.Contains(senderOutput, "|wes|mutters ass") && !strings.Contains(senderOutput, "****")
+	history := strings.Contains(lateOutput, "HISTORY|BROADCAST|") &&
+		strings.Contains(lateOutput, "|wes|****, the class ran late") && !strings.Contains(lateOutput, "Darn")
+
+	if censored && original && history {
+		return
+	}
+
+	t.Errorf("censored=%v original=%v history=%v", censored, original, history)
+	t.Log("Xia's output:")
+	t.Log(watcherOutput)
+	t.Log("Wes's output:")
+	t.Log(senderOutput)
+}
+
+func testReconnect(t *testing.T) {
+	server, err := startAltServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { stopServer(server) }()
+
+	output, err := createTempFile()
+	if err != nil {
+		t.Fatal("failed to create temp file")
+	}
+	clientOut, err := newClientOutput(output)
+	if err != nil {
+		t.Fatal("failed to open output file")
+	}
+	cmd := exec.Command(clientBin, "--host", testHost, "--port", altPort, "--username", "comeback",
+		"--reconnect", "--reconnect-attempts", "5")
+	cmd.Stdout = clientOut
+	cmd.Stderr = clientOut
+	stdin, err := cmd.StdinPipe()
+	if err != nil || cmd.Start() != nil {
+		t.Fatal("failed to start the client")
+	}
+	mu.Lock()
+	clientCmds = append(clientCmds, cmd)
+	mu.Unlock()
+	defer func() {
+		stdin.Close()
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	}()
+	if !clientOut.waitFor(joinedMarker, joinTimeout) {
+		t.Fatalf("the client did not join:\n%s", readFileContent(output))
+	}
+	fmt.Fprintln(stdin, "join #dev")
+	if !clientOut.waitFor("You are now in #dev", responseTimeout) {
+		t.Fatalf("the client did not move to #dev:\n%s", readFileContent(output))
+	}
+
+	// a restart forgets the session, so the client has to fall back to a plain join
+	stopServer(server)
+	server, err = startAltServer("CHAT_PORT=" + altPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientOut.waitFor("Rejoined #dev", 6*time.Second)
+
+	watcher, watcherReader, err := dialAndJoin(altPort, "watcher")
+	if err != nil {
+		t.Fatalf("watcher could not join: %v", err)
+	}
+	defer watcher.Close()
+	fmt.Fprintln(watcher, "ROOM|#dev")
+	handled(watcher, watcherReader)
+	fmt.Fprintln(stdin, "send back again")
+	lines, _ := readUntilClosed(watcher, watcherReader, time.Now().Add(messageReceiveDelay))
+	heard := strings.Contains(strings.Join(lines, "\n"), "|comeback|back again")
+
+	content := readFileContent(output)
+	announced := strings.Contains(content, "Reconnecting...") && strings.Contains(content, "Reconnected") &&
+		strings.Contains(content, "Rejoined #dev")
+	if !heard || !announced {
+		t.Fatalf("heard in #dev: %v, announced: %v\nclient: %s", heard, announced, content)
+	}
+}
+
+func testReadTimeout(t *testing.T) {
+	// without sessions, the stalled user leaves at once rather than being held
+	server, err := startAltServer(
+		fmt.Sprintf("CHAT_READ_TIMEOUT=%dms", readTimeout.Milliseconds()),
+		"CHAT_PING_INTERVAL=0",
+		"CHAT_SESSION_GRACE=0",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stopServer(server)
+
+	// a single byte that never becomes a line
+	conn, reader, err := dial(altPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("J")); err != nil {
+		t.Fatal(err)
+	}
+	lines, closed := readUntilClosed(conn, reader, time.Now().Add(3*readTimeout))
+	if !closed || !slices.Equal(lines, []string{"ERR|408|read-timeout|read timeout"}) {
+		t.Errorf("single byte: closed=%v, got %q", closed, lines)
+	}
+
+	watcher, watcherReader, err := dialAndJoin(altPort, "tina")
+	if err != nil {
+		t.Fatalf("Tina could not join: %v", err)
+	}
+	defer watcher.Close()
+	staller, stallerReader, err := dialAndJoin(altPort, "ulf")
+	if err != nil {
+		t.Fatalf("Ulf could not join: %v", err)
+	}
+	defer staller.Close()
+	handled(watcher, watcherReader)
+
+	// Tina's chatter reaches Ulf while his line hangs, which must not keep it alive
+	if _, err := fmt.Fprint(staller, "SEND|never finished"); err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(readTimeout / 4)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				_, _ = fmt.Fprintln(watcher, "SEND|still here")
+			}
+		}
+	}()
+	ulfLines, ulfClosed := readUntilClosed(staller, stallerReader, time.Now().Add(3*readTimeout))
+	close(stop)
+	// the leave goes through the dispatcher, so it may come after a PONG would
+	var tinaLines []string
+	announced := false
+	_ = watcher.SetReadDeadline(time.Now().Add(responseTimeout))
+	for !announced {
+		line, err := watcherReader.ReadString('\n')
+		if err != nil {
+			break
+		}
+		tinaLines = append(tinaLines, strings.TrimSpace(line))
+		announced = strings.HasPrefix(line, "LEFT|") && strings.HasSuffix(line, "|ulf|#general|disconnected\n")
+	}
+
+	tinaOutput := strings.Join(tinaLines, "\n")
+	timedOut := slices.Contains(ulfLines, "ERR|408|read-timeout|read timeout")
+	leaked := strings.Contains(tinaOutput, "never finished")
+	if ulfClosed && timedOut && announced && !leaked {
+		return
+	}
+	t.Errorf("ulfClosed=%v timedOut=%v announced=%v leaked=%v", ulfClosed, timedOut, announced, leaked)
+	t.Log("Ulf's output:")
+	t.Log(strings.Join(ulfLines, "\n"))
+	t.Log("Tina's output:")
+	t.Log(tinaOutput)
+}
+
+func testSlowReader(t *testing.T) {
+	// more than the server's queues and kernel buffers hold for Sloth
+	const messages, size = 3500, 1900
+	server, err := startAltServer(
+		"CHAT_PING_INTERVAL=0",
+		fmt.Sprintf("CHAT_RATE_LIMIT=%d", messages),
+		fmt.Sprintf("CHAT_RATE_BURST=%d", messages),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stopServer(server)
+
+	// Sloth never reads. He keeps what the kernel buffers for him small, and
+	// from before connecting, so the window he offers stays small too.
+	dialer := net.Dialer{
+		Timeout: 2 * time.Second,
+		Control: func(_, _ string, c syscall.RawConn) error {
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF, 4096)
+			})
+			if err != nil {
+				return err
+			}
+			return sockErr
+		},
+	}
+	sloth, err := dialer.Dial("tcp", net.JoinHostPort(testHost, altPort))
+	if err != nil {
+		t.Fatalf("Sloth could not connect: %v", err)
+	}
+	defer sloth.Close()
+	slothReader := bufio.NewReader(sloth)
+	fmt.Fprintln(sloth, "JOIN|sloth")
+
+	owl, owlReader, err := dialAndJoin(altPort, "owl")
+	if err != nil {
+		t.Fatalf("Owl could not join: %v", err)
+	}
+	defer owl.Close()
+	fox, foxReader, err := dialAndJoin(altPort, "fox")
+	if err != nil {
+		t.Fatalf("Fox could not join: %v", err)
+	}
+	defer fox.Close()
+	handled(owl, owlReader)
+
+	// Fox hears his own messages and must keep up with them too
+	_ = fox.SetReadDeadline(time.Time{})
+	go func() { _, _ = io.Copy(io.Discard, foxReader) }()
+
+	var heard atomic.Int64
+	var slothLeft atomic.Bool
+	_ = owl.SetReadDeadline(time.Time{})
+	go func() {
+		for {
+			line, err := owlReader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			// not his join notice, which may come late
+			if strings.Contains(line, "|fox|x") {
+				heard.Add(1)
+			}
+			if strings.HasSuffix(line, "|sloth|#general\n") {
+				slothLeft.Store(true)
+			}
+		}
+	}()
+	deadline := time.Now().Add(30 * time.Second)
+	waitFor := func(done func() bool) bool {
+		for !done() {
+			if time.Now().After(deadline) {
+				return false
+			}
+			time.Sleep(time.Millisecond)
+		}
+		return true
+	}
+
+	// Fox never gets far ahead of Owl, who must not fall behind for Sloth
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		filler := strings.Repeat("x", size)
+		for i := 1; i <= messages; i++ {
+			if _, err := fmt.Fprintf(fox, "SEND|%s\n", filler); err != nil {
+				return
+			}
+			if i%100 == 0 && !waitFor(func() bool { return heard.Load() > int64(i-100) }) {
+				return
+			}
+		}
+	}()
+
+	left := waitFor(slothLeft.Load)
+	// reading at last, Sloth gets what was queued, then why he was dropped
+	slothLines, slothClosed := readUntilClosed(sloth, slothReader, time.Now().Add(5*time.Second))
+	told := len(slothLines) > 0 && slothLines[len(slothLines)-1] == "ERR|408|too-slow|too slow"
+	<-sent
+	heardAll := waitFor(func() bool { return heard.Load() == messages })
+
+	if left && slothClosed && told && heardAll {
+		return
+	}
+	t.Errorf("slothLeft=%v slothClosed=%v told=%v owl heard %d of %d",
+		left, slothClosed, told, heard.Load(), messages)
+	if n := len(slothLines); n > 0 {
+		t.Logf("Sloth read %d lines, the last %.80q", n, slothLines[n-1])
+	}
+}
+
+func testWriteTimeout(t *testing.T) {
+	// few enough lines to fit Stan's queue, big enough to fill his socket
+	const messages, size = 150, 60000
+	const writeTimeout = time.Second
+	server, err := startAltServer(
+		"CHAT_PING_INTERVAL=0",
+		"CHAT_SESSION_GRACE=0",
+		fmt.Sprintf("CHAT_WRITE_TIMEOUT=%dms", writeTimeout.Milliseconds()),
+		fmt.Sprintf("CHAT_MAX_MSG_LEN=%d", size+100),
+		fmt.Sprintf("CHAT_RATE_LIMIT=%d", messages),
+		fmt.Sprintf("CHAT_RATE_BURST=%d", messages),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stopServer(server)
+
+	// Stan never reads, and offers a small window from the start
+	dialer := net.Dialer{
+		Timeout: 2 * time.Second,
+		Control: func(_, _ string, c syscall.RawConn) error {
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF, 4096)
+			})
+			if err != nil {
+				return err
+			}
+			return sockErr
+		},
+	}
+	stan, err := dialer.Dial("tcp", net.JoinHostPort(testHost, altPort))
+	if err != nil {
+		t.Fatalf("Stan could not connect: %v", err)
+	}
+	defer stan.Close()
+	fmt.Fprintln(stan, "JOIN|stan")
+
+	sam, samReader, err := dialAndJoin(altPort, "sam")
+	if err != nil {
+		t.Fatalf("Sam could not join: %v", err)
+	}
+	defer sam.Close()
+
+	// Sam hears his own lines and must keep up with them
+	stanLeft := make(chan time.Time, 1)
+	_ = sam.SetReadDeadline(time.Time{})
+	go func() {
+		for {
+			line, err := samReader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if strings.HasSuffix(line, "|stan|#general|disconnected\n") {
+				stanLeft <- time.Now()
+				return
+			}
+		}
+	}()
+
+	filler := strings.Repeat("x", size)
+	for i := 0; i < messages; i++ {
+		if _, err := fmt.Fprintf(sam, "SEND|%s\n", filler); err != nil {
+			t.Fatalf("Sam could not send: %v", err)
+		}
+	}
+	sent := time.Now()
+
+	select {
+	case left := <-stanLeft:
+		t.Logf("Stan dropped %v after the last line was sent", left.Sub(sent).Round(time.Millisecond))
+	case <-time.After(writeTimeout + 10*time.Second):
+		t.Errorf("Stan was not dropped within %v of the last line", writeTimeout+10*time.Second)
+	}
+}
+
+func testRoomHistorySizes(t *testing.T) {
+	server, err := startAltServer("CHAT_HISTORY_SIZE=1", "CHAT_ROOM_HISTORY_SIZES=#dev=3,quiet=0", "CHAT_PING_INTERVAL=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stopServer(server)
+
+	// each room keeps someone in it, or its history would go
+	said := map[string][]string{
+		"gus": {"SEND|g1", "SEND|g2"},
+		"hal": {"ROOM|#dev", "SEND|d1", "SEND|d2", "SEND|d3", "SEND|d4"},
+		"ida": {"ROOM|#quiet", "SEND|q1"},
+	}
+	var hal net.Conn
+	var halReader *bufio.Reader
+	for _, name := range []string{"gus", "hal", "ida"} {
+		conn, reader, err := dialAndJoin(altPort, name)
+		if err != nil {
+			t.Fatalf("%s could not join: %v", name, err)
+		}
+		defer conn.Close()
+		if name == "hal" {
+			hal, halReader = conn, reader
+		}
+		for _, line := range said[name] {
+			fmt.Fprintln(conn, line)
+		}
+		handled(conn, reader)
+	}
+
+	newcomer, reader, err := dialAndJoin(altPort, "jay")
+	if err != nil {
+		t.Fatalf("Jay could not join: %v", err)
+	}
+	defer newcomer.Close()
+	replayed := func(command string) []string {
+		if command != "" {
+			fmt.Fprintln(newcomer, command)
+		}
+		var texts []string
+		for _, line := range handled(newcomer, reader) {
+			if strings.HasPrefix(line, "HISTORY|BROADCAST|") {
+				texts = append(texts, line[strings.LastIndex(line, "|")+1:])
+			}
+		}
+		return texts
+	}
+	general := replayed("")
+	dev := replayed("ROOM|#dev")
+	quiet := replayed("ROOM|#quiet")
+	// once Hal and Jay are gone #dev is empty, and starts over
+	fmt.Fprintln(hal, "ROOM|#general")
+	handled(hal, halReader)
+	emptied := replayed("ROOM|#dev")
+
+	if slices.Equal(general, []string{"g2"}) && slices.Equal(dev, []string{"d2", "d3", "d4"}) &&
+		len(quiet) == 0 && len(emptied) == 0 {
+		return
+	}
+	t.Errorf("replayed in #general %q, #dev %q, #quiet %q, #dev again %q", general, dev, quiet, emptied)
+}
+
+func testUnixSocket(t *testing.T) {
+	// the server must leave this port alone
+	port := freePort(t)
+	socket := filepath.Join(t.TempDir(), "chat.sock")
+	env := []string{"CHAT_LISTEN=unix:" + socket, "CHAT_PORT=" + port, "CHAT_PING_INTERVAL=0"}
+	server, err := startAltServer(env...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// killed, it leaves the socket file behind for the next server to replace
+	stopServer(server)
+	server, err = startAltServer(env...)
+	if err != nil {
+		t.Fatalf("a stale socket file stopped the next server: %v", err)
+	}
+	defer stopServer(server)
+
+	conn, reader, err := dialAndSendOn("unix", socket, "JOIN|ursa")
+	if err != nil {
+		t.Fatalf("Ursa could not join: %v", err)
+	}
+	defer conn.Close()
+	handled(conn, reader)
+
+	output, err := createTempFile()
+	if err != nil {
+		t.Fatal("failed to create temp file")
+	}
+	inputs := []string{"send hello over a socket", "leave"}
+	if _, err := runClientWithInputOn(port, "umar", inputs, output, 3*time.Second, "--unix", socket); err != nil {
+		t.Fatalf("client failed: %v", err)
+	}
+	ursaLines, _ := readUntilClosed(conn, reader, time.Now().Add(messageReceiveDelay))
+	received := slices.ContainsFunc(ursaLines, func(line string) bool {
+		return strings.HasPrefix(line, "BROADCAST|") && strings.HasSuffix(line, "|umar|hello over a socket")
+	})
+
+	// nothing listens on TCP meanwhile
+	tcp, tcpErr := net.DialTimeout("tcp", net.JoinHostPort(testHost, port), time.Second)
+	if tcpErr == nil {
+		tcp.Close()
+	}
+
+	if received && tcpErr != nil {
+		return
+	}
+	t.Errorf("received=%v tcpRefused=%v\nUrsa's lines: %q", received, tcpErr != nil, ursaLines)
+	t.Log("Umar's output:")
+	t.Log(readFileContent(output))
+}
+
+func testIPv6(t *testing.T) {
+	probe, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("no IPv6 loopback: %v", err)
+	}
+	probe.Close()
+
+	server, err := startAltServer("CHAT_HOST=[::1]", "CHAT_PING_INTERVAL=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stopServer(server)
+
+	conn, reader, err := dialAndSendOn("tcp", net.JoinHostPort("::1", altPort), "JOIN|ivy")
+	if err != nil {
+		t.Fatalf("Ivy could not join: %v", err)
+	}
+	defer conn.Close()
+	handled(conn, reader)
+
+	output, err := createTempFile()
+	if err != nil {
+		t.Fatal("failed to create temp file")
+	}
+	inputs := []string{"send hello over ipv6", "leave"}
+	if _, err := runClientWithInputAt("::1", altPort, "igor", inputs, output, 3*time.Second); err != nil {
+		t.Fatalf("client failed: %v", err)
+	}
+	ivyLines, _ := readUntilClosed(conn, reader, time.Now().Add(messageReceiveDelay))
+	received := slices.ContainsFunc(ivyLines, func(line string) bool {
+		return strings.HasPrefix(line, "BROADCAST|") && strings.HasSuffix(line, "|igor|hello over ipv6")
+	})
+	if received {
+		return
+	}
+	t.Errorf("Ivy did not hear Igor\nIvy's lines: %q", ivyLines)
+	t.Log("Igor's output:")
+	t.Log(readFileContent(output))
+}
+
+func testStats(t *testing.T) {
+	const token = "opsecret"
+	server, err := startAltServer("CHAT_ADMIN_TOKEN="+token, "CHAT_PING_INTERVAL=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stopServer(server)
+
+	oscar, oscarReader, err := dialAndJoin(altPort, "oscar")
+	if err != nil {
+		t.Fatalf("oscar could not join: %v", err)
+	}
+	defer oscar.Close()
+	pat, patReader, err := dialAndJoin(altPort, "pat")
+	if err != nil {
+		t.Fatalf("pat could not join: %v", err)
+	}
+	defer pat.Close()
+
+	fmt.Fprintln(pat, "STATS")
+	patLines := handled(pat, patReader)
+	fmt.Fprintf(oscar, "SEND|hello\nAUTH|%s\nSTATS\n", token)
+	oscarLines := readThrough(oscar, oscarReader, "INFO|Memory: ")
+	// anything meant for oscar alone would have reached pat by now
+	patLines = append(patLines, handled(pat, patReader)...)
+
+	refused := slices.Contains(patLines, "ERR|403|not-authorized|not authorized")
+	uptime := regexp.MustCompile(`^INFO\|Uptime: \d+s$`)
+	reported := slices.ContainsFunc(oscarLines, uptime.MatchString) &&
+		slices.Contains(oscarLines, "INFO|Connections served: 2") &&
+		slices.Contains(oscarLines, "INFO|Clients online: 2") &&
+		slices.Contains(oscarLines, "INFO|Messages broadcast: 1")
+	private := !slices.ContainsFunc(patLines, func(line string) bool {
+		return strings.HasPrefix(line, "INFO|Uptime: ")
+	})
+
+	if refused && reported && private {
+		return
+	}
+
+	t.Errorf("refused=%v reported=%v private=%v", refused, reported, private)
+	t.Log("Oscar's output:")
+	t.Log(strings.Join(oscarLines, "\n"))
+	t.Log("Pat's output:")
+	t.Log(strings.Join(patLines, "\n"))
+}
+
+func testHelp(t *testing.T) {
+	const token = "opsecret"
+	server, err := startAltServer("CHAT_ADMIN_TOKEN="+token, "CHAT_PING_INTERVAL=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stopServer(server)
+
+	hugo, hugoReader, err := dialAndJoin(altPort, "hugo")
+	if err != nil {
+		t.Fatalf("hugo could not join: %v", err)
+	}
+	defer hugo.Close()
+	iris, irisReader, err := dialAndJoin(altPort, "iris")
+	if err != nil {
+		t.Fatalf("iris could not join: %v", err)
+	}
+	defer iris.Close()
+
+	fmt.Fprintln(iris, "HELP")
+	irisLines := handled(iris, irisReader)
+	fmt.Fprintf(hugo, "AUTH|%s\nHELP\n", token)
+	hugoLines := handled(hugo, hugoReader)
+	// anything meant for hugo alone would have reached iris by now
+	irisLines = append(irisLines, handled(iris, irisReader)...)
+
+	lists := func(lines []string, command string) bool {
+		return slices.ContainsFunc(lines, func(line string) bool {
+			return strings.HasPrefix(line, "INFO|  "+command+" - ")
+		})
+	}
+	listed := lists(irisLines, "send <message>") && lists(irisLines, "join #room") &&
+		lists(irisLines, "dm <username> <message>") && lists(irisLines, "help")
+	canAuth := lists(irisLines, "auth <token>") && !lists(irisLines, "kick <username>")
+	operator := lists(hugoLines, "kick <username>") && lists(hugoLines, "stats") && !lists(hugoLines, "auth <token>")
+	private := strings.Count(strings.Join(irisLines, "\n"), "INFO|Commands") == 1
+
+	if listed && canAuth && operator && private {
+		return
+	}
+
+	t.Errorf("listed=%v canAuth=%v operator=%v private=%v", listed, canAuth, operator, private)
+	t.Log("Iris's output:")
+	t.Log(strings.Join(irisLines, "\n"))
+	t.Log("Hugo's output:")
+	t.Log(strings.Join(hugoLines, "\n"))
+}
+
+func testSQLiteStore(t *testing.T) {
+	const token = "opsecret"
+	env := []string{
+		"CHAT_STORE=sqlite:" + filepath.Join(t.TempDir(), "chat.db"),
+		"CHAT_ADMIN_TOKEN=" + token,
+		"CHAT_PING_INTERVAL=0",
+	}
+	server, err := startAltServer(env...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oscar, oscarReader, err := dialAndJoin(altPort, "oscar")
+	if err != nil {
+		stopServer(server)
+		t.Fatalf("oscar could not join: %v", err)
+	}
+	fmt.Fprintf(oscar, "AUTH|%s\nBAN|trent\nSEND|remember me\n", token)
+	oscarLines := handled(oscar, oscarReader)
+	// the room empties before the restart; its history stays in the database
+	oscar.Close()
+	stopServer(server)
+
+	server, err = startAltServer(env...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stopServer(server)
+	trent, _, err := dialAndJoin(altPort, "trent")
+	if err == nil {
+		trent.Close()
+	}
+	banned := err != nil && strings.Contains(err.Error(), "ERR|403|banned|you are banned")
+	zed, zedReader, err := dialAndJoin(altPort, "zed")
+	if err != nil {
+		t.Fatalf("zed could not join: %v", err)
+	}
+	defer zed.Close()
+	zedLines := handled(zed, zedReader)
+	replayed := slices.ContainsFunc(zedLines, func(line string) bool {
+		return strings.HasPrefix(line, "HISTORY|") && strings.HasSuffix(line, "|remember me")
+	})
+
+	if banned && replayed {
+		return
+	}
+
+	t.Errorf("banned=%v replayed=%v", banned, replayed)
+	t.Log("Oscar's output:")
+	t.Log(strings.Join(oscarLines, "\n"))
+	t.Log("Zed's output:")
+	t.Log(strings.Join(zedLines, "\n"))
+}
+
+func testWhoAll(t *testing.T) {
+	const token = "opsecret"
+	server, err := startAltServer("CHAT_ADMIN_TOKEN="+token, "CHAT_PING_INTERVAL=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stopServer(server)
+
+	conns := make(map[string]net.Conn)
+	readers := make(map[string]*bufio.Reader)
+	for _, name := range []string{"olga", "pete", "quin"} {
+		conn, reader, err := dialAndJoin(altPort, name)
+		if err != nil {
+			t.Fatalf("%s could not join: %v", name, err)
+		}
+		defer conn.Close()
+		conns[name], readers[name] = conn, reader
+	}
+	fmt.Fprintln(conns["quin"], "ROOM|#dev")
+	handled(conns["quin"], readers["quin"])
+
+	fmt.Fprintln(conns["pete"], "WHO\nWHOALL")
+	peteLines := handled(conns["pete"], readers["pete"])
+	fmt.Fprintf(conns["olga"], "AUTH|%s\nWHOALL\n", token)
+	olgaLines := handled(conns["olga"], readers["olga"])
+
+	roomOnly := slices.Contains(peteLines, "INFO|Online in #general (2): olga, pete")
+	refused := slices.Contains(peteLines, "ERR|403|not-authorized|not authorized")
+	grouped := slices.Contains(olgaLines, "INFO|Online everywhere (3), by room:") &&
+		slices.Contains(olgaLines, "INFO|  #dev (1): quin") &&
+		slices.Contains(olgaLines, "INFO|  #general (2): olga, pete")
+
+	if roomOnly && refused && grouped {
+		return
+	}
+
+	t.Errorf("roomOnly=%v refused=%v grouped=%v", roomOnly, refused, grouped)
+	t.Log("Pete's output:")
+	t.Log(strings.Join(peteLines, "\n"))
+	t.Log("Olga's output:")
+	t.Log(strings.Join(olgaLines, "\n"))
+}
+
+func testBroadcast(t *testing.T) {
+	const token = "opsecret"
+	server, err := startAltServer(
+		"CHAT_ADMIN_TOKEN="+token,
+		"CHAT_PING_INTERVAL=0",
+		"CHAT_RATE_LIMIT=1",
+		"CHAT_RATE_BURST=1",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stopServer(server)
+
+	opal, opalReader, err := dialAndJoin(altPort, "opal")
+	if err != nil {
+		t.Fatalf("opal could not join: %v", err)
+	}
+	defer opal.Close()
+	quinn, quinnReader, err := dialAndJoin(altPort, "quinn")
+	if err != nil {
+		t.Fatalf("quinn could not join: %v", err)
+	}
+	defer quinn.Close()
+
+	fmt.Fprintln(quinn, "ROOM|#elsewhere")
+	fmt.Fprintln(quinn, "BROADCAST|not from me")
+	quinnLines := handled(quinn, quinnReader)
+
+	// the send uses up opal's only token, which the announcements don't need
+	fmt.Fprintf(opal, "AUTH|%s\nSEND|hi\nBROADCAST|down at 5\nBROADCAST|really, at 5\n", token)
+	opalLines := readThrough(opal, opalReader, "|really, at 5")
+	quinnLines = append(quinnLines, readThrough(quinn, quinnReader, "|really, at 5")...)
+
+	refused := slices.Contains(quinnLines, "ERR|403|not-authorized|not authorized")
+	announced := slices.ContainsFunc(quinnLines, func(line string) bool {
+		return strings.HasPrefix(line, "ANNOUNCE|") && strings.HasSuffix(line, "|down at 5")
+	})
+	unlimited := !slices.ContainsFunc(opalLines, func(line string) bool {
+		return strings.HasPrefix(line, "ERR|")
+	})
+	spoofed := slices.ContainsFunc(quinnLines, func(line string) bool {
+		return strings.Contains(line, "not from me")
+	})
+
+	if refused && announced && unlimited && !spoofed {
+		return
+	}
+
+	t.Errorf("refused=%v announced=%v unlimited=%v spoofed=%v", refused, announced, unlimited, spoofed)
+	t.Log("Opal's output:")
+	t.Log(strings.Join(opalLines, "\n"))
+	t.Log("Quinn's output:")
+	t.Log(strings.Join(quinnLines, "\n"))
+}
+
+func testNotify(t *testing.T) {
+	server, err := startAltServer("CHAT_NOTIFY=leave", "CHAT_PING_INTERVAL=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stopServer(server)
+
+	vera, veraReader, err := dialAndJoin(altPort, "vera")
+	if err != nil {
+		t.Fatalf("vera could not join: %v", err)
+	}
+	defer vera.Close()
+	walt, waltReader, err := dialAndJoin(altPort, "walt")
+	if err != nil {
+		t.Fatalf("walt could not join: %v", err)
+	}
+	defer walt.Close()
+
+	// out of vera's room and back, then gone
+	fmt.Fprintln(walt, "ROOM|#side")
+	fmt.Fprintln(walt, "ROOM|#general")
+	handled(walt, waltReader)
+	fmt.Fprintln(walt, "LEAVE")
+	readThrough(walt, waltReader, "GOODBYE")
+	lines := handled(vera, veraReader)
+
+	count := func(prefix string) int {
+		n := 0
+		for _, line := range lines {
+			if strings.HasPrefix(line, prefix) && strings.Contains(line, "|walt|") {
+				n++
+			}
+		}
+		return n
+	}
+	joins, leaves := count("JOINED|"), count("LEFT|")
+
+	if joins == 0 && leaves == 2 {
+		return
+	}
+
+	t.Errorf("joins=%d leaves=%d, want 0 and 2", joins, leaves)
+	t.Log("Vera's output:")
+	t.Log(strings.Join(lines, "\n"))
+}
+
+func testReload(t *testing.T) {
+	configFile, err := createTempFile()
+	if err != nil {
+		t.Fatal("failed to create config file")
+	}
+	filterFile, err := createTempFile()
+	if err != nil {
+		t.Fatal("failed to create filter file")
+	}
+	write := func(config, words string) {
+		if err := os.WriteFile(configFile, []byte(config), 0o600); err != nil {
+			t.Fatalf("failed to write config file: %v", err)
+		}
+		if err := os.WriteFile(filterFile, []byte(words), 0o600); err != nil {
+			t.Fatalf("failed to write filter file: %v", err)
+		}
+	}
+	write("max_clients: 2\nmotd: Before.\n", "darn\n")
+	server, err := startServerWith([]string{"--config", configFile},
+		"CHAT_HOST="+testHost, "CHAT_PORT="+altPort, "CHAT_FILTER_FILE="+filterFile,
+		"CHAT_PING_INTERVAL=0", "CHAT_SESSION_GRACE=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stopServer(server)
+
+	carl, carlReader, err := dialAndJoin(altPort, "carl")
+	if err != nil {
+		t.Fatalf("carl could not join: %v", err)
+	}
+	defer carl.Close()
+	carlLines := handled(carl, carlReader)
+	before := slices.Contains(carlLines, "INFO|Before.")
+
+	// max_clients needs a restart, so the cap of 2 still holds afterwards
+	write("max_clients: 1\nmotd: After.\nreserved_names: [dan]\n", "heck\n")
+	if err := server.Process.Signal(syscall.SIGHUP); err != nil {
+		t.Fatalf("failed to send SIGHUP: %v", err)
+	}
+	// the reload is done once a newcomer gets the new MOTD
+	var probeLines []string
+	for deadline := time.Now().Add(responseTimeout); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		probe, probeReader, err := dialAndJoin(altPort, "erin")
+		if err != nil {
+			continue
+		}
+		probeLines = handled(probe, probeReader)
+		fmt.Fprintln(probe, "LEAVE")
+		_, _ = readUntilClosed(probe, probeReader, time.Now().Add(messageReceiveDelay))
+		probe.Close()
+		if slices.Contains(probeLines, "INFO|After.") {
+			break
+		}
+	}
+	motd := slices.Contains(probeLines, "INFO|After.") && !slices.Contains(probeLines, "INFO|Before.")
+
+	_, _, err = dialAndJoin(altPort, "dan")
+	reserved := err != nil && strings.Contains(err.Error(), "username reserved")
+	frank, _, err := dialAndJoin(altPort, "frank")
+	uncapped := err == nil
+	if uncapped {
+		defer frank.Close()
+		fmt.Fprintln(frank, "SEND|darn heck")
+	}
+
+	// carl stayed joined through it all, and sees frank's line by the new list
+	carlLines, carlClosed := readUntilClosed(carl, carlReader, time.Now().Add(messageReceiveDelay))
+	filtered := slices.ContainsFunc(carlLines, func(line string) bool {
+		return strings.HasSuffix(line, "|frank|darn ****")
+	})
+	kept := !carlClosed
+
+	if before && motd && reserved && uncapped && filtered && kept {
+		return
+	}
+
+	t.Errorf("before=%v motd=%v reserved=%v uncapped=%v filtered=%v kept=%v",
+		before, motd, reserved, uncapped, filtered, kept)
+	t.Logf("Probe's lines: %q\nCarl's lines: %q", probeLines, carlLines)
+}
+
+func testRoomPolicies(t *testing.T) {
+	const token = "opsecret"
+	server, err := startAltServer(
+		"CHAT_ADMIN_TOKEN="+token,
+		"CHAT_ROOM_POLICIES=#long len=4000",
+		"CHAT_PING_INTERVAL=0",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stopServer(server)
+
+	rosa, rosaReader, err := dialAndJoin(altPort, "rosa")
+	if err != nil {
+		t.Fatalf("rosa could not join: %v", err)
+	}
+	defer rosa.Close()
+	long := strings.Repeat("x", 3000)
+
+	fmt.Fprintf(rosa, "SEND|%s\n", long)
+	fmt.Fprintln(rosa, "ROOMPOLICY|#long|len=10")
+	fmt.Fprintln(rosa, "ROOM|#long")
+	fmt.Fprintf(rosa, "SEND|%s\n", long)
+	fmt.Fprintf(rosa, "AUTH|%s\n", token)
+	fmt.Fprintln(rosa, "ROOMPOLICY|#short|len=10")
+	fmt.Fprintln(rosa, "ROOM|#short")
+	fmt.Fprintln(rosa, "SEND|far too long for here")
+	lines := handled(rosa, rosaReader)
+
+	// the long line goes through in #long alone, and only the operator sets #short
+	var errs []string
+	for _, line := range lines {
+		if strings.HasPrefix(line, "ERR|") {
+			errs = append(errs, line)
+		}
+	}
+	wantErrs := []string{
+		fmt.Sprintf("ERR|413|message-too-long|message too long (max %d)", maxMsgLen),
+		"ERR|403|not-authorized|not authorized",
+		"ERR|413|message-too-long|message too long (max 10)",
+	}
+	set := slices.Contains(lines, fmt.Sprintf("INFO|#short: 5 messages a second, bursts of %d, up to 10 characters", rateBurst))
+
+	if slices.Equal(errs, wantErrs) && set {
+		return
+	}
+
+	t.Errorf("errors=%q set=%v", errs, set)
+	t.Log(strings.Join(lines, "\n"))
+}
+
+func testFileSharing(t *testing.T) {
+	// no cooldown, so vera can come straight back under her name
+	server, err := startAltServer("CHAT_MAX_FILE_SIZE=10", "CHAT_FILE_QUOTA=15", "CHAT_PING_INTERVAL=0",
+		"CHAT_NAME_COOLDOWN=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stopServer(server)
+
+	tim, timReader, err := dialAndJoin(altPort, "tim")
+	if err != nil {
+		t.Fatalf("tim could not join: %v", err)
+	}
+	defer tim.Close()
+	encode := func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+
+	// the client shares a file under its own name, without the directory
+	path, err := createTempFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("hello"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	output, err := createTempFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	scriptErr := runClientScript(altPort, "uma", []string{"sendfile " + path, "sleep 200"}, output, 10*time.Second)
+	shared := fmt.Sprintf("|uma|%s|5|%s", filepath.Base(path), encode("hello"))
+	timLines := handled(tim, timReader)
+	relayed := slices.ContainsFunc(timLines, func(line string) bool {
+		return strings.HasPrefix(line, "FILE|") && strings.HasSuffix(line, shared)
+	})
+
+	vera, veraReader, err := dialAndJoin(altPort, "vera")
+	if err != nil {
+		t.Fatalf("vera could not join: %v", err)
+	}
+	defer vera.Close()
+	fmt.Fprintf(vera, "FILE|big.bin|%s\n", encode("01234567890"))
+	fmt.Fprintf(vera, "FILE|../x|%s\n", encode("x"))
+	fmt.Fprintf(vera, "FILE|a.txt|%s\n", encode("0123456789"))
+	fmt.Fprintf(vera, "FILE|b.txt|%s\n", encode("01234"))
+	fmt.Fprintf(vera, "FILE|c.txt|%s\n", encode("x"))
+	lines := handled(vera, veraReader)
+
+	// the quota is hers, not her connection's, so coming back doesn't renew it
+	fmt.Fprintln(vera, "LEAVE")
+	readUntilClosed(vera, veraReader, time.Now().Add(responseTimeout))
+	vera, veraReader, err = dialAndJoin(altPort, "vera")
+	if err != nil {
+		t.Fatalf("vera could not join again: %v", err)
+	}
+	defer vera.Close()
+	fmt.Fprintf(vera, "FILE|d.txt|%s\n", encode("x"))
+	lines = append(lines, handled(vera, veraReader)...)
+
+	// the quota counts what went through, and nothing refused reaches the room
+	var errs, files []string
+	for _, line := range lines {
+		if strings.HasPrefix(line, "ERR|") {
+			errs = append(errs, line)
+		}
+		if fields := strings.Split(line, "|"); len(fields) == 6 && fields[0] == "FILE" {
+			files = append(files, fields[3])
+		}
+	}
+	wantErrs := []string{
+		"ERR|413|file-too-large|file too large (max 10)",
+		"ERR|400|bad-request|invalid file name",
+		"ERR|429|quota-exceeded|file quota exceeded (0 of 15 bytes left)",
+		"ERR|429|quota-exceeded|file quota exceeded (0 of 15 bytes left)",
+	}
+
+	if scriptErr == nil && relayed && slices.Equal(errs, wantErrs) && slices.Equal(files, []string{"a.txt", "b.txt"}) {
+		return
+	}
+
+	t.Errorf("script=%v relayed=%v errors=%q files=%q", scriptErr, relayed, errs, files)
+	t.Log(strings.Join(timLines, "\n"))
+	t.Log(readFileContent(output))
+}
+
+func testRacingJoins(t *testing.T) {
+	const racers = 50
+	server, err := startAltServer("CHAT_PING_INTERVAL=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stopServer(server)
+
+	// everyone connects first, so the joins go out as close together as they can
+	conns := make([]net.Conn, 0, racers)
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+	for len(conns) < racers {
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort(testHost, altPort), 2*time.Second)
+		if err != nil {
+			t.Fatalf("racer %d could not connect: %v", len(conns), err)
+		}
+		conns = append(conns, conn)
+	}
+
+	start := make(chan struct{})
+	replies := make([]string, racers)
+	var wg sync.WaitGroup
+	for i, conn := range conns {
+		i, conn := i, conn
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			fmt.Fprintln(conn, "JOIN|racer")
+			reader := bufio.NewReader(conn)
+			_ = conn.SetReadDeadline(time.Now().Add(responseTimeout))
+			for {
+				line, err := reader.ReadString('\n')
+				line = strings.TrimSpace(line)
+				if line == "OK" || strings.HasPrefix(line, "ERR|") {
+					replies[i] = line
+					return
+				}
+				if err != nil {
+					replies[i] = "no answer: " + err.Error()
+					return
+				}
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	// exactly one gets the name; every other is told it is taken, never busy
+	counts := map[string]int{}
+	for _, reply := range replies {
+		counts[reply]++
+	}
+	taken := "ERR|409|name-taken|username 'racer' is already taken"
+	if counts["OK"] == 1 && counts[taken] == racers-1 {
+		return
+	}
+
+	t.Errorf("replies=%v", counts)
+}
+
+func testLineTooLong(t *testing.T) {
+	// without files, the longest line is the longest message plus 1024
+	const maxLen = 100
+	server, err := startAltServer("CHAT_MAX_FILE_SIZE=0", fmt.Sprintf("CHAT_MAX_MSG_LEN=%d", maxLen), "CHAT_PING_INTERVAL=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stopServer(server)
+	tooLong := fmt.Sprintf("ERR|413|line-too-long|line too long (max %d)", maxLen+1024)
+
+	watcher, watcherReader, err := dialAndJoin(altPort, "watcher")
+	if err != nil {
+		t.Fatalf("watcher could not join: %v", err)
+	}
+	defer watcher.Close()
+	hog, hogReader, err := dialAndJoin(altPort, "hog")
+	if err != nil {
+		t.Fatalf("hog could not join: %v", err)
+	}
+	defer hog.Close()
+
+	// a message over the limit is only refused, a line past the buffer ends it
+	fmt.Fprintf(hog, "SEND|%s\n", strings.Repeat("x", maxLen+1))
+	fmt.Fprintf(hog, "SEND|%s\n", strings.Repeat("x", 2000))
+	hogLines, hogClosed := readUntilClosed(hog, hogReader, time.Now().Add(responseTimeout))
+	// the room hears of it through the dispatcher, however long that takes
+	watcherLines, disconnected := readUntil(watcher, watcherReader, "|hog|#general|disconnected")
+
+	// nor does a connection get to send one before it joins
+	stranger, strangerReader, err := dial(altPort)
+	if err != nil {
+		t.Fatalf("stranger could not connect: %v", err)
+	}
+	defer stranger.Close()
+	fmt.Fprintf(stranger, "JOIN|%s\n", strings.Repeat("x", 2000))
+	strangerLines, strangerClosed := readUntilClosed(stranger, strangerReader, time.Now().Add(responseTimeout))
+
+	refusedFirst := slices.Contains(hogLines, fmt.Sprintf("ERR|413|message-too-long|message too long (max %d)", maxLen))
+	hogDropped := hogClosed && len(hogLines) > 0 && hogLines[len(hogLines)-1] == tooLong
+	seenLeaving := disconnected &&
+		!slices.ContainsFunc(watcherLines, func(line string) bool { return strings.Contains(line, "xxx") })
+	strangerDropped := strangerClosed && slices.Contains(strangerLines, tooLong)
+
+	if refusedFirst && hogDropped && seenLeaving && strangerDropped {
+		return
+	}
+
+	t.Errorf("refusedFirst=%v hogDropped=%v seenLeaving=%v strangerDropped=%v",
+		refusedFirst, hogDropped, seenLeaving, strangerDropped)
+	t.Log(strings.Join(hogLines, "\n"))
+	t.Log(strings.Join(strangerLines, "\n"))
+}
+
+func testConnsAndDrop(t *testing.T) {
+	const token = "opsecret"
+	server, err := startAltServer("CHAT_ADMIN_TOKEN="+token, "CHAT_PING_INTERVAL=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stopServer(server)
+
+	ivy, ivyReader, err := dialAndJoin(altPort, "ivy")
+	if err != nil {
+		t.Fatalf("ivy could not join: %v", err)
+	}
+	defer ivy.Close()
+	jay, jayReader, err := dialAndJoin(altPort, "jay")
+	if err != nil {
+		t.Fatalf("jay could not join: %v", err)
+	}
+	defer jay.Close()
+	// connected but never joined, so only its address tells it apart
+	lurker, lurkerReader, err := dial(altPort)
+	if err != nil {
+		t.Fatalf("lurker could not connect: %v", err)
+	}
+	defer lurker.Close()
+	jayAddr, lurkerAddr := jay.LocalAddr().String(), lurker.LocalAddr().String()
+
+	fmt.Fprintf(jay, "CONNS\nDROP|%s\n", lurkerAddr)
+	jayLines := handled(jay, jayReader)
+	fmt.Fprintf(ivy, "AUTH|%s\nCONNS\n", token)
+	listing := handled(ivy, ivyReader)
+
+	fmt.Fprintf(ivy, "DROP|%s\nDROP|127.0.0.1:1\nDROP|nonsense\n", lurkerAddr)
+	dropLines := handled(ivy, ivyReader)
+	lurkerLines, lurkerClosed := readUntilClosed(lurker, lurkerReader, time.Now().Add(responseTimeout))
+	fmt.Fprintf(ivy, "DROP|%s\n", jayAddr)
+	jayLast, jayClosed := readUntilClosed(jay, jayReader, time.Now().Add(responseTimeout))
+	ivyLines, _ := readUntilClosed(ivy, ivyReader, time.Now().Add(messageReceiveDelay))
+
+	// one line per connection, in address order, with - for what the lurker lacks
+	var entries []string
+	for _, line := range listing {
+		if strings.HasPrefix(line, "INFO|  ") {
+			entries = append(entries, strings.TrimPrefix(line, "INFO|  "))
+		}
+	}
+	sorted := slices.IsSortedFunc(entries, func(a, b string) int {
+		return strings.Compare(sortKey(a), sortKey(b))
+	})
+	listed := slices.Contains(listing, "INFO|Open connections (3):") && len(entries) == 3 && sorted &&
+		slices.ContainsFunc(entries, func(e string) bool { return strings.HasPrefix(e, jayAddr+" jay #general connected ") }) &&
+		slices.ContainsFunc(entries, func(e string) bool { return strings.HasPrefix(e, lurkerAddr+" - - connected ") })
+	refused := slices.Equal(jayLines, []string{"ERR|403|not-authorized|not authorized", "ERR|403|not-authorized|not authorized"})
+	dropped := slices.Equal(dropLines, []string{
+		"INFO|Dropped " + lurkerAddr,
+		"ERR|404|no-such-connection|no connection from 127.0.0.1:1",
+		"ERR|400|bad-request|invalid address 'nonsense', expected ip:port",
+	}) && lurkerClosed && slices.Equal(lurkerLines, []string{"INFO|You were disconnected by an operator"})
+	jayDropped := jayClosed && slices.Contains(jayLast, "INFO|You were disconnected by an operator") &&
+		slices.ContainsFunc(ivyLines, func(line string) bool { return strings.HasSuffix(line, "|jay|#general|disconnected") })
+
+	if listed && refused && dropped && jayDropped {
+		return
+	}
+
+	t.Errorf("listed=%v refused=%v dropped=%v jayDropped=%v", listed, refused, dropped, jayDropped)
+	t.Log(strings.Join(listing, "\n"))
+	t.Log(strings.Join(dropLines, "\n"))
+	t.Log(strings.Join(lurkerLines, "\n"))
+}
+
+// sortKey orders a conns entry the way the server does, by address with
+// the port as a number.
+func sortKey(entry string) string {
+	addr, _, _ := strings.Cut(entry, " ")
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return entry
+	}
+	return fmt.Sprintf("%s %05s", host, port)
+}
+
+func testGracefulShutdown(t *testing.T) {
+	const grace = 1 * time.Second
+	server, err := startAltServer(fmt.Sprintf("CHAT_SHUTDOWN_GRACE=%dms", grace.Milliseconds()), "CHAT_PING_INTERVAL=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stopServer(server)
+
+	conn, reader, err := dialAndJoin(altPort, "wes")
+	if err != nil {
+		t.Fatalf("Wes could not join: %v", err)
+	}
+	defer conn.Close()
+
+	signalled := time.Now()
+	if err := server.Process.Signal(syscall.SIGTERM); err != nil {
+		t.Fatalf("failed to signal server: %v", err)
+	}
+	lines, closed := readUntilClosed(conn, reader, time.Now().Add(grace+3*time.Second))
+	closedAfter := time.Since(signalled)
+	warned := false
+	for _, line := range lines {
+		warned = warned || line == "SHUTDOWN|1"
+	}
+
+	exited := make(chan error, 1)
+	go func() { exited <- server.Wait() }()
+	var exitErr error
+	select {
+	case exitErr = <-exited:
+	case <-time.After(5 * time.Second):
+		exitErr = errors.New("server did not exit")
+	}
+
+	if warned && closed && closedAfter >= grace && exitErr == nil {
+		return
+	}
+
+	t.Errorf("warned=%v closed=%v after=%v exit=%v",
+		warned, closed, closedAfter, exitErr)
+	t.Log("Wes's output:")
+	t.Log(strings.Join(lines, "\n"))
+}
+
+func testTimestampFormat(t *testing.T) {
+	server, err := startAltServer("CHAT_TS_FORMAT=UnixMilli", "CHAT_PING_INTERVAL=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stopServer(server)
+
+	vera, veraReader, err := dialAndJoin(altPort, "vera")
+	if err != nil {
+		t.Fatalf("Vera could not join: %v", err)
+	}
+	defer vera.Close()
+	walt, waltReader, err := dialAndJoin(altPort, "walt")
+	if err != nil {
+		t.Fatalf("Walt could not join: %v", err)
+	}
+	defer walt.Close()
+	fmt.Fprintln(vera, "SEND|stamped")
+	handled(vera, veraReader)
+	lines := handled(walt, waltReader)
+
+	// milliseconds since the epoch, close to now
+	broadcast := regexp.MustCompile(`^BROADCAST\|(\d+)\|\d+\|vera\|stamped$`)
+	stamped := false
+	for _, line := range lines {
+		if match := broadcast.FindStringSubmatch(line); match != nil {
+			ms, err := strconv.ParseInt(match[1], 10, 64)
+			stamped = err == nil && time.Since(time.UnixMilli(ms)).Abs() < time.Minute
+		}
+	}
+
+	// a layout with nothing of the reference time in it stops startup
+	ctx, cancel := context.WithTimeout(context.Background(), startTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, serverBin)
+	cmd.Env = append(os.Environ(), "CHAT_HOST="+testHost, "CHAT_PORT=0", "CHAT_TS_FORMAT=yyyy-mm-dd")
+	output, err := cmd.CombinedOutput()
+	refused := err != nil && ctx.Err() == nil && strings.Contains(string(output), "invalid CHAT_TS_FORMAT")
+
+	if stamped && refused {
+		return
+	}
+
+	t.Errorf("stamped=%v refused=%v", stamped, refused)
+	t.Logf("Walt's lines: %q\nOutput of the misconfigured server: %s", lines, output)
+}
+
+func testNameCooldown(t *testing.T) {
+	cooldown := time.Second
+	server, err := startAltServer(fmt.Sprintf("CHAT_NAME_COOLDOWN=%dms", cooldown.Milliseconds()), "CHAT_PING_INTERVAL=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stopServer(server)
+
+	watcher, watcherReader, err := dialAndJoin(altPort, "rita")
+	if err != nil {
+		t.Fatalf("rita could not join: %v", err)
+	}
+	defer watcher.Close()
+
+	// leaveWithToken joins as vic, keeps the session token and leaves cleanly
+	leaveWithToken := func(conn net.Conn, reader *bufio.Reader) string {
+		line, _ := reader.ReadString('\n')
+		fields := strings.Split(strings.TrimSpace(line), "|")
+		fmt.Fprintln(conn, "LEAVE")
+		readUntilClosed(conn, reader, time.Now().Add(responseTimeout))
+		if len(fields) != 3 || fields[0] != "SESSION" {
+			return ""
+		}
+		return fields[1]
+	}
+	vic, vicReader, err := dialAndJoin(altPort, "vic")
+	if err != nil {
+		t.Fatalf("vic could not join: %v", err)
+	}
+	token := leaveWithToken(vic, vicReader)
+
+	// nobody may take the name straight away, in any case
+	_, _, err = dialAndJoin(altPort, "VIC")
+	cooling := err != nil && strings.Contains(err.Error(), "ERR|409|name-cooling-down|")
+
+	// but the session that gave it up can, joining afresh
+	var newToken string
+	back, backReader, err := dialAndRejoin(altPort, token)
+	reclaimed := err == nil
+	if reclaimed {
+		newToken = leaveWithToken(back, backReader)
+	}
+
+	// once the cooldown is over, the name is anyone's
+	time.Sleep(cooldown + messageReceiveDelay)
+	_, _, err = dialAndRejoin(altPort, newToken)
+	spent := err != nil && strings.Contains(err.Error(), "invalid or expired session")
+	taken, _, err := dialAndJoin(altPort, "vic")
+	free := err == nil
+	if free {
+		defer taken.Close()
+	}
+
+	watcherLines := handled(watcher, watcherReader)
+	joins := 0
+	for _, line := range watcherLines {
+		if strings.HasPrefix(line, "JOINED|") && strings.HasSuffix(line, "|vic|#general") {
+			joins++
+		}
+	}
+
+	if token != "" && cooling && reclaimed && newToken != "" && spent && free && joins == 3 {
+		return
+	}
+
+	t.Errorf("token=%q cooling=%v reclaimed=%v newToken=%q spent=%v free=%v joins=%d",
+		token, cooling, reclaimed, newToken, spent, free, joins)
+	t.Log("Rita's output:")
+	t.Log(strings.Join(watcherLines, "\n"))
+}
@@ -0,0 +1,584 @@
+package integration
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// freePort returns a port nothing listens on, as the OS would pick for port 0.
+func freePort(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", net.JoinHostPort(testHost, "0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	return port
+}
+
+// dialAndJoin opens a raw protocol connection and completes the JOIN handshake.
+func dialAndJoin(port, username string) (net.Conn, *bufio.Reader, error) {
+	return dialAndSend(port, "JOIN|"+username)
+}
+
+// dialAndRejoin resumes a session with the token a SESSION line carried.
+func dialAndRejoin(port, token string) (net.Conn, *bufio.Reader, error) {
+	return dialAndSend(port, "REJOIN|"+token)
+}
+
+// dialAndSend connects, sends one join-like command and reads up to its OK.
+func dialAndSend(port, command string) (net.Conn, *bufio.Reader, error) {
+	return dialAndSendOn("tcp", net.JoinHostPort(testHost, port), command)
+}
+
+// dialAndSendOn is dialAndSend for any network, e.g. "unix" and a socket path.
+func dialAndSendOn(network, address, command string) (net.Conn, *bufio.Reader, error) {
+	conn, reader, _, err := dialOn(network, address)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := fmt.Fprintf(conn, "%s\n", command); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+		if strings.HasPrefix(line, "OK") {
+			return conn, reader, nil
+		}
+		if strings.HasPrefix(line, "ERR") {
+			conn.Close()
+			return nil, nil, fmt.Errorf("join rejected: %s", strings.TrimSpace(line))
+		}
+	}
+}
+
+// dial connects without joining and reads the HELLO line the server greets
+// every connection with, so what is read next answers what the test sends.
+func dial(port string) (net.Conn, *bufio.Reader, error) {
+	conn, reader, _, err := dialOn("tcp", net.JoinHostPort(testHost, port))
+	return conn, reader, err
+}
+
+// dialOn is dial for any network, also returning the HELLO line.
+func dialOn(network, address string) (net.Conn, *bufio.Reader, string, error) {
+	conn, err := net.DialTimeout(network, address, 2*time.Second)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	reader := bufio.NewReader(conn)
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	hello, err := reader.ReadString('\n')
+	if err != nil || !strings.HasPrefix(hello, "HELLO|") {
+		conn.Close()
+		return nil, nil, "", fmt.Errorf("no HELLO on connecting: %q %v", hello, err)
+	}
+	return conn, reader, strings.TrimSpace(hello), nil
+}
+
+// withoutSession drops the SESSION line that follows a successful join.
+func withoutSession(lines []string) []string {
+	if len(lines) > 0 && strings.HasPrefix(lines[0], "SESSION|") {
+		return lines[1:]
+	}
+	return lines
+}
+
+// readUntilClosed collects lines until the server closes the connection or
+// the deadline passes, reporting which happened.
+func readUntilClosed(conn net.Conn, reader *bufio.Reader, deadline time.Time) ([]string, bool) {
+	_ = conn.SetReadDeadline(deadline)
+	var lines []string
+	for {
+		line, err := reader.ReadString('\n')
+		if line != "" {
+			lines = append(lines, strings.TrimSpace(line))
+		}
+		if err != nil {
+			return lines, errors.Is(err, io.EOF)
+		}
+	}
+}
+
+// handled pings the server over a raw connection and reads up to the PONG.
+// By then everything sent before has been dealt with, and whatever it sent
+// other connections is queued for them. It returns the lines read on the way.
+func handled(conn net.Conn, reader *bufio.Reader) []string {
+	fmt.Fprintln(conn, "PING|sync")
+	return readThrough(conn, reader, "PONG|sync")
+}
+
+// readThrough collects lines until one containing marker, which it drops,
+// or until responseTimeout passes.
+func readThrough(conn net.Conn, reader *bufio.Reader, marker string) []string {
+	_ = conn.SetReadDeadline(time.Now().Add(responseTimeout))
+	var lines []string
+	for {
+		line, err := reader.ReadString('\n')
+		if strings.Contains(line, marker) {
+			return lines
+		}
+		if line != "" {
+			lines = append(lines, strings.TrimSpace(line))
+		}
+		if err != nil {
+			return lines
+		}
+	}
+}
+
+// readUntil collects lines until one ending in suffix, which it keeps, or
+// until responseTimeout passes, reporting whether that line came.
+func readUntil(conn net.Conn, reader *bufio.Reader, suffix string) ([]string, bool) {
+	_ = conn.SetReadDeadline(time.Now().Add(responseTimeout))
+	var lines []string
+	for {
+		line, err := reader.ReadString('\n')
+		if line != "" {
+			lines = append(lines, strings.TrimSpace(line))
+			if strings.HasSuffix(strings.TrimSpace(line), suffix) {
+				return lines, true
+			}
+		}
+		if err != nil {
+			return lines, false
+		}
+	}
+}
+
+// clientOutput is what a client has printed so far, written to its output
+// file and kept in memory, so tests can wait for a line instead of sleeping.
+// As the client's stdout and stderr it is fed by exec, so the file is
+// complete once cmd.Wait returns.
+type clientOutput struct {
+	mu      sync.Mutex
+	file    *os.File
+	text    strings.Builder
+	exited  bool
+	changed chan struct{} // closed on every write and on exit
+}
+
+func (o *clientOutput) Write(p []byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.text.Write(p)
+	close(o.changed)
+	o.changed = make(chan struct{})
+	return o.file.Write(p)
+}
+
+// ReadFrom copies the client's output as it comes, until the client exits.
+func (o *clientOutput) ReadFrom(r io.Reader) (int64, error) {
+	defer o.exit()
+	buf := make([]byte, 4096)
+	var total int64
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if _, err := o.Write(buf[:n]); err != nil {
+				return total, err
+			}
+			total += int64(n)
+		}
+		if errors.Is(err, io.EOF) {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+}
+
+// exit records that the client is gone, so nobody waits on it any longer.
+func (o *clientOutput) exit() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if !o.exited {
+		o.exited = true
+		o.file.Close()
+		close(o.changed)
+	}
+}
+
+// waitFor reports whether marker showed up in the output before timeout
+// passed or the client exited without printing it.
+func (o *clientOutput) waitFor(marker string, timeout time.Duration) bool {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		o.mu.Lock()
+		found, exited, changed := strings.Contains(o.text.String(), marker), o.exited, o.changed
+		o.mu.Unlock()
+		if found || exited {
+			return found
+		}
+		select {
+		case <-changed:
+		case <-deadline.C:
+			return false
+		}
+	}
+}
+
+func newClientOutput(outputFile string) (*clientOutput, error) {
+	file, err := os.Create(outputFile)
+	if err != nil {
+		return nil, err
+	}
+	output := &clientOutput{file: file, changed: make(chan struct{})}
+	mu.Lock()
+	clientOutputs[outputFile] = output
+	mu.Unlock()
+	return output, nil
+}
+
+// waitForOutput waits up to timeout for marker in the output of the client
+// writing to outputFile.
+func waitForOutput(outputFile, marker string, timeout time.Duration) bool {
+	mu.Lock()
+	output := clientOutputs[outputFile]
+	mu.Unlock()
+	return output != nil && output.waitFor(marker, timeout)
+}
+
+// typeInput writes input lines to a joined client, acting on wait
+// directives; it stops early if an expected line never comes.
+func typeInput(stdin io.Writer, output *clientOutput, input []string) {
+	for _, line := range input {
+		if marker, ok := strings.CutPrefix(line, waitDirective); ok {
+			if !output.waitFor(marker, responseTimeout) {
+				return
+			}
+			continue
+		}
+		fmt.Fprintln(stdin, line)
+	}
+}
+
+func runClientWithInput(username string, input []string, outputFile string, duration time.Duration) (*exec.Cmd, error) {
+	return runClientWithInputOn(testPort, username, input, outputFile, duration)
+}
+
+// runClientWithInputOn is runClientWithInput against any port, with extra client flags.
+func runClientWithInputOn(port, username string, input []string, outputFile string, duration time.Duration,
+	extraArgs ...string) (*exec.Cmd, error) {
+	return runClientWithInputAt(testHost, port, username, input, outputFile, duration, extraArgs...)
+}
+
+// runClientWithInputAt is runClientWithInputOn against any host as well.
+func runClientWithInputAt(host, port, username string, input []string, outputFile string, duration time.Duration,
+	extraArgs ...string) (*exec.Cmd, error) {
+	cmd := exec.Command(clientBin, extraArgs...)
+	cmd.Env = clientEnv(host, port, username)
+
+	// Create output file
+	output, err := newClientOutput(outputFile)
+	if err != nil {
+		return nil, err
+	}
+	cmd.Stdout = output
+	cmd.Stderr = output
+
+	// Create stdin pipe
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		output.exit()
+		return nil, err
+	}
+
+	if err := cmd.Start(); err != nil {
+		output.exit()
+		return nil, err
+	}
+
+	mu.Lock()
+	clientCmds = append(clientCmds, cmd)
+	mu.Unlock()
+
+	// Type once joined; the client takes its time over each line itself
+	go func() {
+		defer stdin.Close()
+		if output.waitFor(joinedMarker, joinTimeout) {
+			typeInput(stdin, output, input)
+		}
+	}()
+
+	// Wait with timeout, a hard deadline for a client that hangs
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(duration):
+		_ = cmd.Process.Kill()
+		<-done
+	}
+
+	return cmd, nil
+}
+
+// clientEnv is the environment a client runs with: this process's own, with
+// where to connect and whom to join as in place of any CHAT_* it sets. A
+// flag in the client's arguments still wins over these.
+func clientEnv(host, port, username string) []string {
+	return append(os.Environ(), "CHAT_HOST="+host, "CHAT_PORT="+port, "CHAT_USERNAME="+username)
+}
+
+// runClientScript runs a client with --script over the given lines and
+// returns its exit error, nil if it exited cleanly. Its output goes to outputFile.
+func runClientScript(port, username string, script []string, outputFile string, duration time.Duration,
+	extraArgs ...string) error {
+	scriptFile, err := createTempFile()
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(scriptFile, []byte(strings.Join(script, "\n")+"\n"), 0o600); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), duration)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, clientBin, append([]string{"--script", scriptFile}, extraArgs...)...)
+	cmd.Env = clientEnv(testHost, port, username)
+	output, err := cmd.CombinedOutput()
+	if writeErr := os.WriteFile(outputFile, output, 0o600); writeErr != nil {
+		return writeErr
+	}
+	if ctx.Err() != nil {
+		return fmt.Errorf("client still running after %v", duration)
+	}
+	return err
+}
+
+// runClientBackground starts a client that stays connected until it is
+// killed, returning once it has joined, or failed to, and typing input after.
+func runClientBackground(username string, input []string, outputFile string) (*exec.Cmd, error) {
+	cmd := exec.Command(clientBin)
+	cmd.Env = clientEnv(testHost, testPort, username)
+
+	output, err := newClientOutput(outputFile)
+	if err != nil {
+		return nil, err
+	}
+	cmd.Stdout = output
+	cmd.Stderr = output
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		output.exit()
+		return nil, err
+	}
+
+	if err := cmd.Start(); err != nil {
+		output.exit()
+		return nil, err
+	}
+
+	mu.Lock()
+	clientCmds = append(clientCmds, cmd)
+	mu.Unlock()
+
+	if !output.waitFor(joinedMarker, joinTimeout) {
+		return cmd, nil
+	}
+	// stdin stays open so the client remains connected until it is killed
+	go typeInput(stdin, output, input)
+
+	return cmd, nil
+}
+
+func readFileContent(path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+func containsIgnoreCase(s, substr string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+}
+
+// joinedAs reports whether output has the line a client prints on joining as username.
+func joinedAs(output, username string) bool {
+	return slices.ContainsFunc(strings.Split(output, "\n"), func(line string) bool {
+		return strings.TrimSpace(line) == joinedMarker+username
+	})
+}
+
+// onlineListIncludes reports whether the "Online in #room (N): ..." line in output names every user.
+func onlineListIncludes(output string, users ...string) bool {
+	for _, line := range strings.Split(output, "\n") {
+		_, list, found := strings.Cut(line, "Online in #")
+		if !found {
+			continue
+		}
+		_, names, _ := strings.Cut(list, "): ")
+		online := make(map[string]bool)
+		for _, name := range strings.Split(names, ", ") {
+			online[strings.TrimSuffix(strings.TrimSpace(name), " (away)")] = true
+		}
+		for _, user := range users {
+			if !online[user] {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// writeSelfSignedCert writes a throwaway certificate and key for testHost as PEM files.
+func writeSelfSignedCert() (string, string, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: testHost},
+		IPAddresses:  []net.IP{net.ParseIP(testHost)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return "", "", err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return "", "", err
+	}
+
+	certPath, err := createTempFile()
+	if err != nil {
+		return "", "", err
+	}
+	keyPath, err := createTempFile()
+	if err != nil {
+		return "", "", err
+	}
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		return "", "", err
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		return "", "", err
+	}
+	return certPath, keyPath, nil
+}
+
+// jsonMessage is a server message in the JSON protocol.
+type jsonMessage struct {
+	Type  string   `json:"type"`
+	From  *string  `json:"from"`
+	Room  *string  `json:"room"`
+	TS    *string  `json:"ts"`
+	Text  *string  `json:"text"`
+	Color *string  `json:"color"`
+	Users []string `json:"users"`
+	// a broadcast's id, and the id of the line it replies to
+	ID      *string `json:"id"`
+	ReplyTo *string `json:"reply_to"`
+	// the number a chat line has in its room
+	Seq *uint64 `json:"seq"`
+	// an err's code, and the code's name
+	Code   int     `json:"code"`
+	Reason *string `json:"reason"`
+}
+
+// frame prefixes payload with its 4-byte big-endian length.
+func frame(payload string) []byte {
+	return append(binary.BigEndian.AppendUint32(nil, uint32(len(payload))), payload...)
+}
+
+// readFrames collects frames until the connection closes or the deadline passes.
+func readFrames(conn net.Conn, reader *bufio.Reader, deadline time.Time) []string {
+	_ = conn.SetReadDeadline(deadline)
+	var frames []string
+	for {
+		var header [4]byte
+		if _, err := io.ReadFull(reader, header[:]); err != nil {
+			return frames
+		}
+		payload := make([]byte, binary.BigEndian.Uint32(header[:]))
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			return frames
+		}
+		frames = append(frames, string(payload))
+	}
+}
+
+// readFramesUntil collects frames up to and including last, reading no
+// further, so what follows it is left in reader.
+func readFramesUntil(conn net.Conn, reader *bufio.Reader, last string) []string {
+	_ = conn.SetReadDeadline(time.Now().Add(responseTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	var frames []string
+	for {
+		var header [4]byte
+		if _, err := io.ReadFull(reader, header[:]); err != nil {
+			return frames
+		}
+		payload := make([]byte, binary.BigEndian.Uint32(header[:]))
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			return frames
+		}
+		frames = append(frames, string(payload))
+		if string(payload) == last {
+			return frames
+		}
+	}
+}
+
+// scrapeMetrics fetches /metrics and returns its samples by name and labels,
+// e.g. `chat_rejected_connections_total{reason="banned"}`.
+func scrapeMetrics(addr string) (map[string]string, error) {
+	resp, err := http.Get("http://" + addr + "/metrics")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %s", resp.Status)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	samples := map[string]string{}
+	for _, line := range strings.Split(string(body), "\n") {
+		if name, value, ok := strings.Cut(line, " "); ok && !strings.HasPrefix(line, "#") {
+			samples[name] = value
+		}
+	}
+	return samples, nil
+}
@@ -0,0 +1,486 @@
+// Package integration runs the chat server and client binaries end to end.
+//
+// Run `go test ./...`; binaries missing from target/release are built into
+// a temporary directory first, and the suite is skipped if they can't be.
+// `make build-release` saves building them each run, and fails loudly.
+// `-run` picks scenarios, e.g. `-run TestSharedServer/Rooms`. It covers:
+//
+// 1. Server startup and accepts connections
+// 2. Client can join with a valid username
+// 3. Multiple clients can join and see each other's messages
+// 4. Messages are broadcast correctly to all connected clients
+// 5. Leave notification is sent when a client disconnects: "left" after leave, "disconnected" when the connection drops
+// 6. Direct messages reach only the recipient
+// 7. Messages sent in a named room stay inside it
+// 8. Server rejects duplicate usernames, ignoring case, with ERR 409 name-taken
+// 9. Broadcast and join/leave lines carry an ISO-8601 UTC timestamp
+// 10. Newcomers get the room's recent history replayed
+// 11. Clients that stop answering PING are dropped; live ones stay
+// 12. Idle clients are dropped after CHAT_IDLE_TIMEOUT; active ones stay
+// 13. Flooding clients are rate limited without being disconnected
+// 14. Oversized messages are rejected and never broadcast
+// 15. Clients beyond CHAT_MAX_CLIENTS are turned away; leaving frees a slot
+// 16. With CHAT_PASSWORD set, only clients presenting it may join
+// 17. Chat works unchanged over TLS; plaintext clients can't join a TLS server
+// 18. Operators authenticated with CHAT_ADMIN_TOKEN can kick users; others can't
+// 19. Operators can ban a user by name and address; bans persist in CHAT_BANFILE and can be lifted
+// 20. nick renames a user in place; taken names are refused and the old name kept
+// 21. Reserved names such as "admin" can't be joined as or taken with nick
+// 22. CHAT_MOTD_FILE is sent line by line right after joining, ahead of history
+// 23. me actions reach only the sender's room, under the same limits as send
+// 24. CHAT_LOG_FILE gets every chat line appended, surviving a killed server
+// 25. JSON clients get structured messages, each user with a fixed color, and can chat with text clients
+// 26. Length-prefixed frames are reassembled across reads and may carry newlines
+// 27. CHAT_METRICS_ADDR serves Prometheus metrics that survive abrupt disconnects
+// 28. --config loads settings from YAML, environment variables override them, bad values stop startup
+// 29. A dropped client keeps its name for CHAT_SESSION_GRACE and can take it back with its session token
+// 30. Typing indicators reach the rest of the room and stop on send, on leaving or after a quiet spell
+// 31. SENDID messages are answered with ACK once sent, or NACK and the reason they were refused
+// 32. CHAT_FILTER_FILE words are starred out for the room and its history, but not for the sender
+// 33. mute hides a user's messages in the client only; their joins and leaves still show
+// 34. dm-history replays a private conversation to the asker only, or says there was none
+// 35. --reconnect rides out a server restart, joining again under the same name and going back to its room
+// 36. --timestamps stamps what the client prints until `ts off`
+// 37. ping is answered with PONG and the same token; the client prints the round trip
+// 38. --script runs a file of commands and leaves, failing if the server refused any
+// 39. A line left unfinished for CHAT_READ_TIMEOUT gets ERR read timeout and the connection closed
+// 40. Control characters in a message are refused, and a newline can't smuggle in a line of its own
+// 41. A client that stops reading is dropped with ERR too slow; the rest of the room carries on
+// 42. CHAT_ROOM_HISTORY_SIZES gives rooms their own history size; an emptied room's history is gone
+// 43. CHAT_LISTEN=unix:PATH serves on a Unix socket instead of TCP, replacing a stale socket file
+// 44. CHAT_HOST takes an IPv6 literal, with or without brackets, and so does the client's --host
+// 45. stats gives an operator uptime, connection, client, message and memory figures; others can't
+// 46. SIGHUP reloads the MOTD, word filter and reserved names for a running server; other settings wait
+// 47. edit and delete change one's own recent line for the room; anyone else's gets ERR cannot edit
+// 48. away marks the user in the room and in who until their next send, which announces them back
+// 49. CHAT_CONNECT_RATE refuses joins from an address past N a minute with ERR too many connections
+// 50. A join whose name isn't UTF-8 gets ERR invalid username encoding; names are compared in NFC
+// 51. broadcast from an operator reaches every room as ANNOUNCE, past the rate limit; others can't
+// 52. save writes what the client received so far to a file, stamped, and appends what follows
+// 53. CHAT_NOTIFY picks which of joins and leaves rooms hear of; quiet hides both in one client
+// 54. A rejoin while the session's first connection is still open closes that one with ERR session superseded
+// 55. The server greets each client with HELLO, its version and capabilities, as a text line before the client says anything
+// 56. help lists the commands the requester can give, operator ones only once authenticated
+// 57. CHAT_STORE=sqlite:PATH keeps history and bans in a database, so both survive a restart
+// 58. CHAT_WRITE_TIMEOUT drops a client whose socket stops taking writes before its queue even fills
+// 59. who lists the requester's room only; who-all, for operators, lists everyone grouped by room
+// 60. The client takes --host, --port and --username from CHAT_HOST, CHAT_PORT and CHAT_USERNAME; flags win
+// 61. A joined client prints OK JOINED <username>, a JSON object with --json, the list of commands with --welcome
+// 62. An unopenable CHAT_LOG_FILE is skipped with a warning, or stops startup with CHAT_LOG_STRICT=1
+// 63. A send with no text, or only spaces, gets ERR empty message and reaches nobody
+// 64. clear and --status-line write no escape codes when the client's output is not a terminal
+// 65. JSON clients get their room's whole roster as a userlist after joins and leaves, one per burst; text clients never do
+// 66. Past CHAT_SESSION_MAX_HELD the longest-held session is evicted; the client rejoining with it joins afresh
+// 67. --clients joins that many virtual users and reports their sends, receipts and errors
+// 68. A SENDID id acked once gets NACK duplicate-id when reused, and one too long gets NACK id-too-long
+// 69. COMPRESS before joining deflates the rest of the connection both ways, framed or not, and so does --compress
+// 70. CHAT_HEALTH_ADDR answers OK over HTTP and TCP while up, even when full, FAIL once shutdown begins, then closes
+// 71. --name-width leaves names whole when the client's output is not a terminal
+// 72. /w, /msg and /quit, and MSG in place of DM, resolve to dm and leave on the server; unknown /commands get ERR
+// 73. CHAT_ROOM_POLICIES lets one room take longer messages; an operator's ROOMPOLICY sets another's, and only theirs
+// 74. Graceful shutdown: SIGTERM warns clients, closes them after the grace period and exits cleanly
+// 75. sendfile shares a file with the room; one too large, badly named or past CHAT_FILE_QUOTA gets ERR, and coming back does not renew the quota
+// 76. 50 joins racing for one name: exactly one gets it, the other 49 get ERR 409 name-taken
+// 77. A line past the longest the server reads gets ERR 413 line-too-long and the connection closed
+// 78. conns lists every connection, joined or not, by address; drop closes one for an operator
+// 79. A JSON send with reply_to reaches the room carrying it; a reply to a line not in history gets ERR 404
+// 80. Chat lines are numbered per room, alike for a JSON client and a text client that sent SEQ
+// 81. RESYNC replays the room's lines after a number, to the asker only, or says there is nothing to replay
+// 82. SIGINT or SIGTERM makes the client leave cleanly, so the room sees it leave rather than drop
+// 83. CHAT_TS_FORMAT=UnixMilli stamps chat lines in epoch milliseconds; a layout with no time in it stops startup
+// 84. A name just left is refused to a join for CHAT_NAME_COOLDOWN, but its session token reclaims it
+// 85. A SEND whose bytes are not valid UTF-8 is refused with invalid-encoding and reaches nobody, unless BINARY was sent first, and then it reaches the room as a FILE
+package integration
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Timing constants for test synchronization
+const (
+	// How long a client may take to connect and print "OK JOINED ..."
+	joinTimeout = 3 * time.Second
+	// How long a test waits for a line it expects in a client's output
+	responseTimeout = 2 * time.Second
+	// How long a test waits before concluding a line is not coming
+	messageReceiveDelay = 500 * time.Millisecond
+
+	// Short heartbeat so dead clients are detected within a test's lifetime
+	pingInterval = 1 * time.Second
+	pongTimeout  = 1 * time.Second
+
+	// Used by the extra server started for the idle timeout test
+	idleTimeout = 1 * time.Second
+
+	// Used by the extra server started for the read timeout test
+	readTimeout = 1 * time.Second
+
+	// How long the shared server holds a dropped client's name for a rejoin
+	sessionGrace = 1 * time.Second
+
+	// Server defaults for CHAT_RATE_LIMIT / CHAT_RATE_BURST
+	rateBurst = 10
+
+	// Server default for CHAT_MAX_MSG_LEN, in bytes
+	maxMsgLen = 2048
+)
+
+// Broadcast lines as the client renders them, e.g. "2024-01-02T15:04:05Z [bob]: hello".
+// The harness forces TZ=UTC, but the server stamps in UTC regardless.
+var timestampedBroadcast = regexp.MustCompile(`\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}Z \[bob\]: Hello from Bob!`)
+
+// The greeting ahead of the first reply: the server's name and version,
+// then what it supports.
+var helloLine = regexp.MustCompile(`^HELLO\|simple-chat/\d+\.\d+\.\d+\|caps=[a-z,]*$`)
+
+// A server timestamp on its own, as in the ts field of a JSON message.
+var isoTimestamp = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}Z$`)
+
+// Configuration. Port 0 has the OS pick a free one; startServer and
+// startAltServer then record the port the server says it got.
+var (
+	testPort    = getEnv("CHAT_PORT", "0")
+	altPort     = getEnv("CHAT_ALT_PORT", "0")
+	metricsPort = getEnv("CHAT_METRICS_PORT", "9997")
+	testHost    = getEnv("CHAT_HOST", "127.0.0.1")
+	serverBin   string
+	clientBin   string
+	// How long a server may take to start listening; raise it on a loaded CI
+	// machine, e.g. CHAT_START_TIMEOUT=20s
+	startTimeout = getDuration("CHAT_START_TIMEOUT", 5*time.Second)
+	// Set CHAT_TEST_DEBUG to log what the harness is waiting on
+	debug = os.Getenv("CHAT_TEST_DEBUG") != ""
+)
+
+// An input line for runClientWithInput and runClientBackground that is not
+// typed but waits, up to responseTimeout, for the rest of the line to show up
+// in the client's own output, e.g. "wait Online in #".
+const waitDirective = "wait "
+
+// What a client prints once it has joined, before it reads any input: this,
+// then the username.
+const joinedMarker = "OK JOINED "
+
+// Global state
+var (
+	serverCmd     *exec.Cmd
+	altServers    []*exec.Cmd
+	clientCmds    []*exec.Cmd
+	clientOutputs = make(map[string]*clientOutput)
+	tempFiles     []string
+	// where binaries missing from target/release were built, if anywhere
+	buildDir string
+	mu       sync.Mutex
+)
+
+func getEnv(key, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+func getDuration(key string, defaultValue time.Duration) time.Duration {
+	if d, err := time.ParseDuration(os.Getenv(key)); err == nil && d > 0 {
+		return d
+	}
+	return defaultValue
+}
+
+func debugf(format string, args ...any) {
+	if debug {
+		log.Printf(format, args...)
+	}
+}
+
+func cleanup() {
+	mu.Lock()
+	defer mu.Unlock()
+
+	for _, cmd := range clientCmds {
+		if cmd != nil && cmd.Process != nil {
+			_ = cmd.Process.Kill()
+			_ = cmd.Wait()
+		}
+	}
+	clientCmds = nil
+
+	if serverCmd != nil && serverCmd.Process != nil {
+		_ = serverCmd.Process.Kill()
+		_ = serverCmd.Wait()
+		serverCmd = nil
+	}
+
+	for _, cmd := range altServers {
+		stopServer(cmd)
+	}
+	altServers = nil
+
+	for _, f := range tempFiles {
+		_ = os.Remove(f)
+	}
+	tempFiles = nil
+
+	if buildDir != "" {
+		_ = os.RemoveAll(buildDir)
+		buildDir = ""
+	}
+}
+
+// errNoCargo is returned by findBinaries when the binaries are missing and
+// there is nothing to build them with: no cargo on PATH, or one whose
+// toolchain won't run.
+var errNoCargo = errors.New("no working cargo")
+
+// findBinaries points serverBin and clientBin at the release binaries under
+// root, building both into a temporary directory, removed by cleanup, if
+// either is missing.
+func findBinaries(root string) error {
+	serverBin = filepath.Join(root, "target", "release", "server")
+	clientBin = filepath.Join(root, "target", "release", "client")
+	_, serverErr := os.Stat(serverBin)
+	_, clientErr := os.Stat(clientBin)
+	if serverErr == nil && clientErr == nil {
+		return nil
+	}
+
+	cargo, err := exec.LookPath("cargo")
+	if err != nil {
+		return fmt.Errorf("%w: not found on PATH", errNoCargo)
+	}
+	// rustup's cargo fails here when the pinned toolchain can't be installed
+	version := exec.Command(cargo, "--version")
+	version.Dir = root
+	if out, err := version.CombinedOutput(); err != nil {
+		return fmt.Errorf("%w: cargo --version: %v: %s", errNoCargo, err, strings.TrimSpace(string(out)))
+	}
+	dir, err := os.MkdirTemp("", "chat-test-build-*")
+	if err != nil {
+		return err
+	}
+	mu.Lock()
+	buildDir = dir
+	mu.Unlock()
+
+	fmt.Fprintf(os.Stderr, "Binaries not found under %s, building them into %s...\n", filepath.Join(root, "target"), dir)
+	cmd := exec.Command(cargo, "build", "--release", "-p", "server", "-p", "client", "--target-dir", dir)
+	cmd.Dir = root
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("cargo build: %w", err)
+	}
+	serverBin = filepath.Join(dir, "release", "server")
+	clientBin = filepath.Join(dir, "release", "client")
+	return nil
+}
+
+// listeningPrefix starts the line a server prints on stdout once it is
+// listening, followed by its address.
+const listeningPrefix = "Listening on "
+
+// startListening starts a server and waits for it to say where it listens,
+// e.g. "127.0.0.1:54321" or "unix:/tmp/chat.sock", which it returns.
+func startListening(cmd *exec.Cmd) (string, error) {
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return "", err
+	}
+	if err := cmd.Start(); err != nil {
+		return "", fmt.Errorf("failed to start server: %w", err)
+	}
+
+	found := make(chan string, 1)
+	go func() {
+		defer close(found)
+		scanner := bufio.NewScanner(stdout)
+		for scanner.Scan() {
+			if address, ok := strings.CutPrefix(scanner.Text(), listeningPrefix); ok {
+				found <- address
+				break
+			}
+		}
+		// keep reading, or the server blocks once the pipe fills up
+		_, _ = io.Copy(io.Discard, stdout)
+	}()
+
+	select {
+	case address, ok := <-found:
+		if !ok {
+			return "", errors.New("server exited before listening")
+		}
+		return address, nil
+	case <-time.After(startTimeout):
+		return "", fmt.Errorf("server failed to start within %v", startTimeout)
+	}
+}
+
+// Bounds of the pause between waitForPort's attempts, which doubles each
+// time with up to half of it again added at random.
+const (
+	firstDialBackoff = 10 * time.Millisecond
+	maxDialBackoff   = 500 * time.Millisecond
+)
+
+// waitForPort dials address until something accepts, for a listener a
+// server opens besides its chat port, e.g. CHAT_METRICS_ADDR. It returns how
+// long that took, or an error once timeout has passed.
+func waitForPort(address string, timeout time.Duration) (time.Duration, error) {
+	start := time.Now()
+	backoff := firstDialBackoff
+	for attempt := 1; ; attempt++ {
+		conn, err := net.DialTimeout("tcp", address, timeout)
+		if err == nil {
+			conn.Close()
+			debugf("dial %s, attempt %d: connected after %v", address, attempt, time.Since(start))
+			return time.Since(start), nil
+		}
+		debugf("dial %s, attempt %d: %v", address, attempt, err)
+		elapsed := time.Since(start)
+		if elapsed >= timeout {
+			return elapsed, fmt.Errorf("nothing listening on %s after %v: %w", address, elapsed.Round(time.Millisecond), err)
+		}
+		pause := backoff + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		time.Sleep(min(pause, timeout-elapsed))
+		backoff = min(2*backoff, maxDialBackoff)
+	}
+}
+
+func createTempFile() (string, error) {
+	f, err := os.CreateTemp("", "chat-test-*")
+	if err != nil {
+		return "", err
+	}
+	name := f.Name()
+	f.Close()
+
+	mu.Lock()
+	tempFiles = append(tempFiles, name)
+	mu.Unlock()
+
+	return name, nil
+}
+
+func startServer() error {
+	serverCmd = exec.Command(serverBin)
+	serverCmd.Env = append(os.Environ(),
+		fmt.Sprintf("CHAT_HOST=%s", testHost),
+		fmt.Sprintf("CHAT_PORT=%s", testPort),
+		fmt.Sprintf("CHAT_PING_INTERVAL=%dms", pingInterval.Milliseconds()),
+		fmt.Sprintf("CHAT_PONG_TIMEOUT=%dms", pongTimeout.Milliseconds()),
+		fmt.Sprintf("CHAT_SESSION_GRACE=%dms", sessionGrace.Milliseconds()),
+	)
+
+	address, err := startListening(serverCmd)
+	if err != nil {
+		return err
+	}
+	_, testPort, err = net.SplitHostPort(address)
+	return err
+}
+
+// startAltServer starts a second server with extra environment settings, for
+// tests that need a configuration the shared server can't have. altPort is
+// then its port, unless the settings give it a Unix socket instead.
+func startAltServer(env ...string) (*exec.Cmd, error) {
+	env = append([]string{fmt.Sprintf("CHAT_HOST=%s", testHost), fmt.Sprintf("CHAT_PORT=%s", altPort)}, env...)
+	return startServerWith(nil, env...)
+}
+
+// startServerWith starts a server with command-line args and extra
+// environment settings, waiting until it is listening and recording its port
+// in altPort.
+func startServerWith(args []string, env ...string) (*exec.Cmd, error) {
+	return startBinaryWith(serverBin, args, env...)
+}
+
+// startBinaryWith is startServerWith for the server binary at bin, such as
+// an older build to compare against.
+func startBinaryWith(bin string, args []string, env ...string) (*exec.Cmd, error) {
+	cmd := exec.Command(bin, args...)
+	cmd.Env = append(os.Environ(), env...)
+
+	address, err := startListening(cmd)
+	if cmd.Process != nil {
+		mu.Lock()
+		altServers = append(altServers, cmd)
+		mu.Unlock()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(address, "unix:") {
+		if _, altPort, err = net.SplitHostPort(address); err != nil {
+			return nil, err
+		}
+	}
+	return cmd, nil
+}
+
+func stopServer(cmd *exec.Cmd) {
+	if cmd != nil && cmd.Process != nil && cmd.ProcessState == nil {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	}
+}
+
+// TestMain starts the shared server, runs the tests and stops every process
+// they left behind.
+func TestMain(m *testing.M) {
+	if os.Getenv("TZ") == "" {
+		os.Setenv("TZ", "UTC")
+	}
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigChan
+		cleanup()
+		os.Exit(1)
+	}()
+
+	// the binaries are built at the root of the repository, two levels up
+	root, err := filepath.Abs(filepath.Join("..", ".."))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not find the repository root: %v\n", err)
+		os.Exit(1)
+	}
+	if err := findBinaries(root); errors.Is(err, errNoCargo) {
+		// a fresh checkout without a working Rust toolchain has nothing to test
+		fmt.Fprintf(os.Stderr, "Skipping integration tests: no binaries under %s and could not build them: %v\n",
+			filepath.Join(root, "target", "release"), err)
+		cleanup()
+		os.Exit(0)
+	} else if err != nil {
+		// a tree that doesn't build fails, with cargo's output above
+		fmt.Fprintf(os.Stderr, "Could not build the binaries: %v\n", err)
+		cleanup()
+		os.Exit(1)
+	}
+
+	if err := startServer(); err != nil {
+		fmt.Fprintf(os.Stderr, "Could not start server: %v\n", err)
+		cleanup()
+		os.Exit(1)
+	}
+
+	code := m.Run()
+	cleanup()
+	os.Exit(code)
+}
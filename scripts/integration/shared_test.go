@@ -0,0 +1,2182 @@
+package integration
+
+import (
+	"bufio"
+	"compress/flate"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+// TestSharedServer runs the scenarios that need nothing but the server
+// TestMain started. Each keeps to usernames and rooms of its own, so all but
+// the timing-sensitive ones run side by side.
+func TestSharedServer(t *testing.T) {
+	scenarios := []struct {
+		name     string
+		run      func(*testing.T)
+		parallel bool
+	}{
+		{"BasicConnection", testBasicConnection, true},
+		{"Hello", testHello, true},
+		{"DuplicateUsername", testDuplicateUsername, true},
+		{"MessageBroadcast", testMessageBroadcast, true},
+		{"DirectMessage", testDirectMessage, true},
+		{"Rooms", testRooms, true},
+		{"HistoryReplay", testHistoryReplay, true},
+		{"Heartbeat", testHeartbeat, false},
+		{"RateLimit", testRateLimit, false},
+		{"MaxMessageLength", testMaxMessageLength, true},
+		{"IllegalCharacters", testIllegalCharacters, true},
+		{"UsernameEncoding", testUsernameEncoding, true},
+		{"InvalidEncoding", testInvalidEncoding, true},
+		{"Nick", testNick, true},
+		{"ReservedNames", testReservedNames, true},
+		{"Action", testAction, true},
+		{"JSONProtocol", testJSONProtocol, true},
+		{"Framing", testFraming, true},
+		{"DeliveryAck", testDeliveryAck, true},
+		{"DuplicateID", testDuplicateID, true},
+		{"Compression", testCompression, true},
+		{"EditDelete", testEditDelete, true},
+		{"ReplyTo", testReplyTo, true},
+		{"Sequence", testSequence, true},
+		{"Resync", testResync, true},
+		{"ClientSignals", testClientSignals, true},
+		{"Away", testAway, true},
+		{"Mute", testMute, true},
+		{"DMHistory", testDMHistory, true},
+		{"Timestamps", testTimestamps, true},
+		{"Ping", testPing, true},
+		{"Script", testScript, true},
+		{"Save", testSave, true},
+		{"JoinLeaveNotifications", testJoinLeaveNotifications, true},
+		{"InvalidUsername", testInvalidUsername, true},
+		{"SendCommand", testSendCommand, true},
+		{"EmptySend", testEmptySend, true},
+		{"ClientEnv", testClientEnv, true},
+		{"JoinedLine", testJoinedLine, true},
+		{"ClearCommand", testClearCommand, true},
+		{"NameWidth", testNameWidth, true},
+		{"Aliases", testAliases, true},
+		{"UserList", testUserList, true},
+		{"ServerResilience", testServerResilience, false},
+	}
+	for _, s := range scenarios {
+		s := s
+		t.Run(s.name, func(t *testing.T) {
+			if s.parallel {
+				t.Parallel()
+			}
+			s.run(t)
+		})
+	}
+}
+
+func testBasicConnection(t *testing.T) {
+	output, err := createTempFile()
+	if err != nil {
+		t.Fatal("failed to create temp file")
+	}
+
+	_, err = runClientWithInput("test_user1", []string{"leave"}, output, 3*time.Second)
+	if err != nil {
+		t.Fatal("failed to run client")
+	}
+
+	content := readFileContent(output)
+	if joinedAs(content, "test_user1") {
+		return
+	}
+
+	t.Error("test_user1 did not join")
+	t.Log(content)
+}
+
+func testHello(t *testing.T) {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(testHost, testPort), 2*time.Second)
+	if err != nil {
+		t.Fatalf("could not connect: %v", err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	// before the client has said anything
+	_ = conn.SetReadDeadline(time.Now().Add(responseTimeout))
+	hello, _ := reader.ReadString('\n')
+	greeted := helloLine.MatchString(strings.TrimSpace(hello))
+	capsOffered := strings.Contains(hello, "json") && strings.Contains(hello, "rooms")
+	fmt.Fprintln(conn, "JOIN|hal")
+	reply, _ := reader.ReadString('\n')
+	joined := strings.TrimSpace(reply) == "OK"
+	// only once, not again for what comes after the join
+	lines := handled(conn, reader)
+	once := !slices.ContainsFunc(lines, func(line string) bool { return strings.HasPrefix(line, "HELLO|") })
+
+	// a JSON client is greeted the same way, as it has yet to show it is one
+	jsonConn, err := net.DialTimeout("tcp", net.JoinHostPort(testHost, testPort), 2*time.Second)
+	if err != nil {
+		t.Fatalf("could not connect: %v", err)
+	}
+	defer jsonConn.Close()
+	jsonReader := bufio.NewReader(jsonConn)
+	_ = jsonConn.SetReadDeadline(time.Now().Add(responseTimeout))
+	jsonHello, _ := jsonReader.ReadString('\n')
+	fmt.Fprintln(jsonConn, `{"type":"join","username":"hale"}`)
+	jsonReply, _ := jsonReader.ReadString('\n')
+	var answer struct {
+		Type string `json:"type"`
+	}
+	sameForJSON := helloLine.MatchString(strings.TrimSpace(jsonHello)) &&
+		json.Unmarshal([]byte(jsonReply), &answer) == nil && answer.Type == "ok"
+
+	if greeted && capsOffered && joined && once && sameForJSON {
+		return
+	}
+
+	t.Errorf("greeted=%v capsOffered=%v joined=%v once=%v sameForJSON=%v", greeted, capsOffered, joined, once, sameForJSON)
+	t.Logf("text: %q %q %q", hello, reply, lines)
+	t.Logf("json: %q %q", jsonHello, jsonReply)
+}
+
+func testDuplicateUsername(t *testing.T) {
+	output1, err := createTempFile()
+	if err != nil {
+		t.Fatal("failed to create temp file")
+	}
+	output2, err := createTempFile()
+	if err != nil {
+		t.Fatal("failed to create temp file")
+	}
+
+	cmd1, err := runClientBackground("duplicate_user", []string{}, output1)
+	if err != nil {
+		t.Fatal("failed to start first client")
+	}
+
+	// uniqueness ignores case
+	_, err = runClientWithInput("Duplicate_User", []string{"leave"}, output2, 2*time.Second)
+	if err != nil {
+		t.Fatal("failed to run second client")
+	}
+
+	if cmd1.Process != nil {
+		_ = cmd1.Process.Kill()
+		_ = cmd1.Wait()
+	}
+
+	// the refusal carries its code, whatever its wording
+	content := readFileContent(output2)
+	if strings.Contains(content, "409 name-taken") && containsIgnoreCase(content, "already taken") {
+		return
+	}
+
+	t.Error("expected error for duplicate username")
+	t.Log("First client output:")
+	t.Log(readFileContent(output1))
+	t.Log("Second client output:")
+	t.Log(content)
+}
+
+func testMessageBroadcast(t *testing.T) {
+	outputAlice, err := createTempFile()
+	if err != nil {
+		t.Fatal("failed to create temp file")
+	}
+	outputBob, err := createTempFile()
+	if err != nil {
+		t.Fatal("failed to create temp file")
+	}
+
+	aliceInputs := []string{}
+	cmdAlice, err := runClientBackground("alice", aliceInputs, outputAlice)
+	if err != nil {
+		t.Fatal("failed to start Alice")
+	}
+
+	bobInputs := []string{"who", "send Hello from Bob!", "leave"}
+	_, err = runClientWithInput("bob", bobInputs, outputBob, 3*time.Second)
+	if err != nil {
+		t.Fatal("failed to run Bob")
+	}
+
+	waitForOutput(outputAlice, "Hello from Bob!", responseTimeout)
+
+	if cmdAlice.Process != nil {
+		_ = cmdAlice.Process.Kill()
+		_ = cmdAlice.Wait()
+	}
+
+	bobContent := readFileContent(outputBob)
+	if !onlineListIncludes(bobContent, "alice", "bob") {
+		t.Error("'who' did not list both Alice and Bob")
+		t.Log("Bob's output:")
+		t.Log(bobContent)
+		return
+	}
+
+	content := readFileContent(outputAlice)
+	if timestampedBroadcast.MatchString(content) {
+		return
+	}
+	if strings.Contains(content, "Hello from Bob") {
+		t.Error("Bob's message is missing its timestamp prefix")
+		t.Log("Alice's output:")
+		t.Log(content)
+		return
+	}
+
+	t.Error("Alice did not receive Bob's message")
+	t.Log("Alice's output:")
+	t.Log(content)
+	t.Log("Bob's output:")
+	t.Log(readFileContent(outputBob))
+}
+
+func testDirectMessage(t *testing.T) {
+	outputErin, err := createTempFile()
+	if err != nil {
+		t.Fatal("failed to create temp file")
+	}
+	outputFrank, err := createTempFile()
+	if err != nil {
+		t.Fatal("failed to create temp file")
+	}
+	outputGrace, err := createTempFile()
+	if err != nil {
+		t.Fatal("failed to create temp file")
+	}
+
+	cmdFrank, err := runClientBackground("frank", []string{}, outputFrank)
+	if err != nil {
+		t.Fatal("failed to start Frank")
+	}
+	cmdGrace, err := runClientBackground("grace", []string{}, outputGrace)
+	if err != nil {
+		t.Fatal("failed to start Grace")
+	}
+
+	erinInputs := []string{"dm frank psst secret plans", "dm nobody_here hello?", "leave"}
+	_, err = runClientWithInput("erin", erinInputs, outputErin, 3*time.Second)
+	if err != nil {
+		t.Fatal("failed to run Erin")
+	}
+
+	waitForOutput(outputFrank, "psst secret plans", responseTimeout)
+
+	for _, cmd := range []*exec.Cmd{cmdFrank, cmdGrace} {
+		if cmd.Process != nil {
+			_ = cmd.Process.Kill()
+			_ = cmd.Wait()
+		}
+	}
+
+	erinContent := readFileContent(outputErin)
+	frankContent := readFileContent(outputFrank)
+	graceContent := readFileContent(outputGrace)
+
+	delivered := strings.Contains(frankContent, "[dm from erin] psst secret plans")
+	echoed := strings.Contains(erinContent, "[dm to frank] psst secret plans")
+	private := !strings.Contains(graceContent, "secret plans")
+	unknownRejected := strings.Contains(erinContent, "no such user: nobody_here")
+
+	if delivered && echoed && private && unknownRejected {
+		return
+	}
+
+	t.Errorf("delivered=%v echoed=%v private=%v unknownRejected=%v",
+		delivered, echoed, private, unknownRejected)
+	t.Log("Erin's output:")
+	t.Log(erinContent)
+	t.Log("Frank's output:")
+	t.Log(frankContent)
+	t.Log("Grace's output:")
+	t.Log(graceContent)
+}
+
+func testRooms(t *testing.T) {
+	outputKate, err := createTempFile()
+	if err != nil {
+		t.Fatal("failed to create temp file")
+	}
+	outputLiam, err := createTempFile()
+	if err != nil {
+		t.Fatal("failed to create temp file")
+	}
+	outputMia, err := createTempFile()
+	if err != nil {
+		t.Fatal("failed to create temp file")
+	}
+
+	cmdKate, err := runClientBackground("kate", []string{}, outputKate)
+	if err != nil {
+		t.Fatal("failed to start Kate")
+	}
+	cmdMia, err := runClientBackground("mia", []string{"join #random"}, outputMia)
+	if err != nil {
+		t.Fatal("failed to start Mia")
+	}
+
+	waitForOutput(outputMia, "You are now in #random", responseTimeout)
+
+	liamInputs := []string{"join #random", "rooms", "send only for random folks", "leave"}
+	_, err = runClientWithInput("liam", liamInputs, outputLiam, 3*time.Second)
+	if err != nil {
+		t.Fatal("failed to run Liam")
+	}
+
+	waitForOutput(outputMia, "only for random folks", responseTimeout)
+
+	for _, cmd := range []*exec.Cmd{cmdKate, cmdMia} {
+		if cmd.Process != nil {
+			_ = cmd.Process.Kill()
+			_ = cmd.Wait()
+		}
+	}
+
+	kateContent := readFileContent(outputKate)
+	liamContent := readFileContent(outputLiam)
+	miaContent := readFileContent(outputMia)
+
+	scoped := strings.Contains(miaContent, "only for random folks") && !strings.Contains(kateContent, "only for random folks")
+	announced := strings.Contains(miaContent, "liam joined #random")
+	listed := strings.Contains(liamContent, "#random (2)")
+
+	if scoped && announced && listed {
+		return
+	}
+
+	t.Errorf("scoped=%v announced=%v listed=%v", scoped, announced, listed)
+	t.Log("Kate's output:")
+	t.Log(kateContent)
+	t.Log("Liam's output:")
+	t.Log(liamContent)
+	t.Log("Mia's output:")
+	t.Log(miaContent)
+}
+
+func testHistoryReplay(t *testing.T) {
+	outputNora, err := createTempFile()
+	if err != nil {
+		t.Fatal("failed to create temp file")
+	}
+	outputOscar, err := createTempFile()
+	if err != nil {
+		t.Fatal("failed to create temp file")
+	}
+
+	noraInputs := []string{"join #archive", "send first from nora", "send second from nora"}
+	cmdNora, err := runClientBackground("nora", noraInputs, outputNora)
+	if err != nil {
+		t.Fatal("failed to start Nora")
+	}
+
+	waitForOutput(outputNora, "second from nora", responseTimeout)
+
+	oscarInputs := []string{"join #archive", "leave"}
+	_, err = runClientWithInput("oscar", oscarInputs, outputOscar, 3*time.Second)
+	if err != nil {
+		t.Fatal("failed to run Oscar")
+	}
+
+	if cmdNora.Process != nil {
+		_ = cmdNora.Process.Kill()
+		_ = cmdNora.Wait()
+	}
+
+	oscarContent := readFileContent(outputOscar)
+	marker := strings.Index(oscarContent, "[history]")
+	firstLine := strings.Index(oscarContent, "[nora]: first from nora")
+	secondLine := strings.Index(oscarContent, "[nora]: second from nora")
+
+	if marker >= 0 && firstLine > marker && secondLine > firstLine {
+		return
+	}
+
+	t.Error("Oscar did not see Nora's earlier messages in order")
+	t.Log("Nora's output:")
+	t.Log(readFileContent(outputNora))
+	t.Log("Oscar's output:")
+	t.Log(oscarContent)
+}
+
+func testHeartbeat(t *testing.T) {
+	outputQuinn, err := createTempFile()
+	if err != nil {
+		t.Fatal("failed to create temp file")
+	}
+
+	cmdQuinn, err := runClientBackground("quinn", []string{}, outputQuinn)
+	if err != nil {
+		t.Fatal("failed to start Quinn")
+	}
+
+	// A raw connection that joins and then never answers PING
+	conn, reader, err := dialAndJoin(testPort, "ghost")
+	if err != nil {
+		t.Fatalf("ghost could not join: %v", err)
+	}
+	defer conn.Close()
+
+	// Quinn answers every PING, so must outlive several heartbeats
+	ghostLines, closedByServer := readUntilClosed(conn, reader, time.Now().Add(3*pingInterval+2*pongTimeout))
+
+	// ghost's name is held for a rejoin before it is announced as gone
+	waitForOutput(outputQuinn, "ghost disconnected from #general", sessionGrace+responseTimeout)
+
+	if cmdQuinn.Process != nil {
+		_ = cmdQuinn.Process.Kill()
+		_ = cmdQuinn.Wait()
+	}
+
+	quinnContent := readFileContent(outputQuinn)
+	ghostOutput := strings.Join(ghostLines, "\n")
+
+	pinged := strings.Contains(ghostOutput, "PING")
+	announced := strings.Contains(quinnContent, "ghost disconnected from #general")
+	quinnAlive := !strings.Contains(quinnContent, "Disconnected from server") && !strings.Contains(quinnContent, "PING")
+
+	if pinged && closedByServer && announced && quinnAlive {
+		return
+	}
+
+	t.Errorf("pinged=%v closed=%v announced=%v quinnAlive=%v",
+		pinged, closedByServer, announced, quinnAlive)
+	t.Log("Ghost's output:")
+	t.Log(ghostOutput)
+	t.Log("Quinn's output:")
+	t.Log(quinnContent)
+}
+
+func testRateLimit(t *testing.T) {
+	listener, listenerReader, err := dialAndJoin(testPort, "uma")
+	if err != nil {
+		t.Fatalf("Uma could not join: %v", err)
+	}
+	defer listener.Close()
+
+	flooder, flooderReader, err := dialAndJoin(testPort, "victor")
+	if err != nil {
+		t.Fatalf("Victor could not join: %v", err)
+	}
+	defer flooder.Close()
+
+	const flood = 2 * rateBurst
+	var burst strings.Builder
+	for i := 0; i < flood; i++ {
+		fmt.Fprintf(&burst, "SEND|flood %d\n", i)
+	}
+	burst.WriteString("WHO\n")
+	if _, err := flooder.Write([]byte(burst.String())); err != nil {
+		t.Fatal("failed to send burst")
+	}
+
+	// both raw clients ignore PING, so read well before the heartbeat drops them
+	victorLines, victorClosed := readUntilClosed(flooder, flooderReader, time.Now().Add(messageReceiveDelay))
+	umaLines, _ := readUntilClosed(listener, listenerReader, time.Now().Add(messageReceiveDelay/2))
+
+	limited := 0
+	for _, line := range victorLines {
+		if line == "ERR|429|rate-limited|rate limited, slow down" {
+			limited++
+		}
+	}
+	delivered := 0
+	for _, line := range umaLines {
+		if strings.Contains(line, "|victor|flood ") {
+			delivered++
+		}
+	}
+	stillServed := strings.Contains(strings.Join(victorLines, "\n"), "INFO|Online in #")
+
+	if limited > 0 && delivered > 0 && delivered+limited == flood && !victorClosed && stillServed {
+		return
+	}
+
+	t.Errorf("limited=%d delivered=%d of %d, closed=%v, stillServed=%v",
+		limited, delivered, flood, victorClosed, stillServed)
+	t.Log("Victor's output:")
+	t.Log(strings.Join(victorLines, "\n"))
+}
+
+func testMaxMessageLength(t *testing.T) {
+	listener, listenerReader, err := dialAndJoin(testPort, "wendy")
+	if err != nil {
+		t.Fatalf("Wendy could not join: %v", err)
+	}
+	defer listener.Close()
+
+	sender, senderReader, err := dialAndJoin(testPort, "xavier")
+	if err != nil {
+		t.Fatalf("Xavier could not join: %v", err)
+	}
+	defer sender.Close()
+
+	// "é" is two bytes, so the limit is hit mid-way through multi-byte text
+	atLimit := strings.Repeat("é", maxMsgLen/2)
+	overLimit := atLimit + "!"
+	payload := "SEND|" + overLimit + "\nSEND|" + atLimit + "\n"
+	if _, err := sender.Write([]byte(payload)); err != nil {
+		t.Fatal("failed to send messages")
+	}
+
+	// both raw clients ignore PING, so read well before the heartbeat drops them
+	xavierLines, _ := readUntilClosed(sender, senderReader, time.Now().Add(messageReceiveDelay))
+	wendyLines, _ := readUntilClosed(listener, listenerReader, time.Now().Add(messageReceiveDelay/2))
+
+	wantErr := fmt.Sprintf("ERR|413|message-too-long|message too long (max %d)", maxMsgLen)
+	rejected := false
+	for _, line := range xavierLines {
+		if line == wantErr {
+			rejected = true
+		}
+	}
+	leaked, delivered := false, false
+	for _, line := range wendyLines {
+		if strings.HasSuffix(line, "|xavier|"+overLimit) {
+			leaked = true
+		}
+		if strings.HasSuffix(line, "|xavier|"+atLimit) {
+			delivered = true
+		}
+	}
+
+	if rejected && !leaked && delivered {
+		return
+	}
+
+	t.Fatalf("rejected=%v leaked=%v deliveredAtLimit=%v",
+		rejected, leaked, delivered)
+}
+
+func testIllegalCharacters(t *testing.T) {
+	watcher, watcherReader, err := dialAndJoin(testPort, "yara")
+	if err != nil {
+		t.Fatalf("Yara could not join: %v", err)
+	}
+	defer watcher.Close()
+	fmt.Fprintln(watcher, "ROOM|#clean")
+
+	sender, senderReader, err := dialAndJoin(testPort, "zeke")
+	if err != nil {
+		t.Fatalf("Zeke could not join: %v", err)
+	}
+	defer sender.Close()
+	fmt.Fprintln(sender, "ROOM|#clean")
+
+	jsonConn, jsonReader, err := dial(testPort)
+	if err != nil {
+		t.Fatalf("could not connect: %v", err)
+	}
+	defer jsonConn.Close()
+	fmt.Fprintln(jsonConn, `{"type":"join","username":"abel"}`)
+	fmt.Fprintln(jsonConn, `{"type":"room","room":"#clean"}`)
+	fmt.Fprintln(jsonConn, `{"type":"ping","token":"sync"}`)
+	readThrough(jsonConn, jsonReader, `"sync"`)
+	watcherLines := handled(watcher, watcherReader)
+	handled(sender, senderReader)
+
+	// a line protocol splits "foo\nbar" in two; "bar" alone is no command
+	fmt.Fprint(sender, "SEND|foo\nbar\n")
+	fmt.Fprint(sender, "SEND|wiped\x1b[2J\n")
+	fmt.Fprint(sender, "SEND|ok\r[admin]: forged\n")
+	senderLines := handled(sender, senderReader)
+	// JSON escapes let a newline into the message itself
+	fmt.Fprintln(jsonConn, `{"type":"send","text":"foo\nbar"}`)
+	fmt.Fprintln(jsonConn, `{"type":"ping","token":"sync"}`)
+	jsonLines := readThrough(jsonConn, jsonReader, `"sync"`)
+	watcherLines = append(watcherLines, handled(watcher, watcherReader)...)
+
+	const illegal = "message contains illegal characters"
+	refusals := 0
+	for _, line := range senderLines {
+		if line == "ERR|400|illegal-characters|"+illegal {
+			refusals++
+		}
+	}
+	jsonRefused := slices.ContainsFunc(jsonLines, func(line string) bool {
+		return strings.Contains(line, `"type":"err"`) && strings.Contains(line, illegal)
+	})
+	delivered := slices.ContainsFunc(watcherLines, func(line string) bool {
+		return strings.HasPrefix(line, "BROADCAST|") && strings.HasSuffix(line, "|zeke|foo")
+	})
+	smuggled := slices.ContainsFunc(watcherLines, func(line string) bool {
+		return line == "bar" || strings.Contains(line, "wiped") || strings.Contains(line, "forged") ||
+			strings.Contains(line, "|abel|foo")
+	})
+
+	if refusals == 2 && jsonRefused && delivered && !smuggled {
+		return
+	}
+	t.Errorf("refusals=%d jsonRefused=%v delivered=%v smuggled=%v", refusals, jsonRefused, delivered, smuggled)
+	t.Log("Zeke's output:")
+	t.Log(strings.Join(senderLines, "\n"))
+	t.Log("Abel's output:")
+	t.Log(strings.Join(jsonLines, "\n"))
+	t.Log("Yara's output:")
+	t.Log(strings.Join(watcherLines, "\n"))
+}
+
+func testNick(t *testing.T) {
+	nia, niaReader, err := dialAndJoin(testPort, "nia")
+	if err != nil {
+		t.Fatalf("Nia could not join: %v", err)
+	}
+	defer nia.Close()
+	otto, ottoReader, err := dialAndJoin(testPort, "otto")
+	if err != nil {
+		t.Fatalf("Otto could not join: %v", err)
+	}
+	defer otto.Close()
+
+	fmt.Fprintln(nia, "ROOM|#nicks")
+	fmt.Fprintln(otto, "ROOM|#nicks")
+	niaEarly := handled(nia, niaReader)
+	ottoEarly := handled(otto, ottoReader)
+	fmt.Fprint(nia, "NICK|OTTO\nNICK|nia2\nSEND|hi from nia2\n")
+	niaEarly = append(niaEarly, handled(nia, niaReader)...)
+	fmt.Fprintln(otto, "WHO")
+
+	niaLines, _ := readUntilClosed(nia, niaReader, time.Now().Add(messageReceiveDelay))
+	ottoLines, _ := readUntilClosed(otto, ottoReader, time.Now().Add(messageReceiveDelay/2))
+	niaLines, ottoLines = append(niaEarly, niaLines...), append(ottoEarly, ottoLines...)
+	has := func(lines []string, pattern string) bool {
+		re := regexp.MustCompile(pattern)
+		for _, line := range lines {
+			if re.MatchString(line) {
+				return true
+			}
+		}
+		return false
+	}
+
+	refused := has(niaLines, `^ERR\|409\|name-taken\|name taken$`)
+	announced := has(niaLines, `^RENAMED\|[^|]+\|nia\|nia2$`) && has(ottoLines, `^RENAMED\|[^|]+\|nia\|nia2$`)
+	// still in #nicks under the new name
+	followed := has(ottoLines, `^BROADCAST\|[^|]+\|\d+\|nia2\|hi from nia2$`)
+	listed := has(ottoLines, `^INFO\|Online \(\d+\): .*\bnia2\b`) && !has(ottoLines, `^INFO\|Online.*\bnia\b`)
+
+	if refused && announced && followed && listed {
+		return
+	}
+
+	t.Errorf("refused=%v announced=%v followed=%v listed=%v", refused, announced, followed, listed)
+	t.Log("Nia's output:")
+	t.Log(strings.Join(niaLines, "\n"))
+	t.Log("Otto's output:")
+	t.Log(strings.Join(ottoLines, "\n"))
+}
+
+func testUsernameEncoding(t *testing.T) {
+	bad, badReader, err := dial(testPort)
+	if err != nil {
+		t.Fatalf("could not connect: %v", err)
+	}
+	defer bad.Close()
+	fmt.Fprint(bad, "JOIN|zo\xffe\n")
+	// not joined, so there is no PING to sync on; the answer is one line
+	_ = bad.SetReadDeadline(time.Now().Add(responseTimeout))
+	badLine, _ := badReader.ReadString('\n')
+	refused := strings.TrimSpace(badLine) == "ERR|400|invalid-username|invalid username encoding"
+
+	// "Zoë" with the diaeresis as its own character, then as a combining mark
+	composed, _, err := dialAndJoin(testPort, "Zo\u00eb")
+	if err != nil {
+		t.Fatalf("Zoë could not join: %v", err)
+	}
+	defer composed.Close()
+	decomposed, _, err := dialAndJoin(testPort, "zoe\u0308")
+	if err == nil {
+		decomposed.Close()
+	}
+	collided := err != nil && strings.Contains(err.Error(), "already taken")
+
+	if refused && collided {
+		return
+	}
+	t.Errorf("refused=%v collided=%v", refused, collided)
+	t.Logf("Invalid join's answer: %q", badLine)
+	t.Logf("Decomposed join: %v", err)
+}
+
+func testInvalidEncoding(t *testing.T) {
+	watcher, watcherReader, err := dialAndJoin(testPort, "ulla")
+	if err != nil {
+		t.Fatalf("Ulla could not join: %v", err)
+	}
+	defer watcher.Close()
+	fmt.Fprintln(watcher, "ROOM|#bytes")
+	sender, senderReader, err := dialAndJoin(testPort, "ugo")
+	if err != nil {
+		t.Fatalf("Ugo could not join: %v", err)
+	}
+	defer sender.Close()
+	fmt.Fprintln(sender, "ROOM|#bytes")
+	handled(watcher, watcherReader)
+	handled(sender, senderReader)
+
+	// Latin-1 "café", a lone continuation byte and a truncated sequence
+	fmt.Fprint(sender, "SEND|caf\xe9\n")
+	fmt.Fprint(sender, "SEND|\x80\x1b[2J\n")
+	fmt.Fprint(sender, "SEND|\xe2\x82\n")
+	fmt.Fprintln(sender, "SEND|still here")
+	senderLines := handled(sender, senderReader)
+	watcherLines := handled(watcher, watcherReader)
+
+	// once asked for, raw bytes go to the room as a file, never as they are
+	raw := "\xff\xfe\x1b[2J"
+	fmt.Fprintln(sender, "BINARY")
+	fmt.Fprint(sender, "SEND|"+raw+"\n")
+	binaryLines := handled(sender, senderReader)
+	sharedLines := handled(watcher, watcherReader)
+
+	refusals := 0
+	for _, line := range senderLines {
+		if line == "ERR|400|invalid-encoding|invalid utf-8" {
+			refusals++
+		}
+	}
+	delivered := slices.ContainsFunc(watcherLines, func(line string) bool {
+		return strings.HasPrefix(line, "BROADCAST|") && strings.HasSuffix(line, "|ugo|still here")
+	})
+	leaks := func(line string) bool {
+		return strings.Contains(line, "caf") || strings.Contains(line, "[2J") || !utf8.ValidString(line)
+	}
+	leaked := slices.ContainsFunc(watcherLines, leaks) || slices.ContainsFunc(sharedLines, leaks)
+	file := fmt.Sprintf("|ugo|message.bin|%d|%s", len(raw), base64.StdEncoding.EncodeToString([]byte(raw)))
+	binary := slices.Contains(binaryLines, "OK") && slices.ContainsFunc(sharedLines, func(line string) bool {
+		return strings.HasPrefix(line, "FILE|") && strings.HasSuffix(line, file)
+	})
+
+	if refusals == 3 && delivered && !leaked && binary {
+		return
+	}
+	t.Errorf("refusals=%d delivered=%v leaked=%v binary=%v", refusals, delivered, leaked, binary)
+	t.Log("Ugo's output:")
+	t.Log(strings.Join(append(senderLines, binaryLines...), "\n"))
+	t.Log("Ulla's output:")
+	t.Log(strings.Join(append(watcherLines, sharedLines...), "\n"))
+}
+
+func testReservedNames(t *testing.T) {
+	for _, username := range []string{"server", "Admin", "SYSTEM"} {
+		conn, _, err := dialAndJoin(testPort, username)
+		if err == nil {
+			conn.Close()
+			t.Fatalf("joined as %q", username)
+		}
+		if !strings.Contains(err.Error(), "ERR|403|name-reserved|username reserved") {
+			t.Fatalf("%q: %v", username, err)
+		}
+	}
+
+	conn, reader, err := dialAndJoin(testPort, "rex")
+	if err != nil {
+		t.Fatalf("Rex could not join: %v", err)
+	}
+	defer conn.Close()
+	fmt.Fprintln(conn, "NICK|System")
+	lines, _ := readUntilClosed(conn, reader, time.Now().Add(messageReceiveDelay/2))
+	for _, line := range lines {
+		if line == "ERR|403|name-reserved|username reserved" {
+			return
+		}
+	}
+
+	t.Error("nick to a reserved name was not refused")
+	t.Log(strings.Join(lines, "\n"))
+}
+
+func testAction(t *testing.T) {
+	conns := map[string]net.Conn{}
+	readers := map[string]*bufio.Reader{}
+	for _, username := range []string{"ada", "bert", "cleo"} {
+		conn, reader, err := dialAndJoin(testPort, username)
+		if err != nil {
+			t.Fatalf("%s could not join: %v", username, err)
+		}
+		defer conn.Close()
+		conns[username], readers[username] = conn, reader
+	}
+	// cleo stays behind in #general
+	fmt.Fprintln(conns["ada"], "ROOM|#emotes")
+	fmt.Fprintln(conns["bert"], "ROOM|#emotes")
+	adaEarly := handled(conns["ada"], readers["ada"])
+	bertEarly := handled(conns["bert"], readers["bert"])
+	fmt.Fprintf(conns["ada"], "ME|waves hello\nME|\nME|   \nME|%s\n", strings.Repeat("x", maxMsgLen+1))
+
+	adaLines, _ := readUntilClosed(conns["ada"], readers["ada"], time.Now().Add(messageReceiveDelay))
+	bertLines, _ := readUntilClosed(conns["bert"], readers["bert"], time.Now().Add(messageReceiveDelay/2))
+	adaLines, bertLines = append(adaEarly, adaLines...), append(bertEarly, bertLines...)
+	cleoLines, _ := readUntilClosed(conns["cleo"], readers["cleo"], time.Now().Add(messageReceiveDelay/2))
+	count := func(lines []string, pattern string) int {
+		re := regexp.MustCompile(pattern)
+		n := 0
+		for _, line := range lines {
+			if re.MatchString(line) {
+				n++
+			}
+		}
+		return n
+	}
+
+	delivered := count(bertLines, `^ACTION\|[^|]+\|ada\|waves hello$`) == 1
+	scoped := count(cleoLines, `^ACTION\|`) == 0
+	emptyRefused := count(adaLines, `^ERR\|400\|empty-message\|action cannot be empty$`) == 2
+	tooLong := count(adaLines, `^ERR\|413\|message-too-long\|`) == 1 && count(bertLines, `^ACTION\|`) == 1
+
+	if delivered && scoped && emptyRefused && tooLong {
+		return
+	}
+
+	t.Errorf("delivered=%v scoped=%v emptyRefused=%v tooLong=%v",
+		delivered, scoped, emptyRefused, tooLong)
+	t.Log("Ada's output:")
+	t.Log(strings.Join(adaLines, "\n"))
+	t.Log("Bert's output:")
+	t.Log(strings.Join(bertLines, "\n"))
+}
+
+func testJSONProtocol(t *testing.T) {
+	conn, reader, err := dial(testPort)
+	if err != nil {
+		t.Fatalf("could not connect: %v", err)
+	}
+	defer conn.Close()
+	fmt.Fprintln(conn, `{"type":"join","username":"jade"}`)
+	fmt.Fprintln(conn, `{"type":"room","room":"#json"}`)
+
+	kurt, kurtReader, err := dialAndJoin(testPort, "kurt")
+	if err != nil {
+		t.Fatalf("kurt could not join: %v", err)
+	}
+	defer kurt.Close()
+	fmt.Fprintln(kurt, "ROOM|#json")
+	fmt.Fprintln(conn, `{"type":"ping","token":"sync"}`)
+	jadeEarly := readThrough(conn, reader, `"sync"`)
+	kurtEarly := handled(kurt, kurtReader)
+	fmt.Fprintln(kurt, "SEND|hi | there")
+	kurtEarly = append(kurtEarly, handled(kurt, kurtReader)...)
+	fmt.Fprintln(conn, `{"type":"send","text":"from \"json\""}`)
+	fmt.Fprintln(conn, `{"type":"send","text":""}`)
+
+	jadeLines, _ := readUntilClosed(conn, reader, time.Now().Add(messageReceiveDelay))
+	kurtLines, _ := readUntilClosed(kurt, kurtReader, time.Now().Add(messageReceiveDelay/2))
+	jadeLines, kurtLines = append(jadeEarly, jadeLines...), append(kurtEarly, kurtLines...)
+
+	// every line is an object carrying all five fields
+	var messages []jsonMessage
+	wellFormed := len(jadeLines) > 0
+	for _, line := range jadeLines {
+		var fields map[string]json.RawMessage
+		var msg jsonMessage
+		if json.Unmarshal([]byte(line), &fields) != nil || json.Unmarshal([]byte(line), &msg) != nil {
+			wellFormed = false
+			continue
+		}
+		for _, key := range []string{"type", "from", "room", "ts", "text"} {
+			if _, ok := fields[key]; !ok {
+				wellFormed = false
+			}
+		}
+		messages = append(messages, msg)
+	}
+	is := func(s *string, want string) bool { return s != nil && *s == want }
+
+	joined := len(messages) > 0 && messages[0].Type == "ok"
+	// kurt's color is fixed by his name, whichever client shows him
+	received := slices.ContainsFunc(messages, func(m jsonMessage) bool {
+		return m.Type == "broadcast" && is(m.From, "kurt") && is(m.Room, "#json") &&
+			m.TS != nil && isoTimestamp.MatchString(*m.TS) && is(m.Text, "hi | there") && is(m.Color, "#0dbc79")
+	})
+	refused := slices.ContainsFunc(messages, func(m jsonMessage) bool {
+		return m.Type == "err" && m.Code == 400 && is(m.Reason, "empty-message") && is(m.Text, "empty message")
+	})
+	textClientUnaffected := slices.ContainsFunc(kurtLines, func(line string) bool {
+		return strings.HasPrefix(line, "BROADCAST|") && strings.HasSuffix(line, `|jade|from "json"`)
+	})
+
+	if wellFormed && joined && received && refused && textClientUnaffected {
+		return
+	}
+
+	t.Errorf("wellFormed=%v joined=%v received=%v refused=%v textClientUnaffected=%v",
+		wellFormed, joined, received, refused, textClientUnaffected)
+	t.Log("Jade's output:")
+	t.Log(strings.Join(jadeLines, "\n"))
+	t.Log("Kurt's output:")
+	t.Log(strings.Join(kurtLines, "\n"))
+}
+
+// testUserList checks that a JSON client is sent its room's whole roster
+// after joins and leaves, one snapshot for a burst of changes, and that text
+// clients never see one.
+func testUserList(t *testing.T) {
+	conn, reader, err := dial(testPort)
+	if err != nil {
+		t.Fatalf("could not connect: %v", err)
+	}
+	defer conn.Close()
+	fmt.Fprintln(conn, `{"type":"join","username":"lars"}`)
+	fmt.Fprintln(conn, `{"type":"room","room":"#roster"}`)
+
+	var textConns []net.Conn
+	var textReaders []*bufio.Reader
+	for _, username := range []string{"noor", "mira"} {
+		textConn, textReader, err := dialAndJoin(testPort, username)
+		if err != nil {
+			t.Fatalf("%s could not join: %v", username, err)
+		}
+		defer textConn.Close()
+		fmt.Fprintln(textConn, "ROOM|#roster")
+		textConns, textReaders = append(textConns, textConn), append(textReaders, textReader)
+	}
+
+	// reads lars's snapshots of #roster up to one listing exactly users
+	awaitSnapshot := func(users ...string) (int, bool) {
+		_ = conn.SetReadDeadline(time.Now().Add(responseTimeout))
+		seen := 0
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return seen, false
+			}
+			var msg jsonMessage
+			if json.Unmarshal([]byte(line), &msg) != nil || msg.Type != "userlist" || msg.Room == nil || *msg.Room != "#roster" {
+				continue
+			}
+			seen++
+			if slices.Equal(msg.Users, users) {
+				return seen, true
+			}
+		}
+	}
+
+	// three arrivals in quick succession, then one departure
+	snapshots, arrived := awaitSnapshot("lars", "mira", "noor")
+	fmt.Fprintln(textConns[1], "LEAVE")
+	_, departed := awaitSnapshot("lars", "noor")
+	textLines := handled(textConns[0], textReaders[0])
+
+	// lars may have been alone for the first, but not three times over
+	gathered := snapshots <= 2
+	textUnaffected := !slices.ContainsFunc(textLines, func(line string) bool {
+		return strings.HasPrefix(line, "USERLIST")
+	})
+
+	if arrived && departed && gathered && textUnaffected {
+		return
+	}
+	t.Errorf("arrived=%v departed=%v gathered=%v (%d snapshots) textUnaffected=%v",
+		arrived, departed, gathered, snapshots, textUnaffected)
+	t.Log("Noor's output:")
+	t.Log(strings.Join(textLines, "\n"))
+}
+
+// testCompression checks a framed connection that switches to deflate
+// before joining, and the client's --compress, in a room of their own.
+func testCompression(t *testing.T) {
+	conn, reader, hello, err := dialOn("tcp", net.JoinHostPort(testHost, testPort))
+	if err != nil {
+		t.Fatalf("could not connect: %v", err)
+	}
+	defer conn.Close()
+	conn.Write(frame("COMPRESS"))
+	// the answer is the last thing the server sends uncompressed
+	plain := readFramesUntil(conn, reader, "OK")
+	agreed := strings.Contains(hello, "deflate") && len(plain) == 1 && plain[0] == "OK"
+
+	compressed, err := flate.NewWriter(conn, flate.BestSpeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressed.Write(frame("JOIN|squeezy"))
+	compressed.Write(frame("ROOM|#squeeze"))
+	compressed.Flush()
+
+	clientOut, err := createTempFile()
+	if err != nil {
+		t.Fatal("failed to create temp file")
+	}
+	script := []string{"join #squeeze", "send squashed hello", "sleep 300"}
+	scripted := runClientScript(testPort, "squish", script, clientOut, 5*time.Second, "--compress") == nil
+
+	compressed.Write(frame("SEND|line one\nline two"))
+	compressed.Flush()
+	inflated := bufio.NewReader(flate.NewReader(reader))
+	frames := readFrames(conn, inflated, time.Now().Add(messageReceiveDelay))
+
+	joined := slices.Contains(frames, "OK")
+	heardClient := slices.ContainsFunc(frames, func(f string) bool {
+		return strings.HasPrefix(f, "BROADCAST|") && strings.HasSuffix(f, "|squish|squashed hello")
+	})
+	intact := slices.ContainsFunc(frames, func(f string) bool {
+		return strings.HasPrefix(f, "BROADCAST|") && strings.HasSuffix(f, "|squeezy|line one\nline two")
+	})
+
+	if agreed && joined && scripted && heardClient && intact {
+		return
+	}
+	t.Errorf("agreed=%v joined=%v scripted=%v heardClient=%v intact=%v",
+		agreed, joined, scripted, heardClient, intact)
+	t.Log("Squeezy's frames:")
+	t.Logf("%q\n", append(plain, frames...))
+	t.Log("Squish's output:")
+	t.Log(readFileContent(clientOut))
+}
+
+func testFraming(t *testing.T) {
+	conn, reader, err := dial(testPort)
+	if err != nil {
+		t.Fatalf("could not connect: %v", err)
+	}
+	defer conn.Close()
+	conn.Write(frame("JOIN|fern"))
+	conn.Write(frame("ROOM|#framed"))
+
+	gus, gusReader, err := dialAndJoin(testPort, "gus")
+	if err != nil {
+		t.Fatalf("gus could not join: %v", err)
+	}
+	defer gus.Close()
+	fmt.Fprintln(gus, "ROOM|#framed")
+	gusEarly := handled(gus, gusReader)
+
+	// split mid-header and mid-payload, so the server has to reassemble it
+	send := frame("SEND|line one\nline two")
+	for _, part := range [][]byte{send[:2], send[2:9], send[9:]} {
+		conn.Write(part)
+		time.Sleep(50 * time.Millisecond)
+	}
+	// an oversized frame is refused and skipped without losing the next one
+	conn.Write(frame("SEND|" + strings.Repeat("x", maxMsgLen+2000)))
+	conn.Write(frame("WHO"))
+
+	fernFrames := readFrames(conn, reader, time.Now().Add(messageReceiveDelay))
+	gusLines, _ := readUntilClosed(gus, gusReader, time.Now().Add(messageReceiveDelay/2))
+	gusLines = append(gusEarly, gusLines...)
+
+	joined := len(fernFrames) > 0 && fernFrames[0] == "OK"
+	intact := slices.ContainsFunc(fernFrames, func(f string) bool {
+		return strings.HasPrefix(f, "BROADCAST|") && strings.HasSuffix(f, "|fern|line one\nline two")
+	})
+	tooLong := slices.ContainsFunc(fernFrames, func(f string) bool { return strings.HasPrefix(f, "ERR|413|message-too-long|") })
+	stillReading := slices.ContainsFunc(fernFrames, func(f string) bool {
+		return strings.HasPrefix(f, "INFO|") && strings.Contains(f, "fern")
+	})
+	// a line client can't be handed a newline that would start a forged line
+	flattened := slices.ContainsFunc(gusLines, func(line string) bool {
+		return strings.HasPrefix(line, "BROADCAST|") && strings.HasSuffix(line, "|fern|line one line two")
+	}) && !slices.Contains(gusLines, "line two")
+
+	if joined && intact && tooLong && stillReading && flattened {
+		return
+	}
+
+	t.Errorf("joined=%v intact=%v tooLong=%v stillReading=%v flattened=%v",
+		joined, intact, tooLong, stillReading, flattened)
+	t.Log("Fern's frames:")
+	t.Logf("%q\n", fernFrames)
+	t.Log("Gus's output:")
+	t.Log(strings.Join(gusLines, "\n"))
+}
+
+func testDeliveryAck(t *testing.T) {
+	watcher, watcherReader, err := dialAndJoin(testPort, "ackwatch")
+	if err != nil {
+		t.Fatalf("ackwatch could not join: %v", err)
+	}
+	defer watcher.Close()
+
+	sender, senderReader, err := dialAndJoin(testPort, "ackbot")
+	if err != nil {
+		t.Fatalf("ackbot could not join: %v", err)
+	}
+	defer sender.Close()
+
+	// ids are opaque, so one that looks like anything else comes back as is
+	var batch strings.Builder
+	fmt.Fprintf(&batch, "SENDID|ok 1|hello|world\nSEND|no id\nSENDID|long|%s\nSENDID|empty|\n",
+		strings.Repeat("x", maxMsgLen+1))
+	const flood = 2 * rateBurst
+	for i := 0; i < flood; i++ {
+		fmt.Fprintf(&batch, "SENDID|f%d|flood %d\n", i, i)
+	}
+	if _, err := sender.Write([]byte(batch.String())); err != nil {
+		t.Fatal("failed to send")
+	}
+
+	senderLines, _ := readUntilClosed(sender, senderReader, time.Now().Add(messageReceiveDelay))
+	watcherLines, _ := readUntilClosed(watcher, watcherReader, time.Now().Add(messageReceiveDelay/2))
+	senderOutput := strings.Join(senderLines, "\n")
+	watcherOutput := strings.Join(watcherLines, "\n")
+
+	acked := strings.Contains(senderOutput, "ACK|ok 1") && strings.Contains(watcherOutput, "|ackbot|hello|world")
+	// one reply per id, none for the plain SEND
+	replies := 0
+	for _, line := range senderLines {
+		if strings.HasPrefix(line, "ACK|") || strings.HasPrefix(line, "NACK|") {
+			replies++
+		}
+	}
+	noIDNoReply := replies == flood+3
+	refused := strings.Contains(senderOutput, "NACK|long|413|message-too-long|message too long") &&
+		strings.Contains(senderOutput, "NACK|empty|400|empty-message|empty message")
+
+	// every flood id is answered exactly once, some of them as rate limited
+	answered, limited := 0, 0
+	for i := 0; i < flood; i++ {
+		ack := fmt.Sprintf("ACK|f%d", i)
+		nack := fmt.Sprintf("NACK|f%d|429|rate-limited|rate limited, slow down", i)
+		hits := 0
+		for _, line := range senderLines {
+			if line == ack || line == nack {
+				hits++
+			}
+			if line == nack {
+				limited++
+			}
+		}
+		if hits == 1 {
+			answered++
+		}
+	}
+
+	if acked && noIDNoReply && refused && answered == flood && limited > 0 {
+		return
+	}
+
+	t.Errorf("acked=%v noIDNoReply=%v refused=%v answered=%d/%d limited=%d",
+		acked, noIDNoReply, refused, answered, flood, limited)
+	t.Log("Ackbot's output:")
+	t.Log(senderOutput)
+}
+
+// testDuplicateID checks that an id acked once is refused the second time,
+// as is one too long to track.
+func testDuplicateID(t *testing.T) {
+	conn, reader, err := dialAndJoin(testPort, "dupid")
+	if err != nil {
+		t.Fatalf("dupid could not join: %v", err)
+	}
+	defer conn.Close()
+
+	long := strings.Repeat("i", 65)
+	fmt.Fprintf(conn, "SENDID|d1|first\nSENDID|d1|second\nSENDID|%s|long id\nSENDID|d2|third\n", long)
+	lines, _ := readUntilClosed(conn, reader, time.Now().Add(messageReceiveDelay))
+	output := strings.Join(lines, "\n")
+
+	acked := slices.Contains(lines, "ACK|d1") && slices.Contains(lines, "ACK|d2")
+	duplicate := slices.Contains(lines, "NACK|d1|400|bad-request|duplicate-id")
+	tooLong := slices.Contains(lines, "NACK|"+long+"|400|bad-request|id-too-long")
+	// the refused line never reached the room
+	once := !strings.Contains(output, "|dupid|second")
+	if acked && duplicate && tooLong && once {
+		return
+	}
+	t.Errorf("acked=%v duplicate=%v tooLong=%v once=%v", acked, duplicate, tooLong, once)
+	t.Log("Dupid's output:")
+	t.Log(output)
+}
+
+func testEditDelete(t *testing.T) {
+	ivy, ivyReader, err := dialAndJoin(testPort, "ivy")
+	if err != nil {
+		t.Fatalf("ivy could not join: %v", err)
+	}
+	defer ivy.Close()
+	jon, jonReader, err := dialAndJoin(testPort, "jon")
+	if err != nil {
+		t.Fatalf("jon could not join: %v", err)
+	}
+	defer jon.Close()
+	fmt.Fprintln(ivy, "ROOM|#edits")
+	fmt.Fprintln(jon, "ROOM|#edits")
+	handled(jon, jonReader)
+	handled(ivy, ivyReader)
+
+	// the server numbers the line; its sender learns the id from the echo
+	fmt.Fprintln(ivy, "SEND|helo all")
+	var id string
+	for _, line := range handled(ivy, ivyReader) {
+		if fields := strings.SplitN(line, "|", 5); len(fields) == 5 && fields[0] == "BROADCAST" && fields[3] == "ivy" {
+			id = fields[2]
+		}
+	}
+	if id == "" {
+		t.Fatal("ivy's line came back without an id")
+	}
+
+	fmt.Fprintf(ivy, "EDIT|%s|hello all\n", id)
+	fmt.Fprintf(jon, "EDIT|%s|hijacked\n", id)
+	fmt.Fprintf(jon, "DELETE|%s\n", id)
+	jonEarly := handled(jon, jonReader)
+	fmt.Fprintf(ivy, "DELETE|%s\n", id)
+	fmt.Fprintf(ivy, "EDIT|%s|too late\n", id)
+	fmt.Fprintln(ivy, "DELETE|999999")
+
+	ivyLines, _ := readUntilClosed(ivy, ivyReader, time.Now().Add(messageReceiveDelay))
+	jonLines, _ := readUntilClosed(jon, jonReader, time.Now().Add(messageReceiveDelay/2))
+	jonLines = append(jonEarly, jonLines...)
+	has := func(lines []string, pattern string) bool {
+		re := regexp.MustCompile(pattern)
+		return slices.ContainsFunc(lines, re.MatchString)
+	}
+	count := func(lines []string, want string) int {
+		n := 0
+		for _, line := range lines {
+			if line == want {
+				n++
+			}
+		}
+		return n
+	}
+
+	edited := has(jonLines, `^EDITED\|[^|]+\|`+id+`\|ivy\|hello all$`)
+	deleted := has(jonLines, `^DELETED\|[^|]+\|`+id+`\|ivy$`)
+	othersRefused := count(jonLines, "ERR|403|cannot-edit|cannot edit") == 2 && !has(jonLines, `hijacked`)
+	// once deleted the line is gone for good, and so is one that never was
+	goneRefused := count(ivyLines, "ERR|403|cannot-edit|cannot edit") == 2 && !has(jonLines, `too late`)
+
+	if edited && deleted && othersRefused && goneRefused {
+		return
+	}
+
+	t.Errorf("edited=%v deleted=%v othersRefused=%v goneRefused=%v",
+		edited, deleted, othersRefused, goneRefused)
+	t.Log("Ivy's output:")
+	t.Log(strings.Join(ivyLines, "\n"))
+	t.Log("Jon's output:")
+	t.Log(strings.Join(jonLines, "\n"))
+}
+
+// testReplyTo checks that a reply carries the id of the line it answers to
+// JSON and text clients alike, and that one answering a line the room's
+// history doesn't have, or no longer has, is refused.
+func testReplyTo(t *testing.T) {
+	rue, rueReader, err := dial(testPort)
+	if err != nil {
+		t.Fatalf("could not connect: %v", err)
+	}
+	defer rue.Close()
+	fmt.Fprintln(rue, `{"type":"join","username":"rue"}`)
+	fmt.Fprintln(rue, `{"type":"room","room":"#threads"}`)
+	sid, sidReader, err := dialAndJoin(testPort, "sid")
+	if err != nil {
+		t.Fatalf("sid could not join: %v", err)
+	}
+	defer sid.Close()
+	fmt.Fprintln(sid, "ROOM|#threads")
+	fmt.Fprintln(rue, `{"type":"ping","token":"joined"}`)
+	readThrough(rue, rueReader, `"joined"`)
+	handled(sid, sidReader)
+
+	// sid learns the line's id from its echo
+	fmt.Fprintln(sid, "SEND|anyone up for lunch?")
+	var id string
+	for _, line := range handled(sid, sidReader) {
+		if fields := strings.SplitN(line, "|", 5); len(fields) == 5 && fields[0] == "BROADCAST" && fields[3] == "sid" {
+			id = fields[2]
+		}
+	}
+	if id == "" {
+		t.Fatal("sid's line came back without an id")
+	}
+	fmt.Fprintf(rue, `{"type":"send","reply_to":%q,"text":"me | too"}`+"\n", id)
+	fmt.Fprintln(rue, `{"type":"send","reply_to":"999999","text":"to nothing"}`)
+	fmt.Fprintln(rue, `{"type":"ping","token":"replied"}`)
+	rueEarly := readThrough(rue, rueReader, `"replied"`)
+	// only once the reply is in is the line taken back
+	fmt.Fprintf(sid, "DELETE|%s\n", id)
+	sidEarly := handled(sid, sidReader)
+	fmt.Fprintf(sid, "REPLY|%s|too late\n", id)
+
+	rueLines, _ := readUntilClosed(rue, rueReader, time.Now().Add(messageReceiveDelay))
+	sidLines, _ := readUntilClosed(sid, sidReader, time.Now().Add(messageReceiveDelay/2))
+	rueLines, sidLines = append(rueEarly, rueLines...), append(sidEarly, sidLines...)
+
+	var messages []jsonMessage
+	for _, line := range rueLines {
+		var msg jsonMessage
+		if json.Unmarshal([]byte(line), &msg) == nil {
+			messages = append(messages, msg)
+		}
+	}
+	is := func(s *string, want string) bool { return s != nil && *s == want }
+
+	jsonReply := slices.ContainsFunc(messages, func(m jsonMessage) bool {
+		return m.Type == "broadcast" && is(m.From, "rue") && is(m.ReplyTo, id) && is(m.Text, "me | too")
+	})
+	textReply := slices.ContainsFunc(sidLines, regexp.MustCompile(`^REPLY\|[^|]+\|[^|]+\|rue\|`+id+`\|me \| too$`).MatchString)
+	unknownRefused := slices.ContainsFunc(messages, func(m jsonMessage) bool {
+		return m.Type == "err" && m.Code == 404 && is(m.Reason, "no-such-message")
+	}) && !slices.ContainsFunc(sidLines, func(line string) bool { return strings.HasSuffix(line, "to nothing") })
+	deletedRefused := slices.Contains(sidLines, "ERR|404|no-such-message|no such message: "+id)
+
+	if jsonReply && textReply && unknownRefused && deletedRefused {
+		return
+	}
+
+	t.Errorf("jsonReply=%v textReply=%v unknownRefused=%v deletedRefused=%v",
+		jsonReply, textReply, unknownRefused, deletedRefused)
+	t.Log("Rue's output:")
+	t.Log(strings.Join(rueLines, "\n"))
+	t.Log("Sid's output:")
+	t.Log(strings.Join(sidLines, "\n"))
+}
+
+// testSequence checks that a JSON client and a text client that asked for
+// it with SEQ see the room's lines under the same, consecutive numbers.
+func testSequence(t *testing.T) {
+	una, unaReader, err := dial(testPort)
+	if err != nil {
+		t.Fatalf("could not connect: %v", err)
+	}
+	defer una.Close()
+	fmt.Fprintln(una, `{"type":"join","username":"una"}`)
+	fmt.Fprintln(una, `{"type":"room","room":"#numbered"}`)
+	vic, vicReader, err := dialAndJoin(testPort, "vic")
+	if err != nil {
+		t.Fatalf("vic could not join: %v", err)
+	}
+	defer vic.Close()
+	fmt.Fprintln(vic, "SEQ")
+	fmt.Fprintln(vic, "ROOM|#numbered")
+	fmt.Fprintln(una, `{"type":"ping","token":"joined"}`)
+	readThrough(una, unaReader, `"joined"`)
+	vicEarly := handled(vic, vicReader)
+
+	fmt.Fprintln(vic, "SEND|one")
+	handled(vic, vicReader)
+	fmt.Fprintln(una, `{"type":"send","text":"two"}`)
+	fmt.Fprintln(una, `{"type":"ping","token":"sent"}`)
+	unaEarly := readThrough(una, unaReader, `"sent"`)
+	fmt.Fprintln(vic, "SEND|three")
+
+	unaLines, _ := readUntilClosed(una, unaReader, time.Now().Add(messageReceiveDelay))
+	vicLines, _ := readUntilClosed(vic, vicReader, time.Now().Add(messageReceiveDelay/2))
+	unaLines, vicLines = append(unaEarly, unaLines...), append(vicEarly, vicLines...)
+
+	unaSeqs := map[string]uint64{}
+	for _, line := range unaLines {
+		var msg jsonMessage
+		if json.Unmarshal([]byte(line), &msg) == nil && msg.Type == "broadcast" && msg.Text != nil && msg.Seq != nil {
+			unaSeqs[*msg.Text] = *msg.Seq
+		}
+	}
+	vicSeqs := map[string]uint64{}
+	numbered := regexp.MustCompile(`^SEQ\|(\d+)\|BROADCAST\|[^|]+\|[^|]+\|[^|]+\|(.*)$`)
+	for _, line := range vicLines {
+		if m := numbered.FindStringSubmatch(line); m != nil {
+			seq, _ := strconv.ParseUint(m[1], 10, 64)
+			vicSeqs[m[2]] = seq
+		}
+	}
+
+	alike := len(unaSeqs) == 3 && maps.Equal(unaSeqs, vicSeqs)
+	consecutive := alike && unaSeqs["two"] == unaSeqs["one"]+1 && unaSeqs["three"] == unaSeqs["two"]+1
+	optedIn := slices.Contains(vicEarly, "OK")
+
+	if alike && consecutive && optedIn {
+		return
+	}
+
+	t.Errorf("alike=%v consecutive=%v optedIn=%v una=%v vic=%v", alike, consecutive, optedIn, unaSeqs, vicSeqs)
+	t.Log("Una's output:")
+	t.Log(strings.Join(unaLines, "\n"))
+	t.Log("Vic's output:")
+	t.Log(strings.Join(vicLines, "\n"))
+}
+
+// testClientSignals checks that a client sent SIGINT or SIGTERM leaves
+// the room cleanly and exits, rather than dropping.
+func testClientSignals(t *testing.T) {
+	watcher, watcherReader, err := dialAndJoin(testPort, "sigwatch")
+	if err != nil {
+		t.Fatalf("watcher could not join: %v", err)
+	}
+	defer watcher.Close()
+	fmt.Fprintln(watcher, "ROOM|#signals")
+	handled(watcher, watcherReader)
+
+	for _, tc := range []struct {
+		username string
+		signal   os.Signal
+	}{
+		{"sigint", os.Interrupt},
+		{"sigterm", syscall.SIGTERM},
+	} {
+		output, err := createTempFile()
+		if err != nil {
+			t.Fatal("failed to create temp file")
+		}
+		cmd, err := runClientBackground(tc.username, []string{"join #signals"}, output)
+		if err != nil {
+			t.Fatalf("failed to start %s: %v", tc.username, err)
+		}
+		if !waitForOutput(output, "You are now in #signals", responseTimeout) {
+			t.Fatalf("%s did not reach #signals:\n%s", tc.username, readFileContent(output))
+		}
+
+		_ = cmd.Process.Signal(tc.signal)
+		exited := make(chan error, 1)
+		go func() { exited <- cmd.Wait() }()
+		var cleanExit bool
+		select {
+		case err := <-exited:
+			cleanExit = err == nil
+		case <-time.After(5 * time.Second):
+			_ = cmd.Process.Kill()
+			<-exited
+		}
+
+		left, _ := readUntilClosed(watcher, watcherReader, time.Now().Add(messageReceiveDelay))
+		leftCleanly := slices.ContainsFunc(left, regexp.MustCompile(`^LEFT\|[^|]+\|`+tc.username+`\|#signals$`).MatchString)
+		content := readFileContent(output)
+		saidGoodbye := strings.Contains(content, "Goodbye!")
+
+		if !cleanExit || !leftCleanly || !saidGoodbye {
+			t.Errorf("%s: cleanExit=%v leftCleanly=%v saidGoodbye=%v\nwatcher: %s\nclient: %s", tc.username,
+				cleanExit, leftCleanly, saidGoodbye, strings.Join(left, "\n"), content)
+		}
+	}
+}
+
+// testResync checks that RESYNC replays the lines after the number given,
+// and only to whoever asked.
+func testResync(t *testing.T) {
+	wyn, wynReader, err := dialAndJoin(testPort, "wyn")
+	if err != nil {
+		t.Fatalf("wyn could not join: %v", err)
+	}
+	defer wyn.Close()
+	xia, xiaReader, err := dialAndJoin(testPort, "xia")
+	if err != nil {
+		t.Fatalf("xia could not join: %v", err)
+	}
+	defer xia.Close()
+	fmt.Fprintln(wyn, "SEQ")
+	fmt.Fprintln(wyn, "ROOM|#resync")
+	fmt.Fprintln(xia, "ROOM|#resync")
+	handled(wyn, wynReader)
+	handled(xia, xiaReader)
+
+	// wyn learns the numbers from its echoes
+	seqs := map[string]string{}
+	numbered := regexp.MustCompile(`^SEQ\|(\d+)\|BROADCAST\|[^|]+\|[^|]+\|wyn\|(.*)$`)
+	for _, text := range []string{"one", "two", "three"} {
+		fmt.Fprintln(wyn, "SEND|"+text)
+		for _, line := range handled(wyn, wynReader) {
+			if m := numbered.FindStringSubmatch(line); m != nil {
+				seqs[m[2]] = m[1]
+			}
+		}
+	}
+	if len(seqs) != 3 {
+		t.Fatalf("wyn's lines came back unnumbered: %v", seqs)
+	}
+	handled(xia, xiaReader)
+
+	fmt.Fprintln(wyn, "RESYNC|"+seqs["one"])
+	replayed := handled(wyn, wynReader)
+	fmt.Fprintln(wyn, "RESYNC|"+seqs["three"])
+	caughtUp := handled(wyn, wynReader)
+	xiaLines := handled(xia, xiaReader)
+
+	isReplay := func(text string) func(string) bool {
+		return func(line string) bool {
+			return strings.HasPrefix(line, "HISTORY|SEQ|"+seqs[text]+"|BROADCAST|") && strings.HasSuffix(line, "|wyn|"+text)
+		}
+	}
+	afterOne := len(replayed) == 2 && slices.ContainsFunc(replayed, isReplay("two")) &&
+		slices.ContainsFunc(replayed, isReplay("three"))
+	nothingLeft := slices.Contains(caughtUp, "INFO|Nothing to replay")
+	askerOnly := !slices.ContainsFunc(xiaLines, func(line string) bool { return strings.HasPrefix(line, "HISTORY|") })
+
+	if afterOne && nothingLeft && askerOnly {
+		return
+	}
+
+	t.Errorf("afterOne=%v nothingLeft=%v askerOnly=%v", afterOne, nothingLeft, askerOnly)
+	t.Log("Wyn's replay:")
+	t.Log(strings.Join(replayed, "\n"))
+	t.Log("Wyn's second replay:")
+	t.Log(strings.Join(caughtUp, "\n"))
+	t.Log("Xia's output:")
+	t.Log(strings.Join(xiaLines, "\n"))
+}
+
+func testAway(t *testing.T) {
+	kim, kimReader, err := dialAndJoin(testPort, "kim")
+	if err != nil {
+		t.Fatalf("kim could not join: %v", err)
+	}
+	defer kim.Close()
+	lou, louReader, err := dialAndJoin(testPort, "lou")
+	if err != nil {
+		t.Fatalf("lou could not join: %v", err)
+	}
+	defer lou.Close()
+	fmt.Fprintln(kim, "ROOM|#away")
+	fmt.Fprintln(lou, "ROOM|#away")
+	handled(lou, louReader)
+	handled(kim, kimReader)
+
+	fmt.Fprintln(kim, "AWAY|lunch")
+	handled(kim, kimReader)
+	fmt.Fprintln(lou, "WHO")
+	louAway := handled(lou, louReader)
+	// the next line brings kim back, before the line itself
+	fmt.Fprintln(kim, "SEND|back now")
+	handled(kim, kimReader)
+	fmt.Fprintln(lou, "WHO")
+	louBack := handled(lou, louReader)
+
+	has := func(lines []string, pattern string) bool {
+		return slices.ContainsFunc(lines, regexp.MustCompile(pattern).MatchString)
+	}
+	wentAway := has(louAway, `^PRESENCE\|[^|]+\|kim\|away\|lunch$`)
+	listedAway := has(louAway, `^INFO\|Online \(\d+\): .*\bkim \(away\)`)
+	back := slices.IndexFunc(louBack, regexp.MustCompile(`^PRESENCE\|[^|]+\|kim\|back$`).MatchString)
+	said := slices.IndexFunc(louBack, regexp.MustCompile(`^BROADCAST\|[^|]+\|\d+\|kim\|back now$`).MatchString)
+	cameBack := back >= 0 && said > back
+	listedBack := has(louBack, `^INFO\|Online \(\d+\): .*\bkim\b`) && !has(louBack, `kim \(away\)`)
+
+	if wentAway && listedAway && cameBack && listedBack {
+		return
+	}
+
+	t.Errorf("wentAway=%v listedAway=%v cameBack=%v listedBack=%v",
+		wentAway, listedAway, cameBack, listedBack)
+	t.Log("Lou's output:")
+	t.Log(strings.Join(append(louAway, louBack...), "\n"))
+}
+
+func testMute(t *testing.T) {
+	output, err := createTempFile()
+	if err != nil {
+		t.Fatal("failed to create temp file")
+	}
+	cmd, err := runClientBackground("muter", []string{"mute BO", "muted", "mute bo"}, output)
+	if err != nil {
+		t.Fatal("failed to start the client")
+	}
+	waitForOutput(output, "already muted", responseTimeout)
+
+	// joining after the mute, bo should still be seen arriving and leaving
+	muted, mutedReader, err := dialAndJoin(testPort, "bo")
+	if err != nil {
+		t.Fatalf("bo could not join: %v", err)
+	}
+	defer muted.Close()
+	other, otherReader, err := dialAndJoin(testPort, "cy")
+	if err != nil {
+		t.Fatalf("cy could not join: %v", err)
+	}
+	defer other.Close()
+
+	fmt.Fprint(muted, "SEND|from bo\nME|waves from bo\nDM|muter|psst from bo\n")
+	fmt.Fprintln(other, "SEND|from cy")
+	handled(muted, mutedReader)
+	handled(other, otherReader)
+	// dropped, bo is announced as gone once the session grace runs out
+	muted.Close()
+	time.Sleep(sessionGrace + messageReceiveDelay)
+
+	if cmd.Process != nil {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	}
+	content := readFileContent(output)
+
+	confirmed := strings.Contains(content, "Muted BO;") && strings.Contains(content, "Muted: bo") &&
+		strings.Contains(content, "bo is already muted.")
+	hidden := !strings.Contains(content, "from bo")
+	othersShown := strings.Contains(content, "[cy]: from cy")
+	presenceShown := strings.Contains(content, "*** bo joined #general ***") &&
+		strings.Contains(content, "*** bo disconnected from #general ***")
+
+	if confirmed && hidden && othersShown && presenceShown {
+		return
+	}
+
+	t.Errorf("confirmed=%v hidden=%v othersShown=%v presenceShown=%v",
+		confirmed, hidden, othersShown, presenceShown)
+	t.Log("Client output:")
+	t.Log(content)
+}
+
+func testDMHistory(t *testing.T) {
+	var conns [3]net.Conn
+	var readers [3]*bufio.Reader
+	for i, name := range []string{"dmalice", "dmbob", "dmcarol"} {
+		conn, reader, err := dialAndJoin(testPort, name)
+		if err != nil {
+			t.Fatalf("%s could not join: %v", name, err)
+		}
+		defer conn.Close()
+		conns[i], readers[i] = conn, reader
+	}
+	alice, bob, carol := conns[0], conns[1], conns[2]
+
+	alice.Write([]byte("DM|dmbob|secret one\n"))
+	aliceEarly := handled(alice, readers[0])
+	bob.Write([]byte("DM|dmalice|secret two\n"))
+	bobEarly := handled(bob, readers[1])
+	// names are matched regardless of case
+	bob.Write([]byte("DMHISTORY|DMALICE\n"))
+	carol.Write([]byte("DMHISTORY|dmalice\n"))
+
+	bobLines, _ := readUntilClosed(bob, readers[1], time.Now().Add(messageReceiveDelay))
+	bobLines = append(bobEarly, bobLines...)
+	carolLines, _ := readUntilClosed(carol, readers[2], time.Now().Add(messageReceiveDelay/2))
+	aliceLines, _ := readUntilClosed(alice, readers[0], time.Now().Add(messageReceiveDelay/2))
+	aliceLines = append(aliceEarly, aliceLines...)
+	bobOutput := strings.Join(bobLines, "\n")
+	carolOutput := strings.Join(carolLines, "\n")
+	aliceOutput := strings.Join(aliceLines, "\n")
+
+	replayed := strings.Contains(bobOutput, "HISTORY|DM|dmalice|dmbob|secret one") &&
+		strings.Contains(bobOutput, "HISTORY|DM|dmbob|dmalice|secret two")
+	none := strings.Contains(carolOutput, "INFO|No messages with dmalice")
+	private := !strings.Contains(carolOutput, "secret") && !strings.Contains(aliceOutput, "HISTORY|DM|")
+
+	if !replayed || !none || !private {
+		t.Fatalf("replayed: %v, none: %v, private: %v\nbob: %s\ncarol: %s\nalice: %s",
+			replayed, none, private, bobOutput, carolOutput, aliceOutput)
+	}
+}
+
+func testTimestamps(t *testing.T) {
+	output, err := createTempFile()
+	if err != nil {
+		t.Fatal("failed to create temp file")
+	}
+	_, err = runClientWithInputOn(testPort, "stamper", []string{"who", waitDirective + "Online in #", "ts off", "who", "leave"}, output,
+		3*time.Second, "--timestamps")
+	if err != nil {
+		t.Fatalf("failed to run the client: %v", err)
+	}
+
+	var stamped, plain bool
+	for _, line := range strings.Split(readFileContent(output), "\n") {
+		line = strings.TrimLeft(line, "\r> ")
+		if !strings.Contains(line, "Online in #") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.Contains(line, "] Online in #") {
+			stamped = true
+		} else if strings.HasPrefix(line, "Online in #") {
+			plain = true
+		}
+	}
+	if !stamped || !plain {
+		t.Fatalf("stamped: %v, plain after ts off: %v\n%s",
+			stamped, plain, readFileContent(output))
+	}
+}
+
+func testPing(t *testing.T) {
+	conn, reader, err := dialAndJoin(testPort, "prober")
+	if err != nil {
+		t.Fatalf("prober could not join: %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("PING|probe-1\n")); err != nil {
+		t.Fatalf("failed to send the probe: %v", err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	echoed := false
+	for !echoed {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			break
+		}
+		echoed = strings.TrimSpace(line) == "PONG|probe-1"
+	}
+	if !echoed {
+		t.Fatal("the server did not answer PING|probe-1 with PONG|probe-1")
+	}
+
+	output, err := createTempFile()
+	if err != nil {
+		t.Fatal("failed to create temp file")
+	}
+	err = runClientScript(testPort, "pinger", []string{"ping", "sleep 500"}, output, 3*time.Second)
+	if err != nil {
+		t.Fatalf("failed to run the client: %v", err)
+	}
+	content := readFileContent(output)
+	if !regexp.MustCompile(`Round-trip: \d+ms`).MatchString(content) {
+		t.Fatalf("no round trip in the client's output:\n%s", content)
+	}
+}
+
+func testScript(t *testing.T) {
+	listener, err := createTempFile()
+	if err != nil {
+		t.Fatal("failed to create temp file")
+	}
+	cmdListener, err := runClientBackground("scriptfan", []string{}, listener)
+	if err != nil {
+		t.Fatal("failed to start the listener")
+	}
+	defer func() {
+		_ = cmdListener.Process.Kill()
+		_ = cmdListener.Wait()
+	}()
+
+	output, err := createTempFile()
+	if err != nil {
+		t.Fatal("failed to create temp file")
+	}
+	script := []string{"# a comment", "send scripted hello", "sleep 200", "who"}
+	if err := runClientScript(testPort, "scripter", script, output, 5*time.Second); err != nil {
+		t.Fatalf("a clean script failed: %v\n%s", err, readFileContent(output))
+	}
+	waitForOutput(listener, "scripted hello", responseTimeout)
+	if !strings.Contains(readFileContent(listener), "[scripter]: scripted hello") ||
+		!strings.Contains(readFileContent(output), "Online in #") {
+		t.Fatalf("commands did not all run:\n%s", readFileContent(output))
+	}
+
+	// a name just left is kept a moment for its session, so not "scripter"
+	err = runClientScript(testPort, "rescripter", []string{"nick admin", "who"}, output, 5*time.Second)
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || !strings.Contains(readFileContent(output), "Online in #") {
+		t.Fatalf("a refused command did not fail the script after it ran: %v\n%s",
+			err, readFileContent(output))
+	}
+}
+
+func testSave(t *testing.T) {
+	output, err := createTempFile()
+	if err != nil {
+		t.Fatal("failed to create temp file")
+	}
+	transcript, err := createTempFile()
+	if err != nil {
+		t.Fatal("failed to create transcript file")
+	}
+	unwritable := filepath.Join(transcript+".missing", "chat.log")
+	script := []string{"who", "sleep 300", "save " + transcript, "save " + unwritable, "who", "sleep 300"}
+	if err := runClientScript(testPort, "saver", script, output, 5*time.Second); err != nil {
+		t.Fatalf("the script failed: %v\n%s", err, readFileContent(output))
+	}
+
+	// the first reply was saved, the second appended as it came in
+	stamped := regexp.MustCompile(`^\[\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2}[+-]\d{2}:\d{2}\] INFO\|Online \(`)
+	saved := 0
+	for _, line := range strings.Split(readFileContent(transcript), "\n") {
+		if stamped.MatchString(line) {
+			saved++
+		}
+	}
+	complained := strings.Contains(readFileContent(output), "Could not save to "+unwritable)
+	if saved != 2 || !complained {
+		t.Fatalf("saved=%d complained=%v\nTranscript:\n%s\nOutput:\n%s",
+			saved, complained, readFileContent(transcript), readFileContent(output))
+	}
+}
+
+func testJoinLeaveNotifications(t *testing.T) {
+	outputCharlie, err := createTempFile()
+	if err != nil {
+		t.Fatal("failed to create temp file")
+	}
+	outputDave, err := createTempFile()
+	if err != nil {
+		t.Fatal("failed to create temp file")
+	}
+	outputErica, err := createTempFile()
+	if err != nil {
+		t.Fatal("failed to create temp file")
+	}
+
+	cmdCharlie, err := runClientBackground("charlie", []string{}, outputCharlie)
+	if err != nil {
+		t.Fatal("failed to start Charlie")
+	}
+	cmdErica, err := runClientBackground("erica", []string{"quiet"}, outputErica)
+	if err != nil {
+		t.Fatal("failed to start Erica")
+	}
+	waitForOutput(outputErica, "Hiding joins and leaves", responseTimeout)
+
+	daveInputs := []string{"leave"}
+	_, err = runClientWithInput("dave", daveInputs, outputDave, 2*time.Second)
+	if err != nil {
+		t.Fatal("failed to run Dave")
+	}
+
+	// with leaves off this waits out the timeout, and finds nothing
+	waitForOutput(outputCharlie, "dave left", responseTimeout)
+
+	// fay's connection just drops, so she is gone once her session runs out
+	fay, _, err := dialAndJoin(testPort, "fay")
+	if err != nil {
+		t.Fatalf("fay could not join: %v", err)
+	}
+	fay.Close()
+	waitForOutput(outputCharlie, "fay disconnected from #general", sessionGrace+responseTimeout)
+
+	for _, cmd := range []*exec.Cmd{cmdCharlie, cmdErica} {
+		if cmd.Process != nil {
+			_ = cmd.Process.Kill()
+			_ = cmd.Wait()
+		}
+	}
+
+	charlieContent := readFileContent(outputCharlie)
+	daveContent := readFileContent(outputDave)
+	ericaContent := readFileContent(outputErica)
+
+	// the shared server takes CHAT_NOTIFY from the environment the tests run in
+	joined := strings.Contains(charlieContent, "dave joined") || containsIgnoreCase(charlieContent, "JOINED dave")
+	// Dave's client waits for the server's goodbye, which follows the notice to the room
+	left := strings.Contains(charlieContent, "*** dave left #general ***")
+	dropped := strings.Contains(charlieContent, "*** fay disconnected from #general ***") &&
+		!strings.Contains(charlieContent, "fay left")
+	acknowledged := strings.Contains(daveContent, "Goodbye!") && !strings.Contains(daveContent, "Warning")
+	quiet := !strings.Contains(ericaContent, "dave joined") && !strings.Contains(ericaContent, "dave left")
+
+	if joined == notifies("join") && left == notifies("leave") && dropped == notifies("leave") && acknowledged && quiet {
+		return
+	}
+
+	t.Errorf("joined=%v left=%v dropped=%v acknowledged=%v quiet=%v (CHAT_NOTIFY=%q)",
+		joined, left, dropped, acknowledged, quiet, os.Getenv("CHAT_NOTIFY"))
+	t.Log("Charlie's output:")
+	t.Log(charlieContent)
+	t.Log("Dave's output:")
+	t.Log(daveContent)
+	t.Log("Erica's output:")
+	t.Log(ericaContent)
+}
+
+// notifies reports whether the shared server announces kind, "join" or
+// "leave", under the CHAT_NOTIFY it inherited; both are on when it is unset.
+func notifies(kind string) bool {
+	setting, ok := os.LookupEnv("CHAT_NOTIFY")
+	if !ok {
+		return true
+	}
+	for _, listed := range strings.Split(setting, ",") {
+		if strings.EqualFold(strings.TrimSpace(listed), kind) {
+			return true
+		}
+	}
+	return false
+}
+
+func testInvalidUsername(t *testing.T) {
+	output, err := createTempFile()
+	if err != nil {
+		t.Fatal("failed to create temp file")
+	}
+
+	// the client refuses bad names itself, before connecting
+	_, _ = runClientWithInput("bad name", []string{"leave"}, output, 2*time.Second)
+	content := readFileContent(output)
+	if strings.Contains(content, "Joined") || !containsIgnoreCase(content, "invalid username") {
+		t.Error("client did not reject 'bad name'")
+		t.Log(content)
+		return
+	}
+
+	// the server gives the specific reason to anyone who skips that check
+	cases := map[string]string{
+		"":                      "ERR|400|invalid-username|invalid username: empty",
+		strings.Repeat("a", 33): "ERR|400|invalid-username|invalid username: longer than 32 characters",
+		"bad name":              "ERR|400|invalid-username|invalid username: contains whitespace",
+		"bad\x01name":           "ERR|400|invalid-username|invalid username: contains control characters",
+		"bad@name":              "ERR|400|invalid-username|invalid username: '@' is not allowed, only letters, digits, '_' and '-'",
+	}
+	for username, want := range cases {
+		conn, _, err := dialAndJoin(testPort, username)
+		if err == nil {
+			conn.Close()
+			t.Fatalf("%q was accepted", username)
+		}
+		if !strings.Contains(err.Error(), want) {
+			t.Fatalf("%q: got %v, want %s", username, err, want)
+		}
+	}
+
+	conn, _, err := dialAndJoin(testPort, "good-name_1")
+	if err != nil {
+		t.Fatalf("valid name refused: %v", err)
+	}
+	conn.Close()
+
+}
+
+func testSendCommand(t *testing.T) {
+	output, err := createTempFile()
+	if err != nil {
+		t.Fatal("failed to create temp file")
+	}
+
+	inputs := []string{"send Test message 123", "leave"}
+	_, err = runClientWithInput("sender", inputs, output, 5*time.Second)
+	if err != nil {
+		t.Fatal("failed to run client")
+	}
+
+	content := readFileContent(output)
+
+	hasNoSendError := !containsIgnoreCase(content, "Failed to send")
+	joinedSuccessfully := joinedAs(content, "sender")
+
+	if (strings.Contains(content, "Goodbye") || joinedSuccessfully) && hasNoSendError {
+		return
+	}
+
+	t.Error("sender did not join, or a send failed")
+	t.Log(content)
+}
+
+func testEmptySend(t *testing.T) {
+	otto, ottoReader, err := dialAndJoin(testPort, "otto")
+	if err != nil {
+		t.Fatalf("otto could not join: %v", err)
+	}
+	defer otto.Close()
+	fmt.Fprintln(otto, "ROOM|#blank")
+	handled(otto, ottoReader)
+
+	// from the client, as typed, then straight onto the wire
+	output, err := createTempFile()
+	if err != nil {
+		t.Fatal("failed to create temp file")
+	}
+	inputs := []string{"join #blank", "send ", waitDirective + "empty message", "send    ", "send after", "leave"}
+	if _, err := runClientWithInput("ena", inputs, output, 5*time.Second); err != nil {
+		t.Fatalf("failed to run the client: %v", err)
+	}
+	raw, rawReader, err := dialAndJoin(testPort, "ned")
+	if err != nil {
+		t.Fatalf("ned could not join: %v", err)
+	}
+	defer raw.Close()
+	fmt.Fprint(raw, "ROOM|#blank\nSEND\nSEND|\nSEND|   \nSENDID|b|  \n")
+	nedLines := handled(raw, rawReader)
+	ottoLines := handled(otto, ottoReader)
+
+	blank := regexp.MustCompile(`^BROADCAST\|[^|]*\|[^|]*\|[^|]*\|\s*$`)
+	clientRefused := strings.Count(readFileContent(output), "empty message") == 2
+	rawRefused := slices.Equal(slices.DeleteFunc(slices.Clone(nedLines), func(line string) bool {
+		return !strings.HasPrefix(line, "ERR|") && !strings.HasPrefix(line, "NACK|")
+	}), []string{"ERR|400|empty-message|empty message", "ERR|400|empty-message|empty message", "ERR|400|empty-message|empty message", "NACK|b|400|empty-message|empty message"})
+	noBlank := !slices.ContainsFunc(ottoLines, blank.MatchString)
+	after := slices.ContainsFunc(ottoLines, func(line string) bool {
+		return strings.HasSuffix(line, "|ena|after")
+	})
+
+	if clientRefused && rawRefused && noBlank && after {
+		return
+	}
+
+	t.Errorf("clientRefused=%v rawRefused=%v noBlank=%v after=%v", clientRefused, rawRefused, noBlank, after)
+	t.Log("Ena's output:")
+	t.Log(readFileContent(output))
+	t.Logf("Ned's lines: %q\nOtto's lines: %q", nedLines, ottoLines)
+}
+
+func testServerResilience(t *testing.T) {
+	for i := 1; i <= 3; i++ {
+		output, err := createTempFile()
+		if err != nil {
+			t.Logf("iteration %d: temp file error (non-fatal)", i)
+			continue
+		}
+		username := fmt.Sprintf("resilience_user_%d", i)
+		if _, err := runClientWithInput(username, []string{"leave"}, output, 2*time.Second); err != nil {
+			t.Logf("iteration %d: client error (non-fatal)", i)
+		}
+	}
+
+	output, err := createTempFile()
+	if err != nil {
+		t.Fatal("failed to create temp file")
+	}
+
+	_, err = runClientWithInput("final_test_user", []string{"leave"}, output, 2*time.Second)
+	if err != nil {
+		t.Fatal("failed to run final client")
+	}
+
+	content := readFileContent(output)
+	if joinedAs(content, "final_test_user") {
+		return
+	}
+
+	t.Error("server may have crashed")
+	t.Log(content)
+}
+
+func testClientEnv(t *testing.T) {
+	// the harness hands the client CHAT_USERNAME=envuser; the flag beats it
+	output, err := createTempFile()
+	if err != nil {
+		t.Fatal("failed to create temp file")
+	}
+	_, err = runClientWithInputOn(testPort, "envuser", []string{"who", waitDirective + "Online in #", "leave"}, output,
+		3*time.Second, "--username", "flaguser")
+	if err != nil {
+		t.Fatalf("failed to run the client: %v", err)
+	}
+
+	content := readFileContent(output)
+	if joinedAs(content, "flaguser") && onlineListIncludes(content, "flaguser") &&
+		!strings.Contains(content, "envuser") {
+		return
+	}
+	t.Error("--username did not take precedence over CHAT_USERNAME")
+	t.Log(content)
+}
+
+func testJoinedLine(t *testing.T) {
+	outputs := make(map[string]string)
+	for _, run := range []struct {
+		username string
+		args     []string
+	}{
+		{"joinline_json", []string{"--json"}},
+		{"joinline_welcome", []string{"--welcome"}},
+	} {
+		output, err := createTempFile()
+		if err != nil {
+			t.Fatal("failed to create temp file")
+		}
+		if err := runClientScript(testPort, run.username, []string{"leave"}, output, 5*time.Second, run.args...); err != nil {
+			t.Fatalf("%s: %v", run.username, err)
+		}
+		outputs[run.username] = readFileContent(output)
+	}
+
+	jsonOutput := outputs["joinline_json"]
+	welcomeOutput := outputs["joinline_welcome"]
+	jsonLine := strings.Contains(jsonOutput, `{"type":"joined","username":"joinline_json"}`) && !strings.Contains(jsonOutput, joinedMarker)
+	welcomed := strings.Contains(welcomeOutput, "Joined as 'joinline_welcome'. Commands:") && !joinedAs(welcomeOutput, "joinline_welcome")
+
+	if jsonLine && welcomed {
+		return
+	}
+	t.Errorf("jsonLine=%v welcomed=%v", jsonLine, welcomed)
+	t.Log("JSON client's output:")
+	t.Log(jsonOutput)
+	t.Log("Welcomed client's output:")
+	t.Log(welcomeOutput)
+}
+
+// testClearCommand checks that clear and --status-line leave piped output
+// alone: not one escape code, and the client carries on as before.
+func testClearCommand(t *testing.T) {
+	output, err := createTempFile()
+	if err != nil {
+		t.Fatal("failed to create temp file")
+	}
+	// a room of its own, away from the other tests' traffic
+	script := []string{"join #clearing", "clear", "/clear", "send still here", "leave"}
+	if err := runClientScript(testPort, "clearing", script, output, 5*time.Second, "--status-line"); err != nil {
+		t.Fatal(err)
+	}
+	content := readFileContent(output)
+
+	plain := !strings.Contains(content, "\x1b")
+	carriedOn := joinedAs(content, "clearing") && strings.Contains(content, " sent #")
+	if plain && carriedOn {
+		return
+	}
+	t.Errorf("plain=%v carriedOn=%v", plain, carriedOn)
+	t.Log("Client's output:")
+	t.Log(content)
+}
+
+// testNameWidth checks that --name-width leaves names whole when the
+// client's output is not a terminal.
+func testNameWidth(t *testing.T) {
+	speakerOut, err := createTempFile()
+	if err != nil {
+		t.Fatal("failed to create temp file")
+	}
+	output, err := createTempFile()
+	if err != nil {
+		t.Fatal("failed to create temp file")
+	}
+
+	speaker, err := runClientBackground("bartholomew", []string{"join #narrow", "send a long name"}, speakerOut)
+	if err != nil {
+		t.Fatal("failed to start the speaker")
+	}
+	waitForOutput(speakerOut, " sent #", responseTimeout)
+
+	err = runClientScript(testPort, "narrow", []string{"join #narrow", "leave"}, output, 5*time.Second, "--name-width", "4")
+	if speaker.Process != nil {
+		_ = speaker.Process.Kill()
+		_ = speaker.Wait()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content := readFileContent(output)
+	if strings.Contains(content, "[bartholomew]: a long name") && !strings.Contains(content, "…") {
+		return
+	}
+	t.Error("name was not left whole in piped output")
+	t.Log("Client's output:")
+	t.Log(content)
+}
+
+// testAliases checks IRC-style commands, typed with a slash or in place of
+// a wire command's name, against the default aliases.
+func testAliases(t *testing.T) {
+	rhea, rheaReader, err := dialAndJoin(testPort, "rhea")
+	if err != nil {
+		t.Fatalf("rhea could not join: %v", err)
+	}
+	defer rhea.Close()
+	saul, saulReader, err := dialAndJoin(testPort, "saul")
+	if err != nil {
+		t.Fatalf("saul could not join: %v", err)
+	}
+	defer saul.Close()
+
+	fmt.Fprintln(rhea, "/w saul hi there")
+	fmt.Fprintln(rhea, "MSG|saul|again")
+	fmt.Fprintln(rhea, "/shrug")
+	rheaLines := handled(rhea, rheaReader)
+	saulLines := handled(saul, saulReader)
+
+	fmt.Fprintln(saul, "/quit")
+	closing, closed := readUntilClosed(saul, saulReader, time.Now().Add(responseTimeout))
+
+	whispered := slices.Contains(saulLines, "DM|rhea|saul|hi there") && slices.Contains(saulLines, "DM|rhea|saul|again")
+	unknown := slices.ContainsFunc(rheaLines, func(line string) bool {
+		return strings.HasPrefix(line, "ERR|400|unknown-command|") && strings.Contains(line, "/shrug")
+	})
+	quit := closed && slices.Contains(closing, "GOODBYE")
+	if whispered && unknown && quit {
+		return
+	}
+	t.Errorf("whispered=%v unknown=%v quit=%v", whispered, unknown, quit)
+	t.Log("Rhea's output:")
+	t.Log(strings.Join(rheaLines, "\n"))
+	t.Log("Saul's output:")
+	t.Log(strings.Join(append(saulLines, closing...), "\n"))
+}
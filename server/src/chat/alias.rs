@@ -0,0 +1,268 @@
+//! Other names for commands, so users coming from other chat tools can type
+//! `/msg bob hi`, `/w bob hi` or `/quit` and be understood.
+//!
+//! The table comes from `CHAT_ALIASES`, e.g. `msg=dm,w=dm,quit=leave`, which
+//! replaces [`DEFAULT_ALIASES`]; set it empty to have none. Each alias names
+//! a command as users type it: `dm`, `join` for a room, `leave` and so on.
+//!
+//! Aliases are resolved before a command is dispatched, whichever protocol
+//! it came in: a `/command` passed on as typed, whose arguments are split
+//! the way the client would have split them, or a wire command such as
+//! `MSG|bob|hi` or `{"type":"msg",...}`. A `/command` that is no alias but a
+//! command's own name, e.g. `/nick alice`, is taken as that command.
+
+use std::{collections::BTreeMap, str::FromStr};
+
+use common::{
+    consts,
+    json_message::WireFormat,
+    tcp_message::{ClientMessage, ClientParseError, WireDecode as _},
+};
+
+/// IRC's names for the commands, and some other chat tools'.
+pub const DEFAULT_ALIASES: &[(&str, &str)] = &[
+    ("msg", "dm"),
+    ("query", "dm"),
+    ("w", "dm"),
+    ("whisper", "dm"),
+    ("j", "join"),
+    ("names", "who"),
+    ("quit", "leave"),
+    ("exit", "leave"),
+];
+
+/// Each command as users type it, and the wire command it is.
+const COMMANDS: [(&str, &str); 25] = [
+    ("send", consts::CLIENT_SEND_CMD),
+    ("reply", consts::CLIENT_REPLY_CMD),
+    ("me", consts::CLIENT_ME_CMD),
+    ("edit", consts::CLIENT_EDIT_CMD),
+    ("delete", consts::CLIENT_DELETE_CMD),
+    ("away", consts::CLIENT_AWAY_CMD),
+    ("dm", consts::CLIENT_DM_CMD),
+    ("dm-history", consts::CLIENT_DM_HISTORY_CMD),
+    ("resync", consts::CLIENT_RESYNC_CMD),
+    ("join", consts::CLIENT_ROOM_CMD),
+    ("rooms", consts::CLIENT_ROOMS_CMD),
+    ("who", consts::CLIENT_WHO_CMD),
+    ("nick", consts::CLIENT_NICK_CMD),
+    ("auth", consts::CLIENT_AUTH_CMD),
+    ("kick", consts::CLIENT_KICK_CMD),
+    ("ban", consts::CLIENT_BAN_CMD),
+    ("unban", consts::CLIENT_UNBAN_CMD),
+    ("stats", consts::CLIENT_STATS_CMD),
+    ("who-all", consts::CLIENT_WHO_ALL_CMD),
+    ("conns", consts::CLIENT_CONNS_CMD),
+    ("drop", consts::CLIENT_DROP_CMD),
+    ("broadcast", consts::CLIENT_BROADCAST_CMD),
+    ("room-policy", consts::CLIENT_ROOM_POLICY_CMD),
+    ("help", consts::CLIENT_HELP_CMD),
+    ("leave", consts::CLIENT_LEAVE_CMD),
+];
+
+/// Wire commands whose first argument is a word of its own, ahead of text
+/// that may have spaces in it.
+const SPLIT_FIRST_WORD: [&str; 4] = [
+    consts::CLIENT_DM_CMD,
+    consts::CLIENT_REPLY_CMD,
+    consts::CLIENT_EDIT_CMD,
+    consts::CLIENT_ROOM_POLICY_CMD,
+];
+
+/// Aliases, in lower case, and the command each stands for, as typed.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct Aliases(BTreeMap<String, &'static str>);
+
+impl Default for Aliases {
+    fn default() -> Self {
+        Self(
+            DEFAULT_ALIASES
+                .iter()
+                .filter_map(|&(alias, name)| Some((alias.to_string(), typed_name(name)?)))
+                .collect(),
+        )
+    }
+}
+
+impl FromStr for Aliases {
+    type Err = String;
+
+    /// `alias=command` pairs, comma separated; empty for none.
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        let mut aliases = BTreeMap::new();
+        for pair in s.split(',').map(str::trim).filter(|pair| !pair.is_empty()) {
+            let Some((alias, name)) = pair.split_once('=') else {
+                return Err(format!("{pair:?} is not alias=command"));
+            };
+            let alias = alias.trim().trim_start_matches('/').to_lowercase();
+            if alias.is_empty() || alias.contains(|c: char| c.is_whitespace() || c == '|') {
+                return Err(format!("{pair:?} does not name an alias"));
+            }
+            if wire_command(&alias).is_some() || is_wire_command(&alias) {
+                return Err(format!("{alias:?} is a command already"));
+            }
+            let name = name.trim().trim_start_matches('/').to_lowercase();
+            let Some(name) = typed_name(&name) else {
+                return Err(format!("{name:?} is not a command"));
+            };
+            aliases.insert(alias, name);
+        }
+        Ok(Self(aliases))
+    }
+}
+
+impl Aliases {
+    /// Decodes `buf` as `format` does, resolving any alias, or `/command`
+    /// passed on as typed, to the command it stands for.
+    pub fn decode(&self, format: WireFormat, buf: &[u8]) -> Result<ClientMessage, ClientParseError> {
+        match format.decode_client(buf) {
+            Ok(ClientMessage::Typed { command, args }) => self.typed(&command, &args),
+            Err(ClientParseError::UnknownCommand(name)) => match self.0.get(&name.to_lowercase()) {
+                Some(&typed) => format.decode_client(&renamed(format, buf, wire_command(typed).unwrap_or(typed))),
+                None => Err(ClientParseError::UnknownCommand(name)),
+            },
+            decoded => decoded,
+        }
+    }
+
+    /// The aliases by command, for `help`, e.g. `/msg, /w for dm`; `None`
+    /// when there are none.
+    pub fn summary(&self) -> Option<String> {
+        let mut by_command: BTreeMap<&str, Vec<String>> = BTreeMap::new();
+        for (alias, &name) in &self.0 {
+            by_command.entry(name).or_default().push(format!("/{alias}"));
+        }
+        let groups: Vec<String> = by_command
+            .into_iter()
+            .map(|(name, aliases)| format!("{} for {name}", aliases.join(", ")))
+            .collect();
+        (!groups.is_empty()).then(|| groups.join("; "))
+    }
+
+    /// Decodes `/command args` as the command it names, its arguments split
+    /// into fields as the client splits them.
+    fn typed(&self, command: &str, args: &str) -> Result<ClientMessage, ClientParseError> {
+        let lower = command.to_lowercase();
+        let wire = self
+            .0
+            .get(&lower)
+            .copied()
+            .or_else(|| typed_name(&lower))
+            .and_then(wire_command)
+            .ok_or_else(|| ClientParseError::UnknownCommand(format!("/{command}")))?;
+        let args = args.trim();
+        let line = match args.split_once(char::is_whitespace) {
+            _ if args.is_empty() => wire.to_string(),
+            Some((first, rest)) if SPLIT_FIRST_WORD.contains(&wire) => [wire, first, rest.trim_start()].join("|"),
+            _ => [wire, args].join("|"),
+        };
+        ClientMessage::decode(line.as_bytes())
+    }
+}
+
+/// `name` as it appears in [`COMMANDS`], so it can be kept as `'static`.
+fn typed_name(name: &str) -> Option<&'static str> {
+    COMMANDS
+        .iter()
+        .find(|(typed, _)| *typed == name)
+        .map(|(typed, _)| *typed)
+}
+
+/// The wire command for the command typed as `name`.
+fn wire_command(name: &str) -> Option<&'static str> {
+    COMMANDS.iter().find(|(typed, _)| *typed == name).map(|(_, wire)| *wire)
+}
+
+/// Whether the text protocol takes `name` as a command of its own, so an
+/// alias of that name would never be reached.
+fn is_wire_command(name: &str) -> bool {
+    !matches!(
+        ClientMessage::decode(name.as_bytes()),
+        Err(ClientParseError::UnknownCommand(_))
+    )
+}
+
+/// `buf` with its command replaced by `command`.
+fn renamed(format: WireFormat, buf: &[u8], command: &str) -> Vec<u8> {
+    match format {
+        WireFormat::Text => {
+            let line = String::from_utf8_lossy(buf);
+            match line.trim().split_once('|') {
+                Some((_, rest)) => format!("{command}|{rest}").into_bytes(),
+                None => command.as_bytes().to_vec(),
+            }
+        }
+        WireFormat::Json => {
+            let Ok(mut value) = serde_json::from_slice::<serde_json::Value>(buf) else {
+                return buf.to_vec();
+            };
+            if let Some(object) = value.as_object_mut() {
+                object.insert("type".to_string(), command.to_lowercase().into());
+            }
+            serde_json::to_vec(&value).unwrap_or_else(|_| buf.to_vec())
+        }
+    }
+}
+
+#[cfg(test)]
+#[allow(clippy::unwrap_used)]
+mod tests {
+    use super::*;
+
+    fn whisper() -> ClientMessage {
+        ClientMessage::Direct {
+            to: "bob".to_string(),
+            message: "hi there".to_string(),
+        }
+    }
+
+    #[test]
+    fn test_typed_and_wire_aliases() {
+        let aliases = Aliases::default();
+        let text = |line: &str| aliases.decode(WireFormat::Text, line.as_bytes());
+        assert_eq!(text("/w bob hi there").unwrap(), whisper());
+        assert_eq!(text("/MSG|bob  hi there").unwrap(), whisper());
+        assert_eq!(text("msg|bob|hi there").unwrap(), whisper());
+        assert_eq!(text("dm|bob|hi there").unwrap(), whisper());
+        assert_eq!(text("/dm bob hi there").unwrap(), whisper());
+        assert_eq!(text("/quit").unwrap(), ClientMessage::Leave);
+        assert_eq!(
+            text("/nick alice").unwrap(),
+            ClientMessage::Nick {
+                username: "alice".to_string()
+            }
+        );
+        assert_eq!(
+            text("/j #dev").unwrap(),
+            ClientMessage::JoinRoom {
+                room: "#dev".to_string()
+            }
+        );
+        assert!(matches!(text("/shrug"), Err(ClientParseError::UnknownCommand(c)) if c == "/shrug"));
+        assert!(matches!(text("/w bob"), Err(ClientParseError::MissingField(_))));
+
+        let json = |line: &str| aliases.decode(WireFormat::Json, line.as_bytes());
+        assert_eq!(json(r#"{"type":"/w","text":"bob hi there"}"#).unwrap(), whisper());
+        assert_eq!(
+            json(r#"{"type":"msg","to":"bob","text":"hi there"}"#).unwrap(),
+            whisper()
+        );
+        assert!(json(r#"{"type":"shrug"}"#).is_err());
+    }
+
+    #[test]
+    fn test_parse_aliases() {
+        let aliases: Aliases = "tell=dm, /bye=leave".parse().unwrap();
+        assert_eq!(aliases.decode(WireFormat::Text, b"/bye").unwrap(), ClientMessage::Leave);
+        assert!(aliases.decode(WireFormat::Text, b"/quit").is_err());
+        assert_eq!(aliases.summary().as_deref(), Some("/tell for dm; /bye for leave"));
+
+        let none: Aliases = "".parse().unwrap();
+        assert_eq!(none.summary(), None);
+        assert!("tell".parse::<Aliases>().is_err());
+        assert!("tell=shout".parse::<Aliases>().is_err());
+        assert!("who=dm".parse::<Aliases>().is_err());
+        assert!("ping=dm".parse::<Aliases>().is_err());
+        assert!("a b=dm".parse::<Aliases>().is_err());
+    }
+}
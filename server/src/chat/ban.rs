@@ -0,0 +1,148 @@
+//! Usernames and addresses that may not join.
+//!
+//! The list is kept by the configured [`Store`], so whether bans survive a
+//! restart is up to it: the default store keeps them in `CHAT_BANFILE` when
+//! that is set. Checks are answered from a copy held here.
+
+use std::{
+    collections::HashMap,
+    net::IpAddr,
+    sync::{Arc, LazyLock},
+    time::Duration,
+};
+
+use parking_lot::Mutex;
+use thiserror::Error as this_error;
+use tracing::warn;
+
+use super::{
+    store::{self, Store, get_store},
+    string as my_string,
+    user::Username,
+};
+
+const LOCK_TIMEOUT: Duration = Duration::from_millis(50);
+
+static BAN_LIST: LazyLock<BanList> = LazyLock::new(|| BanList::load(get_store()));
+
+pub fn get_ban_list() -> &'static BanList {
+    &BAN_LIST
+}
+
+#[derive(Debug, this_error)]
+pub enum Error {
+    #[error("{0} is not banned")]
+    NotBanned(Username),
+
+    #[error("could not save ban list: {0}")]
+    Store(#[from] store::Error),
+
+    #[error("ban list lock timeout")]
+    LockTimeout,
+}
+
+#[derive(Debug)]
+pub struct BanList {
+    store: Arc<dyn Store>,
+    // keyed by lowercased username, with the address it was banned from
+    bans: Mutex<HashMap<String, Option<IpAddr>>>,
+}
+
+impl BanList {
+    /// Reads the bans `store` keeps; if it can't, starts with none.
+    pub fn load(store: Arc<dyn Store>) -> Self {
+        let bans = store.bans().unwrap_or_else(|e| {
+            warn!("Cannot read bans: {e}");
+            HashMap::new()
+        });
+        Self {
+            store,
+            bans: Mutex::new(bans),
+        }
+    }
+
+    pub fn is_banned(&self, username: &Username, addr: IpAddr) -> Result<bool, Error> {
+        let bans = self.bans.try_lock_for(LOCK_TIMEOUT).ok_or(Error::LockTimeout)?;
+        Ok(bans.contains_key(&key(username)) || bans.values().any(|ip| *ip == Some(addr)))
+    }
+
+    /// Bans `username`, and `addr` too when known, saving the ban first so
+    /// it is never enforced without being persisted.
+    pub fn ban(&self, username: &Username, addr: Option<IpAddr>) -> Result<(), Error> {
+        let mut bans = self.bans.try_lock_for(LOCK_TIMEOUT).ok_or(Error::LockTimeout)?;
+        self.store.add_ban(&key(username), addr)?;
+        bans.insert(key(username), addr);
+        drop(bans);
+        Ok(())
+    }
+
+    /// Lifts the ban on `username` along with the address banned with it.
+    pub fn unban(&self, username: &Username) -> Result<(), Error> {
+        let mut bans = self.bans.try_lock_for(LOCK_TIMEOUT).ok_or(Error::LockTimeout)?;
+        if !bans.contains_key(&key(username)) {
+            return Err(Error::NotBanned(username.clone()));
+        }
+        self.store.remove_ban(&key(username))?;
+        bans.remove(&key(username));
+        drop(bans);
+        Ok(())
+    }
+}
+
+fn key(username: &Username) -> String {
+    my_string::to_lowercase(&username.to_string())
+}
+
+#[cfg(test)]
+#[allow(clippy::unwrap_used)]
+mod tests {
+    use std::{fs, net::Ipv4Addr, path::PathBuf};
+
+    use super::*;
+    use crate::chat::store::MemoryStore;
+
+    const ADDR: IpAddr = IpAddr::V4(Ipv4Addr::new(10, 0, 0, 7));
+    const OTHER: IpAddr = IpAddr::V4(Ipv4Addr::new(10, 0, 0, 8));
+
+    fn user(name: &str) -> Username {
+        Username::new(name).unwrap()
+    }
+
+    fn temp_path(name: &str) -> PathBuf {
+        std::env::temp_dir().join(format!("chat-bans-{}-{name}", std::process::id()))
+    }
+
+    fn load(path: Option<PathBuf>) -> BanList {
+        BanList::load(Arc::new(MemoryStore::new(path)))
+    }
+
+    #[test]
+    fn test_ban_matches_username_or_addr() {
+        let bans = load(None);
+        bans.ban(&user("Mallory"), Some(ADDR)).unwrap();
+
+        assert!(bans.is_banned(&user("mallory"), OTHER).unwrap());
+        assert!(bans.is_banned(&user("alice"), ADDR).unwrap());
+        assert!(!bans.is_banned(&user("alice"), OTHER).unwrap());
+
+        bans.unban(&user("MALLORY")).unwrap();
+        assert!(!bans.is_banned(&user("mallory"), ADDR).unwrap());
+        assert!(matches!(bans.unban(&user("mallory")), Err(Error::NotBanned(_))));
+    }
+
+    #[test]
+    fn test_bans_persist() {
+        let path = temp_path("persist");
+        let _ = fs::remove_file(&path);
+
+        let bans = load(Some(path.clone()));
+        bans.ban(&user("mallory"), Some(ADDR)).unwrap();
+        bans.ban(&user("trent"), None).unwrap();
+        bans.unban(&user("trent")).unwrap();
+
+        let reloaded = load(Some(path.clone()));
+        assert!(reloaded.is_banned(&user("alice"), ADDR).unwrap());
+        assert!(!reloaded.is_banned(&user("trent"), OTHER).unwrap());
+        fs::remove_file(&path).unwrap();
+    }
+}
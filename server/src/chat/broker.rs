@@ -1,17 +1,25 @@
-use std::sync::{
-    Arc, LazyLock,
-    atomic::{AtomicBool, Ordering},
+use std::{
+    sync::{
+        Arc, LazyLock,
+        atomic::{AtomicBool, AtomicU64, Ordering},
+    },
+    time::Duration,
 };
 
 use common::consts;
 use tokio::{sync::Mutex, task::JoinHandle};
-use tracing::info;
+use tracing::{debug, info, warn};
 
 use crate::chat::{
-    room::{Error as RoomError, MessageQueue, MessageReceiver, OneToMany, OneToOne, RecvError, get_room},
-    user::{UserRegistry, get_registry},
+    channel::ChannelName,
+    clock::{Clock, get_clock},
+    room::{Error as RoomError, MessageQueue, MessageReceiver as _, OneToMany, OneToOne, RecvError, get_room},
+    user::{Error as UserError, UserRegistry, Username, get_registry},
 };
 
+/// How long shutdown waits for history on its way to the store.
+const HISTORY_FLUSH_TIMEOUT: Duration = Duration::from_secs(5);
+
 static BROKER: LazyLock<MessageBroker> = LazyLock::new(MessageBroker::new);
 
 pub fn get_broker() -> &'static MessageBroker {
@@ -26,6 +34,9 @@ pub async fn start_dispatcher() {
 pub struct MessageBroker {
     room: &'static dyn MessageQueue,
     registry: &'static UserRegistry,
+    clock: &'static dyn Clock,
+    // the id of the next chat line
+    next_id: AtomicU64,
     dispatcher_handle: Mutex<Option<JoinHandle<()>>>,
     shutdown_flag: Arc<AtomicBool>,
 }
@@ -35,6 +46,8 @@ impl MessageBroker {
         Self {
             room: get_room(),
             registry: get_registry(),
+            clock: get_clock(),
+            next_id: AtomicU64::new(1),
             dispatcher_handle: Mutex::new(None),
             shutdown_flag: Arc::new(AtomicBool::new(false)),
         }
@@ -44,33 +57,101 @@ impl MessageBroker {
         self.registry
     }
 
-    // our use case is broadcast to all
-    pub fn forward_to_room(&self, encoded_msg: Vec<u8>) -> Result<(), RoomError> {
+    /// Timestamp for an outgoing chat line; see [`crate::chat::clock`].
+    pub fn timestamp(&self) -> String {
+        self.clock.stamp()
+    }
+
+    /// A fresh id for an outgoing chat line, which later `edit` and `delete`
+    /// commands name it by. Ids are unique until the server restarts.
+    pub fn message_id(&self) -> String {
+        self.next_id.fetch_add(1, Ordering::Relaxed).to_string()
+    }
+
+    // only members of `channel` receive it
+    pub fn forward_to_channel(&self, channel: ChannelName, encoded_msg: Vec<u8>) -> Result<(), RoomError> {
+        self.room.send_timeout(
+            OneToOne::to_channel(encoded_msg, channel),
+            consts::BACKBONE_DEFAULT_SEND_TIMEOUT,
+        )
+    }
+
+    // like `forward_to_channel`, but the line is also kept in the channel's history
+    pub fn forward_chat_line(&self, channel: ChannelName, encoded_msg: Vec<u8>) -> Result<(), RoomError> {
+        self.room.send_timeout(
+            OneToOne::to_channel(encoded_msg, channel).recorded(),
+            consts::BACKBONE_DEFAULT_SEND_TIMEOUT,
+        )
+    }
+
+    // like `forward_chat_line`, but `sender` gets `own_copy` in its place
+    pub fn forward_chat_line_to_others(
+        &self,
+        channel: ChannelName,
+        sender: &Username,
+        encoded_msg: Vec<u8>,
+        own_copy: Vec<u8>,
+    ) -> Result<(), RoomError> {
+        self.room.send_timeout(
+            OneToOne::to_channel(encoded_msg, channel)
+                .recorded()
+                .except_sender(sender.clone(), own_copy),
+            consts::BACKBONE_DEFAULT_SEND_TIMEOUT,
+        )
+    }
+
+    // like `forward_to_channel`, but never echoed back to `sender`
+    pub fn forward_to_others(
+        &self,
+        channel: ChannelName,
+        sender: &Username,
+        encoded_msg: Vec<u8>,
+    ) -> Result<(), RoomError> {
+        self.room.send_timeout(
+            OneToOne::to_channel(encoded_msg, channel).except(sender.clone()),
+            consts::BACKBONE_DEFAULT_SEND_TIMEOUT,
+        )
+    }
+
+    // every connected user receives it, whatever channel they are in
+    pub fn forward_to_everyone(&self, encoded_msg: Vec<u8>) -> Result<(), RoomError> {
         self.room
             .send_timeout(OneToOne::from(encoded_msg), consts::BACKBONE_DEFAULT_SEND_TIMEOUT)
     }
 
+    // direct messages skip the room and go straight to the recipient
+    pub async fn forward_to_user(&self, username: &Username, encoded_msg: Vec<u8>) -> Result<(), UserError> {
+        self.registry
+            .send_to(username, OneToMany::from(OneToOne::from(encoded_msg)))
+            .await
+    }
+
+    // like `forward_to_user`, but the recipient is disconnected once it's delivered
+    pub async fn disconnect_user(&self, username: &Username, encoded_msg: Vec<u8>) -> Result<(), UserError> {
+        self.registry
+            .send_to(username, OneToMany::from(OneToOne::from(encoded_msg).last()))
+            .await
+    }
+
     async fn start_dispatcher(&self) {
         let receiver = self.room.receiver();
         let registry = self.registry;
         let shutdown_flag = Arc::clone(&self.shutdown_flag);
 
-        let handle = tokio::spawn(async move {
+        // one blocking thread for the dispatcher's whole life, rather than a
+        // fresh blocking task per message, which cost more than the fan-out
+        let handle = tokio::task::spawn_blocking(move || {
             loop {
                 if shutdown_flag.load(Ordering::Relaxed) {
                     info!("Dispatcher received shutdown signal");
                     break;
                 }
 
-                // Use spawn_blocking for the sync crossbeam recv
-                let recv_result = recv_with_timeout(receiver).await;
-
-                match recv_result {
+                match receiver.recv_timeout(consts::BACKBONE_DEFAULT_RECV_TIMEOUT) {
                     Ok(msg) => {
-                        // Now we can await the async broadcast
-                        let sent = registry.broadcast(&msg, None).await.unwrap_or(0);
+                        let sent = registry.broadcast(&msg, msg.excluded()).unwrap_or(0);
                         if sent > 0 {
-                            info!("Dispatched message to {} users", sent);
+                            debug!("Dispatched message to {} users", sent);
                         }
                     }
                     Err(RecvError::Timeout) => {}
@@ -88,18 +169,27 @@ impl MessageBroker {
         *guard = Some(handle);
     }
 
+    /// Whether the dispatcher has started and not stopped since.
+    pub async fn is_dispatching(&self) -> bool {
+        self.dispatcher_handle
+            .lock()
+            .await
+            .as_ref()
+            .is_some_and(|handle| !handle.is_finished())
+    }
+
     pub async fn shutdown(&self) {
         self.shutdown_flag.store(true, Ordering::Relaxed);
         let handle = self.dispatcher_handle.lock().await.take();
         if let Some(h) = handle {
             let _ = h.await;
         }
-    }
-}
 
-/// Bridge sync crossbeam recv into async context
-async fn recv_with_timeout(receiver: &'static dyn MessageReceiver) -> Result<OneToMany, RecvError> {
-    tokio::task::spawn_blocking(move || receiver.recv_timeout(consts::BACKBONE_DEFAULT_RECV_TIMEOUT))
-        .await
-        .unwrap_or(Err(RecvError::Disconnected))
+        // the last lines said may still be on their way to the store
+        let registry = self.registry;
+        let flushed = tokio::task::spawn_blocking(move || registry.flush_history(HISTORY_FLUSH_TIMEOUT)).await;
+        if !matches!(flushed, Ok(Ok(true))) {
+            warn!("History store may be missing the last lines");
+        }
+    }
 }
@@ -0,0 +1,91 @@
+//! A connection's own cancellation, so that what it starts stops with it
+//! however it ends: a leave, a kick or a drop, a read or write error, or
+//! its task simply going away.
+//!
+//! The connection holds the [`Canceller`]; what works for it holds a
+//! [`Cancelled`], and stops once that resolves. Letting go of the canceller
+//! cancels, so a connection that returns early with an error needs to do
+//! nothing more.
+
+use tokio::sync::watch;
+
+#[derive(Debug)]
+pub struct Canceller {
+    tx: watch::Sender<bool>,
+}
+
+impl Canceller {
+    pub fn new() -> Self {
+        Self {
+            tx: watch::Sender::new(false),
+        }
+    }
+
+    /// What resolves once this is cancelled, or dropped.
+    pub fn token(&self) -> Cancelled {
+        Cancelled {
+            rx: self.tx.subscribe(),
+        }
+    }
+
+    pub fn cancel(&self) {
+        self.tx.send_replace(true);
+    }
+}
+
+impl Default for Canceller {
+    fn default() -> Self {
+        Self::new()
+    }
+}
+
+impl Drop for Canceller {
+    fn drop(&mut self) {
+        self.cancel();
+    }
+}
+
+#[derive(Debug, Clone)]
+pub struct Cancelled {
+    rx: watch::Receiver<bool>,
+}
+
+impl Cancelled {
+    /// Resolves once the connection is cancelled, at once if it already is.
+    pub async fn wait(&self) {
+        let mut rx = self.rx.clone();
+        // an error means the canceller is gone, which is as good as cancelled
+        let _ = rx.wait_for(|cancelled| *cancelled).await;
+    }
+
+    pub fn is_cancelled(&self) -> bool {
+        *self.rx.borrow()
+    }
+}
+
+#[cfg(test)]
+#[allow(clippy::unwrap_used)]
+mod tests {
+    use std::time::Duration;
+
+    use tokio::time::timeout;
+
+    use super::*;
+
+    #[tokio::test]
+    async fn test_cancel_and_drop_both_cancel() {
+        let canceller = Canceller::new();
+        let cancelled = canceller.token();
+        assert!(!cancelled.is_cancelled());
+        assert!(timeout(Duration::from_millis(20), cancelled.wait()).await.is_err());
+        canceller.cancel();
+        assert!(cancelled.is_cancelled());
+        timeout(Duration::from_secs(1), cancelled.wait()).await.unwrap();
+
+        let canceller = Canceller::new();
+        let cancelled = canceller.token();
+        let waiting = tokio::spawn(async move { cancelled.wait().await });
+        drop(canceller);
+        timeout(Duration::from_secs(1), waiting).await.unwrap().unwrap();
+    }
+}
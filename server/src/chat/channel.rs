@@ -0,0 +1,217 @@
+//! Named chat rooms such as `#general`.
+//!
+//! Called channels internally so they are not confused with the message
+//! backbone in `room.rs`; users only ever see the word "room".
+
+use std::{
+    collections::{HashMap, HashSet},
+    fmt::{Display, Formatter},
+    hash::Hash,
+};
+
+use common::username::{MAX_USERNAME_LEN, is_valid_username_char};
+use thiserror::Error as this_error;
+
+use super::string as my_string;
+
+pub const CHANNEL_PREFIX: char = '#';
+pub const DEFAULT_CHANNEL: &str = "#general";
+pub const MAX_CHANNEL_NAME_LEN: usize = MAX_USERNAME_LEN;
+
+#[derive(Debug, Clone, this_error, PartialEq, Eq)]
+pub enum Error {
+    #[error("invalid room name: must be '#' followed by up to {MAX_CHANNEL_NAME_LEN} letters, digits, '_' or '-'")]
+    InvalidName,
+
+    #[error("already in {0}")]
+    AlreadyMember(ChannelName),
+}
+
+/// Room names are case-insensitive and always displayed with a leading `#`.
+#[derive(Debug, Clone, PartialEq, Eq, Hash, PartialOrd, Ord)]
+pub struct ChannelName(String);
+
+impl ChannelName {
+    /// Takes a room name with or without its leading `#`.
+    ///
+    /// # Errors
+    ///
+    /// Fails if the name is empty, too long, or has characters a username can't.
+    pub fn new(s: &str) -> Result<Self, Error> {
+        let trimmed = s.trim();
+        let bare = trimmed.strip_prefix(CHANNEL_PREFIX).unwrap_or(trimmed);
+
+        if bare.is_empty() || bare.chars().count() > MAX_CHANNEL_NAME_LEN || !bare.chars().all(is_valid_username_char) {
+            return Err(Error::InvalidName);
+        }
+
+        Ok(Self(format!("{CHANNEL_PREFIX}{}", my_string::to_lowercase(bare))))
+    }
+
+    #[must_use]
+    pub fn default_channel() -> Self {
+        Self(DEFAULT_CHANNEL.to_string())
+    }
+}
+
+impl Display for ChannelName {
+    fn fmt(&self, f: &mut Formatter<'_>) -> std::fmt::Result {
+        write!(f, "{}", self.0)
+    }
+}
+
+/// Tracks which channel each member is in, and who is in each channel.
+///
+/// Holds no lock of its own; the user registry guards it the same way it
+/// guards the user map. Empty channels are dropped as soon as the last member
+/// leaves.
+#[derive(Debug)]
+pub struct ChannelDirectory<K> {
+    members: HashMap<ChannelName, HashSet<K>>,
+    current: HashMap<K, ChannelName>,
+}
+
+impl<K: Clone + Eq + Hash> ChannelDirectory<K> {
+    pub fn new() -> Self {
+        Self {
+            members: HashMap::new(),
+            current: HashMap::new(),
+        }
+    }
+
+    /// Moves `key` into `channel`, returning the channel it left (if any).
+    pub fn enter(&mut self, key: &K, channel: ChannelName) -> Result<Option<ChannelName>, Error> {
+        if self.current.get(key) == Some(&channel) {
+            return Err(Error::AlreadyMember(channel));
+        }
+        let previous = self.remove(key);
+        self.members.entry(channel.clone()).or_default().insert(key.clone());
+        self.current.insert(key.clone(), channel);
+        Ok(previous)
+    }
+
+    /// Removes `key` from whichever channel it is in.
+    pub fn remove(&mut self, key: &K) -> Option<ChannelName> {
+        let channel = self.current.remove(key)?;
+        if let Some(members) = self.members.get_mut(&channel) {
+            members.remove(key);
+            if members.is_empty() {
+                self.members.remove(&channel);
+            }
+        }
+        Some(channel)
+    }
+
+    /// Gives `from`'s place to `to`, keeping the channel (and its history) alive.
+    pub fn rename(&mut self, from: &K, to: K) {
+        let Some(channel) = self.current.remove(from) else {
+            return;
+        };
+        if let Some(members) = self.members.get_mut(&channel) {
+            members.remove(from);
+            members.insert(to.clone());
+        }
+        self.current.insert(to, channel);
+    }
+
+    pub fn channel_of(&self, key: &K) -> Option<&ChannelName> {
+        self.current.get(key)
+    }
+
+    pub fn members(&self, channel: &ChannelName) -> impl Iterator<Item = &K> {
+        self.members.get(channel).into_iter().flatten()
+    }
+
+    /// Non-empty channels with their member counts, sorted by name.
+    pub fn counts(&self) -> Vec<(ChannelName, usize)> {
+        let mut counts: Vec<_> = self
+            .members
+            .iter()
+            .map(|(channel, members)| (channel.clone(), members.len()))
+            .collect();
+        counts.sort();
+        counts
+    }
+}
+
+impl<K: Clone + Eq + Hash> Default for ChannelDirectory<K> {
+    fn default() -> Self {
+        Self::new()
+    }
+}
+
+#[cfg(test)]
+#[allow(clippy::unwrap_used)]
+mod tests {
+    use super::*;
+
+    fn channel(name: &str) -> ChannelName {
+        ChannelName::new(name).unwrap()
+    }
+
+    #[test]
+    fn test_channel_name_normalizes() {
+        assert_eq!(channel("#Random").to_string(), "#random");
+        assert_eq!(channel("random").to_string(), "#random");
+        assert_eq!(channel("  #dev-ops ").to_string(), "#dev-ops");
+        assert_eq!(ChannelName::default_channel().to_string(), DEFAULT_CHANNEL);
+    }
+
+    #[test]
+    fn test_channel_name_invalid() {
+        assert_eq!(ChannelName::new("#").unwrap_err(), Error::InvalidName);
+        assert_eq!(ChannelName::new("").unwrap_err(), Error::InvalidName);
+        assert_eq!(ChannelName::new("#two words").unwrap_err(), Error::InvalidName);
+        assert_eq!(ChannelName::new("#a|b").unwrap_err(), Error::InvalidName);
+        assert_eq!(
+            ChannelName::new(&format!("#{}", "a".repeat(MAX_CHANNEL_NAME_LEN + 1))).unwrap_err(),
+            Error::InvalidName
+        );
+    }
+
+    #[test]
+    fn test_directory_enter_and_move() {
+        let mut dir = ChannelDirectory::new();
+        assert_eq!(dir.enter(&"alice", channel("#general")).unwrap(), None);
+        assert_eq!(
+            dir.enter(&"alice", channel("#random")).unwrap(),
+            Some(channel("#general"))
+        );
+        assert_eq!(dir.channel_of(&"alice"), Some(&channel("#random")));
+        assert_eq!(dir.members(&channel("#random")).collect::<Vec<_>>(), vec![&"alice"]);
+    }
+
+    #[test]
+    fn test_directory_enter_same_channel_is_error() {
+        let mut dir = ChannelDirectory::new();
+        dir.enter(&"alice", channel("#general")).unwrap();
+        assert_eq!(
+            dir.enter(&"alice", channel("#GENERAL")).unwrap_err(),
+            Error::AlreadyMember(channel("#general"))
+        );
+    }
+
+    #[test]
+    fn test_directory_drops_empty_channels() {
+        let mut dir = ChannelDirectory::new();
+        dir.enter(&"alice", channel("#general")).unwrap();
+        dir.enter(&"bob", channel("#general")).unwrap();
+        dir.enter(&"carol", channel("#random")).unwrap();
+        assert_eq!(dir.counts(), vec![(channel("#general"), 2), (channel("#random"), 1)]);
+
+        assert_eq!(dir.remove(&"carol"), Some(channel("#random")));
+        assert_eq!(dir.counts(), vec![(channel("#general"), 2)]);
+        assert_eq!(dir.members(&channel("#random")).count(), 0);
+        assert_eq!(dir.remove(&"carol"), None);
+    }
+
+    #[test]
+    fn test_directory_rename_keeps_channel() {
+        let mut dir = ChannelDirectory::new();
+        dir.enter(&"alice", channel("#random")).unwrap();
+        dir.rename(&"alice", "alice2");
+        assert_eq!(dir.channel_of(&"alice"), None);
+        assert_eq!(dir.channel_of(&"alice2"), Some(&channel("#random")));
+        assert_eq!(dir.counts(), vec![(channel("#random"), 1)]);
+    }
+}
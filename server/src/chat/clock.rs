@@ -0,0 +1,450 @@
+//! Wall-clock time for stamping chat lines.
+//!
+//! Everything the server timestamps goes through a [`Clock`], so tests can
+//! install a [`FixedClock`], with [`crate::Server::with_clock`], instead of
+//! depending on the real time. How the time is written is
+//! `CHAT_TS_FORMAT`'s, a [`TimestampFormat`].
+
+use std::{fmt::Write as _, str::FromStr, sync::OnceLock};
+
+use jiff::{Timestamp, tz::TimeZone};
+
+use crate::config::get_config;
+
+/// Go's `time.RFC3339`; in UTC that is `2024-01-02T15:04:05Z`.
+const RFC3339: &str = "2006-01-02T15:04:05Z07:00";
+
+/// Go's `time.RFC3339Nano`, which drops trailing zeros from the fraction.
+const RFC3339_NANO: &str = "2006-01-02T15:04:05.999999999Z07:00";
+
+const MONTHS: [&str; 12] = [
+    "January",
+    "February",
+    "March",
+    "April",
+    "May",
+    "June",
+    "July",
+    "August",
+    "September",
+    "October",
+    "November",
+    "December",
+];
+
+// Monday first, as jiff counts them
+const WEEKDAYS: [&str; 7] = [
+    "Monday",
+    "Tuesday",
+    "Wednesday",
+    "Thursday",
+    "Friday",
+    "Saturday",
+    "Sunday",
+];
+
+pub trait Clock: Send + Sync {
+    fn now(&self) -> Timestamp;
+
+    /// The current time rendered in the configured [`TimestampFormat`].
+    fn stamp(&self) -> String {
+        get_config().ts_format.render(self.now())
+    }
+}
+
+#[derive(Debug, Default)]
+pub struct SystemClock;
+
+impl Clock for SystemClock {
+    fn now(&self) -> Timestamp {
+        Timestamp::now()
+    }
+}
+
+/// A clock frozen at a single instant.
+#[derive(Debug)]
+pub struct FixedClock(pub Timestamp);
+
+impl Clock for FixedClock {
+    fn now(&self) -> Timestamp {
+        self.0
+    }
+}
+
+static CLOCK: OnceLock<Box<dyn Clock>> = OnceLock::new();
+
+/// Makes `clock` the one [`get_clock`] hands out, unless one was installed
+/// already or the time has been asked for.
+pub fn install(clock: impl Clock + 'static) {
+    let _ = CLOCK.set(Box::new(clock));
+}
+
+/// The installed clock, or the system's if [`install`] was never called.
+pub fn get_clock() -> &'static dyn Clock {
+    CLOCK.get_or_init(|| Box::new(SystemClock)).as_ref()
+}
+
+/// How chat lines are stamped: a Go layout, which writes the reference time
+/// `Mon Jan 2 15:04:05 MST 2006` the way every stamp should look, or one of
+/// the names `RFC3339` (the default), `RFC3339Nano`, `Unix` for seconds and
+/// `UnixMilli` for milliseconds since the epoch. Times are always in UTC, so
+/// a zone comes out as `Z`, `+00:00` or `UTC`.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct TimestampFormat(Style);
+
+#[derive(Debug, Clone, PartialEq, Eq)]
+enum Style {
+    Layout(Vec<Piece>),
+    Unix,
+    UnixMilli,
+}
+
+/// One part of a parsed layout, named after the part of the reference time
+/// that stands for it.
+#[derive(Debug, Clone, PartialEq, Eq)]
+enum Piece {
+    Text(String),
+    /// `2006`
+    Year,
+    /// `06`
+    ShortYear,
+    /// `January`
+    MonthName,
+    /// `Jan`
+    ShortMonthName,
+    /// `1` or `01`
+    Month(Pad),
+    /// `Monday`
+    WeekdayName,
+    /// `Mon`
+    ShortWeekdayName,
+    /// `2`, `_2` or `02`
+    Day(Pad),
+    /// `__2` or `002`
+    YearDay(Pad),
+    /// `15`
+    Hour,
+    /// `3` or `03`
+    Hour12(Pad),
+    /// `4` or `04`
+    Minute(Pad),
+    /// `5` or `05`
+    Second(Pad),
+    /// `PM` or `pm`
+    Meridiem {
+        upper: bool,
+    },
+    /// `.000` or `.999`, up to nine digits, with a `,` in place of the `.`
+    /// if the layout has one; nines drop trailing zeros, and the separator
+    /// with them when nothing is left.
+    Fraction {
+        sep: char,
+        digits: usize,
+        trim: bool,
+    },
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+enum Pad {
+    None,
+    Zero,
+    Space,
+}
+
+impl TimestampFormat {
+    pub fn render(&self, ts: Timestamp) -> String {
+        match &self.0 {
+            Style::Unix => ts.as_second().to_string(),
+            Style::UnixMilli => ts.as_millisecond().to_string(),
+            Style::Layout(pieces) => {
+                let at = ts.to_zoned(TimeZone::UTC);
+                let mut out = String::new();
+                for piece in pieces {
+                    // writing to a String can't fail
+                    let _ = match piece {
+                        Piece::Text(text) => write!(out, "{text}"),
+                        Piece::Year => write!(out, "{:04}", at.year()),
+                        Piece::ShortYear => write!(out, "{:02}", at.year().rem_euclid(100)),
+                        Piece::MonthName => write!(out, "{}", name(&MONTHS, at.month())),
+                        Piece::ShortMonthName => write!(out, "{}", short(name(&MONTHS, at.month()))),
+                        Piece::Month(pad) => padded(&mut out, at.month().into(), *pad, 2),
+                        Piece::WeekdayName => write!(out, "{}", name(&WEEKDAYS, at.weekday().to_monday_one_offset())),
+                        Piece::ShortWeekdayName => {
+                            write!(out, "{}", short(name(&WEEKDAYS, at.weekday().to_monday_one_offset())))
+                        }
+                        Piece::Day(pad) => padded(&mut out, at.day().into(), *pad, 2),
+                        Piece::YearDay(pad) => padded(&mut out, at.day_of_year(), *pad, 3),
+                        Piece::Hour => write!(out, "{:02}", at.hour()),
+                        Piece::Hour12(pad) => {
+                            let hour = match at.hour().rem_euclid(12) {
+                                0 => 12,
+                                hour => hour,
+                            };
+                            padded(&mut out, hour.into(), *pad, 2)
+                        }
+                        Piece::Minute(pad) => padded(&mut out, at.minute().into(), *pad, 2),
+                        Piece::Second(pad) => padded(&mut out, at.second().into(), *pad, 2),
+                        Piece::Meridiem { upper } => match (at.hour() >= 12, *upper) {
+                            (true, true) => write!(out, "PM"),
+                            (true, false) => write!(out, "pm"),
+                            (false, true) => write!(out, "AM"),
+                            (false, false) => write!(out, "am"),
+                        },
+                        Piece::Fraction { sep, digits, trim } => {
+                            let nanos = format!("{:09}", at.subsec_nanosecond());
+                            let fraction = nanos.get(..*digits).unwrap_or(&nanos);
+                            let fraction = if *trim {
+                                fraction.trim_end_matches('0')
+                            } else {
+                                fraction
+                            };
+                            if fraction.is_empty() {
+                                Ok(())
+                            } else {
+                                write!(out, "{sep}{fraction}")
+                            }
+                        }
+                    };
+                }
+                out
+            }
+        }
+    }
+}
+
+impl Default for TimestampFormat {
+    fn default() -> Self {
+        Self(Style::Layout(parse_layout(RFC3339)))
+    }
+}
+
+impl FromStr for TimestampFormat {
+    type Err = String;
+
+    /// A Go layout or one of the names; blank for the default.
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        let raw = s.trim();
+        let style = match raw.to_lowercase().as_str() {
+            "" | "rfc3339" => Style::Layout(parse_layout(RFC3339)),
+            "rfc3339nano" => Style::Layout(parse_layout(RFC3339_NANO)),
+            "unix" => Style::Unix,
+            "unixmilli" => Style::UnixMilli,
+            _ => {
+                // the stamp is a field of the text protocol, and a line of the transcript
+                if raw.contains(|c: char| c == '|' || c.is_control()) {
+                    return Err(format!("{raw:?} would put | or a control character in every timestamp"));
+                }
+                let pieces = parse_layout(raw);
+                if pieces.iter().all(|piece| matches!(piece, Piece::Text(_))) {
+                    return Err(format!(
+                        "{raw:?} is not a Go layout: it has no part of the reference time \
+                         Mon Jan 2 15:04:05 MST 2006, so every timestamp would be the same"
+                    ));
+                }
+                Style::Layout(pieces)
+            }
+        };
+        Ok(Self(style))
+    }
+}
+
+/// Splits a Go layout into the parts of the reference time it names and the
+/// text between them, matching them the way Go's `time` package does.
+fn parse_layout(layout: &str) -> Vec<Piece> {
+    let mut pieces = Vec::new();
+    let mut text = String::new();
+    let mut rest = layout;
+    while let Some(c) = rest.chars().next() {
+        let (piece, len) = next_piece(rest).unwrap_or_else(|| (Piece::Text(c.to_string()), c.len_utf8()));
+        match piece {
+            Piece::Text(part) => text.push_str(&part),
+            piece => {
+                if !text.is_empty() {
+                    pieces.push(Piece::Text(std::mem::take(&mut text)));
+                }
+                pieces.push(piece);
+            }
+        }
+        rest = rest.get(len..).unwrap_or_default();
+    }
+    if !text.is_empty() {
+        pieces.push(Piece::Text(text));
+    }
+    pieces
+}
+
+/// The part of the reference time `rest` starts with, and its length. Zones
+/// come back as the text they always render to, the time being in UTC.
+fn next_piece(rest: &str) -> Option<(Piece, usize)> {
+    // longest first wherever one is the start of another
+    const ZONES: [&str; 11] = [
+        "MST",
+        "Z070000",
+        "Z07:00:00",
+        "Z0700",
+        "Z07:00",
+        "Z07",
+        "-070000",
+        "-07:00:00",
+        "-0700",
+        "-07:00",
+        "-07",
+    ];
+    const FIELDS: [(&str, Piece); 22] = [
+        ("January", Piece::MonthName),
+        ("Jan", Piece::ShortMonthName),
+        ("Monday", Piece::WeekdayName),
+        ("Mon", Piece::ShortWeekdayName),
+        ("2006", Piece::Year),
+        ("002", Piece::YearDay(Pad::Zero)),
+        ("__2", Piece::YearDay(Pad::Space)),
+        ("01", Piece::Month(Pad::Zero)),
+        ("02", Piece::Day(Pad::Zero)),
+        ("03", Piece::Hour12(Pad::Zero)),
+        ("04", Piece::Minute(Pad::Zero)),
+        ("05", Piece::Second(Pad::Zero)),
+        ("06", Piece::ShortYear),
+        ("_2", Piece::Day(Pad::Space)),
+        ("15", Piece::Hour),
+        ("1", Piece::Month(Pad::None)),
+        ("2", Piece::Day(Pad::None)),
+        ("3", Piece::Hour12(Pad::None)),
+        ("4", Piece::Minute(Pad::None)),
+        ("5", Piece::Second(Pad::None)),
+        ("PM", Piece::Meridiem { upper: true }),
+        ("pm", Piece::Meridiem { upper: false }),
+    ];
+    // Go reads `_2006` as an underscore, then the year
+    if rest.starts_with("_2006") {
+        return None;
+    }
+    if let Some(zone) = ZONES.into_iter().find(|zone| rest.starts_with(zone)) {
+        let utc = match zone {
+            "MST" => "UTC".to_string(),
+            zone if zone.starts_with('Z') => "Z".to_string(),
+            zone => zone.replace('-', "+").replace('7', "0"),
+        };
+        return Some((Piece::Text(utc), zone.len()));
+    }
+    fraction(rest).or_else(|| {
+        FIELDS
+            .into_iter()
+            .find(|(prefix, _)| rest.starts_with(prefix))
+            .map(|(prefix, piece)| (piece, prefix.len()))
+    })
+}
+
+/// A fractional second: a `.` or `,` then a run of `0`s or of `9`s that no
+/// other digit follows.
+fn fraction(rest: &str) -> Option<(Piece, usize)> {
+    let mut chars = rest.chars();
+    let sep = chars.next().filter(|&c| c == '.' || c == ',')?;
+    let digit = chars.next().filter(|&c| c == '0' || c == '9')?;
+    let digits = rest
+        .get(1..)
+        .unwrap_or_default()
+        .chars()
+        .take_while(|&c| c == digit)
+        .count();
+    let after = rest.get(1..).unwrap_or_default().get(digits..).unwrap_or_default();
+    if digits > 9 || after.starts_with(|c: char| c.is_ascii_digit()) {
+        return None;
+    }
+    Some((
+        Piece::Fraction {
+            sep,
+            digits,
+            trim: digit == '9',
+        },
+        digits.checked_add(1)?,
+    ))
+}
+
+/// The `n`th of `names`, counting from 1.
+fn name(names: &[&'static str], n: i8) -> &'static str {
+    usize::try_from(n)
+        .ok()
+        .and_then(|n| n.checked_sub(1))
+        .and_then(|i| names.get(i))
+        .copied()
+        .unwrap_or_default()
+}
+
+/// The three-letter form of a month or weekday name.
+fn short(name: &str) -> &str {
+    name.get(..3).unwrap_or(name)
+}
+
+fn padded(out: &mut String, n: i16, pad: Pad, width: usize) -> std::fmt::Result {
+    match pad {
+        Pad::None => write!(out, "{n}"),
+        Pad::Zero => write!(out, "{n:0width$}"),
+        Pad::Space => write!(out, "{n:>width$}"),
+    }
+}
+
+#[cfg(test)]
+#[allow(clippy::unwrap_used)]
+mod tests {
+    use super::*;
+
+    // 2024-01-02T15:04:05.067Z, a Tuesday
+    fn instant() -> Timestamp {
+        Timestamp::from_millisecond(1_704_207_845_067).unwrap()
+    }
+
+    fn render(format: &str) -> String {
+        format.parse::<TimestampFormat>().unwrap().render(instant())
+    }
+
+    #[test]
+    fn test_fixed_clock_stamp() {
+        let clock = FixedClock(Timestamp::from_second(1_704_207_845).unwrap());
+        assert_eq!(clock.stamp(), "2024-01-02T15:04:05Z");
+    }
+
+    #[test]
+    fn test_system_clock_stamp_shape() {
+        let stamp = get_clock().stamp();
+        assert_eq!(stamp.len(), "2024-01-02T15:04:05Z".len());
+        assert!(stamp.ends_with('Z'));
+        assert_eq!(stamp.get(10..11), Some("T"));
+    }
+
+    #[test]
+    fn test_named_formats() {
+        assert_eq!(TimestampFormat::default().render(instant()), "2024-01-02T15:04:05Z");
+        assert_eq!(render(""), "2024-01-02T15:04:05Z");
+        assert_eq!(render("rfc3339"), "2024-01-02T15:04:05Z");
+        assert_eq!(render("RFC3339Nano"), "2024-01-02T15:04:05.067Z");
+        assert_eq!(render("Unix"), "1704207845");
+        assert_eq!(render("UnixMilli"), "1704207845067");
+        assert_eq!(render(" unixmilli "), "1704207845067");
+    }
+
+    #[test]
+    fn test_layouts() {
+        assert_eq!(render("2006-01-02 15:04:05.000"), "2024-01-02 15:04:05.067");
+        assert_eq!(render("Mon Jan _2 3:04PM"), "Tue Jan  2 3:04PM");
+        assert_eq!(render("Monday, 2 January 06"), "Tuesday, 2 January 24");
+        assert_eq!(render("2006-002 15h04 -07:00 MST"), "2024-002 15h04 +00:00 UTC");
+        assert_eq!(render("15:04:05,999999"), "15:04:05,067");
+        assert_eq!(render("15:04:05.999Z0700"), "15:04:05.067Z");
+        // text that isn't a fraction stays text
+        assert_eq!(render("v1.0 15:04"), "v1.0 15:04");
+        assert_eq!(render("_2006"), "_2024");
+        let on_the_second = Timestamp::from_second(1_704_207_845).unwrap();
+        assert_eq!(
+            "15:04:05.999".parse::<TimestampFormat>().unwrap().render(on_the_second),
+            "15:04:05"
+        );
+    }
+
+    #[test]
+    fn test_invalid_layouts() {
+        assert!("yyyy-mm-dd HH:MM:SS".parse::<TimestampFormat>().is_err());
+        assert!("Z07:00".parse::<TimestampFormat>().is_err());
+        assert!("2006|01|02".parse::<TimestampFormat>().is_err());
+        assert!("15:04\t05".parse::<TimestampFormat>().is_err());
+    }
+}
@@ -1,27 +1,76 @@
-use std::net::SocketAddr;
+use std::{borrow::Cow, collections::HashMap, io::Cursor, net::SocketAddr, sync::Arc, time::Duration};
 
+use async_compression::tokio::{bufread::DeflateDecoder, write::DeflateEncoder};
 use common::{
-    consts::{MAX_CLIENT_BUFFER_SIZE, READ_TIMEOUT},
-    tcp_message::{self, ClientMessage, ServerMessage, WireDecode, WireEncode},
+    consts::{self, MAX_CLIENT_BUFFER_SIZE, TYPING_TIMEOUT},
+    error_code::ErrorCode,
+    file,
+    framing::{FrameDecoder, encode_frame, is_framed},
+    json_message::WireFormat,
+    tcp_message::{self, ClientMessage, FIELD_SEPARATOR, ServerMessage, WireDecode, WireEncode},
 };
+use parking_lot::Mutex;
 use thiserror::Error as ThisError;
 use tokio::{
-    io::{AsyncBufReadExt, AsyncReadExt, AsyncWriteExt, BufReader},
-    net::{TcpStream, tcp::OwnedWriteHalf},
-    sync::mpsc::{self, Receiver, Sender},
-    time::timeout,
+    io::{AsyncBufReadExt, AsyncRead, AsyncReadExt, AsyncWrite, AsyncWriteExt, BufReader},
+    sync::{
+        Notify,
+        mpsc::{self, Receiver, Sender},
+    },
+    task::JoinHandle,
+    time::{Instant, sleep, sleep_until, timeout, timeout_at},
 };
 use tracing::{error, info, warn};
 
-use crate::chat::{
-    broker::get_broker,
-    rate_limiter::RateLimiter,
-    room::OneToMany,
-    user::{Error as UserError, User, Username},
+use crate::{
+    chat::{
+        ban::get_ban_list,
+        broker::get_broker,
+        cancel::{Cancelled, Canceller},
+        channel::ChannelName,
+        conns::{Conn, Tracked, get_connections},
+        filter::get_filter,
+        heartbeat::{Beat, Heartbeat},
+        history,
+        policy::{Limits, get_policies},
+        rate_limiter::RateLimiter,
+        recent::{self, RecentLines},
+        refusal::{Refused, refusal},
+        room::{Audience, Error as RoomError, OneToMany, OneToOne},
+        roster::get_rosters,
+        send_ids::{self, SendIds},
+        session::{Claim, Error as SessionError, get_sessions},
+        string::constant_time_eq,
+        throttle::get_throttle,
+        transcript::get_transcript,
+        user::{Error as UserError, User, UserRegistry, Username},
+    },
+    config::get_config,
+    metrics::{Rejection, get_metrics},
 };
 
 const USER_CHANNEL_BUFFER_SIZE: usize = 256;
 
+/// Messages waiting to be written to a client.
+const OUTBOUND_QUEUE_SIZE: usize = 256;
+
+/// How long a client's full outbound queue gets to make room before the
+/// client is dropped as too slow.
+const SLOW_CLIENT_GRACE: Duration = Duration::from_secs(1);
+
+/// How long a closing connection's writer gets to finish.
+const WRITER_DRAIN_TIMEOUT: Duration = Duration::from_secs(2);
+
+const NOT_AUTHORIZED: &str = "not authorized";
+
+const EMPTY_MESSAGE: &str = "empty message";
+
+const CANNOT_EDIT: &str = "cannot edit";
+
+/// Either half of a plain TCP or a TLS stream.
+pub type ClientReader = Box<dyn AsyncRead + Send + Unpin>;
+pub type ClientWriter = Box<dyn AsyncWrite + Send + Unpin>;
+
 #[derive(Debug, ThisError)]
 pub enum ConnectionError {
     #[error("IO error: {0}")]
@@ -30,15 +79,28 @@ pub enum ConnectionError {
     #[error("read timeout")]
     Timeout,
 
-    #[error("message too long (max {MAX_CLIENT_BUFFER_SIZE} bytes)")]
-    MessageTooLong,
+    #[error("message too long (max {0})")]
+    MessageTooLong(usize),
+
+    /// A line or frame past [`max_line_len`], which closes the connection
+    #[error("line too long (max {0})")]
+    LineTooLong(usize),
+
+    #[error("message contains illegal characters")]
+    IllegalCharacters,
+
+    #[error("rate limited, slow down")]
+    RateLimited,
+
+    #[error("too slow")]
+    TooSlow,
 }
 
 /// Connection state machine.
 /// Transitions: Unauthenticated -> Joined -> Disconnected
 enum ConnectionState {
     Unauthenticated(Unauthenticated),
-    Joined(Joined),
+    Joined(Box<Joined>),
     Disconnected,
 }
 
@@ -54,6 +116,452 @@ struct Joined {
     rx: Receiver<OneToMany>,
 
     rate_limiter: RateLimiter,
+    /// Buckets for the rooms with a rate of their own, kept so that leaving
+    /// such a room and coming back doesn't refill its bucket.
+    room_limiters: Mutex<HashMap<ChannelName, RateLimiter>>,
+    heartbeat: Heartbeat,
+    last_activity: Instant,
+    /// When the room is told the user stopped typing, unless they type on.
+    typing_until: Option<Instant>,
+    /// Set by a successful `auth` with the server's admin token.
+    is_admin: bool,
+    /// The user's own lines they may still edit or delete.
+    recent: RecentLines,
+    /// The ids of lines lately acked, which may not be used again yet.
+    send_ids: SendIds,
+    /// The token a dropped client can `rejoin` with; none if sessions are off.
+    session: Option<String>,
+    /// Cleared by [`Joined::leave`]; if still set on drop the user is
+    /// unregistered then, so a connection that errors out can't leak its
+    /// name or its client slot.
+    registered: bool,
+}
+
+/// How a client delimits its messages, known from the first byte it sends.
+enum Framing {
+    Unknown,
+    Lines,
+    Frames(FrameDecoder),
+}
+
+/// The client's half of the connection, read a line or a frame at a time.
+struct Inbound {
+    reader: BufReader<ClientReader>,
+    framing: Framing,
+    /// Set once the client has asked for `COMPRESS` and been told `OK`.
+    compressed: bool,
+    /// The start of a line whose read was abandoned, finished by the next one.
+    partial: Vec<u8>,
+    /// When the message being read started to arrive; `None` between messages.
+    started: Option<Instant>,
+}
+
+impl Inbound {
+    fn new(reader: ClientReader) -> Self {
+        Self {
+            reader: BufReader::new(reader),
+            framing: Framing::Unknown,
+            compressed: false,
+            partial: Vec::new(),
+            started: None,
+        }
+    }
+
+    const fn is_framed(&self) -> bool {
+        matches!(self.framing, Framing::Frames(_))
+    }
+
+    /// Reads the rest of the connection as a deflate stream, lines or frames
+    /// inside it as before. Anything already buffered is the start of it.
+    fn decompress(&mut self) {
+        let placeholder: ClientReader = Box::new(tokio::io::empty());
+        let reader = std::mem::replace(&mut self.reader, BufReader::new(placeholder));
+        let mut early = match &mut self.framing {
+            Framing::Frames(frames) => frames.take_pending(),
+            Framing::Unknown | Framing::Lines => std::mem::take(&mut self.partial),
+        };
+        early.extend_from_slice(reader.buffer());
+        let early = Cursor::new(early);
+        let compressed = BufReader::new(early.chain(reader.into_inner()));
+        self.reader = BufReader::new(Box::new(DeflateDecoder::new(compressed)));
+        self.compressed = true;
+    }
+
+    /// Whether part of a message has arrived that [`Inbound::read_message`]
+    /// hasn't returned yet.
+    fn has_partial(&self) -> bool {
+        !self.partial.is_empty()
+            || !self.reader.buffer().is_empty()
+            || matches!(&self.framing, Framing::Frames(frames) if !frames.is_empty())
+    }
+
+    /// When the message being read must be complete by; for a client that
+    /// has sent nothing yet, a read timeout from now.
+    fn read_deadline(&self) -> Option<Instant> {
+        self.started
+            .unwrap_or_else(Instant::now)
+            .checked_add(get_config().read_timeout)
+    }
+
+    /// Whether a message started arriving longer than the read timeout ago.
+    fn is_overdue(&self) -> bool {
+        self.started
+            .is_some_and(|started| started.elapsed() >= get_config().read_timeout)
+    }
+
+    /// Reads the next message into `buf`, returning its length, or 0 once the
+    /// client has closed the connection.
+    ///
+    /// Safe to abandon in `select!`: a partly read frame or line stays
+    /// buffered for the next call.
+    async fn read_message(&mut self, buf: &mut Vec<u8>) -> Result<usize, ConnectionError> {
+        if self.started.is_none() {
+            if !self.has_partial() && self.reader.fill_buf().await?.is_empty() {
+                return Ok(0);
+            }
+            self.started = Some(Instant::now());
+        }
+        let result = self.read_next(buf).await;
+        self.started = None;
+        result
+    }
+
+    async fn read_next(&mut self, buf: &mut Vec<u8>) -> Result<usize, ConnectionError> {
+        if matches!(self.framing, Framing::Unknown) {
+            let Some(&first) = self.reader.fill_buf().await?.first() else {
+                return Ok(0);
+            };
+            self.framing = if is_framed(first) {
+                Framing::Frames(FrameDecoder::new(max_line_len()))
+            } else {
+                Framing::Lines
+            };
+        }
+        match &mut self.framing {
+            Framing::Frames(frames) => read_frame(&mut self.reader, frames, buf).await,
+            Framing::Unknown | Framing::Lines => {
+                let left = max_line_len().saturating_add(1).saturating_sub(self.partial.len());
+                let limit = u64::try_from(left).unwrap_or(u64::MAX);
+                (&mut self.reader)
+                    .take(limit)
+                    .read_until(b'\n', &mut self.partial)
+                    .await?;
+                // never more than one byte past the limit is held, however
+                // long the client keeps the line going
+                if self.partial.len() > max_line_len() {
+                    return Err(ConnectionError::LineTooLong(max_line_len()));
+                }
+                let n = self.partial.len();
+                buf.append(&mut self.partial);
+                Ok(n)
+            }
+        }
+    }
+}
+
+/// Reads until `frames` holds a complete, non-empty frame and moves it into
+/// `buf`. Empty frames are skipped, so 0 still means the connection closed.
+async fn read_frame(
+    reader: &mut BufReader<ClientReader>,
+    frames: &mut FrameDecoder,
+    buf: &mut Vec<u8>,
+) -> Result<usize, ConnectionError> {
+    loop {
+        match frames.next_frame() {
+            Ok(Some(frame)) if frame.is_empty() => continue,
+            Ok(Some(frame)) => {
+                buf.extend_from_slice(&frame);
+                return Ok(frame.len());
+            }
+            Ok(None) => {}
+            Err(_) => return Err(ConnectionError::LineTooLong(max_line_len())),
+        }
+        let chunk = reader.fill_buf().await?;
+        if chunk.is_empty() {
+            return Ok(0);
+        }
+        let n = chunk.len();
+        frames.extend(chunk);
+        reader.consume(n);
+    }
+}
+
+/// The client's half of the connection, and the wire format and framing it
+/// speaks.
+///
+/// Messages are queued for a task of their own to write, so a client that
+/// stops reading holds up nothing but itself. One whose queue stays full for
+/// [`SLOW_CLIENT_GRACE`] is marked [`Outbound::too_slow`], and what it is sent
+/// from then on is dropped. One whose socket takes no write for
+/// `CHAT_WRITE_TIMEOUT` loses its writer, and with it the connection. The
+/// writer also stops once the connection is cancelled, so it never outlives
+/// it by more than [`WRITER_DRAIN_TIMEOUT`].
+///
+/// Queued messages are always encoded as text; [`Outbound::forward`]
+/// re-encodes them for JSON clients, and keeps `USERLIST` snapshots from
+/// text clients.
+struct Outbound {
+    queue: Sender<Outgoing>,
+    writing: Option<JoinHandle<std::io::Result<()>>>,
+    format: WireFormat,
+    framed: bool,
+    too_slow: bool,
+    sequenced: bool,
+    binary: bool,
+}
+
+impl Outbound {
+    fn new(writer: ClientWriter, addr: SocketAddr, cancelled: Cancelled) -> Self {
+        // one spare slot, kept for telling a slow client why it is dropped
+        let (queue, queued) = mpsc::channel(OUTBOUND_QUEUE_SIZE.saturating_add(1));
+        let write_timeout = get_config().write_timeout;
+        Self {
+            queue,
+            writing: Some(tokio::spawn(write_queued(
+                writer,
+                queued,
+                addr,
+                write_timeout,
+                cancelled,
+            ))),
+            format: WireFormat::default(),
+            framed: false,
+            too_slow: false,
+            sequenced: false,
+            binary: false,
+        }
+    }
+
+    /// Until the client has joined, each line may switch the format, so that
+    /// errors are reported in whatever the client last used.
+    fn detect_format(&mut self, line: &[u8]) -> WireFormat {
+        self.format = WireFormat::detect(line);
+        self.format
+    }
+
+    /// Writes out a message from the user's queue.
+    async fn forward(&mut self, msg: &OneToMany) -> Result<(), std::io::Error> {
+        if self.format == WireFormat::Text {
+            if is_userlist(msg) {
+                return Ok(());
+            }
+            if !self.sequenced {
+                return self.write_message(&without_seq(msg)).await;
+            }
+            return self.write_message(msg).await;
+        }
+        let room = match msg.audience() {
+            Audience::Channel(channel) => Some(channel.to_string()),
+            Audience::Everyone => None,
+        };
+        match ServerMessage::decode(msg) {
+            Ok(decoded) => {
+                let line = self.format.encode_server(&decoded, room.as_deref());
+                self.write_message(&line).await
+            }
+            Err(e) => {
+                warn!("Queued message not re-encoded, sending as text: {e}");
+                self.write_message(msg).await
+            }
+        }
+    }
+
+    /// Queues `message`, waiting up to [`SLOW_CLIENT_GRACE`] for room. Fails
+    /// only once the writer has, i.e. the connection is gone.
+    async fn write_message(&mut self, message: &[u8]) -> Result<(), std::io::Error> {
+        if self.too_slow {
+            return Ok(());
+        }
+        // the spare slot stays free for `write_last`
+        match timeout(SLOW_CLIENT_GRACE, self.queue.reserve_many(2)).await {
+            Ok(Ok(mut permits)) => {
+                if let Some(permit) = permits.next() {
+                    permit.send(Outgoing::Message(self.encode(message)?));
+                }
+                Ok(())
+            }
+            Ok(Err(_)) => Err(std::io::ErrorKind::BrokenPipe.into()),
+            Err(_) => {
+                self.too_slow = true;
+                Ok(())
+            }
+        }
+    }
+
+    /// Queues `msg` in the slot [`Outbound::write_message`] keeps free, even
+    /// if the client is too slow; it is the last thing it will be sent.
+    fn write_last(&self, msg: &ServerMessage) {
+        let line = self.format.encode_server(msg, None);
+        if let Ok(message) = self.encode(&line) {
+            let _ = self.queue.try_send(Outgoing::Message(message));
+        }
+    }
+
+    /// Has the writer compress whatever it is given after what is queued now.
+    async fn start_compressing(&self) -> Result<(), std::io::Error> {
+        self.queue
+            .send(Outgoing::Compress)
+            .await
+            .map_err(|_| std::io::ErrorKind::BrokenPipe.into())
+    }
+
+    /// `message` as a frame, or as a line.
+    fn encode(&self, message: &[u8]) -> Result<Vec<u8>, std::io::Error> {
+        if self.framed {
+            return encode_frame(message).map_err(std::io::Error::other);
+        }
+        // only a framed sender can get a newline this far; flattened, it
+        // can't split the line and pass the rest off as a message of its own
+        let is_line_break = |b: &u8| matches!(b, b'\n' | b'\r');
+        let mut line: Vec<u8> = message
+            .iter()
+            .map(|&b| if is_line_break(&b) { b' ' } else { b })
+            .collect();
+        line.push(b'\n');
+        Ok(line)
+    }
+
+    /// Resolves once the writer has given up, on a write that failed or
+    /// stalled; the connection is no use after that.
+    async fn lost(&self) {
+        self.queue.closed().await;
+    }
+
+    /// Lets the writer finish what is queued and shut the connection down.
+    /// After [`WRITER_DRAIN_TIMEOUT`] the connection is dropped instead,
+    /// with whatever the client hasn't read.
+    async fn close(mut self) -> Result<(), std::io::Error> {
+        let Some(mut writing) = self.writing.take() else {
+            return Ok(());
+        };
+        drop(self);
+        if let Ok(result) = timeout(WRITER_DRAIN_TIMEOUT, &mut writing).await {
+            return result.map_err(std::io::Error::other)?;
+        }
+        writing.abort();
+        Ok(())
+    }
+}
+
+/// Whether the text-encoded `msg` is a `USERLIST` snapshot; checked without
+/// decoding, as every line a text client is sent goes by here.
+fn is_userlist(msg: &[u8]) -> bool {
+    msg.strip_prefix(consts::SERVER_EVENT_USERLIST.as_bytes())
+        .is_some_and(|rest| rest.starts_with(FIELD_SEPARATOR.as_bytes()))
+}
+
+/// The text-encoded `msg` without the `SEQ|<n>|` a chat line is numbered
+/// with, also inside a `HISTORY|` replay, for a text client that never sent
+/// `SEQ`.
+fn without_seq(msg: &[u8]) -> Cow<'_, [u8]> {
+    let separator = FIELD_SEPARATOR.as_bytes();
+    let (replay, line) = match msg
+        .strip_prefix(consts::SERVER_EVENT_HISTORY.as_bytes())
+        .and_then(|rest| rest.strip_prefix(separator))
+    {
+        Some(line) => (true, line),
+        None => (false, msg),
+    };
+    let Some(numbered) = line
+        .strip_prefix(consts::SERVER_EVENT_SEQ.as_bytes())
+        .and_then(|rest| rest.strip_prefix(separator))
+    else {
+        return Cow::Borrowed(msg);
+    };
+    let Some(inner) = numbered
+        .iter()
+        .position(|b| !b.is_ascii_digit())
+        .and_then(|end| numbered.get(end..))
+        .and_then(|rest| rest.strip_prefix(separator))
+    else {
+        return Cow::Borrowed(msg);
+    };
+    if replay {
+        Cow::Owned(history::replay_line(inner))
+    } else {
+        Cow::Borrowed(inner)
+    }
+}
+
+/// What [`Outbound`] hands its writer.
+enum Outgoing {
+    /// An encoded message, ready to write
+    Message(Vec<u8>),
+    /// Deflate everything written from here on
+    Compress,
+}
+
+/// Writes out what `queued` brings, flushing whenever it runs dry, and shuts
+/// the connection down once the [`Outbound`] is gone. Gives up on a client
+/// whose socket takes no write for `write_timeout`, as one whose TCP window
+/// stays full would otherwise hold the writer forever.
+///
+/// A connection that ends without [`Outbound::close`], e.g. on an error, is
+/// cancelled instead; what it queued then gets [`WRITER_DRAIN_TIMEOUT`] to
+/// go out. Cancelling is only noticed between writes, so no message is cut
+/// short by it.
+async fn write_queued(
+    mut writer: ClientWriter,
+    mut queued: Receiver<Outgoing>,
+    addr: SocketAddr,
+    write_timeout: Duration,
+    cancelled: Cancelled,
+) -> std::io::Result<()> {
+    let written = async {
+        loop {
+            let outgoing = tokio::select! {
+                outgoing = queued.recv() => outgoing,
+                () = cancelled.wait() => break,
+            };
+            let Some(outgoing) = outgoing else {
+                return Ok(());
+            };
+            write_outgoing(&mut writer, outgoing, write_timeout).await?;
+            while let Ok(outgoing) = queued.try_recv() {
+                write_outgoing(&mut writer, outgoing, write_timeout).await?;
+            }
+            within(write_timeout, writer.flush()).await?;
+        }
+        queued.close();
+        within(WRITER_DRAIN_TIMEOUT, async {
+            while let Some(outgoing) = queued.recv().await {
+                write_outgoing(&mut writer, outgoing, write_timeout).await?;
+            }
+            writer.flush().await
+        })
+        .await
+    }
+    .await;
+    if let Err(e) = written {
+        if e.kind() == std::io::ErrorKind::TimedOut {
+            warn!("Connection {addr} stopped taking writes, dropping it");
+        }
+        return Err(e);
+    }
+    // over TLS, this sends close_notify
+    within(write_timeout, writer.shutdown()).await
+}
+
+async fn write_outgoing(writer: &mut ClientWriter, outgoing: Outgoing, write_timeout: Duration) -> std::io::Result<()> {
+    match outgoing {
+        Outgoing::Message(message) => within(write_timeout, writer.write_all(&message)).await,
+        Outgoing::Compress => {
+            // what went before, e.g. the `OK`, goes out as it was
+            within(write_timeout, writer.flush()).await?;
+            let placeholder: ClientWriter = Box::new(tokio::io::sink());
+            let plain = std::mem::replace(writer, placeholder);
+            *writer = Box::new(DeflateEncoder::new(plain));
+            Ok(())
+        }
+    }
+}
+
+/// `write`, failing with [`std::io::ErrorKind::TimedOut`] if it takes longer
+/// than `limit`.
+async fn within(limit: Duration, write: impl Future<Output = std::io::Result<()>>) -> std::io::Result<()> {
+    timeout(limit, write)
+        .await
+        .unwrap_or_else(|_| Err(std::io::ErrorKind::TimedOut.into()))
 }
 
 impl Unauthenticated {
@@ -62,69 +570,353 @@ impl Unauthenticated {
         Self { addr, tx, rx }
     }
     // shall not be responsible for sending notifications
-    fn join(self, raw_username: &String) -> Result<Joined, (Self, String)> {
+    fn join(self, raw_username: &String, password: Option<&str>) -> Result<Joined, (Self, UserError)> {
+        if !get_throttle().admit(self.addr.ip(), Instant::now()) {
+            return Err((self, UserError::TooManyConnections));
+        }
+        if let Some(expected) = &get_config().password
+            && !constant_time_eq(expected.as_bytes(), password.unwrap_or_default().as_bytes())
+        {
+            return Err((self, UserError::AuthenticationFailed));
+        }
         let username = match Username::new(raw_username) {
             Ok(u) => u,
-            Err(e) => return Err((self, e.to_string())),
+            Err(e) => return Err((self, e)),
+        };
+        match get_ban_list().is_banned(&username, self.addr.ip()) {
+            Ok(false) => {}
+            Ok(true) => return Err((self, UserError::Banned)),
+            Err(e) => {
+                warn!("Cannot check bans for {}: {e}", self.addr);
+                return Err((self, UserError::LockTimeout));
+            }
+        }
+        if let Err(e) = check_cooldown(&username) {
+            return Err((self, e));
+        }
+        self.register(&username)
+    }
+
+    fn register(self, username: &Username) -> Result<Joined, (Self, UserError)> {
+        match get_broker()
+            .registry()
+            .register(username, self.addr.ip(), self.tx.clone())
+        {
+            Ok(registered_user) => Ok(self.into_joined(registered_user)),
+            Err(e) => Err((self, e)),
+        }
+    }
+
+    /// Takes over the user a session token was issued to, along with their
+    /// name and room. A previous connection still holding them is told and
+    /// closed. A session that has ended still reclaims its name within the
+    /// cooldown, joining afresh under it; the flag says which it was, true
+    /// for taking over.
+    fn rejoin(self, token: &str) -> Result<(Joined, bool), (Self, UserError)> {
+        if !get_throttle().admit(self.addr.ip(), Instant::now()) {
+            return Err((self, UserError::TooManyConnections));
+        }
+        let claim = match get_sessions().claim(token, Instant::now()) {
+            Ok(claim) => claim,
+            Err(e) => return Err((self, e.into())),
+        };
+        let (Claim::Session(username) | Claim::Name(username)) = &claim;
+        // an unclaimed name is still released when the session runs out
+        match get_ban_list().is_banned(username, self.addr.ip()) {
+            Ok(false) => {}
+            Ok(true) => return Err((self, UserError::Banned)),
+            Err(e) => {
+                warn!("Cannot check bans for {}: {e}", self.addr);
+                return Err((self, UserError::LockTimeout));
+            }
+        }
+
+        let username = match claim {
+            Claim::Session(username) => username,
+            Claim::Name(username) => return self.register(&username).map(|joined| (joined, false)),
         };
+        match get_broker()
+            .registry()
+            .reattach(&username, self.addr.ip(), self.tx.clone())
+        {
+            Ok((reattached, previous)) => {
+                let notice = refusal(&SessionError::Superseded);
+                previous.try_deliver(OneToMany::from(OneToOne::from(notice.encode()).last()));
+                Ok((self.into_joined(reattached), true))
+            }
+            Err(e) => Err((self, e)),
+        }
+    }
+
+    fn into_joined(self, user: User) -> Joined {
+        Joined {
+            session: issue_session(&user),
+            user,
+            addr: self.addr,
+            rx: self.rx,
+            rate_limiter: RateLimiter::with_config(get_config().rate_per_second, get_config().rate_burst),
+            room_limiters: Mutex::new(HashMap::new()),
+            heartbeat: Heartbeat::new(get_config().ping_interval, get_config().pong_timeout, Instant::now()),
+            last_activity: Instant::now(),
+            typing_until: None,
+            is_admin: false,
+            recent: RecentLines::new(recent::CAPACITY, recent::EDIT_WINDOW),
+            send_ids: SendIds::new(send_ids::CAPACITY),
+            registered: true,
+        }
+    }
+}
 
-        match get_broker().registry().register(&username, self.tx.clone()) {
-            Ok(registered_user) => Ok(Joined {
-                user: registered_user,
-                addr: self.addr,
-                rx: self.rx,
-                rate_limiter: RateLimiter::new(),
-            }),
-            Err(e) => Err((self, e.to_string())),
+/// Refuses `username` while it is kept for the session that gave it up.
+fn check_cooldown(username: &Username) -> Result<(), UserError> {
+    match get_sessions().cooling(username, Instant::now())? {
+        None => Ok(()),
+        Some(left) => {
+            let seconds = left.as_secs().saturating_add(u64::from(left.subsec_nanos() > 0));
+            Err(UserError::NameCoolingDown(username.to_string(), seconds))
         }
     }
 }
 
+/// A session token for `user`, unless sessions are turned off.
+fn issue_session(user: &User) -> Option<String> {
+    if get_config().session_grace.is_zero() {
+        return None;
+    }
+    get_sessions()
+        .issue(&user.get_username())
+        .inspect_err(|e| warn!("No session for '{user}': {e}"))
+        .ok()
+}
+
 impl Joined {
-    async fn drain_broadcasts(&mut self, writer: &mut OwnedWriteHalf) -> Result<(), ConnectionError> {
-        while let Ok(msg) = self.rx.try_recv() {
-            writer.write_all(&msg).await?;
-            writer.write_all(b"\n").await?;
-            writer.flush().await?;
+    /// Writes out everything queued, stopping early at a message that ends
+    /// the connection; returns whether it found one. A client found too slow
+    /// is not worth draining for, so that stops it too.
+    async fn drain_broadcasts(&mut self, writer: &mut Outbound) -> Result<bool, ConnectionError> {
+        while !writer.too_slow
+            && let Ok(msg) = self.rx.try_recv()
+        {
+            writer.forward(&msg).await?;
+            if msg.is_last() {
+                return Ok(true);
+            }
+        }
+        Ok(false)
+    }
+
+    /// Takes a token from the bucket for `channel` under `limits`: the
+    /// connection's own at the server's rate, or one of the room's.
+    fn try_acquire(&self, channel: Option<ChannelName>, limits: &Limits) -> bool {
+        let Some(channel) = channel.filter(|_| !limits.same_rate(&Limits::global(&get_config()))) else {
+            return self.rate_limiter.try_acquire();
+        };
+        let mut room_limiters = self.room_limiters.lock();
+        let limiter = room_limiters
+            .entry(channel)
+            .or_insert_with(|| RateLimiter::with_config(limits.rate_per_second, limits.rate_burst));
+        limiter.reconfigure(limits.rate_per_second, limits.rate_burst);
+        limiter.try_acquire()
+    }
+
+    /// Anything the client sends counts as activity, `PONG` included.
+    fn touch(&mut self, now: Instant) {
+        self.last_activity = now;
+        self.heartbeat.alive(now);
+    }
+
+    fn idle_deadline(&self) -> Option<Instant> {
+        let idle_timeout = get_config().idle_timeout;
+        if idle_timeout.is_zero() {
+            return None;
+        }
+        self.last_activity.checked_add(idle_timeout)
+    }
+
+    /// The earliest of the heartbeat, idle and typing deadlines.
+    fn next_deadline(&self) -> Option<Instant> {
+        [self.heartbeat.deadline(), self.idle_deadline(), self.typing_until]
+            .into_iter()
+            .flatten()
+            .min()
+    }
+
+    fn leave(mut self) -> Result<bool, UserError> {
+        stop_typing(&mut self);
+        if let Some(token) = self.session.take()
+            && let Err(e) = get_sessions().vacate(&token, get_config().name_cooldown, Instant::now())
+        {
+            warn!("Failed to end the session of '{}': {e}", self.user);
+        }
+        let removed = get_broker().registry().unregister(&self.user)?;
+        self.registered = false;
+        if removed {
+            get_metrics().left();
+            info!(remote_addr = %self.addr, username = %self.user, "User left");
+        }
+        Ok(removed)
+    }
+
+    /// Keeps the user, name, room and all, for `CHAT_SESSION_GRACE` after an
+    /// abnormal disconnect so they can `rejoin`, or until more than
+    /// `CHAT_SESSION_MAX_HELD` newer sessions push theirs out. Returns false,
+    /// having done nothing, if there is no session to hold.
+    fn hold(&mut self) -> bool {
+        let Some(token) = self.session.take() else {
+            return false;
+        };
+        // the room won't hear from a held user until they are back
+        stop_typing(self);
+        let config = get_config();
+        let grace = config.session_grace;
+        let evicted = match get_sessions().detach(&token, grace, config.session_max_held, Instant::now()) {
+            Ok(evicted) => evicted,
+            Err(e) => {
+                warn!("Cannot hold the session of '{}': {e}", self.user);
+                let _ = get_sessions().revoke(&token);
+                return false;
+            }
+        };
+        self.registered = false;
+        info!(remote_addr = %self.addr, username = %self.user, "Session held for rejoin");
+        tokio::spawn(expire_session(self.user.clone(), self.addr, token, grace, evicted));
+        true
+    }
+}
+
+impl Drop for Joined {
+    fn drop(&mut self) {
+        if !self.registered || self.hold() {
+            return;
+        }
+        stop_typing(self);
+        let registry = get_broker().registry();
+        let username = self.user.get_username();
+        let channel = registry.channel_of(&username);
+        match registry.unregister(&self.user) {
+            Ok(true) => {
+                get_metrics().left();
+                info!(
+                    remote_addr = %self.addr,
+                    username = %self.user,
+                    "User left after an abnormal disconnect"
+                );
+                match channel {
+                    Ok(channel) => announce_disconnected(&username, channel),
+                    Err(e) => warn!("Failed to look up room for '{username}': {e}"),
+                }
+            }
+            Ok(false) => {}
+            Err(e) => warn!("Failed to release '{}' ({}): {e}", self.user, self.addr),
         }
-        Ok(())
     }
+}
+
+/// Waits out a held session, or until it is `evicted` for newer ones. Unless
+/// someone rejoined with it in time, the user then leaves and their room is
+/// told they disconnected.
+async fn expire_session(user: User, addr: SocketAddr, token: String, grace: Duration, evicted: Arc<Notify>) {
+    let why = tokio::select! {
+        () = sleep(grace) => "expired",
+        () = evicted.notified() => "evicted",
+    };
+    if let Err(e) = get_sessions().vacate(&token, get_config().name_cooldown, Instant::now()) {
+        warn!("Failed to end the session of '{user}': {e}");
+    }
+    let registry = get_broker().registry();
+    let username = user.get_username();
+    let channel = registry.channel_of(&username);
+    // a rejoin has swapped in another connection, which this won't remove
+    match registry.unregister(&user) {
+        Ok(true) => {}
+        Ok(false) => return,
+        Err(e) => {
+            warn!("Failed to release '{user}' ({addr}): {e}");
+            return;
+        }
+    }
+    get_metrics().left();
+    info!(remote_addr = %addr, username = %username, "User left, session {why}");
+
+    match channel {
+        Ok(channel) => announce_disconnected(&username, channel),
+        Err(e) => warn!("Failed to look up room for '{username}': {e}"),
+    }
+}
 
-    fn leave(self) -> Result<bool, UserError> {
-        get_broker().registry().unregister(&self.user)
+/// Tells `channel` that `username` dropped off rather than leaving, for
+/// callers with no client left to tell if that fails.
+fn announce_disconnected(username: &Username, channel: ChannelName) {
+    let notice = ServerMessage::UserLeft {
+        timestamp: get_broker().timestamp(),
+        username: username.to_string(),
+        room: channel.to_string(),
+        disconnected: true,
+    };
+    get_rosters().changed(&channel);
+    if is_notified(&notice)
+        && let Err(e) = get_broker().forward_to_channel(channel, notice.encode())
+    {
+        warn!("Failed to send message to room: {e}");
     }
 }
 
-pub async fn handle_connection(stream: TcpStream, addr: SocketAddr, shutdown_rx: tokio::sync::watch::Receiver<bool>) {
-    info!("New connection from {addr}");
-    if let Err(e) = run_state_machine(stream, addr, shutdown_rx).await {
-        error!("Connection {addr} error: {e}");
+pub async fn handle_connection(
+    reader: ClientReader,
+    writer: ClientWriter,
+    addr: SocketAddr,
+    shutdown_rx: tokio::sync::watch::Receiver<bool>,
+) {
+    info!(remote_addr = %addr, "Connection accepted");
+    get_metrics().connected();
+    if let Err(e) = run_state_machine(reader, writer, addr, shutdown_rx).await {
+        error!(remote_addr = %addr, error = %e, "Connection error");
     }
 }
 
 async fn run_state_machine(
-    stream: TcpStream,
+    reader: ClientReader,
+    writer: ClientWriter,
     addr: SocketAddr,
     mut shutdown_rx: tokio::sync::watch::Receiver<bool>,
 ) -> Result<(), ConnectionError> {
-    let (reader, mut writer) = stream.into_split();
-    let mut reader = BufReader::new(reader);
+    // dropped last, however this returns, to stop what the connection started
+    let canceller = Canceller::new();
+    let mut reader = Inbound::new(reader);
+    let mut writer = Outbound::new(writer, addr, canceller.token());
+    let mut tracked = get_connections().open(addr, get_broker().timestamp());
     let mut buf = Vec::with_capacity(MAX_CLIENT_BUFFER_SIZE);
     let mut state = ConnectionState::Unauthenticated(Unauthenticated::new(addr));
+    // ahead of anything the client says, so always a text line; the client
+    // tells it from what follows by its first byte, as we tell frames from
+    // lines by theirs
+    send_message_to_client(&mut writer, &hello()).await?;
     loop {
+        tracked.set_username(match &state {
+            ConnectionState::Joined(joined) => Some(joined.user.get_username()),
+            _ => None,
+        });
         state = match state {
             ConnectionState::Unauthenticated(unauth) => {
                 buf.clear();
-                match tick_unauthenticated(unauth, &mut reader, &mut writer, &mut buf, &mut shutdown_rx).await {
+                match tick_unauthenticated(unauth, &mut reader, &mut writer, &mut buf, &mut shutdown_rx, &tracked).await
+                {
                     Ok(s) => s,
                     Err(e) => return Err(e),
                 }
             }
+            ConnectionState::Joined(joined) if writer.too_slow || joined.user.is_too_slow() => {
+                drop_too_slow(*joined, &mut writer).await?;
+                break;
+            }
             ConnectionState::Joined(mut joined) => {
                 // Drain pending broadcasts first
-                joined.drain_broadcasts(&mut writer).await?;
+                if joined.drain_broadcasts(&mut writer).await? {
+                    leave_kicked(*joined, &mut writer).await?;
+                    break;
+                }
                 buf.clear();
-                match tick_joined(joined, &mut reader, &mut writer, &mut buf, &mut shutdown_rx).await {
+                match tick_joined(joined, &mut reader, &mut writer, &mut buf, &mut shutdown_rx, &tracked).await {
                     Ok(s) => s,
                     Err(e) => return Err(e),
                 }
@@ -133,6 +925,7 @@ async fn run_state_machine(
         };
     }
 
+    writer.close().await?;
     Ok(())
 }
 
@@ -140,15 +933,21 @@ enum InputEvent {
     Data(usize),
     Broadcast(OneToMany),
     Shutdown,
+    /// An operator's `drop` named the connection's address.
+    Dropped,
     Timeout,
+    Deadline,
     Continue,
 }
 
 async fn wait_for_input(
-    reader: &mut BufReader<tokio::net::tcp::OwnedReadHalf>,
+    reader: &mut Inbound,
     buf: &mut Vec<u8>,
     shutdown_rx: &mut tokio::sync::watch::Receiver<bool>,
     rx: Option<&mut Receiver<OneToMany>>,
+    deadline: Option<Instant>,
+    writer: &Outbound,
+    tracked: &Tracked<'_>,
 ) -> Result<InputEvent, ConnectionError> {
     tokio::select! {
         biased; // poll top to bottom
@@ -159,6 +958,15 @@ async fn wait_for_input(
                 Ok(InputEvent::Continue)
             }
         }
+        () = tracked.dropped() => Ok(InputEvent::Dropped),
+        // the writer has said why already
+        () = writer.lost() => Err(ConnectionError::Io(std::io::ErrorKind::BrokenPipe.into())),
+        () = async {
+            match deadline {
+                Some(deadline) => sleep_until(deadline).await,
+                None => std::future::pending().await,
+            }
+        } => Ok(InputEvent::Deadline),
         maybe_msg = async {
             if let Some(r) = rx {
                 r.recv().await
@@ -170,20 +978,17 @@ async fn wait_for_input(
                 Ok(InputEvent::Broadcast(msg))
             })
         }
-        result = timeout(READ_TIMEOUT, async {
-            let limit = (MAX_CLIENT_BUFFER_SIZE + 1) as u64;
-            let mut take = reader.take(limit);
-            take.read_until(b'\n', buf).await
-        }) => {
+        result = async {
+            match reader.read_deadline() {
+                Some(deadline) => timeout_at(deadline, reader.read_message(buf)).await,
+                None => Ok(reader.read_message(buf).await),
+            }
+        } => {
             match result {
-                Ok(Ok(n)) => {
-                    if n > MAX_CLIENT_BUFFER_SIZE {
-                        Err(ConnectionError::MessageTooLong)
-                    } else {
-                        Ok(InputEvent::Data(n))
-                    }
-                }
-                Ok(Err(e)) => Err(ConnectionError::Io(e)),
+                Ok(Ok(n)) => Ok(InputEvent::Data(n)),
+                Ok(Err(e)) => Err(e),
+                // a message started arriving while we waited, so it has longer
+                Err(_) if reader.started.is_some() && !reader.is_overdue() => Ok(InputEvent::Continue),
                 Err(_) => Ok(InputEvent::Timeout),
             }
         }
@@ -192,18 +997,29 @@ async fn wait_for_input(
 
 async fn tick_unauthenticated(
     mut state: Unauthenticated,
-    reader: &mut BufReader<tokio::net::tcp::OwnedReadHalf>,
-    writer: &mut OwnedWriteHalf,
+    reader: &mut Inbound,
+    writer: &mut Outbound,
     buf: &mut Vec<u8>,
     shutdown_rx: &mut tokio::sync::watch::Receiver<bool>,
+    tracked: &Tracked<'_>,
 ) -> Result<ConnectionState, ConnectionError> {
-    let event = match wait_for_input(reader, buf, shutdown_rx, Some(&mut state.rx)).await {
+    let event = match wait_for_input(reader, buf, shutdown_rx, Some(&mut state.rx), None, writer, tracked).await {
         Ok(event) => event,
+        Err(e @ ConnectionError::LineTooLong(_)) => {
+            info!(
+                "Connection {} sent a line too long during join, disconnecting",
+                state.addr
+            );
+            send_farewell(writer, state.addr, &refusal(&e)).await;
+            return Ok(ConnectionState::Disconnected);
+        }
         Err(e) => return Err(e),
     };
+    // answer in frames once the client has shown it sends them
+    writer.framed = reader.is_framed();
 
     match event {
-        InputEvent::Broadcast(_) => {
+        InputEvent::Broadcast(_) | InputEvent::Deadline => {
             // Should not happen for unauthenticated user
             Ok(ConnectionState::Unauthenticated(state))
         }
@@ -211,94 +1027,202 @@ async fn tick_unauthenticated(
             info!("Shutdown signal received for connection {} during join", state.addr);
             Ok(ConnectionState::Disconnected)
         }
+        InputEvent::Dropped => {
+            info!("Connection {} dropped by an operator during join", state.addr);
+            send_farewell(writer, state.addr, &dropped_notice()).await;
+            Ok(ConnectionState::Disconnected)
+        }
         InputEvent::Continue => Ok(ConnectionState::Unauthenticated(state)),
         InputEvent::Timeout => {
             warn!("Connection {} timed out during join", state.addr);
-            Err(ConnectionError::Timeout)
+            send_read_timeout(writer, state.addr).await;
+            Ok(ConnectionState::Disconnected)
         }
         InputEvent::Data(0) => {
             info!("Connection {} closed before joining", state.addr);
             Ok(ConnectionState::Disconnected)
         }
-        InputEvent::Data(_) => match tcp_message::ClientMessage::decode(buf) {
-            Ok(ClientMessage::Join { username }) => match state.join(&username) {
-                Ok(joined) => {
-                    let broadcast_message = ServerMessage::UserJoined { username };
-                    if let Err(e) = get_broker().forward_to_room(broadcast_message.encode()) {
-                        warn!("Failed to send message to room: {e}");
-                        send_message_to_client(writer, &ServerMessage::Err { reason: e.to_string() }).await?;
-                    }
+        InputEvent::Data(_) => {
+            let format = writer.detect_format(buf);
+            match get_config().aliases.decode(format, buf) {
+                Ok(ClientMessage::Join { username, password }) => {
+                    let joined = state.join(&username, password.as_deref());
+                    admit(joined.map(|joined| (joined, false)), writer).await
+                }
+                Ok(ClientMessage::Rejoin { token }) => admit(state.rejoin(&token), writer).await,
+                Ok(ClientMessage::Compress) if reader.compressed => {
+                    let refused = Refused::new(ErrorCode::ALREADY_COMPRESSED, "already compressed");
+                    send_message_to_client(writer, &refused.into()).await?;
+                    Ok(ConnectionState::Unauthenticated(state))
+                }
+                Ok(ClientMessage::Compress) => {
+                    send_message_to_client(writer, &ServerMessage::Ok).await?;
+                    writer.start_compressing().await?;
+                    reader.decompress();
+                    Ok(ConnectionState::Unauthenticated(state))
+                }
+                // before joining, so that the history replay is numbered too
+                Ok(ClientMessage::Sequence) => {
+                    writer.sequenced = true;
                     send_message_to_client(writer, &ServerMessage::Ok).await?;
-                    Ok(ConnectionState::Joined(joined))
+                    Ok(ConnectionState::Unauthenticated(state))
                 }
-                Err((returned_state, reason)) => {
-                    send_message_to_client(writer, &ServerMessage::Err { reason }).await?;
-                    Ok(ConnectionState::Unauthenticated(returned_state))
+                Ok(ClientMessage::Binary) => {
+                    let reply = allow_binary(writer);
+                    send_message_to_client(writer, &reply).await?;
+                    Ok(ConnectionState::Unauthenticated(state))
+                }
+                Ok(_) => {
+                    let refused = Refused::new(ErrorCode::NOT_JOINED, "must join first");
+                    send_message_to_client(writer, &refused.into()).await?;
+                    Ok(ConnectionState::Unauthenticated(state))
+                }
+                Err(e) => {
+                    warn!("Invalid command from {}: {e}", state.addr);
+                    send_message_to_client(writer, &refusal(&e)).await?;
+                    Ok(ConnectionState::Unauthenticated(state))
                 }
-            },
-            Ok(_) => {
-                send_message_to_client(
-                    writer,
-                    &ServerMessage::Err {
-                        reason: "must join first".to_string(),
-                    },
-                )
-                .await?;
-                Ok(ConnectionState::Unauthenticated(state))
-            }
-            Err(e) => {
-                warn!("Invalid command from {}: {e}", state.addr);
-                send_message_to_client(writer, &ServerMessage::Err { reason: e.to_string() }).await?;
-                Ok(ConnectionState::Unauthenticated(state))
             }
-        },
+        }
+    }
+}
+
+/// The server's name and version, and the capabilities this configuration
+/// offers: JSON, rooms, deflate and numbering always, TLS, history, and
+/// files and binary sends when they are on.
+fn hello() -> ServerMessage {
+    let config = get_config();
+    let history = config.history_size > 0 || config.room_history_sizes.iter().any(|(_, size)| *size > 0);
+    let caps = [
+        (consts::CAP_JSON, true),
+        (consts::CAP_TLS, config.tls_cert.is_some()),
+        (consts::CAP_ROOMS, true),
+        (consts::CAP_HISTORY, history),
+        (consts::CAP_DEFLATE, true),
+        (consts::CAP_FILES, config.max_file_size > 0),
+        (consts::CAP_SEQ, true),
+        (consts::CAP_BINARY, config.max_file_size > 0),
+    ]
+    .into_iter()
+    .filter_map(|(cap, offered)| offered.then(|| cap.to_string()))
+    .collect();
+    ServerMessage::Hello {
+        server: format!("{}/{}", consts::SERVER_NAME, env!("CARGO_PKG_VERSION")),
+        caps,
+    }
+}
+
+/// Answers a `join` or a `rejoin`, the flag saying whether it resumed a
+/// session. A client let in gets `OK` and its session token, then the MOTD,
+/// or if it is resuming the room it is back in, and its room is told.
+async fn admit(
+    result: Result<(Joined, bool), (Unauthenticated, UserError)>,
+    writer: &mut Outbound,
+) -> Result<ConnectionState, ConnectionError> {
+    let (joined, rejoined) = match result {
+        Ok(admitted) => admitted,
+        // nothing the client can fix by retrying on this connection
+        Err((
+            rejected,
+            e @ (UserError::ServerFull
+            | UserError::AuthenticationFailed
+            | UserError::Banned
+            | UserError::TooManyConnections),
+        )) => {
+            info!(remote_addr = %rejected.addr, reason = %e, "Connection rejected");
+            get_metrics().rejected(match e {
+                UserError::ServerFull => Rejection::ServerFull,
+                UserError::AuthenticationFailed => Rejection::AuthenticationFailed,
+                UserError::TooManyConnections => Rejection::Throttled,
+                _ => Rejection::Banned,
+            });
+            send_message_to_client(writer, &refusal(&e)).await?;
+            return Ok(ConnectionState::Disconnected);
+        }
+        Err((returned_state, e)) => {
+            send_message_to_client(writer, &refusal(&e)).await?;
+            return Ok(ConnectionState::Unauthenticated(returned_state));
+        }
+    };
+
+    let username = joined.user.get_username();
+    let mut back_in = None;
+    let (channel, notice) = if rejoined {
+        info!(remote_addr = %joined.addr, username = %username, "User rejoined");
+        let channel = get_broker()
+            .registry()
+            .channel_of(&username)
+            .unwrap_or_else(|_| ChannelName::default_channel());
+        let text = format!("{username} reconnected");
+        back_in = Some(ServerMessage::Info {
+            text: format!("Rejoined {channel}"),
+        });
+        (channel, ServerMessage::Info { text })
+    } else {
+        get_metrics().joined();
+        info!(remote_addr = %joined.addr, username = %username, "User joined");
+        let channel = ChannelName::default_channel();
+        let notice = ServerMessage::UserJoined {
+            timestamp: get_broker().timestamp(),
+            username: username.to_string(),
+            room: channel.to_string(),
+        };
+        get_rosters().changed(&channel);
+        (channel, notice)
+    };
+    if is_notified(&notice)
+        && let Err(e) = get_broker().forward_to_channel(channel, notice.encode())
+    {
+        warn!("Failed to send message to room: {e}");
+        send_message_to_client(writer, &refusal(&e)).await?;
     }
+    send_message_to_client(writer, &ServerMessage::Ok).await?;
+    if let Some(token) = &joined.session {
+        let session = ServerMessage::Session {
+            token: token.clone(),
+            seconds: get_config().session_grace.as_secs(),
+        };
+        send_message_to_client(writer, &session).await?;
+    }
+    match back_in {
+        Some(back_in) => send_message_to_client(writer, &back_in).await?,
+        None => send_motd(writer).await?,
+    }
+    Ok(ConnectionState::Joined(Box::new(joined)))
 }
 
 /// Process one tick in Joined state. Returns next state.
 async fn tick_joined(
-    mut joined: Joined,
-    reader: &mut BufReader<tokio::net::tcp::OwnedReadHalf>,
-    writer: &mut OwnedWriteHalf,
+    mut joined: Box<Joined>,
+    reader: &mut Inbound,
+    writer: &mut Outbound,
     buf: &mut Vec<u8>,
     shutdown_rx: &mut tokio::sync::watch::Receiver<bool>,
+    tracked: &Tracked<'_>,
 ) -> Result<ConnectionState, ConnectionError> {
-    let username = joined.user.get_username().to_string();
-
+    let deadline = joined.next_deadline();
     let rx = &mut joined.rx;
-    let event = match wait_for_input(reader, buf, shutdown_rx, Some(rx)).await {
+    let event = match wait_for_input(reader, buf, shutdown_rx, Some(rx), deadline, writer, tracked).await {
         Ok(event) => event,
-        Err(ConnectionError::MessageTooLong) => {
-            // Drain the rest of the line if incomplete
-            if buf.last() != Some(&b'\n') {
-                loop {
-                    buf.clear();
-                    let limit = common::consts::MAX_CLIENT_MESSAGE_LENGTH as u64;
-                    let n = reader.take(limit).read_until(b'\n', buf).await?;
-                    if n == 0 || buf.last() == Some(&b'\n') {
-                        break;
-                    }
-                }
-            }
-            buf.clear();
-
-            send_message_to_client(
-                writer,
-                &ServerMessage::Err {
-                    reason: ConnectionError::MessageTooLong.to_string(),
-                },
-            )
-            .await?;
-            return Ok(ConnectionState::Joined(joined));
+        Err(e @ ConnectionError::LineTooLong(_)) => {
+            info!(
+                "Connection {} ('{}') sent a line too long, disconnecting",
+                joined.addr, joined.user
+            );
+            send_farewell(writer, joined.addr, &refusal(&e)).await;
+            leave_and_announce(*joined, writer, true).await?;
+            return Ok(ConnectionState::Disconnected);
         }
         Err(e) => return Err(e),
     };
 
     match event {
         InputEvent::Broadcast(msg) => {
-            writer.write_all(&msg).await?;
-            writer.write_all(b"\n").await?;
-            writer.flush().await?;
+            writer.forward(&msg).await?;
+            if msg.is_last() {
+                leave_kicked(*joined, writer).await?;
+                return Ok(ConnectionState::Disconnected);
+            }
             Ok(ConnectionState::Joined(joined))
         }
         InputEvent::Shutdown => {
@@ -309,27 +1233,29 @@ async fn tick_joined(
             }
             Ok(ConnectionState::Disconnected)
         }
+        InputEvent::Dropped => {
+            info!("Connection {} ('{}') dropped by an operator", joined.addr, joined.user);
+            send_farewell(writer, joined.addr, &dropped_notice()).await;
+            leave_and_announce(*joined, writer, true).await?;
+            Ok(ConnectionState::Disconnected)
+        }
+        InputEvent::Timeout if reader.is_overdue() => time_out(joined, writer).await,
         InputEvent::Timeout | InputEvent::Continue => Ok(ConnectionState::Joined(joined)),
+        InputEvent::Deadline => on_deadline(joined, writer).await,
         InputEvent::Data(0) => {
             info!("Connection {} closed by client", joined.addr);
             joined.drain_broadcasts(writer).await?;
-            if let Err(e) = joined.leave() {
-                warn!("Failed to leave: {e}");
-            }
-            let broadcast_message = ServerMessage::UserLeft { username };
-            if let Err(e) = get_broker().forward_to_room(broadcast_message.encode()) {
-                warn!("Failed to send message to room: {e}");
-                send_message_to_client(writer, &ServerMessage::Err { reason: e.to_string() }).await?;
-            }
+            leave_or_hold(*joined, writer).await?;
             Ok(ConnectionState::Disconnected)
         }
         InputEvent::Data(_) => {
-            let should_disconnect = handle_joined_message(&joined, writer, buf).await?;
+            joined.touch(Instant::now());
+            let should_disconnect = handle_joined_message(&mut joined, writer, buf).await?;
             if should_disconnect {
                 joined.drain_broadcasts(writer).await?;
-                if let Err(e) = joined.leave() {
-                    warn!("Failed to leave: {e}");
-                }
+                // the room hears of it first, so the client may exit on the goodbye
+                leave_and_announce(*joined, writer, false).await?;
+                send_message_to_client(writer, &ServerMessage::Goodbye).await?;
                 Ok(ConnectionState::Disconnected)
             } else {
                 Ok(ConnectionState::Joined(joined))
@@ -338,29 +1264,308 @@ async fn tick_joined(
     }
 }
 
-/// Handle a message while in Joined state.
-async fn handle_joined_message(
-    joined: &Joined,
-    writer: &mut OwnedWriteHalf,
-    buf: &[u8],
-) -> Result<bool, ConnectionError> {
-    // Size check is handled in wait_for_input
+/// Drops a client that fell too far behind reading what it was sent. Its
+/// room is told at once; the client hears why only after everything queued
+/// ahead of that, if it ever reads again.
+async fn drop_too_slow(joined: Joined, writer: &mut Outbound) -> Result<(), ConnectionError> {
+    info!(
+        "Connection {} ('{}') too slow to keep up, disconnecting",
+        joined.addr, joined.user
+    );
+    leave_and_announce(joined, writer, true).await?;
+    writer.write_last(&refusal(&ConnectionError::TooSlow));
+    Ok(())
+}
 
-    let broker = get_broker();
+/// Drops a client that started a message and never finished it, as if the
+/// connection had dropped.
+async fn time_out(joined: Box<Joined>, writer: &mut Outbound) -> Result<ConnectionState, ConnectionError> {
+    info!(
+        "Connection {} sent part of a message and stalled, disconnecting",
+        joined.addr
+    );
+    send_read_timeout(writer, joined.addr).await;
+    leave_or_hold(*joined, writer).await?;
+    Ok(ConnectionState::Disconnected)
+}
 
-    match ClientMessage::decode(buf) {
-        Ok(ClientMessage::Send { message }) => {
-            joined.rate_limiter.acquire().await;
-            let broadcast_message = ServerMessage::Broadcast {
-                username: joined.user.get_username().to_string(),
-                message,
-            };
+/// Tells a client it is being dropped for [`ConnectionError::Timeout`].
+async fn send_read_timeout(writer: &mut Outbound, addr: SocketAddr) {
+    send_farewell(writer, addr, &refusal(&ConnectionError::Timeout)).await;
+}
 
-            if let Err(e) = broker.forward_to_room(broadcast_message.encode()) {
-                warn!("Failed to send message to room: {e}");
-                send_message_to_client(writer, &ServerMessage::Err { reason: e.to_string() }).await?;
-            }
-        }
+/// Tells a client why it is being dropped. It may well not be listening, so
+/// failing to is not an error.
+async fn send_farewell(writer: &mut Outbound, addr: SocketAddr, why: &ServerMessage) {
+    if let Err(e) = send_message_to_client(writer, why).await {
+        info!("Connection {addr} unreachable: {e}");
+    }
+}
+
+/// Drops an idle client; otherwise pings it, or drops it if the previous
+/// ping went unanswered.
+async fn on_deadline(mut joined: Box<Joined>, writer: &mut Outbound) -> Result<ConnectionState, ConnectionError> {
+    let now = Instant::now();
+    if joined.typing_until.is_some_and(|deadline| deadline <= now) {
+        stop_typing(&mut joined);
+    }
+    if joined.idle_deadline().is_some_and(|deadline| deadline <= now) {
+        info!(
+            "Connection {} idle for {:?}, disconnecting",
+            joined.addr,
+            get_config().idle_timeout
+        );
+        let refused = Refused::new(ErrorCode::IDLE_TIMEOUT, "idle timeout, disconnecting");
+        if let Err(e) = send_message_to_client(writer, &refused.into()).await {
+            info!("Connection {} unreachable: {e}", joined.addr);
+        }
+        leave_and_announce(*joined, writer, true).await?;
+        return Ok(ConnectionState::Disconnected);
+    }
+    if joined.heartbeat.deadline().is_none_or(|deadline| deadline > now) {
+        return Ok(ConnectionState::Joined(joined));
+    }
+
+    match joined.heartbeat.beat(now) {
+        Beat::SendPing => {
+            if let Err(e) = send_message_to_client(writer, &ServerMessage::Ping).await {
+                info!("Connection {} unreachable: {e}", joined.addr);
+                leave_or_hold(*joined, writer).await?;
+                return Ok(ConnectionState::Disconnected);
+            }
+            Ok(ConnectionState::Joined(joined))
+        }
+        Beat::Expired => {
+            info!("Connection {} missed its PONG, disconnecting", joined.addr);
+            leave_or_hold(*joined, writer).await?;
+            Ok(ConnectionState::Disconnected)
+        }
+    }
+}
+
+/// After an abnormal disconnect, holds the user's session for a rejoin, or
+/// if there is none, unregisters them and tells their room they
+/// disconnected.
+async fn leave_or_hold(mut joined: Joined, writer: &mut Outbound) -> Result<(), ConnectionError> {
+    if joined.hold() {
+        return Ok(());
+    }
+    leave_and_announce(joined, writer, true).await
+}
+
+/// Unregisters the user and tells the room they were in that they left, or
+/// were `disconnected` without saying so.
+async fn leave_and_announce(joined: Joined, writer: &mut Outbound, disconnected: bool) -> Result<(), ConnectionError> {
+    leave_with_notice(joined, writer, |username, channel| ServerMessage::UserLeft {
+        timestamp: get_broker().timestamp(),
+        username: username.to_string(),
+        room: channel.to_string(),
+        disconnected,
+    })
+    .await?;
+    Ok(())
+}
+
+/// Unregisters a user an operator kicked and tells the room they were in.
+/// Their name is free at once, with no cooldown kept for their session.
+///
+/// A connection whose session was resumed elsewhere ends the same way, but
+/// the user stays and nobody is told.
+async fn leave_kicked(mut joined: Joined, writer: &mut Outbound) -> Result<(), ConnectionError> {
+    let (user, addr) = (joined.user.clone(), joined.addr);
+    if let Some(token) = joined.session.take()
+        && let Err(e) = get_sessions().revoke(&token)
+    {
+        warn!("Failed to end the session of '{user}': {e}");
+    }
+    let removed = leave_with_notice(joined, writer, |username, _| ServerMessage::Info {
+        text: format!("{username} was kicked"),
+    })
+    .await?;
+    if removed {
+        info!("'{user}' ({addr}) was kicked");
+    } else {
+        info!("'{user}' ({addr}) was taken over by another connection");
+    }
+    Ok(())
+}
+
+/// Unregisters the user and sends the room they were in the `notice` built
+/// for it; returns whether they were still registered to this connection.
+async fn leave_with_notice(
+    joined: Joined,
+    writer: &mut Outbound,
+    notice: impl FnOnce(&Username, &ChannelName) -> ServerMessage + Send,
+) -> Result<bool, ConnectionError> {
+    let username = joined.user.get_username();
+    let channel = get_broker().registry().channel_of(&username);
+    match joined.leave() {
+        Ok(true) => {}
+        Ok(false) => return Ok(false),
+        Err(e) => warn!("Failed to leave: {e}"),
+    }
+    let channel = match channel {
+        Ok(channel) => channel,
+        Err(e) => {
+            warn!("Failed to look up room for '{username}': {e}");
+            return Ok(true);
+        }
+    };
+
+    get_rosters().changed(&channel);
+    let broadcast_message = notice(&username, &channel);
+    if is_notified(&broadcast_message)
+        && let Err(e) = get_broker().forward_to_channel(channel, broadcast_message.encode())
+    {
+        warn!("Failed to send message to room: {e}");
+        send_message_to_client(writer, &refusal(&e)).await?;
+    }
+    Ok(true)
+}
+
+/// Whether rooms are told of `notice` under `CHAT_NOTIFY`, which can only
+/// silence joins and leaves.
+fn is_notified(notice: &ServerMessage) -> bool {
+    let notify = get_config().notify;
+    match notice {
+        ServerMessage::UserJoined { .. } => notify.joins,
+        ServerMessage::UserLeft { .. } => notify.leaves,
+        _ => true,
+    }
+}
+
+/// Greets a newly joined client with the MOTD, if any.
+///
+/// Written straight to the client, so it lands ahead of the history replay
+/// that is still waiting in the user's queue.
+async fn send_motd(writer: &mut Outbound) -> Result<(), ConnectionError> {
+    let config = get_config();
+    let Some(motd) = &config.motd else {
+        return Ok(());
+    };
+    for line in motd.lines() {
+        send_message_to_client(writer, &ServerMessage::Info { text: line.to_string() }).await?;
+    }
+    Ok(())
+}
+
+/// Handle a message while in Joined state.
+async fn handle_joined_message(
+    joined: &mut Joined,
+    writer: &mut Outbound,
+    buf: &[u8],
+) -> Result<bool, ConnectionError> {
+    // Size check is handled in wait_for_input
+
+    // a reload may have changed the limits since the last message
+    let config = get_config();
+    joined
+        .rate_limiter
+        .reconfigure(config.rate_per_second, config.rate_burst);
+
+    let broker = get_broker();
+
+    // only a `send` may carry bytes that aren't UTF-8, and only once asked
+    if writer.binary
+        && let Some(payload) = tcp_message::binary_payload(buf)
+        && std::str::from_utf8(payload).is_err()
+    {
+        send_bytes(joined, writer, payload).await?;
+        return Ok(false);
+    }
+
+    match config.aliases.decode(writer.format, buf) {
+        Ok(ClientMessage::Send { id, message }) => send_message(joined, writer, id, None, message).await?,
+        Ok(ClientMessage::Reply { id, reply_to, message }) => {
+            send_message(joined, writer, id, Some(reply_to), message).await?;
+        }
+        Ok(ClientMessage::Action { text }) => send_action(joined, writer, text).await?,
+        Ok(ClientMessage::Edit { id, message }) => amend_line(joined, writer, id, Some(message)).await?,
+        Ok(ClientMessage::Delete { id }) => amend_line(joined, writer, id, None).await?,
+        Ok(ClientMessage::Typing) => start_typing(joined, Instant::now()),
+        Ok(ClientMessage::Away { message }) => go_away(joined, writer, message).await?,
+        Ok(ClientMessage::File { name, data }) => share_file(joined, writer, name, data).await?,
+        Ok(ClientMessage::JoinRoom { room }) => {
+            let channel = match ChannelName::new(&room) {
+                Ok(channel) => channel,
+                Err(e) => {
+                    send_message_to_client(writer, &refusal(&e)).await?;
+                    return Ok(false);
+                }
+            };
+            switch_channel(joined, writer, channel).await?;
+        }
+        Ok(ClientMessage::ListRooms) => {
+            send_message_to_client(writer, &rooms_reply(broker.registry())).await?;
+        }
+        Ok(ClientMessage::Direct { to, message }) => send_direct(joined, writer, to, message).await?,
+        Ok(ClientMessage::DirectHistory { username }) => {
+            if let Some(reply) = direct_history(joined, &username) {
+                send_message_to_client(writer, &reply).await?;
+            }
+        }
+        Ok(ClientMessage::Who) => {
+            send_message_to_client(writer, &who_reply(joined, broker.registry())).await?;
+        }
+        Ok(ClientMessage::Help) => {
+            for reply in help_reply(joined) {
+                send_message_to_client(writer, &reply).await?;
+            }
+        }
+        // liveness was already noted by the caller
+        Ok(ClientMessage::Pong) => {}
+        Ok(ClientMessage::Ping { token }) => {
+            send_message_to_client(writer, &ServerMessage::Pong { token }).await?;
+        }
+        Ok(ClientMessage::Sequence) => {
+            writer.sequenced = true;
+            send_message_to_client(writer, &ServerMessage::Ok).await?;
+        }
+        Ok(ClientMessage::Binary) => {
+            let reply = allow_binary(writer);
+            send_message_to_client(writer, &reply).await?;
+        }
+        Ok(ClientMessage::Resync { after }) => {
+            if let Some(reply) = resync(joined, after) {
+                send_message_to_client(writer, &reply).await?;
+            }
+        }
+        Ok(ClientMessage::Nick { username }) => {
+            send_message_to_client(writer, &change_nick(joined, &username)).await?;
+        }
+        Ok(ClientMessage::Auth { token }) => {
+            send_message_to_client(writer, &authenticate(joined, &token)).await?;
+        }
+        Ok(
+            command @ (ClientMessage::Kick { .. }
+            | ClientMessage::Ban { .. }
+            | ClientMessage::Unban { .. }
+            | ClientMessage::DropConnection { .. }),
+        ) => {
+            send_message_to_client(writer, &operator_command(joined, command).await).await?;
+        }
+        Ok(ClientMessage::Stats) => {
+            for reply in stats_reply(joined, broker.registry()) {
+                send_message_to_client(writer, &reply).await?;
+            }
+        }
+        Ok(ClientMessage::WhoAll) => {
+            for reply in who_all_reply(joined, broker.registry()) {
+                send_message_to_client(writer, &reply).await?;
+            }
+        }
+        Ok(ClientMessage::Connections) => {
+            for reply in conns_reply(joined) {
+                send_message_to_client(writer, &reply).await?;
+            }
+        }
+        Ok(ClientMessage::Broadcast { message }) => {
+            let reply = announce(joined, &message, writer.framed);
+            send_message_to_client(writer, &reply).await?;
+        }
+        Ok(ClientMessage::RoomPolicy { room, policy }) => {
+            send_message_to_client(writer, &room_policy(joined, &room, &policy)).await?;
+        }
         Ok(ClientMessage::Leave) => {
             info!(
                 "User '{}' requested leave from {}",
@@ -370,21 +1575,1080 @@ async fn handle_joined_message(
             return Ok(true);
         }
         Ok(_) => {
-            let msg = "invlaid command for `Joined state`".to_string();
-            warn!("{} from {}", msg, joined.addr);
-            send_message_to_client(writer, &ServerMessage::Err { reason: msg }).await?;
+            let refused = Refused::new(ErrorCode::BAD_REQUEST, "invlaid command for `Joined state`");
+            warn!("{} from {}", refused.reason, joined.addr);
+            send_message_to_client(writer, &refused.into()).await?;
         }
         Err(e) => {
             warn!("Invalid command from {}: {e}", joined.addr);
-            send_message_to_client(writer, &ServerMessage::Err { reason: e.to_string() }).await?;
+            send_message_to_client(writer, &refusal(&e)).await?;
         }
     }
 
     Ok(false)
 }
 
-async fn send_message_to_client(writer: &mut OwnedWriteHalf, msg: &ServerMessage) -> Result<(), std::io::Error> {
-    writer.write_all(msg.to_string().as_bytes()).await?;
-    writer.write_all(b"\n").await?;
-    writer.flush().await
+/// Delivers a private message to `to`, echoing it back to the sender and
+/// keeping it for `dm-history`.
+async fn send_direct(
+    joined: &Joined,
+    writer: &mut Outbound,
+    to: String,
+    message: String,
+) -> Result<(), ConnectionError> {
+    if !within_limits(joined, writer, &message).await? {
+        return Ok(());
+    }
+    let from = joined.user.get_username();
+    let Ok(target) = Username::new(&to) else {
+        let reply = refusal(&UserError::UserNotFound(to));
+        return Ok(send_message_to_client(writer, &reply).await?);
+    };
+    let direct_message = ServerMessage::Direct {
+        from: from.to_string(),
+        to: target.to_string(),
+        message,
+    };
+
+    let broker = get_broker();
+    match broker.forward_to_user(&target, direct_message.encode()).await {
+        Ok(()) => {
+            if let Err(e) = broker.registry().record_direct(&from, &target, direct_message.encode()) {
+                warn!("Direct message from '{from}' not kept for history: {e}");
+            }
+            // a note to self is delivered once, via the channel
+            if !target.is_same_user(&from) {
+                send_message_to_client(writer, &direct_message).await?;
+            }
+        }
+        Err(e) => {
+            info!("Direct message from '{from}' not delivered: {e}");
+            send_message_to_client(writer, &refusal(&e)).await?;
+        }
+    }
+    Ok(())
+}
+
+/// Queues the recent private messages between the user and `username` for
+/// them alone, or returns what to tell them instead.
+/// Queues the room's history for `joined` again, from after `after` if
+/// given; anything to say instead of a replay is returned.
+fn resync(joined: &Joined, after: Option<u64>) -> Option<ServerMessage> {
+    match get_broker().registry().resync(&joined.user.get_username(), after) {
+        Ok(0) => Some(ServerMessage::Info {
+            text: "Nothing to replay".to_string(),
+        }),
+        Ok(_) => None,
+        Err(e) => Some(refusal(&e)),
+    }
+}
+
+fn direct_history(joined: &Joined, username: &str) -> Option<ServerMessage> {
+    let Ok(other) = Username::new(username) else {
+        return Some(refusal(&UserError::UserNotFound(username.to_string())));
+    };
+    let lines = match get_broker()
+        .registry()
+        .direct_history(&joined.user.get_username(), &other)
+    {
+        Ok(lines) => lines,
+        Err(e) => return Some(refusal(&e)),
+    };
+    if lines.is_empty() {
+        return Some(ServerMessage::Info {
+            text: format!("No messages with {other}"),
+        });
+    }
+    for line in lines {
+        if !joined.user.try_deliver(line) {
+            warn!(
+                "Direct history replay to '{}' cut short, outbound queue full",
+                joined.user
+            );
+            break;
+        }
+    }
+    None
+}
+
+/// Sends a `me` action to the user's room like any other chat line.
+async fn send_action(joined: &mut Joined, writer: &mut Outbound, text: String) -> Result<(), ConnectionError> {
+    if text.trim().is_empty() {
+        let refused = Refused::new(ErrorCode::EMPTY_MESSAGE, "action cannot be empty");
+        return Ok(send_message_to_client(writer, &refused.into()).await?);
+    }
+    if within_limits(joined, writer, &text).await? {
+        send_chat_line(joined, writer, |timestamp, username| ServerMessage::Action {
+            timestamp,
+            username,
+            text,
+        })
+        .await?;
+    }
+    Ok(())
+}
+
+/// Sends a `send` line to the user's room. One that carries an id is
+/// answered with `ACK` once the room has it, or `NACK` and the reason it
+/// was refused; without one, only a refusal is reported, as `ERR`. An id
+/// acked lately can't be used again, so no two `ACK`s are alike.
+///
+/// A reply names the line it answers by `reply_to`, which must still be in
+/// the room's history.
+async fn send_message(
+    joined: &mut Joined,
+    writer: &mut Outbound,
+    id: Option<String>,
+    reply_to: Option<String>,
+    message: String,
+) -> Result<(), ConnectionError> {
+    let outcome = match id.as_deref().map(|id| joined.send_ids.check(id)) {
+        Some(Err(e)) => Err(Refused::new(ErrorCode::BAD_REQUEST, e.to_string())),
+        // blank is as good as empty: nobody wants a room full of nothing
+        _ if message.trim().is_empty() => Err(Refused::new(ErrorCode::EMPTY_MESSAGE, EMPTY_MESSAGE)),
+        _ => check_reply_to(joined, reply_to.as_deref())
+            .and_then(|()| check_limits(joined, &message, writer.framed).map_err(Refused::from))
+            .and_then(|()| post_broadcast(joined, reply_to, message)),
+    };
+    let reply = match (id, outcome) {
+        (None, Ok(())) => return Ok(()),
+        (Some(id), Ok(())) => {
+            joined.send_ids.record(&id);
+            ServerMessage::Ack { id }
+        }
+        (Some(id), Err(refused)) => ServerMessage::Nack {
+            id,
+            code: refused.code,
+            reason: refused.reason,
+        },
+        (None, Err(refused)) => refused.into(),
+    };
+    Ok(send_message_to_client(writer, &reply).await?)
+}
+
+/// Refuses a reply to a line the user's room no longer has in its history,
+/// or never had.
+fn check_reply_to(joined: &Joined, reply_to: Option<&str>) -> Result<(), Refused> {
+    let Some(reply_to) = reply_to else {
+        return Ok(());
+    };
+    let registry = get_broker().registry();
+    let channel = registry.channel_of(&joined.user.get_username())?;
+    if registry.has_line(&channel, reply_to)? {
+        return Ok(());
+    }
+    Err(Refused::new(
+        ErrorCode::NO_SUCH_MESSAGE,
+        format!("no such message: {reply_to}"),
+    ))
+}
+
+/// Sends a `send` line under a new id, by which the user may edit or delete
+/// it for a while.
+fn post_broadcast(joined: &mut Joined, reply_to: Option<String>, message: String) -> Result<(), Refused> {
+    let id = get_broker().message_id();
+    let channel = post_chat_line(joined, |timestamp, username| ServerMessage::Broadcast {
+        timestamp,
+        id: id.clone(),
+        username,
+        message,
+        reply_to,
+    })?;
+    joined.recent.record(id, channel, Instant::now());
+    Ok(())
+}
+
+/// Replaces the text of one of the user's own recent lines with `message`
+/// or, without one, deletes it, and tells the room. A line that isn't
+/// theirs, has aged out or was sent to another room gets `ERR cannot edit`.
+async fn amend_line(
+    joined: &mut Joined,
+    writer: &mut Outbound,
+    id: String,
+    message: Option<String>,
+) -> Result<(), ConnectionError> {
+    // a delete counts against the rate limit like any other line
+    if !within_limits(joined, writer, message.as_deref().unwrap_or_default()).await? {
+        return Ok(());
+    }
+    let broker = get_broker();
+    let username = joined.user.get_username();
+    let channel = match broker.registry().channel_of(&username) {
+        Ok(channel) => channel,
+        Err(e) => {
+            warn!("Failed to look up room for '{username}': {e}");
+            return Ok(send_message_to_client(writer, &refusal(&e)).await?);
+        }
+    };
+    if !joined.recent.is_editable(&id, &channel, Instant::now()) {
+        info!("'{username}' ({}) may not change line {id}", joined.addr);
+        let refused = Refused::new(ErrorCode::CANNOT_EDIT, CANNOT_EDIT);
+        return Ok(send_message_to_client(writer, &refused.into()).await?);
+    }
+
+    let timestamp = broker.timestamp();
+    let username = username.to_string();
+    let amended = match message {
+        Some(message) => ServerMessage::Edited {
+            timestamp,
+            id,
+            username,
+            message,
+        },
+        None => ServerMessage::Deleted {
+            timestamp,
+            id,
+            username,
+        },
+    };
+    if let Err(refused) = deliver_chat_line(joined, &channel, &amended) {
+        return Ok(send_message_to_client(writer, &refused.into()).await?);
+    }
+    if let ServerMessage::Deleted { id, .. } = &amended {
+        joined.recent.forget(id);
+    }
+    Ok(())
+}
+
+/// Sends a chat line like [`post_chat_line`], telling the client with `ERR`
+/// if it could not.
+async fn send_chat_line(
+    joined: &mut Joined,
+    writer: &mut Outbound,
+    line: impl FnOnce(String, String) -> ServerMessage + Send,
+) -> Result<(), ConnectionError> {
+    if let Err(refused) = post_chat_line(joined, line) {
+        send_message_to_client(writer, &refused.into()).await?;
+    }
+    Ok(())
+}
+
+/// Sends a chat line, built from the timestamp and sender's name, to the
+/// user's room, where it is also kept in history. Returns the room, or the
+/// reason it could not be sent.
+fn post_chat_line(
+    joined: &mut Joined,
+    line: impl FnOnce(String, String) -> ServerMessage,
+) -> Result<ChannelName, Refused> {
+    let broker = get_broker();
+    let username = joined.user.get_username();
+    let channel = broker
+        .registry()
+        .channel_of(&username)
+        .inspect_err(|e| warn!("Failed to look up room for '{username}': {e}"))?;
+    let chat_line = line(broker.timestamp(), username.to_string());
+    // a line sent ends the typing that led up to it, and any time away
+    stop_typing(joined);
+    if joined.user.set_away(false) {
+        announce_presence(joined, &channel, None)?;
+    }
+
+    deliver_chat_line(joined, &channel, &chat_line)?;
+    get_metrics().broadcast();
+    Ok(channel)
+}
+
+/// Sends `chat_line` to `channel` and its history, censored for everyone
+/// but the sender, and keeps it in the transcript.
+fn deliver_chat_line(joined: &Joined, channel: &ChannelName, chat_line: &ServerMessage) -> Result<(), Refused> {
+    let broker = get_broker();
+    let username = joined.user.get_username();
+    let censored = get_filter().and_then(|filter| filter.censor_line(chat_line));
+    // the room, and its history, get the censored line; the sender sees what they typed
+    let forwarded = censored.map_or_else(
+        || broker.forward_chat_line(channel.clone(), chat_line.encode()),
+        |censored| {
+            broker.forward_chat_line_to_others(channel.clone(), &username, censored.encode(), chat_line.encode())
+        },
+    );
+    forwarded.inspect_err(|e| warn!("Failed to send message to room: {e}"))?;
+    if let Some(transcript) = get_transcript()
+        && let Err(e) = transcript.record(channel, chat_line)
+    {
+        error!("Chat line from '{username}' missing from transcript: {e}");
+    }
+    Ok(())
+}
+
+/// Shares a file with the user's room, the user included, if the server
+/// takes files that large and the user's quota has room for it, or tells
+/// the client why not. Files are never kept in history or logged.
+async fn share_file(joined: &Joined, writer: &mut Outbound, name: String, data: String) -> Result<(), ConnectionError> {
+    let shared = check_file(joined, &name, &data).and_then(|size| post_file(joined, name, data, size));
+    if let Err(refused) = shared {
+        info!(
+            "File from '{}' ({}) refused: {}",
+            joined.user, joined.addr, refused.reason
+        );
+        send_message_to_client(writer, &refused.into()).await?;
+    }
+    Ok(())
+}
+
+/// Lets the client's `send`s carry bytes that aren't UTF-8, which are shared
+/// as files so that no one else's terminal gets them raw; there is nothing
+/// to share them as while files are off.
+fn allow_binary(writer: &mut Outbound) -> ServerMessage {
+    if get_config().max_file_size == 0 {
+        return Refused::new(ErrorCode::FILES_DISABLED, "file sharing is off").into();
+    }
+    writer.binary = true;
+    ServerMessage::Ok
+}
+
+/// Shares the bytes of a binary `send` with the user's room as a file named
+/// [`consts::BINARY_FILE_NAME`], under the same limits and quota.
+async fn send_bytes(joined: &Joined, writer: &mut Outbound, payload: &[u8]) -> Result<(), ConnectionError> {
+    let name = consts::BINARY_FILE_NAME.to_string();
+    share_file(joined, writer, name, file::encode_data(payload)).await
+}
+
+/// Checks a shared file against the server's limits and the rate limit,
+/// returning its size.
+fn check_file(joined: &Joined, name: &str, data: &str) -> Result<usize, Refused> {
+    let config = get_config();
+    let too_large = || {
+        Refused::new(
+            ErrorCode::FILE_TOO_LARGE,
+            format!("file too large (max {})", config.max_file_size),
+        )
+    };
+    if config.max_file_size == 0 {
+        return Err(Refused::new(ErrorCode::FILES_DISABLED, "file sharing is off"));
+    }
+    if !file::is_valid_name(name) {
+        return Err(Refused::new(ErrorCode::BAD_REQUEST, "invalid file name"));
+    }
+    // an oversized file is refused before it is decoded
+    if data.len() > file::encoded_len(config.max_file_size) {
+        return Err(too_large());
+    }
+    let Some(size) = file::decode_data(data).map(|bytes| bytes.len()) else {
+        return Err(Refused::new(ErrorCode::BAD_REQUEST, "file data is not base64"));
+    };
+    if size > config.max_file_size {
+        return Err(too_large());
+    }
+    // counted by name, so reconnecting or rejoining doesn't renew it
+    let before = get_broker().registry().files_shared(&joined.user.get_username())?;
+    if config.file_quota > 0 && before.saturating_add(size) > config.file_quota {
+        let left = config.file_quota.saturating_sub(before);
+        return Err(Refused::new(
+            ErrorCode::QUOTA_EXCEEDED,
+            format!("file quota exceeded ({left} of {} bytes left)", config.file_quota),
+        ));
+    }
+    let (channel, limits) = room_limits(joined);
+    if !joined.try_acquire(channel, &limits) {
+        return Err(ConnectionError::RateLimited.into());
+    }
+    Ok(size)
+}
+
+/// Sends `FILE` to the user's room and counts it against their quota.
+fn post_file(joined: &Joined, name: String, data: String, size: usize) -> Result<(), Refused> {
+    let broker = get_broker();
+    let username = joined.user.get_username();
+    let channel = broker
+        .registry()
+        .channel_of(&username)
+        .inspect_err(|e| warn!("Failed to look up room for '{username}': {e}"))?;
+    info!("'{username}' shared '{name}' ({size} bytes) with {channel}");
+    let shared = ServerMessage::File {
+        timestamp: broker.timestamp(),
+        username: username.to_string(),
+        name,
+        size: u64::try_from(size).unwrap_or(u64::MAX),
+        data,
+    };
+    broker
+        .forward_to_channel(channel, shared.encode())
+        .inspect_err(|e| warn!("Failed to send file to room: {e}"))?;
+    if let Err(e) = broker.registry().count_file(&username, size) {
+        warn!("Failed to count the file '{username}' shared against their quota: {e}");
+    }
+    Ok(())
+}
+
+/// Marks the user away, with `note` if it isn't empty, and tells their room;
+/// the next line they send brings them back.
+async fn go_away(joined: &mut Joined, writer: &mut Outbound, note: String) -> Result<(), ConnectionError> {
+    if !within_limits(joined, writer, &note).await? {
+        return Ok(());
+    }
+    let username = joined.user.get_username();
+    let channel = match get_broker().registry().channel_of(&username) {
+        Ok(channel) => channel,
+        Err(e) => {
+            warn!("Failed to look up room for '{username}': {e}");
+            return Ok(send_message_to_client(writer, &refusal(&e)).await?);
+        }
+    };
+    joined.user.set_away(true);
+    if let Err(e) = announce_presence(joined, &channel, Some(note)) {
+        send_message_to_client(writer, &refusal(&e)).await?;
+    }
+    Ok(())
+}
+
+/// Tells the whole room, the user included, that they went away or came
+/// back. Presence is never kept in history.
+fn announce_presence(joined: &Joined, channel: &ChannelName, away: Option<String>) -> Result<(), RoomError> {
+    let broker = get_broker();
+    let notice = ServerMessage::Presence {
+        timestamp: broker.timestamp(),
+        username: joined.user.get_username().to_string(),
+        away,
+    };
+    broker
+        .forward_to_channel(channel.clone(), notice.encode())
+        .inspect_err(|e| warn!("Failed to send presence to room: {e}"))
+}
+
+/// Tells the room the user is typing, unless it already knows, and puts off
+/// the automatic stop.
+fn start_typing(joined: &mut Joined, now: Instant) {
+    let was_typing = joined.typing_until.is_some();
+    joined.typing_until = now.checked_add(TYPING_TIMEOUT);
+    if !was_typing {
+        announce_typing(joined, true);
+    }
+}
+
+/// Tells the room the user stopped typing, if they were. Every way out of
+/// the room goes through here, so nobody is left shown as typing.
+fn stop_typing(joined: &mut Joined) {
+    if joined.typing_until.take().is_some() {
+        announce_typing(joined, false);
+    }
+}
+
+/// Typing notices go to the rest of the room only, and are never kept.
+fn announce_typing(joined: &Joined, active: bool) {
+    let broker = get_broker();
+    let username = joined.user.get_username();
+    let channel = match broker.registry().channel_of(&username) {
+        Ok(channel) => channel,
+        Err(e) => {
+            warn!("Failed to look up room for '{username}': {e}");
+            return;
+        }
+    };
+    let notice = ServerMessage::Typing {
+        username: username.to_string(),
+        active,
+    };
+    if let Err(e) = broker.forward_to_others(channel, &username, notice.encode()) {
+        warn!("Failed to send typing notice to room: {e}");
+    }
+}
+
+/// Renames the user, then tells everyone online. Room, rate limit and
+/// operator status all stay with the connection.
+fn change_nick(joined: &mut Joined, raw_username: &str) -> ServerMessage {
+    let username = match Username::new(raw_username) {
+        Ok(username) => username,
+        Err(e) => return refusal(&e),
+    };
+    let from = joined.user.get_username();
+    if username == from {
+        return ServerMessage::Ok;
+    }
+    match get_ban_list().is_banned(&username, joined.addr.ip()) {
+        Ok(false) => {}
+        Ok(true) => {
+            return refusal(&UserError::Banned);
+        }
+        Err(e) => return refusal(&e),
+    }
+    if let Err(e) = check_cooldown(&username) {
+        return refusal(&e);
+    }
+
+    let broker = get_broker();
+    match broker.registry().rename(&joined.user, &username) {
+        Ok(renamed) => joined.user = renamed,
+        Err(e) => return refusal(&e),
+    }
+    if let Some(token) = &joined.session
+        && let Err(e) = get_sessions().rename(token, &username)
+    {
+        warn!("Session of '{from}' not renamed: {e}");
+    }
+    info!("'{from}' ({}) is now known as '{username}'", joined.addr);
+    match broker.registry().channel_of(&username) {
+        Ok(channel) => get_rosters().changed(&channel),
+        Err(e) => warn!("Failed to look up room for '{username}': {e}"),
+    }
+    let notice = ServerMessage::Renamed {
+        timestamp: broker.timestamp(),
+        from: from.to_string(),
+        to: username.to_string(),
+    };
+    if let Err(e) = broker.forward_to_everyone(notice.encode()) {
+        warn!("Failed to announce rename of '{from}': {e}");
+    }
+    ServerMessage::Ok
+}
+
+/// Grants operator rights if `token` matches `CHAT_ADMIN_TOKEN`.
+fn authenticate(joined: &mut Joined, token: &str) -> ServerMessage {
+    let matches = get_config()
+        .admin_token
+        .as_ref()
+        .is_some_and(|expected| constant_time_eq(expected.as_bytes(), token.as_bytes()));
+    if !matches {
+        warn!("Failed operator auth from '{}' ({})", joined.user, joined.addr);
+        return not_authorized();
+    }
+    info!("'{}' ({}) is now an operator", joined.user, joined.addr);
+    joined.is_admin = true;
+    ServerMessage::Info {
+        text: "Authenticated as operator".to_string(),
+    }
+}
+
+/// What anyone but an operator gets for an operator command.
+fn not_authorized() -> ServerMessage {
+    Refused::new(ErrorCode::NOT_AUTHORIZED, NOT_AUTHORIZED).into()
+}
+
+/// Runs a kick, ban, unban or drop once the sender is known to be an
+/// operator.
+async fn operator_command(joined: &Joined, command: ClientMessage) -> ServerMessage {
+    if !joined.is_admin {
+        warn!("'{}' ({}) tried '{command}' without auth", joined.user, joined.addr);
+        return not_authorized();
+    }
+    match command {
+        ClientMessage::Kick { username } => kick(joined, &username).await,
+        ClientMessage::Ban { username } => ban(joined, &username).await,
+        ClientMessage::Unban { username } => unban(joined, &username),
+        ClientMessage::DropConnection { addr } => drop_connection(joined, &addr),
+        other => Refused::new(ErrorCode::BAD_REQUEST, format!("not an operator command: {other}")).into(),
+    }
+}
+
+/// Shows an operator `room`'s limits or, given a `policy`, sets them first.
+/// The room need not exist yet: it takes them up once someone joins it.
+fn room_policy(joined: &Joined, room: &str, policy: &str) -> ServerMessage {
+    if !joined.is_admin {
+        warn!("'{}' ({}) tried 'ROOMPOLICY' without auth", joined.user, joined.addr);
+        return not_authorized();
+    }
+    let channel = match ChannelName::new(room) {
+        Ok(channel) => channel,
+        Err(e) => return refusal(&e),
+    };
+    let policies = get_policies();
+    let policy = policy.trim();
+    if policy.eq_ignore_ascii_case("default") {
+        policies.set(channel.clone(), None);
+        info!("'{}' dropped the policy set for {channel}", joined.user);
+    } else if !policy.is_empty() {
+        match policy.parse() {
+            Ok(policy) => {
+                policies.set(channel.clone(), Some(policy));
+                info!("'{}' set {channel} to {policy}", joined.user);
+            }
+            Err(reason) => return Refused::new(ErrorCode::BAD_REQUEST, reason).into(),
+        }
+    }
+    ServerMessage::Info {
+        text: format!("{channel}: {}", policies.limits(&channel)),
+    }
+}
+
+/// Builds the reply to an operator's `stats`, one line per figure.
+fn stats_reply(joined: &Joined, registry: &UserRegistry) -> Vec<ServerMessage> {
+    if !joined.is_admin {
+        warn!("'{}' ({}) tried 'STATS' without auth", joined.user, joined.addr);
+        return vec![not_authorized()];
+    }
+    match registry.user_count() {
+        Ok(connected) => get_metrics()
+            .summary(connected)
+            .into_iter()
+            .map(|text| ServerMessage::Info { text })
+            .collect(),
+        Err(e) => vec![refusal(&e)],
+    }
+}
+
+/// Sends an operator's notice to everyone online, whatever their room. The
+/// message is checked like a chat line but never rate limited, so a warning
+/// goes out however busy the operator has been.
+fn announce(joined: &Joined, message: &str, framed: bool) -> ServerMessage {
+    if !joined.is_admin {
+        warn!("'{}' ({}) tried 'BROADCAST' without auth", joined.user, joined.addr);
+        return not_authorized();
+    }
+    if let Err(e) =
+        check_message_chars(message, framed).and_then(|()| check_message_len(message, get_config().max_msg_len))
+    {
+        return refusal(&e);
+    }
+    let broker = get_broker();
+    let notice = ServerMessage::Announcement {
+        timestamp: broker.timestamp(),
+        text: message.to_string(),
+    };
+    if let Err(e) = broker.forward_to_everyone(notice.encode()) {
+        error!("Failed to send announcement from '{}': {e}", joined.user);
+        return refusal(&e);
+    }
+    info!("'{}' ({}) announced: {message}", joined.user, joined.addr);
+    ServerMessage::Ok
+}
+
+/// Disconnects `target` on behalf of an operator; the target's own
+/// connection tells its room once the notice has been written.
+async fn kick(joined: &Joined, target: &str) -> ServerMessage {
+    let Ok(target) = Username::new(target) else {
+        return refusal(&UserError::UserNotFound(target.to_string()));
+    };
+    let notice = ServerMessage::Info {
+        text: "You were kicked by an operator".to_string(),
+    };
+    match get_broker().disconnect_user(&target, notice.encode()).await {
+        Ok(()) => {
+            info!("'{}' kicked '{target}'", joined.user);
+            ServerMessage::Info {
+                text: format!("Kicked {target}"),
+            }
+        }
+        Err(e) => refusal(&e),
+    }
+}
+
+/// Bans `target` by name and, if they are online, by address too, then
+/// disconnects them.
+async fn ban(joined: &Joined, target: &str) -> ServerMessage {
+    let target = match Username::new(target) {
+        Ok(target) => target,
+        Err(e) => return refusal(&e),
+    };
+    let addr = get_broker().registry().addr_of(&target).ok();
+    if let Err(e) = get_ban_list().ban(&target, addr) {
+        error!("Failed to ban '{target}': {e}");
+        return refusal(&e);
+    }
+    info!("'{}' banned '{target}' ({addr:?})", joined.user);
+
+    if addr.is_some() {
+        let notice = ServerMessage::Info {
+            text: "You were banned by an operator".to_string(),
+        };
+        // they may have left since the lookup; the ban stands either way
+        if let Err(e) = get_broker().disconnect_user(&target, notice.encode()).await {
+            info!("Banned '{target}' was not disconnected: {e}");
+        }
+    }
+    ServerMessage::Info {
+        text: format!("Banned {target}"),
+    }
+}
+
+fn unban(joined: &Joined, target: &str) -> ServerMessage {
+    let target = match Username::new(target) {
+        Ok(target) => target,
+        Err(e) => return refusal(&e),
+    };
+    match get_ban_list().unban(&target) {
+        Ok(()) => {
+            info!("'{}' unbanned '{target}'", joined.user);
+            ServerMessage::Info {
+                text: format!("Unbanned {target}"),
+            }
+        }
+        Err(e) => refusal(&e),
+    }
+}
+
+/// Closes every connection from `addr`, joined or not, on behalf of an
+/// operator; each tells its client why and, if joined, its room.
+fn drop_connection(joined: &Joined, addr: &str) -> ServerMessage {
+    let Ok(target) = addr.parse::<SocketAddr>() else {
+        return Refused::new(
+            ErrorCode::BAD_REQUEST,
+            format!("invalid address '{addr}', expected ip:port"),
+        )
+        .into();
+    };
+    match get_connections().drop_addr(target) {
+        Ok(count) => {
+            info!(
+                "'{}' ({}) dropped {count} connection(s) from {target}",
+                joined.user, joined.addr
+            );
+            ServerMessage::Info {
+                text: format!("Dropped {target}"),
+            }
+        }
+        Err(e) => refusal(&e),
+    }
+}
+
+/// What a connection an operator dropped is told before it closes.
+fn dropped_notice() -> ServerMessage {
+    ServerMessage::Info {
+        text: "You were disconnected by an operator".to_string(),
+    }
+}
+
+/// Checks a chat message's characters and length and the rate limit, or
+/// tells the client its message was dropped.
+async fn within_limits(joined: &Joined, writer: &mut Outbound, message: &str) -> Result<bool, ConnectionError> {
+    let Err(e) = check_limits(joined, message, writer.framed) else {
+        return Ok(true);
+    };
+    send_message_to_client(writer, &refusal(&e)).await?;
+    Ok(false)
+}
+
+/// Checks a chat message's characters and length and the rate limit, those
+/// of the sender's room. Line breaks are allowed only if the message came
+/// `framed`.
+fn check_limits(joined: &Joined, message: &str, framed: bool) -> Result<(), ConnectionError> {
+    let (channel, limits) = room_limits(joined);
+    check_message_chars(message, framed)
+        .and_then(|()| check_message_len(message, limits.max_msg_len))
+        .and_then(|()| {
+            if joined.try_acquire(channel, &limits) {
+                Ok(())
+            } else {
+                Err(ConnectionError::RateLimited)
+            }
+        })
+        .inspect_err(|e| info!("Dropping message from '{}' ({}): {e}", joined.user, joined.addr))
+}
+
+/// The user's room and the limits there; the server's own if the room
+/// can't be told.
+fn room_limits(joined: &Joined) -> (Option<ChannelName>, Limits) {
+    let username = joined.user.get_username();
+    match get_broker().registry().channel_of(&username) {
+        Ok(channel) => {
+            let limits = get_policies().limits(&channel);
+            (Some(channel), limits)
+        }
+        Err(e) => {
+            warn!("Failed to look up room for '{username}': {e}");
+            (None, Limits::global(&get_config()))
+        }
+    }
+}
+
+/// Refuses control characters, which could move a recipient's cursor or
+/// start a forged line in their output. Tabs are fine, and so are line
+/// breaks in a frame, which carries them intact; a line client gets them as
+/// spaces.
+fn check_message_chars(message: &str, framed: bool) -> Result<(), ConnectionError> {
+    let allowed = |c: char| c == '\t' || (framed && matches!(c, '\n' | '\r'));
+    if message.chars().any(|c| c.is_control() && !allowed(c)) {
+        return Err(ConnectionError::IllegalCharacters);
+    }
+    Ok(())
+}
+
+/// Counts bytes, not characters. An oversized message is rejected whole
+/// rather than truncated, so a UTF-8 sequence is never split.
+const fn check_message_len(message: &str, max_len: usize) -> Result<(), ConnectionError> {
+    if message.len() > max_len {
+        return Err(ConnectionError::MessageTooLong(max_len));
+    }
+    Ok(())
+}
+
+/// Longest line or frame read from a client: a message as long as any room
+/// takes, or a file as large as the server shares, encoded, plus room for
+/// the command and other fields. A client that sends a longer one is
+/// dropped; no more than this is ever buffered for it.
+fn max_line_len() -> usize {
+    let max_file_size = get_config().max_file_size;
+    let longest_file = if max_file_size > 0 {
+        file::encoded_len(max_file_size).saturating_add(file::MAX_NAME_LEN)
+    } else {
+        0
+    };
+    get_policies()
+        .longest_msg_len()
+        .max(longest_file)
+        .saturating_add(MAX_CLIENT_BUFFER_SIZE)
+}
+
+/// Builds the reply to `rooms`: every non-empty room with its member count.
+fn rooms_reply(registry: &UserRegistry) -> ServerMessage {
+    match registry.channel_counts() {
+        Ok(counts) => {
+            let listing: Vec<String> = counts
+                .iter()
+                .map(|(channel, members)| format!("{channel} ({members})"))
+                .collect();
+            ServerMessage::Info {
+                text: format!("Rooms ({}): {}", counts.len(), listing.join(", ")),
+            }
+        }
+        Err(e) => refusal(&e),
+    }
+}
+
+/// Builds the reply to `help`: the commands this user can give, as the
+/// client takes them, one per line. `auth` is listed only if the server has
+/// an admin token, and the operator commands once the user has claimed it.
+fn help_reply(joined: &Joined) -> Vec<ServerMessage> {
+    let config = get_config();
+    let mut commands = vec![
+        ("send <message>", "say something to your room"),
+        ("sendid <id> <message>", "send, and get ACK or NACK with the id"),
+        ("reply <id> <message>", "answer a line still in your room's history"),
+        ("me <action>", "emote to your room"),
+        ("edit <id> <message>", "change one of your recent lines"),
+        ("delete <id>", "take back one of your recent lines"),
+        ("away [note]", "show as away until your next line"),
+        ("dm <username> <message>", "message one user privately"),
+        ("dm-history <username>", "replay your recent messages with a user"),
+        (
+            "resync [number]",
+            "replay your room's history, after a line number if given",
+        ),
+        ("join #room", "move to another room"),
+        ("rooms", "list the rooms in use"),
+        ("who", "list who is in your room"),
+        ("nick <newname>", "change your name"),
+        ("ping", "time a round trip to the server"),
+    ];
+    if config.max_file_size > 0 {
+        commands.push(("sendfile <path>", "share a file with your room"));
+    }
+    if joined.is_admin {
+        commands.extend([
+            ("kick <username>", "disconnect a user"),
+            ("ban <username>", "disconnect a user and keep their address out"),
+            ("unban <username>", "lift a ban"),
+            ("stats", "show uptime, load and memory"),
+            ("who-all", "list everyone online, by room"),
+            ("conns", "list open connections, joined or not"),
+            ("drop <ip:port>", "close the connections from an address"),
+            ("broadcast <message>", "announce to everyone, in every room"),
+            (
+                "room-policy #room [rate=N burst=N len=N | default]",
+                "show or set a room's limits",
+            ),
+        ]);
+    } else if config.admin_token.is_some() {
+        commands.push(("auth <token>", "claim operator rights"));
+    }
+    commands.extend([("help", "show this list"), ("leave", "leave the chat")]);
+
+    let (_, limits) = room_limits(joined);
+    let files = if config.max_file_size > 0 {
+        format!(", files up to {} bytes", config.max_file_size)
+    } else {
+        String::new()
+    };
+    let mut reply = vec![ServerMessage::Info {
+        text: format!("Commands (messages up to {} characters{files}):", limits.max_msg_len),
+    }];
+    reply.extend(commands.into_iter().map(|(usage, what)| ServerMessage::Info {
+        text: format!("  {usage} - {what}"),
+    }));
+    if let Some(aliases) = config.aliases.summary() {
+        reply.push(ServerMessage::Info {
+            text: format!("Also: {aliases}"),
+        });
+    }
+    reply
+}
+
+/// Builds the reply to `who`: everyone in the requester's room, the
+/// requester included, with those away marked. Other rooms stay private;
+/// operators see them with `who-all`.
+fn who_reply(joined: &Joined, registry: &UserRegistry) -> ServerMessage {
+    let online = registry
+        .channel_of(&joined.user.get_username())
+        .and_then(|channel| Ok((registry.online_in(&channel)?, channel)));
+    match online {
+        Ok((online, channel)) => ServerMessage::Info {
+            text: format!("Online in {channel} ({}): {}", online.len(), listed(&online)),
+        },
+        Err(e) => refusal(&e),
+    }
+}
+
+/// Builds the reply to `who-all` for an operator: a count of everyone
+/// online, then a line per room listing who is in it.
+fn who_all_reply(joined: &Joined, registry: &UserRegistry) -> Vec<ServerMessage> {
+    if !joined.is_admin {
+        warn!("'{}' ({}) tried 'WHOALL' without auth", joined.user, joined.addr);
+        return vec![not_authorized()];
+    }
+    let grouped = match registry.online_by_channel() {
+        Ok(grouped) => grouped,
+        Err(e) => return vec![refusal(&e)],
+    };
+    let total = grouped.iter().map(|(_, users)| users.len()).sum::<usize>();
+    let mut reply = vec![ServerMessage::Info {
+        text: format!("Online everywhere ({total}), by room:"),
+    }];
+    reply.extend(grouped.iter().map(|(channel, users)| ServerMessage::Info {
+        text: format!("  {channel} ({}): {}", users.len(), listed(users)),
+    }));
+    reply
+}
+
+/// Builds the reply to an operator's `conns`: a count, then a line per open
+/// connection, joined or not, by address.
+fn conns_reply(joined: &Joined) -> Vec<ServerMessage> {
+    if !joined.is_admin {
+        warn!("'{}' ({}) tried 'CONNS' without auth", joined.user, joined.addr);
+        return vec![not_authorized()];
+    }
+    let conns = match get_connections().list() {
+        Ok(conns) => conns,
+        Err(e) => return vec![refusal(&e)],
+    };
+    let mut reply = vec![ServerMessage::Info {
+        text: format!("Open connections ({}):", conns.len()),
+    }];
+    reply.extend(conns.iter().map(|conn| ServerMessage::Info {
+        text: format!("  {}", listed_conn(conn, get_broker().registry())),
+    }));
+    reply
+}
+
+/// `conn`'s address, username, room and when it connected, with `-` for
+/// what a client yet to join doesn't have.
+fn listed_conn(conn: &Conn, registry: &UserRegistry) -> String {
+    let (username, room) = conn.username.as_ref().map_or_else(
+        || ("-".to_string(), "-".to_string()),
+        |username| {
+            let room = registry
+                .channel_of(username)
+                .map_or_else(|_| "-".to_string(), |channel| channel.to_string());
+            (username.to_string(), room)
+        },
+    );
+    format!("{} {username} {room} connected {}", conn.addr, conn.connected_at)
+}
+
+/// `users` by name, comma separated, with those away marked.
+fn listed(users: &[User]) -> String {
+    users
+        .iter()
+        .map(|user| {
+            if user.is_away() {
+                format!("{user} (away)")
+            } else {
+                user.to_string()
+            }
+        })
+        .collect::<Vec<_>>()
+        .join(", ")
+}
+
+/// Moves the user into `channel`, telling both the old and new room.
+async fn switch_channel(
+    joined: &mut Joined,
+    writer: &mut Outbound,
+    channel: ChannelName,
+) -> Result<(), ConnectionError> {
+    let broker = get_broker();
+    let username = joined.user.get_username();
+    // told to the room being left
+    stop_typing(joined);
+
+    let previous = match broker.registry().move_to_channel(&username, &channel) {
+        Ok(previous) => previous,
+        Err(e) => {
+            send_message_to_client(writer, &refusal(&e)).await?;
+            return Ok(());
+        }
+    };
+    info!("User '{username}' moved from {previous} to {channel}");
+    get_rosters().changed(&previous);
+    get_rosters().changed(&channel);
+
+    let timestamp = broker.timestamp();
+    let left_message = ServerMessage::UserLeft {
+        timestamp: timestamp.clone(),
+        username: username.to_string(),
+        room: previous.to_string(),
+        disconnected: false,
+    };
+    let joined_message = ServerMessage::UserJoined {
+        timestamp,
+        username: username.to_string(),
+        room: channel.to_string(),
+    };
+    for (target, msg) in [(previous, left_message), (channel, joined_message)]
+        .into_iter()
+        .filter(|(_, msg)| is_notified(msg))
+    {
+        if let Err(e) = broker.forward_to_channel(target, msg.encode()) {
+            warn!("Failed to send message to room: {e}");
+            send_message_to_client(writer, &refusal(&e)).await?;
+        }
+    }
+    Ok(())
+}
+
+async fn send_message_to_client(writer: &mut Outbound, msg: &ServerMessage) -> Result<(), std::io::Error> {
+    let line = writer.format.encode_server(msg, None);
+    writer.write_message(&line).await
+}
+
+#[cfg(test)]
+#[allow(clippy::unwrap_used)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_check_message_len_counts_bytes() {
+        // 'é' is two bytes in UTF-8
+        let at_limit = "é".repeat(1024);
+        assert_eq!(at_limit.len(), 2048);
+        assert!(check_message_len(&at_limit, 2048).is_ok());
+
+        let err = check_message_len(&format!("{at_limit}a"), 2048).unwrap_err();
+        assert_eq!(err.to_string(), "message too long (max 2048)");
+        assert!(check_message_len("héllo", 5).is_err());
+    }
+
+    #[test]
+    fn test_check_message_chars() {
+        assert!(check_message_chars("tabs\tand ünïcode are fine", false).is_ok());
+        assert!(check_message_chars("line one\r\nline two", true).is_ok());
+        let err = check_message_chars("foo\nbar", false).unwrap_err();
+        assert_eq!(err.to_string(), "message contains illegal characters");
+        assert!(check_message_chars("\x1b[2Jcleared", true).is_err());
+        assert!(check_message_chars("nul\0", true).is_err());
+        assert!(check_message_chars("back\x08space", false).is_err());
+    }
+
+    #[test]
+    fn test_is_userlist() {
+        let snapshot = ServerMessage::UserList {
+            room: "#general".to_string(),
+            users: vec!["alice".to_string()],
+        };
+        assert!(is_userlist(&snapshot.encode()));
+        assert!(!is_userlist(b"USERLISTS|#general|alice"));
+        assert!(!is_userlist(b"BROADCAST|2024-01-02T15:04:05Z|7|alice|USERLIST|x"));
+    }
+
+    #[test]
+    fn test_without_seq() {
+        let line = b"BROADCAST|2024-01-02T15:04:05Z|7|alice|SEQ|3|x";
+        assert_eq!(
+            &*without_seq(b"SEQ|12|BROADCAST|2024-01-02T15:04:05Z|7|alice|SEQ|3|x"),
+            line
+        );
+        assert_eq!(
+            &*without_seq(b"HISTORY|SEQ|12|DELETED|2024-01-02T15:04:05Z|7|alice"),
+            b"HISTORY|DELETED|2024-01-02T15:04:05Z|7|alice"
+        );
+        assert_eq!(&*without_seq(line), line);
+        assert_eq!(&*without_seq(b"SEQ|x|BROADCAST"), b"SEQ|x|BROADCAST");
+    }
 }
@@ -0,0 +1,200 @@
+//! Every open connection, joined or not, so that an operator can list them
+//! with `conns` and end one with `drop <addr>`, even a client that has yet
+//! to pick a username.
+//!
+//! A connection is listed from when it is accepted until its task ends, for
+//! as long as it holds the [`Tracked`] it was given.
+
+use std::{
+    collections::HashMap,
+    net::SocketAddr,
+    sync::{
+        Arc, LazyLock,
+        atomic::{AtomicU64, Ordering},
+    },
+    time::Duration,
+};
+
+use parking_lot::Mutex;
+use thiserror::Error as this_error;
+use tokio::sync::Notify;
+
+use crate::chat::user::Username;
+
+const LOCK_TIMEOUT: Duration = Duration::from_millis(50);
+
+static CONNECTIONS: LazyLock<Connections> = LazyLock::new(Connections::new);
+
+pub fn get_connections() -> &'static Connections {
+    &CONNECTIONS
+}
+
+#[derive(Debug, this_error)]
+pub enum Error {
+    #[error("no connection from {0}")]
+    NotFound(SocketAddr),
+
+    #[error("connection list lock timeout")]
+    LockTimeout,
+}
+
+/// An open connection as an operator is shown it.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct Conn {
+    pub addr: SocketAddr,
+    /// When it was accepted, stamped like a chat line.
+    pub connected_at: String,
+    /// Who it is joined as; `None` until it joins.
+    pub username: Option<Username>,
+}
+
+#[derive(Debug)]
+struct Entry {
+    conn: Conn,
+    dropped: Arc<Notify>,
+}
+
+#[derive(Debug, Default)]
+pub struct Connections {
+    next_id: AtomicU64,
+    // keyed by an id of their own, as Unix socket clients share one address
+    open: Mutex<HashMap<u64, Entry>>,
+}
+
+impl Connections {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Lists a connection from `addr` until the returned [`Tracked`] is
+    /// dropped.
+    pub fn open(&self, addr: SocketAddr, connected_at: String) -> Tracked<'_> {
+        let id = self.next_id.fetch_add(1, Ordering::Relaxed);
+        let dropped = Arc::new(Notify::new());
+        let conn = Conn {
+            addr,
+            connected_at,
+            username: None,
+        };
+        self.open.lock().insert(
+            id,
+            Entry {
+                conn,
+                dropped: Arc::clone(&dropped),
+            },
+        );
+        Tracked {
+            connections: self,
+            id,
+            username: None,
+            dropped,
+        }
+    }
+
+    /// Every open connection, by address and then by when it was accepted,
+    /// so the same connections always list in the same order.
+    pub fn list(&self) -> Result<Vec<Conn>, Error> {
+        let open = self.open.try_lock_for(LOCK_TIMEOUT).ok_or(Error::LockTimeout)?;
+        let mut conns = open
+            .iter()
+            .map(|(id, entry)| (*id, entry.conn.clone()))
+            .collect::<Vec<_>>();
+        drop(open);
+        conns.sort_by_key(|(id, conn)| (conn.addr, *id));
+        Ok(conns.into_iter().map(|(_, conn)| conn).collect())
+    }
+
+    /// Tells every connection from `addr` to close, and returns how many
+    /// there were: one, unless `addr` is the one all Unix socket clients
+    /// share.
+    pub fn drop_addr(&self, addr: SocketAddr) -> Result<usize, Error> {
+        let open = self.open.try_lock_for(LOCK_TIMEOUT).ok_or(Error::LockTimeout)?;
+        let mut dropped = 0_usize;
+        for entry in open.values().filter(|entry| entry.conn.addr == addr) {
+            // kept until the connection next waits, should it be busy now
+            entry.dropped.notify_one();
+            dropped = dropped.saturating_add(1);
+        }
+        drop(open);
+        if dropped == 0 {
+            return Err(Error::NotFound(addr));
+        }
+        Ok(dropped)
+    }
+}
+
+/// A connection's entry in [`Connections`], which goes with it.
+#[derive(Debug)]
+pub struct Tracked<'a> {
+    connections: &'a Connections,
+    id: u64,
+    username: Option<Username>,
+    dropped: Arc<Notify>,
+}
+
+impl Tracked<'_> {
+    /// Notes who the connection is joined as, if anyone, for the listing.
+    pub fn set_username(&mut self, username: Option<Username>) {
+        if self.username == username {
+            return;
+        }
+        if let Some(entry) = self.connections.open.lock().get_mut(&self.id) {
+            entry.conn.username.clone_from(&username);
+        }
+        self.username = username;
+    }
+
+    /// Resolves once an operator has dropped the connection.
+    pub async fn dropped(&self) {
+        self.dropped.notified().await;
+    }
+}
+
+impl Drop for Tracked<'_> {
+    fn drop(&mut self) {
+        self.connections.open.lock().remove(&self.id);
+    }
+}
+
+#[cfg(test)]
+#[allow(clippy::unwrap_used)]
+mod tests {
+    use std::net::{IpAddr, Ipv4Addr};
+
+    use super::*;
+
+    fn addr(port: u16) -> SocketAddr {
+        SocketAddr::new(IpAddr::V4(Ipv4Addr::LOCALHOST), port)
+    }
+
+    #[test]
+    fn test_list_is_sorted_and_follows_connections() {
+        let connections = Connections::new();
+        let mut alice = connections.open(addr(9000), "2024-01-02T15:04:05Z".to_string());
+        let lurker = connections.open(addr(8000), "2024-01-02T15:04:06Z".to_string());
+        alice.set_username(Some(Username::new("alice").unwrap()));
+
+        let listed = connections.list().unwrap();
+        assert_eq!(
+            listed.iter().map(|conn| conn.addr).collect::<Vec<_>>(),
+            [addr(8000), addr(9000)]
+        );
+        assert_eq!(listed[0].username, None);
+        assert_eq!(listed[1].username, Some(Username::new("alice").unwrap()));
+
+        drop(lurker);
+        assert_eq!(connections.list().unwrap().len(), 1);
+    }
+
+    #[tokio::test]
+    async fn test_drop_addr() {
+        let connections = Connections::new();
+        let tracked = connections.open(addr(9000), String::new());
+        assert!(matches!(connections.drop_addr(addr(9001)), Err(Error::NotFound(_))));
+        assert_eq!(connections.drop_addr(addr(9000)).unwrap(), 1);
+        // dropped before anyone waited, and still seen
+        tokio::time::timeout(Duration::from_secs(1), tracked.dropped())
+            .await
+            .unwrap();
+    }
+}
@@ -0,0 +1,226 @@
+//! Words censored from chat lines before they reach the room.
+//!
+//! Enabled by `CHAT_FILTER_FILE`, which holds one word per line; blank lines
+//! and lines starting with `#` are ignored. A listed word is matched in any
+//! case, but only as a whole word, so `ass` leaves `class` alone. Each of its
+//! characters becomes a `*`.
+
+use std::{borrow::Cow, collections::HashSet, fs, io, path::Path, sync::Arc};
+
+use common::tcp_message::ServerMessage;
+use parking_lot::RwLock;
+use tracing::info;
+
+static FILTER: RwLock<Option<Arc<WordFilter>>> = RwLock::new(None);
+
+/// Reads the word list at `path`, if given, for [`get_filter`] to hand out
+/// in place of any read before; without one nothing is filtered. Says
+/// whether the words differ from those before, so a reload of an edited
+/// file can tell. On error the previous list stays.
+pub fn init(path: Option<&Path>) -> io::Result<bool> {
+    let filter = match path {
+        Some(path) => {
+            let filter = WordFilter::new(&fs::read_to_string(path)?);
+            info!("Loaded {} filtered word(s) from {}", filter.words.len(), path.display());
+            Some(Arc::new(filter))
+        }
+        None => None,
+    };
+    let mut current = FILTER.write();
+    let changed = current.as_deref() != filter.as_deref();
+    *current = filter;
+    Ok(changed)
+}
+
+pub fn get_filter() -> Option<Arc<WordFilter>> {
+    FILTER.read().clone()
+}
+
+#[derive(Debug, PartialEq, Eq)]
+pub struct WordFilter {
+    // lowercased
+    words: HashSet<String>,
+}
+
+impl WordFilter {
+    /// Builds a filter from the contents of a word list.
+    pub fn new(list: &str) -> Self {
+        let words = list
+            .lines()
+            .map(str::trim)
+            .filter(|line| !line.is_empty() && !line.starts_with('#'))
+            .map(str::to_lowercase)
+            .collect();
+        Self { words }
+    }
+
+    /// `text` with every listed word starred out, borrowed when there was
+    /// nothing to censor.
+    pub fn censor<'a>(&self, text: &'a str) -> Cow<'a, str> {
+        let mut censored = String::new();
+        // bytes of `text` already accounted for in `censored`
+        let mut copied = 0;
+        for (start, word) in words(text) {
+            if self.words.contains(&word.to_lowercase()) {
+                censored.push_str(text.get(copied..start).unwrap_or_default());
+                censored.extend(word.chars().map(|_| '*'));
+                copied = start.saturating_add(word.len());
+            }
+        }
+        if copied == 0 {
+            return Cow::Borrowed(text);
+        }
+        censored.push_str(text.get(copied..).unwrap_or_default());
+        Cow::Owned(censored)
+    }
+
+    /// `line` with its text censored, or `None` if it needed no change or
+    /// is not a chat line.
+    pub fn censor_line(&self, line: &ServerMessage) -> Option<ServerMessage> {
+        match line {
+            ServerMessage::Broadcast {
+                timestamp,
+                id,
+                username,
+                message,
+                reply_to,
+            } => match self.censor(message) {
+                Cow::Borrowed(_) => None,
+                Cow::Owned(message) => Some(ServerMessage::Broadcast {
+                    timestamp: timestamp.clone(),
+                    id: id.clone(),
+                    username: username.clone(),
+                    message,
+                    reply_to: reply_to.clone(),
+                }),
+            },
+            ServerMessage::Edited {
+                timestamp,
+                id,
+                username,
+                message,
+            } => match self.censor(message) {
+                Cow::Borrowed(_) => None,
+                Cow::Owned(message) => Some(ServerMessage::Edited {
+                    timestamp: timestamp.clone(),
+                    id: id.clone(),
+                    username: username.clone(),
+                    message,
+                }),
+            },
+            ServerMessage::Action {
+                timestamp,
+                username,
+                text,
+            } => match self.censor(text) {
+                Cow::Borrowed(_) => None,
+                Cow::Owned(text) => Some(ServerMessage::Action {
+                    timestamp: timestamp.clone(),
+                    username: username.clone(),
+                    text,
+                }),
+            },
+            _ => None,
+        }
+    }
+}
+
+/// The words in `text`, runs of letters and digits, with their byte offsets.
+fn words(text: &str) -> Vec<(usize, &str)> {
+    let mut found = Vec::new();
+    let mut start = None;
+    for (i, c) in text.char_indices() {
+        match (c.is_alphanumeric(), start) {
+            (true, None) => start = Some(i),
+            (false, Some(s)) => {
+                found.extend(text.get(s..i).map(|word| (s, word)));
+                start = None;
+            }
+            _ => {}
+        }
+    }
+    if let Some(s) = start {
+        found.extend(text.get(s..).map(|word| (s, word)));
+    }
+    found
+}
+
+#[cfg(test)]
+#[allow(clippy::unwrap_used)]
+mod tests {
+    use super::*;
+
+    fn filter() -> WordFilter {
+        WordFilter::new("# family friendly\ndarn\n\n  HECK \nass\n")
+    }
+
+    #[test]
+    fn test_init_says_whether_the_words_changed() {
+        let path = std::env::temp_dir().join(format!("chat-filter-{}", std::process::id()));
+        fs::write(&path, "zounds\n").unwrap();
+        assert!(init(Some(&path)).unwrap());
+        assert!(!init(Some(&path)).unwrap());
+        fs::write(&path, "# same words\nZOUNDS\n").unwrap();
+        assert!(!init(Some(&path)).unwrap());
+        fs::write(&path, "zounds\ngadzooks\n").unwrap();
+        assert!(init(Some(&path)).unwrap());
+        assert!(init(None).unwrap());
+        assert!(!init(None).unwrap());
+        let _ = fs::remove_file(&path);
+    }
+
+    #[test]
+    fn test_new_skips_blanks_and_comments() {
+        let words = filter().words;
+        assert_eq!(words.len(), 3);
+        assert!(words.contains("heck"));
+    }
+
+    #[test]
+    fn test_censor_whole_words_in_any_case() {
+        let filter = filter();
+        assert_eq!(filter.censor("Darn it, what the heck!"), "**** it, what the ****!");
+        assert_eq!(filter.censor("DARN darn"), "**** ****");
+        assert_eq!(filter.censor("heck-ass"), "****-***");
+    }
+
+    #[test]
+    fn test_censor_leaves_longer_words() {
+        let filter = filter();
+        assert!(matches!(filter.censor("class assignment darned"), Cow::Borrowed(_)));
+        assert!(matches!(filter.censor(""), Cow::Borrowed(_)));
+    }
+
+    #[test]
+    fn test_censor_counts_characters_not_bytes() {
+        let filter = WordFilter::new("übel\n");
+        assert_eq!(filter.censor("so Übel, übel"), "so ****, ****");
+    }
+
+    #[test]
+    fn test_censor_line() {
+        let filter = filter();
+        let line = |message: &str| ServerMessage::Broadcast {
+            timestamp: "2024-01-02T15:04:05Z".to_string(),
+            id: "1".to_string(),
+            username: "alice".to_string(),
+            message: message.to_string(),
+            reply_to: None,
+        };
+        assert_eq!(filter.censor_line(&line("oh darn")), Some(line("oh ****")));
+        assert_eq!(filter.censor_line(&line("all fine")), None);
+        let edited = |message: &str| ServerMessage::Edited {
+            timestamp: "2024-01-02T15:04:05Z".to_string(),
+            id: "1".to_string(),
+            username: "alice".to_string(),
+            message: message.to_string(),
+        };
+        assert_eq!(filter.censor_line(&edited("oh heck")), Some(edited("oh ****")));
+        assert_eq!(
+            filter.censor_line(&ServerMessage::Info {
+                text: "darn".to_string()
+            }),
+            None
+        );
+    }
+}
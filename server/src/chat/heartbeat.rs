@@ -0,0 +1,101 @@
+//! Per-connection keepalive bookkeeping.
+//!
+//! The connection loop sleeps until [`Heartbeat::deadline`]; when it fires it
+//! either sends a `PING` or, if the last one went unanswered, drops the client.
+//! Anything the client sends counts as proof of life, so a busy client that is
+//! slow to answer a `PING` is never mistaken for a dead one.
+
+use std::time::Duration;
+
+use tokio::time::Instant;
+
+/// What to do once the deadline has passed.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Beat {
+    SendPing,
+    Expired,
+}
+
+#[derive(Debug)]
+pub struct Heartbeat {
+    interval: Duration,
+    pong_timeout: Duration,
+    next_ping: Instant,
+    ping_sent_at: Option<Instant>,
+}
+
+impl Heartbeat {
+    /// A zero `interval` disables the heartbeat.
+    pub fn new(interval: Duration, pong_timeout: Duration, now: Instant) -> Self {
+        Self {
+            interval,
+            pong_timeout,
+            next_ping: now.checked_add(interval).unwrap_or(now),
+            ping_sent_at: None,
+        }
+    }
+
+    pub fn deadline(&self) -> Option<Instant> {
+        if self.interval.is_zero() {
+            return None;
+        }
+        Some(
+            self.ping_sent_at
+                .and_then(|sent| sent.checked_add(self.pong_timeout))
+                .unwrap_or(self.next_ping),
+        )
+    }
+
+    /// Decides what a fired deadline means and records an outgoing ping.
+    pub const fn beat(&mut self, now: Instant) -> Beat {
+        if self.ping_sent_at.is_some() {
+            return Beat::Expired;
+        }
+        self.ping_sent_at = Some(now);
+        Beat::SendPing
+    }
+
+    /// Call on any input from the client.
+    pub fn alive(&mut self, now: Instant) {
+        self.ping_sent_at = None;
+        self.next_ping = now.checked_add(self.interval).unwrap_or(now);
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    const INTERVAL: Duration = Duration::from_secs(30);
+    const TIMEOUT: Duration = Duration::from_secs(10);
+
+    #[test]
+    fn test_heartbeat_pings_then_expires() {
+        let start = Instant::now();
+        let mut hb = Heartbeat::new(INTERVAL, TIMEOUT, start);
+        assert_eq!(hb.deadline(), Some(start + INTERVAL));
+
+        let pinged = start + INTERVAL;
+        assert_eq!(hb.beat(pinged), Beat::SendPing);
+        assert_eq!(hb.deadline(), Some(pinged + TIMEOUT));
+        assert_eq!(hb.beat(pinged + TIMEOUT), Beat::Expired);
+    }
+
+    #[test]
+    fn test_heartbeat_any_input_resets() {
+        let start = Instant::now();
+        let mut hb = Heartbeat::new(INTERVAL, TIMEOUT, start);
+        assert_eq!(hb.beat(start + INTERVAL), Beat::SendPing);
+
+        let answered = start + INTERVAL + Duration::from_secs(1);
+        hb.alive(answered);
+        assert_eq!(hb.deadline(), Some(answered + INTERVAL));
+        assert_eq!(hb.beat(answered + INTERVAL), Beat::SendPing);
+    }
+
+    #[test]
+    fn test_heartbeat_disabled() {
+        let hb = Heartbeat::new(Duration::ZERO, TIMEOUT, Instant::now());
+        assert_eq!(hb.deadline(), None);
+    }
+}
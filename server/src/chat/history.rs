@@ -0,0 +1,541 @@
+//! Recent chat lines per room, replayed to people as they arrive.
+//!
+//! The lines are kept here, in memory, and handed to a [`Store`] on a thread
+//! of its own; a store that outlives the process is read back once, at
+//! startup. So numbering, replaying and looking up a line never wait on a
+//! disk. Holds no lock of its own; the user registry records and replays
+//! under the same lock it uses for room membership, so a newcomer sees every
+//! line exactly once, either replayed or live.
+
+use std::{
+    collections::{HashMap, VecDeque},
+    io,
+    sync::{Arc, mpsc},
+    thread,
+    time::Duration,
+};
+
+use common::{
+    consts,
+    tcp_message::{FIELD_SEPARATOR, ServerMessage, WireDecode, WireEncode},
+};
+use tracing::warn;
+
+use super::{
+    channel::ChannelName,
+    room::{OneToMany, OneToOne},
+    store::Store,
+};
+
+#[derive(Debug)]
+pub struct History {
+    capacity: usize,
+    room_capacities: HashMap<ChannelName, usize>,
+    lines: HashMap<ChannelName, VecDeque<Vec<u8>>>,
+    writer: Option<Writer>,
+    // whether a room that empties out keeps its lines, as the store does
+    keeps_emptied: bool,
+    last_seq: HashMap<ChannelName, u64>,
+}
+
+impl History {
+    /// Keeps at most `capacity` lines per room, in memory; zero disables
+    /// history.
+    pub fn new(capacity: usize) -> Self {
+        Self {
+            capacity,
+            room_capacities: HashMap::new(),
+            lines: HashMap::new(),
+            writer: None,
+            keeps_emptied: false,
+            last_seq: HashMap::new(),
+        }
+    }
+
+    /// Keeps the lines in `store` too, carrying on from what it kept if it
+    /// outlives the process. If its writer thread can't be started, history
+    /// is only kept in memory, and that is logged.
+    pub fn with_store(mut self, store: Arc<dyn Store>) -> Self {
+        if store.outlives_process() {
+            self.lines = read_back(store.as_ref());
+            self.keeps_emptied = true;
+        }
+        self.writer = Writer::start(store)
+            .inspect_err(|e| warn!("Cannot start the history writer, history is not kept: {e}"))
+            .ok();
+        self
+    }
+
+    /// Keeps a different number of lines for the rooms listed, zero for none.
+    pub fn with_room_capacities(mut self, capacities: &[(ChannelName, usize)]) -> Self {
+        self.room_capacities = capacities.iter().cloned().collect();
+        self
+    }
+
+    fn capacity_of(&self, channel: &ChannelName) -> usize {
+        self.room_capacities.get(channel).copied().unwrap_or(self.capacity)
+    }
+
+    /// Keeps `line` for `channel`, and queues it for the store.
+    pub fn record(&mut self, channel: &ChannelName, line: &OneToMany) {
+        let capacity = self.capacity_of(channel);
+        if capacity == 0 {
+            return;
+        }
+        let kept = self.lines.entry(channel.clone()).or_default();
+        kept.push_back(line.to_vec());
+        while kept.len() > capacity {
+            kept.pop_front();
+        }
+        if let Some(writer) = &self.writer {
+            writer.send(Write::Append {
+                channel: channel.clone(),
+                line: line.to_vec(),
+                capacity,
+            });
+        }
+    }
+
+    /// The number for `channel`'s next line, one more than its last. A room
+    /// not numbered since startup carries on from its last kept line, so a
+    /// durable store keeps numbers going up across restarts.
+    pub fn next_seq(&mut self, channel: &ChannelName) -> u64 {
+        let last = match self.last_seq.get(channel) {
+            Some(&last) => last,
+            None => self.last_kept_seq(channel),
+        };
+        let seq = last.saturating_add(1);
+        self.last_seq.insert(channel.clone(), seq);
+        seq
+    }
+
+    fn last_kept_seq(&self, channel: &ChannelName) -> u64 {
+        self.kept(channel)
+            .iter()
+            .rev()
+            .find_map(|line| seq_of(line))
+            .unwrap_or(0)
+    }
+
+    /// The lines kept for `channel`, oldest first. What was read back from
+    /// the store may be more than the room keeps now.
+    fn kept(&self, channel: &ChannelName) -> Vec<&[u8]> {
+        let capacity = self.capacity_of(channel);
+        self.lines.get(channel).map_or_else(Vec::new, |kept| {
+            kept.iter()
+                .skip(kept.len().saturating_sub(capacity))
+                .map(Vec::as_slice)
+                .collect()
+        })
+    }
+
+    /// Replay copies of the lines kept for `channel`, oldest first.
+    pub fn replay(&self, channel: &ChannelName) -> Vec<OneToMany> {
+        self.kept(channel).into_iter().map(replay_of).collect()
+    }
+
+    /// Replay copies of the lines kept for `channel` numbered after `after`,
+    /// or of all of them, oldest first. If lines asked for are gone from the
+    /// history, a [`ServerMessage::Truncated`] comes first saying from where
+    /// it has them.
+    pub fn replay_since(&self, channel: &ChannelName, after: Option<u64>) -> Vec<OneToMany> {
+        let kept = self.kept(channel);
+        let first = kept.iter().find_map(|line| seq_of(line)).unwrap_or_else(|| {
+            let last = self.last_seq.get(channel).copied().unwrap_or(0);
+            last.saturating_add(1)
+        });
+        let wanted = after.unwrap_or(0).saturating_add(1);
+        let truncated = (first > wanted).then(|| {
+            let notice = ServerMessage::Truncated { first };
+            OneToMany::from(OneToOne::from(notice.encode()))
+        });
+        let lines = kept
+            .into_iter()
+            // a line kept before lines were numbered has no place among them
+            .filter(|line| after.is_none_or(|after| seq_of(line).is_some_and(|seq| seq > after)))
+            .map(replay_of);
+        truncated.into_iter().chain(lines).collect()
+    }
+
+    /// Whether the line `id` is among those kept for `channel` and has not
+    /// been deleted since.
+    pub fn has_line(&self, channel: &ChannelName, id: &str) -> bool {
+        let mut found = false;
+        for line in self.kept(channel) {
+            let message = match ServerMessage::decode(line) {
+                Ok(ServerMessage::Sequenced { message, .. }) => Ok(*message),
+                other => other,
+            };
+            match message {
+                Ok(ServerMessage::Broadcast { id: line_id, .. }) if line_id == id => found = true,
+                Ok(ServerMessage::Deleted { id: line_id, .. }) if line_id == id => found = false,
+                _ => {}
+            }
+        }
+        found
+    }
+
+    /// Called once `channel` is empty. Its lines are dropped, unless the
+    /// store outlives the process and so keeps them for whoever comes next;
+    /// numbering carries on from whatever is left.
+    pub fn forget(&mut self, channel: &ChannelName) {
+        self.last_seq.remove(channel);
+        if !self.keeps_emptied {
+            self.lines.remove(channel);
+        }
+        if let Some(writer) = &self.writer {
+            writer.send(Write::Forget(channel.clone()));
+        }
+    }
+
+    /// The thread the store is written from, if there is one, to wait on
+    /// without holding the registry's locks.
+    pub fn writer(&self) -> Option<Writer> {
+        self.writer.clone()
+    }
+}
+
+/// What a store that outlives the process kept of each room. A store that
+/// can't be read only makes for shorter replays, so that is logged.
+fn read_back(store: &dyn Store) -> HashMap<ChannelName, VecDeque<Vec<u8>>> {
+    let rooms = store.rooms().unwrap_or_else(|e| {
+        warn!("Cannot read which rooms have history: {e}");
+        Vec::new()
+    });
+    rooms
+        .into_iter()
+        // the store keeps no more than a room's capacity at the time
+        .filter_map(|channel| match store.recent(&channel, usize::MAX) {
+            Ok(lines) => Some((channel, lines.into())),
+            Err(e) => {
+                warn!("Cannot read {channel} history: {e}");
+                None
+            }
+        })
+        .collect()
+}
+
+#[derive(Debug)]
+enum Write {
+    Append {
+        channel: ChannelName,
+        line: Vec<u8>,
+        capacity: usize,
+    },
+    Forget(ChannelName),
+    Flush(mpsc::Sender<()>),
+}
+
+/// Hands what history records to the store, in order, on a thread of its
+/// own, so a slow disk holds up that thread rather than the registry.
+#[derive(Debug, Clone)]
+pub struct Writer {
+    tx: mpsc::Sender<Write>,
+}
+
+impl Writer {
+    fn start(store: Arc<dyn Store>) -> io::Result<Self> {
+        let (tx, rx) = mpsc::channel();
+        thread::Builder::new()
+            .name("history-writer".to_string())
+            .spawn(move || write_all(store.as_ref(), &rx))?;
+        Ok(Self { tx })
+    }
+
+    fn send(&self, write: Write) {
+        if self.tx.send(write).is_err() {
+            warn!("History writer has stopped, history is not kept");
+        }
+    }
+
+    /// Waits up to `timeout` for the store to have everything recorded
+    /// before the call; false if it didn't in time.
+    pub fn flush(&self, timeout: Duration) -> bool {
+        let (done, flushed) = mpsc::channel();
+        self.tx.send(Write::Flush(done)).is_ok() && flushed.recv_timeout(timeout).is_ok()
+    }
+}
+
+/// Runs until every [`Writer`] is gone. A line the store fails to keep is
+/// only missing from replays after a restart, so that is logged and
+/// writing goes on.
+fn write_all(store: &dyn Store, rx: &mpsc::Receiver<Write>) {
+    for write in rx {
+        match write {
+            Write::Append {
+                channel,
+                line,
+                capacity,
+            } => {
+                if let Err(e) = store.append(&channel, &line, capacity) {
+                    warn!("Cannot keep a line of {channel} history: {e}");
+                }
+            }
+            Write::Forget(channel) => {
+                if let Err(e) = store.forget(&channel) {
+                    warn!("Cannot drop {channel} history: {e}");
+                }
+            }
+            Write::Flush(done) => {
+                let _ = done.send(());
+            }
+        }
+    }
+}
+
+/// The number a kept line was sent under, if it was.
+fn seq_of(line: &[u8]) -> Option<u64> {
+    match ServerMessage::decode(line) {
+        Ok(ServerMessage::Sequenced { seq, .. }) => Some(seq),
+        _ => None,
+    }
+}
+
+fn replay_of(line: &[u8]) -> OneToMany {
+    OneToMany::from(OneToOne::from(replay_line(line)))
+}
+
+/// Wraps an encoded server message as `HISTORY|<message>`.
+pub(super) fn replay_line(line: &[u8]) -> Vec<u8> {
+    [
+        consts::SERVER_EVENT_HISTORY.as_bytes(),
+        FIELD_SEPARATOR.as_bytes(),
+        line,
+    ]
+    .concat()
+}
+
+/// Numbers an encoded server message as `SEQ|<seq>|<message>`.
+pub(super) fn sequenced_line(seq: u64, line: &[u8]) -> Vec<u8> {
+    [
+        consts::SERVER_EVENT_SEQ.as_bytes(),
+        FIELD_SEPARATOR.as_bytes(),
+        seq.to_string().as_bytes(),
+        FIELD_SEPARATOR.as_bytes(),
+        line,
+    ]
+    .concat()
+}
+
+#[cfg(test)]
+#[allow(clippy::unwrap_used)]
+mod tests {
+    use super::*;
+    use crate::chat::store::{self, MemoryStore, SqliteStore};
+
+    fn line(s: &str) -> OneToMany {
+        OneToMany::from(OneToOne::from(s.as_bytes().to_vec()))
+    }
+
+    #[test]
+    fn test_history_keeps_most_recent() {
+        let general = ChannelName::default_channel();
+        let mut history = History::new(2);
+        for s in ["one", "two", "three"] {
+            history.record(&general, &line(s));
+        }
+        let replayed: Vec<Vec<u8>> = history.replay(&general).iter().map(|m| m.to_vec()).collect();
+        assert_eq!(replayed, vec![b"HISTORY|two".to_vec(), b"HISTORY|three".to_vec()]);
+    }
+
+    #[test]
+    fn test_history_is_per_channel() {
+        let general = ChannelName::default_channel();
+        let random = ChannelName::new("#random").unwrap();
+        let mut history = History::new(10);
+        history.record(&general, &line("hi"));
+        assert!(history.replay(&random).is_empty());
+
+        history.forget(&general);
+        assert!(history.replay(&general).is_empty());
+    }
+
+    #[test]
+    fn test_history_room_capacities() {
+        let general = ChannelName::default_channel();
+        let dev = ChannelName::new("#dev").unwrap();
+        let quiet = ChannelName::new("#quiet").unwrap();
+        let mut history = History::new(1).with_room_capacities(&[(dev.clone(), 3), (quiet.clone(), 0)]);
+        for s in ["one", "two", "three"] {
+            for channel in [&general, &dev, &quiet] {
+                history.record(channel, &line(s));
+            }
+        }
+        assert_eq!(history.replay(&general).len(), 1);
+        assert_eq!(history.replay(&dev).len(), 3);
+        assert!(history.replay(&quiet).is_empty());
+    }
+
+    #[test]
+    fn test_history_has_line() {
+        let general = ChannelName::default_channel();
+        let dev = ChannelName::new("#dev").unwrap();
+        let mut history = History::new(2);
+        history.record(&general, &line("BROADCAST|2024-01-02T15:04:05Z|41|bob|hi"));
+        assert!(history.has_line(&general, "41"));
+        assert!(!history.has_line(&general, "42"));
+        assert!(!history.has_line(&dev, "41"));
+
+        history.record(&general, &line("DELETED|2024-01-02T15:04:06Z|41|bob"));
+        assert!(!history.has_line(&general, "41"));
+
+        // gone once it ages out, too
+        history.record(&general, &line("BROADCAST|2024-01-02T15:04:07Z|43|bob|hi"));
+        history.record(&general, &line("BROADCAST|2024-01-02T15:04:08Z|44|bob|hi"));
+        history.record(&general, &line("BROADCAST|2024-01-02T15:04:09Z|45|bob|hi"));
+        assert!(!history.has_line(&general, "43"));
+        assert!(history.has_line(&general, "45"));
+    }
+
+    #[test]
+    fn test_history_numbers_lines_per_room() {
+        let general = ChannelName::default_channel();
+        let dev = ChannelName::new("#dev").unwrap();
+        let quiet = ChannelName::new("#quiet").unwrap();
+        let mut history = History::new(5).with_room_capacities(&[(quiet.clone(), 0)]);
+        assert_eq!(history.next_seq(&general), 1);
+        assert_eq!(history.next_seq(&general), 2);
+        assert_eq!(history.next_seq(&dev), 1);
+        // numbered whether or not the room keeps history
+        assert_eq!(history.next_seq(&quiet), 1);
+        assert_eq!(history.next_seq(&quiet), 2);
+
+        history.forget(&general);
+        assert_eq!(history.next_seq(&general), 1);
+    }
+
+    #[test]
+    fn test_history_numbering_carries_on_from_the_store() {
+        let general = ChannelName::default_channel();
+        let path = std::env::temp_dir().join(format!("chat-history-{}.db", std::process::id()));
+        let remove_db = || {
+            for suffix in ["", "-wal", "-shm"] {
+                let _ = std::fs::remove_file(format!("{}{suffix}", path.display()));
+            }
+        };
+        remove_db();
+        let store: Arc<dyn Store> = Arc::new(SqliteStore::open(&path).unwrap());
+        let mut history = History::new(5).with_store(Arc::clone(&store));
+        let kept = sequenced_line(7, b"BROADCAST|2024-01-02T15:04:05Z|41|bob|hi");
+        history.record(&general, &OneToMany::from(OneToOne::from(kept)));
+        assert!(history.writer().unwrap().flush(Duration::from_secs(5)));
+
+        // as after a restart, with what the store kept
+        let mut history = History::new(5).with_store(store);
+        assert_eq!(history.next_seq(&general), 8);
+        assert!(history.has_line(&general, "41"));
+        remove_db();
+    }
+
+    #[test]
+    fn test_history_keeps_lines_the_store_is_slow_with() {
+        #[derive(Debug)]
+        struct Slow(MemoryStore);
+
+        impl Store for Slow {
+            fn append(&self, channel: &ChannelName, line: &[u8], capacity: usize) -> Result<(), store::Error> {
+                thread::sleep(Duration::from_millis(200));
+                self.0.append(channel, line, capacity)
+            }
+
+            fn recent(&self, channel: &ChannelName, limit: usize) -> Result<Vec<Vec<u8>>, store::Error> {
+                self.0.recent(channel, limit)
+            }
+
+            fn rooms(&self) -> Result<Vec<ChannelName>, store::Error> {
+                self.0.rooms()
+            }
+
+            fn outlives_process(&self) -> bool {
+                false
+            }
+
+            fn forget(&self, channel: &ChannelName) -> Result<(), store::Error> {
+                self.0.forget(channel)
+            }
+
+            fn bans(&self) -> Result<HashMap<String, Option<std::net::IpAddr>>, store::Error> {
+                self.0.bans()
+            }
+
+            fn add_ban(&self, username: &str, addr: Option<std::net::IpAddr>) -> Result<(), store::Error> {
+                self.0.add_ban(username, addr)
+            }
+
+            fn remove_ban(&self, username: &str) -> Result<(), store::Error> {
+                self.0.remove_ban(username)
+            }
+        }
+
+        let general = ChannelName::default_channel();
+        let store = Arc::new(Slow(MemoryStore::new(None)));
+        let mut history = History::new(5).with_store(Arc::clone(&store) as Arc<dyn Store>);
+        let started = std::time::Instant::now();
+        for id in 1..=3 {
+            let seq = history.next_seq(&general);
+            let line = format!("BROADCAST|2024-01-02T15:04:05Z|{id}|bob|hi");
+            let kept = sequenced_line(seq, line.as_bytes());
+            history.record(&general, &OneToMany::from(OneToOne::from(kept)));
+        }
+        // none of that waited on the store
+        assert!(started.elapsed() < Duration::from_millis(200));
+        assert_eq!(history.next_seq(&general), 4);
+        assert!(history.has_line(&general, "3"));
+        assert_eq!(history.replay(&general).len(), 3);
+
+        assert!(history.writer().unwrap().flush(Duration::from_secs(5)));
+        assert_eq!(store.recent(&general, 10).unwrap().len(), 3);
+    }
+
+    #[test]
+    fn test_history_replay_since() {
+        let general = ChannelName::default_channel();
+        let mut history = History::new(2);
+        let replayed = |history: &History, after| -> Vec<Vec<u8>> {
+            history
+                .replay_since(&general, after)
+                .iter()
+                .map(|m| m.to_vec())
+                .collect()
+        };
+        assert!(replayed(&history, None).is_empty());
+        for s in ["one", "two", "three"] {
+            let seq = history.next_seq(&general);
+            let kept = sequenced_line(seq, format!("INFO|{s}").as_bytes());
+            history.record(&general, &OneToMany::from(OneToOne::from(kept)));
+        }
+
+        assert_eq!(replayed(&history, Some(2)), vec![b"HISTORY|SEQ|3|INFO|three".to_vec()]);
+        assert!(replayed(&history, Some(3)).is_empty());
+        // the first line has aged out
+        assert_eq!(
+            replayed(&history, Some(0)),
+            vec![
+                b"TRUNCATED|2".to_vec(),
+                b"HISTORY|SEQ|2|INFO|two".to_vec(),
+                b"HISTORY|SEQ|3|INFO|three".to_vec()
+            ]
+        );
+        assert_eq!(replayed(&history, None).len(), 3);
+
+        // nothing kept at all, but lines were said
+        let mut quiet = History::new(0);
+        quiet.next_seq(&general);
+        assert_eq!(
+            quiet
+                .replay_since(&general, None)
+                .iter()
+                .map(|m| m.to_vec())
+                .collect::<Vec<_>>(),
+            vec![b"TRUNCATED|2".to_vec()]
+        );
+    }
+
+    #[test]
+    fn test_history_disabled() {
+        let general = ChannelName::default_channel();
+        let mut history = History::new(0);
+        history.record(&general, &line("hi"));
+        assert!(history.replay(&general).is_empty());
+    }
+}
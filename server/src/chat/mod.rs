@@ -1,6 +1,25 @@
+pub mod alias;
+pub mod ban;
 pub mod broker;
+pub mod cancel;
+pub mod channel;
+pub mod clock;
 pub mod connection;
+pub mod conns;
+pub mod filter;
+pub mod heartbeat;
+pub mod history;
+pub mod policy;
 pub mod rate_limiter;
+pub mod recent;
+pub mod refusal;
 pub mod room;
+pub mod roster;
+pub mod send_ids;
+pub mod session;
+pub mod store;
 pub mod string;
+pub mod throttle;
+pub mod transcript;
 pub mod user;
+pub mod whispers;
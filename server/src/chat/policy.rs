@@ -0,0 +1,246 @@
+//! Per-room limits, overriding the server-wide rate limit and message length.
+//!
+//! A room's policy comes from an operator's `room-policy`, which lasts until
+//! the server restarts, or else from `CHAT_ROOM_POLICIES`, e.g.
+//! `#announcements rate=1 len=8192, #dev rate=10`. Whatever a policy leaves
+//! out, and every room without one, keeps the server's own limits.
+//!
+//! A user's limits are those of the room they are in, for everything they
+//! send. Each room with a rate of its own gets its own bucket per connection,
+//! so hopping between rooms doesn't refill one.
+
+use std::{
+    collections::HashMap,
+    fmt::{Display, Formatter},
+    str::FromStr,
+    sync::LazyLock,
+};
+
+use parking_lot::RwLock;
+
+use crate::{
+    chat::channel::ChannelName,
+    config::{Config, get_config},
+};
+
+static POLICIES: LazyLock<RoomPolicies> = LazyLock::new(RoomPolicies::new);
+
+pub fn get_policies() -> &'static RoomPolicies {
+    &POLICIES
+}
+
+/// What a room overrides; `None` keeps the server's setting.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+pub struct RoomPolicy {
+    pub rate_per_second: Option<u32>,
+    pub rate_burst: Option<u32>,
+    pub max_msg_len: Option<usize>,
+}
+
+impl FromStr for RoomPolicy {
+    type Err = String;
+
+    /// `rate=N`, `burst=N` and `len=N`, space separated, in any order.
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        let mut policy = Self::default();
+        for setting in s.split_whitespace() {
+            let (name, value) = setting
+                .split_once('=')
+                .ok_or_else(|| format!("{setting:?} is not rate=N, burst=N or len=N"))?;
+            match name.to_lowercase().as_str() {
+                "rate" => policy.rate_per_second = Some(positive(name, value)?),
+                "burst" => policy.rate_burst = Some(positive(name, value)?),
+                "len" => policy.max_msg_len = Some(positive(name, value)?),
+                _ => return Err(format!("{name:?} is not rate, burst or len")),
+            }
+        }
+        if policy == Self::default() {
+            return Err("no limits given".to_string());
+        }
+        Ok(policy)
+    }
+}
+
+/// `value`, the setting `name`, as a whole number of at least 1.
+fn positive<T: FromStr + Default + PartialOrd>(name: &str, value: &str) -> Result<T, String> {
+    value
+        .parse()
+        .ok()
+        .filter(|n| *n > T::default())
+        .ok_or_else(|| format!("{name} must be a whole number of at least 1"))
+}
+
+impl Display for RoomPolicy {
+    fn fmt(&self, f: &mut Formatter<'_>) -> std::fmt::Result {
+        let settings: Vec<String> = [
+            self.rate_per_second.map(|n| format!("rate={n}")),
+            self.rate_burst.map(|n| format!("burst={n}")),
+            self.max_msg_len.map(|n| format!("len={n}")),
+        ]
+        .into_iter()
+        .flatten()
+        .collect();
+        write!(f, "{}", settings.join(" "))
+    }
+}
+
+/// The limits that apply in a room, its policy's and the server's together.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct Limits {
+    pub rate_per_second: u32,
+    pub rate_burst: u32,
+    pub max_msg_len: usize,
+}
+
+impl Limits {
+    pub const fn global(config: &Config) -> Self {
+        Self {
+            rate_per_second: config.rate_per_second,
+            rate_burst: config.rate_burst,
+            max_msg_len: config.max_msg_len,
+        }
+    }
+
+    fn with(self, policy: &RoomPolicy) -> Self {
+        Self {
+            rate_per_second: policy.rate_per_second.unwrap_or(self.rate_per_second),
+            rate_burst: policy.rate_burst.unwrap_or(self.rate_burst),
+            max_msg_len: policy.max_msg_len.unwrap_or(self.max_msg_len),
+        }
+    }
+
+    /// Whether these limits rate messages the way `other` does.
+    pub const fn same_rate(&self, other: &Self) -> bool {
+        self.rate_per_second == other.rate_per_second && self.rate_burst == other.rate_burst
+    }
+}
+
+impl Display for Limits {
+    fn fmt(&self, f: &mut Formatter<'_>) -> std::fmt::Result {
+        write!(
+            f,
+            "{} messages a second, bursts of {}, up to {} characters",
+            self.rate_per_second, self.rate_burst, self.max_msg_len
+        )
+    }
+}
+
+/// The policies operators have set while the server runs.
+#[derive(Debug, Default)]
+pub struct RoomPolicies {
+    set: RwLock<HashMap<ChannelName, RoomPolicy>>,
+}
+
+impl RoomPolicies {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Gives `channel` `policy` in place of any it had, or with `None`
+    /// takes back what an operator set, leaving the configured one if any.
+    pub fn set(&self, channel: ChannelName, policy: Option<RoomPolicy>) {
+        let mut set = self.set.write();
+        match policy {
+            Some(policy) => set.insert(channel, policy),
+            None => set.remove(&channel),
+        };
+    }
+
+    /// `channel`'s policy, if it has one.
+    pub fn policy(&self, channel: &ChannelName) -> Option<RoomPolicy> {
+        self.policy_in(&get_config(), channel)
+    }
+
+    /// The limits in `channel`.
+    pub fn limits(&self, channel: &ChannelName) -> Limits {
+        let config = get_config();
+        let global = Limits::global(&config);
+        self.policy_in(&config, channel)
+            .map_or(global, |policy| global.with(&policy))
+    }
+
+    /// The longest message any room takes, which is how much a client may
+    /// send at once.
+    pub fn longest_msg_len(&self) -> usize {
+        let config = get_config();
+        let set = self.set.read();
+        config
+            .room_policies
+            .iter()
+            .map(|(_, policy)| policy)
+            .chain(set.values())
+            .filter_map(|policy| policy.max_msg_len)
+            .fold(config.max_msg_len, usize::max)
+    }
+
+    fn policy_in(&self, config: &Config, channel: &ChannelName) -> Option<RoomPolicy> {
+        self.set.read().get(channel).copied().or_else(|| {
+            config
+                .room_policies
+                .iter()
+                .find(|(room, _)| room == channel)
+                .map(|(_, policy)| *policy)
+        })
+    }
+}
+
+#[cfg(test)]
+#[allow(clippy::unwrap_used)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_parse_policy() {
+        let policy: RoomPolicy = "len=8192 RATE=1".parse().unwrap();
+        assert_eq!(
+            policy,
+            RoomPolicy {
+                rate_per_second: Some(1),
+                rate_burst: None,
+                max_msg_len: Some(8192),
+            }
+        );
+        assert_eq!(policy.to_string(), "rate=1 len=8192");
+        assert!("".parse::<RoomPolicy>().is_err());
+        assert!("rate=0".parse::<RoomPolicy>().is_err());
+        assert!("rate".parse::<RoomPolicy>().is_err());
+        assert!("speed=3".parse::<RoomPolicy>().is_err());
+    }
+
+    #[test]
+    fn test_policy_overrides_only_what_it_sets() {
+        let global = Limits {
+            rate_per_second: 5,
+            rate_burst: 10,
+            max_msg_len: 2048,
+        };
+        let slow = global.with(&"rate=1 len=8192".parse().unwrap());
+        assert_eq!(
+            slow,
+            Limits {
+                rate_per_second: 1,
+                rate_burst: 10,
+                max_msg_len: 8192,
+            }
+        );
+        assert!(!slow.same_rate(&global));
+        assert!(global.with(&"len=10".parse().unwrap()).same_rate(&global));
+    }
+
+    #[test]
+    fn test_operator_policy_wins() {
+        let policies = RoomPolicies::new();
+        let news = ChannelName::new("#news").unwrap();
+        assert_eq!(policies.policy(&news), None);
+        assert_eq!(policies.limits(&news), Limits::global(&get_config()));
+
+        let policy: RoomPolicy = "len=100000".parse().unwrap();
+        policies.set(news.clone(), Some(policy));
+        assert_eq!(policies.policy(&news), Some(policy));
+        assert_eq!(policies.limits(&news).max_msg_len, 100_000);
+        assert_eq!(policies.longest_msg_len(), 100_000);
+
+        policies.set(news.clone(), None);
+        assert_eq!(policies.policy(&news), None);
+    }
+}
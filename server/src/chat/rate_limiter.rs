@@ -12,6 +12,8 @@ type DirectRateLimiter = GovRateLimiter<NotKeyed, InMemoryState, DefaultClock>;
 #[derive(Debug)]
 pub struct RateLimiter {
     inner: DirectRateLimiter,
+    rate_per_second: u32,
+    burst_capacity: u32,
 }
 
 impl RateLimiter {
@@ -28,15 +30,28 @@ impl RateLimiter {
         let quota = Quota::per_second(rate).allow_burst(burst);
         let limiter = GovRateLimiter::direct(quota);
 
-        Self { inner: limiter }
+        Self {
+            inner: limiter,
+            rate_per_second,
+            burst_capacity,
+        }
+    }
+
+    /// Switches to a new rate and burst, starting over with a full bucket;
+    /// the same ones as now change nothing.
+    pub fn reconfigure(&mut self, rate_per_second: u32, burst_capacity: u32) {
+        if (rate_per_second, burst_capacity) != (self.rate_per_second, self.burst_capacity) {
+            *self = Self::with_config(rate_per_second, burst_capacity);
+        }
     }
 
+    /// Takes a token if one is available, without waiting.
     #[must_use]
-    #[allow(dead_code)]
     pub fn try_acquire(&self) -> bool {
         self.inner.check().is_ok()
     }
 
+    #[allow(dead_code)]
     pub async fn acquire(&self) {
         self.inner.until_ready().await;
     }
@@ -95,6 +110,21 @@ mod tests {
         assert!(limiter.try_acquire());
     }
 
+    #[test]
+    fn test_reconfigure() {
+        let mut limiter = RateLimiter::with_config(1, 1);
+        assert!(limiter.try_acquire());
+
+        limiter.reconfigure(1, 1);
+        assert!(!limiter.try_acquire());
+
+        limiter.reconfigure(1, 3);
+        for _ in 0..3 {
+            assert!(limiter.try_acquire());
+        }
+        assert!(!limiter.try_acquire());
+    }
+
     #[test]
     fn test_default_impl() {
         let limiter = RateLimiter::default();
@@ -0,0 +1,103 @@
+//! The chat lines a connection sent lately, which its user may still `edit`
+//! or `delete`.
+//!
+//! Only the id the server gave each line and the room it went to are kept,
+//! and only for the last [`CAPACITY`] lines; a line older than
+//! [`EDIT_WINDOW`] can no longer be changed.
+
+use std::{collections::VecDeque, time::Duration};
+
+use tokio::time::Instant;
+
+use super::channel::ChannelName;
+
+/// How many of a connection's lines are remembered.
+pub const CAPACITY: usize = 20;
+
+/// How long after sending a line it may be edited or deleted.
+pub const EDIT_WINDOW: Duration = Duration::from_secs(5 * 60);
+
+#[derive(Debug)]
+struct Sent {
+    id: String,
+    channel: ChannelName,
+    at: Instant,
+}
+
+#[derive(Debug)]
+pub struct RecentLines {
+    capacity: usize,
+    window: Duration,
+    lines: VecDeque<Sent>,
+}
+
+impl RecentLines {
+    pub const fn new(capacity: usize, window: Duration) -> Self {
+        Self {
+            capacity,
+            window,
+            lines: VecDeque::new(),
+        }
+    }
+
+    /// Notes that the line `id` was sent to `channel` at `now`.
+    pub fn record(&mut self, id: String, channel: ChannelName, now: Instant) {
+        if self.capacity == 0 {
+            return;
+        }
+        if self.lines.len() >= self.capacity {
+            self.lines.pop_front();
+        }
+        self.lines.push_back(Sent { id, channel, at: now });
+    }
+
+    /// Whether `id` is a line sent to `channel` recently enough to change.
+    pub fn is_editable(&self, id: &str, channel: &ChannelName, now: Instant) -> bool {
+        self.lines.iter().any(|sent| {
+            sent.id == id
+                && sent.channel == *channel
+                && sent.at.checked_add(self.window).is_some_and(|until| now < until)
+        })
+    }
+
+    /// Forgets the line `id`, e.g. once it is deleted.
+    pub fn forget(&mut self, id: &str) {
+        self.lines.retain(|sent| sent.id != id);
+    }
+}
+
+#[cfg(test)]
+#[allow(clippy::unwrap_used)]
+mod tests {
+    use super::*;
+
+    const WINDOW: Duration = Duration::from_secs(60);
+
+    #[test]
+    fn test_recent_lines_window() {
+        let general = ChannelName::default_channel();
+        let start = Instant::now();
+        let mut recent = RecentLines::new(CAPACITY, WINDOW);
+        recent.record("7".to_string(), general.clone(), start);
+        assert!(recent.is_editable("7", &general, start + Duration::from_secs(59)));
+        assert!(!recent.is_editable("7", &general, start + WINDOW));
+        assert!(!recent.is_editable("8", &general, start));
+    }
+
+    #[test]
+    fn test_recent_lines_room_and_capacity() {
+        let general = ChannelName::default_channel();
+        let dev = ChannelName::new("#dev").unwrap();
+        let now = Instant::now();
+        let mut recent = RecentLines::new(2, WINDOW);
+        for id in ["1", "2", "3"] {
+            recent.record(id.to_string(), general.clone(), now);
+        }
+        assert!(!recent.is_editable("1", &general, now));
+        assert!(recent.is_editable("2", &general, now));
+        assert!(!recent.is_editable("2", &dev, now));
+
+        recent.forget("3");
+        assert!(!recent.is_editable("3", &general, now));
+    }
+}
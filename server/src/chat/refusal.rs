@@ -0,0 +1,178 @@
+//! The [`ErrorCode`] each error a client can be told about goes out under,
+//! so that every `ERR` carries one.
+
+use std::fmt::Display;
+
+use common::{
+    error_code::ErrorCode,
+    tcp_message::{ClientParseError, ServerMessage},
+};
+
+use crate::chat::{
+    ban::Error as BanError, channel::Error as ChannelError, connection::ConnectionError, conns::Error as ConnsError,
+    room::Error as RoomError, session::Error as SessionError, user::Error as UserError,
+};
+
+/// An error a client may be sent as `ERR`.
+pub trait Refusal: Display {
+    fn code(&self) -> ErrorCode;
+}
+
+/// A refusal on its way to the client.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct Refused {
+    pub code: ErrorCode,
+    pub reason: String,
+}
+
+impl Refused {
+    pub fn new(code: ErrorCode, reason: impl Into<String>) -> Self {
+        Self {
+            code,
+            reason: reason.into(),
+        }
+    }
+}
+
+impl<E: Refusal> From<E> for Refused {
+    fn from(e: E) -> Self {
+        Self::new(e.code(), e.to_string())
+    }
+}
+
+impl From<Refused> for ServerMessage {
+    fn from(refused: Refused) -> Self {
+        Self::Err {
+            code: refused.code,
+            reason: refused.reason,
+        }
+    }
+}
+
+/// `e` as the `ERR` telling the client about it.
+pub fn refusal(e: &impl Refusal) -> ServerMessage {
+    ServerMessage::Err {
+        code: e.code(),
+        reason: e.to_string(),
+    }
+}
+
+impl Refusal for UserError {
+    fn code(&self) -> ErrorCode {
+        match self {
+            Self::InvalidUsername(_) => ErrorCode::INVALID_USERNAME,
+            Self::UsernameTaken(_) | Self::NameTaken => ErrorCode::NAME_TAKEN,
+            Self::NameCoolingDown(..) => ErrorCode::NAME_COOLING_DOWN,
+            Self::UsernameReserved => ErrorCode::NAME_RESERVED,
+            Self::ServerFull => ErrorCode::SERVER_FULL,
+            Self::AuthenticationFailed => ErrorCode::AUTH_FAILED,
+            Self::Banned => ErrorCode::BANNED,
+            Self::TooManyConnections => ErrorCode::TOO_MANY_CONNECTIONS,
+            Self::UserNotFound(_) => ErrorCode::NO_SUCH_USER,
+            Self::Undeliverable(_) => ErrorCode::UNDELIVERABLE,
+            Self::Channel(e) => e.code(),
+            Self::Session(e) => e.code(),
+            Self::LockTimeout => ErrorCode::BUSY,
+        }
+    }
+}
+
+impl Refusal for ChannelError {
+    fn code(&self) -> ErrorCode {
+        match self {
+            Self::InvalidName => ErrorCode::INVALID_ROOM,
+            Self::AlreadyMember(_) => ErrorCode::ALREADY_IN_ROOM,
+        }
+    }
+}
+
+impl Refusal for SessionError {
+    fn code(&self) -> ErrorCode {
+        match self {
+            Self::Invalid => ErrorCode::INVALID_SESSION,
+            Self::Superseded => ErrorCode::SESSION_SUPERSEDED,
+            Self::LockTimeout => ErrorCode::BUSY,
+        }
+    }
+}
+
+impl Refusal for BanError {
+    fn code(&self) -> ErrorCode {
+        match self {
+            Self::NotBanned(_) => ErrorCode::NOT_BANNED,
+            Self::Store(_) => ErrorCode::SERVER_ERROR,
+            Self::LockTimeout => ErrorCode::BUSY,
+        }
+    }
+}
+
+impl Refusal for ConnsError {
+    fn code(&self) -> ErrorCode {
+        match self {
+            Self::NotFound(_) => ErrorCode::NO_SUCH_CONNECTION,
+            Self::LockTimeout => ErrorCode::BUSY,
+        }
+    }
+}
+
+impl Refusal for RoomError {
+    fn code(&self) -> ErrorCode {
+        match self {
+            Self::Busy | Self::Full | Self::Timeout => ErrorCode::BUSY,
+            Self::Closed | Self::Poisoned => ErrorCode::SERVER_ERROR,
+        }
+    }
+}
+
+impl Refusal for ConnectionError {
+    fn code(&self) -> ErrorCode {
+        match self {
+            Self::Io(_) => ErrorCode::SERVER_ERROR,
+            Self::Timeout => ErrorCode::READ_TIMEOUT,
+            Self::MessageTooLong(_) => ErrorCode::MESSAGE_TOO_LONG,
+            Self::LineTooLong(_) => ErrorCode::LINE_TOO_LONG,
+            Self::IllegalCharacters => ErrorCode::ILLEGAL_CHARACTERS,
+            Self::RateLimited => ErrorCode::RATE_LIMITED,
+            Self::TooSlow => ErrorCode::TOO_SLOW,
+        }
+    }
+}
+
+impl Refusal for ClientParseError {
+    fn code(&self) -> ErrorCode {
+        match self {
+            Self::UnknownCommand(_) => ErrorCode::UNKNOWN_COMMAND,
+            Self::InvalidUsernameEncoding => ErrorCode::INVALID_USERNAME,
+            Self::InvalidUtf8 => ErrorCode::INVALID_ENCODING,
+            Self::Empty | Self::MissingField(_) | Self::InvalidField(_) | Self::InvalidJson(_) => {
+                ErrorCode::BAD_REQUEST
+            }
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::chat::channel::ChannelName;
+
+    #[test]
+    fn test_refusals_carry_their_code() {
+        let taken = UserError::UsernameTaken("bob".to_string());
+        assert_eq!(
+            refusal(&taken),
+            ServerMessage::Err {
+                code: ErrorCode::NAME_TAKEN,
+                reason: "username 'bob' is already taken".to_string(),
+            }
+        );
+        // wrapped errors keep the code of what they wrap
+        let member = UserError::Channel(ChannelError::AlreadyMember(ChannelName::default_channel()));
+        assert_eq!(member.code(), ErrorCode::ALREADY_IN_ROOM);
+        assert_eq!(
+            Refused::from(ConnectionError::RateLimited),
+            Refused::new(ErrorCode::RATE_LIMITED, "rate limited, slow down")
+        );
+        assert_eq!(ClientParseError::InvalidUtf8.code(), ErrorCode::INVALID_ENCODING);
+    }
+}
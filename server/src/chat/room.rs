@@ -9,6 +9,8 @@ use jiff::Timestamp;
 use thiserror::Error as this_error;
 use uuid::Uuid;
 
+use crate::chat::{channel::ChannelName, user::Username};
+
 const DEFAULT_BUFFER_LENGTH: u16 = u16::MAX;
 
 #[derive(this_error, Debug)]
@@ -35,34 +37,152 @@ pub enum RecvError {
     Disconnected,
 }
 
+/// Who the dispatcher fans a message out to.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum Audience {
+    Everyone,
+    Channel(ChannelName),
+}
+
 #[derive(Debug, Clone, PartialEq, Eq)]
-pub struct OneToOne(pub Vec<u8>); // Source of message need not fanout(user->room)
+pub struct OneToOne {
+    // Source of message need not fanout(user->room)
+    payload: Vec<u8>,
+    audience: Audience,
+    recorded: bool,
+    last: bool,
+    except: Option<Username>,
+    own_copy: Option<Vec<u8>>,
+}
 
 #[derive(Debug, Clone)]
-pub struct OneToMany(Arc<Vec<u8>>); // Source of message need fanout(room->to all users)
+pub struct OneToMany {
+    // Source of message need fanout(room->to all users)
+    payload: Arc<Vec<u8>>,
+    audience: Audience,
+    recorded: bool,
+    last: bool,
+    except: Option<Username>,
+    own_copy: Option<Arc<Vec<u8>>>,
+}
+
+impl OneToOne {
+    pub const fn to_channel(payload: Vec<u8>, channel: ChannelName) -> Self {
+        Self {
+            payload,
+            audience: Audience::Channel(channel),
+            recorded: false,
+            last: false,
+            except: None,
+            own_copy: None,
+        }
+    }
+
+    /// Marks a channel message to be kept in that channel's history.
+    pub const fn recorded(mut self) -> Self {
+        self.recorded = true;
+        self
+    }
+
+    /// Marks a message as the last one its recipient gets; their connection
+    /// is closed once it has been written.
+    pub const fn last(mut self) -> Self {
+        self.last = true;
+        self
+    }
+
+    /// Leaves `username` out of the fan-out, e.g. the user it is about.
+    pub fn except(mut self, username: Username) -> Self {
+        self.except = Some(username);
+        self
+    }
+
+    /// Has `sender` get `own_copy` in place of the message, e.g. what they
+    /// typed where the room gets it censored, fanned out along with it.
+    pub fn except_sender(mut self, sender: Username, own_copy: Vec<u8>) -> Self {
+        self.except = Some(sender);
+        self.own_copy = Some(own_copy);
+        self
+    }
+}
+
+impl OneToMany {
+    pub const fn audience(&self) -> &Audience {
+        &self.audience
+    }
+
+    pub const fn is_recorded(&self) -> bool {
+        self.recorded
+    }
+
+    pub const fn is_last(&self) -> bool {
+        self.last
+    }
+
+    pub const fn excluded(&self) -> Option<&Username> {
+        self.except.as_ref()
+    }
+
+    /// What the excluded sender gets in place of the message, if anything,
+    /// to the same audience.
+    pub fn own_copy(&self) -> Option<Self> {
+        self.own_copy.as_ref().map(|own_copy| Self {
+            payload: Arc::clone(own_copy),
+            audience: self.audience.clone(),
+            recorded: false,
+            last: self.last,
+            except: None,
+            own_copy: None,
+        })
+    }
+
+    /// The same message, and own copy, with `rewrite` applied to both, e.g.
+    /// to number a chat line.
+    pub fn rewritten(&self, rewrite: impl Fn(&[u8]) -> Vec<u8>) -> Self {
+        Self {
+            payload: Arc::new(rewrite(&self.payload)),
+            own_copy: self.own_copy.as_ref().map(|own_copy| Arc::new(rewrite(own_copy))),
+            ..self.clone()
+        }
+    }
+}
 
 impl From<Vec<u8>> for OneToOne {
     fn from(v: Vec<u8>) -> Self {
-        Self(v)
+        Self {
+            payload: v,
+            audience: Audience::Everyone,
+            recorded: false,
+            last: false,
+            except: None,
+            own_copy: None,
+        }
     }
 }
 
 impl From<OneToOne> for OneToMany {
     fn from(one: OneToOne) -> Self {
-        Self(Arc::new(one.0))
+        Self {
+            payload: Arc::new(one.payload),
+            audience: one.audience,
+            recorded: one.recorded,
+            last: one.last,
+            except: one.except,
+            own_copy: one.own_copy.map(Arc::new),
+        }
     }
 }
 impl std::ops::Deref for OneToOne {
     type Target = [u8];
     fn deref(&self) -> &Self::Target {
-        &self.0
+        &self.payload
     }
 }
 
 impl std::ops::Deref for OneToMany {
     type Target = [u8];
     fn deref(&self) -> &Self::Target {
-        &self.0
+        &self.payload
     }
 }
 
@@ -203,6 +323,54 @@ mod tests {
         assert_eq!(&*received, msg.as_slice());
     }
 
+    #[test]
+    fn test_room_preserves_audience() {
+        let room = Room::new(10);
+        let general = ChannelName::default_channel();
+        MessageQueue::send_timeout(
+            &room,
+            OneToOne::to_channel(b"hi".to_vec(), general.clone()),
+            Duration::from_millis(100),
+        )
+        .unwrap();
+
+        let received = room.receiver().recv_timeout(Duration::from_millis(100)).unwrap();
+        assert_eq!(received.audience(), &Audience::Channel(general));
+        assert_eq!(&*received, b"hi");
+        assert!(!received.is_recorded());
+    }
+
+    #[test]
+    fn test_room_preserves_recorded_flag() {
+        let room = Room::new(10);
+        MessageQueue::send_timeout(
+            &room,
+            OneToOne::to_channel(b"hi".to_vec(), ChannelName::default_channel()).recorded(),
+            Duration::from_millis(100),
+        )
+        .unwrap();
+
+        let received = room.receiver().recv_timeout(Duration::from_millis(100)).unwrap();
+        assert!(received.is_recorded());
+        assert!(!received.is_last());
+    }
+
+    #[test]
+    fn test_last_flag_survives_fanout() {
+        let msg = OneToMany::from(OneToOne::from(b"bye".to_vec()).last());
+        assert!(msg.is_last());
+        assert!(!msg.is_recorded());
+        assert_eq!(msg.excluded(), None);
+    }
+
+    #[test]
+    fn test_exclusion_survives_fanout() {
+        let alice = Username::new("alice").unwrap();
+        let msg =
+            OneToMany::from(OneToOne::to_channel(b"hi".to_vec(), ChannelName::default_channel()).except(alice.clone()));
+        assert_eq!(msg.excluded(), Some(&alice));
+    }
+
     #[test]
     fn test_room_display() {
         let room = Room::new(1);
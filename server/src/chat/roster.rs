@@ -0,0 +1,110 @@
+//! `USERLIST` snapshots: everyone in a room, sent to the room after anyone
+//! joins or leaves it, so a dashboard that connects late can take the whole
+//! roster from the next one instead of piecing it together from deltas.
+//!
+//! The first change to a room schedules its snapshot [`SNAPSHOT_DELAY`]
+//! later, and any more changes before then are covered by the same one, so
+//! a burst of a hundred joins costs the room one snapshot rather than a
+//! hundred. Only JSON clients are sent them; text clients never see one.
+
+use std::{collections::HashSet, sync::LazyLock, time::Duration};
+
+use common::tcp_message::{ServerMessage, WireEncode as _};
+use parking_lot::Mutex;
+use tracing::warn;
+
+use crate::chat::{broker::get_broker, channel::ChannelName};
+
+/// How long a room's changes are gathered before its snapshot goes out.
+pub const SNAPSHOT_DELAY: Duration = Duration::from_millis(500);
+
+const LOCK_TIMEOUT: Duration = Duration::from_millis(50);
+
+static ROSTERS: LazyLock<RosterFeed> = LazyLock::new(RosterFeed::new);
+
+pub fn get_rosters() -> &'static RosterFeed {
+    &ROSTERS
+}
+
+#[derive(Debug, Default)]
+pub struct RosterFeed {
+    // rooms with a snapshot on its way
+    pending: Mutex<HashSet<ChannelName>>,
+}
+
+impl RosterFeed {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Call when someone joins or leaves `channel`, or is renamed in it.
+    pub fn changed(&'static self, channel: &ChannelName) {
+        if !self.schedule(channel) {
+            return;
+        }
+        let channel = channel.clone();
+        tokio::spawn(async move {
+            tokio::time::sleep(SNAPSHOT_DELAY).await;
+            self.take(&channel);
+            send_snapshot(channel);
+        });
+    }
+
+    /// Whether `channel` needs a snapshot scheduled, i.e. has none on its way.
+    fn schedule(&self, channel: &ChannelName) -> bool {
+        let Some(mut pending) = self.pending.try_lock_for(LOCK_TIMEOUT) else {
+            warn!("Snapshot of {channel} skipped: lock timed out");
+            return false;
+        };
+        pending.insert(channel.clone())
+    }
+
+    /// Marks `channel`'s snapshot as sent, so the next change schedules
+    /// another. Waits for the lock: were this skipped, the room would never
+    /// get another snapshot.
+    fn take(&self, channel: &ChannelName) {
+        self.pending.lock().remove(channel);
+    }
+}
+
+/// Tells `channel` who is in it now; a room that has emptied is told nothing.
+fn send_snapshot(channel: ChannelName) {
+    let broker = get_broker();
+    let users = match broker.registry().online_in(&channel) {
+        Ok(users) => users,
+        Err(e) => {
+            warn!("Snapshot of {channel} not sent: {e}");
+            return;
+        }
+    };
+    if users.is_empty() {
+        return;
+    }
+    let snapshot = ServerMessage::UserList {
+        room: channel.to_string(),
+        users: users.iter().map(ToString::to_string).collect(),
+    };
+    if let Err(e) = broker.forward_to_channel(channel, snapshot.encode()) {
+        warn!("Failed to send message to room: {e}");
+    }
+}
+
+#[cfg(test)]
+#[allow(clippy::unwrap_used)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_changes_share_a_snapshot() {
+        let feed = RosterFeed::new();
+        let general = ChannelName::default_channel();
+        let dev = ChannelName::new("#dev").unwrap();
+        assert!(feed.schedule(&general));
+        assert!(!feed.schedule(&general));
+        assert!(feed.schedule(&dev));
+
+        feed.take(&general);
+        assert!(feed.schedule(&general));
+        assert!(!feed.schedule(&dev));
+    }
+}
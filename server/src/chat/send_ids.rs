@@ -0,0 +1,97 @@
+//! The ids a connection has had `ACK`ed lately, so that one reused too soon
+//! is refused with `NACK <id> duplicate-id` rather than acked a second time,
+//! which would leave the client unable to tell which line the `ACK` was for.
+//!
+//! Only the last [`CAPACITY`] acked ids are kept. An id that was `NACK`ed is
+//! not remembered, so a client may send the same line again under the same id,
+//! e.g. once it is no longer rate limited.
+
+use std::collections::{HashSet, VecDeque};
+
+use thiserror::Error as this_error;
+
+/// How many acked ids each connection remembers.
+pub const CAPACITY: usize = 256;
+
+/// The longest id a `send` may carry, in bytes.
+pub const MAX_ID_LEN: usize = 64;
+
+/// Why an id was refused; the text is the `NACK` reason.
+#[derive(Debug, PartialEq, Eq, this_error)]
+pub enum Error {
+    #[error("empty-id")]
+    Empty,
+
+    #[error("id-too-long")]
+    TooLong,
+
+    #[error("duplicate-id")]
+    Duplicate,
+}
+
+#[derive(Debug)]
+pub struct SendIds {
+    capacity: usize,
+    order: VecDeque<String>,
+    seen: HashSet<String>,
+}
+
+impl SendIds {
+    pub fn new(capacity: usize) -> Self {
+        Self {
+            capacity,
+            order: VecDeque::new(),
+            seen: HashSet::new(),
+        }
+    }
+
+    /// Whether `id` may be used for a new line.
+    pub fn check(&self, id: &str) -> Result<(), Error> {
+        if id.is_empty() {
+            return Err(Error::Empty);
+        }
+        if id.len() > MAX_ID_LEN {
+            return Err(Error::TooLong);
+        }
+        if self.seen.contains(id) {
+            return Err(Error::Duplicate);
+        }
+        Ok(())
+    }
+
+    /// Notes that `id` was acked, forgetting the oldest past the capacity.
+    pub fn record(&mut self, id: &str) {
+        if self.capacity == 0 || !self.seen.insert(id.to_string()) {
+            return;
+        }
+        self.order.push_back(id.to_string());
+        if self.order.len() > self.capacity
+            && let Some(oldest) = self.order.pop_front()
+        {
+            self.seen.remove(&oldest);
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_send_ids_refuse_reuse() {
+        let mut ids = SendIds::new(2);
+        assert_eq!(ids.check("1"), Ok(()));
+        ids.record("1");
+        assert_eq!(ids.check("1"), Err(Error::Duplicate));
+        assert_eq!(ids.check(""), Err(Error::Empty));
+        assert_eq!(ids.check(&"x".repeat(MAX_ID_LEN)), Ok(()));
+        assert_eq!(ids.check(&"x".repeat(MAX_ID_LEN + 1)), Err(Error::TooLong));
+
+        // past the capacity the oldest may be used again
+        ids.record("2");
+        ids.record("3");
+        assert_eq!(ids.check("1"), Ok(()));
+        assert_eq!(ids.check("2"), Err(Error::Duplicate));
+        assert_eq!(Error::Duplicate.to_string(), "duplicate-id");
+    }
+}
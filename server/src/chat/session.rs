@@ -0,0 +1,349 @@
+//! Session tokens that let a dropped client take its place back.
+//!
+//! Every join is issued a token. When a connection drops without a `leave`,
+//! the user stays registered, keeping their name and room, for
+//! `CHAT_SESSION_GRACE`; a new connection presenting the token with `rejoin`
+//! within that window takes over. A token is good for one rejoin, after which
+//! the new connection gets a fresh one; if the old connection was still
+//! open, it is closed with `ERR session superseded`, so a user never has
+//! two. Leaving, being kicked or letting the window run out revokes it.
+//!
+//! No more than `CHAT_SESSION_MAX_HELD` sessions are held at once, so a
+//! flood of dropped connections can't keep every name taken. Past that, the
+//! session held longest is evicted: its token is void at once, and whoever
+//! waits to release its name is woken to do so.
+//!
+//! A session that ends with its user gone, by leaving or by running out, is
+//! [vacated](Sessions::vacate): for `CHAT_NAME_COOLDOWN` more its name is
+//! nobody else's to take, and only a `rejoin` with its token can claim it,
+//! joining afresh under it. So a name can't be sniped the moment its owner
+//! goes, and they get a fair chance to come back for it.
+
+use std::{
+    collections::HashMap,
+    sync::{Arc, LazyLock},
+    time::Duration,
+};
+
+use common::consts;
+use parking_lot::Mutex;
+use thiserror::Error as this_error;
+use tokio::{sync::Notify, time::Instant};
+use uuid::Uuid;
+
+use super::user::Username;
+
+const LOCK_TIMEOUT: Duration = Duration::from_millis(50);
+
+static SESSIONS: LazyLock<Sessions> = LazyLock::new(Sessions::default);
+
+pub fn get_sessions() -> &'static Sessions {
+    &SESSIONS
+}
+
+#[derive(Debug, Clone, this_error, PartialEq, Eq)]
+pub enum Error {
+    #[error("{}", consts::ERR_SESSION_INVALID)]
+    Invalid,
+
+    /// Told to the connection a `rejoin` took the session from.
+    #[error("session superseded")]
+    Superseded,
+
+    #[error("session lock timeout")]
+    LockTimeout,
+}
+
+#[derive(Debug)]
+struct Session {
+    username: Username,
+    /// Set once the connection has dropped.
+    held: Option<Held>,
+    /// Set once the session has ended; until then its name is kept for
+    /// whoever has the token.
+    cooling: Option<Instant>,
+}
+
+/// What a claimed token was good for.
+#[derive(Debug, PartialEq, Eq)]
+pub enum Claim {
+    /// A session going on or held, whose user is still registered.
+    Session(Username),
+    /// A name given up less than its cooldown ago, to join afresh under.
+    Name(Username),
+}
+
+#[derive(Debug)]
+struct Held {
+    since: Instant,
+    /// The token is void after this.
+    expires: Instant,
+    evicted: Arc<Notify>,
+}
+
+#[derive(Debug, Default)]
+pub struct Sessions {
+    sessions: Mutex<HashMap<String, Session>>,
+}
+
+impl Sessions {
+    /// A new token for `username`, valid until revoked or, once detached,
+    /// until its grace window ends.
+    pub fn issue(&self, username: &Username) -> Result<String, Error> {
+        let token = Uuid::new_v4().simple().to_string();
+        self.sessions
+            .try_lock_for(LOCK_TIMEOUT)
+            .ok_or(Error::LockTimeout)?
+            .insert(
+                token.clone(),
+                Session {
+                    username: username.clone(),
+                    held: None,
+                    cooling: None,
+                },
+            );
+        Ok(token)
+    }
+
+    /// Follows a `nick`, so a rejoin reclaims the current name.
+    pub fn rename(&self, token: &str, username: &Username) -> Result<(), Error> {
+        let mut sessions = self.sessions.try_lock_for(LOCK_TIMEOUT).ok_or(Error::LockTimeout)?;
+        let session = sessions.get_mut(token).ok_or(Error::Invalid)?;
+        session.username = username.clone();
+        drop(sessions);
+        Ok(())
+    }
+
+    /// Starts the grace window of a session whose connection dropped at
+    /// `now`, then evicts the sessions held longest while more than
+    /// `max_held` are held; zero holds any number.
+    ///
+    /// Returns what is notified should this session be evicted in turn.
+    pub fn detach(&self, token: &str, grace: Duration, max_held: usize, now: Instant) -> Result<Arc<Notify>, Error> {
+        let mut sessions = self.sessions.try_lock_for(LOCK_TIMEOUT).ok_or(Error::LockTimeout)?;
+        let session = sessions.get_mut(token).ok_or(Error::Invalid)?;
+        let evicted = Arc::new(Notify::new());
+        session.held = Some(Held {
+            since: now,
+            expires: now.checked_add(grace).unwrap_or(now),
+            evicted: Arc::clone(&evicted),
+        });
+        if max_held > 0 {
+            evict_oldest(&mut sessions, max_held);
+        }
+        drop(sessions);
+        Ok(evicted)
+    }
+
+    /// Uses up `token`, returning whose session or name it was if still
+    /// valid at `now`.
+    ///
+    /// An expired token is left for [`Sessions::revoke`], so whoever is
+    /// waiting to release the name still finds it.
+    pub fn claim(&self, token: &str, now: Instant) -> Result<Claim, Error> {
+        let mut sessions = self.sessions.try_lock_for(LOCK_TIMEOUT).ok_or(Error::LockTimeout)?;
+        let session = sessions.get(token).ok_or(Error::Invalid)?;
+        if session.held.as_ref().is_some_and(|held| held.expires <= now) {
+            return Err(Error::Invalid);
+        }
+        let claim = match session.cooling {
+            None => Claim::Session(session.username.clone()),
+            Some(until) if until > now => Claim::Name(session.username.clone()),
+            Some(_) => {
+                sessions.remove(token);
+                return Err(Error::Invalid);
+            }
+        };
+        sessions.remove(token);
+        drop(sessions);
+        Ok(claim)
+    }
+
+    /// Ends `token`'s session as [`Sessions::revoke`] does, but keeps its
+    /// name for the token alone to claim for `cooldown` after `now`; zero
+    /// frees it at once. Returns whether the session was still outstanding.
+    pub fn vacate(&self, token: &str, cooldown: Duration, now: Instant) -> Result<bool, Error> {
+        let mut sessions = self.sessions.try_lock_for(LOCK_TIMEOUT).ok_or(Error::LockTimeout)?;
+        // names whose cooldown is over are nobody's to claim any more
+        sessions.retain(|_, session| session.cooling.is_none_or(|until| until > now));
+        let vacated = if cooldown.is_zero() {
+            sessions.remove(token).is_some()
+        } else if let Some(session) = sessions.get_mut(token) {
+            session.held = None;
+            session.cooling = Some(now.checked_add(cooldown).unwrap_or(now));
+            true
+        } else {
+            false
+        };
+        drop(sessions);
+        Ok(vacated)
+    }
+
+    /// How long `username` is still kept for the session that gave it up,
+    /// if it is, at `now`.
+    pub fn cooling(&self, username: &Username, now: Instant) -> Result<Option<Duration>, Error> {
+        Ok(self
+            .sessions
+            .try_lock_for(LOCK_TIMEOUT)
+            .ok_or(Error::LockTimeout)?
+            .values()
+            .filter(|session| session.username.is_same_user(username))
+            .filter_map(|session| session.cooling)
+            .find(|until| *until > now)
+            .map(|until| until.duration_since(now)))
+    }
+
+    /// Voids `token`, returning whether it was still outstanding.
+    pub fn revoke(&self, token: &str) -> Result<bool, Error> {
+        Ok(self
+            .sessions
+            .try_lock_for(LOCK_TIMEOUT)
+            .ok_or(Error::LockTimeout)?
+            .remove(token)
+            .is_some())
+    }
+}
+
+/// Drops held sessions, longest held first, until no more than `max_held`
+/// are left, and wakes whoever holds each one's name.
+fn evict_oldest(sessions: &mut HashMap<String, Session>, max_held: usize) {
+    let mut held: Vec<(Instant, String)> = sessions
+        .iter()
+        .filter_map(|(token, session)| session.held.as_ref().map(|held| (held.since, token.clone())))
+        .collect();
+    let excess = held.len().saturating_sub(max_held);
+    if excess == 0 {
+        return;
+    }
+    held.sort();
+    for (_, token) in held.into_iter().take(excess) {
+        if let Some(Session { held: Some(held), .. }) = sessions.remove(&token) {
+            // a permit is kept if nobody waits yet, so this is never missed
+            held.evicted.notify_one();
+        }
+    }
+}
+
+#[cfg(test)]
+#[allow(clippy::unwrap_used)]
+mod tests {
+    use super::*;
+
+    const GRACE: Duration = Duration::from_secs(60);
+
+    fn alice() -> Username {
+        Username::new("alice").unwrap()
+    }
+
+    #[test]
+    fn test_tokens_are_unique() {
+        let sessions = Sessions::default();
+        let first = sessions.issue(&alice()).unwrap();
+        let second = sessions.issue(&alice()).unwrap();
+        assert_ne!(first, second);
+        assert_eq!(first.len(), 32);
+    }
+
+    #[test]
+    fn test_claim_is_single_use() {
+        let sessions = Sessions::default();
+        let now = Instant::now();
+        let token = sessions.issue(&alice()).unwrap();
+        sessions.detach(&token, GRACE, 0, now).unwrap();
+        assert_eq!(sessions.claim(&token, now), Ok(Claim::Session(alice())));
+        assert_eq!(sessions.claim(&token, now), Err(Error::Invalid));
+        assert_eq!(sessions.claim("made-up", now), Err(Error::Invalid));
+    }
+
+    #[test]
+    fn test_claim_after_grace_fails() {
+        let sessions = Sessions::default();
+        let now = Instant::now();
+        let token = sessions.issue(&alice()).unwrap();
+        sessions.detach(&token, GRACE, 0, now).unwrap();
+        assert_eq!(sessions.claim(&token, now + GRACE), Err(Error::Invalid));
+        // still there for the reaper to find
+        assert!(sessions.revoke(&token).unwrap());
+    }
+
+    #[tokio::test]
+    async fn test_oldest_held_is_evicted_past_the_cap() {
+        let sessions = Sessions::default();
+        let now = Instant::now();
+        let tokens: Vec<String> = ["alice", "bob", "carol"]
+            .iter()
+            .map(|name| sessions.issue(&Username::new(*name).unwrap()).unwrap())
+            .collect();
+        let first = sessions.detach(&tokens[0], GRACE, 2, now).unwrap();
+        sessions
+            .detach(&tokens[1], GRACE, 2, now + Duration::from_secs(1))
+            .unwrap();
+        // still connected, so not counted
+        let connected = sessions.issue(&Username::new("dave").unwrap()).unwrap();
+        sessions
+            .detach(&tokens[2], GRACE, 2, now + Duration::from_secs(2))
+            .unwrap();
+
+        assert_eq!(sessions.claim(&tokens[0], now), Err(Error::Invalid));
+        // woken even though nobody was waiting when it happened
+        assert!(
+            tokio::time::timeout(Duration::from_secs(1), first.notified())
+                .await
+                .is_ok()
+        );
+        assert_eq!(
+            sessions.claim(&tokens[1], now),
+            Ok(Claim::Session(Username::new("bob").unwrap()))
+        );
+        assert_eq!(
+            sessions.claim(&tokens[2], now),
+            Ok(Claim::Session(Username::new("carol").unwrap()))
+        );
+        assert!(sessions.revoke(&connected).unwrap());
+    }
+
+    #[test]
+    fn test_rename_and_revoke() {
+        let sessions = Sessions::default();
+        let token = sessions.issue(&alice()).unwrap();
+        let renamed = Username::new("alice2").unwrap();
+        sessions.rename(&token, &renamed).unwrap();
+        assert!(sessions.revoke(&token).unwrap());
+        assert_eq!(sessions.rename(&token, &renamed), Err(Error::Invalid));
+
+        let token = sessions.issue(&alice()).unwrap();
+        sessions.rename(&token, &renamed).unwrap();
+        assert_eq!(sessions.claim(&token, Instant::now()), Ok(Claim::Session(renamed)));
+    }
+
+    #[test]
+    fn test_vacated_name_is_kept_for_its_token() {
+        let sessions = Sessions::default();
+        let now = Instant::now();
+        let cooldown = Duration::from_secs(5);
+        let token = sessions.issue(&alice()).unwrap();
+        assert_eq!(sessions.cooling(&alice(), now), Ok(None));
+        assert!(sessions.vacate(&token, cooldown, now).unwrap());
+        // any case of the name
+        let shouted = Username::new("ALICE").unwrap();
+        assert_eq!(sessions.cooling(&shouted, now), Ok(Some(cooldown)));
+        assert_eq!(
+            sessions.cooling(&alice(), now + Duration::from_secs(2)),
+            Ok(Some(Duration::from_secs(3)))
+        );
+        assert_eq!(sessions.cooling(&alice(), now + cooldown), Ok(None));
+        assert_eq!(sessions.claim(&token, now), Ok(Claim::Name(alice())));
+        assert_eq!(sessions.cooling(&alice(), now), Ok(None));
+
+        // once the cooldown is over, the token is good for nothing
+        let token = sessions.issue(&alice()).unwrap();
+        sessions.vacate(&token, cooldown, now).unwrap();
+        assert_eq!(sessions.claim(&token, now + cooldown), Err(Error::Invalid));
+
+        // without a cooldown, vacating is revoking
+        let token = sessions.issue(&alice()).unwrap();
+        assert!(sessions.vacate(&token, Duration::ZERO, now).unwrap());
+        assert!(!sessions.vacate(&token, cooldown, now).unwrap());
+        assert_eq!(sessions.cooling(&alice(), now), Ok(None));
+    }
+}
@@ -0,0 +1,237 @@
+//! The default store: history lasts as long as the process, and bans live
+//! in `CHAT_BANFILE` when it is set.
+//!
+//! The file holds one ban per line, `<username> [ip]`; blank lines and lines
+//! starting with `#` are ignored. New bans are appended, while an unban
+//! rewrites the whole file.
+
+use std::{
+    collections::{HashMap, VecDeque},
+    fs::{self, OpenOptions},
+    io::{self, Write},
+    net::IpAddr,
+    path::{Path, PathBuf},
+    time::Duration,
+};
+
+use parking_lot::Mutex;
+use tracing::{info, warn};
+
+use super::{Error, Store};
+use crate::chat::{channel::ChannelName, string as my_string, user::Username};
+
+const LOCK_TIMEOUT: Duration = Duration::from_millis(50);
+
+#[derive(Debug)]
+pub struct MemoryStore {
+    ban_file: Option<PathBuf>,
+    lines: Mutex<HashMap<ChannelName, VecDeque<Vec<u8>>>>,
+    bans: Mutex<HashMap<String, Option<IpAddr>>>,
+}
+
+impl MemoryStore {
+    /// Reads `ban_file` if given; a missing file is just an empty list.
+    pub fn new(ban_file: Option<PathBuf>) -> Self {
+        let bans = ban_file.as_deref().map(read_ban_file).unwrap_or_default();
+        if let Some(path) = &ban_file {
+            info!("Loaded {} ban(s) from {}", bans.len(), path.display());
+        }
+        Self {
+            ban_file,
+            lines: Mutex::new(HashMap::new()),
+            bans: Mutex::new(bans),
+        }
+    }
+}
+
+impl Store for MemoryStore {
+    fn append(&self, channel: &ChannelName, line: &[u8], capacity: usize) -> Result<(), Error> {
+        let mut lines = self.lines.try_lock_for(LOCK_TIMEOUT).ok_or(Error::LockTimeout)?;
+        let kept = lines.entry(channel.clone()).or_default();
+        if kept.len() >= capacity {
+            kept.pop_front();
+        }
+        kept.push_back(line.to_vec());
+        drop(lines);
+        Ok(())
+    }
+
+    fn recent(&self, channel: &ChannelName, limit: usize) -> Result<Vec<Vec<u8>>, Error> {
+        let lines = self.lines.try_lock_for(LOCK_TIMEOUT).ok_or(Error::LockTimeout)?;
+        let recent = lines
+            .get(channel)
+            .map(|kept| kept.iter().skip(kept.len().saturating_sub(limit)).cloned().collect())
+            .unwrap_or_default();
+        drop(lines);
+        Ok(recent)
+    }
+
+    fn rooms(&self) -> Result<Vec<ChannelName>, Error> {
+        Ok(self
+            .lines
+            .try_lock_for(LOCK_TIMEOUT)
+            .ok_or(Error::LockTimeout)?
+            .keys()
+            .cloned()
+            .collect())
+    }
+
+    fn outlives_process(&self) -> bool {
+        false
+    }
+
+    fn forget(&self, channel: &ChannelName) -> Result<(), Error> {
+        self.lines
+            .try_lock_for(LOCK_TIMEOUT)
+            .ok_or(Error::LockTimeout)?
+            .remove(channel);
+        Ok(())
+    }
+
+    fn bans(&self) -> Result<HashMap<String, Option<IpAddr>>, Error> {
+        Ok(self.bans.try_lock_for(LOCK_TIMEOUT).ok_or(Error::LockTimeout)?.clone())
+    }
+
+    fn add_ban(&self, username: &str, addr: Option<IpAddr>) -> Result<(), Error> {
+        let mut bans = self.bans.try_lock_for(LOCK_TIMEOUT).ok_or(Error::LockTimeout)?;
+        if let Some(path) = &self.ban_file {
+            let mut file = OpenOptions::new().create(true).append(true).open(path)?;
+            writeln!(file, "{}", ban_line(username, addr))?;
+        }
+        bans.insert(username.to_string(), addr);
+        drop(bans);
+        Ok(())
+    }
+
+    fn remove_ban(&self, username: &str) -> Result<(), Error> {
+        let mut bans = self.bans.try_lock_for(LOCK_TIMEOUT).ok_or(Error::LockTimeout)?;
+        let Some(addr) = bans.remove(username) else {
+            return Ok(());
+        };
+        if let Some(path) = &self.ban_file
+            && let Err(e) = write_ban_file(path, &bans)
+        {
+            bans.insert(username.to_string(), addr);
+            return Err(e.into());
+        }
+        drop(bans);
+        Ok(())
+    }
+}
+
+fn ban_line(username: &str, addr: Option<IpAddr>) -> String {
+    addr.map_or_else(|| username.to_string(), |addr| format!("{username} {addr}"))
+}
+
+fn read_ban_file(path: &Path) -> HashMap<String, Option<IpAddr>> {
+    let contents = match fs::read_to_string(path) {
+        Ok(contents) => contents,
+        Err(e) if e.kind() == io::ErrorKind::NotFound => return HashMap::new(),
+        Err(e) => {
+            warn!("Cannot read ban file {}: {e}", path.display());
+            return HashMap::new();
+        }
+    };
+    contents
+        .lines()
+        .filter_map(|line| {
+            let parsed = parse_ban_line(line);
+            if parsed.is_none() {
+                warn!("Ignoring malformed line in {}: {line:?}", path.display());
+            }
+            parsed.flatten()
+        })
+        .collect()
+}
+
+/// `None` for a malformed line, `Some(None)` for one to skip.
+#[allow(clippy::option_option)]
+fn parse_ban_line(line: &str) -> Option<Option<(String, Option<IpAddr>)>> {
+    let line = line.trim();
+    if line.is_empty() || line.starts_with('#') {
+        return Some(None);
+    }
+    let mut fields = line.split_whitespace();
+    let username = Username::new(fields.next()?).ok()?;
+    let addr = match fields.next() {
+        Some(addr) => Some(addr.parse().ok()?),
+        None => None,
+    };
+    if fields.next().is_some() {
+        return None;
+    }
+    Some(Some((my_string::to_lowercase(&username.to_string()), addr)))
+}
+
+/// Replaces the file via a temporary sibling so a crash never leaves it half-written.
+fn write_ban_file(path: &Path, bans: &HashMap<String, Option<IpAddr>>) -> io::Result<()> {
+    let mut lines: Vec<String> = bans.iter().map(|(username, addr)| ban_line(username, *addr)).collect();
+    lines.sort();
+    let tmp = path.with_extension("tmp");
+    let mut file = fs::File::create(&tmp)?;
+    for line in &lines {
+        writeln!(file, "{line}")?;
+    }
+    file.sync_all()?;
+    fs::rename(tmp, path)
+}
+
+#[cfg(test)]
+#[allow(clippy::unwrap_used)]
+mod tests {
+    use std::net::Ipv4Addr;
+
+    use super::*;
+
+    const ADDR: IpAddr = IpAddr::V4(Ipv4Addr::new(10, 0, 0, 7));
+
+    #[test]
+    fn test_memory_store_keeps_most_recent() {
+        let store = MemoryStore::new(None);
+        let general = ChannelName::default_channel();
+        for line in ["one", "two", "three"] {
+            store.append(&general, line.as_bytes(), 2).unwrap();
+        }
+        assert_eq!(
+            store.recent(&general, 10).unwrap(),
+            vec![b"two".to_vec(), b"three".to_vec()]
+        );
+        assert_eq!(store.recent(&general, 1).unwrap(), vec![b"three".to_vec()]);
+        assert_eq!(store.rooms().unwrap(), vec![general.clone()]);
+
+        store.forget(&general).unwrap();
+        assert!(store.recent(&general, 10).unwrap().is_empty());
+        assert!(store.rooms().unwrap().is_empty());
+    }
+
+    #[test]
+    fn test_memory_store_bans_persist() {
+        let path = std::env::temp_dir().join(format!("chat-bans-{}-memory", std::process::id()));
+        let _ = fs::remove_file(&path);
+
+        let store = MemoryStore::new(Some(path.clone()));
+        store.add_ban("mallory", Some(ADDR)).unwrap();
+        store.add_ban("trent", None).unwrap();
+        store.remove_ban("trent").unwrap();
+
+        let reopened = MemoryStore::new(Some(path.clone()));
+        assert_eq!(
+            reopened.bans().unwrap(),
+            HashMap::from([("mallory".to_string(), Some(ADDR))])
+        );
+        fs::remove_file(&path).unwrap();
+    }
+
+    #[test]
+    fn test_parse_ban_line() {
+        assert_eq!(
+            parse_ban_line("Mallory 10.0.0.7"),
+            Some(Some(("mallory".to_string(), Some(ADDR))))
+        );
+        assert_eq!(parse_ban_line("trent"), Some(Some(("trent".to_string(), None))));
+        assert_eq!(parse_ban_line("  # comment"), Some(None));
+        assert_eq!(parse_ban_line(""), Some(None));
+        assert_eq!(parse_ban_line("mallory not-an-ip"), None);
+        assert_eq!(parse_ban_line("mallory 10.0.0.7 extra"), None);
+    }
+}
@@ -0,0 +1,99 @@
+//! Where history and bans are kept, behind the [`Store`] trait so the rest
+//! of the server never knows which.
+//!
+//! `CHAT_STORE` picks one at startup. The default, `memory`, keeps history
+//! for as long as the process runs and bans in `CHAT_BANFILE` if set;
+//! `sqlite:PATH` keeps both in a SQLite database, so history and bans
+//! survive restarts.
+
+mod memory;
+mod sqlite;
+
+use std::{
+    collections::HashMap,
+    fmt::Debug,
+    io,
+    net::IpAddr,
+    sync::{Arc, OnceLock},
+};
+
+pub use memory::MemoryStore;
+pub use sqlite::SqliteStore;
+use thiserror::Error as this_error;
+use tracing::info;
+
+use super::channel::ChannelName;
+use crate::config::{Config, get_config};
+
+static STORE: OnceLock<Arc<dyn Store>> = OnceLock::new();
+
+/// Opens the store `config` names for [`get_store`] to hand out; fails if
+/// the SQLite database can't be opened or set up.
+pub fn init(config: &Config) -> Result<(), Error> {
+    if STORE.get().is_none() {
+        let _ = STORE.set(open(config)?);
+    }
+    Ok(())
+}
+
+/// The store [`init`] opened, or an in-memory one if it was never called.
+pub fn get_store() -> Arc<dyn Store> {
+    Arc::clone(STORE.get_or_init(|| Arc::new(MemoryStore::new(get_config().ban_file.clone()))))
+}
+
+fn open(config: &Config) -> Result<Arc<dyn Store>, Error> {
+    Ok(match &config.store {
+        Some(path) => {
+            let store = SqliteStore::open(path)?;
+            info!("Keeping history and bans in {}", path.display());
+            Arc::new(store)
+        }
+        None => Arc::new(MemoryStore::new(config.ban_file.clone())),
+    })
+}
+
+#[derive(Debug, this_error)]
+pub enum Error {
+    #[error("{0}")]
+    Io(#[from] io::Error),
+
+    #[error("{0}")]
+    Sqlite(#[from] rusqlite::Error),
+
+    #[error("store lock timeout")]
+    LockTimeout,
+}
+
+/// Chat lines per room and the ban list, however they are kept.
+///
+/// Bans are keyed by lowercased username, each with the address it was
+/// banned from, if known.
+pub trait Store: Debug + Send + Sync {
+    /// Keeps `line` as `channel`'s newest, dropping the oldest beyond
+    /// `capacity`.
+    fn append(&self, channel: &ChannelName, line: &[u8], capacity: usize) -> Result<(), Error>;
+
+    /// Up to `limit` of `channel`'s most recent lines, oldest first.
+    fn recent(&self, channel: &ChannelName, limit: usize) -> Result<Vec<Vec<u8>>, Error>;
+
+    /// Every room with lines kept.
+    fn rooms(&self) -> Result<Vec<ChannelName>, Error>;
+
+    /// Whether the lines kept outlive the process, so they are worth reading
+    /// back at startup and a room that empties out still has them.
+    fn outlives_process(&self) -> bool;
+
+    /// Called once nobody is left in `channel`. A store that lives only as
+    /// long as the process drops its lines; one that outlives it keeps them
+    /// for whoever comes next.
+    fn forget(&self, channel: &ChannelName) -> Result<(), Error>;
+
+    /// Every ban kept.
+    fn bans(&self) -> Result<HashMap<String, Option<IpAddr>>, Error>;
+
+    /// Saves a ban on `username`, and `addr` with it when known.
+    fn add_ban(&self, username: &str, addr: Option<IpAddr>) -> Result<(), Error>;
+
+    /// Lifts the saved ban on `username`.
+    fn remove_ban(&self, username: &str) -> Result<(), Error>;
+}
@@ -0,0 +1,219 @@
+//! History and bans in a SQLite database, so both survive restarts.
+//!
+//! Rooms keep their lines when they empty out, up to their history size,
+//! for whoever comes next, even after a restart. The database is opened in
+//! WAL mode, so a line is one short append rather than a rewrite.
+
+use std::{collections::HashMap, net::IpAddr, path::Path, time::Duration};
+
+use parking_lot::Mutex;
+use rusqlite::{Connection, OptionalExtension, params};
+use tracing::warn;
+
+use super::{Error, Store};
+use crate::chat::channel::ChannelName;
+
+/// Generous, since writers queue behind each other's disk writes.
+const LOCK_TIMEOUT: Duration = Duration::from_secs(1);
+
+const SCHEMA: &str = "
+    CREATE TABLE IF NOT EXISTS history (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        room TEXT NOT NULL,
+        line BLOB NOT NULL
+    );
+    CREATE INDEX IF NOT EXISTS history_room ON history (room, id);
+    CREATE TABLE IF NOT EXISTS bans (
+        username TEXT PRIMARY KEY,
+        addr TEXT
+    );
+";
+
+#[derive(Debug)]
+pub struct SqliteStore {
+    conn: Mutex<Connection>,
+}
+
+impl SqliteStore {
+    /// Opens the database at `path`, creating it and its tables if need be.
+    pub fn open(path: &Path) -> Result<Self, Error> {
+        let conn = Connection::open(path)?;
+        conn.pragma_update_and_check(None, "journal_mode", "WAL", |row| row.get::<_, String>(0))?;
+        conn.pragma_update(None, "synchronous", "NORMAL")?;
+        conn.execute_batch(SCHEMA)?;
+        Ok(Self { conn: Mutex::new(conn) })
+    }
+}
+
+impl Store for SqliteStore {
+    fn append(&self, channel: &ChannelName, line: &[u8], capacity: usize) -> Result<(), Error> {
+        let room = channel.to_string();
+        let mut conn = self.conn.try_lock_for(LOCK_TIMEOUT).ok_or(Error::LockTimeout)?;
+        let tx = conn.transaction()?;
+        tx.execute("INSERT INTO history (room, line) VALUES (?1, ?2)", params![room, line])?;
+        // the newest line beyond capacity, if any, and everything before it goes
+        let oldest_dropped: Option<i64> = tx
+            .query_row(
+                "SELECT id FROM history WHERE room = ?1 ORDER BY id DESC LIMIT 1 OFFSET ?2",
+                params![room, to_sql_count(capacity)],
+                |row| row.get(0),
+            )
+            .optional()?;
+        if let Some(id) = oldest_dropped {
+            tx.execute("DELETE FROM history WHERE room = ?1 AND id <= ?2", params![room, id])?;
+        }
+        tx.commit()?;
+        drop(conn);
+        Ok(())
+    }
+
+    fn recent(&self, channel: &ChannelName, limit: usize) -> Result<Vec<Vec<u8>>, Error> {
+        let conn = self.conn.try_lock_for(LOCK_TIMEOUT).ok_or(Error::LockTimeout)?;
+        let mut stmt = conn.prepare_cached(
+            "SELECT line FROM (SELECT id, line FROM history WHERE room = ?1 ORDER BY id DESC LIMIT ?2) ORDER BY id",
+        )?;
+        let lines: Vec<Vec<u8>> = stmt
+            .query_map(params![channel.to_string(), to_sql_count(limit)], |row| row.get(0))?
+            .collect::<Result<_, _>>()?;
+        drop(stmt);
+        drop(conn);
+        Ok(lines)
+    }
+
+    fn rooms(&self) -> Result<Vec<ChannelName>, Error> {
+        let conn = self.conn.try_lock_for(LOCK_TIMEOUT).ok_or(Error::LockTimeout)?;
+        let mut stmt = conn.prepare("SELECT DISTINCT room FROM history")?;
+        let rooms: Vec<String> = stmt.query_map([], |row| row.get(0))?.collect::<Result<_, _>>()?;
+        drop(stmt);
+        drop(conn);
+        Ok(rooms
+            .into_iter()
+            .filter_map(|room| match ChannelName::new(&room) {
+                Ok(channel) => Some(channel),
+                Err(_) => {
+                    warn!("Ignoring history kept for a malformed room name {room:?}");
+                    None
+                }
+            })
+            .collect())
+    }
+
+    fn outlives_process(&self) -> bool {
+        true
+    }
+
+    fn forget(&self, _channel: &ChannelName) -> Result<(), Error> {
+        Ok(())
+    }
+
+    fn bans(&self) -> Result<HashMap<String, Option<IpAddr>>, Error> {
+        let conn = self.conn.try_lock_for(LOCK_TIMEOUT).ok_or(Error::LockTimeout)?;
+        let mut stmt = conn.prepare("SELECT username, addr FROM bans")?;
+        let rows: Vec<(String, Option<String>)> = stmt
+            .query_map([], |row| Ok((row.get(0)?, row.get(1)?)))?
+            .collect::<Result<_, _>>()?;
+        drop(stmt);
+        drop(conn);
+        Ok(rows
+            .into_iter()
+            .filter_map(|(username, addr)| match addr.map(|addr| addr.parse()).transpose() {
+                Ok(addr) => Some((username, addr)),
+                Err(_) => {
+                    warn!("Ignoring ban on '{username}' with a malformed address");
+                    None
+                }
+            })
+            .collect())
+    }
+
+    fn add_ban(&self, username: &str, addr: Option<IpAddr>) -> Result<(), Error> {
+        self.conn
+            .try_lock_for(LOCK_TIMEOUT)
+            .ok_or(Error::LockTimeout)?
+            .execute(
+                "INSERT OR REPLACE INTO bans (username, addr) VALUES (?1, ?2)",
+                params![username, addr.map(|addr| addr.to_string())],
+            )?;
+        Ok(())
+    }
+
+    fn remove_ban(&self, username: &str) -> Result<(), Error> {
+        self.conn
+            .try_lock_for(LOCK_TIMEOUT)
+            .ok_or(Error::LockTimeout)?
+            .execute("DELETE FROM bans WHERE username = ?1", params![username])?;
+        Ok(())
+    }
+}
+
+/// SQLite counts in `i64`; nothing kept here comes near its limit.
+fn to_sql_count(n: usize) -> i64 {
+    i64::try_from(n).unwrap_or(i64::MAX)
+}
+
+#[cfg(test)]
+#[allow(clippy::unwrap_used)]
+mod tests {
+    use std::{fs, net::Ipv4Addr, path::PathBuf};
+
+    use super::*;
+
+    const ADDR: IpAddr = IpAddr::V4(Ipv4Addr::new(10, 0, 0, 7));
+
+    fn temp_db(name: &str) -> PathBuf {
+        let path = std::env::temp_dir().join(format!("chat-store-{}-{name}.db", std::process::id()));
+        remove_db(&path);
+        path
+    }
+
+    fn remove_db(path: &Path) {
+        for suffix in ["", "-wal", "-shm"] {
+            let _ = fs::remove_file(format!("{}{suffix}", path.display()));
+        }
+    }
+
+    #[test]
+    fn test_sqlite_store_history_survives_reopen() {
+        let path = temp_db("history");
+        let general = ChannelName::default_channel();
+        let random = ChannelName::new("#random").unwrap();
+        {
+            let store = SqliteStore::open(&path).unwrap();
+            for line in ["one", "two", "three"] {
+                store.append(&general, line.as_bytes(), 2).unwrap();
+            }
+            store.append(&random, b"elsewhere", 2).unwrap();
+            store.forget(&general).unwrap();
+        }
+
+        let store = SqliteStore::open(&path).unwrap();
+        assert_eq!(
+            store.recent(&general, 10).unwrap(),
+            vec![b"two".to_vec(), b"three".to_vec()]
+        );
+        assert_eq!(store.recent(&general, 1).unwrap(), vec![b"three".to_vec()]);
+        assert_eq!(store.recent(&random, 10).unwrap(), vec![b"elsewhere".to_vec()]);
+        let mut rooms = store.rooms().unwrap();
+        rooms.sort();
+        assert_eq!(rooms, vec![general, random]);
+        remove_db(&path);
+    }
+
+    #[test]
+    fn test_sqlite_store_bans_survive_reopen() {
+        let path = temp_db("bans");
+        {
+            let store = SqliteStore::open(&path).unwrap();
+            store.add_ban("mallory", Some(ADDR)).unwrap();
+            store.add_ban("trent", None).unwrap();
+            store.remove_ban("trent").unwrap();
+        }
+
+        let store = SqliteStore::open(&path).unwrap();
+        assert_eq!(
+            store.bans().unwrap(),
+            HashMap::from([("mallory".to_string(), Some(ADDR))])
+        );
+        remove_db(&path);
+    }
+}
@@ -0,0 +1,136 @@
+//! How often each address may join, so one host can't storm the server with
+//! connections.
+//!
+//! Every address keeps the times of its joins over the last [`WINDOW`]; one
+//! that has used up `CHAT_CONNECT_RATE` of them is turned away until the
+//! oldest falls out. Addresses with nothing left in the window are pruned
+//! once per window, so memory stays bounded by recent traffic.
+
+use std::{
+    collections::{HashMap, VecDeque},
+    net::IpAddr,
+    sync::LazyLock,
+    time::Duration,
+};
+
+use parking_lot::Mutex;
+use tokio::time::Instant;
+
+use crate::config::get_config;
+
+/// The span over which joins from one address are counted.
+pub const WINDOW: Duration = Duration::from_secs(60);
+
+const LOCK_TIMEOUT: Duration = Duration::from_millis(50);
+
+static THROTTLE: LazyLock<ConnectThrottle> = LazyLock::new(|| ConnectThrottle::new(WINDOW));
+
+pub fn get_throttle() -> &'static ConnectThrottle {
+    &THROTTLE
+}
+
+#[derive(Debug)]
+pub struct ConnectThrottle {
+    window: Duration,
+    state: Mutex<Joins>,
+}
+
+#[derive(Debug, Default)]
+struct Joins {
+    by_addr: HashMap<IpAddr, VecDeque<Instant>>,
+    pruned: Option<Instant>,
+}
+
+impl ConnectThrottle {
+    pub fn new(window: Duration) -> Self {
+        Self {
+            window,
+            state: Mutex::new(Joins::default()),
+        }
+    }
+
+    /// Whether `addr` may join now under the configured rate, counting the
+    /// join if so.
+    pub fn admit(&self, addr: IpAddr, now: Instant) -> bool {
+        self.admit_at_most(addr, get_config().connect_rate, now)
+    }
+
+    /// Whether `addr` has joined fewer than `limit` times within the window
+    /// before `now`, counting this join if so; a `limit` of zero lets
+    /// everyone in. Refused joins are not counted, so a host that keeps
+    /// trying is let back in as soon as its earlier joins age out.
+    pub fn admit_at_most(&self, addr: IpAddr, limit: usize, now: Instant) -> bool {
+        if limit == 0 {
+            return true;
+        }
+        // rather let a join through than stall the accept path
+        let Some(mut joins) = self.state.try_lock_for(LOCK_TIMEOUT) else {
+            return true;
+        };
+        let window = self.window;
+        if joins
+            .pruned
+            .is_none_or(|pruned| now.saturating_duration_since(pruned) >= window)
+        {
+            joins
+                .by_addr
+                .retain(|_, times| times.back().is_some_and(|last| is_recent(*last, now, window)));
+            joins.pruned = Some(now);
+        }
+        let times = joins.by_addr.entry(addr).or_default();
+        while times.front().is_some_and(|first| !is_recent(*first, now, window)) {
+            times.pop_front();
+        }
+        let admitted = times.len() < limit;
+        if admitted {
+            times.push_back(now);
+        }
+        drop(joins);
+        admitted
+    }
+}
+
+fn is_recent(at: Instant, now: Instant, window: Duration) -> bool {
+    now.saturating_duration_since(at) < window
+}
+
+#[cfg(test)]
+mod tests {
+    use std::net::Ipv4Addr;
+
+    use super::*;
+
+    const ADDR: IpAddr = IpAddr::V4(Ipv4Addr::LOCALHOST);
+    const OTHER: IpAddr = IpAddr::V4(Ipv4Addr::new(10, 0, 0, 2));
+
+    fn tracked(throttle: &ConnectThrottle) -> usize {
+        throttle.state.lock().by_addr.len()
+    }
+
+    #[test]
+    fn test_throttle_sliding_window() {
+        let throttle = ConnectThrottle::new(WINDOW);
+        let start = Instant::now();
+        assert!(throttle.admit_at_most(ADDR, 2, start));
+        assert!(throttle.admit_at_most(ADDR, 2, start + Duration::from_secs(30)));
+        assert!(!throttle.admit_at_most(ADDR, 2, start + Duration::from_secs(59)));
+        assert!(throttle.admit_at_most(OTHER, 2, start + Duration::from_secs(59)));
+
+        // the first join has aged out, the second not yet
+        assert!(throttle.admit_at_most(ADDR, 2, start + WINDOW));
+        assert!(!throttle.admit_at_most(ADDR, 2, start + WINDOW));
+        assert!(throttle.admit_at_most(ADDR, 0, start + WINDOW));
+    }
+
+    #[test]
+    fn test_throttle_prunes_idle_addresses() {
+        let throttle = ConnectThrottle::new(WINDOW);
+        let start = Instant::now();
+        assert!(throttle.admit_at_most(ADDR, 1, start));
+        assert!(throttle.admit_at_most(OTHER, 1, start + Duration::from_secs(1)));
+        assert_eq!(tracked(&throttle), 2);
+
+        assert!(throttle.admit_at_most(OTHER, 1, start + WINDOW + Duration::from_secs(1)));
+        assert_eq!(tracked(&throttle), 1);
+    }
+}
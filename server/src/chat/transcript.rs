@@ -0,0 +1,195 @@
+//! Durable record of everything said in rooms, for moderation.
+//!
+//! Enabled by `CHAT_LOG_FILE`. The file is opened for appending, so restarts
+//! add to it, and each chat line becomes one line of text:
+//!
+//! ```text
+//! 2024-01-02T15:04:05Z #general <alice> hello
+//! 2024-01-02T15:04:09Z #general * alice waves
+//! 2024-01-02T15:04:12Z #general <alice> edited: hello all
+//! 2024-01-02T15:04:15Z #general <alice> deleted a line
+//! ```
+//!
+//! Control characters in the text are escaped, so a message can never break
+//! the one-line-per-message layout.
+//!
+//! A file that can't be opened leaves the server running without a
+//! transcript, unless `CHAT_LOG_STRICT` says to refuse to start; a write that
+//! fails later loses that line and is logged, and chat carries on.
+
+use std::{
+    fs::{File, OpenOptions},
+    io::{self, Write},
+    path::Path,
+    sync::OnceLock,
+    time::Duration,
+};
+
+use common::{security::sanitize_for_log, tcp_message::ServerMessage};
+use parking_lot::Mutex;
+use thiserror::Error as this_error;
+
+use super::channel::ChannelName;
+
+/// Generous, since writers queue behind each other's disk writes.
+const LOCK_TIMEOUT: Duration = Duration::from_secs(1);
+
+static TRANSCRIPT: OnceLock<Transcript> = OnceLock::new();
+
+/// Opens the transcript at `path`, if given, for [`get_transcript`] to hand out.
+pub fn init(path: Option<&Path>) -> io::Result<()> {
+    if let Some(path) = path {
+        let _ = TRANSCRIPT.set(Transcript::open(path)?);
+    }
+    Ok(())
+}
+
+pub fn get_transcript() -> Option<&'static Transcript> {
+    TRANSCRIPT.get()
+}
+
+#[derive(Debug, this_error)]
+pub enum Error {
+    #[error("transcript write failed: {0}")]
+    Io(#[from] io::Error),
+
+    #[error("transcript lock timeout")]
+    LockTimeout,
+}
+
+#[derive(Debug)]
+pub struct Transcript {
+    file: Mutex<File>,
+}
+
+impl Transcript {
+    pub fn open(path: &Path) -> io::Result<Self> {
+        let file = OpenOptions::new().create(true).append(true).open(path)?;
+        Ok(Self { file: Mutex::new(file) })
+    }
+
+    /// Appends `line` if it is something said in `room`; other messages are
+    /// not part of the transcript.
+    ///
+    /// Each line goes to the OS in a single unbuffered write, so a killed
+    /// server leaves only whole lines behind.
+    pub fn record(&self, room: &ChannelName, line: &ServerMessage) -> Result<(), Error> {
+        let Some(text) = format_line(room, line) else {
+            return Ok(());
+        };
+        let mut file = self.file.try_lock_for(LOCK_TIMEOUT).ok_or(Error::LockTimeout)?;
+        file.write_all(text.as_bytes())?;
+        file.flush()?;
+        drop(file);
+        Ok(())
+    }
+}
+
+fn format_line(room: &ChannelName, line: &ServerMessage) -> Option<String> {
+    match line {
+        ServerMessage::Broadcast {
+            timestamp,
+            username,
+            message,
+            ..
+        } => Some(format!(
+            "{timestamp} {room} <{username}> {}\n",
+            sanitize_for_log(message)
+        )),
+        ServerMessage::Edited {
+            timestamp,
+            username,
+            message,
+            ..
+        } => Some(format!(
+            "{timestamp} {room} <{username}> edited: {}\n",
+            sanitize_for_log(message)
+        )),
+        ServerMessage::Deleted {
+            timestamp, username, ..
+        } => Some(format!("{timestamp} {room} <{username}> deleted a line\n")),
+        ServerMessage::Action {
+            timestamp,
+            username,
+            text,
+        } => Some(format!("{timestamp} {room} * {username} {}\n", sanitize_for_log(text))),
+        _ => None,
+    }
+}
+
+#[cfg(test)]
+#[allow(clippy::unwrap_used)]
+mod tests {
+    use std::fs;
+
+    use super::*;
+
+    fn broadcast(message: &str) -> ServerMessage {
+        ServerMessage::Broadcast {
+            timestamp: "2024-01-02T15:04:05Z".to_string(),
+            id: "1".to_string(),
+            username: "alice".to_string(),
+            message: message.to_string(),
+            reply_to: None,
+        }
+    }
+
+    #[test]
+    fn test_format_line() {
+        let room = ChannelName::default_channel();
+        assert_eq!(
+            format_line(&room, &broadcast("hello | world")).unwrap(),
+            "2024-01-02T15:04:05Z #general <alice> hello | world\n"
+        );
+        let action = ServerMessage::Action {
+            timestamp: "2024-01-02T15:04:09Z".to_string(),
+            username: "alice".to_string(),
+            text: "waves".to_string(),
+        };
+        assert_eq!(
+            format_line(&room, &action).unwrap(),
+            "2024-01-02T15:04:09Z #general * alice waves\n"
+        );
+        let deleted = ServerMessage::Deleted {
+            timestamp: "2024-01-02T15:04:15Z".to_string(),
+            id: "1".to_string(),
+            username: "alice".to_string(),
+        };
+        assert_eq!(
+            format_line(&room, &deleted).unwrap(),
+            "2024-01-02T15:04:15Z #general <alice> deleted a line\n"
+        );
+        assert_eq!(format_line(&room, &ServerMessage::Ping), None);
+    }
+
+    #[test]
+    fn test_format_line_escapes_control_chars() {
+        let room = ChannelName::default_channel();
+        assert_eq!(
+            format_line(&room, &broadcast("forged\r\n2024-01-02T00:00:00Z #general <bob> hi")).unwrap(),
+            "2024-01-02T15:04:05Z #general <alice> forged\\r\\n2024-01-02T00:00:00Z #general <bob> hi\n"
+        );
+    }
+
+    #[test]
+    fn test_record_appends() {
+        let path = std::env::temp_dir().join(format!("chat-transcript-{}", std::process::id()));
+        fs::write(&path, "earlier\n").unwrap();
+        let room = ChannelName::new("#dev").unwrap();
+
+        let transcript = Transcript::open(&path).unwrap();
+        transcript.record(&room, &broadcast("one")).unwrap();
+        transcript.record(&room, &ServerMessage::Ok).unwrap();
+        drop(transcript);
+        Transcript::open(&path)
+            .unwrap()
+            .record(&room, &broadcast("two"))
+            .unwrap();
+
+        assert_eq!(
+            fs::read_to_string(&path).unwrap(),
+            "earlier\n2024-01-02T15:04:05Z #dev <alice> one\n2024-01-02T15:04:05Z #dev <alice> two\n"
+        );
+        fs::remove_file(&path).unwrap();
+    }
+}
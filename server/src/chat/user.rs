@@ -1,22 +1,36 @@
 use std::{
-    collections::{HashMap, hash_map::Entry},
+    collections::{HashMap, HashSet, hash_map::Entry},
     fmt::{Display, Formatter},
-    sync::LazyLock,
+    net::IpAddr,
+    sync::{
+        Arc, LazyLock,
+        atomic::{AtomicBool, Ordering},
+    },
     time::Duration,
 };
 
-use futures::stream::{self, StreamExt};
-use parking_lot::RwLock;
+use common::username::{UsernameError, composed, normalized_username};
+use parking_lot::{Mutex, RwLock};
 use stringzilla::sz;
 use thiserror::Error as this_error;
-use tokio::sync::mpsc::Sender;
+use tokio::sync::mpsc::{Sender, error::TrySendError};
+use tracing::warn;
 
-use super::string::{self as my_string, ValidationResult};
-use crate::chat::room;
+use super::string as my_string;
+use crate::{
+    chat::{
+        channel::{ChannelDirectory, ChannelName, Error as ChannelError},
+        history::{History, sequenced_line},
+        room::{self, Audience},
+        session::Error as SessionError,
+        store::{Store, get_store},
+        whispers::{self, Whispers},
+    },
+    config::get_config,
+};
 
 const SEND_TIMEOUT: Duration = Duration::from_millis(100);
 const LOCK_TIMEOUT: Duration = Duration::from_millis(50);
-const CONCURRENT_LIMIT: usize = 1024;
 
 static REGISTRY: LazyLock<UserRegistry> = LazyLock::new(UserRegistry::new);
 
@@ -26,18 +40,46 @@ pub fn get_registry() -> &'static UserRegistry {
 
 #[derive(Debug, Clone, this_error, PartialEq, Eq)]
 pub enum Error {
-    #[error("username cannot be empty")]
-    UsernameEmpty,
-
-    #[error("username too long (max 32 chars)")]
-    UsernameTooLong,
-
-    #[error("username must be alphanumeric")]
-    UsernameNotAlphanumeric,
+    #[error("invalid username: {0}")]
+    InvalidUsername(#[from] UsernameError),
 
     #[error("username '{0}' is already taken")]
     UsernameTaken(String),
 
+    #[error("username reserved")]
+    UsernameReserved,
+
+    #[error("name taken")]
+    NameTaken,
+
+    /// The name, and the whole seconds until anyone may take it.
+    #[error("username '{0}' was just given up; it is free in {1}s")]
+    NameCoolingDown(String, u64),
+
+    #[error("server full")]
+    ServerFull,
+
+    #[error("authentication failed")]
+    AuthenticationFailed,
+
+    #[error("you are banned")]
+    Banned,
+
+    #[error("too many connections")]
+    TooManyConnections,
+
+    #[error("no such user: {0}")]
+    UserNotFound(String),
+
+    #[error("message to '{0}' could not be delivered")]
+    Undeliverable(String),
+
+    #[error(transparent)]
+    Channel(#[from] ChannelError),
+
+    #[error(transparent)]
+    Session(#[from] SessionError),
+
     #[error("registry lock timeout")]
     LockTimeout,
 }
@@ -48,14 +90,12 @@ pub struct Username(String);
 impl Username {
     pub fn new(s: impl Into<String>) -> Result<Self, Error> {
         let s = s.into();
-        let trimmed = s.trim();
+        Ok(Self(normalized_username(&s)?))
+    }
 
-        match my_string::validate_username(trimmed) {
-            ValidationResult::Valid => Ok(Self(trimmed.to_string())),
-            ValidationResult::Empty => Err(Error::UsernameEmpty),
-            ValidationResult::TooLong => Err(Error::UsernameTooLong),
-            ValidationResult::InvalidChars => Err(Error::UsernameNotAlphanumeric),
-        }
+    /// Compares two usernames the same way the registry does (case-insensitive).
+    pub fn is_same_user(&self, other: &Self) -> bool {
+        NormalizedKey::from_username(self) == NormalizedKey::from_username(other)
     }
 }
 
@@ -68,7 +108,13 @@ impl Display for Username {
 #[derive(Debug, Clone)]
 pub struct User {
     username: Username,
+    addr: IpAddr,
     tx: Sender<room::OneToMany>,
+    /// Set once a message found `tx` full; shared by every copy.
+    overflowed: Arc<AtomicBool>,
+    /// Set by `away`, cleared by the next line sent; a reconnect starts
+    /// afresh.
+    away: Arc<AtomicBool>,
 }
 impl Display for User {
     fn fmt(&self, f: &mut Formatter<'_>) -> std::fmt::Result {
@@ -76,95 +122,576 @@ impl Display for User {
     }
 }
 impl User {
-    const fn new(username: Username, tx: Sender<room::OneToMany>) -> Self {
-        Self { username, tx }
+    fn new(username: Username, addr: IpAddr, tx: Sender<room::OneToMany>) -> Self {
+        Self {
+            username,
+            addr,
+            tx,
+            overflowed: Arc::new(AtomicBool::new(false)),
+            away: Arc::new(AtomicBool::new(false)),
+        }
     }
     pub fn get_username(&self) -> Username {
         self.username.clone()
     }
+
+    /// Queues `message` for this user without waiting; false if their queue
+    /// is full, which marks them [`User::is_too_slow`], or their connection
+    /// gone.
+    pub fn try_deliver(&self, message: room::OneToMany) -> bool {
+        match self.tx.try_send(message) {
+            Ok(()) => true,
+            Err(TrySendError::Full(_)) => {
+                self.overflowed.store(true, Ordering::Relaxed);
+                false
+            }
+            Err(TrySendError::Closed(_)) => false,
+        }
+    }
+
+    /// Whether a message has been dropped because this user's queue was full;
+    /// they have fallen too far behind to catch up.
+    pub fn is_too_slow(&self) -> bool {
+        self.overflowed.load(Ordering::Relaxed)
+    }
+
+    /// Marks this user away or back, returning whether they were away.
+    pub fn set_away(&self, away: bool) -> bool {
+        self.away.swap(away, Ordering::Relaxed)
+    }
+
+    pub fn is_away(&self) -> bool {
+        self.away.load(Ordering::Relaxed)
+    }
 }
 
-#[derive(Debug, Clone, PartialEq, Eq, Hash)]
-struct NormalizedKey(String);
+#[derive(Debug, Clone, PartialEq, Eq, PartialOrd, Ord, Hash)]
+pub struct NormalizedKey(String);
 
 impl NormalizedKey {
     fn from_username(username: &Username) -> Self {
-        Self(my_string::to_lowercase(&username.0))
+        Self::from_name(&username.0)
+    }
+
+    fn from_name(name: &str) -> Self {
+        Self(my_string::to_lowercase(&composed(name)))
     }
 }
 
+// Lock order is always `users`, then `channels`, then `history`, then
+// `whispers`, then `files_shared`.
+//
+// History is only touched while `channels` is held, so recording a line and
+// replaying to a newcomer can never interleave. Whispers are only touched
+// while `users` is held, so a conversation is never kept for someone who has
+// already gone.
 #[derive(Debug)]
 pub struct UserRegistry {
     users: RwLock<HashMap<NormalizedKey, User, sz::BuildSzHasher>>,
+    channels: RwLock<ChannelDirectory<NormalizedKey>>,
+    history: Mutex<History>,
+    whispers: Mutex<Whispers<NormalizedKey>>,
+    // bytes of files shared under each name, kept after they leave so that
+    // coming back doesn't restore their `CHAT_FILE_QUOTA`
+    files_shared: Mutex<HashMap<NormalizedKey, usize>>,
+    max_users: usize,
+    // never held together with the locks above
+    reserved: RwLock<HashSet<NormalizedKey>>,
 }
 
 impl UserRegistry {
     pub fn new() -> Self {
+        Self::with_history_size(get_config().history_size)
+            .with_history_store(get_store())
+            .with_room_history_sizes(&get_config().room_history_sizes)
+            .with_max_users(get_config().max_clients)
+            .with_reserved_names(&get_config().reserved_names)
+    }
+
+    pub fn with_history_size(history_size: usize) -> Self {
         Self {
             users: RwLock::new(HashMap::with_hasher(sz::BuildSzHasher::default())),
+            channels: RwLock::new(ChannelDirectory::new()),
+            history: Mutex::new(History::new(history_size)),
+            whispers: Mutex::new(Whispers::new(whispers::PAIR_CAPACITY)),
+            files_shared: Mutex::new(HashMap::new()),
+            max_users: 0,
+            reserved: RwLock::new(HashSet::new()),
+        }
+    }
+
+    /// Keeps history in `store` too; see [`History::with_store`].
+    pub fn with_history_store(self, store: Arc<dyn Store>) -> Self {
+        let history = self.history.into_inner().with_store(store);
+        Self {
+            history: Mutex::new(history),
+            ..self
+        }
+    }
+
+    /// Keeps a different amount of history for the rooms listed.
+    pub fn with_room_history_sizes(self, sizes: &[(ChannelName, usize)]) -> Self {
+        let history = self.history.into_inner().with_room_capacities(sizes);
+        Self {
+            history: Mutex::new(history),
+            ..self
+        }
+    }
+
+    /// Caps how many users may be registered at once; zero removes the cap.
+    pub const fn with_max_users(mut self, max_users: usize) -> Self {
+        self.max_users = max_users;
+        self
+    }
+
+    /// Names nobody may register or rename to, compared the way usernames are.
+    pub fn with_reserved_names(self, names: &[String]) -> Self {
+        self.set_reserved_names(names);
+        self
+    }
+
+    /// Replaces the reserved names; anyone already using one keeps it.
+    pub fn set_reserved_names(&self, names: &[String]) {
+        *self.reserved.write() = names.iter().map(|name| NormalizedKey::from_name(name)).collect();
+    }
+
+    fn is_reserved(&self, key: &NormalizedKey) -> bool {
+        self.reserved.read().contains(key)
+    }
+
+    /// Registers a user, places them in the default channel and queues that
+    /// channel's history for them ahead of any live message.
+    ///
+    /// The name is checked and taken under one write lock, so of any number
+    /// of joins racing for it exactly one wins; the rest get
+    /// [`Error::UsernameTaken`].
+    pub fn register(&self, username: &Username, addr: IpAddr, tx: Sender<room::OneToMany>) -> Result<User, Error> {
+        let key = NormalizedKey::from_username(username);
+        if self.is_reserved(&key) {
+            return Err(Error::UsernameReserved);
+        }
+        let mut users = self.users.try_write_for(LOCK_TIMEOUT).ok_or(Error::LockTimeout)?;
+        let mut channels = self.channels.try_write_for(LOCK_TIMEOUT).ok_or(Error::LockTimeout)?;
+        let history = self.history.try_lock_for(LOCK_TIMEOUT).ok_or(Error::LockTimeout)?;
+        let full = self.max_users > 0 && users.len() >= self.max_users;
+        let registered_user = match users.entry(key.clone()) {
+            Entry::Occupied(_) => return Err(Error::UsernameTaken(username.to_string())),
+            Entry::Vacant(_) if full => return Err(Error::ServerFull),
+            Entry::Vacant(e) => e.insert(User::new(username.clone(), addr, tx)).clone(),
+        };
+        drop(users);
+        let channel = ChannelName::default_channel();
+        channels.enter(&key, channel.clone())?;
+        replay_history(&history, &channel, &registered_user);
+        drop(history);
+        drop(channels);
+        Ok(registered_user)
+    }
+
+    /// Removes `user`, unless their name has since been taken over by
+    /// another connection with [`UserRegistry::reattach`].
+    pub fn unregister(&self, user: &User) -> Result<bool, Error> {
+        let key = NormalizedKey::from_username(&user.get_username());
+        let mut users = self.users.try_write_for(LOCK_TIMEOUT).ok_or(Error::LockTimeout)?;
+        let mut channels = self.channels.try_write_for(LOCK_TIMEOUT).ok_or(Error::LockTimeout)?;
+        let mut history = self.history.try_lock_for(LOCK_TIMEOUT).ok_or(Error::LockTimeout)?;
+        let mut whispers = self.whispers.try_lock_for(LOCK_TIMEOUT).ok_or(Error::LockTimeout)?;
+        let removed = match users.entry(key.clone()) {
+            Entry::Occupied(e) if e.get().tx.same_channel(&user.tx) => {
+                e.remove();
+                true
+            }
+            _ => false,
+        };
+        drop(users);
+        if removed {
+            whispers.forget(&key);
+        }
+        drop(whispers);
+        if removed && let Some(left) = channels.remove(&key) {
+            forget_if_empty(&channels, &mut history, &left);
         }
+        drop(history);
+        drop(channels);
+        Ok(removed)
     }
 
-    pub fn register(&self, username: &Username, tx: Sender<room::OneToMany>) -> Result<User, Error> {
-        match self
+    /// Hands a registered user over to a new connection, keeping their name
+    /// and channel, and queues the channel's history for them.
+    ///
+    /// Returns the user as now registered and as they were before, whose
+    /// sender still reaches the previous connection if it is alive.
+    pub fn reattach(
+        &self,
+        username: &Username,
+        addr: IpAddr,
+        tx: Sender<room::OneToMany>,
+    ) -> Result<(User, User), Error> {
+        let key = NormalizedKey::from_username(username);
+        let mut users = self.users.try_write_for(LOCK_TIMEOUT).ok_or(Error::LockTimeout)?;
+        let channels = self.channels.try_read_for(LOCK_TIMEOUT).ok_or(Error::LockTimeout)?;
+        let history = self.history.try_lock_for(LOCK_TIMEOUT).ok_or(Error::LockTimeout)?;
+        let user = users
+            .get_mut(&key)
+            .ok_or_else(|| Error::UserNotFound(username.to_string()))?;
+        let previous = std::mem::replace(user, User::new(user.username.clone(), addr, tx));
+        let reattached = user.clone();
+        drop(users);
+        if let Some(channel) = channels.channel_of(&key) {
+            replay_history(&history, channel, &reattached);
+        }
+        drop(history);
+        drop(channels);
+        Ok((reattached, previous))
+    }
+
+    /// Renames `user` to `username`, keeping their channel, sender and
+    /// address, and returns the renamed user.
+    ///
+    /// Changing only the case of a name is allowed; taking someone else's is not.
+    pub fn rename(&self, user: &User, username: &Username) -> Result<User, Error> {
+        let old_key = NormalizedKey::from_username(&user.username);
+        let new_key = NormalizedKey::from_username(username);
+        if self.is_reserved(&new_key) {
+            return Err(Error::UsernameReserved);
+        }
+        let mut users = self.users.try_write_for(LOCK_TIMEOUT).ok_or(Error::LockTimeout)?;
+        let mut channels = self.channels.try_write_for(LOCK_TIMEOUT).ok_or(Error::LockTimeout)?;
+        let mut whispers = self.whispers.try_lock_for(LOCK_TIMEOUT).ok_or(Error::LockTimeout)?;
+        if new_key != old_key && users.contains_key(&new_key) {
+            return Err(Error::NameTaken);
+        }
+        let mut renamed = users
+            .remove(&old_key)
+            .ok_or_else(|| Error::UserNotFound(user.username.to_string()))?;
+        renamed.username = username.clone();
+        users.insert(new_key.clone(), renamed.clone());
+        drop(users);
+        whispers.rename(&old_key, &new_key);
+        drop(whispers);
+        // the quota goes with the user, or a rename would renew it
+        if new_key != old_key {
+            let mut files_shared = self.files_shared.try_lock_for(LOCK_TIMEOUT).ok_or(Error::LockTimeout)?;
+            if let Some(bytes) = files_shared.remove(&old_key) {
+                let total = files_shared.entry(new_key.clone()).or_default();
+                *total = total.saturating_add(bytes);
+            }
+        }
+        channels.rename(&old_key, new_key);
+        drop(channels);
+        Ok(renamed)
+    }
+
+    /// Moves a user into `channel`, returning the channel they left.
+    ///
+    /// The new channel's history is queued for them before anything said
+    /// there afterwards.
+    pub fn move_to_channel(&self, username: &Username, channel: &ChannelName) -> Result<ChannelName, Error> {
+        let key = NormalizedKey::from_username(username);
+        let users = self.users.try_read_for(LOCK_TIMEOUT).ok_or(Error::LockTimeout)?;
+        let user = users
+            .get(&key)
+            .cloned()
+            .ok_or_else(|| Error::UserNotFound(username.to_string()))?;
+        let mut channels = self.channels.try_write_for(LOCK_TIMEOUT).ok_or(Error::LockTimeout)?;
+        drop(users);
+        let mut history = self.history.try_lock_for(LOCK_TIMEOUT).ok_or(Error::LockTimeout)?;
+        let previous = channels
+            .enter(&key, channel.clone())?
+            .unwrap_or_else(ChannelName::default_channel);
+        forget_if_empty(&channels, &mut history, &previous);
+        replay_history(&history, channel, &user);
+        drop(history);
+        drop(channels);
+        Ok(previous)
+    }
+
+    /// The address `username` connected from.
+    pub fn addr_of(&self, username: &Username) -> Result<IpAddr, Error> {
+        self.users
+            .try_read_for(LOCK_TIMEOUT)
+            .ok_or(Error::LockTimeout)?
+            .get(&NormalizedKey::from_username(username))
+            .map(|user| user.addr)
+            .ok_or_else(|| Error::UserNotFound(username.to_string()))
+    }
+
+    pub fn channel_of(&self, username: &Username) -> Result<ChannelName, Error> {
+        self.channels
+            .try_read_for(LOCK_TIMEOUT)
+            .ok_or(Error::LockTimeout)?
+            .channel_of(&NormalizedKey::from_username(username))
+            .cloned()
+            .ok_or_else(|| Error::UserNotFound(username.to_string()))
+    }
+
+    /// How many users are registered right now.
+    pub fn user_count(&self) -> Result<usize, Error> {
+        Ok(self.users.try_read_for(LOCK_TIMEOUT).ok_or(Error::LockTimeout)?.len())
+    }
+
+    /// Everyone currently online, sorted case-insensitively.
+    pub fn usernames(&self) -> Result<Vec<Username>, Error> {
+        Ok(self.online()?.into_iter().map(|user| user.username).collect())
+    }
+
+    /// Everyone currently online, as [`UserRegistry::usernames`] sorts them.
+    pub fn online(&self) -> Result<Vec<User>, Error> {
+        let mut online: Vec<(NormalizedKey, User)> = self
             .users
-            .try_write_for(LOCK_TIMEOUT)
+            .try_read_for(LOCK_TIMEOUT)
+            .ok_or(Error::LockTimeout)?
+            .iter()
+            .map(|(key, user)| (key.clone(), user.clone()))
+            .collect();
+        online.sort_by(|a, b| a.0.0.cmp(&b.0.0));
+        Ok(online.into_iter().map(|(_, user)| user).collect())
+    }
+
+    /// Those online in `channel`, sorted like [`UserRegistry::online`].
+    pub fn online_in(&self, channel: &ChannelName) -> Result<Vec<User>, Error> {
+        let users = self.users.try_read_for(LOCK_TIMEOUT).ok_or(Error::LockTimeout)?;
+        let channels = self.channels.try_read_for(LOCK_TIMEOUT).ok_or(Error::LockTimeout)?;
+        let members = sorted_members(&users, &channels, channel);
+        drop(channels);
+        drop(users);
+        Ok(members)
+    }
+
+    /// Everyone online, grouped by the channel they are in; channels are
+    /// sorted by name, and their members like [`UserRegistry::online`].
+    pub fn online_by_channel(&self) -> Result<Vec<(ChannelName, Vec<User>)>, Error> {
+        let users = self.users.try_read_for(LOCK_TIMEOUT).ok_or(Error::LockTimeout)?;
+        let channels = self.channels.try_read_for(LOCK_TIMEOUT).ok_or(Error::LockTimeout)?;
+        let grouped = channels
+            .counts()
+            .into_iter()
+            .map(|(channel, _)| {
+                let members = sorted_members(&users, &channels, &channel);
+                (channel, members)
+            })
+            .collect();
+        drop(channels);
+        drop(users);
+        Ok(grouped)
+    }
+
+    /// Non-empty channels with member counts, sorted by name.
+    pub fn channel_counts(&self) -> Result<Vec<(ChannelName, usize)>, Error> {
+        Ok(self
+            .channels
+            .try_read_for(LOCK_TIMEOUT)
             .ok_or(Error::LockTimeout)?
-            .entry(NormalizedKey::from_username(username))
-        {
-            Entry::Occupied(_) => Err(Error::UsernameTaken(username.to_string())),
-            Entry::Vacant(e) => {
-                let registered_user = e.insert(User::new(username.clone(), tx));
-                Ok(registered_user.clone())
+            .counts())
+    }
+
+    /// Queues `message` for its audience, bar `exclude`, and returns how
+    /// many it reached. Never waits: a user whose queue is full misses it,
+    /// see [`User::try_deliver`], so one slow client can't hold up the rest.
+    /// The excluded user gets the message's own copy instead, if it has one.
+    ///
+    /// A line kept in a room's history is numbered first, under the history
+    /// lock, so everyone in the room sees the same number for it.
+    ///
+    /// Queueing never blocks, so it happens under the read lock rather than
+    /// on copies of every recipient; in a room of a thousand those copies
+    /// cost more than the queueing itself.
+    pub fn broadcast(&self, message: &room::OneToMany, exclude: Option<&Username>) -> Result<usize, Error> {
+        let guard = self.users.try_read_for(LOCK_TIMEOUT).ok_or(Error::LockTimeout)?;
+        let channels = self.channels.try_read_for(LOCK_TIMEOUT).ok_or(Error::LockTimeout)?;
+        let numbered = match message.audience() {
+            Audience::Channel(channel) if message.is_recorded() => {
+                let mut history = self.history.try_lock_for(LOCK_TIMEOUT).ok_or(Error::LockTimeout)?;
+                let seq = history.next_seq(channel);
+                let numbered = message.rewritten(|line| sequenced_line(seq, line));
+                history.record(channel, &numbered);
+                drop(history);
+                Some(numbered)
+            }
+            _ => None,
+        };
+        let message = numbered.as_ref().unwrap_or(message);
+        let own_copy = message.own_copy();
+        let deliver = |user: &User| {
+            if exclude == Some(&user.username) {
+                if let Some(own_copy) = &own_copy
+                    && !user.try_deliver(own_copy.clone())
+                {
+                    warn!("Own copy of a line not delivered to '{user}'");
+                }
+                return false;
+            }
+            let delivered = user.try_deliver(message.clone());
+            if !delivered && user.is_too_slow() {
+                warn!("'{user}' missed a message, outbound queue full");
             }
+            delivered
+        };
+        let sent = match message.audience() {
+            Audience::Everyone => guard.values().filter(|user| deliver(user)).count(),
+            Audience::Channel(channel) => channels
+                .members(channel)
+                .filter_map(|key| guard.get(key))
+                .filter(|user| deliver(user))
+                .count(),
+        };
+        drop(channels);
+        drop(guard);
+        Ok(sent)
+    }
+
+    /// Keeps a delivered private message for [`UserRegistry::direct_history`],
+    /// as long as both sides are still registered.
+    pub fn record_direct(&self, from: &Username, to: &Username, encoded_msg: Vec<u8>) -> Result<(), Error> {
+        let from = NormalizedKey::from_username(from);
+        let to = NormalizedKey::from_username(to);
+        let users = self.users.try_read_for(LOCK_TIMEOUT).ok_or(Error::LockTimeout)?;
+        if users.contains_key(&from) && users.contains_key(&to) {
+            self.whispers
+                .try_lock_for(LOCK_TIMEOUT)
+                .ok_or(Error::LockTimeout)?
+                .record(&from, &to, encoded_msg);
         }
+        drop(users);
+        Ok(())
     }
 
-    pub fn unregister(&self, user: &User) -> Result<bool, Error> {
+    /// Bytes of files `username` has shared since the server started, over
+    /// every connection they joined on.
+    pub fn files_shared(&self, username: &Username) -> Result<usize, Error> {
+        let files_shared = self.files_shared.try_lock_for(LOCK_TIMEOUT).ok_or(Error::LockTimeout)?;
+        Ok(files_shared
+            .get(&NormalizedKey::from_username(username))
+            .copied()
+            .unwrap_or_default())
+    }
+
+    /// Counts a file of `size` bytes `username` shared against their quota.
+    pub fn count_file(&self, username: &Username, size: usize) -> Result<(), Error> {
+        let mut files_shared = self.files_shared.try_lock_for(LOCK_TIMEOUT).ok_or(Error::LockTimeout)?;
+        let total = files_shared.entry(NormalizedKey::from_username(username)).or_default();
+        *total = total.saturating_add(size);
+        drop(files_shared);
+        Ok(())
+    }
+
+    /// Replay copies of the recent private messages between `a` and `b`,
+    /// oldest first.
+    pub fn direct_history(&self, a: &Username, b: &Username) -> Result<Vec<room::OneToMany>, Error> {
         Ok(self
-            .users
-            .try_write_for(LOCK_TIMEOUT)
+            .whispers
+            .try_lock_for(LOCK_TIMEOUT)
+            .ok_or(Error::LockTimeout)?
+            .replay(&NormalizedKey::from_username(a), &NormalizedKey::from_username(b)))
+    }
+
+    /// Queues `username`'s room's history for them again, only the lines
+    /// numbered after `after` if given; see [`History::replay_since`]. Like
+    /// the replay on joining, it goes through their queue, so it lands in
+    /// order with what the room says meanwhile. Returns how many lines it
+    /// had to queue.
+    pub fn resync(&self, username: &Username, after: Option<u64>) -> Result<usize, Error> {
+        let key = NormalizedKey::from_username(username);
+        let users = self.users.try_read_for(LOCK_TIMEOUT).ok_or(Error::LockTimeout)?;
+        let channels = self.channels.try_read_for(LOCK_TIMEOUT).ok_or(Error::LockTimeout)?;
+        let (Some(user), Some(channel)) = (users.get(&key), channels.channel_of(&key)) else {
+            return Err(Error::UserNotFound(username.to_string()));
+        };
+        let history = self.history.try_lock_for(LOCK_TIMEOUT).ok_or(Error::LockTimeout)?;
+        let lines = history.replay_since(channel, after);
+        drop(history);
+        let count = lines.len();
+        queue_replay(lines, user);
+        drop(channels);
+        drop(users);
+        Ok(count)
+    }
+
+    /// Waits up to `timeout` for the history store to have every line kept
+    /// so far, as at shutdown; false if it didn't in time.
+    pub fn flush_history(&self, timeout: Duration) -> Result<bool, Error> {
+        let writer = self
+            .history
+            .try_lock_for(LOCK_TIMEOUT)
             .ok_or(Error::LockTimeout)?
-            .remove(&NormalizedKey::from_username(&user.get_username()))
-            .is_some())
+            .writer();
+        Ok(writer.is_none_or(|writer| writer.flush(timeout)))
     }
 
-    pub async fn broadcast(&self, message: &room::OneToMany, exclude: Option<&Username>) -> Result<usize, Error> {
-        let senders: Vec<_> = {
+    /// Whether `channel` still has the line `id` in its history, to be
+    /// replied to.
+    pub fn has_line(&self, channel: &ChannelName, id: &str) -> Result<bool, Error> {
+        Ok(self
+            .history
+            .try_lock_for(LOCK_TIMEOUT)
+            .ok_or(Error::LockTimeout)?
+            .has_line(channel, id))
+    }
+
+    /// Delivers `message` to a single user, bypassing the room.
+    pub async fn send_to(&self, username: &Username, message: room::OneToMany) -> Result<(), Error> {
+        let tx = {
             let guard = self.users.try_read_for(LOCK_TIMEOUT).ok_or(Error::LockTimeout)?;
             guard
-                .values()
-                .filter(|user| exclude != Some(&user.username))
+                .get(&NormalizedKey::from_username(username))
                 .map(|user| user.tx.clone())
-                .collect()
+                .ok_or_else(|| Error::UserNotFound(username.to_string()))?
         };
 
-        // Stream with bounded concurrency - max CONCURRENT_LIMIT in-flight
-        let sent_count = stream::iter(senders)
-            .map(|tx| {
-                let msg = message.clone();
-                async move {
-                    tokio::time::timeout(SEND_TIMEOUT, tx.send(msg))
-                        .await
-                        .is_ok_and(|r| r.is_ok())
-                }
-            })
-            .buffer_unordered(CONCURRENT_LIMIT)
-            .filter(|&success| async move { success })
-            .count()
-            .await;
+        match tokio::time::timeout(SEND_TIMEOUT, tx.send(message)).await {
+            Ok(Ok(())) => Ok(()),
+            _ => Err(Error::Undeliverable(username.to_string())),
+        }
+    }
+}
+
+/// The users in `channel`, sorted by their lowercased names.
+fn sorted_members(
+    users: &HashMap<NormalizedKey, User, sz::BuildSzHasher>,
+    channels: &ChannelDirectory<NormalizedKey>,
+    channel: &ChannelName,
+) -> Vec<User> {
+    let mut members: Vec<(&NormalizedKey, &User)> = channels
+        .members(channel)
+        .filter_map(|key| users.get_key_value(key))
+        .collect();
+    members.sort_by(|a, b| a.0.0.cmp(&b.0.0));
+    members.into_iter().map(|(_, user)| user.clone()).collect()
+}
+
+/// Queues `channel`'s history on `user`'s outbound channel.
+///
+/// Never waits: a queue too full to take the whole replay just gets less of it.
+fn replay_history(history: &History, channel: &ChannelName, user: &User) {
+    queue_replay(history.replay(channel), user);
+}
+
+fn queue_replay(lines: Vec<room::OneToMany>, user: &User) {
+    for line in lines {
+        if user.tx.try_send(line).is_err() {
+            warn!("History replay to '{user}' cut short, outbound queue full");
+            break;
+        }
+    }
+}
 
-        Ok(sent_count)
+fn forget_if_empty(channels: &ChannelDirectory<NormalizedKey>, history: &mut History, channel: &ChannelName) {
+    if channels.members(channel).next().is_none() {
+        history.forget(channel);
     }
 }
 
 #[cfg(test)]
 #[allow(clippy::unwrap_used)]
 mod tests {
+    use std::{net::Ipv4Addr, sync::Barrier, thread};
+
     use tokio::sync::mpsc;
 
     use super::*;
 
+    const ADDR: IpAddr = IpAddr::V4(Ipv4Addr::LOCALHOST);
+
     #[test]
     fn test_username_valid() {
         assert!(Username::new("alice").is_ok());
@@ -180,20 +707,39 @@ mod tests {
 
     #[test]
     fn test_username_empty() {
-        assert_eq!(Username::new("").unwrap_err(), Error::UsernameEmpty);
-        assert_eq!(Username::new("   ").unwrap_err(), Error::UsernameEmpty);
+        assert_eq!(
+            Username::new("").unwrap_err(),
+            Error::InvalidUsername(UsernameError::Empty)
+        );
+        assert_eq!(
+            Username::new("   ").unwrap_err(),
+            Error::InvalidUsername(UsernameError::Empty)
+        );
     }
 
     #[test]
     fn test_username_too_long() {
         let long_name = "a".repeat(33);
-        assert_eq!(Username::new(&long_name).unwrap_err(), Error::UsernameTooLong);
+        assert_eq!(
+            Username::new(&long_name).unwrap_err(),
+            Error::InvalidUsername(UsernameError::TooLong)
+        );
     }
 
     #[test]
     fn test_username_invalid_chars() {
-        assert_eq!(Username::new("user@name").unwrap_err(), Error::UsernameNotAlphanumeric);
-        assert_eq!(Username::new("hello!").unwrap_err(), Error::UsernameNotAlphanumeric);
+        assert_eq!(
+            Username::new("user@name").unwrap_err(),
+            Error::InvalidUsername(UsernameError::InvalidChar('@'))
+        );
+        assert_eq!(
+            Username::new("hello!").unwrap_err(),
+            Error::InvalidUsername(UsernameError::InvalidChar('!'))
+        );
+        assert_eq!(
+            Username::new("al ice").unwrap_err().to_string(),
+            "invalid username: contains whitespace"
+        );
     }
 
     #[test]
@@ -208,7 +754,7 @@ mod tests {
         let (tx, _rx) = mpsc::channel(256);
         let username = Username::new("alice").unwrap();
 
-        let result = registry.register(&username, tx);
+        let result = registry.register(&username, ADDR, tx);
         assert!(result.is_ok());
         assert_eq!(result.unwrap().get_username(), username);
     }
@@ -220,8 +766,8 @@ mod tests {
         let (tx2, _rx2) = mpsc::channel(256);
         let username = Username::new("bob").unwrap();
 
-        assert!(registry.register(&username, tx1).is_ok());
-        let err = registry.register(&username, tx2).unwrap_err();
+        assert!(registry.register(&username, ADDR, tx1).is_ok());
+        let err = registry.register(&username, ADDR, tx2).unwrap_err();
         assert_eq!(err, Error::UsernameTaken("bob".to_string()));
     }
 
@@ -231,12 +777,31 @@ mod tests {
         let (tx1, _rx1) = mpsc::channel(256);
         let (tx2, _rx2) = mpsc::channel(256);
 
-        let alice_lower = Username::new("alice").unwrap();
+        let alice_mixed = Username::new("Alice").unwrap();
         let alice_upper = Username::new("ALICE").unwrap();
 
-        assert!(registry.register(&alice_lower, tx1).is_ok());
-        let err = registry.register(&alice_upper, tx2).unwrap_err();
+        assert!(registry.register(&alice_mixed, ADDR, tx1).is_ok());
+        let err = registry.register(&alice_upper, ADDR, tx2).unwrap_err();
         assert_eq!(err, Error::UsernameTaken("ALICE".to_string()));
+        // the first comer's casing is what everyone sees
+        assert_eq!(registry.usernames().unwrap(), vec![alice_mixed]);
+    }
+
+    #[test]
+    fn test_registry_composed_duplicate() {
+        let registry = UserRegistry::new();
+        let (tx1, _rx1) = mpsc::channel(256);
+        let (tx2, _rx2) = mpsc::channel(256);
+
+        // the same name whether the accent is its own character or not
+        let precomposed = Username::new("Ren\u{e9}e").unwrap();
+        let combining = Username::new("RENE\u{301}E").unwrap();
+        assert_eq!(combining.to_string(), "REN\u{c9}E");
+        assert!(precomposed.is_same_user(&combining));
+
+        assert!(registry.register(&precomposed, ADDR, tx1).is_ok());
+        let err = registry.register(&combining, ADDR, tx2).unwrap_err();
+        assert_eq!(err, Error::UsernameTaken("REN\u{c9}E".to_string()));
     }
 
     #[test]
@@ -245,12 +810,67 @@ mod tests {
         let (tx, _rx) = mpsc::channel(256);
         let username = Username::new("charlie").unwrap();
 
-        let user = registry.register(&username, tx).unwrap();
+        let user = registry.register(&username, ADDR, tx).unwrap();
+        assert_eq!(registry.user_count().unwrap(), 1);
         assert!(registry.unregister(&user).unwrap());
+        assert_eq!(registry.user_count().unwrap(), 0);
 
         assert!(!registry.unregister(&user).unwrap());
     }
 
+    #[test]
+    fn test_direct_history_is_dropped_with_either_side() {
+        let registry = UserRegistry::new();
+        let (tx1, _rx1) = mpsc::channel(256);
+        let (tx2, _rx2) = mpsc::channel(256);
+        let (tx3, _rx3) = mpsc::channel(256);
+        let alice = Username::new("alice").unwrap();
+        let bob = Username::new("Bob").unwrap();
+
+        registry.register(&alice, ADDR, tx1).unwrap();
+        let user = registry.register(&bob, ADDR, tx2).unwrap();
+        registry
+            .record_direct(&alice, &bob, b"DM|alice|Bob|hi".to_vec())
+            .unwrap();
+        let bob_lower = Username::new("bob").unwrap();
+        assert_eq!(registry.direct_history(&bob_lower, &alice).unwrap().len(), 1);
+
+        // whoever takes the name next starts with nothing
+        registry.unregister(&user).unwrap();
+        registry.register(&bob, ADDR, tx3).unwrap();
+        assert!(registry.direct_history(&alice, &bob).unwrap().is_empty());
+    }
+
+    #[test]
+    fn test_registry_racing_joins_register_once() {
+        const RACERS: usize = 50;
+        let registry = UserRegistry::with_history_size(10);
+        let username = Username::new("racer").unwrap();
+        let start = Barrier::new(RACERS);
+        let results: Vec<Result<User, Error>> = thread::scope(|scope| {
+            let racers: Vec<_> = (0..RACERS)
+                .map(|_| {
+                    scope.spawn(|| {
+                        let (tx, _rx) = mpsc::channel(256);
+                        start.wait();
+                        registry.register(&username, ADDR, tx)
+                    })
+                })
+                .collect();
+            racers.into_iter().map(|racer| racer.join().unwrap()).collect()
+        });
+
+        assert_eq!(results.iter().filter(|result| result.is_ok()).count(), 1);
+        let taken = Error::UsernameTaken("racer".to_string());
+        assert!(
+            results
+                .iter()
+                .filter_map(|result| result.as_ref().err())
+                .all(|e| *e == taken)
+        );
+        assert_eq!(registry.user_count().unwrap(), 1);
+    }
+
     #[test]
     fn test_registry_reregister_after_unregister() {
         let registry = UserRegistry::new();
@@ -258,17 +878,399 @@ mod tests {
         let (tx2, _rx2) = mpsc::channel(256);
         let username = Username::new("dave").unwrap();
 
-        let user = registry.register(&username, tx1).unwrap();
+        let user = registry.register(&username, ADDR, tx1).unwrap();
         assert!(registry.unregister(&user).unwrap());
 
-        assert!(registry.register(&username, tx2).is_ok());
+        assert!(registry.register(&username, ADDR, tx2).is_ok());
+    }
+
+    #[tokio::test]
+    async fn test_registry_reattach() {
+        let registry = UserRegistry::with_history_size(10);
+        let (tx_old, _rx_old) = mpsc::channel(256);
+        let alice = Username::new("alice").unwrap();
+        let old = registry.register(&alice, ADDR, tx_old).unwrap();
+        let random = ChannelName::new("#random").unwrap();
+        registry.move_to_channel(&alice, &random).unwrap();
+        let msg = room::OneToMany::from(room::OneToOne::to_channel(b"hi".to_vec(), random.clone()).recorded());
+        registry.broadcast(&msg, None).unwrap();
+
+        let (tx_new, mut rx_new) = mpsc::channel(256);
+        let other = IpAddr::V4(Ipv4Addr::new(10, 0, 0, 2));
+        let (new, previous) = registry
+            .reattach(&Username::new("ALICE").unwrap(), other, tx_new)
+            .unwrap();
+        assert_eq!(new.get_username(), alice);
+        assert!(previous.tx.same_channel(&old.tx));
+        assert_eq!(registry.addr_of(&alice), Ok(other));
+        assert_eq!(registry.channel_of(&alice), Ok(random));
+        assert_eq!(&*rx_new.try_recv().unwrap(), b"HISTORY|SEQ|1|hi");
+
+        // the old connection letting go doesn't take the new one with it
+        assert!(!registry.unregister(&old).unwrap());
+        assert_eq!(registry.user_count().unwrap(), 1);
+        assert!(registry.unregister(&new).unwrap());
+
+        let (tx, _rx) = mpsc::channel(256);
+        assert_eq!(
+            registry.reattach(&alice, ADDR, tx).unwrap_err(),
+            Error::UserNotFound("alice".to_string())
+        );
+    }
+
+    #[test]
+    fn test_registry_online_by_channel() {
+        let registry = UserRegistry::new();
+        let (tx, _rx) = mpsc::channel(256);
+        for name in ["carol", "Alice", "bob"] {
+            registry
+                .register(&Username::new(name).unwrap(), ADDR, tx.clone())
+                .unwrap();
+        }
+        let dev = ChannelName::new("#dev").unwrap();
+        registry.move_to_channel(&Username::new("bob").unwrap(), &dev).unwrap();
+
+        let names = |users: Vec<User>| users.iter().map(ToString::to_string).collect::<Vec<_>>();
+        let general = ChannelName::default_channel();
+        assert_eq!(names(registry.online_in(&general).unwrap()), ["Alice", "carol"]);
+        assert!(
+            registry
+                .online_in(&ChannelName::new("#empty").unwrap())
+                .unwrap()
+                .is_empty()
+        );
+        let grouped: Vec<_> = registry
+            .online_by_channel()
+            .unwrap()
+            .into_iter()
+            .map(|(channel, users)| (channel.to_string(), names(users)))
+            .collect();
+        assert_eq!(
+            grouped,
+            [
+                ("#dev".to_string(), vec!["bob".to_string()]),
+                ("#general".to_string(), vec!["Alice".to_string(), "carol".to_string()]),
+            ]
+        );
+    }
+
+    #[test]
+    fn test_registry_addr_of() {
+        let registry = UserRegistry::new();
+        let (tx, _rx) = mpsc::channel(256);
+        let alice = Username::new("alice").unwrap();
+        registry.register(&alice, ADDR, tx).unwrap();
+
+        assert_eq!(registry.addr_of(&Username::new("ALICE").unwrap()), Ok(ADDR));
+        assert!(registry.addr_of(&Username::new("bob").unwrap()).is_err());
+    }
+
+    #[test]
+    fn test_registry_rename() {
+        let registry = UserRegistry::new();
+        let (tx, _rx) = mpsc::channel(256);
+        let alice = registry
+            .register(&Username::new("alice").unwrap(), ADDR, tx.clone())
+            .unwrap();
+        registry.register(&Username::new("bob").unwrap(), ADDR, tx).unwrap();
+        let room = ChannelName::new("#den").unwrap();
+        registry.move_to_channel(&alice.get_username(), &room).unwrap();
+
+        let bob = Username::new("BOB").unwrap();
+        assert_eq!(registry.rename(&alice, &bob).unwrap_err(), Error::NameTaken);
+
+        // going away survives a change of name
+        assert!(!alice.set_away(true));
+        let alice2 = Username::new("alice2").unwrap();
+        let renamed = registry.rename(&alice, &alice2).unwrap();
+        assert_eq!(renamed.get_username(), alice2);
+        assert!(renamed.is_away());
+        assert!(registry.online().unwrap().iter().any(User::is_away));
+        assert_eq!(registry.channel_of(&alice2), Ok(room));
+        assert!(registry.channel_of(&alice.get_username()).is_err());
+        assert_eq!(
+            registry.usernames().unwrap(),
+            vec![alice2, Username::new("bob").unwrap()]
+        );
+
+        // a change of case is not a collision with oneself
+        let upper = Username::new("ALICE2").unwrap();
+        assert_eq!(registry.rename(&renamed, &upper).unwrap().get_username(), upper);
+    }
+
+    #[test]
+    fn test_files_shared_outlive_the_connection() {
+        let registry = UserRegistry::new();
+        let (tx, _rx) = mpsc::channel(256);
+        let alice = Username::new("alice").unwrap();
+        let user = registry.register(&alice, ADDR, tx.clone()).unwrap();
+        registry.count_file(&alice, 600).unwrap();
+
+        // coming back, in any case, finds the count where it was
+        registry.unregister(&user).unwrap();
+        let upper = Username::new("ALICE").unwrap();
+        let user = registry.register(&upper, ADDR, tx).unwrap();
+        assert_eq!(registry.files_shared(&upper), Ok(600));
+        registry.count_file(&upper, 100).unwrap();
+
+        // and a rename takes it along
+        let alicia = Username::new("alicia").unwrap();
+        registry.rename(&user, &alicia).unwrap();
+        assert_eq!(registry.files_shared(&alicia), Ok(700));
+        assert_eq!(registry.files_shared(&alice), Ok(0));
+    }
+
+    #[test]
+    fn test_registry_reserved_names() {
+        let registry = UserRegistry::with_history_size(0).with_reserved_names(&["server".to_string()]);
+        let (tx, _rx) = mpsc::channel(256);
+
+        let err = registry
+            .register(&Username::new("SERVER").unwrap(), ADDR, tx.clone())
+            .unwrap_err();
+        assert_eq!(err, Error::UsernameReserved);
+        assert_eq!(err.to_string(), "username reserved");
+
+        let alice = registry.register(&Username::new("alice").unwrap(), ADDR, tx).unwrap();
+        let err = registry.rename(&alice, &Username::new("Server").unwrap()).unwrap_err();
+        assert_eq!(err, Error::UsernameReserved);
+        assert_eq!(registry.usernames().unwrap(), vec![alice.get_username()]);
+
+        // alice keeps a name reserved after she took it
+        registry.set_reserved_names(&["alice".to_string()]);
+        let server = registry.rename(&alice, &Username::new("Server").unwrap()).unwrap();
+        assert_eq!(server.get_username().to_string(), "Server");
+    }
+
+    #[test]
+    fn test_registry_max_users() {
+        let registry = UserRegistry::with_history_size(0).with_max_users(2);
+        let (tx, _rx) = mpsc::channel(256);
+        let alice = registry
+            .register(&Username::new("alice").unwrap(), ADDR, tx.clone())
+            .unwrap();
+        registry
+            .register(&Username::new("bob").unwrap(), ADDR, tx.clone())
+            .unwrap();
+
+        let carol = Username::new("carol").unwrap();
+        assert_eq!(
+            registry.register(&carol, ADDR, tx.clone()).unwrap_err(),
+            Error::ServerFull
+        );
+
+        assert!(registry.unregister(&alice).unwrap());
+        assert!(registry.register(&carol, ADDR, tx).is_ok());
+    }
+
+    #[tokio::test]
+    async fn test_registry_send_to_delivers_only_to_target() {
+        let registry = UserRegistry::new();
+        let (tx_alice, mut rx_alice) = mpsc::channel(256);
+        let (tx_bob, mut rx_bob) = mpsc::channel(256);
+        registry
+            .register(&Username::new("alice").unwrap(), ADDR, tx_alice)
+            .unwrap();
+        registry.register(&Username::new("bob").unwrap(), ADDR, tx_bob).unwrap();
+
+        let msg = room::OneToMany::from(room::OneToOne::from(b"psst".to_vec()));
+        registry.send_to(&Username::new("BOB").unwrap(), msg).await.unwrap();
+
+        assert_eq!(&*rx_bob.try_recv().unwrap(), b"psst");
+        assert!(rx_alice.try_recv().is_err());
+    }
+
+    #[tokio::test]
+    async fn test_registry_send_to_unknown_user() {
+        let registry = UserRegistry::new();
+        let msg = room::OneToMany::from(room::OneToOne::from(b"psst".to_vec()));
+        let err = registry
+            .send_to(&Username::new("ghost").unwrap(), msg)
+            .await
+            .unwrap_err();
+        assert_eq!(err, Error::UserNotFound("ghost".to_string()));
+        assert_eq!(err.to_string(), "no such user: ghost");
+    }
+
+    #[test]
+    fn test_username_is_same_user() {
+        let alice = Username::new("alice").unwrap();
+        assert!(alice.is_same_user(&Username::new("ALICE").unwrap()));
+        assert!(!alice.is_same_user(&Username::new("bob").unwrap()));
+    }
+
+    #[tokio::test]
+    async fn test_registry_channel_broadcast_is_scoped() {
+        let registry = UserRegistry::new();
+        let (tx_alice, mut rx_alice) = mpsc::channel(256);
+        let (tx_bob, mut rx_bob) = mpsc::channel(256);
+        let alice = Username::new("alice").unwrap();
+        let bob = Username::new("bob").unwrap();
+        registry.register(&alice, ADDR, tx_alice).unwrap();
+        registry.register(&bob, ADDR, tx_bob).unwrap();
+
+        let random = ChannelName::new("#random").unwrap();
+        assert_eq!(
+            registry.move_to_channel(&bob, &random).unwrap(),
+            ChannelName::default_channel()
+        );
+
+        let msg = room::OneToMany::from(room::OneToOne::to_channel(b"hi".to_vec(), random));
+        assert_eq!(registry.broadcast(&msg, None).unwrap(), 1);
+        assert_eq!(&*rx_bob.try_recv().unwrap(), b"hi");
+        assert!(rx_alice.try_recv().is_err());
+    }
+
+    #[test]
+    fn test_registry_new_users_start_in_default_channel() {
+        let registry = UserRegistry::new();
+        let (tx, _rx) = mpsc::channel(256);
+        let alice = Username::new("alice").unwrap();
+        registry.register(&alice, ADDR, tx).unwrap();
+        assert_eq!(registry.channel_of(&alice).unwrap(), ChannelName::default_channel());
+    }
+
+    #[test]
+    fn test_registry_channel_counts_follow_membership() {
+        let registry = UserRegistry::new();
+        let (tx1, _rx1) = mpsc::channel(256);
+        let (tx2, _rx2) = mpsc::channel(256);
+        let alice = Username::new("alice").unwrap();
+        let bob = registry.register(&Username::new("bob").unwrap(), ADDR, tx2);
+        registry.register(&alice, ADDR, tx1).unwrap();
+        let random = ChannelName::new("#random").unwrap();
+        registry.move_to_channel(&alice, &random).unwrap();
+
+        assert_eq!(
+            registry.channel_counts().unwrap(),
+            vec![(ChannelName::default_channel(), 1), (random, 1)]
+        );
+
+        registry.unregister(&bob.unwrap()).unwrap();
+        assert_eq!(
+            registry.channel_counts().unwrap(),
+            vec![(ChannelName::new("#random").unwrap(), 1)]
+        );
+    }
+
+    #[test]
+    fn test_registry_usernames_sorted() {
+        let registry = UserRegistry::new();
+        for name in ["charlie", "Alice", "bob"] {
+            let (tx, _rx) = mpsc::channel(256);
+            registry.register(&Username::new(name).unwrap(), ADDR, tx).unwrap();
+        }
+        let online: Vec<String> = registry.usernames().unwrap().iter().map(ToString::to_string).collect();
+        assert_eq!(online, vec!["Alice", "bob", "charlie"]);
+    }
+
+    #[test]
+    fn test_registry_move_to_current_channel_fails() {
+        let registry = UserRegistry::new();
+        let (tx, _rx) = mpsc::channel(256);
+        let alice = Username::new("alice").unwrap();
+        registry.register(&alice, ADDR, tx).unwrap();
+        assert!(matches!(
+            registry.move_to_channel(&alice, &ChannelName::default_channel()),
+            Err(Error::Channel(ChannelError::AlreadyMember(_)))
+        ));
+    }
+
+    #[tokio::test]
+    async fn test_registry_replays_history_before_live_messages() {
+        let registry = UserRegistry::with_history_size(2);
+        let (tx_alice, _rx_alice) = mpsc::channel(256);
+        registry
+            .register(&Username::new("alice").unwrap(), ADDR, tx_alice)
+            .unwrap();
+
+        let general = ChannelName::default_channel();
+        for line in ["one", "two", "three"] {
+            let msg = room::OneToMany::from(room::OneToOne::to_channel(line.into(), general.clone()).recorded());
+            registry.broadcast(&msg, None).unwrap();
+        }
+        let notice = room::OneToMany::from(room::OneToOne::to_channel(b"notice".to_vec(), general.clone()));
+        registry.broadcast(&notice, None).unwrap();
+
+        let (tx_bob, mut rx_bob) = mpsc::channel(256);
+        registry.register(&Username::new("bob").unwrap(), ADDR, tx_bob).unwrap();
+        let live = room::OneToMany::from(room::OneToOne::to_channel(b"four".to_vec(), general).recorded());
+        registry.broadcast(&live, None).unwrap();
+
+        assert_eq!(&*rx_bob.try_recv().unwrap(), b"HISTORY|SEQ|2|two");
+        assert_eq!(&*rx_bob.try_recv().unwrap(), b"HISTORY|SEQ|3|three");
+        assert_eq!(&*rx_bob.try_recv().unwrap(), b"SEQ|4|four");
+        assert!(rx_bob.try_recv().is_err());
+    }
+
+    #[tokio::test]
+    async fn test_registry_numbers_a_line_alike_for_everyone() {
+        let registry = UserRegistry::with_history_size(0);
+        let (tx_alice, mut rx_alice) = mpsc::channel(256);
+        let (tx_bob, mut rx_bob) = mpsc::channel(256);
+        let alice = Username::new("alice").unwrap();
+        registry.register(&alice, ADDR, tx_alice).unwrap();
+        registry.register(&Username::new("bob").unwrap(), ADDR, tx_bob).unwrap();
+
+        let general = ChannelName::default_channel();
+        let first = room::OneToMany::from(room::OneToOne::to_channel(b"one".to_vec(), general.clone()).recorded());
+        registry.broadcast(&first, None).unwrap();
+        let censored = room::OneToMany::from(
+            room::OneToOne::to_channel(b"***".to_vec(), general)
+                .recorded()
+                .except_sender(alice.clone(), b"darn".to_vec()),
+        );
+        assert_eq!(registry.broadcast(&censored, Some(&alice)).unwrap(), 1);
+
+        assert_eq!(&*rx_alice.try_recv().unwrap(), b"SEQ|1|one");
+        assert_eq!(&*rx_alice.try_recv().unwrap(), b"SEQ|2|darn");
+        assert_eq!(&*rx_bob.try_recv().unwrap(), b"SEQ|1|one");
+        assert_eq!(&*rx_bob.try_recv().unwrap(), b"SEQ|2|***");
+    }
+
+    #[tokio::test]
+    async fn test_registry_replays_history_on_channel_move() {
+        let registry = UserRegistry::with_history_size(10);
+        let (tx_alice, _rx_alice) = mpsc::channel(256);
+        let (tx_bob, mut rx_bob) = mpsc::channel(256);
+        let alice = Username::new("alice").unwrap();
+        let bob = Username::new("bob").unwrap();
+        registry.register(&alice, ADDR, tx_alice).unwrap();
+        registry.register(&bob, ADDR, tx_bob).unwrap();
+
+        let random = ChannelName::new("#random").unwrap();
+        registry.move_to_channel(&alice, &random).unwrap();
+        let msg = room::OneToMany::from(room::OneToOne::to_channel(b"hi".to_vec(), random.clone()).recorded());
+        registry.broadcast(&msg, None).unwrap();
+        assert!(rx_bob.try_recv().is_err());
+
+        registry.move_to_channel(&bob, &random).unwrap();
+        assert_eq!(&*rx_bob.try_recv().unwrap(), b"HISTORY|SEQ|1|hi");
+    }
+
+    #[tokio::test]
+    async fn test_registry_forgets_history_of_empty_channel() {
+        let registry = UserRegistry::with_history_size(10);
+        let (tx_alice, _rx_alice) = mpsc::channel(256);
+        let alice = registry
+            .register(&Username::new("alice").unwrap(), ADDR, tx_alice)
+            .unwrap();
+        let msg = room::OneToMany::from(
+            room::OneToOne::to_channel(b"hi".to_vec(), ChannelName::default_channel()).recorded(),
+        );
+        registry.broadcast(&msg, None).unwrap();
+        registry.unregister(&alice).unwrap();
+
+        let (tx_bob, mut rx_bob) = mpsc::channel(256);
+        registry.register(&Username::new("bob").unwrap(), ADDR, tx_bob).unwrap();
+        assert!(rx_bob.try_recv().is_err());
     }
 
     #[test]
     fn test_user_display() {
         let (tx, _rx) = mpsc::channel(256);
         let username = Username::new("echo").unwrap();
-        let user = User::new(username, tx);
+        let user = User::new(username, ADDR, tx);
         assert_eq!(format!("{user}"), "echo");
     }
 }
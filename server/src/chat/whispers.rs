@@ -0,0 +1,125 @@
+//! Recent private messages per pair of users, replayed with `dm-history`.
+//!
+//! A conversation is kept under both names sorted, so either side finds the
+//! same lines, and only for as long as both stay registered: whoever takes a
+//! name over later must not read what was said to its previous owner. Like
+//! [`super::history::History`] it holds no lock of its own.
+
+use std::{
+    collections::{HashMap, VecDeque},
+    hash::Hash,
+};
+
+use super::{
+    history::replay_line,
+    room::{OneToMany, OneToOne},
+};
+
+/// How many private messages are kept per pair.
+pub const PAIR_CAPACITY: usize = 20;
+
+#[derive(Debug)]
+pub struct Whispers<K> {
+    capacity: usize,
+    lines: HashMap<(K, K), VecDeque<Vec<u8>>>,
+}
+
+impl<K: Clone + Ord + Hash> Whispers<K> {
+    /// Keeps at most `capacity` lines per pair.
+    pub fn new(capacity: usize) -> Self {
+        Self {
+            capacity,
+            lines: HashMap::new(),
+        }
+    }
+
+    pub fn record(&mut self, a: &K, b: &K, line: Vec<u8>) {
+        if self.capacity == 0 {
+            return;
+        }
+        let lines = self.lines.entry(pair(a, b)).or_default();
+        if lines.len() >= self.capacity {
+            lines.pop_front();
+        }
+        lines.push_back(line);
+    }
+
+    /// Replay copies of the lines between `a` and `b`, oldest first.
+    pub fn replay(&self, a: &K, b: &K) -> Vec<OneToMany> {
+        self.lines
+            .get(&pair(a, b))
+            .into_iter()
+            .flatten()
+            .map(|line| OneToMany::from(OneToOne::from(replay_line(line))))
+            .collect()
+    }
+
+    /// Drops every conversation `key` took part in, e.g. once they've left.
+    pub fn forget(&mut self, key: &K) {
+        self.lines.retain(|(a, b), _| a != key && b != key);
+    }
+
+    /// Moves `from`'s conversations over to `to`.
+    pub fn rename(&mut self, from: &K, to: &K) {
+        let moved: Vec<_> = self.lines.extract_if(|(a, b), _| a == from || b == from).collect();
+        for ((a, b), lines) in moved {
+            let other = if a == *from { b } else { a };
+            // a note to self follows the rename on both sides
+            let other = if other == *from { to.clone() } else { other };
+            self.lines.insert(pair(to, &other), lines);
+        }
+    }
+}
+
+fn pair<K: Clone + Ord>(a: &K, b: &K) -> (K, K) {
+    if a <= b {
+        (a.clone(), b.clone())
+    } else {
+        (b.clone(), a.clone())
+    }
+}
+
+#[cfg(test)]
+#[allow(clippy::unwrap_used)]
+mod tests {
+    use super::*;
+
+    fn replayed(whispers: &Whispers<&str>, a: &'static str, b: &'static str) -> Vec<Vec<u8>> {
+        whispers.replay(&a, &b).iter().map(|m| m.to_vec()).collect()
+    }
+
+    #[test]
+    fn test_pair_is_shared_by_both_sides() {
+        let mut whispers = Whispers::new(2);
+        for line in ["one", "two", "three"] {
+            whispers.record(&"alice", &"bob", line.as_bytes().to_vec());
+        }
+        let expected = vec![b"HISTORY|two".to_vec(), b"HISTORY|three".to_vec()];
+        assert_eq!(replayed(&whispers, "bob", "alice"), expected);
+        assert_eq!(replayed(&whispers, "alice", "bob"), expected);
+        assert!(replayed(&whispers, "alice", "carol").is_empty());
+    }
+
+    #[test]
+    fn test_forget_drops_every_pair_of_a_user() {
+        let mut whispers = Whispers::new(10);
+        whispers.record(&"alice", &"bob", b"hi bob".to_vec());
+        whispers.record(&"carol", &"alice", b"hi alice".to_vec());
+        whispers.record(&"bob", &"carol", b"hi carol".to_vec());
+        whispers.forget(&"alice");
+        assert!(replayed(&whispers, "alice", "bob").is_empty());
+        assert!(replayed(&whispers, "alice", "carol").is_empty());
+        assert_eq!(replayed(&whispers, "bob", "carol").len(), 1);
+    }
+
+    #[test]
+    fn test_rename_keeps_conversations() {
+        let mut whispers = Whispers::new(10);
+        whispers.record(&"alice", &"bob", b"hi bob".to_vec());
+        whispers.record(&"alice", &"alice", b"note".to_vec());
+        whispers.rename(&"alice", &"zed");
+        assert!(replayed(&whispers, "alice", "bob").is_empty());
+        assert_eq!(replayed(&whispers, "bob", "zed"), vec![b"HISTORY|hi bob".to_vec()]);
+        assert_eq!(replayed(&whispers, "zed", "zed"), vec![b"HISTORY|note".to_vec()]);
+    }
+}
@@ -0,0 +1,1295 @@
+//! Server settings, read at startup.
+//!
+//! Each setting comes from, in order of precedence, its environment variable,
+//! the config file given with `--config`, or the built-in default. The file is
+//! YAML, a flat mapping whose keys are the variable names without `CHAT_`, in
+//! lower case:
+//!
+//! ```yaml
+//! port: 9000
+//! max_clients: 20
+//! rate_limit: 5
+//! tls_cert: /etc/chat/cert.pem
+//! motd: |
+//!   Be kind.
+//!   No spam.
+//! ```
+//!
+//! A value is read as the text its environment variable would hold: a list
+//! is joined with commas, and an empty value is empty text. Nested mappings
+//! and keys that name no setting are refused.
+//!
+//! A running server can be told to read them again, as `SIGHUP` does; only
+//! the settings in [`RELOADABLE`] take effect then, the rest wait for a
+//! restart.
+
+use std::{
+    env,
+    fmt::{Display, Formatter},
+    fs, io,
+    net::SocketAddr,
+    path::{Path, PathBuf},
+    str::FromStr,
+    sync::{Arc, OnceLock},
+    time::Duration,
+};
+
+use common::{config::unbracket, consts, file};
+use parking_lot::RwLock;
+use serde::{Deserialize, Deserializer, de};
+use thiserror::Error as this_error;
+
+pub use crate::chat::channel::ChannelName;
+use crate::{
+    chat::{alias::Aliases, clock::TimestampFormat, policy::RoomPolicy},
+    tls::TlsVersion,
+};
+
+/// Address the server listens on.
+pub const DEFAULT_HOST: &str = "127.0.0.1";
+
+/// Port the server listens on.
+pub const DEFAULT_PORT: u16 = 8080;
+
+/// Chat lines kept per room for replay to newcomers.
+pub const DEFAULT_HISTORY_SIZE: usize = 50;
+
+/// How often an idle connection is sent a `PING`.
+pub const DEFAULT_PING_INTERVAL: Duration = Duration::from_secs(30);
+
+/// How long a client has to answer a `PING` before it is dropped.
+pub const DEFAULT_PONG_TIMEOUT: Duration = Duration::from_secs(10);
+
+/// How long clients are warned before the server closes on shutdown.
+pub const DEFAULT_SHUTDOWN_GRACE: Duration = Duration::from_secs(3);
+
+/// Largest `send` or `dm` payload accepted, in bytes.
+pub const DEFAULT_MAX_MSG_LEN: usize = 2048;
+
+/// Largest file `sendfile` may share, in bytes.
+pub const DEFAULT_MAX_FILE_SIZE: usize = 64 * 1024;
+
+/// Bytes of files one connection may share in all.
+pub const DEFAULT_FILE_QUOTA: usize = 1024 * 1024;
+
+/// Joined clients allowed at once.
+pub const DEFAULT_MAX_CLIENTS: usize = 100;
+
+/// Names nobody may join as or `nick` to, so no one can pass for the server.
+pub const DEFAULT_RESERVED_NAMES: &[&str] = &["server", "admin", "system"];
+
+/// How long a joined client may go without sending anything.
+pub const DEFAULT_IDLE_TIMEOUT: Duration = Duration::from_secs(10 * 60);
+
+/// How long a dropped client's name is held for it to `rejoin`.
+pub const DEFAULT_SESSION_GRACE: Duration = Duration::from_secs(60);
+
+/// Dropped clients' names held at once; the longest held go first.
+pub const DEFAULT_SESSION_MAX_HELD: usize = 1000;
+
+/// How long a name given up with its session is kept for that session's token.
+pub const DEFAULT_NAME_COOLDOWN: Duration = Duration::from_secs(5);
+
+/// Every setting, by environment variable. `CHAT_MOTD_FILE` comes before
+/// `CHAT_MOTD` so that `CHAT_MOTD` wins when both are given.
+const SETTINGS: [&str; 40] = [
+    consts::ENV_CHAT_HOST,
+    consts::ENV_CHAT_PORT,
+    consts::ENV_CHAT_LISTEN,
+    consts::ENV_CHAT_HISTORY_SIZE,
+    consts::ENV_CHAT_ROOM_HISTORY_SIZES,
+    consts::ENV_CHAT_PING_INTERVAL,
+    consts::ENV_CHAT_PONG_TIMEOUT,
+    consts::ENV_CHAT_IDLE_TIMEOUT,
+    consts::ENV_CHAT_READ_TIMEOUT,
+    consts::ENV_CHAT_WRITE_TIMEOUT,
+    consts::ENV_CHAT_RATE_LIMIT,
+    consts::ENV_CHAT_RATE_BURST,
+    consts::ENV_CHAT_MAX_MSG_LEN,
+    consts::ENV_CHAT_ROOM_POLICIES,
+    consts::ENV_CHAT_MAX_FILE_SIZE,
+    consts::ENV_CHAT_FILE_QUOTA,
+    consts::ENV_CHAT_MAX_CLIENTS,
+    consts::ENV_CHAT_CONNECT_RATE,
+    consts::ENV_CHAT_PASSWORD,
+    consts::ENV_CHAT_TLS_CERT,
+    consts::ENV_CHAT_TLS_KEY,
+    consts::ENV_CHAT_TLS_MIN_VERSION,
+    consts::ENV_CHAT_SHUTDOWN_GRACE,
+    consts::ENV_CHAT_ADMIN_TOKEN,
+    consts::ENV_CHAT_BANFILE,
+    consts::ENV_CHAT_STORE,
+    consts::ENV_CHAT_RESERVED_NAMES,
+    consts::ENV_CHAT_MOTD_FILE,
+    consts::ENV_CHAT_MOTD,
+    consts::ENV_CHAT_LOG_FILE,
+    consts::ENV_CHAT_LOG_STRICT,
+    consts::ENV_CHAT_METRICS_ADDR,
+    consts::ENV_CHAT_HEALTH_ADDR,
+    consts::ENV_CHAT_SESSION_GRACE,
+    consts::ENV_CHAT_SESSION_MAX_HELD,
+    consts::ENV_CHAT_NAME_COOLDOWN,
+    consts::ENV_CHAT_FILTER_FILE,
+    consts::ENV_CHAT_NOTIFY,
+    consts::ENV_CHAT_ALIASES,
+    consts::ENV_CHAT_TS_FORMAT,
+];
+
+/// Settings a running server takes up again on a reload: the MOTD, the word
+/// filter, reserved names, rate limits and room policies.
+pub const RELOADABLE: [&str; 7] = [
+    consts::ENV_CHAT_MOTD_FILE,
+    consts::ENV_CHAT_MOTD,
+    consts::ENV_CHAT_FILTER_FILE,
+    consts::ENV_CHAT_RESERVED_NAMES,
+    consts::ENV_CHAT_RATE_LIMIT,
+    consts::ENV_CHAT_RATE_BURST,
+    consts::ENV_CHAT_ROOM_POLICIES,
+];
+
+static CONFIG: OnceLock<RwLock<Arc<Config>>> = OnceLock::new();
+
+/// Makes `config` the one [`get_config`] hands out, unless one was
+/// installed already.
+pub fn install(config: Config) -> Arc<Config> {
+    Arc::clone(&CONFIG.get_or_init(|| RwLock::new(Arc::new(config))).read())
+}
+
+/// The installed configuration, or the defaults if [`install`] was never
+/// called. Hold on to it only as long as one consistent view is needed, as
+/// a [`reload`] replaces it.
+pub fn get_config() -> Arc<Config> {
+    Arc::clone(&CONFIG.get_or_init(|| RwLock::new(Arc::new(Config::default()))).read())
+}
+
+/// Takes the [`RELOADABLE`] settings from `loaded` into the installed
+/// configuration and leaves the rest as they are.
+pub fn reload(loaded: Config) -> Reload {
+    let mut config = CONFIG.get_or_init(|| RwLock::new(Arc::new(Config::default()))).write();
+    let (reloaded, report) = config.reloaded(loaded);
+    *config = Arc::new(reloaded);
+    report
+}
+
+/// What a [`reload`] found changed, by environment variable.
+#[derive(Debug, Default, PartialEq, Eq)]
+pub struct Reload {
+    /// Changes now in effect.
+    pub applied: Vec<&'static str>,
+    /// Changes that need a restart, and were left alone.
+    pub ignored: Vec<&'static str>,
+}
+
+#[derive(Debug, this_error)]
+pub enum Error {
+    #[error("cannot read {}: {source}", path.display())]
+    Read { path: PathBuf, source: io::Error },
+
+    #[error("{}: {source}", path.display())]
+    Syntax { path: PathBuf, source: serde_yaml::Error },
+
+    /// `field` is the file key or environment variable the value came from.
+    #[error("invalid {field}: {reason}")]
+    Invalid { field: String, reason: String },
+}
+
+/// Builds the configuration from the defaults, then the file at `path`, if
+/// any, then the environment, and checks the result.
+///
+/// # Errors
+///
+/// Returns the first offending field, or why the file could not be read.
+pub fn load(path: Option<&Path>) -> Result<Config, Error> {
+    let mut config = Config::default();
+    if let Some(path) = path {
+        let text = fs::read_to_string(path).map_err(|source| Error::Read {
+            path: path.to_path_buf(),
+            source,
+        })?;
+        let file = ConfigFile::parse(&text).map_err(|source| Error::Syntax {
+            path: path.to_path_buf(),
+            source,
+        })?;
+        config.apply_file(&file)?;
+    }
+    config.apply_env()?;
+    config.validate()?;
+    Ok(config)
+}
+
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct Config {
+    /// `CHAT_HOST`
+    pub host: String,
+    /// `CHAT_PORT`
+    pub port: u16,
+    /// `CHAT_LISTEN`, as `unix:PATH`; when set the server listens on that Unix socket instead of TCP.
+    pub listen: Option<PathBuf>,
+    /// `CHAT_HISTORY_SIZE`; zero disables history.
+    pub history_size: usize,
+    /// `CHAT_ROOM_HISTORY_SIZES`, `#room=N` pairs, comma separated; rooms not listed keep `history_size`.
+    pub room_history_sizes: Vec<(ChannelName, usize)>,
+    /// `CHAT_PING_INTERVAL`; zero disables the heartbeat.
+    pub ping_interval: Duration,
+    /// `CHAT_PONG_TIMEOUT`
+    pub pong_timeout: Duration,
+    /// `CHAT_IDLE_TIMEOUT`; zero disables it.
+    pub idle_timeout: Duration,
+    /// `CHAT_READ_TIMEOUT`; a message started and not finished within it closes the connection.
+    pub read_timeout: Duration,
+    /// `CHAT_WRITE_TIMEOUT`; a client whose socket takes longer than this to accept a write is dropped.
+    pub write_timeout: Duration,
+    /// `CHAT_RATE_LIMIT`, messages per second per connection
+    pub rate_per_second: u32,
+    /// `CHAT_RATE_BURST`
+    pub rate_burst: u32,
+    /// `CHAT_MAX_MSG_LEN`, in bytes
+    pub max_msg_len: usize,
+    /// `CHAT_ROOM_POLICIES`, `#room rate=N burst=N len=N`, comma separated; each overrides the limits above in its room.
+    pub room_policies: Vec<(ChannelName, RoomPolicy)>,
+    /// `CHAT_MAX_FILE_SIZE`, in bytes; zero turns `sendfile` off.
+    pub max_file_size: usize,
+    /// `CHAT_FILE_QUOTA`, bytes of files a user may share in all; zero removes the cap.
+    pub file_quota: usize,
+    /// `CHAT_MAX_CLIENTS`; zero removes the cap.
+    pub max_clients: usize,
+    /// `CHAT_CONNECT_RATE`, joins per minute from one address; zero removes the cap.
+    pub connect_rate: usize,
+    /// `CHAT_PASSWORD`; when set, clients must present it to join.
+    pub password: Option<String>,
+    /// `CHAT_TLS_CERT`, a PEM certificate chain; TLS is on when this and the key are set.
+    pub tls_cert: Option<PathBuf>,
+    /// `CHAT_TLS_KEY`, a PEM private key
+    pub tls_key: Option<PathBuf>,
+    /// `CHAT_TLS_MIN_VERSION`, `1.2` or `1.3`
+    pub tls_min_version: TlsVersion,
+    /// `CHAT_SHUTDOWN_GRACE`
+    pub shutdown_grace: Duration,
+    /// `CHAT_ADMIN_TOKEN`; when unset nobody can become an operator.
+    pub admin_token: Option<String>,
+    /// `CHAT_BANFILE`; bans are loaded from and saved to this file.
+    pub ban_file: Option<PathBuf>,
+    /// `CHAT_STORE`, `memory` or `sqlite:PATH`; with a path, history and bans are kept in that SQLite database.
+    pub store: Option<PathBuf>,
+    /// `CHAT_RESERVED_NAMES`, comma separated; set it empty to reserve nothing.
+    pub reserved_names: Vec<String>,
+    /// `CHAT_MOTD`, or else the contents of `CHAT_MOTD_FILE`; sent line by line after a join.
+    pub motd: Option<String>,
+    /// `CHAT_LOG_FILE`; every chat line is appended here when set.
+    pub log_file: Option<PathBuf>,
+    /// `CHAT_LOG_STRICT`; when set, a `CHAT_LOG_FILE` that can't be opened stops startup instead of being skipped.
+    pub log_strict: bool,
+    /// `CHAT_METRICS_ADDR`; Prometheus metrics are served here when set.
+    pub metrics_addr: Option<SocketAddr>,
+    /// `CHAT_HEALTH_ADDR`; liveness probes are answered here when set.
+    pub health_addr: Option<SocketAddr>,
+    /// `CHAT_SESSION_GRACE`; zero turns session tokens off.
+    pub session_grace: Duration,
+    /// `CHAT_SESSION_MAX_HELD`; past this many held sessions the oldest is evicted, and zero removes the cap.
+    pub session_max_held: usize,
+    /// `CHAT_NAME_COOLDOWN`; a name given up with its session is only its token's to take for this long, and zero frees it at once.
+    pub name_cooldown: Duration,
+    /// `CHAT_FILTER_FILE`; words listed here are starred out of chat lines.
+    pub filter_file: Option<PathBuf>,
+    /// `CHAT_NOTIFY`, `join`, `leave`, both comma separated, or `none`: which of them rooms are told of.
+    pub notify: Notify,
+    /// `CHAT_ALIASES`, `alias=command` pairs, comma separated; set it empty to have none.
+    pub aliases: Aliases,
+    /// `CHAT_TS_FORMAT`, a Go layout, or `RFC3339`, `RFC3339Nano`, `Unix` or `UnixMilli`; how chat lines are stamped.
+    pub ts_format: TimestampFormat,
+}
+
+impl Config {
+    /// Applies the settings the config file sets, in [`SETTINGS`] order
+    /// rather than the file's.
+    fn apply_file(&mut self, file: &ConfigFile) -> Result<(), Error> {
+        for (name, value) in file.entries() {
+            if let FileValue::Set(raw) = value {
+                self.set(name, raw).map_err(|reason| Error::Invalid {
+                    field: file_key(name),
+                    reason,
+                })?;
+            }
+        }
+        Ok(())
+    }
+
+    fn apply_env(&mut self) -> Result<(), Error> {
+        for name in SETTINGS {
+            if let Some(raw) = env::var_os(name) {
+                let raw = raw.into_string().map_err(|_| Error::Invalid {
+                    field: name.to_string(),
+                    reason: "not valid UTF-8".to_string(),
+                })?;
+                self.set(name, &raw).map_err(|reason| Error::Invalid {
+                    field: name.to_string(),
+                    reason,
+                })?;
+            }
+        }
+        Ok(())
+    }
+
+    /// Sets the field behind the environment variable `name` from `raw`.
+    fn set(&mut self, name: &str, raw: &str) -> Result<(), String> {
+        match name {
+            consts::ENV_CHAT_HOST => self.host = unbracket(raw.trim()).to_string(),
+            consts::ENV_CHAT_PORT => self.port = parse(raw, "a port number")?,
+            consts::ENV_CHAT_LISTEN => self.listen = parse_listen(raw)?,
+            consts::ENV_CHAT_HISTORY_SIZE => self.history_size = parse(raw, "a whole number")?,
+            consts::ENV_CHAT_ROOM_HISTORY_SIZES => self.room_history_sizes = parse_room_sizes(raw)?,
+            consts::ENV_CHAT_PING_INTERVAL => self.ping_interval = parse_duration(raw)?,
+            consts::ENV_CHAT_PONG_TIMEOUT => self.pong_timeout = parse_duration(raw)?,
+            consts::ENV_CHAT_IDLE_TIMEOUT => self.idle_timeout = parse_duration(raw)?,
+            consts::ENV_CHAT_READ_TIMEOUT => self.read_timeout = parse_duration(raw)?,
+            consts::ENV_CHAT_WRITE_TIMEOUT => self.write_timeout = parse_duration(raw)?,
+            consts::ENV_CHAT_RATE_LIMIT => self.rate_per_second = parse(raw, "a whole number")?,
+            consts::ENV_CHAT_RATE_BURST => self.rate_burst = parse(raw, "a whole number")?,
+            consts::ENV_CHAT_MAX_MSG_LEN => self.max_msg_len = parse(raw, "a whole number")?,
+            consts::ENV_CHAT_ROOM_POLICIES => self.room_policies = parse_room_policies(raw)?,
+            consts::ENV_CHAT_MAX_FILE_SIZE => self.max_file_size = parse(raw, "a whole number")?,
+            consts::ENV_CHAT_FILE_QUOTA => self.file_quota = parse(raw, "a whole number")?,
+            consts::ENV_CHAT_MAX_CLIENTS => self.max_clients = parse(raw, "a whole number")?,
+            consts::ENV_CHAT_CONNECT_RATE => self.connect_rate = parse(raw, "a whole number")?,
+            consts::ENV_CHAT_PASSWORD => self.password = non_empty(raw),
+            consts::ENV_CHAT_TLS_CERT => self.tls_cert = non_empty(raw).map(PathBuf::from),
+            consts::ENV_CHAT_TLS_KEY => self.tls_key = non_empty(raw).map(PathBuf::from),
+            consts::ENV_CHAT_TLS_MIN_VERSION => self.tls_min_version = parse(raw, "1.2 or 1.3")?,
+            consts::ENV_CHAT_SHUTDOWN_GRACE => self.shutdown_grace = parse_duration(raw)?,
+            consts::ENV_CHAT_ADMIN_TOKEN => self.admin_token = non_empty(raw),
+            consts::ENV_CHAT_BANFILE => self.ban_file = non_empty(raw).map(PathBuf::from),
+            consts::ENV_CHAT_STORE => self.store = parse_store(raw)?,
+            consts::ENV_CHAT_RESERVED_NAMES => self.reserved_names = parse_list(Some(raw), &[]),
+            consts::ENV_CHAT_MOTD_FILE => {
+                if let Some(path) = non_empty(raw) {
+                    self.motd = read_motd(Path::new(&path))?;
+                }
+            }
+            consts::ENV_CHAT_MOTD => self.motd = Some(raw.to_string()).filter(|motd| !motd.trim().is_empty()),
+            consts::ENV_CHAT_LOG_FILE => self.log_file = non_empty(raw).map(PathBuf::from),
+            consts::ENV_CHAT_LOG_STRICT => self.log_strict = parse_switch(raw)?,
+            consts::ENV_CHAT_SESSION_GRACE => self.session_grace = parse_duration(raw)?,
+            consts::ENV_CHAT_SESSION_MAX_HELD => self.session_max_held = parse(raw, "a whole number")?,
+            consts::ENV_CHAT_NAME_COOLDOWN => self.name_cooldown = parse_duration(raw)?,
+            consts::ENV_CHAT_FILTER_FILE => self.filter_file = non_empty(raw).map(PathBuf::from),
+            consts::ENV_CHAT_NOTIFY => self.notify = parse(raw, "join, leave, both or none")?,
+            consts::ENV_CHAT_ALIASES => self.aliases = raw.parse()?,
+            consts::ENV_CHAT_TS_FORMAT => self.ts_format = raw.parse()?,
+            consts::ENV_CHAT_METRICS_ADDR => {
+                self.metrics_addr = non_empty(raw)
+                    .map(|addr| parse(&addr, "an address like 127.0.0.1:9100"))
+                    .transpose()?;
+            }
+            consts::ENV_CHAT_HEALTH_ADDR => {
+                self.health_addr = non_empty(raw)
+                    .map(|addr| parse(&addr, "an address like 127.0.0.1:9101"))
+                    .transpose()?;
+            }
+            _ => return Err("unknown setting".to_string()),
+        }
+        Ok(())
+    }
+
+    /// `self` with the [`RELOADABLE`] settings taken from `loaded`, and
+    /// which changes that applied and which it left alone.
+    fn reloaded(&self, loaded: Self) -> (Self, Reload) {
+        let (applied, ignored) = self
+            .changed(&loaded)
+            .into_iter()
+            .partition(|name| RELOADABLE.contains(name));
+        let reloaded = Self {
+            motd: loaded.motd,
+            filter_file: loaded.filter_file,
+            reserved_names: loaded.reserved_names,
+            rate_per_second: loaded.rate_per_second,
+            rate_burst: loaded.rate_burst,
+            room_policies: loaded.room_policies,
+            ..self.clone()
+        };
+        (reloaded, Reload { applied, ignored })
+    }
+
+    /// The settings, by environment variable, whose values differ in
+    /// `other`. A MOTD is reported as `CHAT_MOTD` wherever it came from.
+    fn changed(&self, other: &Self) -> Vec<&'static str> {
+        [
+            (consts::ENV_CHAT_HOST, self.host != other.host),
+            (consts::ENV_CHAT_PORT, self.port != other.port),
+            (consts::ENV_CHAT_LISTEN, self.listen != other.listen),
+            (consts::ENV_CHAT_HISTORY_SIZE, self.history_size != other.history_size),
+            (
+                consts::ENV_CHAT_ROOM_HISTORY_SIZES,
+                self.room_history_sizes != other.room_history_sizes,
+            ),
+            (
+                consts::ENV_CHAT_PING_INTERVAL,
+                self.ping_interval != other.ping_interval,
+            ),
+            (consts::ENV_CHAT_PONG_TIMEOUT, self.pong_timeout != other.pong_timeout),
+            (consts::ENV_CHAT_IDLE_TIMEOUT, self.idle_timeout != other.idle_timeout),
+            (consts::ENV_CHAT_READ_TIMEOUT, self.read_timeout != other.read_timeout),
+            (
+                consts::ENV_CHAT_WRITE_TIMEOUT,
+                self.write_timeout != other.write_timeout,
+            ),
+            (
+                consts::ENV_CHAT_RATE_LIMIT,
+                self.rate_per_second != other.rate_per_second,
+            ),
+            (consts::ENV_CHAT_RATE_BURST, self.rate_burst != other.rate_burst),
+            (consts::ENV_CHAT_MAX_MSG_LEN, self.max_msg_len != other.max_msg_len),
+            (
+                consts::ENV_CHAT_ROOM_POLICIES,
+                self.room_policies != other.room_policies,
+            ),
+            (
+                consts::ENV_CHAT_MAX_FILE_SIZE,
+                self.max_file_size != other.max_file_size,
+            ),
+            (consts::ENV_CHAT_FILE_QUOTA, self.file_quota != other.file_quota),
+            (consts::ENV_CHAT_MAX_CLIENTS, self.max_clients != other.max_clients),
+            (consts::ENV_CHAT_CONNECT_RATE, self.connect_rate != other.connect_rate),
+            (consts::ENV_CHAT_PASSWORD, self.password != other.password),
+            (consts::ENV_CHAT_TLS_CERT, self.tls_cert != other.tls_cert),
+            (consts::ENV_CHAT_TLS_KEY, self.tls_key != other.tls_key),
+            (
+                consts::ENV_CHAT_TLS_MIN_VERSION,
+                self.tls_min_version != other.tls_min_version,
+            ),
+            (
+                consts::ENV_CHAT_SHUTDOWN_GRACE,
+                self.shutdown_grace != other.shutdown_grace,
+            ),
+            (consts::ENV_CHAT_ADMIN_TOKEN, self.admin_token != other.admin_token),
+            (consts::ENV_CHAT_BANFILE, self.ban_file != other.ban_file),
+            (consts::ENV_CHAT_STORE, self.store != other.store),
+            (
+                consts::ENV_CHAT_RESERVED_NAMES,
+                self.reserved_names != other.reserved_names,
+            ),
+            (consts::ENV_CHAT_MOTD, self.motd != other.motd),
+            (consts::ENV_CHAT_LOG_FILE, self.log_file != other.log_file),
+            (consts::ENV_CHAT_LOG_STRICT, self.log_strict != other.log_strict),
+            (consts::ENV_CHAT_METRICS_ADDR, self.metrics_addr != other.metrics_addr),
+            (consts::ENV_CHAT_HEALTH_ADDR, self.health_addr != other.health_addr),
+            (
+                consts::ENV_CHAT_SESSION_GRACE,
+                self.session_grace != other.session_grace,
+            ),
+            (
+                consts::ENV_CHAT_SESSION_MAX_HELD,
+                self.session_max_held != other.session_max_held,
+            ),
+            (
+                consts::ENV_CHAT_NAME_COOLDOWN,
+                self.name_cooldown != other.name_cooldown,
+            ),
+            (consts::ENV_CHAT_FILTER_FILE, self.filter_file != other.filter_file),
+            (consts::ENV_CHAT_NOTIFY, self.notify != other.notify),
+            (consts::ENV_CHAT_ALIASES, self.aliases != other.aliases),
+            (consts::ENV_CHAT_TS_FORMAT, self.ts_format != other.ts_format),
+        ]
+        .into_iter()
+        .filter_map(|(name, differs)| differs.then_some(name))
+        .collect()
+    }
+
+    /// Checks what each value alone can't, field by field.
+    fn validate(&self) -> Result<(), Error> {
+        let invalid = |name: &str, reason: &str| Error::Invalid {
+            field: file_key(name),
+            reason: reason.to_string(),
+        };
+        if !self.ping_interval.is_zero() && self.pong_timeout.is_zero() {
+            return Err(invalid(
+                consts::ENV_CHAT_PONG_TIMEOUT,
+                "must be more than 0 while the heartbeat is on",
+            ));
+        }
+        if self.read_timeout.is_zero() {
+            return Err(invalid(consts::ENV_CHAT_READ_TIMEOUT, "must be more than 0"));
+        }
+        if self.write_timeout.is_zero() {
+            return Err(invalid(consts::ENV_CHAT_WRITE_TIMEOUT, "must be more than 0"));
+        }
+        if self.rate_per_second == 0 {
+            return Err(invalid(consts::ENV_CHAT_RATE_LIMIT, "must be at least 1"));
+        }
+        if self.rate_burst == 0 {
+            return Err(invalid(consts::ENV_CHAT_RATE_BURST, "must be at least 1"));
+        }
+        if self.max_msg_len == 0 {
+            return Err(invalid(consts::ENV_CHAT_MAX_MSG_LEN, "must be at least 1"));
+        }
+        if self.max_file_size > file::MAX_SIZE {
+            return Err(invalid(
+                consts::ENV_CHAT_MAX_FILE_SIZE,
+                &format!("must be at most {}", file::MAX_SIZE),
+            ));
+        }
+        if self.listen.is_some() && self.tls_cert.is_some() {
+            return Err(invalid(
+                consts::ENV_CHAT_LISTEN,
+                "TLS is not supported on a Unix socket",
+            ));
+        }
+        match (&self.tls_cert, &self.tls_key) {
+            (Some(_), None) => Err(invalid(consts::ENV_CHAT_TLS_KEY, "required with tls_cert")),
+            (None, Some(_)) => Err(invalid(consts::ENV_CHAT_TLS_CERT, "required with tls_key")),
+            _ => Ok(()),
+        }
+    }
+}
+
+impl Default for Config {
+    fn default() -> Self {
+        Self {
+            host: DEFAULT_HOST.to_string(),
+            port: DEFAULT_PORT,
+            listen: None,
+            history_size: DEFAULT_HISTORY_SIZE,
+            room_history_sizes: Vec::new(),
+            ping_interval: DEFAULT_PING_INTERVAL,
+            pong_timeout: DEFAULT_PONG_TIMEOUT,
+            idle_timeout: DEFAULT_IDLE_TIMEOUT,
+            read_timeout: consts::READ_TIMEOUT,
+            write_timeout: consts::WRITE_TIMEOUT,
+            rate_per_second: consts::MAX_MESSAGES_PER_SECOND,
+            rate_burst: consts::MESSAGE_BURST_CAPACITY,
+            max_msg_len: DEFAULT_MAX_MSG_LEN,
+            room_policies: Vec::new(),
+            max_file_size: DEFAULT_MAX_FILE_SIZE,
+            file_quota: DEFAULT_FILE_QUOTA,
+            max_clients: DEFAULT_MAX_CLIENTS,
+            connect_rate: 0,
+            password: None,
+            tls_cert: None,
+            tls_key: None,
+            tls_min_version: TlsVersion::default(),
+            shutdown_grace: DEFAULT_SHUTDOWN_GRACE,
+            admin_token: None,
+            ban_file: None,
+            store: None,
+            reserved_names: parse_list(None, DEFAULT_RESERVED_NAMES),
+            motd: None,
+            log_file: None,
+            log_strict: false,
+            metrics_addr: None,
+            health_addr: None,
+            session_grace: DEFAULT_SESSION_GRACE,
+            session_max_held: DEFAULT_SESSION_MAX_HELD,
+            name_cooldown: DEFAULT_NAME_COOLDOWN,
+            filter_file: None,
+            notify: Notify::default(),
+            aliases: Aliases::default(),
+            ts_format: TimestampFormat::default(),
+        }
+    }
+}
+
+/// A duration written as `500ms`, `30s`, `10m` or `1h`; a bare number means seconds.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+struct HumanDuration(Duration);
+
+impl FromStr for HumanDuration {
+    type Err = ();
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        let s = s.trim();
+        // "ms" must be tried before "s" and "m"
+        let (digits, unit_ms) = [("ms", 1), ("s", 1_000), ("m", 60_000), ("h", 3_600_000)]
+            .into_iter()
+            .find_map(|(suffix, unit_ms)| s.strip_suffix(suffix).map(|n| (n, unit_ms)))
+            .unwrap_or((s, 1_000));
+        let n: u64 = digits.trim().parse().map_err(|_| ())?;
+        n.checked_mul(unit_ms)
+            .map(|ms| Self(Duration::from_millis(ms)))
+            .ok_or(())
+    }
+}
+
+impl Display for HumanDuration {
+    fn fmt(&self, f: &mut Formatter<'_>) -> std::fmt::Result {
+        write!(f, "{:?}", self.0)
+    }
+}
+
+/// Which presence changes rooms are told of: `x joined #room` and
+/// `x left #room`.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct Notify {
+    pub joins: bool,
+    pub leaves: bool,
+}
+
+impl Default for Notify {
+    fn default() -> Self {
+        Self {
+            joins: true,
+            leaves: true,
+        }
+    }
+}
+
+impl FromStr for Notify {
+    type Err = ();
+
+    /// `join`, `leave` or both, comma separated, or `none` alone.
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        let kinds = parse_list(Some(s), &[]);
+        if kinds.is_empty() {
+            return Err(());
+        }
+        if kinds.iter().all(|kind| kind.eq_ignore_ascii_case("none")) {
+            return Ok(Self {
+                joins: false,
+                leaves: false,
+            });
+        }
+        kinds.iter().try_fold(
+            Self {
+                joins: false,
+                leaves: false,
+            },
+            |notify, kind| match kind.to_lowercase().as_str() {
+                "join" => Ok(Self { joins: true, ..notify }),
+                "leave" => Ok(Self { leaves: true, ..notify }),
+                _ => Err(()),
+            },
+        )
+    }
+}
+
+/// The config file key for the environment variable `name`.
+fn file_key(name: &str) -> String {
+    name.strip_prefix("CHAT_").unwrap_or(name).to_lowercase()
+}
+
+fn parse<T: FromStr>(raw: &str, expected: &str) -> Result<T, String> {
+    raw.trim().parse().map_err(|_| format!("{raw:?} is not {expected}"))
+}
+
+fn parse_duration(raw: &str) -> Result<Duration, String> {
+    parse::<HumanDuration>(raw, "a duration like 500ms, 30s, 10m or 1h").map(|d| d.0)
+}
+
+/// The socket path in `unix:PATH`; blank means TCP.
+fn parse_listen(raw: &str) -> Result<Option<PathBuf>, String> {
+    non_empty(raw)
+        .map(|listen| {
+            listen
+                .strip_prefix("unix:")
+                .filter(|path| !path.is_empty())
+                .map(PathBuf::from)
+                .ok_or_else(|| format!("{raw:?} is not unix:PATH"))
+        })
+        .transpose()
+}
+
+/// The database path in `sqlite:PATH`; `memory` or blank means none.
+fn parse_store(raw: &str) -> Result<Option<PathBuf>, String> {
+    non_empty(raw)
+        .filter(|store| !store.eq_ignore_ascii_case("memory"))
+        .map(|store| {
+            store
+                .strip_prefix("sqlite:")
+                .filter(|path| !path.is_empty())
+                .map(PathBuf::from)
+                .ok_or_else(|| format!("{raw:?} is not memory or sqlite:PATH"))
+        })
+        .transpose()
+}
+
+/// `1`, `true`, `yes` or `on` for on; `0`, `false`, `no`, `off` or blank for off.
+fn parse_switch(raw: &str) -> Result<bool, String> {
+    let raw = raw.trim();
+    if ["1", "true", "yes", "on"].iter().any(|on| raw.eq_ignore_ascii_case(on)) {
+        Ok(true)
+    } else if ["", "0", "false", "no", "off"]
+        .iter()
+        .any(|off| raw.eq_ignore_ascii_case(off))
+    {
+        Ok(false)
+    } else {
+        Err(format!("{raw:?} is not 1 or 0"))
+    }
+}
+
+fn non_empty(raw: &str) -> Option<String> {
+    Some(raw.trim().to_string()).filter(|raw| !raw.is_empty())
+}
+
+fn read_motd(path: &Path) -> Result<Option<String>, String> {
+    fs::read_to_string(path)
+        .map(|motd| Some(motd).filter(|motd| !motd.trim().is_empty()))
+        .map_err(|e| format!("cannot read {}: {e}", path.display()))
+}
+
+/// Reads `#room=N` pairs, as in `#dev=200,#random=0`; the `#` is optional.
+fn parse_room_sizes(raw: &str) -> Result<Vec<(ChannelName, usize)>, String> {
+    parse_list(Some(raw), &[])
+        .iter()
+        .map(|pair| {
+            let (room, size) = pair.split_once('=').ok_or_else(|| format!("{pair:?} is not #room=N"))?;
+            let room = ChannelName::new(room).map_err(|e| format!("{room:?}: {e}"))?;
+            Ok((room, parse(size, "a whole number")?))
+        })
+        .collect()
+}
+
+/// `#room rate=N burst=N len=N` entries, comma separated; see [`RoomPolicy`].
+fn parse_room_policies(raw: &str) -> Result<Vec<(ChannelName, RoomPolicy)>, String> {
+    parse_list(Some(raw), &[])
+        .iter()
+        .map(|entry| {
+            let (room, policy) = entry
+                .split_once(char::is_whitespace)
+                .ok_or_else(|| format!("{entry:?} is not #room followed by its limits"))?;
+            let room = ChannelName::new(room).map_err(|e| format!("{room:?}: {e}"))?;
+            Ok((room, policy.parse().map_err(|e| format!("{entry:?}: {e}"))?))
+        })
+        .collect()
+}
+
+/// Splits a comma separated list, dropping blank entries.
+fn parse_list(raw: Option<&str>, default: &[&str]) -> Vec<String> {
+    raw.map_or_else(
+        || default.iter().map(ToString::to_string).collect(),
+        |raw| {
+            raw.split(',')
+                .map(str::trim)
+                .filter(|name| !name.is_empty())
+                .map(str::to_string)
+                .collect()
+        },
+    )
+}
+
+/// The config file: a flat mapping with a key for each setting it sets, as
+/// [`file_key`] names them.
+#[derive(Debug, Default, Deserialize)]
+#[serde(default, deny_unknown_fields)]
+struct ConfigFile {
+    host: FileValue,
+    port: FileValue,
+    listen: FileValue,
+    history_size: FileValue,
+    room_history_sizes: FileValue,
+    ping_interval: FileValue,
+    pong_timeout: FileValue,
+    idle_timeout: FileValue,
+    read_timeout: FileValue,
+    write_timeout: FileValue,
+    rate_limit: FileValue,
+    rate_burst: FileValue,
+    max_msg_len: FileValue,
+    room_policies: FileValue,
+    max_file_size: FileValue,
+    file_quota: FileValue,
+    max_clients: FileValue,
+    connect_rate: FileValue,
+    password: FileValue,
+    tls_cert: FileValue,
+    tls_key: FileValue,
+    tls_min_version: FileValue,
+    shutdown_grace: FileValue,
+    admin_token: FileValue,
+    banfile: FileValue,
+    store: FileValue,
+    reserved_names: FileValue,
+    motd_file: FileValue,
+    motd: FileValue,
+    log_file: FileValue,
+    log_strict: FileValue,
+    metrics_addr: FileValue,
+    health_addr: FileValue,
+    session_grace: FileValue,
+    session_max_held: FileValue,
+    name_cooldown: FileValue,
+    filter_file: FileValue,
+    notify: FileValue,
+    aliases: FileValue,
+    ts_format: FileValue,
+}
+
+impl ConfigFile {
+    /// Reads `text`; an empty file, or one of comments alone, sets nothing.
+    fn parse(text: &str) -> Result<Self, serde_yaml::Error> {
+        serde_yaml::from_str::<Option<Self>>(text).map(Option::unwrap_or_default)
+    }
+
+    /// Each setting with its value in the file, in [`SETTINGS`] order.
+    const fn entries(&self) -> [(&'static str, &FileValue); SETTINGS.len()] {
+        [
+            (consts::ENV_CHAT_HOST, &self.host),
+            (consts::ENV_CHAT_PORT, &self.port),
+            (consts::ENV_CHAT_LISTEN, &self.listen),
+            (consts::ENV_CHAT_HISTORY_SIZE, &self.history_size),
+            (consts::ENV_CHAT_ROOM_HISTORY_SIZES, &self.room_history_sizes),
+            (consts::ENV_CHAT_PING_INTERVAL, &self.ping_interval),
+            (consts::ENV_CHAT_PONG_TIMEOUT, &self.pong_timeout),
+            (consts::ENV_CHAT_IDLE_TIMEOUT, &self.idle_timeout),
+            (consts::ENV_CHAT_READ_TIMEOUT, &self.read_timeout),
+            (consts::ENV_CHAT_WRITE_TIMEOUT, &self.write_timeout),
+            (consts::ENV_CHAT_RATE_LIMIT, &self.rate_limit),
+            (consts::ENV_CHAT_RATE_BURST, &self.rate_burst),
+            (consts::ENV_CHAT_MAX_MSG_LEN, &self.max_msg_len),
+            (consts::ENV_CHAT_ROOM_POLICIES, &self.room_policies),
+            (consts::ENV_CHAT_MAX_FILE_SIZE, &self.max_file_size),
+            (consts::ENV_CHAT_FILE_QUOTA, &self.file_quota),
+            (consts::ENV_CHAT_MAX_CLIENTS, &self.max_clients),
+            (consts::ENV_CHAT_CONNECT_RATE, &self.connect_rate),
+            (consts::ENV_CHAT_PASSWORD, &self.password),
+            (consts::ENV_CHAT_TLS_CERT, &self.tls_cert),
+            (consts::ENV_CHAT_TLS_KEY, &self.tls_key),
+            (consts::ENV_CHAT_TLS_MIN_VERSION, &self.tls_min_version),
+            (consts::ENV_CHAT_SHUTDOWN_GRACE, &self.shutdown_grace),
+            (consts::ENV_CHAT_ADMIN_TOKEN, &self.admin_token),
+            (consts::ENV_CHAT_BANFILE, &self.banfile),
+            (consts::ENV_CHAT_STORE, &self.store),
+            (consts::ENV_CHAT_RESERVED_NAMES, &self.reserved_names),
+            (consts::ENV_CHAT_MOTD_FILE, &self.motd_file),
+            (consts::ENV_CHAT_MOTD, &self.motd),
+            (consts::ENV_CHAT_LOG_FILE, &self.log_file),
+            (consts::ENV_CHAT_LOG_STRICT, &self.log_strict),
+            (consts::ENV_CHAT_METRICS_ADDR, &self.metrics_addr),
+            (consts::ENV_CHAT_HEALTH_ADDR, &self.health_addr),
+            (consts::ENV_CHAT_SESSION_GRACE, &self.session_grace),
+            (consts::ENV_CHAT_SESSION_MAX_HELD, &self.session_max_held),
+            (consts::ENV_CHAT_NAME_COOLDOWN, &self.name_cooldown),
+            (consts::ENV_CHAT_FILTER_FILE, &self.filter_file),
+            (consts::ENV_CHAT_NOTIFY, &self.notify),
+            (consts::ENV_CHAT_ALIASES, &self.aliases),
+            (consts::ENV_CHAT_TS_FORMAT, &self.ts_format),
+        ]
+    }
+}
+
+/// A setting's value in the config file, as the text its environment
+/// variable would hold.
+#[derive(Debug, Default, PartialEq, Eq)]
+enum FileValue {
+    #[default]
+    Unset,
+    Set(String),
+}
+
+impl<'de> Deserialize<'de> for FileValue {
+    fn deserialize<D: Deserializer<'de>>(deserializer: D) -> Result<Self, D::Error> {
+        let value = serde_yaml::Value::deserialize(deserializer)?;
+        raw_value(&value, true).map(Self::Set).map_err(de::Error::custom)
+    }
+}
+
+/// `value` as text: a scalar as written, nothing as empty text and, where
+/// `list` allows, a list of scalars joined with commas.
+fn raw_value(value: &serde_yaml::Value, list: bool) -> Result<String, String> {
+    use serde_yaml::Value;
+    match value {
+        Value::Null => Ok(String::new()),
+        Value::Bool(b) => Ok(b.to_string()),
+        Value::Number(n) => Ok(n.to_string()),
+        Value::String(s) => Ok(s.clone()),
+        Value::Sequence(items) if list => items
+            .iter()
+            .map(|item| raw_value(item, false))
+            .collect::<Result<Vec<_>, _>>()
+            .map(|items| items.join(",")),
+        Value::Sequence(_) | Value::Mapping(_) | Value::Tagged(_) => Err("nested values are not supported".to_string()),
+    }
+}
+
+#[cfg(test)]
+#[allow(clippy::unwrap_used)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_parse() {
+        assert_eq!(parse::<usize>(" 10 ", "n"), Ok(10));
+        assert_eq!(parse::<usize>("0", "n"), Ok(0));
+        assert_eq!(
+            parse::<usize>("lots", "a number"),
+            Err("\"lots\" is not a number".to_string())
+        );
+        assert!(parse::<usize>("-1", "n").is_err());
+    }
+
+    #[test]
+    fn test_set() {
+        let mut config = Config::default();
+        assert_eq!(config.set(consts::ENV_CHAT_PORT, " 9000 "), Ok(()));
+        assert_eq!(config.port, 9000);
+        assert!(config.set(consts::ENV_CHAT_PORT, "70000").is_err());
+        assert_eq!(config.port, 9000);
+        assert_eq!(config.set(consts::ENV_CHAT_PING_INTERVAL, "250ms"), Ok(()));
+        assert_eq!(config.ping_interval, Duration::from_millis(250));
+        assert_eq!(config.set(consts::ENV_CHAT_SESSION_GRACE, "0"), Ok(()));
+        assert_eq!(config.session_grace, Duration::ZERO);
+        assert_eq!(config.set(consts::ENV_CHAT_SESSION_MAX_HELD, "2"), Ok(()));
+        assert_eq!(config.session_max_held, 2);
+        assert_eq!(config.name_cooldown, DEFAULT_NAME_COOLDOWN);
+        assert_eq!(config.set(consts::ENV_CHAT_NAME_COOLDOWN, "0"), Ok(()));
+        assert_eq!(config.name_cooldown, Duration::ZERO);
+        assert_eq!(config.set(consts::ENV_CHAT_CONNECT_RATE, "30"), Ok(()));
+        assert_eq!(config.connect_rate, 30);
+        assert_eq!(config.set(consts::ENV_CHAT_MAX_FILE_SIZE, "0"), Ok(()));
+        assert_eq!(config.max_file_size, 0);
+        assert!(config.set(consts::ENV_CHAT_FILE_QUOTA, "1MB").is_err());
+        assert_eq!(config.set(consts::ENV_CHAT_FILTER_FILE, " words.txt "), Ok(()));
+        assert_eq!(config.filter_file, Some(PathBuf::from("words.txt")));
+        assert_eq!(config.set(consts::ENV_CHAT_PASSWORD, ""), Ok(()));
+        assert_eq!(config.password, None);
+        assert_eq!(config.set(consts::ENV_CHAT_MOTD, "  "), Ok(()));
+        assert_eq!(config.motd, None);
+        assert!(config.set(consts::ENV_CHAT_METRICS_ADDR, "localhost").is_err());
+        assert_eq!(config.set(consts::ENV_CHAT_HEALTH_ADDR, "127.0.0.1:9101"), Ok(()));
+        assert_eq!(config.health_addr, Some("127.0.0.1:9101".parse().unwrap()));
+        assert!(config.set(consts::ENV_CHAT_HEALTH_ADDR, "localhost").is_err());
+        assert!(config.set(consts::ENV_CHAT_MOTD_FILE, "/nonexistent/motd").is_err());
+        assert!(config.set("CHAT_NOPE", "1").is_err());
+    }
+
+    #[test]
+    fn test_set_notify() {
+        let mut config = Config::default();
+        assert_eq!(
+            config.notify,
+            Notify {
+                joins: true,
+                leaves: true
+            }
+        );
+        assert_eq!(config.set(consts::ENV_CHAT_NOTIFY, "leave"), Ok(()));
+        assert_eq!(
+            config.notify,
+            Notify {
+                joins: false,
+                leaves: true
+            }
+        );
+        assert_eq!(config.set(consts::ENV_CHAT_NOTIFY, " Join , leave "), Ok(()));
+        assert_eq!(config.notify, Notify::default());
+        assert_eq!(config.set(consts::ENV_CHAT_NOTIFY, "none"), Ok(()));
+        assert_eq!(
+            config.notify,
+            Notify {
+                joins: false,
+                leaves: false
+            }
+        );
+        assert!(config.set(consts::ENV_CHAT_NOTIFY, "join,none").is_err());
+        assert!(config.set(consts::ENV_CHAT_NOTIFY, "").is_err());
+        assert!(config.set(consts::ENV_CHAT_NOTIFY, "joins").is_err());
+    }
+
+    #[test]
+    fn test_set_room_policies() {
+        let mut config = Config::default();
+        let raw = "#announcements rate=1 len=8192, #dev burst=20";
+        assert_eq!(config.set(consts::ENV_CHAT_ROOM_POLICIES, raw), Ok(()));
+        let rooms: Vec<String> = config.room_policies.iter().map(|(room, _)| room.to_string()).collect();
+        assert_eq!(rooms, ["#announcements", "#dev"]);
+        assert_eq!(
+            config.room_policies.first().map(|(_, policy)| policy.to_string()),
+            Some("rate=1 len=8192".to_string())
+        );
+        assert_eq!(config.set(consts::ENV_CHAT_ROOM_POLICIES, ""), Ok(()));
+        assert!(config.room_policies.is_empty());
+        assert!(config.set(consts::ENV_CHAT_ROOM_POLICIES, "#dev").is_err());
+        assert!(config.set(consts::ENV_CHAT_ROOM_POLICIES, "#dev rate=0").is_err());
+        assert!(config.set(consts::ENV_CHAT_ROOM_POLICIES, "dev! len=10").is_err());
+    }
+
+    #[test]
+    fn test_set_aliases() {
+        let mut config = Config::default();
+        assert_eq!(config.aliases, Aliases::default());
+        assert_eq!(config.set(consts::ENV_CHAT_ALIASES, "tell=dm"), Ok(()));
+        assert_eq!(config.aliases.summary().as_deref(), Some("/tell for dm"));
+        assert_eq!(config.set(consts::ENV_CHAT_ALIASES, ""), Ok(()));
+        assert_eq!(config.aliases.summary(), None);
+        assert!(config.set(consts::ENV_CHAT_ALIASES, "tell=shout").is_err());
+    }
+
+    #[test]
+    fn test_set_ts_format() {
+        let mut config = Config::default();
+        assert_eq!(config.ts_format, TimestampFormat::default());
+        assert_eq!(config.set(consts::ENV_CHAT_TS_FORMAT, "UnixMilli"), Ok(()));
+        assert_eq!(config.ts_format, "unixmilli".parse().unwrap());
+        assert_eq!(config.set(consts::ENV_CHAT_TS_FORMAT, "Jan _2 15:04:05.000"), Ok(()));
+        assert_eq!(config.set(consts::ENV_CHAT_TS_FORMAT, ""), Ok(()));
+        assert_eq!(config.ts_format, TimestampFormat::default());
+        let err = config.set(consts::ENV_CHAT_TS_FORMAT, "yyyy-mm-dd").unwrap_err();
+        assert!(err.contains("not a Go layout"), "{err}");
+        assert_eq!(config.ts_format, TimestampFormat::default());
+    }
+
+    #[test]
+    fn test_set_log_strict() {
+        let mut config = Config::default();
+        assert!(!config.log_strict);
+        assert_eq!(config.set(consts::ENV_CHAT_LOG_STRICT, "1"), Ok(()));
+        assert!(config.log_strict);
+        assert_eq!(config.set(consts::ENV_CHAT_LOG_STRICT, " off "), Ok(()));
+        assert!(!config.log_strict);
+        assert_eq!(config.set(consts::ENV_CHAT_LOG_STRICT, "TRUE"), Ok(()));
+        assert!(config.log_strict);
+        assert!(config.set(consts::ENV_CHAT_LOG_STRICT, "sometimes").is_err());
+        assert!(config.log_strict);
+    }
+
+    #[test]
+    fn test_set_listen() {
+        let mut config = Config::default();
+        assert_eq!(config.set(consts::ENV_CHAT_HOST, "[::1]"), Ok(()));
+        assert_eq!(config.host, "::1");
+        assert_eq!(config.set(consts::ENV_CHAT_LISTEN, "unix:/tmp/chat.sock"), Ok(()));
+        assert_eq!(config.listen, Some(PathBuf::from("/tmp/chat.sock")));
+        assert!(config.set(consts::ENV_CHAT_LISTEN, "/tmp/chat.sock").is_err());
+        assert!(config.set(consts::ENV_CHAT_LISTEN, "unix:").is_err());
+        assert_eq!(config.set(consts::ENV_CHAT_LISTEN, ""), Ok(()));
+        assert_eq!(config.listen, None);
+    }
+
+    #[test]
+    fn test_set_store() {
+        let mut config = Config::default();
+        assert_eq!(config.store, None);
+        assert_eq!(config.set(consts::ENV_CHAT_STORE, "sqlite:chat.db"), Ok(()));
+        assert_eq!(config.store, Some(PathBuf::from("chat.db")));
+        assert!(config.set(consts::ENV_CHAT_STORE, "sqlite:").is_err());
+        assert!(config.set(consts::ENV_CHAT_STORE, "postgres://db").is_err());
+        assert_eq!(config.store, Some(PathBuf::from("chat.db")));
+        assert_eq!(config.set(consts::ENV_CHAT_STORE, " Memory "), Ok(()));
+        assert_eq!(config.store, None);
+    }
+
+    #[test]
+    fn test_config_file() {
+        let yaml = concat!(
+            "---\n",
+            "# comment\n",
+            "host: 0.0.0.0  # all interfaces\n",
+            "password: \"a \\\"b\\\" # c\"\n",
+            "admin_token: 'it''s'\n",
+            "reserved_names: [root, \"ops\"]\n",
+            "motd: |\n",
+            "  Be kind.\n",
+            "\n",
+            "    No spam.\n",
+            "\n",
+            "port: 9000\n",
+            "log_strict: true\n",
+            "banfile:\n",
+        );
+        let file = ConfigFile::parse(yaml).unwrap();
+        let value = |name: &str| {
+            file.entries()
+                .into_iter()
+                .find(|(setting, _)| *setting == name)
+                .map(|(_, value)| value)
+                .unwrap()
+        };
+        let set = |raw: &str| FileValue::Set(raw.to_string());
+        assert_eq!(value(consts::ENV_CHAT_HOST), &set("0.0.0.0"));
+        assert_eq!(value(consts::ENV_CHAT_PASSWORD), &set("a \"b\" # c"));
+        assert_eq!(value(consts::ENV_CHAT_ADMIN_TOKEN), &set("it's"));
+        assert_eq!(value(consts::ENV_CHAT_RESERVED_NAMES), &set("root,ops"));
+        assert_eq!(value(consts::ENV_CHAT_MOTD), &set("Be kind.\n\n  No spam.\n"));
+        assert_eq!(value(consts::ENV_CHAT_PORT), &set("9000"));
+        assert_eq!(value(consts::ENV_CHAT_LOG_STRICT), &set("true"));
+        assert_eq!(value(consts::ENV_CHAT_BANFILE), &set(""));
+        assert_eq!(value(consts::ENV_CHAT_MAX_CLIENTS), &FileValue::Unset);
+
+        assert!(ConfigFile::parse("port: 1\n  nested: 2\n").is_err());
+        assert!(ConfigFile::parse("port 1\n").is_err());
+        assert!(ConfigFile::parse("port: 1\nport: 2\n").is_err());
+        assert!(ConfigFile::parse("motd: \"open\n").is_err());
+        assert!(ConfigFile::parse("motd:\n  text: nested\n").is_err());
+        assert!(ConfigFile::parse("reserved_names: [[root]]\n").is_err());
+        let unknown = ConfigFile::parse("colour: blue\n").unwrap_err();
+        assert!(unknown.to_string().contains("colour"));
+        assert!(ConfigFile::parse("CHAT_PORT: 9000\n").is_err());
+        assert_eq!(
+            ConfigFile::parse("# nothing yet\n").unwrap().entries(),
+            ConfigFile::default().entries()
+        );
+    }
+
+    #[test]
+    fn test_config_file_has_every_setting() {
+        let names: Vec<&str> = ConfigFile::default().entries().iter().map(|(name, _)| *name).collect();
+        assert_eq!(names, SETTINGS);
+        for name in SETTINGS {
+            let file = ConfigFile::parse(&format!("{}: x\n", file_key(name))).unwrap();
+            let set: Vec<&str> = file
+                .entries()
+                .into_iter()
+                .filter(|(_, value)| **value != FileValue::Unset)
+                .map(|(name, _)| name)
+                .collect();
+            assert_eq!(set, [name]);
+        }
+    }
+
+    #[test]
+    fn test_apply_file() {
+        let mut config = Config::default();
+        let file = ConfigFile::parse("motd: from the file\nmax_clients: 20\nrate_limit: 3\n").unwrap();
+        config.apply_file(&file).unwrap();
+        assert_eq!(config.max_clients, 20);
+        assert_eq!(config.rate_per_second, 3);
+        assert_eq!(config.motd.as_deref(), Some("from the file"));
+        assert_eq!(config.history_size, DEFAULT_HISTORY_SIZE);
+
+        let invalid = |yaml: &str| match Config::default().apply_file(&ConfigFile::parse(yaml).unwrap()) {
+            Err(Error::Invalid { field, .. }) => Some(field),
+            _ => None,
+        };
+        assert_eq!(
+            invalid("history_size: 5\nmax_clients: many\nport: x\n").unwrap(),
+            "port"
+        );
+        assert_eq!(
+            invalid("room_history_sizes: [dev=lots]\n").unwrap(),
+            "room_history_sizes"
+        );
+    }
+
+    #[test]
+    fn test_validate() {
+        let field = |config: Config| match config.validate() {
+            Err(Error::Invalid { field, .. }) => Some(field),
+            _ => None,
+        };
+        assert_eq!(field(Config::default()), None);
+        assert_eq!(
+            field(Config {
+                rate_burst: 0,
+                max_msg_len: 0,
+                ..Config::default()
+            }),
+            Some("rate_burst".to_string())
+        );
+        assert_eq!(
+            field(Config {
+                pong_timeout: Duration::ZERO,
+                ..Config::default()
+            }),
+            Some("pong_timeout".to_string())
+        );
+        assert_eq!(
+            field(Config {
+                max_file_size: file::MAX_SIZE + 1,
+                ..Config::default()
+            }),
+            Some("max_file_size".to_string())
+        );
+        assert_eq!(
+            field(Config {
+                ping_interval: Duration::ZERO,
+                pong_timeout: Duration::ZERO,
+                ..Config::default()
+            }),
+            None
+        );
+        assert_eq!(
+            field(Config {
+                read_timeout: Duration::ZERO,
+                ..Config::default()
+            }),
+            Some("read_timeout".to_string())
+        );
+        assert_eq!(
+            field(Config {
+                write_timeout: Duration::ZERO,
+                ..Config::default()
+            }),
+            Some("write_timeout".to_string())
+        );
+        assert_eq!(
+            field(Config {
+                tls_cert: Some(PathBuf::from("cert.pem")),
+                ..Config::default()
+            }),
+            Some("tls_key".to_string())
+        );
+        assert_eq!(
+            field(Config {
+                listen: Some(PathBuf::from("/tmp/chat.sock")),
+                tls_cert: Some(PathBuf::from("cert.pem")),
+                tls_key: Some(PathBuf::from("key.pem")),
+                ..Config::default()
+            }),
+            Some("listen".to_string())
+        );
+    }
+
+    #[test]
+    fn test_reloaded() {
+        let current = Config {
+            motd: Some("old".to_string()),
+            ..Config::default()
+        };
+        let loaded = Config {
+            port: 9000,
+            motd: Some("new".to_string()),
+            rate_burst: 20,
+            reserved_names: Vec::new(),
+            ..Config::default()
+        };
+        let (reloaded, report) = current.reloaded(loaded);
+
+        assert_eq!(reloaded.port, DEFAULT_PORT);
+        assert_eq!(reloaded.motd.as_deref(), Some("new"));
+        assert_eq!(reloaded.rate_burst, 20);
+        assert!(reloaded.reserved_names.is_empty());
+        assert_eq!(
+            report.applied,
+            [
+                consts::ENV_CHAT_RATE_BURST,
+                consts::ENV_CHAT_RESERVED_NAMES,
+                consts::ENV_CHAT_MOTD
+            ]
+        );
+        assert_eq!(report.ignored, [consts::ENV_CHAT_PORT]);
+        assert_eq!(reloaded.reloaded(reloaded.clone()).1, Reload::default());
+    }
+
+    #[test]
+    fn test_parse_room_sizes() {
+        let dev = ChannelName::new("#dev").unwrap();
+        let random = ChannelName::new("#random").unwrap();
+        assert_eq!(
+            parse_room_sizes(" #Dev=200, random = 0 ,"),
+            Ok(vec![(dev, 200), (random, 0)])
+        );
+        assert_eq!(parse_room_sizes(""), Ok(Vec::new()));
+        assert!(parse_room_sizes("#dev").is_err());
+        assert!(parse_room_sizes("#dev=lots").is_err());
+        assert!(parse_room_sizes("#no room=5").is_err());
+    }
+
+    #[test]
+    fn test_parse_list() {
+        assert_eq!(parse_list(None, &["a", "b"]), vec!["a", "b"]);
+        assert_eq!(parse_list(Some(" root , ,Ops"), &["a"]), vec!["root", "Ops"]);
+        assert!(parse_list(Some(""), &["a"]).is_empty());
+    }
+
+    #[test]
+    fn test_human_duration() {
+        let parse = |s: &str| s.parse::<HumanDuration>().map(|d| d.0);
+        assert_eq!(parse("30"), Ok(Duration::from_secs(30)));
+        assert_eq!(parse("30s"), Ok(Duration::from_secs(30)));
+        assert_eq!(parse(" 10m "), Ok(Duration::from_secs(600)));
+        assert_eq!(parse("1h"), Ok(Duration::from_secs(3600)));
+        assert_eq!(parse("250ms"), Ok(Duration::from_millis(250)));
+        assert_eq!(parse("0"), Ok(Duration::ZERO));
+        assert!(parse("soon").is_err());
+        assert!(parse("-5s").is_err());
+        assert!(parse(&format!("{}h", u64::MAX)).is_err());
+    }
+}
@@ -0,0 +1,169 @@
+//! Optional liveness probe, for load balancers.
+//!
+//! Enabled by setting `CHAT_HEALTH_ADDR`, e.g. `127.0.0.1:9101`. The server
+//! is healthy while its chat listener is accepting connections and the
+//! message dispatcher is running; once shutdown begins it no longer is, so a
+//! balancer stops sending clients during the grace period.
+//!
+//! `GET /health` over HTTP is answered `200 OK` or `503 Service Unavailable`.
+//! A plain TCP probe sends a line, any line, and is answered `OK` or `FAIL`.
+//! Probes never join the chat, so they don't count towards
+//! `CHAT_MAX_CLIENTS`.
+
+use std::{
+    net::SocketAddr,
+    sync::atomic::{AtomicBool, Ordering},
+    time::Duration,
+};
+
+use tokio::{
+    io::{AsyncReadExt, AsyncWriteExt},
+    net::{TcpListener, TcpStream},
+    sync::watch,
+    time::timeout,
+};
+use tracing::{info, warn};
+
+use crate::{chat::broker::get_broker, metrics::request_line};
+
+/// How long a probe has to send its request.
+const REQUEST_TIMEOUT: Duration = Duration::from_secs(2);
+
+/// Longest request read; anything longer is not a probe.
+const MAX_REQUEST_LEN: usize = 4 * 1024;
+
+static ACCEPTING: AtomicBool = AtomicBool::new(false);
+
+/// Marks the chat listener as accepting for as long as it is held.
+#[must_use]
+pub struct Accepting;
+
+impl Accepting {
+    pub fn start() -> Self {
+        ACCEPTING.store(true, Ordering::Relaxed);
+        Self
+    }
+}
+
+impl Drop for Accepting {
+    fn drop(&mut self) {
+        ACCEPTING.store(false, Ordering::Relaxed);
+    }
+}
+
+async fn is_healthy() -> bool {
+    ACCEPTING.load(Ordering::Relaxed) && get_broker().is_dispatching().await
+}
+
+/// Answers probes on `listener` until `shutdown_rx` flips to true.
+pub async fn serve(listener: TcpListener, mut shutdown_rx: watch::Receiver<bool>) {
+    loop {
+        tokio::select! {
+            _ = shutdown_rx.changed() => {
+                if *shutdown_rx.borrow() {
+                    info!("Health server stopped");
+                    return;
+                }
+            }
+            accepted = listener.accept() => match accepted {
+                Ok((stream, addr)) => {
+                    tokio::spawn(async move {
+                        if let Err(e) = answer(stream).await {
+                            warn!("Health probe from {addr} failed: {e}");
+                        }
+                    });
+                }
+                Err(e) => warn!("Failed to accept health connection: {e}"),
+            },
+        }
+    }
+}
+
+/// Reads one probe and replies, closing the connection after.
+async fn answer(mut stream: TcpStream) -> std::io::Result<()> {
+    let mut request = Vec::new();
+    // an HTTP request is read to the end of its head, anything else to its first line
+    let _ = timeout(REQUEST_TIMEOUT, async {
+        let mut chunk = [0; 512];
+        while !is_complete(&request) && request.len() < MAX_REQUEST_LEN {
+            let n = stream.read(&mut chunk).await?;
+            if n == 0 {
+                break;
+            }
+            request.extend_from_slice(chunk.get(..n).unwrap_or_default());
+        }
+        Ok::<_, std::io::Error>(())
+    })
+    .await;
+
+    let healthy = is_healthy().await;
+    let response = if is_http(&request) {
+        match request_line(&request) {
+            Some(("GET" | "HEAD", "/health")) if healthy => http_response("200 OK", "OK\n"),
+            Some(("GET" | "HEAD", "/health")) => http_response("503 Service Unavailable", "FAIL\n"),
+            Some((_, "/health")) => http_response("405 Method Not Allowed", "only GET is supported\n"),
+            _ => http_response("404 Not Found", "try /health\n"),
+        }
+    } else if healthy {
+        "OK\n".to_string()
+    } else {
+        "FAIL\n".to_string()
+    };
+    stream.write_all(response.as_bytes()).await?;
+    stream.shutdown().await
+}
+
+fn is_http(request: &[u8]) -> bool {
+    let line = request.split(|&b| b == b'\n').next().unwrap_or_default();
+    line.windows(5).any(|w| w == b"HTTP/")
+}
+
+/// Whether all of the probe's request has arrived.
+fn is_complete(request: &[u8]) -> bool {
+    if is_http(request) {
+        request.windows(4).any(|w| w == b"\r\n\r\n")
+    } else {
+        request.contains(&b'\n')
+    }
+}
+
+fn http_response(status: &str, body: &str) -> String {
+    format!(
+        concat!(
+            "HTTP/1.1 {}\r\n",
+            "Content-Type: text/plain; charset=utf-8\r\n",
+            "Content-Length: {}\r\n",
+            "Connection: close\r\n\r\n{}"
+        ),
+        status,
+        body.len(),
+        body
+    )
+}
+
+/// Binds the health endpoint at `addr`, if configured.
+pub async fn bind(addr: Option<SocketAddr>) -> std::io::Result<Option<TcpListener>> {
+    let Some(addr) = addr else {
+        return Ok(None);
+    };
+    let listener = TcpListener::bind(addr).await?;
+    info!("Health checks answered at {addr}");
+    Ok(Some(listener))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_probe_kinds() {
+        let http = b"GET /health HTTP/1.1\r\nHost: a\r\n";
+        assert!(is_http(http));
+        assert!(!is_complete(http));
+        assert!(is_complete(b"GET /health HTTP/1.1\r\nHost: a\r\n\r\n"));
+
+        assert!(!is_http(b"PING\n"));
+        assert!(is_complete(b"PING\n"));
+        assert!(!is_complete(b"PI"));
+    }
+}
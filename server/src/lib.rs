@@ -0,0 +1,422 @@
+//! The chat server, to run from the `server` binary or in-process.
+//!
+//! [`Server::new`] takes a [`Config`] and [`Server::start`] binds the
+//! listeners and serves until the future it is given resolves. Port 0 picks an
+//! ephemeral port; [`Running::local_addr`] tells which. The user registry,
+//! rooms and bans are process-wide, so a process runs one server, and
+//! [`reload`] reconfigures whichever that is.
+
+mod chat;
+pub mod config;
+mod health;
+mod metrics;
+mod tls;
+
+#[cfg(unix)]
+use std::path::PathBuf;
+use std::{
+    fmt::{Display, Formatter},
+    io,
+    net::{IpAddr, Ipv4Addr, SocketAddr},
+    path::Path,
+    sync::Arc,
+};
+
+pub use chat::clock::{Clock, FixedClock};
+use chat::{ban::get_ban_list, broker::get_broker, connection::handle_connection};
+use common::{
+    consts::{self, MAX_CONNECTIONS},
+    tcp_message::{ServerMessage, WireEncode},
+};
+pub use config::Config;
+#[cfg(unix)]
+use tokio::net::{UnixListener, UnixStream};
+use tokio::{
+    io::{AsyncRead, AsyncWrite},
+    net::TcpListener,
+    sync::Semaphore,
+    task::JoinHandle,
+    time::{Duration, interval, sleep, timeout},
+};
+use tokio_rustls::TlsAcceptor;
+use tracing::{error, info, warn};
+
+/// How long closing connections get to flush once the grace period is over.
+const CONNECTION_DRAIN_TIMEOUT: Duration = Duration::from_secs(5);
+
+/// A server that has its configuration but is not listening yet.
+pub struct Server {
+    config: Arc<Config>,
+}
+
+/// What clients on a Unix socket are known by, e.g. to bans: they are all
+/// local, and can't be told apart by address.
+const UNIX_PEER: SocketAddr = SocketAddr::new(IpAddr::V4(Ipv4Addr::LOCALHOST), 0);
+
+/// A server that is accepting connections.
+pub struct Running {
+    local_addr: Option<SocketAddr>,
+    listening_on: String,
+    task: JoinHandle<()>,
+}
+
+impl Server {
+    /// Makes `config` the process's configuration. If one was installed
+    /// already, that one stays.
+    #[must_use]
+    pub fn new(config: Config) -> Self {
+        Self {
+            config: config::install(config),
+        }
+    }
+
+    /// Stamps what the server sends with `clock` rather than the system's,
+    /// e.g. a [`FixedClock`] for a test that checks timestamps. Like the
+    /// configuration, the first one installed stays.
+    #[must_use]
+    pub fn with_clock(self, clock: impl Clock + 'static) -> Self {
+        chat::clock::install(clock);
+        self
+    }
+
+    /// Binds the chat, metrics and health listeners and starts serving. Once
+    /// `shutdown` resolves, clients are warned, given the grace period and
+    /// closed.
+    ///
+    /// # Errors
+    ///
+    /// Returns why the server could not start: bad TLS material, an
+    /// unreadable filter file, a log file that can't be opened with
+    /// `CHAT_LOG_STRICT` set, a store that can't be opened, or an address
+    /// that can't be bound.
+    pub async fn start(
+        self,
+        shutdown: impl Future<Output = ()> + Send + 'static,
+    ) -> Result<Running, Box<dyn std::error::Error>> {
+        let config = self.config;
+        let tls_acceptor = tls::acceptor(&config)?;
+        if let Err(e) = chat::transcript::init(config.log_file.as_deref()) {
+            if config.log_strict {
+                return Err(format!("Cannot open {}: {e}", consts::ENV_CHAT_LOG_FILE).into());
+            }
+            warn!(
+                "Cannot open {}: {e}; carrying on without a transcript (set {} to refuse to start instead)",
+                consts::ENV_CHAT_LOG_FILE,
+                consts::ENV_CHAT_LOG_STRICT
+            );
+        }
+        chat::filter::init(config.filter_file.as_deref())
+            .map_err(|e| format!("Cannot read {}: {e}", consts::ENV_CHAT_FILTER_FILE))?;
+        chat::store::init(&config).map_err(|e| format!("Cannot open {}: {e}", consts::ENV_CHAT_STORE))?;
+        let listener = Listener::bind(&config).await?;
+        let local_addr = listener.local_addr()?;
+        let metrics_listener = metrics::bind(config.metrics_addr)
+            .await
+            .map_err(|e| format!("Cannot serve metrics: {e}"))?;
+        let health_listener = health::bind(config.health_addr)
+            .await
+            .map_err(|e| format!("Cannot serve health checks: {e}"))?;
+        if tls_acceptor.is_some() {
+            info!("Chat server listening on {listener} (TLS {}+)", config.tls_min_version);
+        } else {
+            info!("Chat server listening on {listener}");
+        }
+
+        let _broker = get_broker();
+        metrics::get_metrics().start();
+        // load the bans now rather than on the first join
+        let _bans = get_ban_list();
+        chat::broker::start_dispatcher().await;
+        info!("Message dispatcher started");
+
+        let listening_on = listener.to_string();
+        let task = tokio::spawn(serve_until(
+            listener,
+            tls_acceptor,
+            metrics_listener,
+            health_listener,
+            shutdown,
+            config,
+        ));
+        Ok(Running {
+            local_addr,
+            listening_on,
+            task,
+        })
+    }
+}
+
+/// Loads the configuration again, from the file at `path` if any and the
+/// environment, and puts the [reloadable](config::RELOADABLE) settings into
+/// effect.
+///
+/// Connected clients stay connected; other changes are logged and wait for
+/// a restart. If the new settings are invalid, or the word filter can't be
+/// read, everything stays as it was.
+pub fn reload(path: Option<&Path>) {
+    let loaded = match config::load(path) {
+        Ok(loaded) => loaded,
+        Err(e) => {
+            error!("Reload failed, keeping the current settings: {e}");
+            return;
+        }
+    };
+    let filter_changed = match chat::filter::init(loaded.filter_file.as_deref()) {
+        Ok(changed) => changed,
+        Err(e) => {
+            error!(
+                "Reload failed, keeping the current settings: cannot read {}: {e}",
+                consts::ENV_CHAT_FILTER_FILE
+            );
+            return;
+        }
+    };
+    let mut report = config::reload(loaded);
+    // the same file may have been edited, which the settings alone don't show
+    if filter_changed && !report.applied.contains(&consts::ENV_CHAT_FILTER_FILE) {
+        report.applied.push(consts::ENV_CHAT_FILTER_FILE);
+    }
+    get_broker()
+        .registry()
+        .set_reserved_names(&config::get_config().reserved_names);
+
+    if report.applied.is_empty() {
+        info!("Configuration reloaded, no changes");
+    } else {
+        info!("Configuration reloaded, changed: {}", report.applied.join(", "));
+    }
+    if !report.ignored.is_empty() {
+        warn!("Ignored until restart: {}", report.ignored.join(", "));
+    }
+}
+
+impl Running {
+    /// Where the chat listener is bound, or `None` on a Unix socket.
+    #[must_use]
+    pub const fn local_addr(&self) -> Option<SocketAddr> {
+        self.local_addr
+    }
+
+    /// Where the chat listener is bound, as the logs put it: an address
+    /// such as `127.0.0.1:54321`, or `unix:` and the socket's path.
+    #[must_use]
+    pub fn listening_on(&self) -> &str {
+        &self.listening_on
+    }
+
+    /// Resolves once the server has shut down.
+    pub async fn stopped(self) {
+        if let Err(e) = self.task.await {
+            error!("Server task failed: {e}");
+        }
+    }
+}
+
+/// Where clients connect: TCP on `CHAT_HOST:CHAT_PORT`, or the Unix socket
+/// `CHAT_LISTEN` names.
+enum Listener {
+    Tcp(TcpListener),
+    #[cfg(unix)]
+    Unix(UnixListener, PathBuf),
+}
+
+/// A client's connection, whichever listener it came in on.
+trait ClientStream: AsyncRead + AsyncWrite + Send + Unpin {}
+
+impl<T: AsyncRead + AsyncWrite + Send + Unpin> ClientStream for T {}
+
+impl Listener {
+    async fn bind(config: &Config) -> io::Result<Self> {
+        let Some(path) = &config.listen else {
+            return Ok(Self::Tcp(TcpListener::bind((config.host.as_str(), config.port)).await?));
+        };
+        #[cfg(unix)]
+        return Ok(Self::Unix(bind_unix(path).await?, path.clone()));
+        #[cfg(not(unix))]
+        return Err(io::Error::new(
+            io::ErrorKind::Unsupported,
+            format!("cannot listen on {}: no Unix sockets here", path.display()),
+        ));
+    }
+
+    fn local_addr(&self) -> io::Result<Option<SocketAddr>> {
+        match self {
+            Self::Tcp(listener) => listener.local_addr().map(Some),
+            #[cfg(unix)]
+            Self::Unix(..) => Ok(None),
+        }
+    }
+
+    async fn accept(&self) -> io::Result<(Box<dyn ClientStream>, SocketAddr)> {
+        match self {
+            Self::Tcp(listener) => {
+                let (stream, addr) = listener.accept().await?;
+                Ok((Box::new(stream), addr))
+            }
+            #[cfg(unix)]
+            Self::Unix(listener, _) => {
+                let (stream, _) = listener.accept().await?;
+                Ok((Box::new(stream), UNIX_PEER))
+            }
+        }
+    }
+
+    /// Stops listening. A Unix socket's file goes too, so the next server
+    /// can bind it.
+    fn close(self) {
+        #[cfg(unix)]
+        if let Self::Unix(listener, path) = self {
+            drop(listener);
+            if let Err(e) = std::fs::remove_file(&path) {
+                warn!("Failed to remove {}: {e}", path.display());
+            }
+        }
+    }
+}
+
+impl Display for Listener {
+    fn fmt(&self, f: &mut Formatter<'_>) -> std::fmt::Result {
+        match self {
+            Self::Tcp(listener) => match listener.local_addr() {
+                Ok(addr) => write!(f, "{addr}"),
+                Err(_) => write!(f, "TCP"),
+            },
+            #[cfg(unix)]
+            Self::Unix(_, path) => write!(f, "unix:{}", path.display()),
+        }
+    }
+}
+
+/// Binds the Unix socket at `path`, replacing the file a server that did not
+/// shut down cleanly left behind, but not one that still answers.
+#[cfg(unix)]
+async fn bind_unix(path: &Path) -> io::Result<UnixListener> {
+    match UnixListener::bind(path) {
+        Err(e) if e.kind() == io::ErrorKind::AddrInUse && UnixStream::connect(path).await.is_err() => {
+            std::fs::remove_file(path)?;
+            UnixListener::bind(path)
+        }
+        bound => bound,
+    }
+}
+
+async fn serve_until(
+    listener: Listener,
+    tls_acceptor: Option<TlsAcceptor>,
+    metrics_listener: Option<TcpListener>,
+    health_listener: Option<TcpListener>,
+    shutdown: impl Future<Output = ()> + Send,
+    config: Arc<Config>,
+) {
+    let connection_semaphore = Arc::new(Semaphore::new(MAX_CONNECTIONS));
+    info!("Max concurrent connections: {MAX_CONNECTIONS}");
+
+    let (shutdown_tx, shutdown_rx) = tokio::sync::watch::channel(false);
+    let metrics_server = metrics_listener.map(|listener| tokio::spawn(metrics::serve(listener, shutdown_rx.clone())));
+    let health_server = health_listener.map(|listener| tokio::spawn(health::serve(listener, shutdown_rx.clone())));
+
+    tokio::select! {
+        () = accept_connections(&listener, tls_acceptor, Arc::clone(&connection_semaphore), shutdown_rx) => {}
+        () = shutdown => {
+            info!("Shutting down server...");
+        }
+    }
+
+    // stop accepting, warn everyone, then close
+    listener.close();
+    let grace = config.shutdown_grace;
+    let notice = ServerMessage::ShuttingDown {
+        seconds: grace.as_secs().saturating_add(u64::from(grace.subsec_nanos() > 0)),
+    };
+    if let Err(e) = get_broker().forward_to_everyone(notice.encode()) {
+        warn!("Failed to announce shutdown: {e}");
+    }
+    sleep(grace).await;
+    let _ = shutdown_tx.send(true);
+    drain_connections(&connection_semaphore).await;
+    if let Some(metrics_server) = metrics_server
+        && let Err(e) = metrics_server.await
+    {
+        warn!("Metrics server did not stop cleanly: {e}");
+    }
+    if let Some(health_server) = health_server
+        && let Err(e) = health_server.await
+    {
+        warn!("Health server did not stop cleanly: {e}");
+    }
+
+    get_broker().shutdown().await;
+    info!("Server shutdown complete");
+}
+
+/// Waits for every connection task to finish, i.e. to hand back its permit.
+async fn drain_connections(semaphore: &Semaphore) {
+    let Ok(all) = u32::try_from(MAX_CONNECTIONS) else {
+        return;
+    };
+    if timeout(CONNECTION_DRAIN_TIMEOUT, semaphore.acquire_many(all))
+        .await
+        .is_err()
+    {
+        warn!("Some connections did not close within {CONNECTION_DRAIN_TIMEOUT:?}");
+    }
+}
+
+async fn accept_connections(
+    listener: &Listener,
+    tls_acceptor: Option<TlsAcceptor>,
+    semaphore: Arc<Semaphore>,
+    shutdown_rx: tokio::sync::watch::Receiver<bool>,
+) {
+    // dropped, and so unhealthy, once the loop returns or shutdown cancels it
+    let _accepting = health::Accepting::start();
+    let mut error_backoff = interval(Duration::from_millis(100));
+    loop {
+        let permit = if let Ok(p) = semaphore.clone().try_acquire_owned() {
+            p
+        } else {
+            warn!("Connection limit reached ({MAX_CONNECTIONS}), waiting...");
+            let Ok(p) = semaphore.clone().acquire_owned().await else {
+                error!("Semaphore closed unexpectedly");
+                return;
+            };
+            p
+        };
+
+        // Now accept — we have capacity
+        if let Ok((stream, sock_addr)) = listener.accept().await {
+            let conn_shutdown_rx = shutdown_rx.clone();
+            let tls_acceptor = tls_acceptor.clone();
+            tokio::spawn(async move {
+                let _permit = permit;
+                serve(stream, sock_addr, tls_acceptor, conn_shutdown_rx).await;
+            });
+        } else {
+            error!("Failed to accept connection");
+            error_backoff.tick().await;
+        }
+    }
+}
+
+/// Runs the TLS handshake first when TLS is enabled, then hands the
+/// connection to the chat state machine.
+async fn serve(
+    stream: Box<dyn ClientStream>,
+    addr: SocketAddr,
+    tls_acceptor: Option<TlsAcceptor>,
+    shutdown_rx: tokio::sync::watch::Receiver<bool>,
+) {
+    let Some(acceptor) = tls_acceptor else {
+        let (reader, writer) = tokio::io::split(stream);
+        handle_connection(Box::new(reader), Box::new(writer), addr, shutdown_rx).await;
+        return;
+    };
+    match timeout(tls::HANDSHAKE_TIMEOUT, acceptor.accept(stream)).await {
+        Ok(Ok(tls_stream)) => {
+            let (reader, writer) = tokio::io::split(tls_stream);
+            handle_connection(Box::new(reader), Box::new(writer), addr, shutdown_rx).await;
+        }
+        Ok(Err(e)) => warn!("TLS handshake with {addr} failed: {e}"),
+        Err(_) => warn!("TLS handshake with {addr} timed out"),
+    }
+}
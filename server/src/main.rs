@@ -1,87 +1,74 @@
-mod chat;
+use std::path::PathBuf;
 
-use std::{env, sync::Arc};
+use clap::Parser;
+use common::{consts, telemetry};
+use server::{Server, config};
+use tracing::{error, info};
 
-use chat::{broker::get_broker, connection::handle_connection};
-use common::{consts::MAX_CONNECTIONS, telemetry};
-use tokio::{
-    net::TcpListener,
-    sync::Semaphore,
-    time::{Duration, interval},
-};
-use tracing::{error, info, warn};
-
-const DEFAULT_HOST: &str = "127.0.0.1";
-const DEFAULT_PORT: &str = "8080";
+#[derive(Parser, Debug)]
+#[command(author, version, about = "Chat server")]
+struct Args {
+    /// YAML file with settings; environment variables override it
+    #[arg(long, env = consts::ENV_CHAT_CONFIG)]
+    config: Option<PathBuf>,
+}
 
 #[tokio::main]
 async fn main() -> Result<(), Box<dyn std::error::Error>> {
+    let args = Args::parse();
     let _guard = telemetry::init_logging().map_err(|e| format!("Failed to initialize logging: {e}"))?;
+    let config = config::load(args.config.as_deref()).map_err(|e| format!("Invalid configuration: {e}"))?;
+    let running = Server::new(config).start(shutdown_signal()).await?;
+    // registered before anyone can know the port, so no SIGHUP finds the default action
+    #[cfg(unix)]
+    match tokio::signal::unix::signal(tokio::signal::unix::SignalKind::hangup()) {
+        Ok(hangup) => {
+            tokio::spawn(reload_on_hangup(hangup, args.config));
+        }
+        Err(e) => error!("Failed to listen for SIGHUP: {e}"),
+    }
+    // a line of its own, whatever the log format, for scripts to find the port 0 picked
+    println!("Listening on {}", running.listening_on());
+    running.stopped().await;
+    Ok(())
+}
 
-    let host = env::var("CHAT_HOST").unwrap_or_else(|_| DEFAULT_HOST.to_string());
-    let port = env::var("CHAT_PORT").unwrap_or_else(|_| DEFAULT_PORT.to_string());
-    let addr = format!("{host}:{port}");
-
-    let listener = TcpListener::bind(&addr).await?;
-    info!("Chat server listening on {addr}");
-
-    let _broker = get_broker();
-    chat::broker::start_dispatcher().await;
-    info!("Message dispatcher started");
-
-    let connection_semaphore = Arc::new(Semaphore::new(MAX_CONNECTIONS));
-    info!("Max concurrent connections: {MAX_CONNECTIONS}");
-
-    let (shutdown_tx, shutdown_rx) = tokio::sync::watch::channel(false);
+/// Reloads the configuration from `path` and the environment on every SIGHUP.
+#[cfg(unix)]
+async fn reload_on_hangup(mut hangup: tokio::signal::unix::Signal, path: Option<PathBuf>) {
+    while hangup.recv().await.is_some() {
+        info!("SIGHUP received, reloading configuration");
+        server::reload(path.as_deref());
+    }
+}
 
-    let shutdown = async {
+/// Resolves on CTRL+C or, on Unix, SIGTERM.
+async fn shutdown_signal() {
+    let ctrl_c = async {
         if let Err(e) = tokio::signal::ctrl_c().await {
             error!("Failed to listen for CTRL+C: {e}");
+            std::future::pending::<()>().await;
         }
-        info!("Shutdown signal received");
     };
 
-    tokio::select! {
-        () = accept_connections(&listener, connection_semaphore, shutdown_rx) => {}
-        () = shutdown => {
-            let _ = shutdown_tx.send(true);
-            info!("Shutting down server...");
+    #[cfg(unix)]
+    let terminate = async {
+        match tokio::signal::unix::signal(tokio::signal::unix::SignalKind::terminate()) {
+            Ok(mut signal) => {
+                signal.recv().await;
+            }
+            Err(e) => {
+                error!("Failed to listen for SIGTERM: {e}");
+                std::future::pending::<()>().await;
+            }
         }
-    }
-
-    get_broker().shutdown().await;
-    info!("Server shutdown complete");
-    Ok(())
-}
-
-async fn accept_connections(
-    listener: &TcpListener,
-    semaphore: Arc<Semaphore>,
-    shutdown_rx: tokio::sync::watch::Receiver<bool>,
-) {
-    let mut error_backoff = interval(Duration::from_millis(100));
-    loop {
-        let permit = if let Ok(p) = semaphore.clone().try_acquire_owned() {
-            p
-        } else {
-            warn!("Connection limit reached ({MAX_CONNECTIONS}), waiting...");
-            let Ok(p) = semaphore.clone().acquire_owned().await else {
-                error!("Semaphore closed unexpectedly");
-                return;
-            };
-            p
-        };
+    };
+    #[cfg(not(unix))]
+    let terminate = std::future::pending::<()>();
 
-        // Now accept — we have capacity
-        if let Ok((tcp_stream, sock_addr)) = listener.accept().await {
-            let conn_shutdown_rx = shutdown_rx.clone();
-            tokio::spawn(async move {
-                let _permit = permit;
-                handle_connection(tcp_stream, sock_addr, conn_shutdown_rx).await;
-            });
-        } else {
-            error!("Failed to accept connection");
-            error_backoff.tick().await;
-        }
+    tokio::select! {
+        () = ctrl_c => {}
+        () = terminate => {}
     }
+    info!("Shutdown signal received");
 }
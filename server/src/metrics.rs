@@ -0,0 +1,379 @@
+//! Optional Prometheus metrics over HTTP.
+//!
+//! Enabled by setting `CHAT_METRICS_ADDR`, e.g. `127.0.0.1:9100`; scrape
+//! `GET /metrics` there for the text exposition format. The endpoint is plain
+//! HTTP even when chat runs over TLS, so bind it somewhere private.
+//!
+//! Connected clients are counted from the user registry on every scrape, so
+//! the gauge can't drift however connections end.
+//!
+//! The same counters back the operator `stats` command, which adds uptime and
+//! the process's resident memory.
+
+use std::{
+    fmt::Write as _,
+    net::SocketAddr,
+    sync::{
+        LazyLock, OnceLock,
+        atomic::{AtomicU64, Ordering},
+    },
+    time::{Duration, Instant},
+};
+
+use tokio::{
+    io::{AsyncReadExt, AsyncWriteExt},
+    net::{TcpListener, TcpStream},
+    sync::watch,
+    time::timeout,
+};
+use tracing::{info, warn};
+
+use crate::chat::broker::get_broker;
+
+/// How long a scraper has to send its request.
+const REQUEST_TIMEOUT: Duration = Duration::from_secs(5);
+
+/// Longest request head read; anything longer is not a scrape.
+const MAX_REQUEST_LEN: usize = 8 * 1024;
+
+static METRICS: LazyLock<Metrics> = LazyLock::new(Metrics::default);
+
+pub fn get_metrics() -> &'static Metrics {
+    &METRICS
+}
+
+/// Why a client was turned away at join.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Rejection {
+    ServerFull,
+    AuthenticationFailed,
+    Banned,
+    Throttled,
+}
+
+impl Rejection {
+    const ALL: [Self; 4] = [
+        Self::ServerFull,
+        Self::AuthenticationFailed,
+        Self::Banned,
+        Self::Throttled,
+    ];
+
+    const fn label(self) -> &'static str {
+        match self {
+            Self::ServerFull => "server_full",
+            Self::AuthenticationFailed => "authentication_failed",
+            Self::Banned => "banned",
+            Self::Throttled => "throttled",
+        }
+    }
+}
+
+#[derive(Debug, Default)]
+pub struct Metrics {
+    started: OnceLock<Instant>,
+    connections: AtomicU64,
+    broadcasts: AtomicU64,
+    joins: AtomicU64,
+    leaves: AtomicU64,
+    rejected: [AtomicU64; 4],
+}
+
+impl Metrics {
+    /// Starts the uptime clock; later calls leave it running.
+    pub fn start(&self) {
+        let _ = self.started.set(Instant::now());
+    }
+
+    /// A connection was accepted, whether or not it ever joins.
+    pub fn connected(&self) {
+        self.connections.fetch_add(1, Ordering::Relaxed);
+    }
+
+    /// A chat line was sent to a room.
+    pub fn broadcast(&self) {
+        self.broadcasts.fetch_add(1, Ordering::Relaxed);
+    }
+
+    pub fn joined(&self) {
+        self.joins.fetch_add(1, Ordering::Relaxed);
+    }
+
+    /// A user was unregistered, whether they left or their connection broke.
+    pub fn left(&self) {
+        self.leaves.fetch_add(1, Ordering::Relaxed);
+    }
+
+    pub fn rejected(&self, reason: Rejection) {
+        if let Some(counter) = self.rejected.get(reason as usize) {
+            counter.fetch_add(1, Ordering::Relaxed);
+        }
+    }
+
+    /// The Prometheus text exposition of every metric, `connected` being the
+    /// number of joined clients.
+    fn render(&self, connected: usize) -> String {
+        let unlabeled = |value: u64| [(String::new(), value)];
+        let rejected: Vec<_> = Rejection::ALL
+            .iter()
+            .zip(&self.rejected)
+            .map(|(reason, count)| {
+                (
+                    format!("{{reason=\"{}\"}}", reason.label()),
+                    count.load(Ordering::Relaxed),
+                )
+            })
+            .collect();
+
+        let mut out = String::new();
+        write_metric(
+            &mut out,
+            ("chat_connected_clients", "gauge", "Clients currently joined."),
+            &unlabeled(u64::try_from(connected).unwrap_or(u64::MAX)),
+        );
+        write_metric(
+            &mut out,
+            ("chat_connections_total", "counter", "Connections accepted."),
+            &unlabeled(self.connections.load(Ordering::Relaxed)),
+        );
+        write_metric(
+            &mut out,
+            ("chat_messages_broadcast_total", "counter", "Chat lines sent to a room."),
+            &unlabeled(self.broadcasts.load(Ordering::Relaxed)),
+        );
+        write_metric(
+            &mut out,
+            ("chat_joins_total", "counter", "Successful joins."),
+            &unlabeled(self.joins.load(Ordering::Relaxed)),
+        );
+        write_metric(
+            &mut out,
+            (
+                "chat_leaves_total",
+                "counter",
+                "Users gone, including dropped connections.",
+            ),
+            &unlabeled(self.leaves.load(Ordering::Relaxed)),
+        );
+        write_metric(
+            &mut out,
+            (
+                "chat_rejected_connections_total",
+                "counter",
+                "Clients turned away at join.",
+            ),
+            &rejected,
+        );
+        out
+    }
+
+    /// The lines of an operator's `stats` reply, `connected` being the
+    /// number of joined clients.
+    pub fn summary(&self, connected: usize) -> Vec<String> {
+        let uptime = self.started.get().map_or(Duration::ZERO, Instant::elapsed);
+        vec![
+            format!("Uptime: {}", format_uptime(uptime)),
+            format!("Connections served: {}", self.connections.load(Ordering::Relaxed)),
+            format!("Clients online: {connected}"),
+            format!("Messages broadcast: {}", self.broadcasts.load(Ordering::Relaxed)),
+            format!("Memory: {}", resident_memory().unwrap_or_else(|| "unknown".to_string())),
+        ]
+    }
+}
+
+/// `uptime` to the second, as in `2d 3h 0m 5s`, leading zero units dropped.
+fn format_uptime(uptime: Duration) -> String {
+    let secs = uptime.as_secs();
+    let units = [
+        (secs.div_euclid(86_400), "d"),
+        (secs.div_euclid(3_600).rem_euclid(24), "h"),
+        (secs.div_euclid(60).rem_euclid(60), "m"),
+        (secs.rem_euclid(60), "s"),
+    ];
+    // the seconds are always shown, even when zero
+    let first = units.iter().position(|&(n, _)| n > 0).unwrap_or(3);
+    units
+        .get(first..)
+        .unwrap_or_default()
+        .iter()
+        .map(|(n, unit)| format!("{n}{unit}"))
+        .collect::<Vec<_>>()
+        .join(" ")
+}
+
+/// The process's resident set size as the kernel reports it, e.g.
+/// `5120 kB`; `None` where `/proc` is not available.
+fn resident_memory() -> Option<String> {
+    let status = std::fs::read_to_string("/proc/self/status").ok()?;
+    status
+        .lines()
+        .find_map(|line| line.strip_prefix("VmRSS:"))
+        .map(|rss| rss.trim().to_string())
+}
+
+/// Appends one metric, given as name, type and help text, with a sample per
+/// label set.
+fn write_metric(out: &mut String, (name, kind, help): (&str, &str, &str), samples: &[(String, u64)]) {
+    let _ = writeln!(out, "# HELP {name} {help}");
+    let _ = writeln!(out, "# TYPE {name} {kind}");
+    for (labels, value) in samples {
+        let _ = writeln!(out, "{name}{labels} {value}");
+    }
+}
+
+/// Answers scrapes on `listener` until `shutdown_rx` flips to true.
+pub async fn serve(listener: TcpListener, mut shutdown_rx: watch::Receiver<bool>) {
+    loop {
+        tokio::select! {
+            _ = shutdown_rx.changed() => {
+                if *shutdown_rx.borrow() {
+                    info!("Metrics server stopped");
+                    return;
+                }
+            }
+            accepted = listener.accept() => match accepted {
+                Ok((stream, addr)) => {
+                    tokio::spawn(async move {
+                        if let Err(e) = answer(stream).await {
+                            warn!("Metrics request from {addr} failed: {e}");
+                        }
+                    });
+                }
+                Err(e) => warn!("Failed to accept metrics connection: {e}"),
+            },
+        }
+    }
+}
+
+/// Reads one request and replies, closing the connection after.
+async fn answer(mut stream: TcpStream) -> std::io::Result<()> {
+    let mut request = Vec::new();
+    let head = timeout(REQUEST_TIMEOUT, async {
+        let mut chunk = [0; 1024];
+        while !request.windows(4).any(|w| w == b"\r\n\r\n") && request.len() < MAX_REQUEST_LEN {
+            let n = stream.read(&mut chunk).await?;
+            if n == 0 {
+                break;
+            }
+            request.extend_from_slice(chunk.get(..n).unwrap_or_default());
+        }
+        Ok::<_, std::io::Error>(())
+    })
+    .await;
+    if !matches!(head, Ok(Ok(()))) {
+        return Ok(());
+    }
+
+    let response = match request_line(&request) {
+        Some(("GET", "/metrics")) => {
+            let connected = get_broker().registry().user_count().unwrap_or_else(|e| {
+                warn!("Cannot count connected clients: {e}");
+                0
+            });
+            http_response("200 OK", &get_metrics().render(connected))
+        }
+        Some((_, "/metrics")) => http_response("405 Method Not Allowed", "only GET is supported\n"),
+        _ => http_response("404 Not Found", "try /metrics\n"),
+    };
+    stream.write_all(response.as_bytes()).await?;
+    stream.shutdown().await
+}
+
+/// The method and path of an HTTP request, query string dropped.
+pub fn request_line(request: &[u8]) -> Option<(&str, &str)> {
+    let line = std::str::from_utf8(request).ok()?.lines().next()?;
+    let mut parts = line.split_whitespace();
+    let method = parts.next()?;
+    let target = parts.next()?;
+    Some((method, target.split('?').next().unwrap_or(target)))
+}
+
+fn http_response(status: &str, body: &str) -> String {
+    format!(
+        concat!(
+            "HTTP/1.1 {}\r\n",
+            "Content-Type: text/plain; version=0.0.4; charset=utf-8\r\n",
+            "Content-Length: {}\r\n",
+            "Connection: close\r\n\r\n{}"
+        ),
+        status,
+        body.len(),
+        body
+    )
+}
+
+/// Binds the metrics endpoint at `addr`, if configured.
+pub async fn bind(addr: Option<SocketAddr>) -> std::io::Result<Option<TcpListener>> {
+    let Some(addr) = addr else {
+        return Ok(None);
+    };
+    let listener = TcpListener::bind(addr).await?;
+    info!("Metrics available at http://{addr}/metrics");
+    Ok(Some(listener))
+}
+
+#[cfg(test)]
+#[allow(clippy::unwrap_used)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_render() {
+        let metrics = Metrics::default();
+        metrics.broadcast();
+        metrics.broadcast();
+        metrics.joined();
+        metrics.connected();
+        metrics.rejected(Rejection::Banned);
+        let text = metrics.render(3);
+
+        assert!(text.contains("# TYPE chat_connected_clients gauge\nchat_connected_clients 3\n"));
+        assert!(text.contains("chat_messages_broadcast_total 2\n"));
+        assert!(text.contains("chat_connections_total 1\n"));
+        assert!(text.contains("chat_joins_total 1\n"));
+        assert!(text.contains("chat_leaves_total 0\n"));
+        assert!(text.contains("chat_rejected_connections_total{reason=\"banned\"} 1\n"));
+        assert!(text.contains("chat_rejected_connections_total{reason=\"server_full\"} 0\n"));
+    }
+
+    #[test]
+    fn test_summary() {
+        let metrics = Metrics::default();
+        metrics.start();
+        metrics.connected();
+        metrics.connected();
+        metrics.broadcast();
+        let [uptime, connections, online, broadcasts, memory] = metrics.summary(1).try_into().unwrap();
+
+        assert!(uptime.starts_with("Uptime: "));
+        assert_eq!(connections, "Connections served: 2");
+        assert_eq!(online, "Clients online: 1");
+        assert_eq!(broadcasts, "Messages broadcast: 1");
+        assert!(memory.starts_with("Memory: "));
+    }
+
+    #[test]
+    fn test_format_uptime() {
+        assert_eq!(format_uptime(Duration::ZERO), "0s");
+        assert_eq!(format_uptime(Duration::from_millis(59_999)), "59s");
+        assert_eq!(format_uptime(Duration::from_secs(3_605)), "1h 0m 5s");
+        assert_eq!(format_uptime(Duration::from_secs(2 * 86_400 + 7)), "2d 0h 0m 7s");
+    }
+
+    #[cfg(target_os = "linux")]
+    #[test]
+    fn test_resident_memory() {
+        assert!(resident_memory().unwrap().ends_with("kB"));
+    }
+
+    #[test]
+    fn test_request_line() {
+        assert_eq!(
+            request_line(b"GET /metrics?x=1 HTTP/1.1\r\nHost: a\r\n\r\n"),
+            Some(("GET", "/metrics"))
+        );
+        assert_eq!(request_line(b"POST / HTTP/1.1\r\n\r\n"), Some(("POST", "/")));
+        assert_eq!(request_line(b""), None);
+        assert_eq!(request_line(b"\xff\xfe"), None);
+    }
+}
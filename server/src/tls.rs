@@ -0,0 +1,136 @@
+//! Optional TLS for client connections.
+//!
+//! Enabled by pointing `CHAT_TLS_CERT` and `CHAT_TLS_KEY` at PEM files. The
+//! chat protocol is unchanged; it simply runs inside the encrypted stream.
+
+use std::{
+    fmt::{Display, Formatter},
+    path::{Path, PathBuf},
+    str::FromStr,
+    sync::Arc,
+    time::Duration,
+};
+
+use common::consts::{ENV_CHAT_TLS_CERT, ENV_CHAT_TLS_KEY};
+use thiserror::Error as this_error;
+use tokio_rustls::{
+    TlsAcceptor,
+    rustls::{
+        self, ServerConfig, SupportedProtocolVersion,
+        pki_types::{CertificateDer, PrivateKeyDer, pem::PemObject},
+    },
+};
+
+use crate::config::Config;
+
+/// How long a client has to finish the TLS handshake.
+pub const HANDSHAKE_TIMEOUT: Duration = Duration::from_secs(10);
+
+#[derive(Debug, this_error)]
+pub enum Error {
+    #[error("{ENV_CHAT_TLS_CERT} and {ENV_CHAT_TLS_KEY} must be set together")]
+    Incomplete,
+
+    #[error("cannot load {}: {source}", path.display())]
+    Pem {
+        path: PathBuf,
+        source: rustls::pki_types::pem::Error,
+    },
+
+    #[error(transparent)]
+    Rustls(#[from] rustls::Error),
+}
+
+const TLS13_ONLY: &[&SupportedProtocolVersion] = &[&rustls::version::TLS13];
+
+/// Oldest protocol version the server will negotiate.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+pub enum TlsVersion {
+    #[default]
+    V1_2,
+    V1_3,
+}
+
+impl TlsVersion {
+    fn protocol_versions(self) -> &'static [&'static SupportedProtocolVersion] {
+        match self {
+            Self::V1_2 => rustls::ALL_VERSIONS,
+            Self::V1_3 => TLS13_ONLY,
+        }
+    }
+}
+
+impl FromStr for TlsVersion {
+    type Err = ();
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        match s.trim() {
+            "1.2" => Ok(Self::V1_2),
+            "1.3" => Ok(Self::V1_3),
+            _ => Err(()),
+        }
+    }
+}
+
+impl Display for TlsVersion {
+    fn fmt(&self, f: &mut Formatter<'_>) -> std::fmt::Result {
+        match self {
+            Self::V1_2 => write!(f, "1.2"),
+            Self::V1_3 => write!(f, "1.3"),
+        }
+    }
+}
+
+/// Builds an acceptor from the configured certificate and key, or `None`
+/// when TLS is not configured.
+pub fn acceptor(config: &Config) -> Result<Option<TlsAcceptor>, Error> {
+    let (cert_path, key_path) = match (&config.tls_cert, &config.tls_key) {
+        (None, None) => return Ok(None),
+        (Some(cert), Some(key)) => (cert, key),
+        _ => return Err(Error::Incomplete),
+    };
+
+    let certs = CertificateDer::pem_file_iter(cert_path)
+        .and_then(Iterator::collect::<Result<Vec<_>, _>>)
+        .map_err(|source| pem_error(cert_path, source))?;
+    let key = PrivateKeyDer::from_pem_file(key_path).map_err(|source| pem_error(key_path, source))?;
+
+    let server_config = ServerConfig::builder_with_protocol_versions(config.tls_min_version.protocol_versions())
+        .with_no_client_auth()
+        .with_single_cert(certs, key)?;
+    Ok(Some(TlsAcceptor::from(Arc::new(server_config))))
+}
+
+fn pem_error(path: &Path, source: rustls::pki_types::pem::Error) -> Error {
+    Error::Pem {
+        path: path.to_path_buf(),
+        source,
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_tls_version_parse() {
+        assert_eq!("1.2".parse(), Ok(TlsVersion::V1_2));
+        assert_eq!(" 1.3 ".parse(), Ok(TlsVersion::V1_3));
+        assert!("1.1".parse::<TlsVersion>().is_err());
+        assert_eq!(TlsVersion::default().to_string(), "1.2");
+    }
+
+    #[test]
+    fn test_acceptor_disabled_by_default() {
+        assert!(acceptor(&Config::default()).is_ok_and(|a| a.is_none()));
+    }
+
+    #[test]
+    fn test_acceptor_needs_cert_and_key() {
+        let config = Config {
+            tls_cert: Some(PathBuf::from("cert.pem")),
+            ..Config::default()
+        };
+        assert!(matches!(acceptor(&config), Err(Error::Incomplete)));
+    }
+}
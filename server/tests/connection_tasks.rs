@@ -0,0 +1,87 @@
+//! Checks that connections leave no tasks behind, however they end. A test
+//! binary of its own, so that the server runs with the configuration it
+//! builds: sessions off, which would each keep a task until they expire.
+
+#![allow(clippy::unwrap_used)]
+
+mod support;
+
+use std::time::Duration;
+
+use common::tcp_message::ClientMessage;
+use server::Config;
+use support::{Client, REPLY_TIMEOUT};
+use tokio::{net::TcpStream, time::timeout};
+
+/// Tasks alive on this test's runtime once the count stops changing, e.g.
+/// after roster snapshots still on their way have gone out.
+async fn settled_task_count() -> usize {
+    let metrics = tokio::runtime::Handle::current().metrics();
+    let mut last = metrics.num_alive_tasks();
+    for _ in 0..50 {
+        tokio::time::sleep(Duration::from_millis(100)).await;
+        let now = metrics.num_alive_tasks();
+        if now == last {
+            break;
+        }
+        last = now;
+    }
+    last
+}
+
+/// Connects and disconnects in one of the ways a connection ends: a clean
+/// `leave`, or the client going away, joined or not.
+async fn come_and_go(addr: std::net::SocketAddr, n: usize) {
+    match n % 3 {
+        0 => {
+            let mut client = Client::join(addr, &format!("cycler{n}")).await;
+            client.send(&ClientMessage::Leave).await;
+            // read until the server closes its end
+            timeout(REPLY_TIMEOUT, async {
+                while let Ok(Some(_)) = client.lines.next_line().await {}
+            })
+            .await
+            .unwrap();
+        }
+        1 => drop(Client::join(addr, &format!("cycler{n}")).await),
+        _ => drop(TcpStream::connect(addr).await.unwrap()),
+    }
+}
+
+#[tokio::test]
+async fn test_connections_leave_no_tasks() {
+    let config = Config {
+        shutdown_grace: Duration::ZERO,
+        // no session held for a rejoin, which would keep a task of its own
+        session_grace: Duration::ZERO,
+        ..Config::default()
+    };
+    let (running, stop) = support::start(config).await;
+    let addr = running.local_addr().unwrap();
+
+    // one of each first, so whatever the server starts only once is running
+    for n in 0..3 {
+        come_and_go(addr, n).await;
+    }
+    let before = settled_task_count().await;
+    for n in 3..103 {
+        come_and_go(addr, n).await;
+    }
+    let after = timeout(Duration::from_secs(10), async {
+        loop {
+            let now = settled_task_count().await;
+            if now <= before {
+                return now;
+            }
+        }
+    })
+    .await;
+    assert!(
+        after.is_ok(),
+        "{} tasks alive after 100 connections came and went, {before} before",
+        tokio::runtime::Handle::current().metrics().num_alive_tasks()
+    );
+
+    stop.send(()).unwrap();
+    timeout(REPLY_TIMEOUT, running.stopped()).await.unwrap();
+}
@@ -0,0 +1,45 @@
+//! Checks that lines ending in CRLF, as a Windows client sends them, read
+//! like lines ending in LF.
+
+#![allow(clippy::unwrap_used)]
+
+mod support;
+
+use std::time::Duration;
+
+use common::{error_code::ErrorCode, tcp_message::ServerMessage};
+use server::Config;
+use support::{Client, REPLY_TIMEOUT};
+use tokio::time::timeout;
+
+#[tokio::test]
+async fn test_crlf_lines() {
+    let config = Config {
+        shutdown_grace: Duration::ZERO,
+        ..Config::default()
+    };
+    let (running, stop) = support::start(config).await;
+    let addr = running.local_addr().unwrap();
+
+    let mut winnie = Client::join(addr, "winnie").await;
+    // a Windows client ends its lines with CRLF
+    let mut windows_winnie = Client::raw(addr, b"JOIN|winnie\r\n").await;
+    let refused = windows_winnie
+        .expect(|msg| matches!(msg, ServerMessage::Ok | ServerMessage::Err { .. }))
+        .await;
+    assert!(matches!(
+        refused,
+        ServerMessage::Err { code, reason } if code == ErrorCode::NAME_TAKEN && reason == "username 'winnie' is already taken"
+    ));
+
+    let mut wanda = Client::raw(addr, b"JOIN|wanda\r\nSEND|hi winnie\r\n").await;
+    wanda.expect(|msg| matches!(msg, ServerMessage::Ok)).await;
+    let heard = winnie
+        .expect(|msg| matches!(msg, ServerMessage::Broadcast { .. }))
+        .await;
+    assert!(matches!(heard, ServerMessage::Broadcast { username, message, .. }
+        if username == "wanda" && message == "hi winnie"));
+
+    stop.send(()).unwrap();
+    timeout(REPLY_TIMEOUT, running.stopped()).await.unwrap();
+}
@@ -0,0 +1,44 @@
+//! Runs the server with a frozen clock and checks that the time it was
+//! frozen at is what a broadcast carries.
+
+#![allow(clippy::unwrap_used)]
+
+mod support;
+
+use std::time::Duration;
+
+use common::tcp_message::{ClientMessage, ServerMessage};
+use jiff::Timestamp;
+use server::{Config, FixedClock, Server};
+use support::{Client, REPLY_TIMEOUT};
+use tokio::time::timeout;
+
+#[tokio::test]
+async fn test_broadcast_carries_the_frozen_time() {
+    let config = Config {
+        port: 0,
+        shutdown_grace: Duration::ZERO,
+        ..Config::default()
+    };
+    let frozen = FixedClock(Timestamp::from_second(1_704_207_845).unwrap());
+    let (running, stop) = support::serve(Server::new(config).with_clock(frozen)).await;
+    let addr = running.local_addr().unwrap();
+
+    let mut fiona = Client::join(addr, "fiona").await;
+    let mut frank = Client::join(addr, "frank").await;
+    fiona
+        .expect(|msg| matches!(msg, ServerMessage::UserJoined { username, .. } if username == "frank"))
+        .await;
+    fiona
+        .send(&ClientMessage::Send {
+            id: None,
+            message: "what time is it".to_string(),
+        })
+        .await;
+    let heard = frank.expect(|msg| matches!(msg, ServerMessage::Broadcast { .. })).await;
+    assert!(matches!(heard, ServerMessage::Broadcast { timestamp, username, .. }
+        if timestamp == "2024-01-02T15:04:05Z" && username == "fiona"));
+
+    stop.send(()).unwrap();
+    timeout(REPLY_TIMEOUT, running.stopped()).await.unwrap();
+}
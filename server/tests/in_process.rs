@@ -0,0 +1,44 @@
+//! Runs the server in-process on an ephemeral port and talks to it over TCP
+//! with the protocol types from `common`.
+
+#![allow(clippy::unwrap_used)]
+
+mod support;
+
+use std::time::Duration;
+
+use common::tcp_message::{ClientMessage, ServerMessage};
+use server::Config;
+use support::{Client, REPLY_TIMEOUT};
+use tokio::time::timeout;
+
+#[tokio::test]
+async fn test_chat_in_process() {
+    let config = Config {
+        shutdown_grace: Duration::ZERO,
+        ..Config::default()
+    };
+    let (running, stop) = support::start(config).await;
+    let addr = running.local_addr().unwrap();
+    assert_ne!(addr.port(), 0);
+
+    let mut alice = Client::join(addr, "alice").await;
+    let mut bob = Client::join(addr, "bob").await;
+    alice
+        .expect(|msg| matches!(msg, ServerMessage::UserJoined { username, .. } if username == "bob"))
+        .await;
+    alice
+        .send(&ClientMessage::Send {
+            id: None,
+            message: "hello bob".to_string(),
+        })
+        .await;
+    let heard = bob.expect(|msg| matches!(msg, ServerMessage::Broadcast { .. })).await;
+    assert!(matches!(heard, ServerMessage::Broadcast { username, message, .. }
+        if username == "alice" && message == "hello bob"));
+
+    stop.send(()).unwrap();
+    bob.expect(|msg| matches!(msg, ServerMessage::ShuttingDown { .. }))
+        .await;
+    timeout(REPLY_TIMEOUT, running.stopped()).await.unwrap();
+}
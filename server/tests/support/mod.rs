@@ -0,0 +1,96 @@
+//! What the in-process tests share: a server started with a given
+//! configuration, and a client that speaks the text protocol to it.
+//!
+//! The user registry, rooms and configuration are process-wide, so each test
+//! that starts a server is a test binary of its own.
+
+#![allow(dead_code)]
+
+use std::time::Duration;
+
+use common::tcp_message::{ClientMessage, ServerMessage, WireDecode, WireEncode};
+use server::{Config, Running, Server};
+use tokio::{
+    io::{AsyncBufReadExt, AsyncWriteExt, BufReader, Lines},
+    net::{
+        TcpStream,
+        tcp::{OwnedReadHalf, OwnedWriteHalf},
+    },
+    sync::oneshot,
+    time::timeout,
+};
+
+pub const REPLY_TIMEOUT: Duration = Duration::from_secs(5);
+
+pub struct Client {
+    pub lines: Lines<BufReader<OwnedReadHalf>>,
+    writer: OwnedWriteHalf,
+}
+
+impl Client {
+    pub async fn join(addr: std::net::SocketAddr, username: &str) -> Self {
+        let (reader, writer) = TcpStream::connect(addr).await.unwrap().into_split();
+        let mut client = Self {
+            lines: BufReader::new(reader).lines(),
+            writer,
+        };
+        client
+            .send(&ClientMessage::Join {
+                username: username.to_string(),
+                password: None,
+            })
+            .await;
+        client.expect(|msg| matches!(msg, ServerMessage::Ok)).await;
+        client
+    }
+
+    /// Connects and writes `raw` as is, line ending and all.
+    pub async fn raw(addr: std::net::SocketAddr, raw: &[u8]) -> Self {
+        let (reader, mut writer) = TcpStream::connect(addr).await.unwrap().into_split();
+        writer.write_all(raw).await.unwrap();
+        Self {
+            lines: BufReader::new(reader).lines(),
+            writer,
+        }
+    }
+
+    pub async fn send(&mut self, msg: &ClientMessage) {
+        let mut line = msg.encode();
+        line.push(b'\n');
+        self.writer.write_all(&line).await.unwrap();
+    }
+
+    /// Reads until a message `wanted` accepts, and returns it.
+    pub async fn expect(&mut self, wanted: fn(&ServerMessage) -> bool) -> ServerMessage {
+        timeout(REPLY_TIMEOUT, async {
+            loop {
+                let line = self.lines.next_line().await.unwrap().unwrap();
+                if let Ok(msg) = ServerMessage::decode(line.as_bytes())
+                    && wanted(&msg)
+                {
+                    return msg;
+                }
+            }
+        })
+        .await
+        .unwrap()
+    }
+}
+
+/// Starts a server on an ephemeral port with `config`, returning it and what
+/// stops it.
+pub async fn start(config: Config) -> (Running, oneshot::Sender<()>) {
+    serve(Server::new(Config { port: 0, ..config })).await
+}
+
+/// Starts `server`, returning it running and what stops it.
+pub async fn serve(server: Server) -> (Running, oneshot::Sender<()>) {
+    let (stop, stopped) = oneshot::channel::<()>();
+    let running = server
+        .start(async {
+            let _ = stopped.await;
+        })
+        .await
+        .unwrap();
+    (running, stop)
+}